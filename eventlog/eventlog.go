@@ -0,0 +1,144 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package eventlog records the agent's notable events with stable IDs grouped
+// by subsystem. On Windows every subsystem has its own Event Log source, so
+// admins can filter and alert on specific agent behaviors.
+package eventlog
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+// Subsystem is an agent subsystem with its own event source.
+type Subsystem string
+
+const (
+	// Network is the network setup subsystem.
+	Network Subsystem = "Network"
+	// Accounts is the accounts management subsystem.
+	Accounts Subsystem = "Accounts"
+	// Scripts is the metadata scripts subsystem.
+	Scripts Subsystem = "Scripts"
+	// Shutdown is the agent and instance shutdown subsystem.
+	Shutdown Subsystem = "Shutdown"
+	// Watchdog is the agent's service recovery and watchdog subsystem.
+	Watchdog Subsystem = "Watchdog"
+)
+
+// Subsystems are all the subsystems, in event ID order.
+var Subsystems = []Subsystem{Network, Accounts, Scripts, Shutdown, Watchdog}
+
+// ID is an event ID. The IDs of a subsystem are in their own range of 100,
+// within the 1-1000 range of the EventCreate message file registered for the
+// sources.
+type ID uint32
+
+// Network events.
+const (
+	InterfaceAdded ID = 100 + iota
+	InterfaceRemoved
+	InterfaceSetupFailed
+	RoutesUpdated
+	RouteUpdateFailed
+)
+
+// Accounts events.
+const (
+	UserCreated ID = 200 + iota
+	PasswordReset
+	PasswordResetFailed
+)
+
+// Scripts events.
+const (
+	ScriptStarted ID = 300 + iota
+	ScriptSucceeded
+	ScriptFailed
+)
+
+// Shutdown events.
+const (
+	AgentStopped ID = 400 + iota
+	ShutdownScriptStarted
+	ShutdownScriptSucceeded
+	ShutdownScriptFailed
+)
+
+// Watchdog events.
+const (
+	ServiceRecoveryConfigured ID = 500 + iota
+	ServiceRecoveryFailed
+	SubsystemRestarted
+	AgentRestarting
+)
+
+// Subsystem returns the subsystem the event belongs to.
+func (id ID) Subsystem() Subsystem {
+	i := int(id)/100 - 1
+	if i < 0 || i >= len(Subsystems) {
+		return ""
+	}
+	return Subsystems[i]
+}
+
+// sourcePrefix prefixes the subsystems' event sources, shared by the agent
+// and the metadata script runner.
+const sourcePrefix = "GCEGuestAgent-"
+
+// Source returns the event source of the subsystem, e.g. GCEGuestAgent-Network.
+func (s Subsystem) Source() string {
+	return sourcePrefix + string(s)
+}
+
+// Init registers and opens the event sources of the subsystems.
+func Init() error {
+	return localSetup()
+}
+
+// Close closes the event sources.
+func Close() {
+	localClose()
+}
+
+// Infof logs an information event.
+func Infof(id ID, format string, v ...any) {
+	log(id, logger.Info, fmt.Sprintf(format, v...))
+}
+
+// Warningf logs a warning event.
+func Warningf(id ID, format string, v ...any) {
+	log(id, logger.Warning, fmt.Sprintf(format, v...))
+}
+
+// Errorf logs an error event.
+func Errorf(id ID, format string, v ...any) {
+	log(id, logger.Error, fmt.Sprintf(format, v...))
+}
+
+// log logs the event with the logger, labeled with its ID and subsystem, and
+// writes it to its subsystem's event source.
+func log(id ID, severity logger.Severity, msg string) {
+	logger.Log(logger.LogEntry{
+		Message:  msg,
+		Severity: severity,
+		// Report the caller of Infof, Warningf or Errorf as the source.
+		CallDepth: 4,
+		Labels:    map[string]string{"event_id": strconv.Itoa(int(id)), "subsystem": string(id.Subsystem())},
+	})
+	localWrite(id, severity, msg)
+}
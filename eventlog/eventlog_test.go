@@ -0,0 +1,47 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eventlog
+
+import "testing"
+
+func TestSubsystem(t *testing.T) {
+	tests := []struct {
+		ids  []ID
+		want Subsystem
+	}{
+		{ids: []ID{InterfaceAdded, InterfaceRemoved, InterfaceSetupFailed, RoutesUpdated, RouteUpdateFailed}, want: Network},
+		{ids: []ID{UserCreated, PasswordReset, PasswordResetFailed}, want: Accounts},
+		{ids: []ID{ScriptStarted, ScriptSucceeded, ScriptFailed}, want: Scripts},
+		{ids: []ID{AgentStopped, ShutdownScriptStarted, ShutdownScriptSucceeded, ShutdownScriptFailed}, want: Shutdown},
+		{ids: []ID{ServiceRecoveryConfigured, ServiceRecoveryFailed, SubsystemRestarted, AgentRestarting}, want: Watchdog},
+		{ids: []ID{0, 99, 600, 1000}, want: ""},
+	}
+
+	for _, tc := range tests {
+		for _, id := range tc.ids {
+			if got := id.Subsystem(); got != tc.want {
+				t.Errorf("ID(%d).Subsystem() = %q, want %q", id, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestSource(t *testing.T) {
+	for _, s := range Subsystems {
+		if got, want := s.Source(), "GCEGuestAgent-"+string(s); got != want {
+			t.Errorf("%s.Source() = %q, want %q", s, got, want)
+		}
+	}
+}
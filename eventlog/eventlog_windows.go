@@ -0,0 +1,82 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package eventlog
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+var (
+	// sources are the open event sources of the subsystems.
+	sources = make(map[Subsystem]*eventlog.Log)
+	// sourcesMu protects sources.
+	sourcesMu sync.RWMutex
+)
+
+func localSetup() error {
+	sourcesMu.Lock()
+	defer sourcesMu.Unlock()
+
+	for _, s := range Subsystems {
+		if _, ok := sources[s]; ok {
+			continue
+		}
+		name := s.Source()
+		err := eventlog.InstallAsEventCreate(name, eventlog.Info|eventlog.Warning|eventlog.Error)
+		if err != nil && !strings.Contains(err.Error(), "registry key already exists") {
+			return err
+		}
+		el, err := eventlog.Open(name)
+		if err != nil {
+			return err
+		}
+		sources[s] = el
+	}
+	return nil
+}
+
+func localClose() {
+	sourcesMu.Lock()
+	defer sourcesMu.Unlock()
+
+	for s, el := range sources {
+		el.Close()
+		delete(sources, s)
+	}
+}
+
+func localWrite(id ID, severity logger.Severity, msg string) {
+	sourcesMu.RLock()
+	defer sourcesMu.RUnlock()
+
+	el, ok := sources[id.Subsystem()]
+	if !ok {
+		return
+	}
+	switch severity {
+	case logger.Warning:
+		el.Warning(uint32(id), msg)
+	case logger.Error, logger.Critical:
+		el.Error(uint32(id), msg)
+	default:
+		el.Info(uint32(id), msg)
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/utils"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+var (
+	// cacheDir is the directory caching the metadata keys served to sshd, one
+	// file per user. Overridden in tests.
+	cacheDir = defaultCacheDir()
+	// decisionCacheDir is the directory caching the OS Login authorization
+	// decisions, one file per authorized user. Overridden in tests.
+	decisionCacheDir = defaultDecisionCacheDir()
+)
+
+// defaultCacheDir returns the OS specific keys cache directory.
+func defaultCacheDir() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("ProgramData"), "Google", "Compute Engine", "authorized_keys_cache")
+	}
+	return "/var/lib/google-guest-agent/authorized_keys_cache"
+}
+
+// defaultDecisionCacheDir returns the OS specific OS Login decisions cache
+// directory.
+func defaultDecisionCacheDir() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("ProgramData"), "Google", "Compute Engine", "oslogin_decision_cache")
+	}
+	return "/var/lib/google-guest-agent/oslogin_decision_cache"
+}
+
+// cacheMaxStaleness returns the configured maximum age of the cached keys, 0
+// if the cache is disabled or the configuration couldn't be loaded.
+func cacheMaxStaleness(config *cfg.Sections) time.Duration {
+	if config == nil || config.Accounts.AuthorizedKeysCacheMaxStaleness == "" {
+		return 0
+	}
+	staleness, err := time.ParseDuration(config.Accounts.AuthorizedKeysCacheMaxStaleness)
+	if err != nil {
+		logger.Errorf("authorized_keys_cache_max_staleness configuration is not a valid duration string, disabling the cache")
+		return 0
+	}
+	return staleness
+}
+
+// cachePath returns the path of username's cache file in dir.
+func cachePath(dir, username string) (string, error) {
+	if username == "." || username == ".." || strings.ContainsAny(username, `/\`) {
+		return "", fmt.Errorf("invalid username %q", username)
+	}
+	return filepath.Join(dir, username), nil
+}
+
+// writeCacheFile atomically replaces username's cache file in dir with data.
+func writeCacheFile(dir, username string, data []byte) error {
+	fpath, err := cachePath(dir, username)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	tmp := fpath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write cache file: %w", err)
+	}
+	if err := os.Rename(tmp, fpath); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write cache file: %w", err)
+	}
+	return nil
+}
+
+// readCacheFile returns the content of username's cache file in dir if it was
+// written less than maxStaleness ago.
+func readCacheFile(dir, username string, maxStaleness time.Duration, now time.Time) ([]byte, error) {
+	fpath, err := cachePath(dir, username)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(fpath)
+	if err != nil {
+		return nil, fmt.Errorf("nothing cached for %s: %w", username, err)
+	}
+	if age := now.Sub(info.ModTime()); age > maxStaleness {
+		return nil, fmt.Errorf("cache of %s is stale, recorded %s ago", username, age.Round(time.Second))
+	}
+
+	data, err := os.ReadFile(fpath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache file: %w", err)
+	}
+	return data, nil
+}
+
+// removeCacheFile removes username's cache file in dir, if any.
+func removeCacheFile(dir, username string) error {
+	fpath, err := cachePath(dir, username)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(fpath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// writeCachedKeys records the keys served for username.
+func writeCachedKeys(username string, keys []string) error {
+	return writeCacheFile(cacheDir, username, []byte(strings.Join(keys, "\n")))
+}
+
+// readCachedKeys returns the keys cached for username if they were recorded
+// less than maxStaleness ago. Keys expired since are dropped.
+func readCachedKeys(username string, maxStaleness time.Duration, now time.Time) ([]string, error) {
+	data, err := readCacheFile(cacheDir, username, maxStaleness, now)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, key := range strings.Split(string(data), "\n") {
+		if key == "" || utils.CheckExpiredKey(key) != nil {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/utils"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCacheMaxStaleness(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+	orig := config.Accounts.AuthorizedKeysCacheMaxStaleness
+	t.Cleanup(func() { config.Accounts.AuthorizedKeysCacheMaxStaleness = orig })
+
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"0", 0},
+		{"", 0},
+		{"invalid", 0},
+		{"15m", 15 * time.Minute},
+	}
+	for _, tc := range tests {
+		config.Accounts.AuthorizedKeysCacheMaxStaleness = tc.value
+		if got := cacheMaxStaleness(config); got != tc.want {
+			t.Errorf("cacheMaxStaleness() = %v with %q, want %v", got, tc.value, tc.want)
+		}
+	}
+	if got := cacheMaxStaleness(nil); got != 0 {
+		t.Errorf("cacheMaxStaleness(nil) = %v, want 0", got)
+	}
+}
+
+func TestCachedKeys(t *testing.T) {
+	origDir := cacheDir
+	t.Cleanup(func() { cacheDir = origDir })
+	cacheDir = filepath.Join(t.TempDir(), "cache")
+
+	key := "ssh-rsa " + utils.MakeRandRSAPubKey(t) + " user"
+	expired := "ssh-rsa " + utils.MakeRandRSAPubKey(t) + ` google-ssh {"userName":"user@example.com","expireOn":"2020-01-01T00:00:00+0000"}`
+	if err := writeCachedKeys("user", []string{key, expired}); err != nil {
+		t.Fatalf("writeCachedKeys() failed unexpectedly with error: %v", err)
+	}
+
+	now := time.Now()
+	got, err := readCachedKeys("user", time.Hour, now)
+	if err != nil {
+		t.Fatalf("readCachedKeys() failed unexpectedly with error: %v", err)
+	}
+	if diff := cmp.Diff([]string{key}, got); diff != "" {
+		t.Errorf("readCachedKeys() returned unexpected diff (-want +got):\n%s", diff)
+	}
+
+	if _, err := readCachedKeys("user", time.Hour, now.Add(2*time.Hour)); err == nil {
+		t.Errorf("readCachedKeys() succeeded with stale keys, want error")
+	}
+	if _, err := readCachedKeys("other", time.Hour, now); err == nil {
+		t.Errorf("readCachedKeys() succeeded without cached keys, want error")
+	}
+
+	for _, user := range []string{"..", "../user", `a\b`} {
+		if err := writeCachedKeys(user, []string{key}); err == nil {
+			t.Errorf("writeCachedKeys(%q) succeeded, want error", user)
+		}
+	}
+
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		t.Fatalf("os.ReadDir() failed unexpectedly with error: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("cache directory has %d entries, want 1", len(entries))
+	}
+}
@@ -18,6 +18,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -27,6 +28,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
 	"github.com/GoogleCloudPlatform/guest-agent/metadata"
 	"github.com/GoogleCloudPlatform/guest-agent/utils"
 	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
@@ -61,17 +63,17 @@ func parseSSHKeys(username string, keys []string) []string {
 		}
 
 		user, keyVal, err := utils.GetUserKey(key)
-		if err == nil {
-			err = utils.ValidateUserKey(user, keyVal)
-		}
-
-		if err != nil {
+		if err != nil || user != username {
 			continue
 		}
 
-		if user == username {
-			keyList = append(keyList, keyVal)
+		if err := utils.ValidateUserKey(user, keyVal); err != nil {
+			if !errors.Is(err, utils.ErrExpiredKey) {
+				logger.Warningf("Skipping SSH key of %s: %v", user, err)
+			}
+			continue
 		}
+		keyList = append(keyList, keyVal)
 	}
 	return keyList
 }
@@ -102,6 +104,7 @@ func checkWinSSHEnabled(instanceAttributes *attributes, projectAttributes *attri
 }
 
 type attributes struct {
+	EnableOSLogin       *bool
 	EnableWindowsSSH    *bool
 	BlockProjectSSHKeys bool
 	SSHKeys             []string
@@ -110,6 +113,7 @@ type attributes struct {
 func getMetadataAttributes(ctx context.Context, metadataKey string) (*attributes, error) {
 	var a attributes
 	type jsonAttributes struct {
+		EnableOSLogin       string `json:"enable-oslogin"`
 		EnableWindowsSSH    string `json:"enable-windows-ssh"`
 		BlockProjectSSHKeys string `json:"block-project-ssh-keys"`
 		SSHKeys             string `json:"ssh-keys"`
@@ -133,6 +137,10 @@ func getMetadataAttributes(ctx context.Context, metadataKey string) (*attributes
 	if err == nil {
 		a.EnableWindowsSSH = &value
 	}
+
+	if value, err := strconv.ParseBool(ja.EnableOSLogin); err == nil {
+		a.EnableOSLogin = &value
+	}
 	if ja.SSHKeys != "" {
 		a.SSHKeys = strings.Split(ja.SSHKeys, "\n")
 	}
@@ -165,15 +173,23 @@ func main() {
 	// Try flushing logs before exiting, if not flushed logs could go missing.
 	defer logger.Close()
 
+	var config *cfg.Sections
+	if err := cfg.Load(nil); err != nil {
+		logger.Warningf("Failed to load instance configuration, keys cache disabled: %v", err)
+	} else {
+		config = cfg.Get()
+	}
+	maxStaleness := cacheMaxStaleness(config)
+
 	instanceAttributes, err := getMetadataAttributes(ctx, "instance/attributes/")
 	if err != nil {
 		logger.Errorf("Cannot read instance metadata attributes: %v", err)
-		os.Exit(1)
+		serveCachedKeys(username, maxStaleness)
 	}
 	projectAttributes, err := getMetadataAttributes(ctx, "project/attributes/")
 	if err != nil {
 		logger.Errorf("Cannot read project metadata attributes: %v", err)
-		os.Exit(1)
+		serveCachedKeys(username, maxStaleness)
 	}
 
 	if runtime.GOOS == "windows" && !checkWinSSHEnabled(instanceAttributes, projectAttributes) {
@@ -181,6 +197,72 @@ func main() {
 		os.Exit(1)
 	}
 
+	if osloginEnabled(instanceAttributes, projectAttributes) {
+		serveOSLoginKeys(ctx, username, maxStaleness)
+		return
+	}
+	// The keys of a user authorized while OS Login was enabled must not be
+	// served anymore.
+	if err := removeCacheFile(decisionCacheDir, username); err != nil {
+		logger.Warningf("Failed to remove cached OS Login decision of %s: %v", username, err)
+	}
+
 	userKeyList := getUserKeys(username, instanceAttributes, projectAttributes)
+	if maxStaleness > 0 {
+		if err := writeCachedKeys(username, userKeyList); err != nil {
+			logger.Warningf("Failed to cache keys of %s: %v", username, err)
+		}
+	}
 	fmt.Print(strings.Join(userKeyList, "\n"))
 }
+
+// serveOSLoginKeys prints the OS Login keys of username if it's authorized to
+// log in. The authorization is cached, a denial invalidates it and the cached
+// decision is served if the metadata server can't be reached.
+func serveOSLoginKeys(ctx context.Context, username string, maxStaleness time.Duration) {
+	keys, err := getOSLoginKeys(ctx, username)
+	if errors.Is(err, errOSLoginDenied) {
+		logger.Infof("%s is not authorized by OS Login.", username)
+		if err := removeCacheFile(decisionCacheDir, username); err != nil {
+			logger.Warningf("Failed to remove cached OS Login decision of %s: %v", username, err)
+		}
+		return
+	}
+	if err != nil {
+		logger.Errorf("Cannot get OS Login keys: %v", err)
+		serveCachedKeys(username, maxStaleness)
+	}
+
+	if maxStaleness > 0 {
+		if err := writeCachedDecision(username, keys); err != nil {
+			logger.Warningf("Failed to cache OS Login decision of %s: %v", username, err)
+		}
+	}
+	// Metadata keys are ignored with OS Login enabled.
+	if err := removeCacheFile(cacheDir, username); err != nil {
+		logger.Warningf("Failed to remove cached keys of %s: %v", username, err)
+	}
+	fmt.Print(strings.Join(activeKeys(keys, time.Now()), "\n"))
+}
+
+// serveCachedKeys prints the cached keys of username and exits, the metadata
+// server being unreachable. The cached OS Login decision is served if there's
+// one, the cached metadata keys otherwise. It exits with failure if the cache
+// is disabled or has no fresh enough keys.
+func serveCachedKeys(username string, maxStaleness time.Duration) {
+	if maxStaleness <= 0 {
+		os.Exit(1)
+	}
+	keys, err := readCachedDecision(username, maxStaleness, time.Now())
+	if err != nil {
+		keys, err = readCachedKeys(username, maxStaleness, time.Now())
+	}
+	if err != nil {
+		logger.Errorf("Cannot serve cached keys: %v", err)
+		os.Exit(1)
+	}
+	logger.Warningf("Serving cached keys of %s, metadata server unreachable.", username)
+	fmt.Print(strings.Join(keys, "\n"))
+	logger.Close()
+	os.Exit(0)
+}
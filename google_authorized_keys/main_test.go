@@ -286,6 +286,10 @@ func (mds *mdsClient) Watch(ctx context.Context) (*metadata.Descriptor, error) {
 	return nil, fmt.Errorf("Watch() not yet implemented")
 }
 
+func (mds *mdsClient) WatchKey(ctx context.Context, key string) (string, error) {
+	return "", fmt.Errorf("WatchKey() not yet implemented")
+}
+
 func (mds *mdsClient) WriteGuestAttributes(ctx context.Context, key string, value string) error {
 	return fmt.Errorf("WriteGuestattributes() not yet implemented")
 }
@@ -0,0 +1,169 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+)
+
+const (
+	// osloginUsersKey is the metadata key of the OS Login user lookup.
+	osloginUsersKey = "oslogin/users"
+	// osloginAuthorizeKey is the metadata key of the OS Login authorization
+	// check.
+	osloginAuthorizeKey = "oslogin/authorize"
+)
+
+// errOSLoginDenied is returned when OS Login doesn't know the user or doesn't
+// authorize it to log in.
+var errOSLoginDenied = errors.New("not authorized by OS Login")
+
+// osloginKey is an OS Login SSH public key.
+type osloginKey struct {
+	Key string `json:"key"`
+	// ExpirationTimeUsec is the key's expiration time in microseconds since
+	// the epoch, empty if the key doesn't expire.
+	ExpirationTimeUsec string `json:"expirationTimeUsec,omitempty"`
+}
+
+// expired returns true if the key expired before now.
+func (k osloginKey) expired(now time.Time) bool {
+	if k.ExpirationTimeUsec == "" {
+		return false
+	}
+	usec, err := strconv.ParseInt(k.ExpirationTimeUsec, 10, 64)
+	if err != nil {
+		return true
+	}
+	return now.After(time.UnixMicro(usec))
+}
+
+// osloginProfiles is the response of the OS Login user lookup.
+type osloginProfiles struct {
+	LoginProfiles []struct {
+		Name          string                `json:"name"`
+		SSHPublicKeys map[string]osloginKey `json:"sshPublicKeys"`
+	} `json:"loginProfiles"`
+}
+
+// isNotFound returns true if err is a metadata server 404 response.
+func isNotFound(err error) bool {
+	var mdsErr *metadata.MDSReqError
+	return errors.As(err, &mdsErr) && mdsErr.Status() == http.StatusNotFound
+}
+
+// osloginEnabled returns true if OS Login is enabled, the instance attribute
+// taking precedence over the project one.
+func osloginEnabled(instanceAttributes *attributes, projectAttributes *attributes) bool {
+	if instanceAttributes.EnableOSLogin != nil {
+		return *instanceAttributes.EnableOSLogin
+	}
+	if projectAttributes.EnableOSLogin != nil {
+		return *projectAttributes.EnableOSLogin
+	}
+	return false
+}
+
+// getOSLoginKeys returns the SSH keys of username if OS Login authorizes it to
+// log in, errOSLoginDenied if it doesn't.
+func getOSLoginKeys(ctx context.Context, username string) ([]osloginKey, error) {
+	resp, err := client.GetKey(ctx, osloginUsersKey+"?username="+url.QueryEscape(username), nil)
+	if isNotFound(err) {
+		return nil, errOSLoginDenied
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up OS Login user %s: %w", username, err)
+	}
+	var profiles osloginProfiles
+	if err := json.Unmarshal([]byte(resp), &profiles); err != nil {
+		return nil, fmt.Errorf("failed to parse OS Login user %s: %w", username, err)
+	}
+	if len(profiles.LoginProfiles) == 0 {
+		return nil, errOSLoginDenied
+	}
+	profile := profiles.LoginProfiles[0]
+
+	resp, err = client.GetKey(ctx, osloginAuthorizeKey+"?email="+url.QueryEscape(profile.Name)+"&policy=login", nil)
+	if isNotFound(err) {
+		return nil, errOSLoginDenied
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to authorize OS Login user %s: %w", username, err)
+	}
+	var auth struct {
+		Success bool `json:"success"`
+	}
+	if err := json.Unmarshal([]byte(resp), &auth); err != nil {
+		return nil, fmt.Errorf("failed to parse OS Login authorization of %s: %w", username, err)
+	}
+	if !auth.Success {
+		return nil, errOSLoginDenied
+	}
+
+	var fingerprints []string
+	for fingerprint := range profile.SSHPublicKeys {
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	sort.Strings(fingerprints)
+	var keys []osloginKey
+	for _, fingerprint := range fingerprints {
+		keys = append(keys, profile.SSHPublicKeys[fingerprint])
+	}
+	return keys, nil
+}
+
+// activeKeys returns the keys not expired at now.
+func activeKeys(keys []osloginKey, now time.Time) []string {
+	var res []string
+	for _, key := range keys {
+		if key.Key != "" && !key.expired(now) {
+			res = append(res, key.Key)
+		}
+	}
+	return res
+}
+
+// writeCachedDecision records that OS Login authorized username with keys.
+func writeCachedDecision(username string, keys []osloginKey) error {
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	return writeCacheFile(decisionCacheDir, username, data)
+}
+
+// readCachedDecision returns the keys of username if OS Login authorized it
+// less than maxStaleness ago. Keys expired since are dropped.
+func readCachedDecision(username string, maxStaleness time.Duration, now time.Time) ([]string, error) {
+	data, err := readCacheFile(decisionCacheDir, username, maxStaleness, now)
+	if err != nil {
+		return nil, err
+	}
+	var keys []osloginKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("failed to parse cached OS Login decision of %s: %w", username, err)
+	}
+	return activeKeys(keys, now), nil
+}
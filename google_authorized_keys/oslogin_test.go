@@ -0,0 +1,178 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/google/go-cmp/cmp"
+)
+
+// osloginMDSClient serves the OS Login responses by key, the keys without a
+// response fail with err.
+type osloginMDSClient struct {
+	mdsClient
+	responses map[string]string
+	err       error
+}
+
+func (c *osloginMDSClient) GetKey(ctx context.Context, key string, headers map[string]string) (string, error) {
+	resp, ok := c.responses[key]
+	if !ok {
+		return "", c.err
+	}
+	return resp, nil
+}
+
+func TestGetOSLoginKeys(t *testing.T) {
+	origClient := client
+	t.Cleanup(func() { client = origClient })
+
+	profile := `{"loginProfiles":[{"name":"123","sshPublicKeys":{"b":{"key":"ssh-rsa B"},"a":{"key":"ssh-rsa A","expirationTimeUsec":"1"}}}]}`
+	notFound := fmt.Errorf("exhausted all (1) retries, last error: %w", metadata.NewMDSReqError(404, fmt.Errorf("not found")))
+	unreachable := metadata.NewMDSReqError(-1, fmt.Errorf("connection refused"))
+
+	tests := []struct {
+		name      string
+		responses map[string]string
+		err       error
+		want      []osloginKey
+		wantErr   error
+	}{
+		{
+			name: "authorized",
+			responses: map[string]string{
+				"oslogin/users?username=user":              profile,
+				"oslogin/authorize?email=123&policy=login": `{"success":true}`,
+			},
+			want: []osloginKey{{Key: "ssh-rsa A", ExpirationTimeUsec: "1"}, {Key: "ssh-rsa B"}},
+		},
+		{
+			name: "not_authorized",
+			responses: map[string]string{
+				"oslogin/users?username=user":              profile,
+				"oslogin/authorize?email=123&policy=login": `{"success":false}`,
+			},
+			wantErr: errOSLoginDenied,
+		},
+		{
+			name: "authorization_not_found",
+			responses: map[string]string{
+				"oslogin/users?username=user": profile,
+			},
+			err:     notFound,
+			wantErr: errOSLoginDenied,
+		},
+		{
+			name:    "unknown_user",
+			err:     notFound,
+			wantErr: errOSLoginDenied,
+		},
+		{
+			name: "no_profile",
+			responses: map[string]string{
+				"oslogin/users?username=user": `{"loginProfiles":[]}`,
+			},
+			wantErr: errOSLoginDenied,
+		},
+		{
+			name:    "unreachable",
+			err:     unreachable,
+			wantErr: unreachable,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client = &osloginMDSClient{responses: tc.responses, err: tc.err}
+			got, err := getOSLoginKeys(context.Background(), "user")
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("getOSLoginKeys() = %v, want error %v", err, tc.wantErr)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("getOSLoginKeys() returned unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestOSLoginEnabled(t *testing.T) {
+	tests := []struct {
+		instance, project *bool
+		want              bool
+	}{
+		{nil, nil, false},
+		{nil, truebool, true},
+		{falsebool, truebool, false},
+		{truebool, falsebool, true},
+	}
+	for _, tc := range tests {
+		got := osloginEnabled(&attributes{EnableOSLogin: tc.instance}, &attributes{EnableOSLogin: tc.project})
+		if got != tc.want {
+			t.Errorf("osloginEnabled(%s, %s) = %t, want %t", boolToStr(tc.instance), boolToStr(tc.project), got, tc.want)
+		}
+	}
+}
+
+func TestCachedDecision(t *testing.T) {
+	origDir := decisionCacheDir
+	t.Cleanup(func() { decisionCacheDir = origDir })
+	decisionCacheDir = filepath.Join(t.TempDir(), "decisions")
+
+	now := time.Now()
+	expiry := strconv.FormatInt(now.Add(time.Minute).UnixMicro(), 10)
+	keys := []osloginKey{{Key: "ssh-rsa A"}, {Key: "ssh-rsa B", ExpirationTimeUsec: expiry}}
+	if err := writeCachedDecision("user", keys); err != nil {
+		t.Fatalf("writeCachedDecision() failed unexpectedly with error: %v", err)
+	}
+
+	got, err := readCachedDecision("user", time.Hour, now)
+	if err != nil {
+		t.Fatalf("readCachedDecision() failed unexpectedly with error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"ssh-rsa A", "ssh-rsa B"}, got); diff != "" {
+		t.Errorf("readCachedDecision() returned unexpected diff (-want +got):\n%s", diff)
+	}
+
+	// Keys expired since the decision are dropped.
+	got, err = readCachedDecision("user", time.Hour, now.Add(2*time.Minute))
+	if err != nil {
+		t.Fatalf("readCachedDecision() failed unexpectedly with error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"ssh-rsa A"}, got); diff != "" {
+		t.Errorf("readCachedDecision() returned unexpected diff (-want +got):\n%s", diff)
+	}
+
+	if _, err := readCachedDecision("user", time.Hour, now.Add(2*time.Hour)); err == nil {
+		t.Errorf("readCachedDecision() succeeded with a stale decision, want error")
+	}
+
+	if err := removeCacheFile(decisionCacheDir, "user"); err != nil {
+		t.Fatalf("removeCacheFile() failed unexpectedly with error: %v", err)
+	}
+	if _, err := readCachedDecision("user", time.Hour, now); err == nil {
+		t.Errorf("readCachedDecision() succeeded after the decision was invalidated, want error")
+	}
+	if err := removeCacheFile(decisionCacheDir, "user"); err != nil {
+		t.Errorf("removeCacheFile() failed without a cached decision: %v", err)
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// accountsAuditFileName is the audit file name used when no audit_file is
+	// configured.
+	accountsAuditFileName = "accounts-audit.json"
+	// accountsAuditMaxSize is the size above which the audit file is rotated,
+	// the previous file is kept with a ".1" suffix.
+	accountsAuditMaxSize = 10 << 20
+
+	// auditUserAdd is recorded when a user is created.
+	auditUserAdd = "user-add"
+	// auditUserRemove is recorded when a user is deprovisioned.
+	auditUserRemove = "user-remove"
+	// auditKeyAdd is recorded when a key is added to a user.
+	auditKeyAdd = "key-add"
+	// auditKeyRemove is recorded when a key is removed from a user.
+	auditKeyRemove = "key-remove"
+	// auditSudoersUpdate is recorded when the google_sudoers file is written.
+	auditSudoersUpdate = "sudoers-update"
+	// auditPasswordReset is recorded when a Windows user's password is reset.
+	auditPasswordReset = "password-reset"
+
+	// auditSourceMetadata is the source of the changes driven by the metadata
+	// SSH keys.
+	auditSourceMetadata = "metadata"
+	// auditSourceBreakGlass is the source of the break-glass user changes.
+	auditSourceBreakGlass = "break-glass"
+	// auditSourceConfig is the source of the changes driven by the agent's
+	// configuration.
+	auditSourceConfig = "config"
+	// auditSourceWindowsKeys is the source of the changes driven by the
+	// windows-keys attribute.
+	auditSourceWindowsKeys = "windows-keys"
+)
+
+var (
+	// writeAccountAuditRecord writes an audit record to the local audit file
+	// and optionally Cloud Logging. Replaceable by unit tests.
+	writeAccountAuditRecord = defaultWriteAccountAuditRecord
+)
+
+// accountAuditRecord is the structured record of an account or key mutation.
+type accountAuditRecord struct {
+	// Time is when the mutation happened.
+	Time time.Time `json:"time"`
+	// Action is the kind of mutation, i.e. key-add.
+	Action string `json:"action"`
+	// User is the mutated user, empty for the sudoers changes.
+	User string `json:"user,omitempty"`
+	// KeyFingerprint is the SHA256 fingerprint of the added or removed key.
+	KeyFingerprint string `json:"keyFingerprint,omitempty"`
+	// Source is what drove the mutation, i.e. metadata.
+	Source string `json:"source"`
+	// MetadataETag is the etag of the metadata the mutation was based on.
+	MetadataETag string `json:"metadataEtag,omitempty"`
+}
+
+// auditAccount records an account mutation.
+func auditAccount(action, user, source string) {
+	writeAccountAuditRecord(&accountAuditRecord{
+		Time:         time.Now(),
+		Action:       action,
+		User:         user,
+		Source:       source,
+		MetadataETag: metadataETag(),
+	})
+}
+
+// auditKeyChanges records the keys added and removed from user's authorized
+// keys going from oldKeys to newKeys.
+func auditKeyChanges(user, source string, oldKeys, newKeys []string) {
+	added, removed := diffKeys(oldKeys, newKeys)
+	for _, key := range removed {
+		auditKey(auditKeyRemove, user, source, key)
+	}
+	for _, key := range added {
+		auditKey(auditKeyAdd, user, source, key)
+	}
+}
+
+// auditKey records a key mutation identified by the key's fingerprint.
+func auditKey(action, user, source, key string) {
+	writeAccountAuditRecord(&accountAuditRecord{
+		Time:           time.Now(),
+		Action:         action,
+		User:           user,
+		KeyFingerprint: keyFingerprint(key),
+		Source:         source,
+		MetadataETag:   metadataETag(),
+	})
+}
+
+// keyFingerprint returns the SHA256 fingerprint of an authorized key,
+// "invalid" if it can't be parsed.
+func keyFingerprint(key string) string {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+	if err != nil {
+		return "invalid"
+	}
+	return ssh.FingerprintSHA256(pub)
+}
+
+// metadataETag returns the etag of the last metadata seen, empty if unknown.
+func metadataETag() string {
+	if mdsClient == nil {
+		return ""
+	}
+	return mdsClient.ETag()
+}
+
+// accountsAuditFile returns the configured audit file path or the OS default
+// one.
+func accountsAuditFile() string {
+	if file := cfg.Get().Accounts.AuditFile; file != "" {
+		return file
+	}
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("ProgramData"), "Google", "Compute Engine", accountsAuditFileName)
+	}
+	return filepath.Join("/var/lib/google-guest-agent", accountsAuditFileName)
+}
+
+// appendAccountsAuditFile appends a JSON encoded record line to the audit file,
+// rotating it first if it would grow over accountsAuditMaxSize.
+func appendAccountsAuditFile(fpath string, line []byte) error {
+	if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		return fmt.Errorf("failed to create audit file directory: %w", err)
+	}
+
+	if fi, err := os.Stat(fpath); err == nil && fi.Size()+int64(len(line)) > accountsAuditMaxSize {
+		if err := os.Rename(fpath, fpath+".1"); err != nil {
+			return fmt.Errorf("failed to rotate audit file: %w", err)
+		}
+	}
+
+	f, err := os.OpenFile(fpath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(line); err != nil {
+		return fmt.Errorf("failed to write audit file: %w", err)
+	}
+	return nil
+}
+
+func defaultWriteAccountAuditRecord(record *accountAuditRecord) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		logger.Errorf("failed to marshal account audit record: %v", err)
+		return
+	}
+
+	if err := appendAccountsAuditFile(accountsAuditFile(), append(data, '\n')); err != nil {
+		logger.Errorf("failed to write account audit record: %v", err)
+	}
+
+	if cfg.Get().Accounts.AuditCloudLogging {
+		logger.Log(logger.LogEntry{
+			Message:           fmt.Sprintf("Account audit: %s", data),
+			Severity:          logger.Info,
+			StructuredPayload: record,
+		})
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/utils"
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestAuditKeyChanges(t *testing.T) {
+	t.Cleanup(func() { writeAccountAuditRecord = defaultWriteAccountAuditRecord })
+	var got []accountAuditRecord
+	writeAccountAuditRecord = func(record *accountAuditRecord) {
+		got = append(got, *record)
+	}
+
+	fingerprint := func(key string) string {
+		t.Helper()
+		pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+		if err != nil {
+			t.Fatalf("ssh.ParseAuthorizedKey() failed unexpectedly with error: %v", err)
+		}
+		return ssh.FingerprintSHA256(pub)
+	}
+	kept := "ssh-rsa " + utils.MakeRandRSAPubKey(t)
+	removed := "ssh-rsa " + utils.MakeRandRSAPubKey(t) + " user@host"
+	added := "ssh-rsa " + utils.MakeRandRSAPubKey(t)
+
+	auditKeyChanges("user", auditSourceMetadata, []string{kept, removed}, []string{kept, added})
+
+	want := []accountAuditRecord{
+		{Action: auditKeyRemove, User: "user", KeyFingerprint: fingerprint(removed), Source: auditSourceMetadata},
+		{Action: auditKeyAdd, User: "user", KeyFingerprint: fingerprint(added), Source: auditSourceMetadata},
+	}
+	for i := range got {
+		if got[i].Time.IsZero() {
+			t.Errorf("auditKeyChanges() recorded %+v without time", got[i])
+		}
+		got[i].Time = time.Time{}
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("auditKeyChanges() recorded unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestWriteAccountAuditRecord(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+	origFile := config.Accounts.AuditFile
+	t.Cleanup(func() { config.Accounts.AuditFile = origFile })
+	config.Accounts.AuditFile = filepath.Join(t.TempDir(), "audit", "accounts.json")
+
+	auditAccount(auditUserAdd, "user1", auditSourceMetadata)
+	auditAccount(auditUserRemove, "user2", auditSourceMetadata)
+
+	data, err := os.ReadFile(config.Accounts.AuditFile)
+	if err != nil {
+		t.Fatalf("os.ReadFile(%s) failed unexpectedly with error: %v", config.Accounts.AuditFile, err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var users []string
+	for dec.More() {
+		var record accountAuditRecord
+		if err := dec.Decode(&record); err != nil {
+			t.Fatalf("json.Decode() failed unexpectedly with error: %v", err)
+		}
+		users = append(users, record.Action+":"+record.User)
+	}
+	if diff := cmp.Diff([]string{"user-add:user1", "user-remove:user2"}, users); diff != "" {
+		t.Errorf("audit file has unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestAppendAccountsAuditFileRotation(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "accounts.json")
+	full := bytes.Repeat([]byte("a"), accountsAuditMaxSize-1)
+	if err := os.WriteFile(fpath, full, 0600); err != nil {
+		t.Fatalf("os.WriteFile(%s) failed unexpectedly with error: %v", fpath, err)
+	}
+
+	line := []byte("{}\n")
+	if err := appendAccountsAuditFile(fpath, line); err != nil {
+		t.Fatalf("appendAccountsAuditFile() failed unexpectedly with error: %v", err)
+	}
+
+	if got, err := os.ReadFile(fpath); err != nil || !bytes.Equal(got, line) {
+		t.Errorf("audit file = %q, %v after rotation, want %q", got, err, line)
+	}
+	if fi, err := os.Stat(fpath + ".1"); err != nil || fi.Size() != int64(len(full)) {
+		t.Errorf("rotated audit file = %v, %v, want the previous %d bytes", fi, err, len(full))
+	}
+}
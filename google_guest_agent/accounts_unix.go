@@ -21,10 +21,13 @@ import (
 	"fmt"
 	"os"
 	"os/user"
+	"strconv"
+	"strings"
 	"syscall"
 
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
 )
 
 func getUIDAndGID(path string) (string, string) {
@@ -36,9 +39,63 @@ func getUIDAndGID(path string) (string, string) {
 	return "", ""
 }
 
+// parseIDRange parses a "<min>-<max>" UID or GID range.
+func parseIDRange(idRange string) (uint64, uint64, error) {
+	first, last, found := strings.Cut(idRange, "-")
+	if !found {
+		return 0, 0, fmt.Errorf("missing \"-\" separator")
+	}
+	min, err := strconv.ParseUint(strings.TrimSpace(first), 10, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	max, err := strconv.ParseUint(strings.TrimSpace(last), 10, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	if min > max {
+		return 0, 0, fmt.Errorf("range start %d is greater than its end %d", min, max)
+	}
+	return min, max, nil
+}
+
+// useraddOptions returns the useradd options setting the configured shell,
+// home base directory, skeleton directory and UID and GID ranges. Options
+// that aren't configured are left to the useradd_cmd and system defaults.
+func useraddOptions(config *cfg.Sections) string {
+	var opts []string
+	if config.Accounts.Shell != "" {
+		opts = append(opts, "-s", config.Accounts.Shell)
+	}
+	if config.Accounts.HomeBase != "" {
+		opts = append(opts, "-b", config.Accounts.HomeBase)
+	}
+	if config.Accounts.SkelDir != "" {
+		opts = append(opts, "-k", config.Accounts.SkelDir)
+	}
+	for _, r := range []struct{ key, value, min, max string }{
+		{"uid_range", config.Accounts.UIDRange, "UID_MIN", "UID_MAX"},
+		{"gid_range", config.Accounts.GIDRange, "GID_MIN", "GID_MAX"},
+	} {
+		if r.value == "" {
+			continue
+		}
+		min, max, err := parseIDRange(r.value)
+		if err != nil {
+			logger.Errorf("Ignoring invalid %s configuration %q: %v", r.key, r.value, err)
+			continue
+		}
+		opts = append(opts, "-K", fmt.Sprintf("%s=%d", r.min, min), "-K", fmt.Sprintf("%s=%d", r.max, max))
+	}
+	return strings.Join(opts, " ")
+}
+
 func createUser(ctx context.Context, username, uid, gid string) error {
 	config := cfg.Get()
 	useradd := config.Accounts.UserAddCmd
+	if opts := useraddOptions(config); opts != "" {
+		useradd = fmt.Sprintf("%s %s", useradd, opts)
+	}
 	if uid != "" {
 		useradd = fmt.Sprintf("%s -u %s", useradd, uid)
 	}
@@ -0,0 +1,95 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package main
+
+import (
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+)
+
+func TestUseraddOptions(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+
+	if got := useraddOptions(config); got != "" {
+		t.Errorf("useraddOptions() = %q by default, want none", got)
+	}
+	if got := userHomeDir(config, "user"); got != "/home/user" {
+		t.Errorf("userHomeDir(user) = %q by default, want %q", got, "/home/user")
+	}
+
+	config.Accounts.Shell = "/bin/zsh"
+	config.Accounts.HomeBase = "/export/home"
+	config.Accounts.SkelDir = "/etc/google-skel"
+	want := "-s /bin/zsh -b /export/home -k /etc/google-skel"
+	if got := useraddOptions(config); got != want {
+		t.Errorf("useraddOptions() = %q, want %q", got, want)
+	}
+	if got := userHomeDir(config, "user"); got != "/export/home/user" {
+		t.Errorf("userHomeDir(user) = %q, want %q", got, "/export/home/user")
+	}
+}
+
+func TestUseraddOptionsIDRanges(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+	t.Cleanup(func() { config.Accounts.UIDRange, config.Accounts.GIDRange = "", "" })
+
+	tests := []struct {
+		name     string
+		uidRange string
+		gidRange string
+		want     string
+	}{
+		{
+			name:     "both",
+			uidRange: "20000-29999",
+			gidRange: " 20000 - 29999 ",
+			want:     "-K UID_MIN=20000 -K UID_MAX=29999 -K GID_MIN=20000 -K GID_MAX=29999",
+		},
+		{
+			name:     "uid_only",
+			uidRange: "5000-5999",
+			want:     "-K UID_MIN=5000 -K UID_MAX=5999",
+		},
+		{
+			name:     "invalid",
+			uidRange: "5999-5000",
+			gidRange: "5000",
+			want:     "",
+		},
+		{
+			name:     "not_a_number",
+			uidRange: "a-b",
+			want:     "",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config.Accounts.UIDRange, config.Accounts.GIDRange = tc.uidRange, tc.gidRange
+			if got := useraddOptions(config); got != tc.want {
+				t.Errorf("useraddOptions() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
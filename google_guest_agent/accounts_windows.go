@@ -17,10 +17,13 @@ package main
 import (
 	"context"
 	"fmt"
+	"os"
+	"path/filepath"
 	"syscall"
 	"unsafe"
 
 	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
 )
 
 var (
@@ -192,3 +195,69 @@ func userExists(name string) (bool, error) {
 func getUIDAndGID(_ string) (string, string) {
 	return "", ""
 }
+
+// adminAuthorizedKeysFile returns the OpenSSH authorized keys file of the
+// administrators.
+func adminAuthorizedKeysFile() string {
+	return filepath.Join(os.Getenv("ProgramData"), "ssh", "administrators_authorized_keys")
+}
+
+// userSSHDir returns the .ssh directory in the profile of user. The profile
+// is created on the user's first logon, creating it earlier would make
+// Windows use another directory.
+func userSSHDir(user string) (string, error) {
+	sid, _, _, err := windows.LookupSID("", user)
+	if err != nil {
+		return "", fmt.Errorf("error looking up the SID of %s: %v", user, err)
+	}
+	profile, err := readRegString(`SOFTWARE\Microsoft\Windows NT\CurrentVersion\ProfileList\`+sid.String(), "ProfileImagePath")
+	if err != nil {
+		return "", fmt.Errorf("no profile for %s: %v", user, err)
+	}
+	profile, err = registry.ExpandString(profile)
+	if err != nil {
+		return "", fmt.Errorf("error expanding the profile path of %s: %v", user, err)
+	}
+	return filepath.Join(profile, ".ssh"), nil
+}
+
+// writeAuthorizedKeysFile writes content to the authorized keys file at path,
+// accessible only by SYSTEM, the administrators and user if not empty as
+// OpenSSH requires.
+func writeAuthorizedKeysFile(path, user string, content []byte) error {
+	sddl := "D:P(A;;FA;;;SY)(A;;FA;;;BA)"
+	if user != "" {
+		sid, _, _, err := windows.LookupSID("", user)
+		if err != nil {
+			return fmt.Errorf("error looking up the SID of %s: %v", user, err)
+		}
+		sddl += fmt.Sprintf("(A;;FA;;;%s)", sid.String())
+	}
+	sd, err := windows.SecurityDescriptorFromString(sddl)
+	if err != nil {
+		return fmt.Errorf("error parsing security descriptor %q: %v", sddl, err)
+	}
+	dacl, _, err := sd.DACL()
+	if err != nil {
+		return fmt.Errorf("error getting the DACL of %q: %v", sddl, err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("error creating %q: %v", filepath.Dir(path), err)
+	}
+	// The file is only readable by sshd once its access is restricted.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		return fmt.Errorf("error writing %q: %v", tmp, err)
+	}
+	secInfo := windows.SECURITY_INFORMATION(windows.DACL_SECURITY_INFORMATION | windows.PROTECTED_DACL_SECURITY_INFORMATION)
+	if err := windows.SetNamedSecurityInfo(tmp, windows.SE_FILE_OBJECT, secInfo, nil, nil, dacl, nil); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error setting the access of %q: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error renaming %q to %q: %v", tmp, path, err)
+	}
+	return nil
+}
@@ -16,21 +16,35 @@ package main
 
 import (
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"maps"
 	"net"
+	"os"
 	"runtime"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
 
+	"github.com/GoogleCloudPlatform/guest-agent/eventlog"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/events"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/events/nic"
 	network "github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/network/manager"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/network/netlink"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
 	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
 )
 
 var (
 	addressKey = regKeyBase + `\ForwardedIps`
+
+	// routesMu serializes the changes of the local and custom routes between
+	// the address manager and the route reconciler.
+	routesMu sync.Mutex
 )
 
 type addressMgr struct{}
@@ -114,33 +128,25 @@ func getLocalRoutes(ctx context.Context, config *cfg.Sections, ifname string) ([
 		return nil, errors.New("getLocalRoutes unimplemented on Windows")
 	}
 
-	protoID := config.IPForwarding.EthernetProtoID
-	args := fmt.Sprintf("route list table local type local scope host dev %s proto %s", ifname, protoID)
-	out := run.WithOutput(ctx, "ip", strings.Split(args, " ")...)
-	if out.ExitCode != 0 {
-		return nil, error(out)
-	}
-	var res []string
-	for _, line := range strings.Split(out.StdOut, "\n") {
-		line = strings.TrimPrefix(line, "local ")
-		line = strings.TrimSpace(line)
-		if line != "" {
-			res = append(res, line)
-		}
+	protoID, err := routeProtoID(config)
+	if err != nil {
+		return nil, err
 	}
 
-	// and again for IPv6 routes, without 'scope host' which is IPv4 only
-	args = fmt.Sprintf("-6 route list table local type local dev %s proto %s", ifname, protoID)
-	out = run.WithOutput(ctx, "ip", strings.Split(args, " ")...)
-	if out.ExitCode != 0 {
-		return nil, error(out)
+	routes, err := netlink.Client.LocalRoutes(ifname, protoID)
+	if err != nil {
+		return nil, err
 	}
-	for _, line := range strings.Split(out.StdOut, "\n") {
-		line = strings.TrimPrefix(line, "local ")
-		line = strings.Split(line, " ")[0]
-		line = strings.TrimSpace(line)
-		if line != "" {
-			res = append(res, line)
+
+	// Format the routes like ip does, omitting the prefix length of single
+	// address routes.
+	var res []string
+	for _, route := range routes {
+		ones, bits := route.Mask.Size()
+		if ones == bits {
+			res = append(res, route.IP.String())
+		} else {
+			res = append(res, route.String())
 		}
 	}
 	return res, nil
@@ -152,13 +158,17 @@ func addLocalRoute(ctx context.Context, config *cfg.Sections, ip, ifname string)
 		return errors.New("addLocalRoute unimplemented on Windows")
 	}
 
-	// TODO: Subnet size should be parsed from alias IP entries.
-	if !strings.Contains(ip, "/") {
-		ip = ip + "/32"
+	protoID, err := routeProtoID(config)
+	if err != nil {
+		return err
+	}
+
+	dst, err := localRouteDst(ip)
+	if err != nil {
+		return err
 	}
-	protoID := config.IPForwarding.EthernetProtoID
-	args := fmt.Sprintf("route add to local %s scope host dev %s proto %s", ip, ifname, protoID)
-	return run.Quiet(ctx, "ip", strings.Split(args, " ")...)
+
+	return netlink.Client.AddLocalRoute(dst, ifname, protoID)
 }
 
 // TODO: removeLocalRoute should be changed to removeIPForwardEntry and match getIPForwardEntries.
@@ -167,13 +177,100 @@ func removeLocalRoute(ctx context.Context, config *cfg.Sections, ip, ifname stri
 		return errors.New("removeLocalRoute unimplemented on Windows")
 	}
 
+	protoID, err := routeProtoID(config)
+	if err != nil {
+		return err
+	}
+
+	dst, err := localRouteDst(ip)
+	if err != nil {
+		return err
+	}
+
+	return netlink.Client.DeleteLocalRoute(dst, ifname, protoID)
+}
+
+// routeProtoID returns the configured routing protocol of the local routes, a
+// number or a name of the iproute2 rt_protos tables as the ip command accepts.
+func routeProtoID(config *cfg.Sections) (int, error) {
+	proto := strings.TrimSpace(config.IPForwarding.EthernetProtoID)
+	if protoID, err := strconv.Atoi(proto); err == nil {
+		if protoID < 0 || protoID > 255 {
+			return 0, fmt.Errorf("invalid ethernet_proto_id %q", proto)
+		}
+		return protoID, nil
+	}
+	if protoID, ok := routeProtos()[proto]; ok {
+		return protoID, nil
+	}
+	return 0, fmt.Errorf("invalid ethernet_proto_id %q, unknown routing protocol", proto)
+}
+
+var (
+	// rtProtosFiles are the iproute2 routing protocol tables, the first ones
+	// take precedence.
+	rtProtosFiles = []string{"/etc/iproute2/rt_protos", "/usr/share/iproute2/rt_protos", "/usr/lib/iproute2/rt_protos"}
+
+	// defaultRouteProtos are the routing protocol names known to iproute2
+	// without tables.
+	defaultRouteProtos = map[string]int{
+		"unspec": 0, "redirect": 1, "kernel": 2, "boot": 3, "static": 4,
+		"gated": 8, "ra": 9, "mrt": 10, "zebra": 11, "bird": 12, "dnrouted": 13,
+		"xorp": 14, "ntk": 15, "dhcp": 16, "keepalived": 18, "babel": 42,
+		"openr": 99, "bgp": 186, "isis": 187, "ospf": 188, "rip": 189, "eigrp": 192,
+	}
+)
+
+// routeProtos returns the routing protocol numbers by name, from the iproute2
+// tables and the defaults.
+func routeProtos() map[string]int {
+	protos := maps.Clone(defaultRouteProtos)
+	for i := len(rtProtosFiles) - 1; i >= 0; i-- {
+		data, err := os.ReadFile(rtProtosFiles[i])
+		if err != nil {
+			continue
+		}
+		maps.Copy(protos, parseRTProtos(string(data)))
+	}
+	return protos
+}
+
+// parseRTProtos parses an iproute2 rt_protos table, made of "number name"
+// lines and comments.
+func parseRTProtos(data string) map[string]int {
+	protos := make(map[string]int)
+	for _, line := range strings.Split(data, "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		id, err := strconv.ParseUint(fields[0], 0, 8)
+		if err != nil {
+			continue
+		}
+		protos[fields[1]] = int(id)
+	}
+	return protos
+}
+
+// localRouteDst returns the destination of the local route of ip, addresses
+// without a prefix length are single address routes.
+func localRouteDst(ip string) (*net.IPNet, error) {
 	// TODO: Subnet size should be parsed from alias IP entries.
 	if !strings.Contains(ip, "/") {
-		ip = ip + "/32"
+		if strings.Contains(ip, ":") {
+			ip = ip + "/128"
+		} else {
+			ip = ip + "/32"
+		}
 	}
-	protoID := config.IPForwarding.EthernetProtoID
-	args := fmt.Sprintf("route delete to local %s scope host dev %s proto %s", ip, ifname, protoID)
-	return run.Quiet(ctx, "ip", strings.Split(args, " ")...)
+
+	_, dst, err := net.ParseCIDR(ip)
+	if err != nil {
+		return nil, fmt.Errorf("invalid route destination %q: %w", ip, err)
+	}
+	return dst, nil
 }
 
 // Filter out forwarded ips based on WSFC (Windows Failover Cluster Settings).
@@ -258,18 +355,106 @@ func (a *addressMgr) Disabled(ctx context.Context) (bool, error) {
 	return !config.Daemons.NetworkDaemon, nil
 }
 
+// handleNICChanges runs the address manager when network interfaces are
+// hot-plugged, the metadata may describe a new NIC before the OS exposes it.
+func handleNICChanges(ctx context.Context, evType string, data interface{}, evData *events.EventData) bool {
+	if evData.Error != nil {
+		logger.Errorf("Network interfaces watcher failed, hot-plugged NICs won't be set up: %+v", evData.Error)
+		return false
+	}
+
+	changes, ok := evData.Data.(*nic.Changes)
+	if !ok {
+		return true
+	}
+	for _, iface := range changes.Removed {
+		eventlog.Infof(eventlog.InterfaceRemoved, "Network interface %s (%s) was removed.", iface.Name, iface.MAC)
+	}
+	// The container interfaces come and go with the pods, they must not
+	// trigger a network setup.
+	var added int
+	for _, iface := range changes.Added {
+		if network.IsIgnoredInterface(cfg.Get(), iface.Name) {
+			logger.Debugf("Network interface %s (%s) was added, ignored.", iface.Name, iface.MAC)
+			continue
+		}
+		eventlog.Infof(eventlog.InterfaceAdded, "Network interface %s (%s) was added.", iface.Name, iface.MAC)
+		added++
+	}
+
+	if added == 0 {
+		return true
+	}
+
+	// The address manager must not race a metadata update.
+	updateMu.Lock()
+	defer updateMu.Unlock()
+	if newMetadata == nil {
+		return true
+	}
+	runManager(ctx, addressManager)
+	return true
+}
+
+// setWindowsMTU sets the MTU provided by the metadata on the interfaces whose
+// MTU doesn't match it yet, netsh persists it across reboots.
+func setWindowsMTU(ctx context.Context, config *cfg.Sections, nics []metadata.NetworkInterfaces) {
+	for _, ni := range nics {
+		if ni.MTU <= 0 {
+			continue
+		}
+
+		iface, err := network.GetInterfaceByMAC(config, ni.Mac)
+		if err != nil || iface.MTU == ni.MTU {
+			continue
+		}
+
+		protocols := []string{"ipv4"}
+		if len(ni.IPv6s) > 0 {
+			protocols = append(protocols, "ipv6")
+		}
+
+		logger.Infof("Setting %s MTU to %d", iface.Name, ni.MTU)
+		for _, proto := range protocols {
+			args := []string{"interface", proto, "set", "subinterface", iface.Name, fmt.Sprintf("mtu=%d", ni.MTU), "store=persistent"}
+			if err := run.Quiet(ctx, "netsh", args...); err != nil {
+				eventlog.Errorf(eventlog.InterfaceSetupFailed, "Failed to set %s %s MTU: %v", iface.Name, proto, err)
+			}
+		}
+	}
+}
+
 func (a *addressMgr) Set(ctx context.Context) error {
 	config := cfg.Get()
 
+	states := newNICStates(newMetadata.Instance.NetworkInterfaces)
+	defer states.publish(ctx, mdsClient)
+
 	if runtime.GOOS == "windows" {
+		// Adding addresses and routes fails every cycle without the privileges.
+		if skipDegraded("addressMgr") {
+			return nil
+		}
 		a.applyWSFCFilter(config)
+
+		if config.NetworkInterfaces.Setup {
+			setWindowsMTU(ctx, config, newMetadata.Instance.NetworkInterfaces)
+			setWindowsNICProperties(ctx, config, newMetadata)
+			setWindowsNICRoutes(config, newMetadata.Instance.NetworkInterfaces, newMetadata.Instance.Attributes.StaticIPConfig)
+		}
 	}
 
+	// The route reconciler must not race with the changes below, the custom
+	// routes included.
+	routesMu.Lock()
+	defer routesMu.Unlock()
+
 	// Guest Agent does not manage interfaces on Windows.
 	if runtime.GOOS != "windows" {
 		// Setup network interfaces.
 		err := network.SetupInterfaces(ctx, config, newMetadata)
 		if err != nil {
+			states.fail(err)
 			return fmt.Errorf("failed to setup network interfaces: %v", err)
 		}
 	}
@@ -280,24 +465,19 @@ func (a *addressMgr) Set(ctx context.Context) error {
 
 	logger.Debugf("Add routes for aliases, forwarded IP and target-instance IPs")
 	// Add routes for IP aliases, forwarded and target-instance IPs.
-	for _, ni := range newMetadata.Instance.NetworkInterfaces {
-		iface, err := network.GetInterfaceByMAC(ni.Mac)
+	for i, ni := range newMetadata.Instance.NetworkInterfaces {
+		state := states[i]
+		iface, err := network.GetInterfaceByMAC(config, ni.Mac)
 		if err != nil {
 			if !slices.Contains(badMAC, ni.Mac) {
 				logger.Errorf("Error getting interface: %s", err)
 				badMAC = append(badMAC, ni.Mac)
 			}
+			state.Error = err.Error()
 			continue
 		}
-		wantIPs := ni.ForwardedIps
-		wantIPs = append(wantIPs, ni.ForwardedIpv6s...)
-		if config.IPForwarding.TargetInstanceIPs {
-			wantIPs = append(wantIPs, ni.TargetInstanceIps...)
-		}
-		// IP Aliases are not supported on windows.
-		if runtime.GOOS != "windows" && config.IPForwarding.IPAliases {
-			wantIPs = append(wantIPs, ni.IPAliases...)
-		}
+		state.Interface = iface.Name
+		wantIPs := wantForwardedIPs(config, ni)
 
 		var forwardedIPs []string
 		var configuredIPs []string
@@ -312,6 +492,7 @@ func (a *addressMgr) Set(ctx context.Context) error {
 			regFwdIPs, err := getForwardsFromRegistry(ni.Mac)
 			if err != nil {
 				logger.Errorf("Error getting forwards from registry: %s", err)
+				state.Error = err.Error()
 				continue
 			}
 			for _, ip := range configuredIPs {
@@ -324,20 +505,14 @@ func (a *addressMgr) Set(ctx context.Context) error {
 			forwardedIPs, err = getLocalRoutes(ctx, config, iface.Name)
 			if err != nil {
 				logger.Errorf("Error getting routes: %v", err)
+				state.Error = err.Error()
 				continue
 			}
 		}
 
 		// Trims any '/32' suffix for consistency.
-		trimSuffix := func(entries []string) []string {
-			var res []string
-			for _, entry := range entries {
-				res = append(res, strings.TrimSuffix(entry, "/32"))
-			}
-			return res
-		}
-		forwardedIPs = trimSuffix(forwardedIPs)
-		wantIPs = trimSuffix(wantIPs)
+		forwardedIPs = trimSuffix32(forwardedIPs)
+		wantIPs = trimSuffix32(wantIPs)
 
 		toAdd, toRm := compareRoutes(forwardedIPs, wantIPs)
 
@@ -357,12 +532,18 @@ func (a *addressMgr) Set(ctx context.Context) error {
 		}
 
 		var registryEntries []string
+		// deniedErr is set once a change was denied, the next ones would be
+		// denied too.
+		var deniedErr error
 		for _, ip := range wantIPs {
 			// If the IP is not in toAdd, add to registry list and continue.
 			if !slices.Contains(toAdd, ip) {
 				registryEntries = append(registryEntries, ip)
 				continue
 			}
+			if deniedErr != nil {
+				continue
+			}
 			var err error
 			if runtime.GOOS == "windows" {
 				// Don't addAddress if this is already configured.
@@ -381,12 +562,22 @@ func (a *addressMgr) Set(ctx context.Context) error {
 			}
 			if err == nil {
 				registryEntries = append(registryEntries, ip)
+			} else if isAccessDenied(err) {
+				enterDegradedMode("adding forwarded IPs was denied")
+				state.Error = err.Error()
+				deniedErr = fmt.Errorf("failed to add forwarded IP %s: %w", ip, err)
 			} else {
-				logger.Errorf("error adding route: %v", err)
+				eventlog.Errorf(eventlog.RouteUpdateFailed, "error adding route: %v", err)
+				state.Error = err.Error()
 			}
 		}
 
 		for _, ip := range toRm {
+			if deniedErr != nil {
+				// Keep the record of the IPs left in place.
+				registryEntries = append(registryEntries, ip)
+				continue
+			}
 			var err error
 			if runtime.GOOS == "windows" {
 				if !slices.Contains(configuredIPs, ip) {
@@ -404,23 +595,93 @@ func (a *addressMgr) Set(ctx context.Context) error {
 				err = removeLocalRoute(ctx, config, ip, iface.Name)
 			}
 			if err != nil {
-				logger.Errorf("error removing route: %v", err)
+				eventlog.Errorf(eventlog.RouteUpdateFailed, "error removing route: %v", err)
+				state.Error = err.Error()
 				// Add IPs we fail to remove to registry to maintain accurate record.
 				registryEntries = append(registryEntries, ip)
 			}
 		}
 
+		state.Routes = registryEntries
+
 		if runtime.GOOS == "windows" {
 			if err := writeRegMultiString(addressKey, ni.Mac, registryEntries); err != nil {
 				logger.Errorf("error writing registry: %s", err)
 			}
 		}
+		if deniedErr != nil {
+			return deniedErr
+		}
 	}
-	logger.Infof("Completed adding/removing routes for aliases, forwarded IP and target-instance IPs")
+	eventlog.Infof(eventlog.RoutesUpdated, "Completed adding/removing routes for aliases, forwarded IP and target-instance IPs")
 
 	return nil
 }
 
+// wantForwardedIPs returns the forwarded IPs, target-instance IPs and alias IP
+// ranges the metadata assigns to ni, according to the configuration.
+func wantForwardedIPs(config *cfg.Sections, ni metadata.NetworkInterfaces) []string {
+	wantIPs := slices.Clone(ni.ForwardedIps)
+	wantIPs = append(wantIPs, ni.ForwardedIpv6s...)
+	if config.IPForwarding.TargetInstanceIPs {
+		wantIPs = append(wantIPs, ni.TargetInstanceIps...)
+	}
+	if config.IPForwarding.IPAliases {
+		// Windows has no local routes, the alias ranges are assigned address
+		// by address when enabled.
+		if runtime.GOOS != "windows" {
+			wantIPs = append(wantIPs, ni.IPAliases...)
+		} else if config.IPForwarding.WindowsIPAliases {
+			wantIPs = append(wantIPs, aliasAddresses(ni.IPAliases)...)
+		}
+	}
+	return wantIPs
+}
+
+// maxAliasPrefix is the largest alias IP range (the smallest prefix length)
+// expanded into addresses.
+const maxAliasPrefix = 24
+
+// aliasAddresses expands the IPv4 alias IP ranges into their addresses. The
+// ranges larger than a /24 and the IPv6 ones are skipped.
+func aliasAddresses(aliases []string) []string {
+	var res []string
+	for _, alias := range aliases {
+		if !strings.Contains(alias, "/") {
+			alias += "/32"
+		}
+
+		ip, ipNet, err := net.ParseCIDR(alias)
+		if err != nil || ip.To4() == nil {
+			logger.Errorf("Skipping unsupported alias IP range %q", alias)
+			continue
+		}
+
+		ones, _ := ipNet.Mask.Size()
+		if ones < maxAliasPrefix {
+			logger.Errorf("Skipping alias IP range %q, ranges larger than a /%d are not supported", alias, maxAliasPrefix)
+			continue
+		}
+
+		start := binary.BigEndian.Uint32(ipNet.IP.To4())
+		for i := uint32(0); i < 1<<(32-ones); i++ {
+			addr := make(net.IP, 4)
+			binary.BigEndian.PutUint32(addr, start+i)
+			res = append(res, addr.String())
+		}
+	}
+	return res
+}
+
+// trimSuffix32 trims the '/32' suffix of entries.
+func trimSuffix32(entries []string) []string {
+	var res []string
+	for _, entry := range entries {
+		res = append(res, strings.TrimSuffix(entry, "/32"))
+	}
+	return res
+}
+
 // isIPv6 returns true if the IP address is an IPv6 address.
 func isIPv6(ip net.IP) bool {
 	return ip.To4() == nil
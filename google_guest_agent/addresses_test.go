@@ -19,10 +19,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"slices"
 	"testing"
 
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/events"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/events/nic"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/fakes"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/network/netlink"
 	"github.com/GoogleCloudPlatform/guest-agent/metadata"
 )
 
@@ -202,3 +210,188 @@ func TestIsIPv6(t *testing.T) {
 		})
 	}
 }
+
+func TestHandleNICChanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		evData *events.EventData
+		want   bool
+	}{
+		{
+			name:   "watcher_error",
+			evData: &events.EventData{Error: fmt.Errorf("not permitted")},
+			want:   false,
+		},
+		{
+			name:   "unexpected_data",
+			evData: &events.EventData{Data: "eth1"},
+			want:   true,
+		},
+		{
+			name:   "removed_only",
+			evData: &events.EventData{Data: &nic.Changes{Removed: []nic.Interface{{Name: "eth1", Index: 3}}}},
+			want:   true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := handleNICChanges(context.Background(), nic.ChangedEvent, nil, tc.evData); got != tc.want {
+				t.Errorf("handleNICChanges() = %t, want %t", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLocalRouteDst(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{ip: "10.0.0.1", want: "10.0.0.1/32"},
+		{ip: "10.0.0.0/24", want: "10.0.0.0/24"},
+		{ip: "2600:1900::1", want: "2600:1900::1/128"},
+		{ip: "2600:1900::/96", want: "2600:1900::/96"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.ip, func(t *testing.T) {
+			got, err := localRouteDst(tc.ip)
+			if err != nil {
+				t.Fatalf("localRouteDst(%s) failed unexpectedly with error: %v", tc.ip, err)
+			}
+			if got.String() != tc.want {
+				t.Errorf("localRouteDst(%s) = %q, want %q", tc.ip, got, tc.want)
+			}
+		})
+	}
+
+	if _, err := localRouteDst("invalid"); err == nil {
+		t.Errorf("localRouteDst(invalid) succeeded, want error")
+	}
+}
+
+func TestLocalRoutes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("local routes are not supported on Windows")
+	}
+
+	orig := netlink.Client
+	netlink.Client = fakes.NewNetlink()
+	t.Cleanup(func() { netlink.Client = orig })
+
+	reloadConfig(t, nil)
+	config := cfg.Get()
+	ctx := context.Background()
+
+	for _, ip := range []string{"10.0.0.1", "10.1.0.0/24", "2600:1900::1", "2600:1900::/96"} {
+		if err := addLocalRoute(ctx, config, ip, "eth0"); err != nil {
+			t.Fatalf("addLocalRoute(%s) failed unexpectedly with error: %v", ip, err)
+		}
+	}
+
+	if err := removeLocalRoute(ctx, config, "10.1.0.0/24", "eth0"); err != nil {
+		t.Fatalf("removeLocalRoute(10.1.0.0/24) failed unexpectedly with error: %v", err)
+	}
+
+	got, err := getLocalRoutes(ctx, config, "eth0")
+	if err != nil {
+		t.Fatalf("getLocalRoutes(eth0) failed unexpectedly with error: %v", err)
+	}
+
+	want := []string{"10.0.0.1", "2600:1900::1", "2600:1900::/96"}
+	if !slices.Equal(got, want) {
+		t.Errorf("getLocalRoutes(eth0) = %v, want %v", got, want)
+	}
+
+	if _, err := getLocalRoutes(ctx, config, "eth1"); err != nil {
+		t.Errorf("getLocalRoutes(eth1) failed unexpectedly with error: %v", err)
+	}
+}
+
+func TestWantForwardedIPs(t *testing.T) {
+	ni := metadata.NetworkInterfaces{
+		ForwardedIps:      []string{"10.0.0.10"},
+		ForwardedIpv6s:    []string{"2600:1900::/96"},
+		TargetInstanceIps: []string{"10.0.0.20"},
+		IPAliases:         []string{"10.1.0.0/30"},
+	}
+
+	// Windows leaves the alias ranges alone unless windows_ip_aliases is
+	// enabled, then assigns them address by address.
+	aliases := []string{"10.1.0.0/30"}
+	windowsAliases := []string{"10.1.0.0/30"}
+	if runtime.GOOS == "windows" {
+		aliases = nil
+		windowsAliases = []string{"10.1.0.0", "10.1.0.1", "10.1.0.2", "10.1.0.3"}
+	}
+
+	tests := []struct {
+		config []byte
+		want   []string
+	}{
+		{config: nil, want: append([]string{"10.0.0.10", "2600:1900::/96", "10.0.0.20"}, aliases...)},
+		{config: []byte("[IpForwarding]\nwindows_ip_aliases = true\n"), want: append([]string{"10.0.0.10", "2600:1900::/96", "10.0.0.20"}, windowsAliases...)},
+		{config: []byte("[IpForwarding]\nip_aliases = false\ntarget_instance_ips = false\n"), want: []string{"10.0.0.10", "2600:1900::/96"}},
+	}
+
+	for _, tc := range tests {
+		reloadConfig(t, tc.config)
+		if got := wantForwardedIPs(cfg.Get(), ni); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("wantForwardedIPs(%q, %+v) = %v, want %v", tc.config, ni, got, tc.want)
+		}
+	}
+	reloadConfig(t, nil)
+}
+
+func TestAliasAddresses(t *testing.T) {
+	aliases := []string{"10.1.0.5", "10.1.0.8/32", "10.1.0.16/30", "10.2.0.0/16", "2600:1900::/96", "invalid"}
+	want := []string{"10.1.0.5", "10.1.0.8", "10.1.0.16", "10.1.0.17", "10.1.0.18", "10.1.0.19"}
+
+	if got := aliasAddresses(aliases); !slices.Equal(got, want) {
+		t.Errorf("aliasAddresses(%v) = %v, want %v", aliases, got, want)
+	}
+
+	if got := aliasAddresses([]string{"10.3.0.0/24"}); len(got) != 256 || got[255] != "10.3.0.255" {
+		t.Errorf("aliasAddresses([10.3.0.0/24]) returned %d addresses, want the 256 addresses of the range", len(got))
+	}
+}
+
+func TestRouteProtoID(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+	origProto, origFiles := config.IPForwarding.EthernetProtoID, rtProtosFiles
+	t.Cleanup(func() { config.IPForwarding.EthernetProtoID, rtProtosFiles = origProto, origFiles })
+
+	rtProtos := filepath.Join(t.TempDir(), "rt_protos")
+	if err := os.WriteFile(rtProtos, []byte("# Reserved protocols.\n0x42\tgoogle # The agent's routes.\n200 static\ninvalid line\n"), 0644); err != nil {
+		t.Fatalf("os.WriteFile(%s) failed unexpectedly with error: %v", rtProtos, err)
+	}
+	rtProtosFiles = []string{rtProtos, filepath.Join(t.TempDir(), "missing")}
+
+	tests := []struct {
+		proto   string
+		want    int
+		wantErr bool
+	}{
+		{proto: "66", want: 66},
+		{proto: "google", want: 66},
+		{proto: "static", want: 200},
+		{proto: "dhcp", want: 16},
+		{proto: "256", wantErr: true},
+		{proto: "unknown", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		config.IPForwarding.EthernetProtoID = tc.proto
+		got, err := routeProtoID(config)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("routeProtoID(%q) = error %v, want error: %t", tc.proto, err, tc.wantErr)
+		}
+		if got != tc.want {
+			t.Errorf("routeProtoID(%q) = %d, want %d", tc.proto, got, tc.want)
+		}
+	}
+}
@@ -215,7 +215,7 @@ func createUnicastIpAddressEntry6(ip net.IP, prefix uint8, index uint32) error {
 	}
 
 	if ret, _, err := procCreateUnicastIpAddressEntry.Call(uintptr(unsafe.Pointer(ipRow))); ret != 0 {
-		return fmt.Errorf("nonzero return code from CreateUnicastIpAddressEntry: %s, last err: %w", syscall.Errno(ret), err)
+		return fmt.Errorf("nonzero return code from CreateUnicastIpAddressEntry: %w, last err: %w", syscall.Errno(ret), err)
 	}
 	return nil
 }
@@ -249,7 +249,7 @@ func createUnicastIpAddressEntry(ip net.IP, prefix uint8, index uint32) error {
 	ipRow.Address.Ipv4.sin_addr.S_un.S_addr = binary.LittleEndian.Uint32(ip.To4())
 
 	if ret, _, _ := procCreateUnicastIpAddressEntry.Call(uintptr(unsafe.Pointer(ipRow))); ret != 0 {
-		return fmt.Errorf("nonzero return code from CreateUnicastIpAddressEntry: %s", syscall.Errno(ret))
+		return fmt.Errorf("nonzero return code from CreateUnicastIpAddressEntry: %w", syscall.Errno(ret))
 	}
 	return nil
 }
@@ -291,7 +291,7 @@ func addIPAddress(ip net.IP, mask net.IPMask, index uint32) error {
 		uintptr(unsafe.Pointer(&nteC)),
 		uintptr(unsafe.Pointer(&nteI)))
 	if ret != 0 {
-		return fmt.Errorf("nonzero return code from AddIPAddress: %s", syscall.Errno(ret))
+		return fmt.Errorf("nonzero return code from AddIPAddress: %w", syscall.Errno(ret))
 	}
 	return nil
 }
@@ -399,7 +399,24 @@ func addIPForwardEntry(fe ipForwardEntry) error {
 	}
 
 	if ret, _, _ := procCreateIpForwardEntry.Call(uintptr(unsafe.Pointer(fr))); ret != 0 {
-		return fmt.Errorf("nonzero return code from CreateIpForwardEntry: %s", syscall.Errno(ret))
+		return fmt.Errorf("nonzero return code from CreateIpForwardEntry: %w", syscall.Errno(ret))
+	}
+	return nil
+}
+
+func removeIPForwardEntry(fe ipForwardEntry) error {
+	// https://learn.microsoft.com/en-us/windows/win32/api/iphlpapi/nf-iphlpapi-deleteipforwardentry
+
+	fr := &MIB_IPFORWARDROW{
+		dwForwardDest:    binary.LittleEndian.Uint32(fe.ipForwardDest.To4()),
+		dwForwardMask:    binary.LittleEndian.Uint32(fe.ipForwardMask),
+		dwForwardNextHop: binary.LittleEndian.Uint32(fe.ipForwardNextHop.To4()),
+		dwForwardIfIndex: IF_INDEX(fe.ipForwardIfIndex),
+		dwForwardProto:   MIB_IPPROTO_NETMGMT,
+	}
+
+	if ret, _, _ := procDeleteIpForwardEntry.Call(uintptr(unsafe.Pointer(fr))); ret != 0 {
+		return fmt.Errorf("nonzero return code from DeleteIpForwardEntry: %s", syscall.Errno(ret))
 	}
 	return nil
 }
@@ -0,0 +1,168 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/command"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/scheduler"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// syncAddressesCommand re-applies the network configuration and the
+	// forwarded IP addresses.
+	syncAddressesCommand = "agent.SyncAddresses"
+	// refreshKeysCommand re-applies the metadata SSH keys and accounts.
+	refreshKeysCommand = "agent.RefreshKeys"
+	// dumpStateCommand returns the agent's state.
+	dumpStateCommand = "agent.DumpState"
+)
+
+var (
+	// getMetadata returns the current metadata, overridden in tests.
+	getMetadata = func(ctx context.Context) (*metadata.Descriptor, error) {
+		return mdsClient.Get(ctx)
+	}
+)
+
+// managerState is the state of a manager returned by agent.DumpState.
+type managerState struct {
+	Name     string
+	Disabled bool
+}
+
+// jobState is the state of a job returned by agent.DumpState.
+type jobState struct {
+	ID        string
+	Scheduled bool
+}
+
+// agentStateResponse is the agent.DumpState response.
+type agentStateResponse struct {
+	command.Response
+	Version    string
+	OS         string
+	InstanceID string
+	// Maintenance is why the maintenance mode is on, empty if it's off.
+	Maintenance string
+	Managers    []managerState
+	Jobs        []jobState
+}
+
+// registerAgentCommands registers the handlers of the agent actions requested
+// through the command monitor, i.e. by the GCEGuestAgent PowerShell module.
+func registerAgentCommands(ctx context.Context, jobs []scheduler.Job) {
+	handlers := map[string]command.Handler{
+		syncAddressesCommand: func([]byte) ([]byte, error) {
+			return forceManager(ctx, addressManager)
+		},
+		refreshKeysCommand: func([]byte) ([]byte, error) {
+			return forceManager(ctx, accountsManager())
+		},
+		dumpStateCommand: func([]byte) ([]byte, error) {
+			return json.Marshal(dumpAgentState(ctx, jobs))
+		},
+		setMaintenanceModeCommand: func(b []byte) ([]byte, error) {
+			return setMaintenanceMode(ctx, b)
+		},
+	}
+	for name, handler := range handlers {
+		if err := command.Get().RegisterHandler(name, handler); err != nil {
+			logger.Errorf("Failed to register the %s command handler: %v", name, err)
+		}
+	}
+}
+
+// accountsManager returns the manager of the accounts and SSH keys.
+func accountsManager() manager {
+	if runtime.GOOS == "windows" {
+		return &winAccountsMgr{}
+	}
+	return &accountsMgr{}
+}
+
+// managerName returns the manager's type name, i.e. addressMgr.
+func managerName(mgr manager) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", mgr), "*main.")
+}
+
+// forceManager fetches the current metadata and runs the manager, whether its
+// metadata changed or not.
+func forceManager(ctx context.Context, mgr manager) ([]byte, error) {
+	name := managerName(mgr)
+	disabled, err := mgr.Disabled(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if disabled {
+		return nil, fmt.Errorf("%s is disabled", name)
+	}
+	if on, reason := maintenanceEnabled(); on {
+		return nil, fmt.Errorf("%s is paused, maintenance mode is on: %s", name, reason)
+	}
+
+	updateMu.Lock()
+	defer updateMu.Unlock()
+
+	md, err := getMetadata(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get metadata: %w", err)
+	}
+	if md == nil {
+		return nil, errors.New("no metadata available")
+	}
+	// The other managers see the changes since oldMetadata on the next update.
+	newMetadata = md
+
+	logger.Infof("Running %s as requested through the command monitor.", name)
+	if err := mgr.Set(ctx); err != nil {
+		return nil, err
+	}
+	return json.Marshal(command.Response{StatusMessage: name + " ran"})
+}
+
+// dumpAgentState returns the agent's version, managers and jobs.
+func dumpAgentState(ctx context.Context, jobs []scheduler.Job) agentStateResponse {
+	res := agentStateResponse{Version: version, OS: runtime.GOOS}
+	if on, reason := maintenanceEnabled(); on {
+		res.Maintenance = reason
+	}
+
+	updateMu.Lock()
+	if newMetadata != nil {
+		res.InstanceID = newMetadata.Instance.ID.String()
+	}
+	updateMu.Unlock()
+
+	for _, mgr := range availableManagers() {
+		disabled, err := mgr.Disabled(ctx)
+		if err != nil {
+			logger.Errorf("Failed to check whether %s is disabled: %v", managerName(mgr), err)
+		}
+		res.Managers = append(res.Managers, managerState{Name: managerName(mgr), Disabled: disabled})
+	}
+	for _, job := range jobs {
+		res.Jobs = append(res.Jobs, jobState{ID: job.ID(), Scheduled: scheduler.Get().IsScheduled(job.ID())})
+	}
+	return res
+}
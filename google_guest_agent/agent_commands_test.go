@@ -0,0 +1,103 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/command"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/scheduler"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+)
+
+// commandTestMgr is a manager recording the metadata it ran with.
+type commandTestMgr struct {
+	disabled bool
+	err      error
+	ranWith  *metadata.Descriptor
+}
+
+func (m *commandTestMgr) Diff(ctx context.Context) (bool, error)     { return false, nil }
+func (m *commandTestMgr) Disabled(ctx context.Context) (bool, error) { return m.disabled, nil }
+func (m *commandTestMgr) Timeout(ctx context.Context) (bool, error)  { return false, nil }
+func (m *commandTestMgr) Set(ctx context.Context) error {
+	m.ranWith = newMetadata
+	return m.err
+}
+
+func TestForceManager(t *testing.T) {
+	ctx := context.Background()
+	md := &metadata.Descriptor{}
+	md.Instance.ID = "1234"
+
+	origGetMetadata, origNewMetadata, origEnabled := getMetadata, newMetadata, maintenanceEnabled
+	t.Cleanup(func() { getMetadata, newMetadata, maintenanceEnabled = origGetMetadata, origNewMetadata, origEnabled })
+	getMetadata = func(ctx context.Context) (*metadata.Descriptor, error) { return md, nil }
+	maintenanceEnabled = func() (bool, string) { return false, "" }
+	newMetadata = &metadata.Descriptor{}
+
+	mgr := &commandTestMgr{}
+	b, err := forceManager(ctx, mgr)
+	if err != nil {
+		t.Fatalf("forceManager(ctx, %+v) failed unexpectedly with error: %v", mgr, err)
+	}
+	if mgr.ranWith != md {
+		t.Errorf("forceManager(ctx, %+v) ran the manager with %+v, want the current metadata", mgr, mgr.ranWith)
+	}
+	var res command.Response
+	if err := json.Unmarshal(b, &res); err != nil || res.Status != 0 {
+		t.Errorf("forceManager(ctx, %+v) = %s, want a successful response", mgr, b)
+	}
+
+	for _, mgr := range []*commandTestMgr{{disabled: true}, {err: errors.New("set failed")}} {
+		if _, err := forceManager(ctx, mgr); err == nil {
+			t.Errorf("forceManager(ctx, %+v) succeeded, want error", mgr)
+		}
+	}
+
+	getMetadata = func(ctx context.Context) (*metadata.Descriptor, error) { return nil, errors.New("mds unavailable") }
+	mgr = &commandTestMgr{}
+	if _, err := forceManager(ctx, mgr); err == nil || mgr.ranWith != nil {
+		t.Errorf("forceManager(ctx, %+v) = %v, want error without running the manager", mgr, err)
+	}
+}
+
+func TestDumpAgentState(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	origNewMetadata := newMetadata
+	t.Cleanup(func() { newMetadata = origNewMetadata })
+	newMetadata = &metadata.Descriptor{}
+	newMetadata.Instance.ID = "1234"
+
+	res := dumpAgentState(context.Background(), nil)
+	if res.InstanceID != "1234" {
+		t.Errorf("dumpAgentState() = instance ID %q, want 1234", res.InstanceID)
+	}
+	if len(res.Managers) != len(availableManagers()) || res.Managers[0].Name != "addressMgr" {
+		t.Errorf("dumpAgentState() = managers %+v, want the available managers starting with addressMgr", res.Managers)
+	}
+
+	job := newWindowsTimeJob(nil)
+	res = dumpAgentState(context.Background(), []scheduler.Job{job})
+	if len(res.Jobs) != 1 || res.Jobs[0].ID != windowsTimeJobID || res.Jobs[0].Scheduled {
+		t.Errorf("dumpAgentState() = jobs %+v, want the unscheduled %s job", res.Jobs, windowsTimeJobID)
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// bitLockerEscrowID is the BitLocker recovery key escrow job's ID.
+	bitLockerEscrowID = "bitlocker-escrow"
+	// bitLockerEscrowedRegKey is the registry value listing the escrowed
+	// recovery key protectors, as mount point|protector ID entries.
+	bitLockerEscrowedRegKey = "BitLockerEscrowed"
+
+	// escrowGuestAttributes escrows the recovery keys to the guest attributes.
+	escrowGuestAttributes = "guest-attributes"
+	// escrowSecretManager escrows the recovery keys to a Secret Manager secret.
+	escrowSecretManager = "secret-manager"
+
+	// defaultBitLockerCheckInterval is used if check_interval is not a valid
+	// duration.
+	defaultBitLockerCheckInterval = 10 * time.Minute
+
+	// bitLockerQueryCommand prints the mount point, protector ID and recovery
+	// password of the recovery password protectors of the volumes.
+	bitLockerQueryCommand = "Get-BitLockerVolume | ForEach-Object { $v = $_; $_.KeyProtector | " +
+		"Where-Object KeyProtectorType -eq 'RecoveryPassword' | " +
+		"ForEach-Object { $v.MountPoint + '|' + $_.KeyProtectorId + '|' + $_.RecoveryPassword } }"
+)
+
+// recoveryKey is a BitLocker recovery password protector of a volume.
+type recoveryKey struct {
+	MountPoint       string `json:"mountPoint"`
+	ProtectorID      string `json:"protectorId"`
+	RecoveryPassword string `json:"recoveryPassword"`
+}
+
+// id returns the key's mount point|protector ID identifier, recorded once
+// escrowed.
+func (k recoveryKey) id() string {
+	return k.MountPoint + "|" + k.ProtectorID
+}
+
+// guestAttributesDeleter is implemented by the metadata clients able to delete
+// guest attributes, i.e. *metadata.Client.
+type guestAttributesDeleter interface {
+	DeleteGuestAttributes(context.Context, string) error
+}
+
+// bitLockerEscrow escrows the BitLocker recovery keys to the guest attributes
+// or Secret Manager whenever a volume is protected or its keys rotate.
+type bitLockerEscrow struct {
+	client metadata.MDSClientInterface
+}
+
+// newBitLockerEscrow returns the BitLocker recovery key escrow job accessing
+// the metadata server with client.
+func newBitLockerEscrow(client metadata.MDSClientInterface) *bitLockerEscrow {
+	return &bitLockerEscrow{client: client}
+}
+
+// ID returns the BitLocker recovery key escrow job's ID.
+func (e *bitLockerEscrow) ID() string {
+	return bitLockerEscrowID
+}
+
+// Interval returns the configured check interval.
+func (e *bitLockerEscrow) Interval() (time.Duration, bool) {
+	interval, err := time.ParseDuration(cfg.Get().BitLocker.CheckInterval)
+	if err != nil || interval <= 0 {
+		logger.Errorf("BitLocker check_interval configuration is not a valid duration string, falling back to %s", defaultBitLockerCheckInterval)
+		return defaultBitLockerCheckInterval, true
+	}
+	return interval, true
+}
+
+// ShouldEnable returns true on Windows if an escrow destination is
+// configured.
+func (e *bitLockerEscrow) ShouldEnable(ctx context.Context) bool {
+	config := cfg.Get().BitLocker
+	switch config.Escrow {
+	case "":
+		return false
+	case escrowGuestAttributes, escrowSecretManager:
+		return runtime.GOOS == "windows"
+	}
+	logger.Errorf("Unknown BitLocker escrow destination %q, not escrowing the recovery keys", config.Escrow)
+	return false
+}
+
+// Run escrows the recovery keys if they changed since last escrowed.
+func (e *bitLockerEscrow) Run(ctx context.Context) (bool, error) {
+	if pausedForMaintenance(e.ID()) {
+		return true, nil
+	}
+
+	config := cfg.Get().BitLocker
+
+	out, err := runPowerShellOutput(ctx, bitLockerQueryCommand)
+	if err != nil {
+		return true, fmt.Errorf("failed to get the BitLocker recovery keys: %w", err)
+	}
+	keys := parseRecoveryKeys(out)
+
+	escrowed, err := readRegMultiString(regKeyBase, bitLockerEscrowedRegKey)
+	if err != nil && err != errRegNotExist {
+		return true, err
+	}
+	ids := recoveryKeyIDs(keys)
+	if slices.Equal(ids, escrowed) {
+		return true, nil
+	}
+
+	logger.Infof("Escrowing %d BitLocker recovery keys to %s.", len(keys), config.Escrow)
+	switch config.Escrow {
+	case escrowGuestAttributes:
+		err = e.escrowToGuestAttributes(ctx, config.GuestAttributesNamespace, keys, escrowed)
+	case escrowSecretManager:
+		err = escrowToSecretManager(ctx, e.client, config.Secret, keys)
+	}
+	if err != nil {
+		return true, fmt.Errorf("failed to escrow the BitLocker recovery keys: %w", err)
+	}
+	return true, writeRegMultiString(regKeyBase, bitLockerEscrowedRegKey, ids)
+}
+
+// parseRecoveryKeys parses the mount point|protector ID|recovery password
+// lines of the BitLocker query command.
+func parseRecoveryKeys(out string) []recoveryKey {
+	var res []recoveryKey
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), "|")
+		if len(fields) != 3 || fields[2] == "" {
+			continue
+		}
+		res = append(res, recoveryKey{MountPoint: fields[0], ProtectorID: fields[1], RecoveryPassword: fields[2]})
+	}
+	return res
+}
+
+// recoveryKeyIDs returns the sorted identifiers of keys.
+func recoveryKeyIDs(keys []recoveryKey) []string {
+	var res []string
+	for _, k := range keys {
+		res = append(res, k.id())
+	}
+	slices.Sort(res)
+	return res
+}
+
+// recoveryKeyAttribute returns the guest attribute of the volume's recovery
+// keys in namespace, i.e. bitlocker/volume-C.
+func recoveryKeyAttribute(namespace, mountPoint string) string {
+	volume := strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, mountPoint)
+	return namespace + "/volume-" + volume
+}
+
+// escrowToGuestAttributes publishes the recovery keys of each volume to its
+// guest attribute in namespace, and deletes the attributes of the escrowed
+// volumes without recovery keys anymore.
+func (e *bitLockerEscrow) escrowToGuestAttributes(ctx context.Context, namespace string, keys []recoveryKey, escrowed []string) error {
+	volumes := make(map[string][]recoveryKey)
+	for _, k := range keys {
+		volumes[k.MountPoint] = append(volumes[k.MountPoint], k)
+	}
+
+	for _, id := range escrowed {
+		mountPoint, _, _ := strings.Cut(id, "|")
+		if _, found := volumes[mountPoint]; found {
+			continue
+		}
+		if err := e.deleteGuestAttribute(ctx, recoveryKeyAttribute(namespace, mountPoint)); err != nil {
+			return err
+		}
+		// Volumes have multiple protectors, only delete the attribute once.
+		volumes[mountPoint] = nil
+	}
+
+	for mountPoint, vkeys := range volumes {
+		if len(vkeys) == 0 {
+			continue
+		}
+		data, err := json.Marshal(vkeys)
+		if err != nil {
+			return err
+		}
+		if err := e.client.WriteGuestAttributes(ctx, recoveryKeyAttribute(namespace, mountPoint), string(data)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteGuestAttribute deletes the guest attribute key, clearing it if the
+// metadata client can't delete attributes.
+func (e *bitLockerEscrow) deleteGuestAttribute(ctx context.Context, key string) error {
+	logger.Infof("Deleting the BitLocker recovery keys guest attribute %s.", key)
+	if deleter, ok := e.client.(guestAttributesDeleter); ok {
+		return deleter.DeleteGuestAttributes(ctx, key)
+	}
+	return e.client.WriteGuestAttributes(ctx, key, "")
+}
+
+// escrowToSecretManager adds the recovery keys as a new version of the Secret
+// Manager secret, i.e. projects/<project>/secrets/<secret>, with the default
+// service account.
+func escrowToSecretManager(ctx context.Context, client metadata.MDSClientInterface, secret string, keys []recoveryKey) error {
+	if secret == "" {
+		return fmt.Errorf("no secret configured")
+	}
+	auth, err := authorizationHeader(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	var body struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	body.Payload.Data = base64.StdEncoding.EncodeToString(data)
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, secretManagerURL+strings.TrimPrefix(secret, "/")+":addVersion", bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := secretManagerClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 1<<20))
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to add a version to secret %s: %s", secret, res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseRecoveryKeys(t *testing.T) {
+	out := "C:|{1111}|111111-222222\r\n\r\nD:|{2222}|333333-444444\r\nE:|{3333}|\r\ngarbage\r\n"
+	want := []recoveryKey{
+		{MountPoint: "C:", ProtectorID: "{1111}", RecoveryPassword: "111111-222222"},
+		{MountPoint: "D:", ProtectorID: "{2222}", RecoveryPassword: "333333-444444"},
+	}
+
+	got := parseRecoveryKeys(out)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("parseRecoveryKeys(%q) returned unexpected diff (-want +got):\n%s", out, diff)
+	}
+
+	wantIDs := []string{"C:|{1111}", "D:|{2222}"}
+	if diff := cmp.Diff(wantIDs, recoveryKeyIDs([]recoveryKey{got[1], got[0]})); diff != "" {
+		t.Errorf("recoveryKeyIDs() returned unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestRecoveryKeyAttribute(t *testing.T) {
+	tests := []struct {
+		mountPoint string
+		want       string
+	}{
+		{mountPoint: "C:", want: "bitlocker/volume-C"},
+		{mountPoint: `\\?\Volume{1234-abcd}\`, want: "bitlocker/volume-Volume1234abcd"},
+	}
+
+	for _, tc := range tests {
+		if got := recoveryKeyAttribute("bitlocker", tc.mountPoint); got != tc.want {
+			t.Errorf("recoveryKeyAttribute(bitlocker, %q) = %q, want %q", tc.mountPoint, got, tc.want)
+		}
+	}
+}
+
+// deletingGuestAttributesClient is a guestAttributesClient able to delete
+// attributes.
+type deletingGuestAttributesClient struct {
+	guestAttributesClient
+}
+
+func (c *deletingGuestAttributesClient) DeleteGuestAttributes(_ context.Context, key string) error {
+	delete(c.attributes, key)
+	return nil
+}
+
+func TestEscrowToGuestAttributes(t *testing.T) {
+	ctx := context.Background()
+	client := &deletingGuestAttributesClient{guestAttributesClient{attributes: map[string]string{
+		"bitlocker/volume-C": "[]",
+		"bitlocker/volume-D": "[]",
+	}}}
+	e := newBitLockerEscrow(client)
+	keys := []recoveryKey{{MountPoint: "C:", ProtectorID: "{1111}", RecoveryPassword: "111111-222222"}}
+	escrowed := []string{"C:|{0000}", "D:|{2222}", "D:|{3333}"}
+
+	if err := e.escrowToGuestAttributes(ctx, "bitlocker", keys, escrowed); err != nil {
+		t.Fatalf("escrowToGuestAttributes(ctx, bitlocker, %+v, %v) failed unexpectedly with error: %v", keys, escrowed, err)
+	}
+	want := map[string]string{
+		"bitlocker/volume-C": `[{"mountPoint":"C:","protectorId":"{1111}","recoveryPassword":"111111-222222"}]`,
+	}
+	if diff := cmp.Diff(want, client.attributes); diff != "" {
+		t.Errorf("escrowToGuestAttributes() returned unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestEscrowToSecretManager(t *testing.T) {
+	keys := []recoveryKey{{MountPoint: "C:", ProtectorID: "{1111}", RecoveryPassword: "111111-222222"}}
+	var got []recoveryKey
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.Method != http.MethodPost || r.URL.Path != "/projects/p/secrets/s:addVersion" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("failed to read request body: %v", err)
+		}
+		var req struct {
+			Payload struct {
+				Data string `json:"data"`
+			} `json:"payload"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Errorf("failed to unmarshal request %q: %v", body, err)
+		}
+		data, err := base64.StdEncoding.DecodeString(req.Payload.Data)
+		if err != nil {
+			t.Errorf("failed to decode payload %q: %v", req.Payload.Data, err)
+		}
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Errorf("failed to unmarshal payload %q: %v", data, err)
+		}
+		w.Write([]byte(`{"name": "projects/p/secrets/s/versions/2"}`))
+	}))
+	defer srv.Close()
+	origURL := secretManagerURL
+	t.Cleanup(func() { secretManagerURL = origURL })
+	secretManagerURL = srv.URL + "/"
+
+	client := &osloginMDSClient{pages: map[string]string{
+		accessTokenKey: `{"access_token": "token", "token_type": "Bearer"}`,
+	}}
+	ctx := context.Background()
+
+	if err := escrowToSecretManager(ctx, client, "projects/p/secrets/s", keys); err != nil {
+		t.Fatalf("escrowToSecretManager(ctx, client, projects/p/secrets/s, %+v) failed unexpectedly with error: %v", keys, err)
+	}
+	if diff := cmp.Diff(keys, got); diff != "" {
+		t.Errorf("escrowToSecretManager() escrowed unexpected keys (-want +got):\n%s", diff)
+	}
+
+	if err := escrowToSecretManager(ctx, client, "projects/p/secrets/other", keys); err == nil {
+		t.Errorf("escrowToSecretManager(ctx, client, projects/p/secrets/other, %+v) succeeded, want error", keys)
+	}
+	if err := escrowToSecretManager(ctx, client, "", keys); err == nil {
+		t.Errorf("escrowToSecretManager(ctx, client, \"\", %+v) succeeded, want error", keys)
+	}
+}
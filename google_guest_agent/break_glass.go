@@ -0,0 +1,191 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-agent/utils"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// accessTokenKey is the metadata key of the default service account's
+	// OAuth access token.
+	accessTokenKey = "instance/service-accounts/default/token"
+	// breakGlassRefreshInterval is the interval at which the break-glass
+	// account's keys are fetched again, the secret or attribute they are read
+	// from can change without the metadata SSH keys changing.
+	breakGlassRefreshInterval = 15 * time.Minute
+)
+
+var (
+	// secretManagerURL is the Secret Manager API endpoint, overridden in tests.
+	secretManagerURL = "https://secretmanager.googleapis.com/v1/"
+	// secretManagerClient is the HTTP client accessing Secret Manager.
+	secretManagerClient = &http.Client{Timeout: 30 * time.Second}
+	// breakGlassFetched is when the break-glass account's keys were last
+	// fetched.
+	breakGlassFetched time.Time
+)
+
+// breakGlassMgr provisions the break-glass account. It's separate from the
+// accounts manager as the account must stay usable while OS Login is enabled.
+type breakGlassMgr struct{}
+
+func (b *breakGlassMgr) Diff(ctx context.Context) (bool, error) {
+	return !breakGlassWritten, nil
+}
+
+func (b *breakGlassMgr) Timeout(ctx context.Context) (bool, error) {
+	return breakGlassRefreshDue(cfg.Get()), nil
+}
+
+func (b *breakGlassMgr) Disabled(ctx context.Context) (bool, error) {
+	config := cfg.Get()
+	return runtime.GOOS == "windows" || config.Accounts.BreakGlassUser == "" || !config.Daemons.AccountsDaemon, nil
+}
+
+func (b *breakGlassMgr) Set(ctx context.Context) error {
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+	config := cfg.Get()
+
+	// The accounts manager doesn't run with OS Login enabled, the break-glass
+	// account still needs the google-sudoers group.
+	if err := createSudoersFile(ctx, config); err != nil {
+		logger.Errorf("Error creating google-sudoers file: %v.", err)
+	}
+	if err := createSudoersGroup(ctx, config); err != nil {
+		logger.Errorf("Error creating google-sudoers group: %v.", err)
+	}
+	return provisionBreakGlassUser(ctx, config)
+}
+
+// breakGlassRefreshDue returns true if a break-glass account is configured and
+// its keys were last fetched breakGlassRefreshInterval ago.
+func breakGlassRefreshDue(config *cfg.Sections) bool {
+	if config.Accounts.BreakGlassUser == "" {
+		return false
+	}
+	return time.Since(breakGlassFetched) >= breakGlassRefreshInterval
+}
+
+// getBreakGlassKeys returns the break-glass account's keys from the configured
+// instance attribute or Secret Manager secret version, the secret taking
+// precedence. Invalid keys are logged and skipped.
+func getBreakGlassKeys(ctx context.Context, client metadata.MDSClientInterface, config *cfg.Sections) ([]string, error) {
+	user := config.Accounts.BreakGlassUser
+	var content string
+	var err error
+	switch {
+	case config.Accounts.BreakGlassKeySecret != "":
+		content, err = accessSecret(ctx, client, config.Accounts.BreakGlassKeySecret)
+	case config.Accounts.BreakGlassKeyAttribute != "":
+		content, err = client.GetKey(ctx, "instance/attributes/"+config.Accounts.BreakGlassKeyAttribute, nil)
+	default:
+		return nil, fmt.Errorf("no key source configured for break-glass user %s", user)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get keys of break-glass user %s: %w", user, err)
+	}
+
+	var keys []string
+	for _, key := range strings.Split(content, "\n") {
+		key = strings.TrimSpace(key)
+		if key == "" || strings.HasPrefix(key, "#") {
+			continue
+		}
+		if err := utils.ValidateUserKey(user, key); err != nil {
+			logger.Warningf("Skipping key of break-glass user %s: %v", user, err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// authorizationHeader returns the Authorization header value of the default
+// service account's access token.
+func authorizationHeader(ctx context.Context, client metadata.MDSClientInterface) (string, error) {
+	resp, err := client.GetKey(ctx, accessTokenKey, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to get access token: %w", err)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+	}
+	if err := json.Unmarshal([]byte(resp), &token); err != nil {
+		return "", fmt.Errorf("failed to parse access token: %w", err)
+	}
+	if token.TokenType == "" {
+		token.TokenType = "Bearer"
+	}
+	return token.TokenType + " " + token.AccessToken, nil
+}
+
+// accessSecret returns the payload of the Secret Manager secret version, i.e.
+// projects/<project>/secrets/<secret>/versions/latest, accessed with the
+// default service account.
+func accessSecret(ctx context.Context, client metadata.MDSClientInterface, version string) (string, error) {
+	auth, err := authorizationHeader(ctx, client)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, secretManagerURL+strings.TrimPrefix(version, "/")+":access", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", auth)
+	res, err := secretManagerClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to access secret %s: %s", version, res.Status)
+	}
+
+	var secret struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return "", fmt.Errorf("failed to parse secret %s: %w", version, err)
+	}
+	data, err := base64.StdEncoding.DecodeString(secret.Payload.Data)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode secret %s: %w", version, err)
+	}
+	return string(data), nil
+}
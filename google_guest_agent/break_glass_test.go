@@ -0,0 +1,156 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-agent/utils"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestGetBreakGlassKeys(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+	ctx := context.Background()
+	origAccounts := config.Accounts
+	t.Cleanup(func() { config.Accounts = origAccounts })
+
+	key1 := "ssh-rsa " + utils.MakeRandRSAPubKey(t) + " admin@corp"
+	key2 := "ssh-rsa " + utils.MakeRandRSAPubKey(t)
+	content := fmt.Sprintf("# Emergency keys\n%s\n\nssh-rsa invalid\n%s\n", key1, key2)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Path != "/projects/p/secrets/s/versions/latest:access" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"payload": {"data": %q}}`, base64.StdEncoding.EncodeToString([]byte(content)))
+	}))
+	defer srv.Close()
+	origURL := secretManagerURL
+	t.Cleanup(func() { secretManagerURL = origURL })
+	secretManagerURL = srv.URL + "/"
+
+	client := &osloginMDSClient{pages: map[string]string{
+		"instance/attributes/break-glass-keys": content,
+		accessTokenKey:                         `{"access_token": "token", "token_type": "Bearer"}`,
+	}}
+	want := []string{key1, key2}
+
+	tests := []struct {
+		name      string
+		attribute string
+		secret    string
+		wantErr   bool
+	}{
+		{name: "attribute", attribute: "break-glass-keys"},
+		{name: "secret", attribute: "break-glass-keys", secret: "projects/p/secrets/s/versions/latest"},
+		{name: "missing_secret", secret: "projects/p/secrets/other/versions/latest", wantErr: true},
+		{name: "missing_attribute", attribute: "other", wantErr: true},
+		{name: "no_source", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config.Accounts = &cfg.Accounts{
+				BreakGlassUser:         "breakglass",
+				BreakGlassKeyAttribute: tc.attribute,
+				BreakGlassKeySecret:    tc.secret,
+			}
+			got, err := getBreakGlassKeys(ctx, client, config)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("getBreakGlassKeys() = %v, want error: %t", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("getBreakGlassKeys() returned unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestBreakGlassRefreshDue(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+	origFetched := breakGlassFetched
+	t.Cleanup(func() {
+		breakGlassFetched = origFetched
+		config.Accounts.BreakGlassUser = ""
+	})
+
+	if breakGlassRefreshDue(config) {
+		t.Errorf("breakGlassRefreshDue() = true without a break-glass user, want false")
+	}
+
+	config.Accounts.BreakGlassUser = "breakglass"
+	breakGlassFetched = time.Now()
+	if breakGlassRefreshDue(config) {
+		t.Errorf("breakGlassRefreshDue() = true right after a fetch, want false")
+	}
+
+	breakGlassFetched = time.Now().Add(-breakGlassRefreshInterval)
+	if !breakGlassRefreshDue(config) {
+		t.Errorf("breakGlassRefreshDue() = false %s after a fetch, want true", breakGlassRefreshInterval)
+	}
+}
+
+func TestBreakGlassMgrOSLoginEnabled(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+	origNewMetadata := newMetadata
+	t.Cleanup(func() {
+		newMetadata = origNewMetadata
+		config.Accounts.BreakGlassUser = ""
+	})
+
+	enable := true
+	newMetadata = &metadata.Descriptor{}
+	newMetadata.Instance.Attributes.EnableOSLogin = &enable
+	config.Accounts.BreakGlassUser = "breakglass"
+	ctx := context.Background()
+
+	if disabled, _ := (&accountsMgr{}).Disabled(ctx); !disabled {
+		t.Errorf("accountsMgr.Disabled() = false with OS Login enabled, want true")
+	}
+	if disabled, _ := (&breakGlassMgr{}).Disabled(ctx); disabled {
+		t.Errorf("breakGlassMgr.Disabled() = true with OS Login enabled, want false")
+	}
+
+	config.Accounts.BreakGlassUser = ""
+	if disabled, _ := (&breakGlassMgr{}).Disabled(ctx); !disabled {
+		t.Errorf("breakGlassMgr.Disabled() = false without a break-glass user, want true")
+	}
+}
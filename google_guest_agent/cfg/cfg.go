@@ -45,14 +45,41 @@ const (
 cloud_logging_enabled = true
 
 [Accounts]
+audit_cloud_logging = false
+audit_file =
+authorized_keys_cache_max_staleness = 0
+break_glass_key_attribute =
+break_glass_key_secret =
+break_glass_user =
+deprovision_post_cmd =
+deprovision_pre_cmd =
 deprovision_remove = false
+gid_range =
 gpasswd_add_cmd = gpasswd -a {user} {group}
 gpasswd_remove_cmd = gpasswd -d {user} {group}
 groupadd_cmd = groupadd {group}
 groups = adm,dip,docker,lxd,plugdev,video
+home_base =
+key_sync_debounce = 0
+limit_nofile =
+limit_nproc =
+protected_users =
+publish_users_interval = 0
 reuse_homedir = false
+shell =
+skel_dir =
+sudoers_template = %{group} ALL=(ALL:ALL) NOPASSWD:ALL
+uid_range =
 useradd_cmd = useradd -m -s /bin/bash -p * {user}
 userdel_cmd = userdel -r {user}
+user_slice_properties =
+windows_authorized_keys_files = false
+
+[BitLocker]
+check_interval = 10m
+escrow =
+guest_attributes_namespace = bitlocker
+secret =
 
 [Daemons]
 accounts_daemon = true
@@ -63,6 +90,16 @@ network_daemon = true
 ethernet_proto_id = 66
 ip_aliases = true
 target_instance_ips = true
+route_reconcile_interval = 60s
+windows_ip_aliases = false
+
+[GracefulShutdown]
+audit_file =
+max_duration = 10m
+sandbox_user =
+sandbox_cpu_quota =
+sandbox_memory_max =
+sandbox_no_network = false
 
 [Instance]
 instance_id =
@@ -71,20 +108,57 @@ instance_id_dir = /etc/google_instance_id
 [InstanceSetup]
 host_key_dir = /etc/ssh
 host_key_types = ecdsa,ed25519,rsa
+host_key_rotation_interval = 0
 network_enabled = true
 optimize_local_ssd = true
 set_boto_config = true
 set_host_keys = true
 set_multiqueue = true
 
+[Maintenance]
+enable = false
+
 [MetadataScripts]
+authenticode_publishers =
+cloud_init_mode =
+cloud_init_semaphore =
 default_shell = /bin/bash
+download_cache = false
+download_cache_dir =
+download_timeout = 10m
+expand_templates = false
+local_scripts_dir =
+max_parallel_scripts = 4
+output_max_bytes = 10485760
+output_rate_limit = 100
+require_authenticode = false
+require_signature = false
 run_dir =
+run_once_dir =
+sandbox_cpu_quota =
+sandbox_memory_max =
+sandbox_namespaces = false
+sandbox_user =
+script_timeout =
 shutdown = true
 shutdown-windows = true
+shutdown_retry_attempts = 1
+shutdown_retry_backoff =
+shutdown_retry_exit_codes =
+shutdown_timeout =
+signature_keys =
 startup = true
 startup-windows = true
-sysprep-specialize = true
+startup_retry_attempts = 1
+startup_retry_backoff =
+startup_retry_exit_codes =
+startup_timeout =
+sysprep_generalize = true
+sysprep_generalize_timeout =
+sysprep_specialize = true
+sysprep_specialize_timeout =
+url_auth_audience =
+url_auth_hosts =
 
 [NetworkInterfaces]
 dhcp_command =
@@ -93,14 +167,43 @@ setup = true
 manage_primary_nic =
 restore_debian12_netplan_config = true
 vlan_setup_enabled = false
+hotplug = true
+policy_routing = false
+networkd_priority = 20
+networkd_dns =
+networkd_domains =
+networkd_route_metric =
+verify_connectivity = true
+stable_interface_names = false
+bond_nics =
+bond_mode = active-backup
+ignore_interfaces = cali*,cilium*,docker*,veth*,flannel*,cni*,virbr*,lxc*,kube-*
+drift_check_interval = 60s
+drift_reapply = true
+mss_clamp = false
+rp_filter =
+arp_announce =
+accept_ra =
+manage_router_advertisements = false
+multiqueue_policy =
+multiqueue_max_queues = 0
+windows_nic_properties =
 
 [OSLogin]
+backend = nss
+cache_watch_interval = 0
 cert_authentication = true
+sssd_allow_groups =
 
 [MDS]
 disable-https-mds-setup = true
 enable-https-mds-native-cert-store = false
 
+[RemoteAccessCerts]
+rdp = false
+rotation_interval = 720h
+winrm = false
+
 [Snapshots]
 enabled = false
 snapshot_service_ip = 169.254.169.254
@@ -113,6 +216,28 @@ command_pipe_mode = 0770
 command_pipe_group =
 command_request_timeout = 10s
 systemd_config_dir = /usr/lib/systemd/network
+
+[Watchdog]
+check_interval = 1m
+enable = true
+service_recovery = true
+stall_timeout = 30m
+
+[WindowsActivation]
+check_interval = 1h
+enable = true
+kms_fallback_ip = 35.190.247.13
+kms_host = kms.windows.googlecloud.com
+kms_port = 1688
+
+[WindowsFirewall]
+enable = true
+
+[WindowsTime]
+check_interval = 1h
+enable = true
+ntp_server = metadata.google.internal
+poll_interval = 1024
 `
 )
 
@@ -143,6 +268,9 @@ type Sections struct {
 	// pointer is nil or not.
 	AddressManager *AddressManager `ini:"addressManager,omitempty"`
 
+	// BitLocker defines the escrow of the Windows BitLocker recovery keys.
+	BitLocker *BitLocker `ini:"BitLocker,omitempty"`
+
 	// Daemons defines the availability of clock skew, network and account managers.
 	Daemons *Daemons `ini:"Daemons,omitempty"`
 
@@ -152,6 +280,9 @@ type Sections struct {
 	// pointer is nil or not.
 	Diagnostics *Diagnostics `ini:"diagnostics,omitempty"`
 
+	// GracefulShutdown defines the graceful shutdown hooks execution and auditing options.
+	GracefulShutdown *GracefulShutdown `ini:"GracefulShutdown,omitempty"`
+
 	// IPForwarding defines the ip forwarding configuration options.
 	IPForwarding *IPForwarding `ini:"IpForwarding,omitempty"`
 
@@ -162,6 +293,9 @@ type Sections struct {
 	// host keys etc.
 	InstanceSetup *InstanceSetup `ini:"InstanceSetup,omitempty"`
 
+	// Maintenance defines the maintenance mode, pausing the accounts, network and scripts changes.
+	Maintenance *Maintenance `ini:"Maintenance,omitempty"`
+
 	// MetadataScripts contains the configurations of the metadata-scripts service.
 	MetadataScripts *MetadataScripts `ini:"MetadataScripts,omitempty"`
 
@@ -175,6 +309,9 @@ type Sections struct {
 	// MDS defines the MDS configuration options.
 	MDS *MDS `ini:"MDS,omitempty"`
 
+	// RemoteAccessCerts defines the rotation of the Windows RDP and WinRM TLS certificates.
+	RemoteAccessCerts *RemoteAccessCerts `ini:"RemoteAccessCerts,omitempty"`
+
 	// Snpashots defines the snapshot listener configuration and behavior i.e. the server address and port.
 	Snapshots *Snapshots `ini:"Snapshots,omitempty"`
 
@@ -182,6 +319,18 @@ type Sections struct {
 	// guaranteed for any keys under this section. No application, script or utility should rely on it.
 	Unstable *Unstable `ini:"Unstable,omitempty"`
 
+	// Watchdog defines the restart of wedged subsystems and of the agent's service.
+	Watchdog *Watchdog `ini:"Watchdog,omitempty"`
+
+	// WindowsActivation defines the Windows KMS activation and its state reporting.
+	WindowsActivation *WindowsActivation `ini:"WindowsActivation,omitempty"`
+
+	// WindowsFirewall defines the Windows Firewall rules of the agent's listeners.
+	WindowsFirewall *WindowsFirewall `ini:"WindowsFirewall,omitempty"`
+
+	// WindowsTime defines the Windows Time service configuration and sync state reporting.
+	WindowsTime *WindowsTime `ini:"WindowsTime,omitempty"`
+
 	// WSFC defines the wsfc configurations. It takes precedence over instance's and project's
 	// metadata configuration. The default configuration doesn't define values to it, if the user
 	// has defined it then we shouldn't even consider metadata values. Users must check if this
@@ -196,14 +345,56 @@ type AccountManager struct {
 
 // Accounts contains the configurations of Accounts section.
 type Accounts struct {
-	DeprovisionRemove bool   `ini:"deprovision_remove,omitempty"`
-	GPasswdAddCmd     string `ini:"gpasswd_add_cmd,omitempty"`
-	GPasswdRemoveCmd  string `ini:"gpasswd_remove_cmd,omitempty"`
-	GroupAddCmd       string `ini:"groupadd_cmd,omitempty"`
-	Groups            string `ini:"groups,omitempty"`
-	ReuseHomedir      bool   `ini:"reuse_homedir,omitempty"`
-	UserAddCmd        string `ini:"useradd_cmd,omitempty"`
-	UserDelCmd        string `ini:"userdel_cmd,omitempty"`
+	// AuditCloudLogging also sends the account audit records to Cloud Logging.
+	AuditCloudLogging bool `ini:"audit_cloud_logging,omitempty"`
+	// AuditFile is the path of the local JSON account audit file, if empty an
+	// OS specific default path is used.
+	AuditFile string `ini:"audit_file,omitempty"`
+	// AuthorizedKeysCacheMaxStaleness is the maximum age of the keys and OS
+	// Login decisions served from cache when the metadata server can't be
+	// reached, "0" disables the cache.
+	AuthorizedKeysCacheMaxStaleness string `ini:"authorized_keys_cache_max_staleness,omitempty"`
+	// BreakGlassUser is the emergency access account provisioned with the
+	// keys of BreakGlassKeyAttribute or BreakGlassKeySecret and never removed.
+	BreakGlassUser string `ini:"break_glass_user,omitempty"`
+	// BreakGlassKeyAttribute is the instance attribute holding the break-glass
+	// account's keys.
+	BreakGlassKeyAttribute string `ini:"break_glass_key_attribute,omitempty"`
+	// BreakGlassKeySecret is the Secret Manager secret version holding the
+	// break-glass account's keys, i.e.
+	// projects/<project>/secrets/<secret>/versions/latest.
+	BreakGlassKeySecret string `ini:"break_glass_key_secret,omitempty"`
+	DeprovisionPostCmd  string `ini:"deprovision_post_cmd,omitempty"`
+	DeprovisionPreCmd   string `ini:"deprovision_pre_cmd,omitempty"`
+	DeprovisionRemove   bool   `ini:"deprovision_remove,omitempty"`
+	GIDRange            string `ini:"gid_range,omitempty"`
+	GPasswdAddCmd       string `ini:"gpasswd_add_cmd,omitempty"`
+	GPasswdRemoveCmd    string `ini:"gpasswd_remove_cmd,omitempty"`
+	GroupAddCmd         string `ini:"groupadd_cmd,omitempty"`
+	Groups              string `ini:"groups,omitempty"`
+	HomeBase            string `ini:"home_base,omitempty"`
+	KeySyncDebounce     string `ini:"key_sync_debounce,omitempty"`
+	LimitNoFile         string `ini:"limit_nofile,omitempty"`
+	LimitNProc          string `ini:"limit_nproc,omitempty"`
+	ProtectedUsers      string `ini:"protected_users,omitempty"`
+	ReuseHomedir        bool   `ini:"reuse_homedir,omitempty"`
+	Shell               string `ini:"shell,omitempty"`
+	SkelDir             string `ini:"skel_dir,omitempty"`
+	SudoersTemplate     string `ini:"sudoers_template,omitempty"`
+	UIDRange            string `ini:"uid_range,omitempty"`
+	UserAddCmd          string `ini:"useradd_cmd,omitempty"`
+	UserDelCmd          string `ini:"userdel_cmd,omitempty"`
+	// UserSliceProperties is a comma separated list of systemd slice
+	// properties, i.e. MemoryMax=4G,TasksMax=512, applied to the user slices
+	// of the users provisioned from metadata.
+	UserSliceProperties string `ini:"user_slice_properties,omitempty"`
+	// PublishUsersInterval is the interval at which the managed users and
+	// the fingerprints of their keys are published to the guest attributes,
+	// "0" disables the publishing.
+	PublishUsersInterval string `ini:"publish_users_interval,omitempty"`
+	// WindowsAuthorizedKeysFiles makes the agent write the metadata SSH keys
+	// to the OpenSSH authorized keys files on Windows.
+	WindowsAuthorizedKeysFiles bool `ini:"windows_authorized_keys_files,omitempty"`
 }
 
 // AddressManager contains the configuration of addressManager section.
@@ -211,6 +402,22 @@ type AddressManager struct {
 	Disable bool `ini:"disable,omitempty"`
 }
 
+// BitLocker contains the configurations of BitLocker section.
+type BitLocker struct {
+	// CheckInterval is the interval at which the recovery keys are checked
+	// for changes.
+	CheckInterval string `ini:"check_interval,omitempty"`
+	// Escrow is where the recovery keys are escrowed: guest-attributes or
+	// secret-manager, empty disables the escrow.
+	Escrow string `ini:"escrow,omitempty"`
+	// GuestAttributesNamespace is the guest attributes namespace the recovery
+	// keys are published to.
+	GuestAttributesNamespace string `ini:"guest_attributes_namespace,omitempty"`
+	// Secret is the Secret Manager secret the recovery keys are added to as a
+	// new version, i.e. projects/<project>/secrets/<secret>.
+	Secret string `ini:"secret,omitempty"`
+}
+
 // Daemons contains the configurations of Daemons section.
 type Daemons struct {
 	AccountsDaemon  bool `ini:"accounts_daemon,omitempty"`
@@ -223,11 +430,40 @@ type Diagnostics struct {
 	Enable bool `ini:"enable,omitempty"`
 }
 
+// GracefulShutdown contains the configurations of GracefulShutdown section.
+type GracefulShutdown struct {
+	// AuditFile is the path of the local JSON audit file, if empty an OS
+	// specific default path is used.
+	AuditFile string `ini:"audit_file,omitempty"`
+	// MaxDuration is the time the hooks are given to run before the instance is
+	// stopped, it should match the instance's graceful shutdown max duration.
+	MaxDuration string `ini:"max_duration,omitempty"`
+	// SandboxUser is the user running the graceful shutdown scripts on Linux,
+	// if empty the scripts run as root.
+	SandboxUser string `ini:"sandbox_user,omitempty"`
+	// SandboxCPUQuota is the CPU quota (e.g. 50%) of the graceful shutdown
+	// scripts cgroup on Linux, if empty no limit is set.
+	SandboxCPUQuota string `ini:"sandbox_cpu_quota,omitempty"`
+	// SandboxMemoryMax is the memory limit (e.g. 512M) of the graceful shutdown
+	// scripts cgroup on Linux, if empty no limit is set.
+	SandboxMemoryMax string `ini:"sandbox_memory_max,omitempty"`
+	// SandboxNoNetwork runs the graceful shutdown scripts without network access
+	// on Linux.
+	SandboxNoNetwork bool `ini:"sandbox_no_network,omitempty"`
+}
+
 // IPForwarding contains the configurations of IPForwarding section.
 type IPForwarding struct {
 	EthernetProtoID   string `ini:"ethernet_proto_id,omitempty"`
 	IPAliases         bool   `ini:"ip_aliases,omitempty"`
 	TargetInstanceIPs bool   `ini:"target_instance_ips,omitempty"`
+	// RouteReconcileInterval is the interval at which the local routes of the
+	// forwarded IPs and alias IP ranges are verified and repaired, "0"
+	// disables the verification.
+	RouteReconcileInterval string `ini:"route_reconcile_interval,omitempty"`
+	// WindowsIPAliases enables assigning the alias IP ranges address by
+	// address on Windows, where they are otherwise left alone.
+	WindowsIPAliases bool `ini:"windows_ip_aliases,omitempty"`
 }
 
 // Instance contains the configurations of Instance section.
@@ -243,13 +479,22 @@ type Instance struct {
 
 // InstanceSetup contains the configurations of InstanceSetup section.
 type InstanceSetup struct {
-	HostKeyDir       string `ini:"host_key_dir,omitempty"`
-	HostKeyTypes     string `ini:"host_key_types,omitempty"`
-	NetworkEnabled   bool   `ini:"network_enabled,omitempty"`
-	OptimizeLocalSSD bool   `ini:"optimize_local_ssd,omitempty"`
-	SetBotoConfig    bool   `ini:"set_boto_config,omitempty"`
-	SetHostKeys      bool   `ini:"set_host_keys,omitempty"`
-	SetMultiqueue    bool   `ini:"set_multiqueue,omitempty"`
+	HostKeyDir   string `ini:"host_key_dir,omitempty"`
+	HostKeyTypes string `ini:"host_key_types,omitempty"`
+	// HostKeyRotationInterval is the maximum age of the SSH host keys before
+	// they are regenerated, "0" disables the rotation.
+	HostKeyRotationInterval string `ini:"host_key_rotation_interval,omitempty"`
+	NetworkEnabled          bool   `ini:"network_enabled,omitempty"`
+	OptimizeLocalSSD        bool   `ini:"optimize_local_ssd,omitempty"`
+	SetBotoConfig           bool   `ini:"set_boto_config,omitempty"`
+	SetHostKeys             bool   `ini:"set_host_keys,omitempty"`
+	SetMultiqueue           bool   `ini:"set_multiqueue,omitempty"`
+}
+
+// Maintenance contains the configurations of Maintenance section.
+type Maintenance struct {
+	// Enable turns the maintenance mode on until it's unset.
+	Enable bool `ini:"enable,omitempty"`
 }
 
 // MetadataScripts contains the configurations of MetadataScripts section.
@@ -261,11 +506,120 @@ type MetadataScripts struct {
 	Startup           bool   `ini:"startup,omitempty"`
 	StartupWindows    bool   `ini:"startup-windows,omitempty"`
 	SysprepSpecialize bool   `ini:"sysprep_specialize,omitempty"`
+	// ScriptTimeout is the default timeout of each script, a <key>-timeout
+	// metadata key overrides it for a given script. Empty means no timeout.
+	ScriptTimeout string `ini:"script_timeout,omitempty"`
+	// StartupTimeout is the timeout of the whole startup phase.
+	StartupTimeout string `ini:"startup_timeout,omitempty"`
+	// ShutdownTimeout is the timeout of the whole shutdown phase.
+	ShutdownTimeout string `ini:"shutdown_timeout,omitempty"`
+	// SysprepSpecializeTimeout is the timeout of the whole specialize phase.
+	SysprepSpecializeTimeout string `ini:"sysprep_specialize_timeout,omitempty"`
+	// SysprepGeneralize enables the Windows generalize phase scripts, run by
+	// sysprep before generalizing the image.
+	SysprepGeneralize bool `ini:"sysprep_generalize,omitempty"`
+	// SysprepGeneralizeTimeout is the timeout of the whole generalize phase.
+	SysprepGeneralizeTimeout string `ini:"sysprep_generalize_timeout,omitempty"`
+	// SandboxUser is the user running the scripts on Linux, if empty the
+	// scripts run as root.
+	SandboxUser string `ini:"sandbox_user,omitempty"`
+	// SandboxCPUQuota is the CPU quota (e.g. 50%) of each script's cgroup on
+	// Linux, if empty no limit is set.
+	SandboxCPUQuota string `ini:"sandbox_cpu_quota,omitempty"`
+	// SandboxMemoryMax is the memory limit (e.g. 512M) of each script's cgroup
+	// on Linux, if empty no limit is set.
+	SandboxMemoryMax string `ini:"sandbox_memory_max,omitempty"`
+	// SandboxNamespaces runs each script in its own mount and PID namespaces on
+	// Linux.
+	SandboxNamespaces bool `ini:"sandbox_namespaces,omitempty"`
+	// DownloadCache enables the local cache of the downloaded URL scripts.
+	DownloadCache bool `ini:"download_cache,omitempty"`
+	// DownloadCacheDir is the download cache directory, if empty an OS
+	// specific default directory is used.
+	DownloadCacheDir string `ini:"download_cache_dir,omitempty"`
+	// DownloadTimeout is the overall deadline of a script download, retries
+	// included. Empty means no deadline.
+	DownloadTimeout string `ini:"download_timeout,omitempty"`
+	// ExpandTemplates expands the template placeholders, i.e. {{.InstanceName}},
+	// in the scripts before running them.
+	ExpandTemplates bool `ini:"expand_templates,omitempty"`
+	// RequireSignature only runs the scripts with a valid detached signature
+	// made with one of the SignatureKeys.
+	RequireSignature bool `ini:"require_signature,omitempty"`
+	// SignatureKeys is a comma separated list of public key files verifying
+	// the scripts' signatures, either PEM encoded (i.e. cosign) or armored
+	// OpenPGP keys.
+	SignatureKeys string `ini:"signature_keys,omitempty"`
+	// URLAuthHosts is a comma separated list of hosts, i.e. artifacts.example.com
+	// or *.example.com, the HTTPS script URLs of which are downloaded with the
+	// service account's token.
+	URLAuthHosts string `ini:"url_auth_hosts,omitempty"`
+	// URLAuthAudience is the audience of the identity token sent to the
+	// URLAuthHosts, if empty an OAuth access token is sent instead.
+	URLAuthAudience string `ini:"url_auth_audience,omitempty"`
+	// RunOnceDir is where the fingerprints of the run-once scripts that ran are
+	// recorded, if empty an OS specific default directory is used.
+	RunOnceDir string `ini:"run_once_dir,omitempty"`
+	// CloudInitMode coordinates the startup scripts with cloud-init: defer
+	// skips them when cloud-init is present, fence runs them at most once per
+	// boot through the CloudInitSemaphore. Empty disables the coordination.
+	CloudInitMode string `ini:"cloud_init_mode,omitempty"`
+	// CloudInitSemaphore is the semaphore file fencing the startup scripts, if
+	// empty /run/google-metadata-scripts/startup.sem is used.
+	CloudInitSemaphore string `ini:"cloud_init_semaphore,omitempty"`
+	// OutputRateLimit is the number of output lines per second a script logs,
+	// the lines above it are dropped, 100 by default. 0 means unlimited.
+	OutputRateLimit int `ini:"output_rate_limit,omitempty"`
+	// OutputMaxBytes is the number of output bytes a script logs before its
+	// output is truncated, 10 MiB by default. 0 means unlimited.
+	OutputMaxBytes int64 `ini:"output_max_bytes,omitempty"`
+	// MaxParallelScripts is the number of scripts run at the same time when a
+	// phase has a dependencies manifest.
+	MaxParallelScripts int `ini:"max_parallel_scripts,omitempty"`
+	// RequireAuthenticode only runs the PowerShell scripts with a valid
+	// Authenticode signature on Windows.
+	RequireAuthenticode bool `ini:"require_authenticode,omitempty"`
+	// AuthenticodePublishers is a comma separated list of certificate
+	// thumbprints or common names allowed to sign the PowerShell scripts, any
+	// trusted signer is allowed if empty.
+	AuthenticodePublishers string `ini:"authenticode_publishers,omitempty"`
+	// StartupRetryAttempts is the number of times a failed startup script is
+	// run, 1 disables the retries.
+	StartupRetryAttempts int `ini:"startup_retry_attempts,omitempty"`
+	// StartupRetryBackoff is the delay before the first retry of a startup
+	// script, doubled after each attempt.
+	StartupRetryBackoff string `ini:"startup_retry_backoff,omitempty"`
+	// StartupRetryExitCodes is a comma separated list of the exit codes of the
+	// retried startup scripts, any non-zero exit code if empty.
+	StartupRetryExitCodes string `ini:"startup_retry_exit_codes,omitempty"`
+	// ShutdownRetryAttempts is the number of times a failed shutdown script is
+	// run, 1 disables the retries.
+	ShutdownRetryAttempts int `ini:"shutdown_retry_attempts,omitempty"`
+	// ShutdownRetryBackoff is the delay before the first retry of a shutdown
+	// script, doubled after each attempt.
+	ShutdownRetryBackoff string `ini:"shutdown_retry_backoff,omitempty"`
+	// ShutdownRetryExitCodes is a comma separated list of the exit codes of the
+	// retried shutdown scripts, any non-zero exit code if empty.
+	ShutdownRetryExitCodes string `ini:"shutdown_retry_exit_codes,omitempty"`
+	// LocalScriptsDir is the base directory of the phases' local scripts
+	// directories, i.e. <dir>/shutdown.d, if empty an OS specific default
+	// directory is used.
+	LocalScriptsDir string `ini:"local_scripts_dir,omitempty"`
 }
 
 // OSLogin contains the configurations of OSLogin section.
 type OSLogin struct {
-	CertAuthentication bool `ini:"cert_authentication,omitempty"`
+	// Backend selects how OS Login users and groups are resolved, "nss" uses
+	// the OS Login NSS modules and cache, "sssd" configures an sssd domain.
+	Backend string `ini:"backend,omitempty"`
+	// CacheWatchInterval is the interval at which the OS Login users and
+	// groups are polled to refresh the NSS cache when they change, "0"
+	// disables the polling.
+	CacheWatchInterval string `ini:"cache_watch_interval,omitempty"`
+	CertAuthentication bool   `ini:"cert_authentication,omitempty"`
+	// SSSDAllowGroups is a comma separated list of groups allowed to log in
+	// through the sssd backend, empty allows all OS Login users.
+	SSSDAllowGroups string `ini:"sssd_allow_groups,omitempty"`
 }
 
 // MDS contains the configurations for MDS section. Currently its opt-in only
@@ -289,6 +643,134 @@ type NetworkInterfaces struct {
 	ManagePrimaryNIC             bool   `ini:"manage_primary_nic,omitempty"`
 	RestoreDebian12NetplanConfig bool   `ini:"restore_debian12_netplan_config,omitempty"`
 	VlanSetupEnabled             bool   `ini:"vlan_setup_enabled,omitempty"`
+	// Hotplug enables the network interfaces hot-plug watcher, setting up
+	// the interfaces added while the agent is running.
+	Hotplug bool `ini:"hotplug,omitempty"`
+	// PolicyRouting enables the source-based policy routing of the secondary
+	// NICs, each one getting its own routing table.
+	PolicyRouting bool `ini:"policy_routing,omitempty"`
+	// NetworkdPriority is the file name prefix of the systemd-networkd configs
+	// written by the agent, configs with lower values take precedence.
+	NetworkdPriority int `ini:"networkd_priority,omitempty"`
+	// NetworkdDNS is a comma separated list of DNS servers added to the
+	// systemd-networkd configs.
+	NetworkdDNS string `ini:"networkd_dns,omitempty"`
+	// NetworkdDomains is a comma separated list of search domains added to
+	// the systemd-networkd configs.
+	NetworkdDomains string `ini:"networkd_domains,omitempty"`
+	// NetworkdRouteMetric is the metric of the routes systemd-networkd
+	// installs from DHCP, the systemd default is used when unset.
+	NetworkdRouteMetric int `ini:"networkd_route_metric,omitempty"`
+	// VerifyConnectivity enables checking the metadata server is still
+	// reachable after applying the network configuration, rolling it back
+	// otherwise.
+	VerifyConnectivity bool `ini:"verify_connectivity,omitempty"`
+	// StableInterfaceNames enables writing systemd .link files pinning the
+	// names of the metadata NICs to their MAC addresses.
+	StableInterfaceNames bool `ini:"stable_interface_names,omitempty"`
+	// BondNICs is a comma separated list of NIC indices enslaved into a bond
+	// managed by the agent, empty to disable bonding.
+	BondNICs string `ini:"bond_nics,omitempty"`
+	// BondMode is the bonding driver mode of the bond.
+	BondMode string `ini:"bond_mode,omitempty"`
+	// IgnoreInterfaces is a comma separated list of interface name glob
+	// patterns the agent never touches, i.e. the container networking ones.
+	IgnoreInterfaces string `ini:"ignore_interfaces,omitempty"`
+	// DriftCheckInterval is the interval at which the network configuration
+	// files written by the agent are checked for changes by other tools, 0
+	// disables the checks.
+	DriftCheckInterval string `ini:"drift_check_interval,omitempty"`
+	// DriftReapply enables applying the network configuration again when its
+	// files were changed by other tools, instead of only reporting it.
+	DriftReapply bool `ini:"drift_reapply,omitempty"`
+	// MSSClamp enables clamping the MSS of the TCP connections forwarded
+	// through the managed interfaces to the path MTU.
+	MSSClamp bool `ini:"mss_clamp,omitempty"`
+	// RPFilter is the rp_filter sysctl of the managed interfaces, left
+	// untouched if empty.
+	RPFilter string `ini:"rp_filter,omitempty"`
+	// ARPAnnounce is the arp_announce sysctl of the managed interfaces, left
+	// untouched if empty.
+	ARPAnnounce string `ini:"arp_announce,omitempty"`
+	// AcceptRA is the IPv6 accept_ra sysctl of the managed interfaces, left
+	// untouched if empty.
+	AcceptRA string `ini:"accept_ra,omitempty"`
+	// ManageRouterAdvertisements enables setting the accept_ra and autoconf
+	// sysctls of the IPv6 interfaces whose router advertisements are processed
+	// by the kernel, consistently with the agent's IPv6 configuration. It's
+	// opt-in as it changes the kernel's behavior on existing instances.
+	ManageRouterAdvertisements bool `ini:"manage_router_advertisements,omitempty"`
+	// MultiqueuePolicy is the RSS, IRQ affinity and XPS policy of the managed
+	// interfaces, "spread" spreads their queues across the vCPUs. The queues
+	// are left untouched if empty.
+	MultiqueuePolicy string `ini:"multiqueue_policy,omitempty"`
+	// MultiqueueMaxQueues caps the number of queues set by MultiqueuePolicy,
+	// 0 means no cap.
+	MultiqueueMaxQueues int `ini:"multiqueue_max_queues,omitempty"`
+	// WindowsNICProperties is a comma separated list of keyword=value NIC
+	// advanced properties set on Windows, i.e. *JumboPacket=9014. It takes
+	// precedence over the windows-nic-properties metadata attribute.
+	WindowsNICProperties string `ini:"windows_nic_properties,omitempty"`
+}
+
+// RemoteAccessCerts contains the configurations of RemoteAccessCerts section.
+type RemoteAccessCerts struct {
+	// RDP binds the rotated certificate to the Remote Desktop listener.
+	RDP bool `ini:"rdp,omitempty"`
+	// RotationInterval is the maximum age of the certificate before it is
+	// replaced, certificates are valid for twice this interval.
+	RotationInterval string `ini:"rotation_interval,omitempty"`
+	// WinRM binds the rotated certificate to the WinRM HTTPS listener,
+	// creating the listener if needed.
+	WinRM bool `ini:"winrm,omitempty"`
+}
+
+// Watchdog contains the configurations of Watchdog section.
+type Watchdog struct {
+	// CheckInterval is the interval at which the subsystems' runs are checked.
+	CheckInterval string `ini:"check_interval,omitempty"`
+	// Enable restarts the subsystems whose runs exceed StallTimeout.
+	Enable bool `ini:"enable,omitempty"`
+	// ServiceRecovery configures the Windows service to be restarted when the
+	// agent stops with an error, not only when it crashes.
+	ServiceRecovery bool `ini:"service_recovery,omitempty"`
+	// StallTimeout is the time after which a subsystem's run is considered
+	// wedged.
+	StallTimeout string `ini:"stall_timeout,omitempty"`
+}
+
+// WindowsActivation contains the configurations of WindowsActivation section.
+type WindowsActivation struct {
+	// CheckInterval is the interval at which the activation state is checked.
+	CheckInterval string `ini:"check_interval,omitempty"`
+	// Enable activates Windows against KMSHost when it's not activated.
+	Enable bool `ini:"enable,omitempty"`
+	// KMSFallbackIP is the KMS host's address used when KMSHost doesn't
+	// resolve, i.e. with custom DNS servers.
+	KMSFallbackIP string `ini:"kms_fallback_ip,omitempty"`
+	// KMSHost is the KMS host Windows is activated against.
+	KMSHost string `ini:"kms_host,omitempty"`
+	// KMSPort is the KMS host's port.
+	KMSPort int `ini:"kms_port,omitempty"`
+}
+
+// WindowsFirewall contains the configurations of WindowsFirewall section.
+type WindowsFirewall struct {
+	// Enable creates and removes the firewall rules of the agent's listeners.
+	Enable bool `ini:"enable,omitempty"`
+}
+
+// WindowsTime contains the configurations of WindowsTime section.
+type WindowsTime struct {
+	// CheckInterval is the interval at which the configuration and sync state
+	// are checked.
+	CheckInterval string `ini:"check_interval,omitempty"`
+	// Enable configures the Windows Time service to sync with NTPServer.
+	Enable bool `ini:"enable,omitempty"`
+	// NTPServer is the NTP server the Windows Time service syncs with.
+	NTPServer string `ini:"ntp_server,omitempty"`
+	// PollInterval is the NTP polling interval, in seconds.
+	PollInterval int `ini:"poll_interval,omitempty"`
 }
 
 // Snapshots contains the configurations of Snapshots section.
@@ -314,8 +796,19 @@ type Unstable struct {
 // WSFC contains the configurations of WSFC section.
 type WSFC struct {
 	Addresses string `ini:"addresses,omitempty"`
-	Enable    bool   `ini:"enable,omitempty"`
-	Port      string `ini:"port,omitempty"`
+	// AllowedSources is a comma separated list of IP addresses and CIDR ranges
+	// the health check agent accepts connections from, empty allows all sources
+	// but its firewall rule only allows the health check ranges.
+	AllowedSources string `ini:"allowed_sources,omitempty"`
+	// CertFile and KeyFile are the PEM encoded certificate and key the health
+	// check agent serves TLS with, the agent listens in plaintext if not set.
+	CertFile string `ini:"cert_file,omitempty"`
+	Enable   bool   `ini:"enable,omitempty"`
+	KeyFile  string `ini:"key_file,omitempty"`
+	Port     string `ini:"port,omitempty"`
+	// SharedSecret is the secret health check requests must be prefixed with,
+	// separated from the address by a space.
+	SharedSecret string `ini:"shared_secret,omitempty"`
 }
 
 func defaultConfigFile(osName string) string {
@@ -325,22 +818,33 @@ func defaultConfigFile(osName string) string {
 	return unixConfigPath
 }
 
+// Files returns the configuration files loaded on top of the defaults, in
+// load order.
+func Files() []string {
+	config := configFile(runtime.GOOS)
+	return []string{config, config + ".distro", config + ".template"}
+}
+
 func defaultDataSources(extraDefaults []byte) []interface{} {
 	var res = []interface{}{[]byte(defaultConfig)}
-	config := configFile(runtime.GOOS)
 
 	if len(extraDefaults) > 0 {
 		res = append(res, extraDefaults)
 	}
 
-	return append(res, []interface{}{
-		config,
-		config + ".distro",
-		config + ".template",
-	}...)
+	for _, f := range Files() {
+		res = append(res, f)
+	}
+
+	// The registry overrides take precedence over the configuration files.
+	if overrides := registrySource(registryOverrides()); overrides != nil {
+		res = append(res, overrides)
+	}
+	return res
 }
 
-// Load loads default configuration and the configuration from default config files.
+// Load loads default configuration, the configuration from default config files
+// and, on Windows, the registry overrides.
 func Load(extraDefaults []byte) error {
 	opts := ini.LoadOptions{
 		Loose:       true,
@@ -357,6 +861,13 @@ func Load(extraDefaults []byte) error {
 	if err := cfg.MapTo(sections); err != nil {
 		return fmt.Errorf("failed to map configuration to object: %+v", err)
 	}
+	// sysprep-specialize is the former name of sysprep_specialize, either of
+	// them disables the specialize scripts.
+	if key, err := cfg.Section("MetadataScripts").GetKey("sysprep-specialize"); err == nil {
+		if enabled, err := key.Bool(); err == nil && !enabled {
+			sections.MetadataScripts.SysprepSpecialize = false
+		}
+	}
 
 	instance = sections
 	return nil
@@ -94,3 +94,82 @@ func TestGetTwice(t *testing.T) {
 		t.Errorf("Get() should return always the same pointer, expected: %p, got: %p", firstCfg, secondCfg)
 	}
 }
+
+func TestRegistryOverrides(t *testing.T) {
+	if registrySource(nil) != nil {
+		t.Errorf("registrySource(nil) returned a source, expected: nil")
+	}
+
+	fileConfig := `
+[Accounts]
+deprovision_remove = true
+groupadd_cmd = groupadd -r {group}
+`
+	overrides := map[string]map[string]string{
+		"Accounts": {"deprovision_remove": "0"},
+		"Daemons":  {"clock_skew_daemon": "false"},
+	}
+
+	dataSources = func(extraDefaults []byte) []interface{} {
+		return []interface{}{
+			[]byte(defaultConfig),
+			[]byte(fileConfig),
+			registrySource(overrides),
+		}
+	}
+
+	// After testing set it back to the default one.
+	defer func() {
+		dataSources = defaultDataSources
+	}()
+
+	if err := Load(nil); err != nil {
+		t.Fatalf("Failed to load configuration: %+v", err)
+	}
+
+	cfg := Get()
+	if cfg.Accounts.DeprovisionRemove {
+		t.Errorf("Expected the registry to override Accounts.deprovision_remove to: false, got: true")
+	}
+	if cfg.Daemons.ClockSkewDaemon {
+		t.Errorf("Expected the registry to override Daemons.clock_skew_daemon to: false, got: true")
+	}
+	if cfg.Accounts.GroupAddCmd != "groupadd -r {group}" {
+		t.Errorf("Expected Accounts.groupadd_cmd from the file: groupadd -r {group}, got: %s", cfg.Accounts.GroupAddCmd)
+	}
+}
+
+func TestSysprepSpecializeAlias(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   bool
+	}{
+		{name: "default", config: "", want: true},
+		{name: "new_key", config: "[MetadataScripts]\nsysprep_specialize = false\n", want: false},
+		{name: "old_key", config: "[MetadataScripts]\nsysprep-specialize = false\n", want: false},
+		{name: "old_key_enabled", config: "[MetadataScripts]\nsysprep-specialize = true\n", want: true},
+	}
+
+	// After testing set it back to the default one.
+	defer func() {
+		dataSources = defaultDataSources
+	}()
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dataSources = func(extraDefaults []byte) []interface{} {
+				return []interface{}{
+					[]byte(defaultConfig),
+					[]byte(tc.config),
+				}
+			}
+			if err := Load(nil); err != nil {
+				t.Fatalf("Failed to load configuration: %+v", err)
+			}
+			if got := Get().MetadataScripts.SysprepSpecialize; got != tc.want {
+				t.Errorf("MetadataScripts.SysprepSpecialize = %t, want %t", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cfg
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/go-ini/ini"
+)
+
+// registryPolicyKey is the HKLM key whose subkeys override the configuration
+// file's sections on Windows, i.e. set by Group Policy. Each subkey is named
+// after a section and its string or DWORD values after the section's options.
+const registryPolicyKey = `SOFTWARE\Policies\Google\Compute Engine\Agent`
+
+// registrySource returns the registry overrides, section to option to value,
+// as an ini data source. It returns nil if there are no overrides.
+func registrySource(overrides map[string]map[string]string) []byte {
+	if len(overrides) == 0 {
+		return nil
+	}
+
+	file := ini.Empty()
+	names := make([]string, 0, len(overrides))
+	for name := range overrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		section, err := file.NewSection(name)
+		if err != nil {
+			continue
+		}
+		options := make([]string, 0, len(overrides[name]))
+		for option := range overrides[name] {
+			options = append(options, option)
+		}
+		sort.Strings(options)
+		for _, option := range options {
+			// Only empty option names are rejected.
+			section.NewKey(option, overrides[name][option])
+		}
+	}
+
+	var buf bytes.Buffer
+	if _, err := file.WriteTo(&buf); err != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
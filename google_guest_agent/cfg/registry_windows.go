@@ -0,0 +1,70 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cfg
+
+import (
+	"strconv"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// registryOverrides reads the options set under registryPolicyKey, section to
+// option to value. Values of other types than strings and integers are
+// ignored.
+func registryOverrides() map[string]map[string]string {
+	root, err := registry.OpenKey(registry.LOCAL_MACHINE, registryPolicyKey, registry.ENUMERATE_SUB_KEYS)
+	if err != nil {
+		return nil
+	}
+	defer root.Close()
+
+	sections, err := root.ReadSubKeyNames(-1)
+	if err != nil {
+		return nil
+	}
+
+	res := make(map[string]map[string]string)
+	for _, section := range sections {
+		options := readRegistrySection(registryPolicyKey + `\` + section)
+		if len(options) > 0 {
+			res[section] = options
+		}
+	}
+	return res
+}
+
+// readRegistrySection reads the string and integer values of the key.
+func readRegistrySection(path string) map[string]string {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, path, registry.QUERY_VALUE)
+	if err != nil {
+		return nil
+	}
+	defer k.Close()
+
+	names, err := k.ReadValueNames(-1)
+	if err != nil {
+		return nil
+	}
+
+	res := make(map[string]string)
+	for _, name := range names {
+		if s, _, err := k.GetStringValue(name); err == nil {
+			res[name] = s
+		} else if i, _, err := k.GetIntegerValue(name); err == nil {
+			res[name] = strconv.FormatUint(i, 10)
+		}
+	}
+	return res
+}
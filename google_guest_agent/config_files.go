@@ -0,0 +1,148 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+var (
+	// sshdLookPath looks up the sshd binary, overridden in tests.
+	sshdLookPath = exec.LookPath
+)
+
+// replaceConfigFile atomically replaces the content of the configuration file
+// at path keeping its permissions and ownership, readers never see a partially
+// written file. If path is a symlink, its target is replaced.
+func replaceConfigFile(path, contents string) error {
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		path = target
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	uid, gid := getUIDAndGID(path)
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".google")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(contents); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if uid != "" && gid != "" {
+		uid, _ := strconv.Atoi(uid)
+		gid, _ := strconv.Atoi(gid)
+		if err := tmp.Chown(uid, gid); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// configTransaction replaces configuration files recording their original
+// content, so they can be restored if the resulting configuration is invalid.
+type configTransaction struct {
+	// originals is the original content of the replaced files by path, nil if
+	// the file didn't exist.
+	originals map[string]*string
+	// paths are the replaced files in replacement order.
+	paths []string
+}
+
+// replace replaces the content of the configuration file at path.
+func (t *configTransaction) replace(path, contents string) error {
+	if _, ok := t.originals[path]; !ok {
+		var original *string
+		data, err := os.ReadFile(path)
+		if err == nil {
+			s := string(data)
+			original = &s
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		if t.originals == nil {
+			t.originals = make(map[string]*string)
+		}
+		t.originals[path] = original
+		t.paths = append(t.paths, path)
+	}
+	return replaceConfigFile(path, contents)
+}
+
+// rollback restores the original content of the replaced files.
+func (t *configTransaction) rollback() error {
+	var errs []error
+	for i := len(t.paths) - 1; i >= 0; i-- {
+		path := t.paths[i]
+		original := t.originals[path]
+		if original == nil {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		if err := replaceConfigFile(path, *original); err != nil {
+			errs = append(errs, fmt.Errorf("failed to restore %s: %w", path, err))
+		}
+	}
+	t.originals, t.paths = nil, nil
+	return errors.Join(errs...)
+}
+
+// validateSSHDConfig checks the sshd configuration with sshd -t. Nothing is
+// checked if sshd can't be found.
+func validateSSHDConfig(ctx context.Context) error {
+	sshd, err := sshdLookPath("sshd")
+	if err != nil {
+		if _, statErr := os.Stat("/usr/sbin/sshd"); statErr != nil {
+			logger.Debugf("sshd not found, not validating its configuration")
+			return nil
+		}
+		sshd = "/usr/sbin/sshd"
+	}
+	res := run.WithCombinedOutput(ctx, sshd, "-t")
+	if res.ExitCode != 0 {
+		return fmt.Errorf("sshd -t failed: %s", strings.TrimSpace(res.Combined))
+	}
+	return nil
+}
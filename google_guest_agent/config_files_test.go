@@ -0,0 +1,180 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+)
+
+// sshdMockRunner fails sshd -t with the configured exit code.
+type sshdMockRunner struct {
+	exitCode int
+	calls    []string
+}
+
+func (r *sshdMockRunner) Quiet(ctx context.Context, name string, args ...string) error {
+	return nil
+}
+
+func (r *sshdMockRunner) WithOutput(ctx context.Context, name string, args ...string) *run.Result {
+	return r.WithCombinedOutput(ctx, name, args...)
+}
+
+func (r *sshdMockRunner) WithOutputTimeout(ctx context.Context, timeout time.Duration, name string, args ...string) *run.Result {
+	return r.WithCombinedOutput(ctx, name, args...)
+}
+
+func (r *sshdMockRunner) WithCombinedOutput(ctx context.Context, name string, args ...string) *run.Result {
+	r.calls = append(r.calls, name)
+	if r.exitCode != 0 {
+		return &run.Result{ExitCode: r.exitCode, Combined: "/etc/ssh/sshd_config line 1: Bad configuration option\n"}
+	}
+	return &run.Result{}
+}
+
+func TestReplaceConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sshd_config")
+	if err := os.WriteFile(path, []byte("old"), 0600); err != nil {
+		t.Fatalf("os.WriteFile(%s) failed unexpectedly with error: %v", path, err)
+	}
+
+	if err := replaceConfigFile(path, "new"); err != nil {
+		t.Fatalf("replaceConfigFile(%s) failed unexpectedly with error: %v", path, err)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("os.ReadFile(%s) failed unexpectedly with error: %v", path, err)
+	}
+	if string(got) != "new" {
+		t.Errorf("replaceConfigFile(%s) wrote %q, want %q", path, got, "new")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("os.Stat(%s) failed unexpectedly with error: %v", path, err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("replaceConfigFile(%s) set mode %v, want %v", path, info.Mode().Perm(), os.FileMode(0600))
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatalf("os.ReadDir(%s) failed unexpectedly with error: %v", filepath.Dir(path), err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("replaceConfigFile(%s) left %d files behind, want 1", path, len(entries))
+	}
+}
+
+func TestReplaceConfigFileSymlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "sshd_config.real")
+	link := filepath.Join(dir, "sshd_config")
+	if err := os.WriteFile(target, []byte("old"), 0600); err != nil {
+		t.Fatalf("os.WriteFile(%s) failed unexpectedly with error: %v", target, err)
+	}
+	if err := os.Symlink(target, link); err != nil {
+		t.Skipf("os.Symlink(%s, %s) failed: %v", target, link, err)
+	}
+
+	if err := replaceConfigFile(link, "new"); err != nil {
+		t.Fatalf("replaceConfigFile(%s) failed unexpectedly with error: %v", link, err)
+	}
+
+	info, err := os.Lstat(link)
+	if err != nil {
+		t.Fatalf("os.Lstat(%s) failed unexpectedly with error: %v", link, err)
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("replaceConfigFile(%s) replaced the symlink, want its target replaced", link)
+	}
+	got, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatalf("os.ReadFile(%s) failed unexpectedly with error: %v", target, err)
+	}
+	if string(got) != "new" {
+		t.Errorf("replaceConfigFile(%s) wrote %q to the target, want %q", link, got, "new")
+	}
+}
+
+func TestConfigTransactionRollback(t *testing.T) {
+	dir := t.TempDir()
+	sshdConfig := filepath.Join(dir, "sshd_config")
+	pamConfig := filepath.Join(dir, "sshd")
+	if err := os.WriteFile(sshdConfig, []byte("original"), 0644); err != nil {
+		t.Fatalf("os.WriteFile(%s) failed unexpectedly with error: %v", sshdConfig, err)
+	}
+
+	tx := &configTransaction{}
+	for _, path := range []string{sshdConfig, sshdConfig, pamConfig} {
+		if err := tx.replace(path, "proposed"); err != nil {
+			t.Fatalf("tx.replace(%s) failed unexpectedly with error: %v", path, err)
+		}
+	}
+
+	if err := tx.rollback(); err != nil {
+		t.Fatalf("tx.rollback() failed unexpectedly with error: %v", err)
+	}
+
+	got, err := os.ReadFile(sshdConfig)
+	if err != nil {
+		t.Fatalf("os.ReadFile(%s) failed unexpectedly with error: %v", sshdConfig, err)
+	}
+	if string(got) != "original" {
+		t.Errorf("tx.rollback() restored %q, want %q", got, "original")
+	}
+	if _, err := os.Stat(pamConfig); !os.IsNotExist(err) {
+		t.Errorf("tx.rollback() kept %s, want it removed as it didn't exist before", pamConfig)
+	}
+}
+
+func TestValidateSSHDConfig(t *testing.T) {
+	origClient := run.Client
+	t.Cleanup(func() {
+		run.Client = origClient
+		sshdLookPath = exec.LookPath
+	})
+	sshdLookPath = func(string) (string, error) { return "/usr/sbin/sshd", nil }
+
+	tests := []struct {
+		name     string
+		exitCode int
+		wantErr  bool
+	}{
+		{name: "valid", exitCode: 0, wantErr: false},
+		{name: "invalid", exitCode: 255, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			runner := &sshdMockRunner{exitCode: tc.exitCode}
+			run.Client = runner
+
+			err := validateSSHDConfig(context.Background())
+			if (err != nil) != tc.wantErr {
+				t.Errorf("validateSSHDConfig() = error %v, want error: %t", err, tc.wantErr)
+			}
+			if len(runner.calls) != 1 || runner.calls[0] != "/usr/sbin/sshd" {
+				t.Errorf("validateSSHDConfig() ran %v, want [/usr/sbin/sshd]", runner.calls)
+			}
+		})
+	}
+}
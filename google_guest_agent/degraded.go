@@ -0,0 +1,94 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+// degradedProbeInterval is the interval at which the environment is inspected
+// again in degraded mode, i.e. after the agent was granted the privileges.
+const degradedProbeInterval = 5 * time.Minute
+
+// The agent runs in degraded mode where it can't change the network
+// configuration, i.e. in a Windows container or without administrator
+// privileges. The address and WSFC managers then skip their changes instead of
+// failing on every metadata change, until the degraded mode is left.
+var (
+	degradedMu sync.Mutex
+	// degraded is why the agent runs in degraded mode, empty if it doesn't.
+	degraded string
+	// degradedChecked is when the environment was last inspected or the
+	// degraded mode entered, zero if never.
+	degradedChecked time.Time
+	// degradedLogged is the set of modules which logged they are skipped.
+	degradedLogged = make(map[string]bool)
+)
+
+// degradedReason returns why the agent runs in degraded mode, empty if it
+// doesn't. The environment is inspected once, then every
+// degradedProbeInterval while in degraded mode, the agent leaves it when the
+// inspection doesn't find a reason anymore. A denied change is then retried.
+func degradedReason() string {
+	degradedMu.Lock()
+	defer degradedMu.Unlock()
+
+	if !degradedChecked.IsZero() && (degraded == "" || time.Since(degradedChecked) < degradedProbeInterval) {
+		return degraded
+	}
+	degradedChecked = time.Now()
+	reason := detectDegradedMode()
+	switch {
+	case reason != "" && degraded == "":
+		logger.Warningf("Network configuration changes are disabled, %s.", reason)
+	case reason == "" && degraded != "":
+		logger.Infof("Network configuration changes are enabled again.")
+		clear(degradedLogged)
+	}
+	degraded = reason
+	return degraded
+}
+
+// enterDegradedMode switches the agent to degraded mode, i.e. after a change
+// was denied. The first reason is kept.
+func enterDegradedMode(reason string) {
+	degradedMu.Lock()
+	defer degradedMu.Unlock()
+	if degraded != "" {
+		return
+	}
+	degraded = reason
+	degradedChecked = time.Now()
+	logger.Warningf("Network configuration changes are disabled, %s.", reason)
+}
+
+// skipDegraded returns whether module must skip its changes because the agent
+// runs in degraded mode, logging it once per module and degraded mode.
+func skipDegraded(module string) bool {
+	reason := degradedReason()
+	if reason == "" {
+		return false
+	}
+	degradedMu.Lock()
+	defer degradedMu.Unlock()
+	if !degradedLogged[module] {
+		logger.Infof("Skipping %s, %s.", module, reason)
+		degradedLogged[module] = true
+	}
+	return true
+}
@@ -0,0 +1,78 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func resetDegradedMode(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		degradedChecked = time.Time{}
+		degraded = ""
+		degradedLogged = make(map[string]bool)
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestDegradedMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the detection depends on the test environment on Windows")
+	}
+	resetDegradedMode(t)
+
+	if skipDegraded("addressMgr") {
+		t.Errorf("skipDegraded(addressMgr) = true before entering degraded mode, want false")
+	}
+
+	enterDegradedMode("adding forwarded IPs was denied")
+	enterDegradedMode("running in a Windows container")
+	if got, want := degradedReason(), "adding forwarded IPs was denied"; got != want {
+		t.Errorf("degradedReason() = %q, want %q", got, want)
+	}
+	for i := 0; i < 2; i++ {
+		if !skipDegraded("addressMgr") {
+			t.Errorf("skipDegraded(addressMgr) = false in degraded mode, want true")
+		}
+	}
+	if len(degradedLogged) != 1 || !degradedLogged["addressMgr"] {
+		t.Errorf("degradedLogged = %v, want addressMgr logged once", degradedLogged)
+	}
+}
+
+func TestDegradedModeReprobe(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the detection depends on the test environment on Windows")
+	}
+	resetDegradedMode(t)
+
+	enterDegradedMode("adding forwarded IPs was denied")
+	if !skipDegraded("addressMgr") {
+		t.Errorf("skipDegraded(addressMgr) = false right after a denied change, want true")
+	}
+
+	// The environment is inspected again once the probe interval passed.
+	degradedChecked = time.Now().Add(-degradedProbeInterval)
+	if skipDegraded("addressMgr") {
+		t.Errorf("skipDegraded(addressMgr) = true after a successful probe, want false")
+	}
+	if len(degradedLogged) != 0 {
+		t.Errorf("degradedLogged = %v after leaving degraded mode, want empty", degradedLogged)
+	}
+}
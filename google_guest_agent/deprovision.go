@@ -0,0 +1,64 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+)
+
+// deprovisionHookTimeout bounds the run time of a deprovisioning hook, a stuck
+// hook would otherwise block the accounts manager.
+const deprovisionHookTimeout = 2 * time.Minute
+
+// builtinProtectedUsers are never deleted whatever the configuration.
+var builtinProtectedUsers = []string{"root"}
+
+// protectedUserPattern returns the protected_users glob pattern matching user,
+// the accounts manager never deletes these users.
+func protectedUserPattern(config *cfg.Sections, user string) (string, bool) {
+	patterns := builtinProtectedUsers
+	for _, pattern := range strings.Split(config.Accounts.ProtectedUsers, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, user); ok {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// runDeprovisionHook runs the deprovisioning hook command for user, {user} is
+// replaced with the user name. An empty hook does nothing.
+func runDeprovisionHook(ctx context.Context, hook, user string) error {
+	if hook == "" {
+		return nil
+	}
+	name, args := createUserGroupCmd(hook, user, "")
+	res := run.WithOutputTimeout(ctx, deprovisionHookTimeout, name, args...)
+	if res.ExitCode != 0 {
+		return fmt.Errorf("deprovisioning hook %q failed for user %s: %w", hook, user, res)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+)
+
+// hookMockRunner records the hooks it runs and fails the "false" command.
+type hookMockRunner struct {
+	commands []string
+	timeout  time.Duration
+}
+
+func (r *hookMockRunner) Quiet(ctx context.Context, name string, args ...string) error {
+	return nil
+}
+
+func (r *hookMockRunner) WithOutput(ctx context.Context, name string, args ...string) *run.Result {
+	return &run.Result{}
+}
+
+func (r *hookMockRunner) WithOutputTimeout(ctx context.Context, timeout time.Duration, name string, args ...string) *run.Result {
+	r.timeout = timeout
+	r.commands = append(r.commands, strings.Join(append([]string{name}, args...), " "))
+	if name == "false" {
+		return &run.Result{ExitCode: 1, StdErr: "failed"}
+	}
+	return &run.Result{}
+}
+
+func (r *hookMockRunner) WithCombinedOutput(ctx context.Context, name string, args ...string) *run.Result {
+	return &run.Result{}
+}
+
+func TestRunDeprovisionHook(t *testing.T) {
+	ctx := context.Background()
+	origClient := run.Client
+	t.Cleanup(func() { run.Client = origClient })
+	runner := &hookMockRunner{}
+	run.Client = runner
+
+	if err := runDeprovisionHook(ctx, "", "user"); err != nil {
+		t.Errorf("runDeprovisionHook() without hook failed unexpectedly with error: %v", err)
+	}
+	if len(runner.commands) != 0 {
+		t.Errorf("runDeprovisionHook() without hook ran %v, want no command", runner.commands)
+	}
+
+	if err := runDeprovisionHook(ctx, "/usr/local/bin/archive-home --user {user}", "user"); err != nil {
+		t.Errorf("runDeprovisionHook() failed unexpectedly with error: %v", err)
+	}
+	if want := "/usr/local/bin/archive-home --user user"; len(runner.commands) != 1 || runner.commands[0] != want {
+		t.Errorf("runDeprovisionHook() ran %v, want %q", runner.commands, want)
+	}
+	if runner.timeout != deprovisionHookTimeout {
+		t.Errorf("runDeprovisionHook() ran with timeout %v, want %v", runner.timeout, deprovisionHookTimeout)
+	}
+
+	if err := runDeprovisionHook(ctx, "false {user}", "user"); err == nil {
+		t.Errorf("runDeprovisionHook() with a failing hook succeeded, want error")
+	}
+}
+
+func TestProtectedUserPattern(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+	config.Accounts.ProtectedUsers = "svc-*, admin ,,"
+	t.Cleanup(func() { config.Accounts.ProtectedUsers = "" })
+
+	tests := []struct {
+		user        string
+		wantPattern string
+		want        bool
+	}{
+		{user: "root", wantPattern: "root", want: true},
+		{user: "svc-backup", wantPattern: "svc-*", want: true},
+		{user: "admin", wantPattern: "admin", want: true},
+		{user: "admin2", want: false},
+		{user: "alice", want: false},
+	}
+
+	for _, tc := range tests {
+		pattern, ok := protectedUserPattern(config, tc.user)
+		if ok != tc.want || pattern != tc.wantPattern {
+			t.Errorf("protectedUserPattern(%s) = (%q, %t), want (%q, %t)", tc.user, pattern, ok, tc.wantPattern, tc.want)
+		}
+	}
+}
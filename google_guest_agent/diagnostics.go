@@ -123,6 +123,8 @@ func (d *diagnosticsMgr) Set(ctx context.Context) error {
 		return nil
 	}
 
+	// The collection outlives the diagnostics manager's run.
+	ctx = backgroundContext(ctx)
 	go func() {
 		logger.Infof("Diagnostics: collecting logs from the system.")
 		res := run.WithCombinedOutput(ctx, diagnosticsCmd, args...)
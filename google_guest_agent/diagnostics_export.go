@@ -0,0 +1,247 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/eventlog"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+// diagnosticsExportAction is the subcommand collecting the Windows state into
+// a zip archive for support cases.
+const diagnosticsExportAction = "diagnostics-export"
+
+// diagnosticsCommandTimeout is the time a collection command has to complete.
+const diagnosticsCommandTimeout = 2 * time.Minute
+
+// secretConfigKey matches the configuration lines whose value is redacted from
+// the archive.
+var secretConfigKey = regexp.MustCompile(`(?i)^\s*([a-z0-9_]*(secret|password)[a-z0-9_]*)\s*=.*$`)
+
+// exportEntry is a file of the diagnostics archive.
+type exportEntry struct {
+	// name is the entry's path in the archive.
+	name string
+	// cmd is the command to run, its output is the entry's content unless
+	// file is set.
+	cmd []string
+	// file is the file copied into the archive, after running cmd if any.
+	file string
+	// redact is whether the secret configuration values are redacted.
+	redact bool
+}
+
+// redactSecrets replaces the value of the secret keys of an ini file.
+func redactSecrets(content []byte) []byte {
+	var buf bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := secretConfigKey.FindStringSubmatch(line); m != nil {
+			line = m[1] + " = <redacted>"
+		}
+		buf.WriteString(line + "\n")
+	}
+	return buf.Bytes()
+}
+
+// collectEntry returns the content of e.
+func collectEntry(ctx context.Context, e exportEntry) ([]byte, error) {
+	var content []byte
+	if len(e.cmd) > 0 {
+		res := run.WithOutputTimeout(ctx, diagnosticsCommandTimeout, e.cmd[0], e.cmd[1:]...)
+		if res.ExitCode != 0 {
+			return nil, fmt.Errorf("%s failed with exit code %d: %s", strings.Join(e.cmd, " "), res.ExitCode, res.Error())
+		}
+		content = []byte(res.StdOut)
+	}
+
+	if e.file != "" {
+		var err error
+		if content, err = os.ReadFile(e.file); err != nil {
+			return nil, err
+		}
+	}
+
+	if e.redact {
+		content = redactSecrets(content)
+	}
+	return content, nil
+}
+
+// writeDiagnosticsArchive writes the zip archive of entries to w. The entries
+// failing to collect are skipped and their errors listed in errors.txt.
+func writeDiagnosticsArchive(ctx context.Context, w io.Writer, entries []exportEntry) error {
+	zw := zip.NewWriter(w)
+	var errs []string
+
+	for _, e := range entries {
+		content, err := collectEntry(ctx, e)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", e.name, err))
+			continue
+		}
+
+		f, err := zw.Create(e.name)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(content); err != nil {
+			return err
+		}
+	}
+
+	if len(errs) > 0 {
+		f, err := zw.Create("errors.txt")
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, strings.Join(errs, "\n")+"\n"); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// agentEventsQuery returns the XPath query of the events of the given sources.
+func agentEventsQuery(sources ...string) string {
+	var providers []string
+	for _, s := range sources {
+		providers = append(providers, fmt.Sprintf("@Name='%s'", s))
+	}
+	return fmt.Sprintf("*[System[Provider[%s]]]", strings.Join(providers, " or "))
+}
+
+// windowsExportEntries returns the entries of the diagnostics archive, the
+// exported event logs being written to tmpDir.
+func windowsExportEntries(tmpDir string) []exportEntry {
+	var entries []exportEntry
+
+	// Event logs, the agent and script runner logs included.
+	for _, log := range []string{"Application", "System"} {
+		file := filepath.Join(tmpDir, log+".evtx")
+		entries = append(entries, exportEntry{
+			name: "eventlogs/" + log + ".evtx",
+			cmd:  []string{"wevtutil", "epl", log, file},
+			file: file,
+		})
+	}
+	var agentSources []string
+	for _, s := range eventlog.Subsystems {
+		agentSources = append(agentSources, s.Source())
+	}
+	entries = append(entries, exportEntry{
+		name: "eventlogs/agent.txt",
+		cmd:  []string{"wevtutil", "qe", "Application", "/q:" + agentEventsQuery(append([]string{programName}, agentSources...)...), "/f:text", "/rd:true"},
+	})
+
+	// Script transcripts, as logged by the script runner.
+	entries = append(entries, exportEntry{
+		name: "scripts/transcripts.txt",
+		cmd:  []string{"wevtutil", "qe", "Application", "/q:" + agentEventsQuery("GCEMetadataScripts", eventlog.Scripts.Source()), "/f:text"},
+	})
+
+	// Agent configuration and state.
+	for _, f := range cfg.Files() {
+		entries = append(entries, exportEntry{name: "config/" + filepath.Base(f), file: f, redact: true})
+	}
+	entries = append(entries, exportEntry{name: "state/" + accountsAuditFileName, file: accountsAuditFile()})
+
+	// Network.
+	entries = append(entries,
+		exportEntry{name: "network/ipconfig.txt", cmd: []string{"ipconfig", "/all"}},
+		exportEntry{name: "network/routes.txt", cmd: []string{"route", "print"}},
+		exportEntry{name: "network/netsh.txt", cmd: []string{"netsh", "interface", "ip", "show", "config"}},
+		exportEntry{name: "network/firewall.txt", cmd: []string{"netsh", "advfirewall", "show", "allprofiles"}},
+	)
+
+	// Sysprep state.
+	entries = append(entries, exportEntry{
+		name: "sysprep/state.txt",
+		cmd:  []string{"reg", "query", `HKLM\SOFTWARE\Microsoft\Windows\CurrentVersion\Setup\State`},
+	})
+	entries = append(entries, exportEntry{
+		name: "sysprep/specialize-state.json",
+		file: filepath.Join(os.Getenv("ProgramData"), "Google", "Compute Engine", "specialize-state.json"),
+	})
+	windir := os.Getenv("WINDIR")
+	for _, dir := range []string{"Panther", `System32\Sysprep\Panther`} {
+		prefix := strings.ReplaceAll(strings.ToLower(dir), `\`, "-")
+		for _, log := range []string{"setupact.log", "setuperr.log"} {
+			entries = append(entries, exportEntry{name: "sysprep/" + prefix + "-" + log, file: filepath.Join(windir, dir, log)})
+		}
+	}
+	return entries
+}
+
+// diagnosticsExport collects the Windows state into a zip archive written to
+// the path of the first argument, or to the temporary directory. It returns
+// the process exit code.
+func diagnosticsExport(ctx context.Context, args []string) int {
+	opts := logger.LogOpts{LoggerName: programName, DisableCloudLogging: true, DisableLocalLogging: true}
+	opts.FormatFunction = logFormat
+	opts.Writers = []io.Writer{os.Stderr}
+	if err := logger.Init(ctx, opts); err != nil {
+		fmt.Fprintf(os.Stderr, "Error initializing logger: %v\n", err)
+		return 1
+	}
+	defer logger.Close()
+
+	if runtime.GOOS != "windows" {
+		fmt.Fprintf(os.Stderr, "%s is only supported on Windows\n", diagnosticsExportAction)
+		return 1
+	}
+
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("gce-diagnostics-%s.zip", time.Now().Format("20060102-150405")))
+	if len(args) > 0 {
+		path = args[0]
+	}
+
+	tmpDir, err := os.MkdirTemp("", "gce-diagnostics")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create a temporary directory: %v\n", err)
+		return 1
+	}
+	defer os.RemoveAll(tmpDir)
+
+	f, err := os.Create(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create %s: %v\n", path, err)
+		return 1
+	}
+	defer closeFile(f)
+
+	if err := writeDiagnosticsArchive(ctx, f, windowsExportEntries(tmpDir)); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write %s: %v\n", path, err)
+		return 1
+	}
+	fmt.Println(path)
+	return 0
+}
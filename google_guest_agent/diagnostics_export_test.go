@@ -0,0 +1,88 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRedactSecrets(t *testing.T) {
+	in := "[wsfc]\nenable = true\nshared_secret = s3cr3t\n[Accounts]\nAdminPassword=x\n"
+	want := "[wsfc]\nenable = true\nshared_secret = <redacted>\n[Accounts]\nAdminPassword = <redacted>\n"
+	if got := string(redactSecrets([]byte(in))); got != want {
+		t.Errorf("redactSecrets(%q) = %q, want %q", in, got, want)
+	}
+}
+
+func TestAgentEventsQuery(t *testing.T) {
+	want := "*[System[Provider[@Name='a' or @Name='b']]]"
+	if got := agentEventsQuery("a", "b"); got != want {
+		t.Errorf("agentEventsQuery(a, b) = %q, want %q", got, want)
+	}
+}
+
+func TestWriteDiagnosticsArchive(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "instance_configs.cfg")
+	if err := os.WriteFile(config, []byte("[wsfc]\nshared_secret = s3cr3t\n"), 0644); err != nil {
+		t.Fatalf("os.WriteFile(%s) failed: %v", config, err)
+	}
+
+	entries := []exportEntry{
+		{name: "config/instance_configs.cfg", file: config, redact: true},
+		{name: "state/missing", file: filepath.Join(dir, "missing")},
+	}
+	var buf bytes.Buffer
+	if err := writeDiagnosticsArchive(context.Background(), &buf, entries); err != nil {
+		t.Fatalf("writeDiagnosticsArchive() failed: %v", err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("zip.NewReader() failed: %v", err)
+	}
+	got := make(map[string]string)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("Open(%s) failed: %v", f.Name, err)
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("ReadAll(%s) failed: %v", f.Name, err)
+		}
+		got[f.Name] = string(content)
+	}
+
+	if diff := cmp.Diff("[wsfc]\nshared_secret = <redacted>\n", got["config/instance_configs.cfg"]); diff != "" {
+		t.Errorf("writeDiagnosticsArchive() wrote unexpected config (-want +got):\n%s", diff)
+	}
+	if _, ok := got["state/missing"]; ok {
+		t.Errorf("writeDiagnosticsArchive() archived the missing file")
+	}
+	if !strings.HasPrefix(got["errors.txt"], "state/missing: ") {
+		t.Errorf("writeDiagnosticsArchive() errors = %q, want the missing file error", got["errors.txt"])
+	}
+}
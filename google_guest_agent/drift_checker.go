@@ -0,0 +1,127 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"runtime"
+	"slices"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/events/netconfig"
+	network "github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/network/manager"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// driftCheckerID is the network configuration drift checker job's ID.
+	driftCheckerID = "network-config-drift-checker"
+
+	// defaultDriftCheckInterval is used if drift_check_interval is not a valid
+	// duration.
+	defaultDriftCheckInterval = time.Minute
+)
+
+var (
+	// configDrift returns the drifted network configuration files, overridden
+	// in tests.
+	configDrift = network.ConfigDrift
+)
+
+// driftChecker periodically verifies the network configuration files written
+// by the agent, applying the configuration again when another tool rewrote
+// them instead of waiting for the next metadata change.
+type driftChecker struct {
+	// watcher reports the drifts as events, if not nil.
+	watcher *netconfig.Watcher
+	// lastDrift are the drifted files last reported without applying the
+	// configuration again, the same drift is only reported once.
+	lastDrift []string
+}
+
+// newDriftChecker returns a drift checker reporting the drifts to watcher.
+func newDriftChecker(watcher *netconfig.Watcher) *driftChecker {
+	return &driftChecker{watcher: watcher}
+}
+
+// ID returns the drift checker job's ID.
+func (d *driftChecker) ID() string {
+	return driftCheckerID
+}
+
+// Interval returns the configured drift check interval.
+func (d *driftChecker) Interval() (time.Duration, bool) {
+	return driftCheckInterval(), false
+}
+
+// ShouldEnable returns true on Linux if the network interfaces setup is
+// enabled and the drift checks are not disabled.
+func (d *driftChecker) ShouldEnable(ctx context.Context) bool {
+	config := cfg.Get()
+	return runtime.GOOS != "windows" && config.NetworkInterfaces.Setup && driftCheckInterval() > 0
+}
+
+// Run reports the drifted configuration files and applies the configuration
+// again if enabled.
+func (d *driftChecker) Run(ctx context.Context) (bool, error) {
+	updateMu.Lock()
+	noMetadata := newMetadata == nil
+	updateMu.Unlock()
+	if noMetadata || pausedForMaintenance(d.ID()) {
+		return true, nil
+	}
+
+	files := configDrift()
+	if len(files) == 0 {
+		d.lastDrift = nil
+		return true, nil
+	}
+
+	drift := &netconfig.Drift{Files: files}
+	if cfg.Get().NetworkInterfaces.DriftReapply {
+		logger.Warningf("Network configuration files %q were changed by another tool, applying the configuration again.", files)
+		// The address manager must not race a metadata update.
+		updateMu.Lock()
+		network.ForgetApplied()
+		runManager(ctx, addressManager)
+		updateMu.Unlock()
+		drift.Reapplied = true
+		d.lastDrift = nil
+	} else {
+		// The drift stays until the next network setup, only report its
+		// changes.
+		if slices.Equal(files, d.lastDrift) {
+			return true, nil
+		}
+		logger.Warningf("Network configuration files %q were changed by another tool.", files)
+		d.lastDrift = files
+	}
+
+	if d.watcher != nil {
+		d.watcher.Report(drift)
+	}
+	return true, nil
+}
+
+// driftCheckInterval returns the configured drift check interval.
+func driftCheckInterval() time.Duration {
+	interval, err := time.ParseDuration(cfg.Get().NetworkInterfaces.DriftCheckInterval)
+	if err != nil {
+		logger.Errorf("drift_check_interval configuration is not a valid duration string, falling back to %s", defaultDriftCheckInterval)
+		return defaultDriftCheckInterval
+	}
+	return interval
+}
@@ -0,0 +1,83 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/events/netconfig"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDriftCheckerReportsChanges(t *testing.T) {
+	if err := cfg.Load([]byte("[NetworkInterfaces]\ndrift_reapply = false\n")); err != nil {
+		t.Fatalf("cfg.Load() failed unexpectedly with error: %v", err)
+	}
+	origConfigDrift, origMaintenanceEnabled, origNewMetadata := configDrift, maintenanceEnabled, newMetadata
+	t.Cleanup(func() {
+		configDrift = origConfigDrift
+		maintenanceEnabled = origMaintenanceEnabled
+		newMetadata = origNewMetadata
+		cfg.Load(nil)
+	})
+	maintenanceEnabled = func() (bool, string) { return false, "" }
+	newMetadata = &metadata.Descriptor{}
+
+	watcher := netconfig.New()
+	checker := newDriftChecker(watcher)
+
+	// Each check returns the next drift.
+	checks := [][]string{
+		{"/etc/netplan/20-google-guest-agent-eth0.yaml"},
+		{"/etc/netplan/20-google-guest-agent-eth0.yaml"},
+		{"/etc/netplan/20-google-guest-agent-eth0.yaml", "/etc/netplan/20-google-guest-agent-eth1.yaml"},
+		nil,
+		{"/etc/netplan/20-google-guest-agent-eth0.yaml"},
+	}
+	var check int
+	configDrift = func() []string {
+		res := checks[check]
+		check++
+		return res
+	}
+
+	for range checks {
+		if _, err := checker.Run(context.Background()); err != nil {
+			t.Fatalf("driftChecker.Run() failed unexpectedly with error: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	var got [][]string
+	for {
+		_, data, err := watcher.Run(ctx, netconfig.DriftEvent)
+		if err != nil {
+			break
+		}
+		got = append(got, data.(*netconfig.Drift).Files)
+	}
+
+	// The unchanged drift of the second check isn't reported again, the drift
+	// coming back after it was fixed is.
+	want := [][]string{checks[0], checks[2], checks[4]}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("driftChecker.Run() reported unexpected drifts (-want +got):\n%s", diff)
+	}
+}
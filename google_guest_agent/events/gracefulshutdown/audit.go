@@ -0,0 +1,161 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gracefulshutdown
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/utils"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// auditFileName is the audit file name used when no audit_file is configured.
+	auditFileName = "graceful-shutdown-audit.json"
+	// defaultMaxDuration is used when max_duration is not a valid duration.
+	defaultMaxDuration = 10 * time.Minute
+)
+
+var (
+	// writeAuditRecord writes an audit record to the serial console and the
+	// local audit file. Replaceable by unit tests.
+	writeAuditRecord = defaultWriteAuditRecord
+)
+
+// AuditRecord is the structured record of a graceful shutdown, it's written
+// once all the hooks of a stop request have finished or were cancelled.
+type AuditRecord struct {
+	// Event is the kind of stop that triggered the hooks.
+	Event string `json:"event"`
+	// DetectedAt is when the watcher detected the stop request.
+	DetectedAt time.Time `json:"detectedAt"`
+	// Deadline is when the instance is expected to be stopped.
+	Deadline time.Time `json:"deadline"`
+	// DeadlineHit is true if the hooks were still running past the deadline.
+	DeadlineHit bool `json:"deadlineHit"`
+	// Cancelled is true if the stop was cancelled while the hooks were running.
+	Cancelled bool `json:"cancelled"`
+	// Hooks are the records of the hooks executed for the stop request.
+	Hooks []HookRecord `json:"hooks"`
+}
+
+// HookRecord is the record of a single hook execution.
+type HookRecord struct {
+	// Name identifies the hook.
+	Name string `json:"name"`
+	// StartedAt is when the hook was started.
+	StartedAt time.Time `json:"startedAt"`
+	// FinishedAt is when the hook finished or was terminated.
+	FinishedAt time.Time `json:"finishedAt"`
+	// ExitCode is the hook's exit code, -1 if it couldn't be determined.
+	ExitCode int `json:"exitCode"`
+	// Error is the error message if the hook failed.
+	Error string `json:"error,omitempty"`
+}
+
+// newAuditRecord allocates a new AuditRecord for a stop request detected now.
+func newAuditRecord(event string) *AuditRecord {
+	now := time.Now()
+	return &AuditRecord{
+		Event:      event,
+		DetectedAt: now,
+		Deadline:   now.Add(maxDuration()),
+	}
+}
+
+// maxDuration returns the configured graceful shutdown max duration.
+func maxDuration() time.Duration {
+	dur, err := time.ParseDuration(cfg.Get().GracefulShutdown.MaxDuration)
+	if err != nil {
+		logger.Errorf("graceful shutdown max_duration configuration is not a valid duration string, falling back to %s", defaultMaxDuration)
+		return defaultMaxDuration
+	}
+	return dur
+}
+
+// exitCode returns the exit code of a command given its returned error.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// auditFile returns the configured audit file path or the OS default one.
+func auditFile() string {
+	if file := cfg.Get().GracefulShutdown.AuditFile; file != "" {
+		return file
+	}
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("ProgramData"), "Google", "Compute Engine", auditFileName)
+	}
+	return filepath.Join("/var/lib/google-guest-agent", auditFileName)
+}
+
+// serialPort returns the serial console port name.
+func serialPort() string {
+	if runtime.GOOS == "windows" {
+		return "COM1"
+	}
+	return "/dev/ttyS0"
+}
+
+// appendAuditFile appends a JSON encoded record line to the audit file.
+func appendAuditFile(fpath string, line []byte) error {
+	if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		return fmt.Errorf("failed to create audit file directory: %w", err)
+	}
+
+	f, err := os.OpenFile(fpath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(line); err != nil {
+		return fmt.Errorf("failed to write audit file: %w", err)
+	}
+	return nil
+}
+
+func defaultWriteAuditRecord(record *AuditRecord) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		logger.Errorf("failed to marshal graceful shutdown audit record: %v", err)
+		return
+	}
+	line := append(data, '\n')
+
+	serial := &utils.SerialPort{Port: serialPort()}
+	if _, err := serial.Write(append([]byte("google-guest-agent graceful-shutdown-audit: "), line...)); err != nil {
+		logger.Errorf("failed to write graceful shutdown audit record to serial console: %v", err)
+	}
+
+	if err := appendAuditFile(auditFile(), line); err != nil {
+		logger.Errorf("failed to write graceful shutdown audit record: %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gracefulshutdown
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExitCode(t *testing.T) {
+	exitErr := exec.Command("sh", "-c", "exit 3").Run()
+
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "success", err: nil, want: 0},
+		{name: "exit_error", err: exitErr, want: 3},
+		{name: "unknown_error", err: fmt.Errorf("unknown"), want: -1},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := exitCode(tc.err); got != tc.want {
+				t.Errorf("exitCode(%v) = %d, want %d", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAppendAuditFile(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "audit", auditFileName)
+
+	for _, line := range []string{"{\"event\":\"a\"}\n", "{\"event\":\"b\"}\n"} {
+		if err := appendAuditFile(fpath, []byte(line)); err != nil {
+			t.Fatalf("appendAuditFile(%s) = %v, want nil", fpath, err)
+		}
+	}
+
+	f, err := os.Open(fpath)
+	if err != nil {
+		t.Fatalf("os.Open(%s) = %v, want nil", fpath, err)
+	}
+	defer f.Close()
+
+	var events []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("json.Unmarshal(%s) = %v, want nil", scanner.Text(), err)
+		}
+		events = append(events, record.Event)
+	}
+
+	if len(events) != 2 || events[0] != "a" || events[1] != "b" {
+		t.Errorf("audit file events = %v, want [a b]", events)
+	}
+}
+
+func TestRunHookRecord(t *testing.T) {
+	hook := func(context.Context) error {
+		return exec.Command("sh", "-c", "exit 2").Run()
+	}
+
+	got := newAuditRecord("graceful-shutdown")
+	// Force the deadline to be in the past.
+	got.Deadline = got.DetectedAt.Add(-time.Second)
+
+	runHook(context.Background(), got, gracefulShutdownHook, hook)
+
+	if got.Cancelled {
+		t.Errorf("audit record Cancelled = true, want false")
+	}
+	if !got.DeadlineHit {
+		t.Errorf("audit record DeadlineHit = false, want true")
+	}
+	if len(got.Hooks) != 1 {
+		t.Fatalf("audit record has %d hooks, want 1", len(got.Hooks))
+	}
+	if got.Hooks[0].ExitCode != 2 {
+		t.Errorf("hook ExitCode = %d, want 2", got.Hooks[0].ExitCode)
+	}
+	if got.Hooks[0].Error == "" {
+		t.Errorf("hook Error is empty, want the command's error")
+	}
+}
@@ -18,14 +18,14 @@ package gracefulshutdown
 import (
 	"context"
 	"errors"
-	"os"
 	"os/exec"
-	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-agent/metadatascripts"
 	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
 )
 
@@ -34,29 +34,82 @@ const (
 	WatcherID = "graceful-shutdown-watcher"
 	// RunScriptEvent is the graceful shutdown's event type ID.
 	RunScriptEvent = "graceful-shutdown-watcher,run-script"
+	// ShutdownCancelledEvent is emitted when a pending stop is cancelled after
+	// the graceful shutdown hooks were started.
+	ShutdownCancelledEvent = "graceful-shutdown-watcher,shutdown-cancelled"
+	// PreSuspendEvent is emitted when a suspend is pending, the pre-suspend
+	// hooks are started at the same time.
+	PreSuspendEvent = "graceful-shutdown-watcher,pre-suspend"
+	// PostResumeEvent is emitted when the instance leaves the pending suspend
+	// state i.e. it was resumed, the post-resume hooks are started at the same time.
+	PostResumeEvent = "graceful-shutdown-watcher,post-resume"
+	// PreHibernateEvent is emitted when a hibernate-targeted stop is pending, the
+	// hibernate hooks are started at the same time.
+	PreHibernateEvent = "graceful-shutdown-watcher,pre-hibernate"
+
+	// stopStateKey is the metadata key holding the instance's stop state.
+	stopStateKey = "instance/shutdown-details/stop-state"
+	// pendingStopState is the stop state signaling a graceful stop is in progress.
+	pendingStopState = "PENDING_STOP"
+	// pendingSuspendState is the stop state signaling a suspend is in progress.
+	pendingSuspendState = "PENDING_SUSPEND"
+	// pendingHibernateState is the stop state signaling a hibernate-targeted
+	// stop is in progress.
+	pendingHibernateState = "PENDING_HIBERNATE"
+	// gracefulShutdownHook is the name of the graceful shutdown hook in the audit records.
+	gracefulShutdownHook = "graceful-shutdown-scripts"
+	// gracefulShutdownUnit is the systemd unit running the graceful shutdown scripts.
+	gracefulShutdownUnit = "google-graceful-shutdown-scripts.service"
+
+	// preSuspendPhase is the script runner's phase running the pre-suspend scripts.
+	preSuspendPhase = "pre-suspend"
+	// postResumePhase is the script runner's phase running the post-resume scripts.
+	postResumePhase = "post-resume"
+	// hibernatePhase is the script runner's phase running the hibernate scripts.
+	hibernatePhase = "hibernate"
 )
 
 var (
-	runGracefulShutdownScript = func() {
+	// cancelStates are the stop states indicating a previously pending stop
+	// was reverted/cancelled.
+	cancelStates = map[string]bool{
+		"NONE":        true,
+		"CANCELLED":   true,
+		"UNSPECIFIED": true,
+	}
+
+	runGracefulShutdownScript = func(ctx context.Context) error {
 		logger.Infof("Starting graceful shutdown scripts.")
 		if runtime.GOOS == "linux" {
-			cmd := exec.Command("systemctl", "start", "google-graceful-shutdown-scripts.service")
-			if err := cmd.Run(); err != nil {
-				logger.Errorf("failed to run graceful shutdown script: %v", err)
+			// A broken sandbox configuration must not prevent the scripts from running.
+			if err := applySandbox(ctx); err != nil {
+				logger.Errorf("failed to apply graceful shutdown sandbox configuration: %v", err)
 			}
+			return startGracefulShutdownUnit(ctx)
 		} else if runtime.GOOS == "windows" {
-			// On Windows, we run the script runner directly.
-			// We assume GCEMetadataScriptRunner.exe is in the same directory as the agent.
-			exePath, err := os.Executable()
-			if err != nil {
-				logger.Errorf("failed to get agent executable path: %v", err)
-				return
-			}
-			runnerPath := filepath.Join(filepath.Dir(exePath), "GCEMetadataScriptRunner.exe")
-			cmd := exec.Command(runnerPath, "graceful-shutdown")
-			if err := cmd.Run(); err != nil {
-				logger.Errorf("failed to run graceful shutdown script: %v", err)
-			}
+			return runScriptPhase(ctx, "graceful-shutdown")
+		}
+		return nil
+	}
+
+	// runScriptPhase runs the metadata scripts of a given phase in process.
+	runScriptPhase = func(ctx context.Context, phase string) error {
+		logger.Infof("Starting %s scripts.", phase)
+		_, err := metadatascripts.RunPhase(ctx, phase)
+		return err
+	}
+
+	// cancelGracefulShutdownScript signals the running graceful shutdown hooks
+	// to terminate. On Windows the script runner is a child process and is killed
+	// by the cancellation of its context, on Linux the hooks run in their own
+	// systemd unit so we signal all processes of the unit.
+	cancelGracefulShutdownScript = func() {
+		if runtime.GOOS != "linux" {
+			return
+		}
+		cmd := exec.Command("systemctl", "kill", "--kill-whom=all", "--signal=SIGTERM", gracefulShutdownUnit)
+		if err := cmd.Run(); err != nil {
+			logger.Errorf("failed to cancel graceful shutdown script: %v", err)
 		}
 	}
 )
@@ -64,12 +117,36 @@ var (
 // Watcher is the graceful shutdown event watcher implementation.
 type Watcher struct {
 	client metadata.MDSClientInterface
+
+	// pendingStop is true if a PENDING_STOP or PENDING_HIBERNATE was seen and
+	// the hooks were started.
+	pendingStop bool
+
+	// pendingSuspend is true if a PENDING_SUSPEND was seen and the pre-suspend
+	// hooks were started.
+	pendingSuspend bool
+
+	// hooksCancel cancels the running stop hooks, nil if no hooks are running.
+	hooksCancel func()
+
+	// mutex protects pendingStop, pendingSuspend and hooksCancel on concurrent accesses.
+	mutex sync.Mutex
+
+	// notify maps the events emitted from the stop state watching to the
+	// channels used to communicate them to the event's Run() call.
+	notify map[string]chan interface{}
 }
 
 // New allocates and initializes a new Watcher.
 func New() *Watcher {
 	return &Watcher{
 		client: metadata.New(),
+		notify: map[string]chan interface{}{
+			ShutdownCancelledEvent: make(chan interface{}, 1),
+			PreSuspendEvent:        make(chan interface{}, 1),
+			PostResumeEvent:        make(chan interface{}, 1),
+			PreHibernateEvent:      make(chan interface{}, 1),
+		},
 	}
 }
 
@@ -80,12 +157,16 @@ func (mp *Watcher) ID() string {
 
 // Events returns an slice with all implemented events.
 func (mp *Watcher) Events() []string {
-	return []string{RunScriptEvent}
+	return []string{RunScriptEvent, ShutdownCancelledEvent, PreSuspendEvent, PostResumeEvent, PreHibernateEvent}
 }
 
 // Run listens to metadata changes and report back the event.
 func (mp *Watcher) Run(ctx context.Context, evType string) (bool, interface{}, error) {
-	val, err := mp.client.WatchKey(ctx, "instance/shutdown-details/stop-state")
+	if evType != RunScriptEvent {
+		return mp.waitEvent(ctx, evType)
+	}
+
+	val, err := mp.client.WatchKey(ctx, stopStateKey)
 	if err != nil {
 		// If the key doesn't exist (404), it means graceful shutdown is not in progress.
 		// We wait and renew the watcher silently.
@@ -108,12 +189,181 @@ func (mp *Watcher) Run(ctx context.Context, evType string) (bool, interface{}, e
 		}
 	}
 
-	if strings.TrimSpace(val) == "PENDING_STOP" {
-		runGracefulShutdownScript()
-		// VM is stopping, no need to renew the watcher.
-		return false, nil, nil
+	// Keep watching even after the hooks were started, the stop may still be
+	// cancelled and the hooks must be notified.
+	mp.handleState(strings.TrimSpace(val))
+	return true, nil, nil
+}
+
+// handleState starts the graceful shutdown hooks when a stop is pending and
+// cancels them if the pending stop is reverted. It also handles the suspend
+// and resume transitions.
+func (mp *Watcher) handleState(state string) {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+
+	// The hanging get times out and reports the same state again, the hooks
+	// must only be started once per stop/suspend request.
+	if state == pendingSuspendState {
+		if !mp.pendingSuspend {
+			mp.pendingSuspend = true
+			logger.Infof("Suspend pending, running pre-suspend hooks.")
+			mp.startPhaseHooks(preSuspendPhase)
+			mp.emit(PreSuspendEvent, state)
+		}
+		return
 	}
 
-	// If the state is something else (e.g. "NONE" or empty), keep watching.
-	return true, nil, nil
+	// Any state other than a pending suspend means the instance was resumed
+	// (or the suspend reverted), either way the workload must be reinitialized.
+	if mp.pendingSuspend {
+		mp.pendingSuspend = false
+		logger.Infof("Instance resumed, stop state changed to %q, running post-resume hooks.", state)
+		mp.startPhaseHooks(postResumePhase)
+		mp.emit(PostResumeEvent, state)
+	}
+
+	if state == pendingStopState || state == pendingHibernateState {
+		if mp.pendingStop {
+			return
+		}
+		mp.pendingStop = true
+
+		if state == pendingStopState {
+			mp.startStopHooks("graceful-shutdown", gracefulShutdownHook, mp.runGracefulShutdown, cancelGracefulShutdownScript)
+			return
+		}
+
+		logger.Infof("Hibernate pending, running hibernate hooks.")
+		mp.startStopHooks(hibernatePhase, hibernatePhase+"-scripts", func(ctx context.Context) error {
+			return runScriptPhase(ctx, hibernatePhase)
+		}, nil)
+		mp.emit(PreHibernateEvent, state)
+		return
+	}
+
+	if !mp.pendingStop || !cancelStates[state] {
+		return
+	}
+	mp.pendingStop = false
+
+	logger.Infof("Graceful shutdown cancelled, stop state changed to %q.", state)
+	if mp.hooksCancel != nil {
+		mp.hooksCancel()
+		mp.hooksCancel = nil
+	}
+
+	mp.emit(ShutdownCancelledEvent, state)
+}
+
+// emit communicates an event to its Run() call. It never blocks the watcher,
+// if a previous event wasn't consumed yet the new one is dropped.
+func (mp *Watcher) emit(evType string, data interface{}) {
+	select {
+	case mp.notify[evType] <- data:
+	default:
+	}
+}
+
+// startStopHooks starts the hooks of a pending stop, if the stop is cancelled
+// the hook's context is cancelled and, if not nil, terminate is called to signal
+// the hook processes not owned by the agent. The caller must hold the
+// watcher's mutex.
+func (mp *Watcher) startStopHooks(event, name string, hook func(context.Context) error, terminate func()) {
+	// The hooks' context is not derived from the watcher's one, the agent
+	// itself being stopped must not interrupt the hooks.
+	hooksCtx, cancel := context.WithCancel(context.Background())
+	mp.hooksCancel = func() {
+		cancel()
+		if terminate != nil {
+			terminate()
+		}
+	}
+
+	record := newAuditRecord(event)
+	hooksCtx = withStopDeadline(hooksCtx, record.Deadline)
+	go func() {
+		defer cancel()
+		runHook(hooksCtx, record, name, hook)
+
+		mp.mutex.Lock()
+		// If the context was cancelled the cancellation path already reset the
+		// state, and a new set of hooks may be running.
+		if hooksCtx.Err() == nil {
+			mp.hooksCancel = nil
+		}
+		mp.mutex.Unlock()
+
+		writeAuditRecord(record)
+	}()
+}
+
+// stopDeadlineKey is the context key of a stop request's deadline.
+type stopDeadlineKey struct{}
+
+// withStopDeadline returns a copy of the hooks' context ctx carrying the stop
+// request's deadline, it isn't a context deadline as the hooks must not be
+// interrupted by it.
+func withStopDeadline(ctx context.Context, deadline time.Time) context.Context {
+	return context.WithValue(ctx, stopDeadlineKey{}, deadline)
+}
+
+// stopDeadline returns the stop request's deadline carried by ctx, if any.
+func stopDeadline(ctx context.Context) (time.Time, bool) {
+	deadline, ok := ctx.Value(stopDeadlineKey{}).(time.Time)
+	return deadline, ok
+}
+
+// runGracefulShutdown runs the graceful shutdown scripts and publishes their
+// result to guest attributes.
+func (mp *Watcher) runGracefulShutdown(ctx context.Context) error {
+	err := runGracefulShutdownScript(ctx)
+	mp.publishResult(ctx.Err() != nil, err)
+	return err
+}
+
+// startPhaseHooks starts the hooks of a script runner's phase, i.e. pre-suspend.
+// Unlike the stop hooks nothing cancels them, they're interrupted at the
+// max_duration deadline instead.
+func (mp *Watcher) startPhaseHooks(phase string) {
+	record := newAuditRecord(phase)
+	go func() {
+		ctx, cancel := context.WithDeadline(context.Background(), record.Deadline)
+		defer cancel()
+		runHook(ctx, record, phase+"-scripts", func(ctx context.Context) error {
+			return runScriptPhase(ctx, phase)
+		})
+		writeAuditRecord(record)
+	}()
+}
+
+// runHook runs a hook and adds its execution record to the audit record.
+func runHook(ctx context.Context, record *AuditRecord, name string, hook func(context.Context) error) {
+	hookRecord := HookRecord{Name: name, StartedAt: time.Now()}
+	err := hook(ctx)
+	hookRecord.FinishedAt = time.Now()
+	hookRecord.ExitCode = exitCode(err)
+	if err != nil {
+		hookRecord.Error = err.Error()
+	}
+
+	cancelled := ctx.Err() != nil
+	if err != nil && !cancelled {
+		logger.Errorf("failed to run %s hook: %v", name, err)
+	}
+
+	record.Hooks = append(record.Hooks, hookRecord)
+	record.Cancelled = cancelled
+	record.DeadlineHit = hookRecord.FinishedAt.After(record.Deadline)
+}
+
+// waitEvent waits for an event emitted by the stop state watching and reports
+// the stop state as the event data.
+func (mp *Watcher) waitEvent(ctx context.Context, evType string) (bool, interface{}, error) {
+	select {
+	case <-ctx.Done():
+		return false, nil, ctx.Err()
+	case data := <-mp.notify[evType]:
+		return true, data, nil
+	}
 }
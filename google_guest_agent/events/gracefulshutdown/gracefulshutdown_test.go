@@ -17,15 +17,32 @@ package gracefulshutdown
 import (
 	"context"
 	"fmt"
+	"os"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
 	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/google/go-cmp/cmp"
 )
 
+func TestMain(m *testing.M) {
+	if err := cfg.Load(nil); err != nil {
+		os.Exit(1)
+	}
+	// Never write audit records to the serial port or the system's audit file.
+	writeAuditRecord = func(*AuditRecord) {}
+	os.Exit(m.Run())
+}
+
 type mockMDSClient struct {
 	keyVal string
 	keyErr error
+
+	// attrsMu protects attrs, guest attributes are written from the hooks' goroutine.
+	attrsMu sync.Mutex
+	attrs   map[string]string
 }
 
 func (m *mockMDSClient) Get(ctx context.Context) (*metadata.Descriptor, error) {
@@ -52,6 +69,12 @@ func (m *mockMDSClient) WatchKey(ctx context.Context, key string) (string, error
 }
 
 func (m *mockMDSClient) WriteGuestAttributes(ctx context.Context, key string, value string) error {
+	m.attrsMu.Lock()
+	defer m.attrsMu.Unlock()
+	if m.attrs == nil {
+		m.attrs = make(map[string]string)
+	}
+	m.attrs[key] = value
 	return nil
 }
 
@@ -93,18 +116,28 @@ func TestWatcherAPI(t *testing.T) {
 	if w.ID() != WatcherID {
 		t.Errorf("ID() = %q, want %q", w.ID(), WatcherID)
 	}
-	events := w.Events()
-	if len(events) != 1 || events[0] != RunScriptEvent {
-		t.Errorf("Events() = %v, want [%s]", events, RunScriptEvent)
+	want := []string{RunScriptEvent, ShutdownCancelledEvent, PreSuspendEvent, PostResumeEvent, PreHibernateEvent}
+	if diff := cmp.Diff(want, w.Events()); diff != "" {
+		t.Errorf("Events() returned unexpected diff (-want +got):\n%s", diff)
 	}
 }
 
 func TestRun_PendingStop(t *testing.T) {
-	scriptRun := false
+	scriptRun := make(chan bool, 2)
 	originalRunScript := runGracefulShutdownScript
-	defer func() { runGracefulShutdownScript = originalRunScript }()
-	runGracefulShutdownScript = func() {
-		scriptRun = true
+	originalWriteAudit := writeAuditRecord
+	defer func() {
+		runGracefulShutdownScript = originalRunScript
+		writeAuditRecord = originalWriteAudit
+	}()
+	runGracefulShutdownScript = func(context.Context) error {
+		scriptRun <- true
+		return nil
+	}
+	// The audit record is the last thing written by the hooks go routine.
+	hooksDone := make(chan bool, 2)
+	writeAuditRecord = func(*AuditRecord) {
+		hooksDone <- true
 	}
 
 	client := &mockMDSClient{keyVal: "PENDING_STOP"}
@@ -116,12 +149,287 @@ func TestRun_PendingStop(t *testing.T) {
 		t.Errorf("Run() returned error: %v", err)
 	}
 
-	if renew {
-		t.Errorf("Run() returned renew=true, want false for PENDING_STOP")
+	if !renew {
+		t.Errorf("Run() returned renew=false, want true for PENDING_STOP")
+	}
+
+	select {
+	case <-scriptRun:
+		<-hooksDone
+	case <-time.After(time.Second):
+		t.Fatal("graceful shutdown script was not run")
+	}
+
+	client.attrsMu.Lock()
+	result := client.attrs[resultGuestAttribute]
+	client.attrsMu.Unlock()
+	if want := `{"result":"success"}`; result != want {
+		t.Errorf("guest attribute %q = %q, want %q", resultGuestAttribute, result, want)
+	}
+
+	// A repeated PENDING_STOP (i.e. hanging get timeout) must not re-run the hooks.
+	if _, _, err := w.Run(ctx, RunScriptEvent); err != nil {
+		t.Errorf("Run() returned error: %v", err)
+	}
+
+	select {
+	case <-scriptRun:
+		t.Error("graceful shutdown script was run twice for the same stop")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRun_StopCancelled(t *testing.T) {
+	tests := []string{"NONE", "CANCELLED"}
+
+	for _, state := range tests {
+		t.Run(state, func(t *testing.T) {
+			originalRunScript := runGracefulShutdownScript
+			originalCancelScript := cancelGracefulShutdownScript
+			originalWriteAudit := writeAuditRecord
+			t.Cleanup(func() {
+				runGracefulShutdownScript = originalRunScript
+				cancelGracefulShutdownScript = originalCancelScript
+				writeAuditRecord = originalWriteAudit
+			})
+
+			started := make(chan bool)
+			runGracefulShutdownScript = func(ctx context.Context) error {
+				close(started)
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			records := make(chan *AuditRecord, 1)
+			writeAuditRecord = func(record *AuditRecord) {
+				records <- record
+			}
+			killed := false
+			cancelGracefulShutdownScript = func() {
+				killed = true
+			}
+
+			client := &mockMDSClient{keyVal: "PENDING_STOP"}
+			w := New()
+			w.client = client
+
+			ctx := context.Background()
+			if _, _, err := w.Run(ctx, RunScriptEvent); err != nil {
+				t.Fatalf("Run(%s) returned error: %v", RunScriptEvent, err)
+			}
+			<-started
+
+			client.keyVal = state
+			renew, _, err := w.Run(ctx, RunScriptEvent)
+			if err != nil {
+				t.Fatalf("Run(%s) returned error: %v", RunScriptEvent, err)
+			}
+			if !renew {
+				t.Errorf("Run(%s) returned renew=false, want true", RunScriptEvent)
+			}
+
+			select {
+			case record := <-records:
+				if !record.Cancelled {
+					t.Errorf("audit record Cancelled = false, want true")
+				}
+				if len(record.Hooks) != 1 || record.Hooks[0].Name != gracefulShutdownHook {
+					t.Errorf("audit record Hooks = %+v, want a single %q hook", record.Hooks, gracefulShutdownHook)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("graceful shutdown hooks were not cancelled")
+			}
+
+			if !killed {
+				t.Error("cancelGracefulShutdownScript() was not called")
+			}
+
+			renew, data, err := w.Run(ctx, ShutdownCancelledEvent)
+			if err != nil {
+				t.Fatalf("Run(%s) returned error: %v", ShutdownCancelledEvent, err)
+			}
+			if !renew {
+				t.Errorf("Run(%s) returned renew=false, want true", ShutdownCancelledEvent)
+			}
+			if data != state {
+				t.Errorf("Run(%s) returned data %v, want %q", ShutdownCancelledEvent, data, state)
+			}
+		})
+	}
+}
+
+func TestRun_SuspendResume(t *testing.T) {
+	originalRunPhase := runScriptPhase
+	originalWriteAudit := writeAuditRecord
+	t.Cleanup(func() {
+		runScriptPhase = originalRunPhase
+		writeAuditRecord = originalWriteAudit
+	})
+
+	phases := make(chan string, 4)
+	runScriptPhase = func(ctx context.Context, phase string) error {
+		if _, ok := ctx.Deadline(); !ok {
+			t.Errorf("runScriptPhase() called without a deadline for phase %q, want the max_duration deadline", phase)
+		}
+		phases <- phase
+		return nil
+	}
+	records := make(chan *AuditRecord, 4)
+	writeAuditRecord = func(record *AuditRecord) {
+		records <- record
+	}
+
+	client := &mockMDSClient{}
+	w := New()
+	w.client = client
+	ctx := context.Background()
+
+	steps := []struct {
+		state   string
+		evType  string
+		phase   string
+		repeats int
+	}{
+		{state: "PENDING_SUSPEND", evType: PreSuspendEvent, phase: preSuspendPhase, repeats: 2},
+		{state: "NONE", evType: PostResumeEvent, phase: postResumePhase, repeats: 1},
+	}
+
+	for _, step := range steps {
+		client.keyVal = step.state
+		for i := 0; i < step.repeats; i++ {
+			if _, _, err := w.Run(ctx, RunScriptEvent); err != nil {
+				t.Fatalf("Run(%s) returned error: %v", RunScriptEvent, err)
+			}
+		}
+
+		renew, data, err := w.Run(ctx, step.evType)
+		if err != nil {
+			t.Fatalf("Run(%s) returned error: %v", step.evType, err)
+		}
+		if !renew {
+			t.Errorf("Run(%s) returned renew=false, want true", step.evType)
+		}
+		if data != step.state {
+			t.Errorf("Run(%s) returned data %v, want %q", step.evType, data, step.state)
+		}
+
+		select {
+		case phase := <-phases:
+			if phase != step.phase {
+				t.Errorf("runScriptPhase() called with phase %q, want %q", phase, step.phase)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s hooks were not run", step.phase)
+		}
+
+		record := <-records
+		if record.Event != step.phase {
+			t.Errorf("audit record Event = %q, want %q", record.Event, step.phase)
+		}
 	}
 
-	if !scriptRun {
-		t.Error("graceful shutdown script was not run")
+	select {
+	case phase := <-phases:
+		t.Errorf("unexpected %s hooks run", phase)
+	default:
+	}
+}
+
+func TestRun_PendingHibernate(t *testing.T) {
+	originalRunScript := runGracefulShutdownScript
+	originalRunPhase := runScriptPhase
+	originalCancelScript := cancelGracefulShutdownScript
+	originalWriteAudit := writeAuditRecord
+	t.Cleanup(func() {
+		runGracefulShutdownScript = originalRunScript
+		runScriptPhase = originalRunPhase
+		cancelGracefulShutdownScript = originalCancelScript
+		writeAuditRecord = originalWriteAudit
+	})
+
+	runGracefulShutdownScript = func(context.Context) error {
+		t.Error("runGracefulShutdownScript() called for a hibernate stop")
+		return nil
+	}
+	cancelGracefulShutdownScript = func() {
+		t.Error("cancelGracefulShutdownScript() called for a hibernate stop")
+	}
+	phases := make(chan string, 2)
+	runScriptPhase = func(ctx context.Context, phase string) error {
+		phases <- phase
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	records := make(chan *AuditRecord, 1)
+	writeAuditRecord = func(record *AuditRecord) {
+		records <- record
+	}
+
+	client := &mockMDSClient{keyVal: "PENDING_HIBERNATE"}
+	w := New()
+	w.client = client
+	ctx := context.Background()
+
+	// A repeated PENDING_HIBERNATE must not run the hooks twice.
+	for i := 0; i < 2; i++ {
+		if _, _, err := w.Run(ctx, RunScriptEvent); err != nil {
+			t.Fatalf("Run(%s) returned error: %v", RunScriptEvent, err)
+		}
+	}
+
+	select {
+	case phase := <-phases:
+		if phase != hibernatePhase {
+			t.Errorf("runScriptPhase() called with phase %q, want %q", phase, hibernatePhase)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("hibernate hooks were not started")
+	}
+
+	_, data, err := w.Run(ctx, PreHibernateEvent)
+	if err != nil {
+		t.Fatalf("Run(%s) returned error: %v", PreHibernateEvent, err)
+	}
+	if data != "PENDING_HIBERNATE" {
+		t.Errorf("Run(%s) returned data %v, want %q", PreHibernateEvent, data, "PENDING_HIBERNATE")
+	}
+
+	client.keyVal = "CANCELLED"
+	if _, _, err := w.Run(ctx, RunScriptEvent); err != nil {
+		t.Fatalf("Run(%s) returned error: %v", RunScriptEvent, err)
+	}
+
+	select {
+	case record := <-records:
+		if record.Event != hibernatePhase || !record.Cancelled {
+			t.Errorf("audit record = {Event: %q, Cancelled: %t}, want {Event: %q, Cancelled: true}", record.Event, record.Cancelled, hibernatePhase)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("hibernate hooks were not cancelled")
+	}
+
+	if len(phases) != 0 {
+		t.Errorf("runScriptPhase() called %d extra times, want 0", len(phases))
+	}
+}
+
+func TestRun_CancelledWithoutPendingStop(t *testing.T) {
+	client := &mockMDSClient{keyVal: "NONE"}
+	w := New()
+	w.client = client
+
+	if _, _, err := w.Run(context.Background(), RunScriptEvent); err != nil {
+		t.Fatalf("Run(%s) returned error: %v", RunScriptEvent, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	renew, _, err := w.Run(ctx, ShutdownCancelledEvent)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Run(%s) returned error: %v, want %v", ShutdownCancelledEvent, err, context.DeadlineExceeded)
+	}
+	if renew {
+		t.Errorf("Run(%s) returned renew=true, want false", ShutdownCancelledEvent)
 	}
 }
 
@@ -129,8 +437,9 @@ func TestRun_NotPending(t *testing.T) {
 	scriptRun := false
 	originalRunScript := runGracefulShutdownScript
 	defer func() { runGracefulShutdownScript = originalRunScript }()
-	runGracefulShutdownScript = func() {
+	runGracefulShutdownScript = func(context.Context) error {
 		scriptRun = true
+		return nil
 	}
 
 	client := &mockMDSClient{keyVal: "NONE"}
@@ -155,7 +464,7 @@ func TestRun_404(t *testing.T) {
 	// To test 404, we need to construct a real MDSReqError.
 	// We will assume `metadata.NewMDSReqError` exists (I will add it).
 	err404 := metadata.NewMDSReqError(404, fmt.Errorf("not found"))
-	
+
 	client := &mockMDSClient{keyErr: err404}
 	w := &Watcher{client: client}
 
@@ -167,12 +476,12 @@ func TestRun_404(t *testing.T) {
 	}()
 
 	renew, _, err := w.Run(ctx, RunScriptEvent)
-	
+
 	// Expect error to be context cancelled, because we waited.
 	if err != context.Canceled {
 		t.Errorf("Run() returned error: %v, want context.Canceled (implying it waited)", err)
 	}
-	
+
 	// Renew should be false because context cancelled (it exits).
 	if renew {
 		t.Error("Run() returned renew=true, want false on context cancel")
@@ -0,0 +1,108 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gracefulshutdown
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+)
+
+const (
+	// sandboxDropinName is the name of the systemd drop-in holding the sandbox
+	// settings of the graceful shutdown unit.
+	sandboxDropinName = "50-google-sandbox.conf"
+	// metadataServerIPs are the only addresses the scripts can reach when the
+	// sandbox has no network access, the IPv6 one for IPv6-only instances.
+	metadataServerIPs = "169.254.169.254 fd20:ce::254"
+)
+
+var (
+	// sandboxDropinDir is the runtime drop-in directory of the graceful shutdown
+	// unit, the drop-in doesn't survive a reboot and is written again on every
+	// stop request.
+	sandboxDropinDir = filepath.Join("/run/systemd/system", gracefulShutdownUnit+".d")
+
+	// daemonReload reloads systemd's units configuration. Replaceable by unit tests.
+	daemonReload = func(ctx context.Context) error {
+		return exec.CommandContext(ctx, "systemctl", "daemon-reload").Run()
+	}
+)
+
+// sandboxDropin returns the systemd drop-in applying the configured sandbox to
+// the graceful shutdown unit, an empty string means no sandbox is configured.
+func sandboxDropin(config *cfg.GracefulShutdown) string {
+	var lines []string
+
+	if config.SandboxUser != "" {
+		lines = append(lines, "User="+config.SandboxUser)
+	}
+	if config.SandboxCPUQuota != "" {
+		lines = append(lines, "CPUQuota="+config.SandboxCPUQuota)
+	}
+	if config.SandboxMemoryMax != "" {
+		lines = append(lines, "MemoryMax="+config.SandboxMemoryMax)
+	}
+	if config.SandboxNoNetwork {
+		// The script runner still needs the metadata server to fetch the scripts.
+		lines = append(lines, "IPAddressDeny=any", "IPAddressAllow="+metadataServerIPs)
+	}
+
+	if len(lines) == 0 {
+		return ""
+	}
+	return "[Service]\n" + strings.Join(lines, "\n") + "\n"
+}
+
+// applySandbox writes (or removes) the graceful shutdown unit's sandbox
+// drop-in according to the configuration, systemd is only reloaded if the
+// drop-in changed.
+func applySandbox(ctx context.Context) error {
+	fpath := filepath.Join(sandboxDropinDir, sandboxDropinName)
+	want := sandboxDropin(cfg.Get().GracefulShutdown)
+
+	got, err := os.ReadFile(fpath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read sandbox drop-in: %w", err)
+	}
+	if bytes.Equal(got, []byte(want)) {
+		return nil
+	}
+
+	if want == "" {
+		if err := os.Remove(fpath); err != nil {
+			return fmt.Errorf("failed to remove sandbox drop-in: %w", err)
+		}
+	} else {
+		if err := os.MkdirAll(sandboxDropinDir, 0755); err != nil {
+			return fmt.Errorf("failed to create sandbox drop-in directory: %w", err)
+		}
+		if err := os.WriteFile(fpath, []byte(want), 0644); err != nil {
+			return fmt.Errorf("failed to write sandbox drop-in: %w", err)
+		}
+	}
+
+	if err := daemonReload(ctx); err != nil {
+		return fmt.Errorf("failed to reload systemd configuration: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gracefulshutdown
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+)
+
+func TestSandboxDropin(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *cfg.GracefulShutdown
+		want   string
+	}{
+		{
+			name:   "no_sandbox",
+			config: &cfg.GracefulShutdown{},
+			want:   "",
+		},
+		{
+			name:   "user_only",
+			config: &cfg.GracefulShutdown{SandboxUser: "nobody"},
+			want:   "[Service]\nUser=nobody\n",
+		},
+		{
+			name: "all_options",
+			config: &cfg.GracefulShutdown{
+				SandboxUser:      "drain",
+				SandboxCPUQuota:  "50%",
+				SandboxMemoryMax: "512M",
+				SandboxNoNetwork: true,
+			},
+			want: "[Service]\nUser=drain\nCPUQuota=50%\nMemoryMax=512M\nIPAddressDeny=any\nIPAddressAllow=169.254.169.254 fd20:ce::254\n",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := sandboxDropin(tc.config); got != tc.want {
+				t.Errorf("sandboxDropin(%+v) = %q, want %q", tc.config, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestApplySandbox(t *testing.T) {
+	originalDir := sandboxDropinDir
+	originalReload := daemonReload
+	originalUser := cfg.Get().GracefulShutdown.SandboxUser
+	t.Cleanup(func() {
+		sandboxDropinDir = originalDir
+		daemonReload = originalReload
+		cfg.Get().GracefulShutdown.SandboxUser = originalUser
+	})
+
+	sandboxDropinDir = filepath.Join(t.TempDir(), gracefulShutdownUnit+".d")
+	reloads := 0
+	daemonReload = func(context.Context) error {
+		reloads++
+		return nil
+	}
+	fpath := filepath.Join(sandboxDropinDir, sandboxDropinName)
+	ctx := context.Background()
+
+	// No sandbox configured and no drop-in, nothing to do.
+	if err := applySandbox(ctx); err != nil {
+		t.Fatalf("applySandbox() returned error: %v", err)
+	}
+	if reloads != 0 {
+		t.Errorf("applySandbox() reloaded systemd %d times, want 0", reloads)
+	}
+
+	cfg.Get().GracefulShutdown.SandboxUser = "nobody"
+	for i := 0; i < 2; i++ {
+		if err := applySandbox(ctx); err != nil {
+			t.Fatalf("applySandbox() returned error: %v", err)
+		}
+	}
+	got, err := os.ReadFile(fpath)
+	if err != nil {
+		t.Fatalf("failed to read drop-in: %v", err)
+	}
+	if string(got) != "[Service]\nUser=nobody\n" {
+		t.Errorf("drop-in content = %q, want %q", got, "[Service]\nUser=nobody\n")
+	}
+	// The second call must not reload an unchanged drop-in.
+	if reloads != 1 {
+		t.Errorf("applySandbox() reloaded systemd %d times, want 1", reloads)
+	}
+
+	cfg.Get().GracefulShutdown.SandboxUser = ""
+	if err := applySandbox(ctx); err != nil {
+		t.Fatalf("applySandbox() returned error: %v", err)
+	}
+	if _, err := os.Stat(fpath); !os.IsNotExist(err) {
+		t.Errorf("drop-in %q was not removed, stat error: %v", fpath, err)
+	}
+	if reloads != 2 {
+		t.Errorf("applySandbox() reloaded systemd %d times, want 2", reloads)
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gracefulshutdown
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/retry"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// resultGuestAttribute is the guest attribute the graceful shutdown result
+	// is published to.
+	resultGuestAttribute = "guest-agent/graceful-shutdown-result"
+	// journalLines is the number of the unit's journal lines published on failure.
+	journalLines = 20
+)
+
+var (
+	// unitStartPolicy is the retry policy of the graceful shutdown unit start,
+	// the retries are additionally bounded by the grace period.
+	unitStartPolicy = retry.Policy{MaxAttempts: 10, BackoffFactor: 2, Jitter: time.Second}
+
+	// unitRanResults are the systemd unit results meaning the scripts were
+	// executed, a failed start with those results is not retried as it would
+	// run the scripts again.
+	unitRanResults = map[string]bool{
+		"exit-code": true,
+		"signal":    true,
+		"core-dump": true,
+		"timeout":   true,
+	}
+
+	// startUnit starts the graceful shutdown unit and waits for it to finish.
+	startUnit = func(ctx context.Context) error {
+		return exec.CommandContext(ctx, "systemctl", "start", gracefulShutdownUnit).Run()
+	}
+
+	// unitResult returns the graceful shutdown unit's last result.
+	unitResult = func(ctx context.Context) string {
+		out, err := exec.CommandContext(ctx, "systemctl", "show", "--property=Result", "--value", gracefulShutdownUnit).Output()
+		if err != nil {
+			logger.Errorf("failed to get %s result: %v", gracefulShutdownUnit, err)
+			return ""
+		}
+		return strings.TrimSpace(string(out))
+	}
+
+	// journalExcerpt returns the last lines of the graceful shutdown unit's
+	// journal, it's empty on non Linux systems.
+	journalExcerpt = func(ctx context.Context) string {
+		if runtime.GOOS != "linux" {
+			return ""
+		}
+		out, err := exec.CommandContext(ctx, "journalctl", "--unit="+gracefulShutdownUnit, "--boot",
+			fmt.Sprintf("--lines=%d", journalLines), "--no-pager", "--output=cat").Output()
+		if err != nil {
+			logger.Errorf("failed to read %s journal: %v", gracefulShutdownUnit, err)
+			return ""
+		}
+		return strings.TrimSpace(string(out))
+	}
+)
+
+// ShutdownResult is the graceful shutdown scripts' result published to guest
+// attributes.
+type ShutdownResult struct {
+	// Result is one of "success", "failed" or "cancelled".
+	Result string `json:"result"`
+	// Error is the error message if the scripts failed.
+	Error string `json:"error,omitempty"`
+	// Journal is an excerpt of the scripts unit's journal if the scripts failed.
+	Journal string `json:"journal,omitempty"`
+}
+
+// startGracefulShutdownUnit starts the graceful shutdown unit, failed starts
+// are retried with backoff until the stop request's deadline unless the scripts
+// were executed and failed themselves.
+func startGracefulShutdownUnit(ctx context.Context) error {
+	// Only the retries are bounded by the time left until the deadline, a
+	// running unit must not be interrupted by it.
+	deadline, ok := stopDeadline(ctx)
+	if !ok {
+		deadline = time.Now().Add(maxDuration())
+	}
+	retryCtx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	policy := unitStartPolicy
+	policy.ShouldRetry = func(err error) bool {
+		if ctx.Err() != nil {
+			return false
+		}
+		if result := unitResult(ctx); unitRanResults[result] {
+			logger.Errorf("%s ran and failed with result %q, not retrying", gracefulShutdownUnit, result)
+			return false
+		}
+		logger.Warningf("failed to start %s, retrying: %v", gracefulShutdownUnit, err)
+		return true
+	}
+
+	// The retry error wraps the last attempt's one, or is the context's once
+	// the deadline passes, the last attempt's error carries the exit code.
+	var lastErr error
+	err := retry.Run(retryCtx, policy, func() error {
+		lastErr = startUnit(ctx)
+		return lastErr
+	})
+	if err != nil && lastErr != nil {
+		return lastErr
+	}
+	return err
+}
+
+// publishResult publishes the graceful shutdown scripts' result to the
+// instance's guest attributes.
+func (mp *Watcher) publishResult(cancelled bool, err error) {
+	// The hooks' context may have been cancelled already, the result must still
+	// be published.
+	ctx := context.Background()
+
+	result := ShutdownResult{Result: "success"}
+	if cancelled {
+		result.Result = "cancelled"
+	} else if err != nil {
+		result.Result = "failed"
+		result.Error = err.Error()
+		result.Journal = journalExcerpt(ctx)
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		logger.Errorf("failed to marshal graceful shutdown result: %v", err)
+		return
+	}
+
+	if err := mp.client.WriteGuestAttributes(ctx, resultGuestAttribute, string(data)); err != nil {
+		logger.Errorf("failed to publish graceful shutdown result: %v", err)
+	}
+}
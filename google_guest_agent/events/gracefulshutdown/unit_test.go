@@ -0,0 +1,187 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gracefulshutdown
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestStartGracefulShutdownUnit(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int
+		result       string
+		wantAttempts int
+		wantErr      bool
+		// deadline is the stop request's deadline relative to now, zero if
+		// the context doesn't carry one.
+		deadline time.Duration
+	}{
+		{
+			name:         "success",
+			failures:     0,
+			wantAttempts: 1,
+		},
+		{
+			name:         "transient_start_failure",
+			failures:     2,
+			result:       "success",
+			wantAttempts: 3,
+		},
+		{
+			name:         "scripts_failed",
+			failures:     1,
+			result:       "exit-code",
+			wantAttempts: 1,
+			wantErr:      true,
+		},
+		{
+			name:         "deadline_passed",
+			failures:     2,
+			wantAttempts: 1,
+			wantErr:      true,
+			deadline:     -time.Second,
+		},
+	}
+
+	originalPolicy := unitStartPolicy
+	originalStartUnit := startUnit
+	originalUnitResult := unitResult
+	t.Cleanup(func() {
+		unitStartPolicy = originalPolicy
+		startUnit = originalStartUnit
+		unitResult = originalUnitResult
+	})
+	unitStartPolicy.Jitter = time.Millisecond
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			attempts := 0
+			startUnit = func(context.Context) error {
+				attempts++
+				if attempts <= tc.failures {
+					return fmt.Errorf("start failure")
+				}
+				return nil
+			}
+			unitResult = func(context.Context) string {
+				return tc.result
+			}
+
+			ctx := context.Background()
+			if tc.deadline != 0 {
+				ctx = withStopDeadline(ctx, time.Now().Add(tc.deadline))
+			}
+			err := startGracefulShutdownUnit(ctx)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("startGracefulShutdownUnit() = %v, want error: %t", err, tc.wantErr)
+			}
+			if attempts != tc.wantAttempts {
+				t.Errorf("startGracefulShutdownUnit() made %d attempts, want %d", attempts, tc.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestStartGracefulShutdownUnitExitCode(t *testing.T) {
+	originalPolicy := unitStartPolicy
+	originalStartUnit := startUnit
+	originalUnitResult := unitResult
+	t.Cleanup(func() {
+		unitStartPolicy = originalPolicy
+		startUnit = originalStartUnit
+		unitResult = originalUnitResult
+	})
+	unitStartPolicy.Jitter = time.Millisecond
+
+	exitErr := exec.Command("sh", "-c", "exit 3").Run()
+	startUnit = func(context.Context) error { return exitErr }
+
+	tests := []struct {
+		name     string
+		result   string
+		deadline time.Duration
+	}{
+		{name: "scripts_failed", result: "exit-code"},
+		{name: "retries_exhausted"},
+		{name: "deadline_passed", deadline: -time.Second},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			unitResult = func(context.Context) string { return tc.result }
+			ctx := context.Background()
+			if tc.deadline != 0 {
+				ctx = withStopDeadline(ctx, time.Now().Add(tc.deadline))
+			}
+			err := startGracefulShutdownUnit(ctx)
+			if got := exitCode(err); got != 3 {
+				t.Errorf("exitCode(startGracefulShutdownUnit()) = %d (%v), want 3", got, err)
+			}
+		})
+	}
+}
+
+func TestPublishResult(t *testing.T) {
+	originalJournal := journalExcerpt
+	t.Cleanup(func() { journalExcerpt = originalJournal })
+	journalExcerpt = func(context.Context) string { return "script failed" }
+
+	tests := []struct {
+		name      string
+		cancelled bool
+		err       error
+		want      ShutdownResult
+	}{
+		{
+			name: "success",
+			want: ShutdownResult{Result: "success"},
+		},
+		{
+			name: "failed",
+			err:  fmt.Errorf("exit status 1"),
+			want: ShutdownResult{Result: "failed", Error: "exit status 1", Journal: "script failed"},
+		},
+		{
+			name:      "cancelled",
+			cancelled: true,
+			err:       context.Canceled,
+			want:      ShutdownResult{Result: "cancelled"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &mockMDSClient{}
+			w := &Watcher{client: client}
+			w.publishResult(tc.cancelled, tc.err)
+
+			var got ShutdownResult
+			if err := json.Unmarshal([]byte(client.attrs[resultGuestAttribute]), &got); err != nil {
+				t.Fatalf("failed to unmarshal published result: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("publishResult(%t, %v) returned unexpected diff (-want +got):\n%s", tc.cancelled, tc.err, diff)
+			}
+		})
+	}
+}
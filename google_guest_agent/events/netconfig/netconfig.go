@@ -0,0 +1,88 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package netconfig implements the network configuration drift events watcher.
+package netconfig
+
+import (
+	"context"
+
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// WatcherID is the network configuration watcher's ID.
+	WatcherID = "netconfig-watcher"
+	// DriftEvent is emitted when configuration files written by the agent were
+	// changed by another tool, the event data is a *Drift.
+	DriftEvent = "netconfig-watcher,network-config-drift"
+
+	// queueSize is the number of drifts waiting to be reported, the ones above
+	// it are dropped rather than blocking the drift checks.
+	queueSize = 16
+)
+
+// Drift describes the agent's network configuration files changed by another
+// tool.
+type Drift struct {
+	// Files are the changed, created or removed configuration files.
+	Files []string
+	// Reapplied is true if the agent applied its configuration again.
+	Reapplied bool
+}
+
+// Watcher is the network configuration drift events watcher implementation.
+type Watcher struct {
+	// drifts queues the drifts until they are reported by Run().
+	drifts chan *Drift
+}
+
+// New allocates and initializes a new Watcher.
+func New() *Watcher {
+	return &Watcher{
+		drifts: make(chan *Drift, queueSize),
+	}
+}
+
+// ID returns the network configuration event watcher id.
+func (mp *Watcher) ID() string {
+	return WatcherID
+}
+
+// Events returns an slice with all implemented events.
+func (mp *Watcher) Events() []string {
+	return []string{DriftEvent}
+}
+
+// Run waits for drifts and reports them as the event data.
+func (mp *Watcher) Run(ctx context.Context, evType string) (bool, interface{}, error) {
+	select {
+	case <-ctx.Done():
+		return false, nil, ctx.Err()
+	case drift := <-mp.drifts:
+		return true, drift, nil
+	}
+}
+
+// Report queues the drift to be reported, it never blocks the caller.
+func (mp *Watcher) Report(drift *Drift) {
+	if drift == nil || len(drift.Files) == 0 {
+		return
+	}
+	select {
+	case mp.drifts <- drift:
+	default:
+		logger.Debugf("Dropping %s event, too many events queued.", DriftEvent)
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRun(t *testing.T) {
+	mp := New()
+	want := &Drift{Files: []string{"/etc/systemd/network/20-eth1-google-guest-agent.network"}, Reapplied: true}
+
+	// Empty drifts are never reported.
+	mp.Report(nil)
+	mp.Report(&Drift{})
+	mp.Report(want)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	renew, data, err := mp.Run(ctx, DriftEvent)
+	if err != nil || !renew {
+		t.Fatalf("Run(%s) = (%t, %v), want (true, nil)", DriftEvent, renew, err)
+	}
+	if diff := cmp.Diff(want, data); diff != "" {
+		t.Errorf("Run(%s) returned unexpected diff (-want +got):\n%s", DriftEvent, diff)
+	}
+}
+
+func TestRunCancelled(t *testing.T) {
+	mp := New()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if renew, _, err := mp.Run(ctx, DriftEvent); renew || err == nil {
+		t.Errorf("Run() = (%t, %v) for a cancelled context, want (false, error)", renew, err)
+	}
+}
+
+func TestReportNeverBlocks(t *testing.T) {
+	mp := New()
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < queueSize*2; i++ {
+			mp.Report(&Drift{Files: []string{"/etc/sysconfig/network/ifcfg-eth1"}})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Report() blocked with a full queue")
+	}
+}
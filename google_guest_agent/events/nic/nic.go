@@ -0,0 +1,180 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package nic implements the network interfaces hot-plug events watcher.
+package nic
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+)
+
+const (
+	// WatcherID is the network interfaces watcher's ID.
+	WatcherID = "nic-watcher"
+	// ChangedEvent is emitted when network interfaces were added or removed,
+	// the event data is a *Changes.
+	ChangedEvent = "nic-watcher,changed"
+)
+
+// notifier waits for the OS notifications of network interface changes.
+type notifier interface {
+	// wait blocks until the network interfaces may have changed or ctx is
+	// done.
+	wait(ctx context.Context) error
+	// close releases the notifier's resources.
+	close()
+}
+
+var (
+	// openNotifier opens the platform's network interface change notifier.
+	openNotifier = newNotifier
+	// listInterfaces lists the system's network interfaces.
+	listInterfaces = net.Interfaces
+)
+
+// Interface describes an added or removed network interface.
+type Interface struct {
+	// Name is the interface's name, i.e. eth1.
+	Name string
+	// Index is the interface's OS index.
+	Index int
+	// MAC is the interface's hardware address.
+	MAC string
+}
+
+// Changes is the ChangedEvent's data.
+type Changes struct {
+	// Added are the network interfaces that appeared.
+	Added []Interface
+	// Removed are the network interfaces that disappeared.
+	Removed []Interface
+}
+
+// Watcher is the network interfaces hot-plug event watcher implementation.
+type Watcher struct {
+	// notifier is opened on the first Run() call and closed when the watcher
+	// leaves.
+	notifier notifier
+	// known are the network interfaces seen so far, by index.
+	known map[int]Interface
+}
+
+// New allocates and initializes a new Watcher.
+func New() *Watcher {
+	return &Watcher{}
+}
+
+// ID returns the network interfaces event watcher id.
+func (mp *Watcher) ID() string {
+	return WatcherID
+}
+
+// Events returns an slice with all implemented events.
+func (mp *Watcher) Events() []string {
+	return []string{ChangedEvent}
+}
+
+// Run waits until network interfaces are added or removed and reports the
+// changes. Interfaces changes not adding or removing an interface (i.e. a
+// link going down) are not reported.
+func (mp *Watcher) Run(ctx context.Context, evType string) (bool, interface{}, error) {
+	if mp.notifier == nil {
+		n, err := openNotifier()
+		if err != nil {
+			return false, nil, fmt.Errorf("failed to watch network interfaces: %w", err)
+		}
+		mp.notifier = n
+
+		known, err := snapshot()
+		if err != nil {
+			mp.leave()
+			return false, nil, err
+		}
+		mp.known = known
+	}
+
+	for {
+		if err := mp.notifier.wait(ctx); err != nil {
+			mp.leave()
+			return false, nil, err
+		}
+
+		current, err := snapshot()
+		if err != nil {
+			mp.leave()
+			return false, nil, err
+		}
+
+		changes := diff(mp.known, current)
+		mp.known = current
+		if len(changes.Added) > 0 || len(changes.Removed) > 0 {
+			return true, changes, nil
+		}
+	}
+}
+
+// leave closes the notifier, a later Run() call opening a new one.
+func (mp *Watcher) leave() {
+	mp.notifier.close()
+	mp.notifier = nil
+}
+
+// snapshot returns the network interfaces backed by a NIC by index, skipping
+// the loopback and the interfaces without hardware address (i.e. tunnels).
+func snapshot() (map[int]Interface, error) {
+	ifaces, err := listInterfaces()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list network interfaces: %w", err)
+	}
+
+	res := make(map[int]Interface)
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 || len(iface.HardwareAddr) == 0 {
+			continue
+		}
+		res[iface.Index] = Interface{Name: iface.Name, Index: iface.Index, MAC: iface.HardwareAddr.String()}
+	}
+	return res, nil
+}
+
+// diff returns the interfaces added and removed between the known and the
+// current interfaces, sorted by index. A known index with another MAC is a
+// removed and re-added interface.
+func diff(known, current map[int]Interface) *Changes {
+	changes := &Changes{}
+	for index, iface := range current {
+		old, found := known[index]
+		if !found || old.MAC != iface.MAC {
+			changes.Added = append(changes.Added, iface)
+		}
+		if found && old.MAC != iface.MAC {
+			changes.Removed = append(changes.Removed, old)
+		}
+	}
+	for index, iface := range known {
+		if _, found := current[index]; !found {
+			changes.Removed = append(changes.Removed, iface)
+		}
+	}
+
+	byIndex := func(s []Interface) func(i, j int) bool {
+		return func(i, j int) bool { return s[i].Index < s[j].Index }
+	}
+	sort.Slice(changes.Added, byIndex(changes.Added))
+	sort.Slice(changes.Removed, byIndex(changes.Removed))
+	return changes
+}
@@ -0,0 +1,79 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// netlinkNotifier waits for the link messages of the kernel's routing netlink
+// family, sent when links are added, removed or changed.
+type netlinkNotifier struct {
+	fd  int
+	buf []byte
+}
+
+// newNotifier opens a netlink socket subscribed to the link changes. The
+// socket's receive timeout lets wait() check its context periodically.
+func newNotifier() (notifier, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netlink socket: %w", err)
+	}
+
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: unix.RTMGRP_LINK}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to subscribe to netlink link changes: %w", err)
+	}
+
+	tv := unix.Timeval{Sec: 1}
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to set netlink socket timeout: %w", err)
+	}
+
+	return &netlinkNotifier{fd: fd, buf: make([]byte, os.Getpagesize())}, nil
+}
+
+func (n *netlinkNotifier) wait(ctx context.Context) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// The messages themselves don't matter, the interfaces are listed again.
+		_, _, err := unix.Recvfrom(n.fd, n.buf, 0)
+		switch {
+		case err == nil:
+			return nil
+		case errors.Is(err, unix.EAGAIN), errors.Is(err, unix.EINTR):
+			continue
+		case errors.Is(err, unix.ENOBUFS):
+			// Messages were lost, listing the interfaces catches up.
+			return nil
+		default:
+			return fmt.Errorf("failed to read netlink socket: %w", err)
+		}
+	}
+}
+
+func (n *netlinkNotifier) close() {
+	unix.Close(n.fd)
+}
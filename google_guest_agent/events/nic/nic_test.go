@@ -0,0 +1,156 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nic
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeNotifier is a notifier signaled by the test.
+type fakeNotifier struct {
+	changes chan bool
+	closed  bool
+}
+
+func (n *fakeNotifier) wait(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-n.changes:
+		return nil
+	}
+}
+
+func (n *fakeNotifier) close() {
+	n.closed = true
+}
+
+func mustMAC(t *testing.T, s string) net.HardwareAddr {
+	t.Helper()
+	mac, err := net.ParseMAC(s)
+	if err != nil {
+		t.Fatalf("net.ParseMAC(%q) failed: %v", s, err)
+	}
+	return mac
+}
+
+func TestDiff(t *testing.T) {
+	eth0 := Interface{Name: "eth0", Index: 2, MAC: "42:01:0a:00:00:02"}
+	eth1 := Interface{Name: "eth1", Index: 3, MAC: "42:01:0a:00:00:03"}
+	eth1Reused := Interface{Name: "eth1", Index: 3, MAC: "42:01:0a:00:00:04"}
+	eth2 := Interface{Name: "eth2", Index: 4, MAC: "42:01:0a:00:00:05"}
+
+	tests := []struct {
+		name    string
+		known   map[int]Interface
+		current map[int]Interface
+		want    *Changes
+	}{
+		{
+			name:    "no_change",
+			known:   map[int]Interface{2: eth0},
+			current: map[int]Interface{2: eth0},
+			want:    &Changes{},
+		},
+		{
+			name:    "added",
+			known:   map[int]Interface{2: eth0},
+			current: map[int]Interface{2: eth0, 4: eth2, 3: eth1},
+			want:    &Changes{Added: []Interface{eth1, eth2}},
+		},
+		{
+			name:    "removed",
+			known:   map[int]Interface{2: eth0, 3: eth1},
+			current: map[int]Interface{2: eth0},
+			want:    &Changes{Removed: []Interface{eth1}},
+		},
+		{
+			name:    "index_reused",
+			known:   map[int]Interface{2: eth0, 3: eth1},
+			current: map[int]Interface{2: eth0, 3: eth1Reused},
+			want:    &Changes{Added: []Interface{eth1Reused}, Removed: []Interface{eth1}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.want, diff(tc.known, tc.current)); diff != "" {
+				t.Errorf("diff() returned unexpected changes (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	fake := &fakeNotifier{changes: make(chan bool, 2)}
+	eth0 := net.Interface{Index: 2, Name: "eth0", HardwareAddr: mustMAC(t, "42:01:0a:00:00:02")}
+	eth1 := net.Interface{Index: 3, Name: "eth1", HardwareAddr: mustMAC(t, "42:01:0a:00:00:03")}
+	lo := net.Interface{Index: 1, Name: "lo", Flags: net.FlagLoopback | net.FlagUp}
+
+	// The initial interfaces, a change not adding or removing interfaces,
+	// which is not reported, and eth1 being plugged.
+	listings := [][]net.Interface{{lo, eth0}, {lo, eth0}, {lo, eth0, eth1}}
+
+	oldOpen, oldList := openNotifier, listInterfaces
+	t.Cleanup(func() { openNotifier, listInterfaces = oldOpen, oldList })
+	openNotifier = func() (notifier, error) { return fake, nil }
+	listInterfaces = func() ([]net.Interface, error) {
+		res := listings[0]
+		if len(listings) > 1 {
+			listings = listings[1:]
+		}
+		return res, nil
+	}
+
+	mp := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fake.changes <- true
+	fake.changes <- true
+
+	renew, data, err := mp.Run(ctx, ChangedEvent)
+	if err != nil || !renew {
+		t.Fatalf("Run() = (%t, %v), want (true, nil)", renew, err)
+	}
+	want := &Changes{Added: []Interface{{Name: "eth1", Index: 3, MAC: "42:01:0a:00:00:03"}}}
+	if diff := cmp.Diff(want, data); diff != "" {
+		t.Errorf("Run() returned unexpected changes (-want +got):\n%s", diff)
+	}
+
+	cancel()
+	renew, _, err = mp.Run(ctx, ChangedEvent)
+	if renew || !errors.Is(err, context.Canceled) {
+		t.Errorf("Run() = (%t, %v) for a cancelled context, want (false, %v)", renew, err, context.Canceled)
+	}
+	if !fake.closed {
+		t.Errorf("Run() didn't close the notifier when leaving")
+	}
+}
+
+func TestRunNotifierError(t *testing.T) {
+	oldOpen := openNotifier
+	t.Cleanup(func() { openNotifier = oldOpen })
+	openNotifier = func() (notifier, error) { return nil, errors.New("not permitted") }
+
+	if renew, _, err := New().Run(context.Background(), ChangedEvent); renew || err == nil {
+		t.Errorf("Run() = (%t, %v) with a failing notifier, want (false, error)", renew, err)
+	}
+}
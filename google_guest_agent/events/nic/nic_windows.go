@@ -0,0 +1,73 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nic
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	// interfaceChanges is signaled by the IP Helper callback.
+	interfaceChanges = make(chan struct{}, 1)
+	// interfaceCallback is the IP Helper callback, created once since the
+	// callbacks are never released.
+	interfaceCallback     uintptr
+	interfaceCallbackOnce sync.Once
+)
+
+// ipHelperNotifier waits for the IP Helper interface change notifications,
+// sent when a network adapter is plugged, unplugged or changed.
+type ipHelperNotifier struct {
+	handle windows.Handle
+}
+
+// notifyInterfaceChange is called by IP Helper, it must not block.
+func notifyInterfaceChange(callerContext, row, notificationType uintptr) uintptr {
+	select {
+	case interfaceChanges <- struct{}{}:
+	default:
+	}
+	return 0
+}
+
+// newNotifier registers for the IP Helper interface change notifications.
+func newNotifier() (notifier, error) {
+	interfaceCallbackOnce.Do(func() {
+		interfaceCallback = windows.NewCallback(notifyInterfaceChange)
+	})
+
+	var handle windows.Handle
+	if err := windows.NotifyIpInterfaceChange(windows.AF_UNSPEC, interfaceCallback, nil, false, &handle); err != nil {
+		return nil, fmt.Errorf("failed to register for interface changes: %w", err)
+	}
+	return &ipHelperNotifier{handle: handle}, nil
+}
+
+func (n *ipHelperNotifier) wait(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-interfaceChanges:
+		return nil
+	}
+}
+
+func (n *ipHelperNotifier) close() {
+	windows.CancelMibChangeNotify2(n.handle)
+}
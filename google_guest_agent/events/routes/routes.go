@@ -0,0 +1,89 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package routes implements the local routes repair events watcher.
+package routes
+
+import (
+	"context"
+
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// WatcherID is the routes watcher's ID.
+	WatcherID = "routes-watcher"
+	// RepairedEvent is emitted when the agent re-added local routes of alias
+	// ranges or forwarded IPs, or custom routes, removed behind its back.
+	RepairedEvent = "routes-watcher,repaired"
+
+	// queueSize is the number of repairs waiting to be reported, the ones
+	// above it are dropped rather than blocking the reconciliation.
+	queueSize = 16
+)
+
+// Repair describes the routes re-added on a network interface.
+type Repair struct {
+	// Interface is the network interface's name.
+	Interface string
+	// MAC is the network interface's MAC address.
+	MAC string
+	// Routes are the re-added routes' destinations.
+	Routes []string
+}
+
+// Watcher is the routes repair events watcher implementation.
+type Watcher struct {
+	// repairs queues the repairs until they are reported by Run().
+	repairs chan []Repair
+}
+
+// New allocates and initializes a new Watcher.
+func New() *Watcher {
+	return &Watcher{
+		repairs: make(chan []Repair, queueSize),
+	}
+}
+
+// ID returns the routes event watcher id.
+func (mp *Watcher) ID() string {
+	return WatcherID
+}
+
+// Events returns an slice with all implemented events.
+func (mp *Watcher) Events() []string {
+	return []string{RepairedEvent}
+}
+
+// Run waits for repaired routes and reports them as the event data.
+func (mp *Watcher) Run(ctx context.Context, evType string) (bool, interface{}, error) {
+	select {
+	case <-ctx.Done():
+		return false, nil, ctx.Err()
+	case repairs := <-mp.repairs:
+		return true, repairs, nil
+	}
+}
+
+// Report queues the repairs to be reported, it never blocks the caller.
+func (mp *Watcher) Report(repairs []Repair) {
+	if len(repairs) == 0 {
+		return
+	}
+	select {
+	case mp.repairs <- repairs:
+	default:
+		logger.Debugf("Dropping %s event, too many events queued.", RepairedEvent)
+	}
+}
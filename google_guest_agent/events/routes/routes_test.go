@@ -0,0 +1,71 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routes
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRun(t *testing.T) {
+	mp := New()
+	want := []Repair{{Interface: "eth0", MAC: "42:01:0a:00:00:02", Routes: []string{"10.1.0.0/24"}}}
+
+	// Empty repairs are never reported.
+	mp.Report(nil)
+	mp.Report(want)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	renew, data, err := mp.Run(ctx, RepairedEvent)
+	if err != nil || !renew {
+		t.Fatalf("Run(%s) = (%t, %v), want (true, nil)", RepairedEvent, renew, err)
+	}
+	if diff := cmp.Diff(want, data); diff != "" {
+		t.Errorf("Run(%s) returned unexpected diff (-want +got):\n%s", RepairedEvent, diff)
+	}
+}
+
+func TestRunCancelled(t *testing.T) {
+	mp := New()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if renew, _, err := mp.Run(ctx, RepairedEvent); renew || err == nil {
+		t.Errorf("Run() = (%t, %v) for a cancelled context, want (false, error)", renew, err)
+	}
+}
+
+func TestReportNeverBlocks(t *testing.T) {
+	mp := New()
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < queueSize*2; i++ {
+			mp.Report([]Repair{{Interface: "eth0", Routes: []string{"10.1.0.0/24"}}})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Report() blocked with a full queue")
+	}
+}
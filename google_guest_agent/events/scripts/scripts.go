@@ -0,0 +1,130 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package scripts implements the metadata scripts lifecycle events watcher.
+package scripts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/command"
+	"github.com/GoogleCloudPlatform/guest-agent/metadatascripts"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// WatcherID is the metadata scripts watcher's ID.
+	WatcherID = "metadata-scripts-watcher"
+	// StartedEvent is emitted when a metadata script run by the agent starts.
+	StartedEvent = "metadata-scripts-watcher,script-started"
+	// FinishedEvent is emitted when a metadata script run by the agent
+	// finished, the event data carrying its result.
+	FinishedEvent = "metadata-scripts-watcher,script-finished"
+	// Command is the command monitor command publishing the lifecycle events
+	// of the scripts run by another process, i.e. the metadata script runner.
+	Command = "agent.ScriptEvent"
+
+	// queueSize is the number of events of each type waiting to be reported,
+	// the events above it are dropped rather than blocking the scripts.
+	queueSize = 64
+)
+
+// Watcher is the metadata scripts lifecycle events watcher implementation.
+type Watcher struct {
+	// notify maps the event types to the channels queuing the scripts'
+	// lifecycle events until they are reported by the event's Run() call.
+	notify map[string]chan metadatascripts.ScriptEvent
+}
+
+// eventRequest is the Command request.
+type eventRequest struct {
+	command.Request
+	Event metadatascripts.ScriptEvent
+}
+
+// New allocates and initializes a new Watcher. The events are received by
+// Handle, set as the metadatascripts event handler for the scripts run by the
+// agent's process, and by HandleCommand for the scripts run by other
+// processes.
+func New() *Watcher {
+	return &Watcher{
+		notify: map[string]chan metadatascripts.ScriptEvent{
+			StartedEvent:  make(chan metadatascripts.ScriptEvent, queueSize),
+			FinishedEvent: make(chan metadatascripts.ScriptEvent, queueSize),
+		},
+	}
+}
+
+// ID returns the metadata scripts event watcher id.
+func (mp *Watcher) ID() string {
+	return WatcherID
+}
+
+// Events returns an slice with all implemented events.
+func (mp *Watcher) Events() []string {
+	return []string{StartedEvent, FinishedEvent}
+}
+
+// Run waits for a script lifecycle event and reports it as the event data.
+func (mp *Watcher) Run(ctx context.Context, evType string) (bool, interface{}, error) {
+	select {
+	case <-ctx.Done():
+		return false, nil, ctx.Err()
+	case ev := <-mp.notify[evType]:
+		return true, ev, nil
+	}
+}
+
+// Handle queues a script lifecycle event, it never blocks the script.
+func (mp *Watcher) Handle(ev metadatascripts.ScriptEvent) {
+	evType := StartedEvent
+	if ev.Type == metadatascripts.ScriptFinished {
+		evType = FinishedEvent
+	}
+	select {
+	case mp.notify[evType] <- ev:
+	default:
+		logger.Debugf("Dropping %s event of %s, too many events queued.", evType, ev.Script)
+	}
+}
+
+// HandleCommand is the Command handler, queuing the event sent by Send.
+func (mp *Watcher) HandleCommand(b []byte) ([]byte, error) {
+	var req eventRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		return nil, err
+	}
+	mp.Handle(req.Event)
+	return json.Marshal(command.Response{})
+}
+
+// Send publishes a script lifecycle event to the agent's watcher through the
+// command monitor, it's used by the processes running scripts outside of the
+// agent.
+func Send(ctx context.Context, ev metadatascripts.ScriptEvent) error {
+	req, err := json.Marshal(eventRequest{Request: command.Request{Command: Command}, Event: ev})
+	if err != nil {
+		return err
+	}
+	var resp command.Response
+	if err := json.Unmarshal(command.SendCommand(ctx, req), &resp); err != nil {
+		return fmt.Errorf("failed to parse the %s response: %w", Command, err)
+	}
+	if resp.Status != 0 {
+		return fmt.Errorf("%s failed with status %d: %s", Command, resp.Status, resp.StatusMessage)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scripts
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/metadatascripts"
+)
+
+func TestRun(t *testing.T) {
+	mp := New()
+
+	started := metadatascripts.ScriptEvent{Type: metadatascripts.ScriptStarted, Phase: "hibernate", Script: "hibernate-script"}
+	finished := metadatascripts.ScriptEvent{
+		Type:   metadatascripts.ScriptFinished,
+		Phase:  "hibernate",
+		Script: "hibernate-script",
+		Result: &metadatascripts.ScriptResult{Script: "hibernate-script", ExitCode: 3},
+	}
+	mp.Handle(started)
+	mp.Handle(finished)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	for evType, want := range map[string]metadatascripts.ScriptEvent{StartedEvent: started, FinishedEvent: finished} {
+		renew, data, err := mp.Run(ctx, evType)
+		if err != nil || !renew {
+			t.Fatalf("Run(%s) = (%t, %v), want (true, nil)", evType, renew, err)
+		}
+		ev, ok := data.(metadatascripts.ScriptEvent)
+		if !ok {
+			t.Fatalf("Run(%s) data is %T, want metadatascripts.ScriptEvent", evType, data)
+		}
+		if ev.Type != want.Type || ev.Script != want.Script || ev.Result != want.Result {
+			t.Errorf("Run(%s) = %+v, want %+v", evType, ev, want)
+		}
+	}
+}
+
+func TestHandleCommand(t *testing.T) {
+	mp := New()
+
+	want := metadatascripts.ScriptEvent{
+		Type:   metadatascripts.ScriptFinished,
+		Phase:  "startup",
+		Script: "startup-script",
+		Result: &metadatascripts.ScriptResult{Script: "startup-script", ExitCode: 3},
+	}
+	req, err := json.Marshal(eventRequest{Event: want})
+	if err != nil {
+		t.Fatalf("json.Marshal() failed unexpectedly with error: %v", err)
+	}
+	if _, err := mp.HandleCommand(req); err != nil {
+		t.Fatalf("HandleCommand() failed unexpectedly with error: %v", err)
+	}
+	if _, err := mp.HandleCommand([]byte("{")); err == nil {
+		t.Errorf("HandleCommand() succeeded with an invalid request, want error")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, data, err := mp.Run(ctx, FinishedEvent)
+	if err != nil {
+		t.Fatalf("Run(%s) failed unexpectedly with error: %v", FinishedEvent, err)
+	}
+	ev, ok := data.(metadatascripts.ScriptEvent)
+	if !ok {
+		t.Fatalf("Run(%s) data is %T, want metadatascripts.ScriptEvent", FinishedEvent, data)
+	}
+	if ev.Script != want.Script || ev.Result == nil || ev.Result.ExitCode != want.Result.ExitCode {
+		t.Errorf("Run(%s) = %+v, want %+v", FinishedEvent, ev, want)
+	}
+}
+
+func TestRunCancelled(t *testing.T) {
+	mp := New()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if renew, _, err := mp.Run(ctx, StartedEvent); renew || err == nil {
+		t.Errorf("Run() = (%t, %v) for a cancelled context, want (false, error)", renew, err)
+	}
+}
+
+func TestHandleNeverBlocks(t *testing.T) {
+	mp := New()
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < queueSize*2; i++ {
+			mp.Handle(metadatascripts.ScriptEvent{Type: metadatascripts.ScriptStarted, Script: "startup-script"})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Handle() blocked with a full queue")
+	}
+}
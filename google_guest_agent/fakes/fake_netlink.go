@@ -0,0 +1,77 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fakes
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Netlink is an in-memory netlink implementation keeping the local routes
+// per interface and protocol.
+type Netlink struct {
+	mu     sync.Mutex
+	routes map[string][]*net.IPNet
+}
+
+// NewNetlink returns an empty fake netlink.
+func NewNetlink() *Netlink {
+	return &Netlink{routes: make(map[string][]*net.IPNet)}
+}
+
+// key returns the routes map key of iface and proto.
+func (n *Netlink) key(iface string, proto int) string {
+	return fmt.Sprintf("%s/%d", iface, proto)
+}
+
+// LocalRoutes returns the routes added to iface with proto.
+func (n *Netlink) LocalRoutes(iface string, proto int) ([]*net.IPNet, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return append([]*net.IPNet(nil), n.routes[n.key(iface, proto)]...), nil
+}
+
+// AddLocalRoute records dst as a route of iface, it fails if the route
+// already exists like the kernel does.
+func (n *Netlink) AddLocalRoute(dst *net.IPNet, iface string, proto int) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	k := n.key(iface, proto)
+	for _, r := range n.routes[k] {
+		if r.String() == dst.String() {
+			return fmt.Errorf("route %s on %s already exists", dst, iface)
+		}
+	}
+	n.routes[k] = append(n.routes[k], dst)
+	return nil
+}
+
+// DeleteLocalRoute removes dst from the routes of iface.
+func (n *Netlink) DeleteLocalRoute(dst *net.IPNet, iface string, proto int) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	k := n.key(iface, proto)
+	for i, r := range n.routes[k] {
+		if r.String() == dst.String() {
+			n.routes[k] = append(n.routes[k][:i], n.routes[k][i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("route %s on %s not found", dst, iface)
+}
@@ -0,0 +1,198 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+// gmsaServicesRegKey is the registry value listing the services configured
+// to run as a gMSA, with the account they ran as before.
+const gmsaServicesRegKey = "GMSAServices"
+
+var (
+	// gmsaAccountExp matches the valid gMSA names, with an optional NetBIOS
+	// domain name and trailing $.
+	gmsaAccountExp = regexp.MustCompile(`^([A-Za-z0-9-]{1,15}\\)?[A-Za-z0-9_.-]{1,15}\$?$`)
+	// serviceNameExp matches the valid service names.
+	serviceNameExp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+)
+
+// gmsaAccounts returns the gMSAs set in the instance attributes, or in the
+// project attributes if unset.
+func gmsaAccounts(md *metadata.Descriptor) metadata.GMSAccounts {
+	if md.Instance.Attributes.GMSAccounts != nil {
+		return md.Instance.Attributes.GMSAccounts
+	}
+	return md.Project.Attributes.GMSAccounts
+}
+
+// gmsaService is a service run as a gMSA.
+type gmsaService struct {
+	// name is the service's name.
+	name string
+	// account is the gMSA's name, with its trailing $.
+	account string
+}
+
+// gmsaServices returns the services to run as the accounts' gMSAs. Invalid
+// accounts and services are logged and skipped, as are the services listed
+// more than once.
+func gmsaServices(accounts metadata.GMSAccounts) []gmsaService {
+	var res []gmsaService
+	seen := make(map[string]bool)
+	for _, a := range accounts {
+		if !gmsaAccountExp.MatchString(a.Account) {
+			logger.Errorf("Invalid gMSA name %q, skipping it", a.Account)
+			continue
+		}
+		account := strings.TrimSuffix(a.Account, "$") + "$"
+
+		for _, name := range a.Services {
+			switch {
+			case !serviceNameExp.MatchString(name):
+				logger.Errorf("Invalid service name %q for gMSA %s, skipping it", name, account)
+			case seen[strings.ToLower(name)]:
+				logger.Errorf("Service %s is set to run as more than one gMSA, skipping %s", name, account)
+			default:
+				seen[strings.ToLower(name)] = true
+				res = append(res, gmsaService{name: name, account: account})
+			}
+		}
+	}
+	return res
+}
+
+// gmsaInstallCommand returns the PowerShell command installing the gMSA on
+// the instance and verifying it can use it.
+func gmsaInstallCommand(account string) string {
+	// Install-ADServiceAccount takes the account without its domain.
+	_, name, found := strings.Cut(account, `\`)
+	if !found {
+		name = account
+	}
+	return fmt.Sprintf("Install-ADServiceAccount -Identity %[1]s; if (-not (Test-ADServiceAccount -Identity %[1]s)) { throw 'gMSA test failed' }", psQuote(name))
+}
+
+// serviceLogonCommand returns the PowerShell command setting the account the
+// service runs as, restarting it if it's running. Accounts without a domain
+// are qualified with the instance's AD domain.
+func serviceLogonCommand(service, account string) string {
+	startName := psQuote(account)
+	if !strings.Contains(account, `\`) && strings.HasSuffix(account, "$") {
+		startName = fmt.Sprintf(`((Get-ADDomain).NetBIOSName + '\' + %s)`, psQuote(account))
+	}
+	return fmt.Sprintf(
+		"$s = Get-CimInstance Win32_Service -Filter %s; "+
+			"if (-not $s) { throw 'service not found' }; "+
+			"$r = Invoke-CimMethod -InputObject $s -MethodName Change -Arguments @{StartName = %s; StartPassword = ''}; "+
+			"if ($r.ReturnValue -ne 0) { throw \"Change failed with $($r.ReturnValue)\" }; "+
+			"if ($s.State -eq 'Running') { Restart-Service -Name %s -Force }",
+		psQuote(fmt.Sprintf("Name='%s'", service)), startName, psQuote(service))
+}
+
+// serviceAccount returns the account the service runs as.
+func serviceAccount(ctx context.Context, service string) (string, error) {
+	cmd := fmt.Sprintf("(Get-CimInstance Win32_Service -Filter %s).StartName", psQuote(fmt.Sprintf("Name='%s'", service)))
+	res := run.WithOutput(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command", cmd)
+	if res.ExitCode != 0 {
+		return "", res
+	}
+	account := strings.TrimSpace(res.StdOut)
+	if account == "" {
+		return "", fmt.Errorf("service %s not found", service)
+	}
+	return account, nil
+}
+
+// parseGMSAState parses the registry entries of the services run as a gMSA,
+// service=previous account, into a map.
+func parseGMSAState(entries []string) map[string]string {
+	res := make(map[string]string)
+	for _, e := range entries {
+		service, account, found := strings.Cut(e, "=")
+		if !found {
+			logger.Errorf("Bad gMSA service entry from registry: %q", e)
+			continue
+		}
+		res[service] = account
+	}
+	return res
+}
+
+// setGMSAccounts installs the gMSAs and sets the services they're configured
+// for to run as them. The services not configured anymore are set back to the
+// account they ran as before.
+func setGMSAccounts(ctx context.Context, accounts metadata.GMSAccounts) error {
+	entries, err := readRegMultiString(regKeyBase, gmsaServicesRegKey)
+	if err != nil && err != errRegNotExist {
+		return err
+	}
+	previous := parseGMSAState(entries)
+	services := gmsaServices(accounts)
+
+	for service, account := range previous {
+		if slices.ContainsFunc(services, func(s gmsaService) bool { return strings.EqualFold(s.name, service) }) {
+			continue
+		}
+		logger.Infof("Setting service %s back to run as %s", service, account)
+		if err := run.Quiet(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command", serviceLogonCommand(service, account)); err != nil {
+			logger.Errorf("Failed to set service %s back to run as %s: %v", service, account, err)
+			continue
+		}
+		delete(previous, service)
+	}
+
+	installed := make(map[string]bool)
+	for _, s := range services {
+		if !installed[s.account] {
+			logger.Infof("Installing gMSA %s", s.account)
+			if err := run.Quiet(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command", gmsaInstallCommand(s.account)); err != nil {
+				logger.Errorf("Failed to install gMSA %s: %v", s.account, err)
+				continue
+			}
+			installed[s.account] = true
+		}
+
+		if _, ok := previous[s.name]; !ok {
+			account, err := serviceAccount(ctx, s.name)
+			if err != nil {
+				logger.Errorf("Failed to get the account of service %s: %v", s.name, err)
+				continue
+			}
+			previous[s.name] = account
+		}
+
+		logger.Infof("Setting service %s to run as gMSA %s", s.name, s.account)
+		if err := run.Quiet(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command", serviceLogonCommand(s.name, s.account)); err != nil {
+			logger.Errorf("Failed to set service %s to run as gMSA %s: %v", s.name, s.account, err)
+		}
+	}
+
+	var state []string
+	for service, account := range previous {
+		state = append(state, service+"="+account)
+	}
+	slices.Sort(state)
+	return writeRegMultiString(regKeyBase, gmsaServicesRegKey, state)
+}
@@ -0,0 +1,72 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestGMSAServices(t *testing.T) {
+	accounts := metadata.GMSAccounts{
+		{Account: `CORP\svc-web`, Services: []string{"W3SVC", "WAS", "bad'name"}},
+		{Account: "svc-sql$", Services: []string{"MSSQLSERVER", "w3svc"}},
+		{Account: "not a valid account", Services: []string{"Spooler"}},
+	}
+	want := []gmsaService{
+		{name: "W3SVC", account: `CORP\svc-web$`},
+		{name: "WAS", account: `CORP\svc-web$`},
+		{name: "MSSQLSERVER", account: "svc-sql$"},
+	}
+	if diff := cmp.Diff(want, gmsaServices(accounts), cmp.AllowUnexported(gmsaService{})); diff != "" {
+		t.Errorf("gmsaServices() returned unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestGMSAInstallCommand(t *testing.T) {
+	got := gmsaInstallCommand(`CORP\svc-web$`)
+	if !strings.HasPrefix(got, "Install-ADServiceAccount -Identity 'svc-web$';") || !strings.Contains(got, "Test-ADServiceAccount -Identity 'svc-web$'") {
+		t.Errorf("gmsaInstallCommand() = %q, want the account installed and tested without its domain", got)
+	}
+}
+
+func TestServiceLogonCommand(t *testing.T) {
+	tests := []struct {
+		account string
+		want    string
+	}{
+		{`CORP\svc-web$`, `StartName = 'CORP\svc-web$'`},
+		{"svc-web$", `StartName = ((Get-ADDomain).NetBIOSName + '\' + 'svc-web$')`},
+		{"LocalSystem", "StartName = 'LocalSystem'"},
+	}
+
+	for _, tc := range tests {
+		got := serviceLogonCommand("W3SVC", tc.account)
+		if !strings.Contains(got, tc.want) || !strings.Contains(got, `-Filter 'Name=''W3SVC'''`) {
+			t.Errorf("serviceLogonCommand(W3SVC, %s) = %q, want it to contain %q", tc.account, got, tc.want)
+		}
+	}
+}
+
+func TestParseGMSAState(t *testing.T) {
+	got := parseGMSAState([]string{"W3SVC=LocalSystem", "bad", `MSSQLSERVER=NT Service\MSSQLSERVER`})
+	want := map[string]string{"W3SVC": "LocalSystem", "MSSQLSERVER": `NT Service\MSSQLSERVER`}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("parseGMSAState() returned unexpected diff (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// hostKeyRotatorID is the SSH host key rotation job's ID.
+	hostKeyRotatorID = "host-key-rotation"
+
+	// maxHostKeyCheckInterval bounds the interval at which the host keys' age
+	// is checked, the agent restarts would otherwise postpone the rotation.
+	maxHostKeyCheckInterval = time.Hour
+)
+
+// hostKeysRotatedFile records the time of the last host key rotation, the age
+// of the key files can't tell it as the key types ssh-keygen fails to generate
+// are never regenerated. Overridden in tests.
+var hostKeysRotatedFile = "/var/lib/google-guest-agent/host_keys_rotated"
+
+// hostKeyRotator regenerates the SSH host keys once they are older than the
+// configured rotation interval, reloads sshd and publishes the new public keys
+// and their fingerprints to the guest attributes.
+type hostKeyRotator struct{}
+
+// ID returns the host key rotation job's ID.
+func (r *hostKeyRotator) ID() string {
+	return hostKeyRotatorID
+}
+
+// Interval returns the interval at which the host keys' age is checked.
+func (r *hostKeyRotator) Interval() (time.Duration, bool) {
+	return min(hostKeyRotationInterval(), maxHostKeyCheckInterval), false
+}
+
+// ShouldEnable returns true on Linux if the agent manages the host keys and
+// the rotation is enabled.
+func (r *hostKeyRotator) ShouldEnable(ctx context.Context) bool {
+	return runtime.GOOS != "windows" && cfg.Get().InstanceSetup.SetHostKeys && hostKeyRotationInterval() > 0
+}
+
+// Run rotates the host keys if the oldest one is due.
+func (r *hostKeyRotator) Run(ctx context.Context) (bool, error) {
+	interval := hostKeyRotationInterval()
+	if interval <= 0 {
+		return false, nil
+	}
+	if pausedForMaintenance(r.ID()) {
+		return true, nil
+	}
+
+	config := cfg.Get().InstanceSetup
+	age, err := hostKeysAge(config.HostKeyDir, strings.Split(config.HostKeyTypes, ","), time.Now())
+	if err != nil {
+		return true, err
+	}
+	if age < interval {
+		return true, nil
+	}
+
+	logger.Infof("SSH host keys are %s old, rotating them.", age.Round(time.Second))
+	if err := generateSSHKeys(ctx); err != nil {
+		return true, fmt.Errorf("failed to rotate SSH host keys: %w", err)
+	}
+	if err := recordHostKeysRotation(time.Now()); err != nil {
+		logger.Errorf("Failed to record the SSH host keys rotation: %v", err)
+	}
+	for _, svc := range []string{"ssh", "sshd"} {
+		if err := systemctlReloadOrRestart(ctx, svc); err != nil {
+			logger.Errorf("Error reloading service: %v.", err)
+		}
+	}
+	return true, nil
+}
+
+// hostKeysAge returns the time since the last host key rotation or, if the
+// keys were never rotated, the age of the oldest SSH host key of keyTypes in
+// dir. Without any host key the keys are considered due.
+func hostKeysAge(dir string, keyTypes []string, now time.Time) (time.Duration, error) {
+	data, err := os.ReadFile(hostKeysRotatedFile)
+	if err == nil {
+		rotated, err := time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+		if err == nil {
+			return now.Sub(rotated), nil
+		}
+		logger.Errorf("Ignoring malformed SSH host keys rotation time %q: %v", data, err)
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	var oldest time.Time
+	for _, keyType := range keyTypes {
+		info, err := os.Stat(filepath.Join(dir, fmt.Sprintf("ssh_host_%s_key", strings.TrimSpace(keyType))))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if oldest.IsZero() || info.ModTime().Before(oldest) {
+			oldest = info.ModTime()
+		}
+	}
+	if oldest.IsZero() {
+		return time.Duration(math.MaxInt64), nil
+	}
+	return now.Sub(oldest), nil
+}
+
+// recordHostKeysRotation records now as the time of the last host key
+// rotation.
+func recordHostKeysRotation(now time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(hostKeysRotatedFile), 0755); err != nil {
+		return err
+	}
+	tmp := hostKeysRotatedFile + ".tmp"
+	if err := os.WriteFile(tmp, []byte(now.Format(time.RFC3339)+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, hostKeysRotatedFile)
+}
+
+// hostKeyAttributes returns the guest attributes publishing the public host
+// key, its base64 encoded key and its SHA256 fingerprint keyed by key type.
+func hostKeyAttributes(pubKey string) (map[string]string, error) {
+	vals := strings.Fields(pubKey)
+	if len(vals) < 2 {
+		return nil, fmt.Errorf("malformed public key")
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pubKey))
+	if err != nil {
+		return nil, fmt.Errorf("malformed public key: %w", err)
+	}
+	return map[string]string{
+		"hostkeys/" + vals[0]:            vals[1],
+		"hostkeyfingerprints/" + vals[0]: ssh.FingerprintSHA256(key),
+	}, nil
+}
+
+// hostKeyRotationInterval returns the configured host key rotation interval.
+func hostKeyRotationInterval() time.Duration {
+	interval, err := time.ParseDuration(cfg.Get().InstanceSetup.HostKeyRotationInterval)
+	if err != nil {
+		logger.Errorf("host_key_rotation_interval configuration is not a valid duration string, disabling the rotation")
+		return 0
+	}
+	return interval
+}
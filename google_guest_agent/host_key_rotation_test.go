@@ -0,0 +1,107 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestHostKeysAge(t *testing.T) {
+	dir := t.TempDir()
+	// The rotation time is recorded with a second precision.
+	now := time.Now().Truncate(time.Second)
+	keyTypes := []string{"ecdsa", "ed25519", "rsa"}
+
+	origRotatedFile := hostKeysRotatedFile
+	t.Cleanup(func() { hostKeysRotatedFile = origRotatedFile })
+	hostKeysRotatedFile = filepath.Join(t.TempDir(), "host_keys_rotated")
+
+	age, err := hostKeysAge(dir, keyTypes, now)
+	if err != nil {
+		t.Fatalf("hostKeysAge() failed unexpectedly with error: %v", err)
+	}
+	if age != time.Duration(math.MaxInt64) {
+		t.Errorf("hostKeysAge() = %v without host keys, want keys due", age)
+	}
+
+	for file, mtime := range map[string]time.Time{
+		"ssh_host_ed25519_key":       now.Add(-time.Hour),
+		"ssh_host_rsa_key":           now.Add(-48 * time.Hour),
+		"ssh_host_dsa_key":           now.Add(-96 * time.Hour),
+		"ssh_host_rsa_key.pub":       now.Add(-72 * time.Hour),
+		"ssh_host_ecdsa_key.temp":    now.Add(-96 * time.Hour),
+		"ssh_known_hosts_google_key": now.Add(-96 * time.Hour),
+	} {
+		path := filepath.Join(dir, file)
+		if err := os.WriteFile(path, nil, 0600); err != nil {
+			t.Fatalf("os.WriteFile(%s) failed unexpectedly with error: %v", path, err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatalf("os.Chtimes(%s) failed unexpectedly with error: %v", path, err)
+		}
+	}
+
+	age, err = hostKeysAge(dir, keyTypes, now)
+	if err != nil {
+		t.Fatalf("hostKeysAge() failed unexpectedly with error: %v", err)
+	}
+	if want := 48 * time.Hour; age.Round(time.Second) != want {
+		t.Errorf("hostKeysAge() = %v, want %v", age, want)
+	}
+
+	// Once rotated, the keys not regenerated don't count.
+	if err := recordHostKeysRotation(now.Add(-2 * time.Hour)); err != nil {
+		t.Fatalf("recordHostKeysRotation() failed unexpectedly with error: %v", err)
+	}
+	age, err = hostKeysAge(dir, keyTypes, now)
+	if err != nil {
+		t.Fatalf("hostKeysAge() failed unexpectedly with error: %v", err)
+	}
+	if want := 2 * time.Hour; age.Round(time.Second) != want {
+		t.Errorf("hostKeysAge() = %v after a rotation, want %v", age, want)
+	}
+}
+
+func TestHostKeyAttributes(t *testing.T) {
+	pubKey := "ssh-rsa " + utils.MakeRandRSAPubKey(t)
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pubKey))
+	if err != nil {
+		t.Fatalf("ssh.ParseAuthorizedKey() failed unexpectedly with error: %v", err)
+	}
+
+	attrs, err := hostKeyAttributes(pubKey + " root@host\n")
+	if err != nil {
+		t.Fatalf("hostKeyAttributes() failed unexpectedly with error: %v", err)
+	}
+	if got, want := attrs["hostkeyfingerprints/ssh-rsa"], ssh.FingerprintSHA256(key); got != want {
+		t.Errorf("hostKeyAttributes() fingerprint = %q, want %q", got, want)
+	}
+	if _, ok := attrs["hostkeys/ssh-rsa"]; !ok || len(attrs) != 2 {
+		t.Errorf("hostKeyAttributes() = %v, want the public key and its fingerprint", attrs)
+	}
+
+	for _, invalid := range []string{"", "ssh-rsa", "ssh-rsa invalid"} {
+		if _, err := hostKeyAttributes(invalid); err == nil {
+			t.Errorf("hostKeyAttributes(%q) succeeded, want error", invalid)
+		}
+	}
+}
@@ -48,6 +48,31 @@ func getDefaultAdapter(fes []ipForwardEntry) (*ipForwardEntry, error) {
 	return nil, fmt.Errorf("no default route to %s found in %+v forward entries", defaultRoute.String(), fes)
 }
 
+// isIPv6OnlyHost returns true if the host has a global IPv6 address and no
+// IPv4 address other than the loopback and link-local ones.
+func isIPv6OnlyHost() bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		logger.Debugf("Failed to list the interface addresses: %v", err)
+		return false
+	}
+
+	var hasIPv6 bool
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return false
+		}
+		if ipNet.IP.IsGlobalUnicast() {
+			hasIPv6 = true
+		}
+	}
+	return hasIPv6
+}
+
 func addMetadataRoute() error {
 	fes, err := getIPForwardEntries()
 	if err != nil {
@@ -99,7 +124,16 @@ func agentInit(ctx context.Context) {
 	if runtime.GOOS == "windows" {
 		// Try maximum for 1 min.
 		policy := retry.Policy{MaxAttempts: 60, BackoffFactor: 1, Jitter: time.Second}
-		err := retry.Run(ctx, policy, addMetadataRoute)
+		err := retry.Run(ctx, policy, func() error {
+			err := addMetadataRoute()
+			// IPv6-only instances have no IPv4 default route, they reach the
+			// metadata server at its IPv6 address.
+			if err != nil && isIPv6OnlyHost() {
+				logger.Infof("No IPv4 address found, skipping the metadata server route: %v", err)
+				return nil
+			}
+			return err
+		})
 		if err != nil {
 			panic(fmt.Sprintf("Failed to set metadata route: %+v", err))
 		}
@@ -158,7 +192,7 @@ func agentInit(ctx context.Context) {
 			if err != nil {
 				logger.Errorf("Failed to reach MDS(all retries exhausted): %+v", err)
 				logger.Infof("Falling to OS default network configuration to attempt to recover.")
-				if err := network.FallbackToDefault(ctx); err != nil {
+				if err := network.FallbackToDefault(ctx, config); err != nil {
 					// Just log error and attempt to continue anyway, if we can't reach MDS
 					// we can't do anything.
 					logger.Errorf("Failed to rollback guest-agent network configuration: %v", err)
@@ -291,12 +325,15 @@ func generateSSHKeys(ctx context.Context) error {
 			logger.Errorf("Can't read %s public key: %v", keytype, err)
 			continue
 		}
-		if vals := strings.Split(string(pubKey), " "); len(vals) >= 2 {
-			if err := mdsClient.WriteGuestAttributes(ctx, "hostkeys/"+vals[0], vals[1]); err != nil {
+		attrs, err := hostKeyAttributes(string(pubKey))
+		if err != nil {
+			logger.Warningf("Generated key is malformed, not uploading: %v", err)
+			continue
+		}
+		for key, value := range attrs {
+			if err := mdsClient.WriteGuestAttributes(ctx, key, value); err != nil {
 				logger.Errorf("Failed to upload %s key to guest attributes: %v", keytype, err)
 			}
-		} else {
-			logger.Warningf("Generated key is malformed, not uploading")
 		}
 	}
 
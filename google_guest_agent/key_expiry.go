@@ -0,0 +1,87 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/utils"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+var (
+	// keyExpiryTimer runs the accounts manager when the earliest of the
+	// applied metadata SSH keys expires, nil if none of them expires.
+	keyExpiryTimer *time.Timer
+	// keyExpiryMu protects keyExpiryTimer.
+	keyExpiryMu sync.Mutex
+
+	// keyExpiryGrace delays the cleanup past the expiration time, a key is
+	// expired only once its expiration time is in the past.
+	keyExpiryGrace = time.Second
+)
+
+// nextKeyExpiration returns the earliest expiration time after now of keys,
+// by user, and false if none of them expires.
+func nextKeyExpiration(keys map[string][]string, now time.Time) (time.Time, bool) {
+	var next time.Time
+	var found bool
+	for _, userKeys := range keys {
+		for _, key := range userKeys {
+			expireOn, expiring, err := utils.KeyExpiration(key)
+			if err != nil || !expiring || !expireOn.After(now) {
+				continue
+			}
+			if !found || expireOn.Before(next) {
+				next, found = expireOn, true
+			}
+		}
+	}
+	return next, found
+}
+
+// scheduleKeyCleanup schedules the removal of keys, by user, the moment the
+// earliest of them expires rather than on the next metadata change. It
+// replaces the previously scheduled cleanup.
+func scheduleKeyCleanup(ctx context.Context, keys map[string][]string) {
+	keyExpiryMu.Lock()
+	defer keyExpiryMu.Unlock()
+
+	if keyExpiryTimer != nil {
+		keyExpiryTimer.Stop()
+		keyExpiryTimer = nil
+	}
+
+	next, ok := nextKeyExpiration(keys, time.Now())
+	if !ok {
+		return
+	}
+
+	// The timer outlives the accounts manager's run.
+	ctx = backgroundContext(ctx)
+	logger.Debugf("Scheduling the removal of expired SSH keys at %s.", next.Format(time.RFC3339))
+	keyExpiryTimer = time.AfterFunc(time.Until(next)+keyExpiryGrace, func() {
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Infof("SSH keys expired, removing them.")
+		// The accounts manager must not race a metadata update.
+		updateMu.Lock()
+		defer updateMu.Unlock()
+		runManager(ctx, &accountsMgr{})
+	})
+}
@@ -0,0 +1,73 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/utils"
+)
+
+func TestNextKeyExpiration(t *testing.T) {
+	pubKey := utils.MakeRandRSAPubKey(t)
+	expiringKey := func(expireOn string) string {
+		return fmt.Sprintf(`ssh-rsa %s google-ssh {"userName":"usera@example.com","expireOn":"%s"}`, pubKey, expireOn)
+	}
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	keys := map[string][]string{
+		"usera": {
+			fmt.Sprintf("ssh-rsa %s usera", pubKey),
+			expiringKey("2030-01-01T02:00:00+0000"),
+			expiringKey("2029-12-31T23:00:00+0000"),
+		},
+		"userb": {
+			expiringKey("2030-01-01T01:00:00Z"),
+			expiringKey("invalid"),
+		},
+	}
+	got, ok := nextKeyExpiration(keys, now)
+	if want := time.Date(2030, 1, 1, 1, 0, 0, 0, time.UTC); !ok || !got.Equal(want) {
+		t.Errorf("nextKeyExpiration() = %v, %t, want %v, true", got, ok, want)
+	}
+
+	delete(keys, "userb")
+	keys["usera"] = keys["usera"][:1]
+	if got, ok := nextKeyExpiration(keys, now); ok {
+		t.Errorf("nextKeyExpiration() = %v, true for non-expiring keys, want false", got)
+	}
+}
+
+func TestScheduleKeyCleanup(t *testing.T) {
+	pubKey := utils.MakeRandRSAPubKey(t)
+	t.Cleanup(func() { scheduleKeyCleanup(context.Background(), nil) })
+
+	expireOn := time.Now().Add(time.Hour).Format(time.RFC3339)
+	keys := map[string][]string{
+		"usera": {fmt.Sprintf(`ssh-rsa %s google-ssh {"userName":"usera@example.com","expireOn":"%s"}`, pubKey, expireOn)},
+	}
+	scheduleKeyCleanup(context.Background(), keys)
+	if keyExpiryTimer == nil {
+		t.Fatalf("scheduleKeyCleanup() scheduled no cleanup for an expiring key")
+	}
+
+	scheduleKeyCleanup(context.Background(), map[string][]string{"usera": {fmt.Sprintf("ssh-rsa %s usera", pubKey)}})
+	if keyExpiryTimer != nil {
+		t.Errorf("scheduleKeyCleanup() kept a cleanup scheduled for non-expiring keys")
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+var (
+	// lastKeySync is when the metadata SSH keys were last synced.
+	lastKeySync time.Time
+	// keySyncPending is true while a debounced key sync is due.
+	keySyncPending bool
+	// keySyncTimer runs the debounced key sync.
+	keySyncTimer *time.Timer
+)
+
+// keySyncDebounce returns the configured minimum interval between two
+// metadata SSH key syncs.
+func keySyncDebounce(config *cfg.Sections) time.Duration {
+	debounce, err := time.ParseDuration(config.Accounts.KeySyncDebounce)
+	if err != nil {
+		logger.Errorf("key_sync_debounce configuration is not a valid duration string, disabling the debouncing")
+		return 0
+	}
+	return debounce
+}
+
+// deferKeySync returns true if the debounce interval didn't pass since the last
+// key sync, the sync is then scheduled for the end of the interval with the
+// metadata current by then, so a burst of metadata changes is synced at once
+// instead of once per change. It must be called with updateMu held.
+func deferKeySync(ctx context.Context, config *cfg.Sections) bool {
+	debounce := keySyncDebounce(config)
+	if debounce <= 0 || lastKeySync.IsZero() {
+		return false
+	}
+	wait := debounce - time.Since(lastKeySync)
+	if wait <= 0 {
+		return false
+	}
+
+	keySyncPending = true
+	if keySyncTimer != nil {
+		return true
+	}
+	// The timer outlives the accounts manager's run.
+	ctx = backgroundContext(ctx)
+	logger.Debugf("Debouncing SSH key sync for %s.", wait.Round(time.Millisecond))
+	keySyncTimer = time.AfterFunc(wait, func() {
+		// The accounts manager must not race a metadata update.
+		updateMu.Lock()
+		defer updateMu.Unlock()
+		keySyncTimer = nil
+		if ctx.Err() != nil {
+			return
+		}
+		runManager(ctx, &accountsMgr{})
+	})
+	return true
+}
+
+// patchAuthorizedKeys returns content with its Google managed keys replaced
+// by keys: the managed keys no longer wanted are removed and the new ones are
+// appended, the other lines and the kept keys are left in place. Each managed
+// key is preceded by the comment line gcomment.
+func patchAuthorizedKeys(content []byte, gcomment string, keys []string) []byte {
+	want := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		want[key] = true
+	}
+
+	var patched bytes.Buffer
+	kept := make(map[string]bool, len(keys))
+	var isgoogle bool
+	for _, line := range strings.Split(string(content), "\n") {
+		if line == "" {
+			continue
+		}
+		if line == gcomment {
+			isgoogle = true
+			continue
+		}
+		if isgoogle {
+			isgoogle = false
+			if !want[line] || kept[line] {
+				continue
+			}
+			kept[line] = true
+			fmt.Fprintf(&patched, "%s\n%s\n", gcomment, line)
+			continue
+		}
+		fmt.Fprintf(&patched, "%s\n", line)
+	}
+	for _, key := range keys {
+		if !kept[key] {
+			kept[key] = true
+			fmt.Fprintf(&patched, "%s\n%s\n", gcomment, key)
+		}
+	}
+	return patched.Bytes()
+}
+
+// diffKeys returns the keys of next missing from prev and the keys of prev
+// missing from next.
+func diffKeys(prev, next []string) (added, removed []string) {
+	prevSet := make(map[string]bool, len(prev))
+	for _, key := range prev {
+		prevSet[key] = true
+	}
+	nextSet := make(map[string]bool, len(next))
+	for _, key := range next {
+		nextSet[key] = true
+		if !prevSet[key] {
+			added = append(added, key)
+		}
+	}
+	for _, key := range prev {
+		if !nextSet[key] {
+			removed = append(removed, key)
+		}
+	}
+	return added, removed
+}
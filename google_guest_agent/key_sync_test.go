@@ -0,0 +1,157 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDiffKeys(t *testing.T) {
+	prev := []string{"ssh-rsa a", "ssh-rsa b", "ssh-rsa c"}
+	next := []string{"ssh-rsa c", "ssh-rsa d", "ssh-rsa a"}
+
+	added, removed := diffKeys(prev, next)
+	if diff := cmp.Diff([]string{"ssh-rsa d"}, added); diff != "" {
+		t.Errorf("diffKeys() returned unexpected added keys (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"ssh-rsa b"}, removed); diff != "" {
+		t.Errorf("diffKeys() returned unexpected removed keys (-want +got):\n%s", diff)
+	}
+
+	added, removed = diffKeys(prev, []string{"ssh-rsa c", "ssh-rsa b", "ssh-rsa a"})
+	if len(added) != 0 || len(removed) != 0 {
+		t.Errorf("diffKeys() = %v, %v for reordered keys, want no changes", added, removed)
+	}
+}
+
+func TestDeferKeySync(t *testing.T) {
+	// The deferred syncs are canceled, they would run the accounts manager.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+	t.Cleanup(func() {
+		config.Accounts.KeySyncDebounce = "0"
+		updateMu.Lock()
+		defer updateMu.Unlock()
+		if keySyncTimer != nil {
+			keySyncTimer.Stop()
+			keySyncTimer = nil
+		}
+		lastKeySync, keySyncPending = time.Time{}, false
+	})
+
+	tests := []struct {
+		name     string
+		debounce string
+		// lastSyncAgo is how long ago the keys were last synced, never if 0.
+		lastSyncAgo time.Duration
+		want        bool
+	}{
+		{
+			name:        "disabled",
+			debounce:    "0",
+			lastSyncAgo: time.Millisecond,
+		},
+		{
+			name:     "first_sync",
+			debounce: "50ms",
+		},
+		{
+			name:        "quiet",
+			debounce:    "50ms",
+			lastSyncAgo: time.Minute,
+		},
+		{
+			name:        "burst",
+			debounce:    "50ms",
+			lastSyncAgo: time.Millisecond,
+			want:        true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config.Accounts.KeySyncDebounce = tc.debounce
+			lastKeySync, keySyncPending = time.Time{}, false
+			if tc.lastSyncAgo > 0 {
+				lastKeySync = time.Now().Add(-tc.lastSyncAgo)
+			}
+
+			updateMu.Lock()
+			got := deferKeySync(ctx, config)
+			updateMu.Unlock()
+			if got != tc.want {
+				t.Errorf("deferKeySync() = %t, want %t", got, tc.want)
+			}
+			if keySyncPending != tc.want {
+				t.Errorf("deferKeySync() set keySyncPending = %t, want %t", keySyncPending, tc.want)
+			}
+		})
+	}
+}
+
+func TestPatchAuthorizedKeys(t *testing.T) {
+	gcomment := "# Added by Google"
+	content := strings.Join([]string{
+		"ssh-rsa own",
+		gcomment,
+		"ssh-rsa a",
+		"ssh-ed25519 own2",
+		gcomment,
+		"ssh-rsa b",
+		gcomment,
+		"ssh-rsa c",
+	}, "\n") + "\n"
+
+	tests := []struct {
+		name string
+		keys []string
+		want []string
+	}{
+		{
+			name: "unchanged",
+			keys: []string{"ssh-rsa c", "ssh-rsa a", "ssh-rsa b"},
+			want: []string{"ssh-rsa own", gcomment, "ssh-rsa a", "ssh-ed25519 own2", gcomment, "ssh-rsa b", gcomment, "ssh-rsa c"},
+		},
+		{
+			name: "added_and_removed",
+			keys: []string{"ssh-rsa d", "ssh-rsa c", "ssh-rsa a"},
+			want: []string{"ssh-rsa own", gcomment, "ssh-rsa a", "ssh-ed25519 own2", gcomment, "ssh-rsa c", gcomment, "ssh-rsa d"},
+		},
+		{
+			name: "all_removed",
+			want: []string{"ssh-rsa own", "ssh-ed25519 own2"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := string(patchAuthorizedKeys([]byte(content), gcomment, tc.keys))
+			want := strings.Join(tc.want, "\n") + "\n"
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("patchAuthorizedKeys() returned unexpected content (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
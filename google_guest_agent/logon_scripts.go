@@ -0,0 +1,193 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// logonScriptsRegKey is the registry value listing the registered logon
+	// scripts.
+	logonScriptsRegKey = "LogonScripts"
+	// logonScriptsTaskPath is the Task Scheduler folder of the logon scripts'
+	// tasks.
+	logonScriptsTaskPath = `\Google\LogonScripts\`
+)
+
+// logonScriptsDirSDDL only allows SYSTEM and the administrators, owning the
+// directory, to change the logon scripts, the users running them can only
+// read and execute them. The entries apply to the scripts written in the
+// directory.
+const logonScriptsDirSDDL = "O:BAD:P(A;OICI;FA;;;SY)(A;OICI;FA;;;BA)(A;OICI;GRGX;;;BU)"
+
+// logonScriptNameExp matches the valid logon script names, used as task and
+// file names.
+var logonScriptNameExp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// logonScriptsMgr registers the windows-logon-scripts as scheduled tasks run
+// at user logon.
+type logonScriptsMgr struct {
+	// fakeWindows forces Disabled to run as if it was running in a windows system.
+	// mostly target for unit tests.
+	fakeWindows bool
+}
+
+// logonScripts returns the logon scripts set in the instance attributes, or
+// in the project attributes if unset.
+func logonScripts(md *metadata.Descriptor) metadata.LogonScripts {
+	if md.Instance.Attributes.LogonScripts != nil {
+		return md.Instance.Attributes.LogonScripts
+	}
+	return md.Project.Attributes.LogonScripts
+}
+
+func (m *logonScriptsMgr) Diff(ctx context.Context) (bool, error) {
+	return !reflect.DeepEqual(logonScripts(newMetadata), logonScripts(oldMetadata)), nil
+}
+
+func (m *logonScriptsMgr) Timeout(ctx context.Context) (bool, error) {
+	return false, nil
+}
+
+func (m *logonScriptsMgr) Disabled(ctx context.Context) (bool, error) {
+	return !m.fakeWindows && runtime.GOOS != "windows", nil
+}
+
+// logonScriptsDir returns the directory the logon scripts are written to.
+func logonScriptsDir() string {
+	return filepath.Join(os.Getenv("ProgramData"), "Google", "Compute Engine", "logon-scripts")
+}
+
+// validLogonScripts returns the scripts with a valid and unique name, the
+// others are logged and skipped.
+func validLogonScripts(scripts metadata.LogonScripts) metadata.LogonScripts {
+	var res metadata.LogonScripts
+	var names []string
+	for _, s := range scripts {
+		switch {
+		case !logonScriptNameExp.MatchString(s.Name):
+			logger.Errorf("Invalid logon script name %q, skipping it", s.Name)
+		case slices.Contains(names, s.Name):
+			logger.Errorf("Duplicate logon script name %q, skipping it", s.Name)
+		default:
+			names = append(names, s.Name)
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// staleLogonScripts returns the registered scripts not in scripts anymore.
+func staleLogonScripts(registered []string, scripts metadata.LogonScripts) []string {
+	var res []string
+	for _, name := range registered {
+		if !slices.ContainsFunc(scripts, func(s metadata.LogonScript) bool { return s.Name == name }) {
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+// logonScriptRegisterCommand returns the PowerShell command registering the
+// task running the script file at the logon of the script's user, with the
+// user's rights, or of any user if unset.
+func logonScriptRegisterCommand(s metadata.LogonScript, file string) string {
+	action := fmt.Sprintf("$a = New-ScheduledTaskAction -Execute 'powershell.exe' -Argument %s", psQuote(fmt.Sprintf(`-NoProfile -NonInteractive -ExecutionPolicy Bypass -File "%s"`, file)))
+	trigger := "$t = New-ScheduledTaskTrigger -AtLogOn"
+	// S-1-5-32-545 is the locale independent SID of BUILTIN\Users.
+	principal := `$p = New-ScheduledTaskPrincipal -GroupId 'S-1-5-32-545' -RunLevel Limited`
+	if s.User != "" {
+		trigger += " -User " + psQuote(s.User)
+		principal = fmt.Sprintf("$p = New-ScheduledTaskPrincipal -UserId %s -LogonType Interactive -RunLevel Limited", psQuote(s.User))
+	}
+	register := fmt.Sprintf("Register-ScheduledTask -TaskName %s -TaskPath %s -Action $a -Trigger $t -Principal $p -Force | Out-Null", psQuote(s.Name), psQuote(logonScriptsTaskPath))
+	return fmt.Sprintf("%s; %s; %s; %s", action, trigger, principal, register)
+}
+
+// logonScriptUnregisterCommand returns the PowerShell command unregistering
+// the task of the named script.
+func logonScriptUnregisterCommand(name string) string {
+	return fmt.Sprintf("Unregister-ScheduledTask -TaskName %s -TaskPath %s -Confirm:$false -ErrorAction SilentlyContinue", psQuote(name), psQuote(logonScriptsTaskPath))
+}
+
+func (m *logonScriptsMgr) Set(ctx context.Context) error {
+	registered, err := readRegMultiString(regKeyBase, logonScriptsRegKey)
+	if err != nil && err != errRegNotExist {
+		return err
+	}
+
+	scripts := validLogonScripts(logonScripts(newMetadata))
+	dir := logonScriptsDir()
+
+	for _, name := range staleLogonScripts(registered, scripts) {
+		logger.Infof("Removing logon script %s", name)
+		if err := run.Quiet(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command", logonScriptUnregisterCommand(name)); err != nil {
+			logger.Errorf("Failed to unregister logon script %s: %v", name, err)
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name+".ps1")); err != nil && !os.IsNotExist(err) {
+			logger.Errorf("Failed to remove logon script %s: %v", name, err)
+		}
+		registered = slices.DeleteFunc(registered, func(n string) bool { return n == name })
+	}
+
+	if len(scripts) > 0 {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create %s: %w", dir, err)
+		}
+		// ProgramData is writable by the users, its permissions must not be
+		// inherited before writing the scripts run by other users.
+		if err := setDirectoryAccess(dir, logonScriptsDirSDDL); err != nil {
+			return fmt.Errorf("failed to restrict the access of %s: %w", dir, err)
+		}
+	}
+
+	for _, s := range scripts {
+		file := filepath.Join(dir, s.Name+".ps1")
+		// A new file gets the directory's permissions, whoever created the
+		// previous one.
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			logger.Errorf("Failed to replace logon script %s: %v", s.Name, err)
+			continue
+		}
+		if err := os.WriteFile(file, []byte(s.Script), 0644); err != nil {
+			logger.Errorf("Failed to write logon script %s: %v", s.Name, err)
+			continue
+		}
+
+		logger.Infof("Registering logon script %s", s.Name)
+		if err := run.Quiet(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command", logonScriptRegisterCommand(s, file)); err != nil {
+			logger.Errorf("Failed to register logon script %s: %v", s.Name, err)
+			continue
+		}
+		if !slices.Contains(registered, s.Name) {
+			registered = append(registered, s.Name)
+		}
+	}
+
+	return writeRegMultiString(regKeyBase, logonScriptsRegKey, registered)
+}
@@ -0,0 +1,82 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLogonScriptsDiff(t *testing.T) {
+	scripts := metadata.LogonScripts{{Name: "drives", Script: "Get-Date"}}
+	oldMetadata = &metadata.Descriptor{}
+	newMetadata = &metadata.Descriptor{Project: metadata.Project{Attributes: metadata.Attributes{LogonScripts: scripts}}}
+
+	mgr := &logonScriptsMgr{fakeWindows: true}
+	if diff, _ := mgr.Diff(context.Background()); !diff {
+		t.Errorf("logonScriptsMgr.Diff() = false with new project logon scripts, want true")
+	}
+
+	oldMetadata = &metadata.Descriptor{Instance: metadata.Instance{Attributes: metadata.Attributes{LogonScripts: scripts}}}
+	if diff, _ := mgr.Diff(context.Background()); diff {
+		t.Errorf("logonScriptsMgr.Diff() = true with the same logon scripts, want false")
+	}
+}
+
+func TestValidLogonScripts(t *testing.T) {
+	scripts := metadata.LogonScripts{
+		{Name: "drives", Script: "a"},
+		{Name: `..\evil`, Script: "b"},
+		{Name: "drives", Script: "c"},
+		{Name: "printers", User: "alice", Script: "d"},
+	}
+	want := metadata.LogonScripts{scripts[0], scripts[3]}
+	if diff := cmp.Diff(want, validLogonScripts(scripts)); diff != "" {
+		t.Errorf("validLogonScripts() returned unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestStaleLogonScripts(t *testing.T) {
+	scripts := metadata.LogonScripts{{Name: "drives"}, {Name: "printers"}}
+	got := staleLogonScripts([]string{"drives", "old"}, scripts)
+	if diff := cmp.Diff([]string{"old"}, got); diff != "" {
+		t.Errorf("staleLogonScripts() returned unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestLogonScriptRegisterCommand(t *testing.T) {
+	file := `C:\ProgramData\Google\Compute Engine\logon-scripts\drives.ps1`
+
+	got := logonScriptRegisterCommand(metadata.LogonScript{Name: "drives", User: "o'brien"}, file)
+	for _, want := range []string{
+		`-File "` + file + `"`,
+		"-AtLogOn -User 'o''brien'",
+		"-UserId 'o''brien' -LogonType Interactive",
+		`-TaskName 'drives' -TaskPath '\Google\LogonScripts\'`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("logonScriptRegisterCommand() = %q, want it to contain %q", got, want)
+		}
+	}
+
+	got = logonScriptRegisterCommand(metadata.LogonScript{Name: "drives"}, file)
+	if !strings.Contains(got, "-AtLogOn;") || !strings.Contains(got, "-GroupId 'S-1-5-32-545'") {
+		t.Errorf("logonScriptRegisterCommand() = %q, want a task triggered by any user logon", got)
+	}
+}
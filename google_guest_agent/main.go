@@ -25,14 +25,20 @@ import (
 	"sync"
 	"time"
 
+	"github.com/GoogleCloudPlatform/guest-agent/eventlog"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/command"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/events"
 	mdsEvent "github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/events/metadata"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/events/netconfig"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/events/nic"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/events/routes"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/events/scripts"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/osinfo"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/scheduler"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/telemetry"
 	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-agent/metadatascripts"
 	"github.com/GoogleCloudPlatform/guest-agent/utils"
 	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
 )
@@ -54,10 +60,16 @@ var (
 	osInfo                   osinfo.OSInfo
 	mdsClient                *metadata.Client
 	addressManager           = &addressMgr{}
+
+	// updateMu serializes the metadata updates with the actions requested
+	// through the command monitor.
+	updateMu sync.Mutex
 )
 
 const (
 	regKeyBase = `SOFTWARE\Google\ComputeEngine`
+	// serviceName is the agent's service name.
+	serviceName = "GCEAgent"
 )
 
 type manager interface {
@@ -95,6 +107,9 @@ func availableManagers() []manager {
 			newWsfcManager(),
 			&winAccountsMgr{},
 			&diagnosticsMgr{},
+			&logonScriptsMgr{},
+			&windowsCertsMgr{},
+			&windowsFirewallMgr{},
 		)
 	}
 
@@ -102,10 +117,15 @@ func availableManagers() []manager {
 		&clockskewMgr{},
 		&osloginMgr{},
 		&accountsMgr{},
+		&breakGlassMgr{},
 	)
 }
 
 func runManager(ctx context.Context, mgr manager) {
+	if pausedForMaintenance(managerName(mgr)) {
+		return
+	}
+
 	disabled, err := mgr.Disabled(ctx)
 	if err != nil {
 		logger.Errorf("Failed to run manager's Disabled() call: %+v", err)
@@ -135,6 +155,8 @@ func runManager(ctx context.Context, mgr manager) {
 	}
 
 	logger.Debugf("running %#v manager", mgr)
+	ctx, done := agentWatchdog.watch(ctx, managerName(mgr))
+	defer done()
 	if err := mgr.Set(ctx); err != nil {
 		logger.Errorf("[%#v] Failed to run manager Set() call: %s", mgr, err)
 	}
@@ -181,12 +203,18 @@ func runAgent(ctx context.Context) {
 	// Try flushing logs before exiting, if not flushed logs could go missing.
 	defer logger.Close()
 
+	if err := eventlog.Init(); err != nil {
+		logger.Errorf("Failed to register the event log sources: %v", err)
+	}
+	defer eventlog.Close()
+
 	logger.Infof("GCE Agent Started (version %s)", version)
 
 	osInfo = osinfo.Get()
 	mdsClient = metadata.New()
 
 	agentInit(ctx)
+	setupServiceRecovery()
 
 	if cfg.Get().Unstable.CommandMonitorEnabled {
 		command.Init(ctx)
@@ -215,7 +243,62 @@ func runAgent(ctx context.Context) {
 
 	// knownJobs is list of default jobs that run on a pre-defined schedule.
 	knownJobs := []scheduler.Job{telemetry.New(mdsClient, programName, version)}
+
+	osloginCache := newOSLoginCacheWatcher(mdsClient)
+	if osloginCache.ShouldEnable(ctx) {
+		knownJobs = append(knownJobs, osloginCache)
+	}
+
+	hostKeys := &hostKeyRotator{}
+	if hostKeys.ShouldEnable(ctx) {
+		knownJobs = append(knownJobs, hostKeys)
+	}
+
+	managedUsers := newManagedUsersPublisher(mdsClient)
+	if managedUsers.ShouldEnable(ctx) {
+		knownJobs = append(knownJobs, managedUsers)
+	}
+
+	remoteAccessCerts := newRemoteAccessCertRotator(mdsClient)
+	if remoteAccessCerts.ShouldEnable(ctx) {
+		knownJobs = append(knownJobs, remoteAccessCerts)
+	}
+
+	windowsTime := newWindowsTimeJob(mdsClient)
+	if windowsTime.ShouldEnable(ctx) {
+		knownJobs = append(knownJobs, windowsTime)
+	}
+
+	windowsActivation := newWindowsActivationJob(mdsClient)
+	if windowsActivation.ShouldEnable(ctx) {
+		knownJobs = append(knownJobs, windowsActivation)
+	}
+
+	bitLockerEscrow := newBitLockerEscrow(mdsClient)
+	if bitLockerEscrow.ShouldEnable(ctx) {
+		knownJobs = append(knownJobs, bitLockerEscrow)
+	}
+
+	watchdogCheck := newWatchdogJob()
+	if watchdogCheck.ShouldEnable(ctx) {
+		knownJobs = append(knownJobs, watchdogCheck)
+	}
+
+	routesWatcher := routes.New()
+	reconciler := newRouteReconciler(routesWatcher)
+	reconcileRoutes := reconciler.ShouldEnable(ctx)
+	if reconcileRoutes {
+		knownJobs = append(knownJobs, reconciler)
+	}
+
+	netconfigWatcher := netconfig.New()
+	checker := newDriftChecker(netconfigWatcher)
+	checkDrift := checker.ShouldEnable(ctx)
+	if checkDrift {
+		knownJobs = append(knownJobs, checker)
+	}
 	scheduler.ScheduleJobs(ctx, knownJobs, false)
+	registerAgentCommands(ctx, knownJobs)
 
 	eventManager := events.Get()
 	if err := eventManager.AddDefaultWatchers(ctx); err != nil {
@@ -228,6 +311,36 @@ func runAgent(ctx context.Context) {
 		return
 	}
 
+	if reconcileRoutes {
+		if err := eventManager.AddWatcher(ctx, routesWatcher); err != nil {
+			logger.Errorf("Failed to add routes watcher: %+v", err)
+		}
+	}
+
+	if checkDrift {
+		if err := eventManager.AddWatcher(ctx, netconfigWatcher); err != nil {
+			logger.Errorf("Failed to add network configuration watcher: %+v", err)
+		}
+	}
+
+	scriptsWatcher := scripts.New()
+	if err := eventManager.AddWatcher(ctx, scriptsWatcher); err != nil {
+		logger.Errorf("Failed to add metadata scripts watcher: %+v", err)
+	} else {
+		metadatascripts.SetEventHandler(scriptsWatcher.Handle)
+		if err := command.Get().RegisterHandler(scripts.Command, scriptsWatcher.HandleCommand); err != nil {
+			logger.Errorf("Failed to register the %s command handler: %v", scripts.Command, err)
+		}
+	}
+
+	if cfg.Get().NetworkInterfaces.Hotplug {
+		if err := eventManager.AddWatcher(ctx, nic.New()); err != nil {
+			logger.Errorf("Failed to add network interfaces watcher: %+v", err)
+		} else {
+			eventManager.Subscribe(nic.ChangedEvent, nil, handleNICChanges)
+		}
+	}
+
 	oldMetadata = &metadata.Descriptor{}
 	eventManager.Subscribe(mdsEvent.LongpollEvent, nil, func(ctx context.Context, evType string, data interface{}, evData *events.EventData) bool {
 		logger.Debugf("Handling metadata %q event.", evType)
@@ -244,6 +357,8 @@ func runAgent(ctx context.Context) {
 			return true
 		}
 
+		updateMu.Lock()
+		defer updateMu.Unlock()
 		newMetadata = evData.Data.(*metadata.Descriptor)
 
 		if err := enableDisableOSLoginCertAuth(ctx); err != nil {
@@ -251,7 +366,10 @@ func runAgent(ctx context.Context) {
 		}
 
 		runUpdate(ctx)
-		oldMetadata = newMetadata
+		// The changes skipped during the maintenance are applied once it's over.
+		if on, _ := maintenanceEnabled(); !on {
+			oldMetadata = newMetadata
+		}
 
 		return true
 	})
@@ -260,7 +378,7 @@ func runAgent(ctx context.Context) {
 		logger.Fatalf("Failed to run event manager: %+v", err)
 	}
 
-	logger.Infof("GCE Agent Stopped")
+	eventlog.Infof(eventlog.AgentStopped, "GCE Agent Stopped")
 }
 
 func logFormatWindows(e logger.LogEntry) string {
@@ -307,7 +425,15 @@ func main() {
 		os.Exit(0)
 	}
 
-	if err := register(ctx, "GCEAgent", "GCEAgent", "", runAgent, action); err != nil {
+	if action == networkDiffAction {
+		os.Exit(networkDiff(ctx, os.Stdout))
+	}
+
+	if action == diagnosticsExportAction {
+		os.Exit(diagnosticsExport(ctx, os.Args[2:]))
+	}
+
+	if err := register(ctx, serviceName, serviceName, "", runAgent, action); err != nil {
 		logger.Fatalf("error registering service: %s", err)
 	}
 }
@@ -0,0 +1,187 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package maintenance implements the maintenance mode, in which the agent and
+// the metadata script runner don't change the accounts, the network nor run
+// scripts, i.e. while an image is captured so it doesn't carry the instance's
+// state. Turned on with Enable, it's turned off automatically on the next boot.
+package maintenance
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+// instanceIDTimeout bounds the metadata server request of the instance ID.
+const instanceIDTimeout = 10 * time.Second
+
+var (
+	// stateFile returns the path of the maintenance state file. Replaceable
+	// by unit tests.
+	stateFile = defaultStateFile
+
+	// getBootID returns the current boot's ID. Replaceable by unit tests.
+	getBootID = bootID
+
+	// getInstanceID returns the current instance's ID. Replaceable by unit
+	// tests.
+	getInstanceID = instanceID
+
+	instanceIDMu sync.Mutex
+	// cachedInstanceID is the instance's ID once fetched, it can't change
+	// without a reboot.
+	cachedInstanceID string
+)
+
+// state is the persisted maintenance mode.
+type state struct {
+	// Reason is why the maintenance mode was turned on.
+	Reason string `json:"reason"`
+	// BootID is the ID of the boot the maintenance mode was turned on
+	// during, it's off during other boots.
+	BootID string `json:"bootId"`
+	// InstanceID is the ID of the instance the maintenance mode was turned on
+	// for, it's off on other instances, i.e. created from an image captured
+	// meanwhile.
+	InstanceID string `json:"instanceId"`
+	// Since is when the maintenance mode was turned on.
+	Since time.Time `json:"since"`
+}
+
+// defaultStateFile returns the path of the maintenance state file.
+func defaultStateFile() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("ProgramData"), "Google", "Compute Engine", "maintenance.json")
+	}
+	return "/var/lib/google-guest-agent/maintenance.json"
+}
+
+// instanceID returns the instance's ID from the metadata server.
+func instanceID() (string, error) {
+	instanceIDMu.Lock()
+	defer instanceIDMu.Unlock()
+	if cachedInstanceID != "" {
+		return cachedInstanceID, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), instanceIDTimeout)
+	defer cancel()
+	id, err := metadata.New().GetKey(ctx, "instance/id", nil)
+	if err != nil {
+		return "", err
+	}
+	cachedInstanceID = id
+	return id, nil
+}
+
+// Enabled returns whether the maintenance mode is on and why, either set in
+// the configuration or turned on with Enable during the current boot of the
+// current instance. The maintenance mode is off if the boot or the instance
+// can't be identified, and a state recorded during another boot or on another
+// instance is removed.
+func Enabled() (bool, string) {
+	if config := cfg.Get().Maintenance; config != nil && config.Enable {
+		return true, "enabled in the configuration"
+	}
+
+	data, err := os.ReadFile(stateFile())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Errorf("Failed to read the maintenance state: %v", err)
+		}
+		return false, ""
+	}
+	var s state
+	if err := json.Unmarshal(data, &s); err != nil {
+		logger.Errorf("Invalid maintenance state in %s: %v", stateFile(), err)
+		return false, ""
+	}
+
+	boot, err := getBootID()
+	if err != nil {
+		// Failing open, the agent would otherwise never manage the instance.
+		logger.Warningf("Failed to get the boot ID, ignoring the maintenance mode: %v", err)
+		return false, ""
+	}
+	if s.BootID != boot {
+		removeStaleState("another boot")
+		return false, ""
+	}
+	instance, err := getInstanceID()
+	if err != nil {
+		logger.Warningf("Failed to get the instance ID, ignoring the maintenance mode: %v", err)
+		return false, ""
+	}
+	if s.InstanceID != instance {
+		removeStaleState("another instance")
+		return false, ""
+	}
+	return true, s.Reason
+}
+
+// removeStaleState removes the maintenance state recorded during another boot
+// or on another instance, i.e. baked into the image the instance was created
+// from.
+func removeStaleState(recordedBy string) {
+	logger.Infof("Removing the maintenance state recorded by %s.", recordedBy)
+	if err := Disable(); err != nil {
+		logger.Errorf("Failed to remove the maintenance state: %v", err)
+	}
+}
+
+// Enable turns the maintenance mode on until Disable is called, the instance
+// reboots or an instance is created from its image.
+func Enable(reason string) error {
+	boot, err := getBootID()
+	if err != nil {
+		return fmt.Errorf("failed to get the boot ID: %w", err)
+	}
+	instance, err := getInstanceID()
+	if err != nil {
+		return fmt.Errorf("failed to get the instance ID: %w", err)
+	}
+	data, err := json.Marshal(state{Reason: reason, BootID: boot, InstanceID: instance, Since: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	path := stateFile()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	// Write then rename so a partial state is never read.
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Disable turns the maintenance mode turned on with Enable off, the mode set
+// in the configuration stays on.
+func Disable() error {
+	if err := os.Remove(stateFile()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package maintenance
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+)
+
+func setupMaintenance(t *testing.T, boot, instance *string) {
+	t.Helper()
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "maintenance.json")
+	origStateFile, origGetBootID, origGetInstanceID := stateFile, getBootID, getInstanceID
+	t.Cleanup(func() { stateFile, getBootID, getInstanceID = origStateFile, origGetBootID, origGetInstanceID })
+	stateFile = func() string { return path }
+	getBootID = func() (string, error) {
+		if *boot == "" {
+			return "", errors.New("no boot ID")
+		}
+		return *boot, nil
+	}
+	getInstanceID = func() (string, error) {
+		if *instance == "" {
+			return "", errors.New("no instance ID")
+		}
+		return *instance, nil
+	}
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	boot, instance := "1", "1234"
+	setupMaintenance(t, &boot, &instance)
+
+	if on, _ := Enabled(); on {
+		t.Fatalf("Enabled() = true by default, want false")
+	}
+
+	if err := Enable("imaging"); err != nil {
+		t.Fatalf("Enable(imaging) failed unexpectedly with error: %v", err)
+	}
+	if on, reason := Enabled(); !on || reason != "imaging" {
+		t.Errorf("Enabled() = %t, %q after Enable(imaging), want true, imaging", on, reason)
+	}
+
+	boot = ""
+	if on, _ := Enabled(); on {
+		t.Errorf("Enabled() = true without boot ID, want false")
+	}
+	boot, instance = "1", ""
+	if on, _ := Enabled(); on {
+		t.Errorf("Enabled() = true without instance ID, want false")
+	}
+
+	// Another instance created from an image with the same boot ID.
+	boot, instance = "1", "5678"
+	if on, _ := Enabled(); on {
+		t.Errorf("Enabled() = true on another instance, want false")
+	}
+	instance = "1234"
+	if on, _ := Enabled(); on {
+		t.Errorf("Enabled() = true once the stale state was removed, want false")
+	}
+
+	if err := Enable("imaging"); err != nil {
+		t.Fatalf("Enable(imaging) failed unexpectedly with error: %v", err)
+	}
+	boot = "2"
+	if on, _ := Enabled(); on {
+		t.Errorf("Enabled() = true after a reboot, want false")
+	}
+
+	boot = "1"
+	if err := Disable(); err != nil {
+		t.Fatalf("Disable() failed unexpectedly with error: %v", err)
+	}
+	if on, _ := Enabled(); on {
+		t.Errorf("Enabled() = true after Disable(), want false")
+	}
+	if err := Disable(); err != nil {
+		t.Errorf("Disable() failed when already disabled: %v", err)
+	}
+}
+
+func TestMaintenanceModeConfig(t *testing.T) {
+	boot, instance := "1", "1234"
+	setupMaintenance(t, &boot, &instance)
+
+	cfg.Get().Maintenance.Enable = true
+	t.Cleanup(func() { cfg.Get().Maintenance.Enable = false })
+	if on, reason := Enabled(); !on || reason == "" {
+		t.Errorf("Enabled() = %t, %q with enable = true, want true with a reason", on, reason)
+	}
+	if err := Disable(); err != nil {
+		t.Fatalf("Disable() failed unexpectedly with error: %v", err)
+	}
+	if on, _ := Enabled(); !on {
+		t.Errorf("Enabled() = false after Disable() with enable = true, want true")
+	}
+}
+
+func TestEnableWithoutBootID(t *testing.T) {
+	boot, instance := "", "1234"
+	setupMaintenance(t, &boot, &instance)
+
+	if err := Enable("imaging"); err == nil {
+		t.Errorf("Enable(imaging) succeeded without boot ID, want error")
+	}
+
+	boot, instance = "1", ""
+	if err := Enable("imaging"); err == nil {
+		t.Errorf("Enable(imaging) succeeded without instance ID, want error")
+	}
+}
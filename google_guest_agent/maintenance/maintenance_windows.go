@@ -0,0 +1,43 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package maintenance
+
+import (
+	"strconv"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// bootIDKey is the registry key of the prefetcher's parameters. Its BootId
+// value isn't documented, it's the counter the prefetcher increments on every
+// boot to tell its traces apart. Should it not change across a boot, i.e. be
+// reset by sysprep, the instance ID recorded along with it still turns the
+// maintenance mode off on instances created from a captured image.
+const bootIDKey = `SYSTEM\CurrentControlSet\Control\Session Manager\Memory Management\PrefetchParameters`
+
+// bootID returns the Windows boot counter.
+func bootID() (string, error) {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, bootIDKey, registry.QUERY_VALUE)
+	if err != nil {
+		return "", err
+	}
+	defer k.Close()
+
+	id, _, err := k.GetIntegerValue("BootId")
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(id, 10), nil
+}
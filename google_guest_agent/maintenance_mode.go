@@ -0,0 +1,121 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/command"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/maintenance"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+// setMaintenanceModeCommand turns the maintenance mode on or off.
+const setMaintenanceModeCommand = "agent.SetMaintenanceMode"
+
+var (
+	// maintenanceEnabled returns whether the maintenance mode is on and why,
+	// overridden in tests.
+	maintenanceEnabled = maintenance.Enabled
+
+	maintenanceMu sync.Mutex
+	// maintenanceLogged is the set of modules which logged they are paused
+	// during the current maintenance.
+	maintenanceLogged = make(map[string]bool)
+)
+
+// maintenanceModeRequest is the agent.SetMaintenanceMode request.
+type maintenanceModeRequest struct {
+	command.Request
+	// Enabled turns the maintenance mode on or off.
+	Enabled bool
+	// Reason is why the maintenance mode is turned on.
+	Reason string
+}
+
+// maintenanceModeResponse is the agent.SetMaintenanceMode response.
+type maintenanceModeResponse struct {
+	command.Response
+	// Enabled is whether the maintenance mode is on after the request.
+	Enabled bool
+	// Reason is why the maintenance mode is on.
+	Reason string
+}
+
+// pausedForMaintenance returns whether module must skip its changes because
+// the maintenance mode is on, logging it once per module and maintenance.
+func pausedForMaintenance(module string) bool {
+	on, reason := maintenanceEnabled()
+
+	maintenanceMu.Lock()
+	defer maintenanceMu.Unlock()
+	if !on {
+		clear(maintenanceLogged)
+		return false
+	}
+	if !maintenanceLogged[module] {
+		logger.Infof("Pausing %s, maintenance mode is on: %s.", module, reason)
+		maintenanceLogged[module] = true
+	}
+	return true
+}
+
+// setMaintenanceMode handles agent.SetMaintenanceMode. Turning the
+// maintenance mode off applies the current metadata right away.
+func setMaintenanceMode(ctx context.Context, b []byte) ([]byte, error) {
+	var req maintenanceModeRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		return nil, fmt.Errorf("invalid %s request: %w", setMaintenanceModeCommand, err)
+	}
+
+	if req.Enabled {
+		reason := req.Reason
+		if reason == "" {
+			reason = "requested through the command monitor"
+		}
+		logger.Infof("Turning the maintenance mode on until the next boot: %s.", reason)
+		if err := maintenance.Enable(reason); err != nil {
+			return nil, fmt.Errorf("failed to turn the maintenance mode on: %w", err)
+		}
+	} else {
+		logger.Infof("Turning the maintenance mode off.")
+		if err := maintenance.Disable(); err != nil {
+			return nil, fmt.Errorf("failed to turn the maintenance mode off: %w", err)
+		}
+		resumeAfterMaintenance(ctx)
+	}
+
+	on, reason := maintenanceEnabled()
+	return json.Marshal(maintenanceModeResponse{Enabled: on, Reason: reason})
+}
+
+// resumeAfterMaintenance runs the managers with the current metadata, the
+// changes made during the maintenance having been skipped.
+func resumeAfterMaintenance(ctx context.Context) {
+	if on, _ := maintenanceEnabled(); on {
+		return
+	}
+
+	updateMu.Lock()
+	defer updateMu.Unlock()
+	if newMetadata == nil {
+		return
+	}
+	runUpdate(ctx)
+	oldMetadata = newMetadata
+}
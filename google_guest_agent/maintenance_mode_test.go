@@ -0,0 +1,53 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+)
+
+func TestPausedForMaintenance(t *testing.T) {
+	on := true
+	origEnabled := maintenanceEnabled
+	t.Cleanup(func() { maintenanceEnabled = origEnabled })
+	maintenanceEnabled = func() (bool, string) { return on, "imaging" }
+
+	if !pausedForMaintenance("addressMgr") || !maintenanceLogged["addressMgr"] {
+		t.Errorf("pausedForMaintenance(addressMgr) = false or not logged during maintenance, want true")
+	}
+
+	on = false
+	if pausedForMaintenance("addressMgr") {
+		t.Errorf("pausedForMaintenance(addressMgr) = true after maintenance, want false")
+	}
+	if len(maintenanceLogged) != 0 {
+		t.Errorf("maintenanceLogged = %v after maintenance, want empty", maintenanceLogged)
+	}
+}
+
+func TestForceManagerDuringMaintenance(t *testing.T) {
+	origEnabled, origNewMetadata := maintenanceEnabled, newMetadata
+	t.Cleanup(func() { maintenanceEnabled, newMetadata = origEnabled, origNewMetadata })
+	maintenanceEnabled = func() (bool, string) { return true, "imaging" }
+	newMetadata = &metadata.Descriptor{}
+
+	mgr := &commandTestMgr{}
+	if _, err := forceManager(context.Background(), mgr); err == nil || mgr.ranWith != nil {
+		t.Errorf("forceManager(ctx, %+v) = %v during maintenance, want error without running the manager", mgr, err)
+	}
+}
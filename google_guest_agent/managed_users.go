@@ -0,0 +1,120 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// managedUsersPublisherID is the managed users publishing job's ID.
+	managedUsersPublisherID = "managed-users-publisher"
+	// managedUsersAttribute is the guest attribute listing the managed users.
+	managedUsersAttribute = "guest-agent-accounts/users"
+)
+
+// managedUser is a user provisioned by the accounts manager and the
+// fingerprints of its keys, the keys themselves are never published.
+type managedUser struct {
+	User         string   `json:"user"`
+	Source       string   `json:"source"`
+	Fingerprints []string `json:"fingerprints"`
+}
+
+// managedUsersPublisher periodically publishes the managed users to the
+// guest attributes, so the access to the fleet can be audited remotely.
+type managedUsersPublisher struct {
+	client metadata.MDSClientInterface
+}
+
+// newManagedUsersPublisher returns the job publishing the managed users with
+// client.
+func newManagedUsersPublisher(client metadata.MDSClientInterface) *managedUsersPublisher {
+	return &managedUsersPublisher{client: client}
+}
+
+// ID returns the managed users publishing job's ID.
+func (p *managedUsersPublisher) ID() string {
+	return managedUsersPublisherID
+}
+
+// Interval returns the configured publishing interval.
+func (p *managedUsersPublisher) Interval() (time.Duration, bool) {
+	return publishUsersInterval(), true
+}
+
+// ShouldEnable returns true on Linux if the accounts daemon runs and the
+// publishing is enabled.
+func (p *managedUsersPublisher) ShouldEnable(ctx context.Context) bool {
+	return runtime.GOOS != "windows" && cfg.Get().Daemons.AccountsDaemon && publishUsersInterval() > 0
+}
+
+// Run publishes the current managed users.
+func (p *managedUsersPublisher) Run(ctx context.Context) (bool, error) {
+	data, err := json.Marshal(managedUsers(cfg.Get()))
+	if err != nil {
+		return true, fmt.Errorf("failed to marshal the managed users: %w", err)
+	}
+	if err := p.client.WriteGuestAttributes(ctx, managedUsersAttribute, string(data)); err != nil {
+		return true, fmt.Errorf("failed to publish the managed users: %w", err)
+	}
+	return true, nil
+}
+
+// managedUsers returns the users provisioned from metadata and the
+// break-glass user, sorted by name.
+func managedUsers(config *cfg.Sections) []managedUser {
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+
+	res := []managedUser{}
+	add := func(user, source string, keys []string) {
+		fingerprints := []string{}
+		for _, key := range keys {
+			fingerprints = append(fingerprints, keyFingerprint(key))
+		}
+		sort.Strings(fingerprints)
+		res = append(res, managedUser{User: user, Source: source, Fingerprints: fingerprints})
+	}
+
+	for user, keys := range sshKeys {
+		add(user, auditSourceMetadata, keys)
+	}
+	if breakGlassWritten && config.Accounts.BreakGlassUser != "" {
+		add(config.Accounts.BreakGlassUser, auditSourceBreakGlass, breakGlassKeys)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].User < res[j].User })
+	return res
+}
+
+// publishUsersInterval returns the configured managed users publishing
+// interval.
+func publishUsersInterval() time.Duration {
+	interval, err := time.ParseDuration(cfg.Get().Accounts.PublishUsersInterval)
+	if err != nil {
+		logger.Errorf("publish_users_interval configuration is not a valid duration string, disabling the publishing")
+		return 0
+	}
+	return interval
+}
@@ -0,0 +1,81 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/utils"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestManagedUsersPublisher(t *testing.T) {
+	if err := cfg.Load([]byte("[Accounts]\nbreak_glass_user = breakglass\n")); err != nil {
+		t.Fatalf("cfg.Load() failed unexpectedly with error: %v", err)
+	}
+	t.Cleanup(func() {
+		sshKeys, breakGlassKeys, breakGlassWritten = nil, nil, false
+	})
+
+	key1 := "ssh-rsa " + utils.MakeRandRSAPubKey(t)
+	key2 := "ssh-rsa " + utils.MakeRandRSAPubKey(t) + " user@host"
+	key3 := "ssh-rsa " + utils.MakeRandRSAPubKey(t)
+	sshKeys = map[string][]string{"user2": {key1}, "user1": {key1, key2}}
+	breakGlassKeys, breakGlassWritten = []string{key3}, true
+
+	client := &guestAttributesClient{attributes: make(map[string]string)}
+	if _, err := newManagedUsersPublisher(client).Run(context.Background()); err != nil {
+		t.Fatalf("managedUsersPublisher.Run() failed unexpectedly with error: %v", err)
+	}
+
+	var got []managedUser
+	if err := json.Unmarshal([]byte(client.attributes[managedUsersAttribute]), &got); err != nil {
+		t.Fatalf("json.Unmarshal(%q) failed unexpectedly with error: %v", client.attributes[managedUsersAttribute], err)
+	}
+	user1Fingerprints := []string{keyFingerprint(key1), keyFingerprint(key2)}
+	sort.Strings(user1Fingerprints)
+	want := []managedUser{
+		{User: "breakglass", Source: auditSourceBreakGlass, Fingerprints: []string{keyFingerprint(key3)}},
+		{User: "user1", Source: auditSourceMetadata, Fingerprints: user1Fingerprints},
+		{User: "user2", Source: auditSourceMetadata, Fingerprints: []string{keyFingerprint(key1)}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("managedUsersPublisher.Run() published unexpected users (-want +got):\n%s", diff)
+	}
+}
+
+func TestPublishUsersInterval(t *testing.T) {
+	tests := []struct {
+		config string
+		want   string
+	}{
+		{config: "", want: "0s"},
+		{config: "[Accounts]\npublish_users_interval = 10m\n", want: "10m0s"},
+		{config: "[Accounts]\npublish_users_interval = invalid\n", want: "0s"},
+	}
+
+	for _, tc := range tests {
+		if err := cfg.Load([]byte(tc.config)); err != nil {
+			t.Fatalf("cfg.Load(%q) failed unexpectedly with error: %v", tc.config, err)
+		}
+		if got := publishUsersInterval().String(); got != tc.want {
+			t.Errorf("publishUsersInterval() with config %q = %s, want %s", tc.config, got, tc.want)
+		}
+	}
+}
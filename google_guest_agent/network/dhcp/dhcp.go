@@ -0,0 +1,381 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dhcp implements a minimal DHCPv4 client, it's used to set up network
+// interfaces on systems shipping no DHCP client.
+package dhcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// clientPort is the DHCP client's UDP port.
+	clientPort = 68
+	// serverPort is the DHCP server's UDP port.
+	serverPort = 67
+
+	// The BOOTP operations.
+	opRequest = 1
+	opReply   = 2
+
+	// The DHCP message types, option 53.
+	msgDiscover = 1
+	msgOffer    = 2
+	msgRequest  = 3
+	msgAck      = 5
+	msgNak      = 6
+
+	// The DHCP options used by the client.
+	optPad             = 0
+	optSubnetMask      = 1
+	optRouter          = 3
+	optDNS             = 6
+	optRequestedIP     = 50
+	optLeaseTime       = 51
+	optMessageType     = 53
+	optServerID        = 54
+	optParamRequest    = 55
+	optClasslessRoutes = 121
+	optEnd             = 255
+
+	// headerSize is the size of the fixed BOOTP header, including the magic cookie.
+	headerSize = 240
+
+	// flagBroadcast asks the server to broadcast its replies, the interface has
+	// no address to receive them otherwise.
+	flagBroadcast = 0x8000
+
+	// attempts is the number of times a message is sent without a reply.
+	attempts = 4
+	// initialTimeout is the time waited for the first reply, it's doubled on
+	// every attempt.
+	initialTimeout = 2 * time.Second
+)
+
+var (
+	// magicCookie marks the start of the DHCP options.
+	magicCookie = []byte{99, 130, 83, 99}
+
+	// openConn opens the transport of the DHCP messages on an interface, it's
+	// replaced in tests.
+	openConn = listen
+)
+
+// conn is the transport of the DHCP messages.
+type conn interface {
+	// send broadcasts a message to the DHCP servers.
+	send(msg []byte) error
+	// receive reads a message, failing once deadline is reached.
+	receive(deadline time.Time) ([]byte, error)
+	// Close closes the transport.
+	Close() error
+}
+
+// Route is a classless static route provided by the DHCP server.
+type Route struct {
+	// Destination is the route's destination network.
+	Destination net.IPNet
+	// Gateway is the route's gateway, unspecified for on-link routes.
+	Gateway net.IP
+}
+
+// Lease is the configuration acknowledged by the DHCP server.
+type Lease struct {
+	// IP is the address leased to the interface.
+	IP net.IP
+	// Mask is the subnet mask of the address.
+	Mask net.IPMask
+	// Router is the default gateway.
+	Router net.IP
+	// DNS are the DNS servers.
+	DNS []net.IP
+	// Routes are the classless static routes, they take precedence over Router.
+	Routes []Route
+	// ServerID is the address of the DHCP server which acknowledged the lease.
+	ServerID net.IP
+	// Duration is the lease's duration.
+	Duration time.Duration
+}
+
+// message is a DHCP message.
+type message struct {
+	op      byte
+	xid     uint32
+	flags   uint16
+	ciaddr  net.IP
+	yiaddr  net.IP
+	siaddr  net.IP
+	chaddr  net.HardwareAddr
+	options map[byte][]byte
+}
+
+// marshal encodes the message in its wire format.
+func (m *message) marshal() []byte {
+	buf := make([]byte, headerSize, headerSize+64)
+	buf[0] = m.op
+	// Ethernet hardware type and address length.
+	buf[1] = 1
+	buf[2] = 6
+	binary.BigEndian.PutUint32(buf[4:8], m.xid)
+	binary.BigEndian.PutUint16(buf[10:12], m.flags)
+	copy(buf[12:16], m.ciaddr.To4())
+	copy(buf[16:20], m.yiaddr.To4())
+	copy(buf[20:24], m.siaddr.To4())
+	copy(buf[28:44], m.chaddr)
+	copy(buf[236:240], magicCookie)
+
+	// Message type goes first, some servers expect it.
+	if v, found := m.options[optMessageType]; found {
+		buf = append(buf, optMessageType, byte(len(v)))
+		buf = append(buf, v...)
+	}
+	for code := 1; code < optEnd; code++ {
+		v, found := m.options[byte(code)]
+		if !found || code == optMessageType {
+			continue
+		}
+		buf = append(buf, byte(code), byte(len(v)))
+		buf = append(buf, v...)
+	}
+	return append(buf, optEnd)
+}
+
+// parseMessage decodes a DHCP message from its wire format.
+func parseMessage(b []byte) (*message, error) {
+	if len(b) < headerSize {
+		return nil, fmt.Errorf("message too short: %d bytes", len(b))
+	}
+	if !bytes.Equal(b[236:240], magicCookie) {
+		return nil, errors.New("invalid magic cookie")
+	}
+
+	hlen := min(int(b[2]), 16)
+	m := &message{
+		op:      b[0],
+		xid:     binary.BigEndian.Uint32(b[4:8]),
+		flags:   binary.BigEndian.Uint16(b[10:12]),
+		ciaddr:  net.IP(slices.Clone(b[12:16])),
+		yiaddr:  net.IP(slices.Clone(b[16:20])),
+		siaddr:  net.IP(slices.Clone(b[20:24])),
+		chaddr:  net.HardwareAddr(slices.Clone(b[28 : 28+hlen])),
+		options: make(map[byte][]byte),
+	}
+
+	opts := b[headerSize:]
+	for len(opts) > 0 {
+		code := opts[0]
+		if code == optEnd {
+			break
+		}
+		if code == optPad {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || len(opts) < 2+int(opts[1]) {
+			return nil, fmt.Errorf("truncated option %d", code)
+		}
+		size := int(opts[1])
+		// Options may be split, concatenate them (RFC 3396).
+		m.options[code] = append(m.options[code], opts[2:2+size]...)
+		opts = opts[2+size:]
+	}
+	return m, nil
+}
+
+// messageType returns the DHCP message type, zero if it's missing.
+func (m *message) messageType() byte {
+	if v := m.options[optMessageType]; len(v) == 1 {
+		return v[0]
+	}
+	return 0
+}
+
+// lease returns the lease described by an acknowledge message.
+func (m *message) lease() (*Lease, error) {
+	ip := m.yiaddr.To4()
+	if ip == nil || ip.IsUnspecified() {
+		return nil, errors.New("no address offered")
+	}
+
+	lease := &Lease{IP: ip, Mask: net.CIDRMask(32, 32)}
+	if v := m.options[optSubnetMask]; len(v) == 4 {
+		lease.Mask = net.IPMask(v)
+	}
+	if v := m.options[optRouter]; len(v) >= 4 {
+		lease.Router = net.IP(v[:4])
+	}
+	for v := m.options[optDNS]; len(v) >= 4; v = v[4:] {
+		lease.DNS = append(lease.DNS, net.IP(v[:4]))
+	}
+	if v := m.options[optServerID]; len(v) == 4 {
+		lease.ServerID = net.IP(v)
+	}
+	if v := m.options[optLeaseTime]; len(v) == 4 {
+		lease.Duration = time.Duration(binary.BigEndian.Uint32(v)) * time.Second
+	}
+
+	routes, err := parseClasslessRoutes(m.options[optClasslessRoutes])
+	if err != nil {
+		return nil, err
+	}
+	lease.Routes = routes
+	return lease, nil
+}
+
+// parseClasslessRoutes decodes the classless static routes option (RFC 3442).
+func parseClasslessRoutes(b []byte) ([]Route, error) {
+	var routes []Route
+	for len(b) > 0 {
+		prefix := int(b[0])
+		if prefix > 32 {
+			return nil, fmt.Errorf("invalid classless route prefix length: %d", prefix)
+		}
+		// Only the significant octets of the destination are present.
+		size := (prefix + 7) / 8
+		if len(b) < 1+size+4 {
+			return nil, errors.New("truncated classless route")
+		}
+		dest := make(net.IP, 4)
+		copy(dest, b[1:1+size])
+		routes = append(routes, Route{
+			Destination: net.IPNet{IP: dest, Mask: net.CIDRMask(prefix, 32)},
+			Gateway:     net.IP(slices.Clone(b[1+size : 1+size+4])),
+		})
+		b = b[1+size+4:]
+	}
+	return routes, nil
+}
+
+// newMessage returns a client message of type msgType.
+func newMessage(msgType byte, xid uint32, hwaddr net.HardwareAddr) *message {
+	return &message{
+		op:     opRequest,
+		xid:    xid,
+		flags:  flagBroadcast,
+		chaddr: hwaddr,
+		options: map[byte][]byte{
+			optMessageType:  {msgType},
+			optParamRequest: {optSubnetMask, optRouter, optDNS, optLeaseTime, optServerID, optClasslessRoutes},
+		},
+	}
+}
+
+// Obtain runs the DHCP exchange (discover, offer, request and acknowledge) on
+// iface and returns the acknowledged lease. The lease is not applied to iface.
+func Obtain(ctx context.Context, iface net.Interface) (*Lease, error) {
+	if len(iface.HardwareAddr) != 6 {
+		return nil, fmt.Errorf("%s has no ethernet hardware address", iface.Name)
+	}
+
+	c, err := openConn(iface.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open DHCP socket on %s: %w", iface.Name, err)
+	}
+	defer c.Close()
+
+	xid := rand.Uint32()
+
+	discover := newMessage(msgDiscover, xid, iface.HardwareAddr)
+	offer, err := exchange(ctx, c, discover, msgOffer)
+	if err != nil {
+		return nil, fmt.Errorf("no DHCP offer received on %s: %w", iface.Name, err)
+	}
+	logger.Debugf("Received DHCP offer of %s on %s", offer.yiaddr, iface.Name)
+
+	request := newMessage(msgRequest, xid, iface.HardwareAddr)
+	request.options[optRequestedIP] = offer.yiaddr.To4()
+	if serverID, found := offer.options[optServerID]; found {
+		request.options[optServerID] = serverID
+	}
+
+	ack, err := exchange(ctx, c, request, msgAck)
+	if err != nil {
+		return nil, fmt.Errorf("DHCP request of %s on %s failed: %w", offer.yiaddr, iface.Name, err)
+	}
+	return ack.lease()
+}
+
+// exchange sends msg until a reply of type want is received, retrying with an
+// exponential backoff. A NAK fails the exchange.
+func exchange(ctx context.Context, c conn, msg *message, want byte) (*message, error) {
+	timeout := initialTimeout
+	data := msg.marshal()
+
+	for i := 0; i < attempts; i++ {
+		if err := c.send(data); err != nil {
+			return nil, fmt.Errorf("failed to send DHCP message: %w", err)
+		}
+
+		deadline := time.Now().Add(timeout)
+		if ctxDeadline, found := ctx.Deadline(); found && ctxDeadline.Before(deadline) {
+			deadline = ctxDeadline
+		}
+
+		reply, err := waitReply(ctx, c, msg, deadline)
+		if err != nil {
+			return nil, err
+		}
+		if reply != nil {
+			if reply.messageType() == msgNak {
+				return nil, errors.New("request refused by the DHCP server")
+			}
+			if reply.messageType() == want {
+				return reply, nil
+			}
+		}
+		timeout *= 2
+	}
+	return nil, fmt.Errorf("no reply after %d attempts", attempts)
+}
+
+// waitReply reads the replies to msg until deadline, it returns nil if no reply
+// was received in time.
+func waitReply(ctx context.Context, c conn, msg *message, deadline time.Time) (*message, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		b, err := c.receive(deadline)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("failed to receive DHCP message: %w", err)
+		}
+
+		reply, err := parseMessage(b)
+		if err != nil {
+			logger.Debugf("Ignoring invalid DHCP message: %v", err)
+			continue
+		}
+		// Replies to other clients are broadcast too.
+		if reply.op != opReply || reply.xid != msg.xid || !bytes.Equal(reply.chaddr, msg.chaddr) {
+			continue
+		}
+		return reply, nil
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package dhcp
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// udpConn is the DHCP transport over an UDP socket bound to an interface.
+type udpConn struct {
+	pc net.PacketConn
+}
+
+// listen opens an UDP socket bound to the DHCP client port of iface. Binding
+// to the device allows broadcasting before the interface has an address.
+func listen(iface string) (conn, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, syscall.IPPROTO_UDP)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+
+	if err := setupSocket(fd, iface); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	f := os.NewFile(uintptr(fd), "dhcp-"+iface)
+	defer f.Close()
+
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+	return &udpConn{pc: pc}, nil
+}
+
+// setupSocket sets the socket options and binds fd.
+func setupSocket(fd int, iface string) error {
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return os.NewSyscallError("setsockopt(SO_REUSEADDR)", err)
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1); err != nil {
+		return os.NewSyscallError("setsockopt(SO_BROADCAST)", err)
+	}
+	if err := syscall.BindToDevice(fd, iface); err != nil {
+		return os.NewSyscallError("setsockopt(SO_BINDTODEVICE)", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Port: clientPort}); err != nil {
+		return os.NewSyscallError("bind", err)
+	}
+	return nil
+}
+
+// send broadcasts msg to the DHCP servers.
+func (c *udpConn) send(msg []byte) error {
+	_, err := c.pc.WriteTo(msg, &net.UDPAddr{IP: net.IPv4bcast, Port: serverPort})
+	return err
+}
+
+// receive reads a message, failing once deadline is reached.
+func (c *udpConn) receive(deadline time.Time) ([]byte, error) {
+	if err := c.pc.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1500)
+	n, _, err := c.pc.ReadFrom(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// Close closes the socket.
+func (c *udpConn) Close() error {
+	return c.pc.Close()
+}
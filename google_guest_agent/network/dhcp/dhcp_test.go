@@ -0,0 +1,183 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeServer is a conn answering the client's messages as a DHCP server.
+type fakeServer struct {
+	// replies queues the server's replies.
+	replies chan []byte
+	// ack is the message type answering the requests, msgAck or msgNak.
+	ack byte
+	// silent drops the replies to the first silent discovers.
+	silent int
+	// sent counts the messages sent by the client.
+	sent int
+}
+
+func (s *fakeServer) send(b []byte) error {
+	s.sent++
+	msg, err := parseMessage(b)
+	if err != nil {
+		return err
+	}
+
+	reply := &message{
+		op:     opReply,
+		xid:    msg.xid,
+		yiaddr: net.IPv4(10, 128, 0, 5),
+		chaddr: msg.chaddr,
+		options: map[byte][]byte{
+			optSubnetMask: {255, 255, 255, 255},
+			optServerID:   {169, 254, 169, 254},
+			optLeaseTime:  {0, 0, 0x0e, 0x10},
+			optDNS:        {169, 254, 169, 254},
+			// 10.128.0.1/32 on-link and the default route via 10.128.0.1.
+			optClasslessRoutes: {32, 10, 128, 0, 1, 0, 0, 0, 0, 0, 10, 128, 0, 1},
+		},
+	}
+
+	switch msg.messageType() {
+	case msgDiscover:
+		if s.silent > 0 {
+			s.silent--
+			return nil
+		}
+		reply.options[optMessageType] = []byte{msgOffer}
+	case msgRequest:
+		reply.options[optMessageType] = []byte{s.ack}
+	}
+
+	// Replies to other clients must be ignored.
+	other := *reply
+	other.xid++
+	s.replies <- other.marshal()
+	s.replies <- reply.marshal()
+	return nil
+}
+
+func (s *fakeServer) receive(deadline time.Time) ([]byte, error) {
+	select {
+	case b := <-s.replies:
+		return b, nil
+	case <-time.After(time.Until(deadline)):
+		return nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (s *fakeServer) Close() error {
+	return nil
+}
+
+func TestMarshalParse(t *testing.T) {
+	hwaddr := net.HardwareAddr{0x42, 0x01, 0x0a, 0x80, 0x00, 0x05}
+	msg := newMessage(msgRequest, 0x1234, hwaddr)
+	msg.options[optRequestedIP] = []byte{10, 128, 0, 5}
+
+	got, err := parseMessage(msg.marshal())
+	if err != nil {
+		t.Fatalf("parseMessage() failed unexpectedly with error: %v", err)
+	}
+
+	if got.op != opRequest || got.xid != 0x1234 || got.flags != flagBroadcast {
+		t.Errorf("parseMessage() = {op: %d, xid: %x, flags: %x}, want {op: %d, xid: 1234, flags: %x}", got.op, got.xid, got.flags, opRequest, flagBroadcast)
+	}
+	if got.chaddr.String() != hwaddr.String() {
+		t.Errorf("parseMessage() chaddr = %s, want %s", got.chaddr, hwaddr)
+	}
+	if diff := cmp.Diff(msg.options, got.options); diff != "" {
+		t.Errorf("parseMessage() returned unexpected options diff (-want +got):\n%s", diff)
+	}
+
+	if _, err := parseMessage([]byte{1, 2, 3}); err == nil {
+		t.Errorf("parseMessage() succeeded for a truncated message, want error")
+	}
+}
+
+func TestParseClasslessRoutes(t *testing.T) {
+	routes, err := parseClasslessRoutes([]byte{24, 10, 1, 2, 10, 128, 0, 1, 0, 10, 128, 0, 1})
+	if err != nil {
+		t.Fatalf("parseClasslessRoutes() failed unexpectedly with error: %v", err)
+	}
+
+	want := []string{"10.1.2.0/24 via 10.128.0.1", "0.0.0.0/0 via 10.128.0.1"}
+	var got []string
+	for _, r := range routes {
+		got = append(got, r.Destination.String()+" via "+r.Gateway.String())
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("parseClasslessRoutes() returned unexpected diff (-want +got):\n%s", diff)
+	}
+
+	if _, err := parseClasslessRoutes([]byte{24, 10, 1}); err == nil {
+		t.Errorf("parseClasslessRoutes() succeeded for a truncated route, want error")
+	}
+}
+
+func TestObtain(t *testing.T) {
+	iface := net.Interface{Name: "eth1", HardwareAddr: net.HardwareAddr{0x42, 0x01, 0x0a, 0x80, 0x00, 0x05}}
+
+	tests := []struct {
+		name     string
+		server   *fakeServer
+		wantErr  bool
+		wantSent int
+	}{
+		{name: "ack", server: &fakeServer{ack: msgAck}, wantSent: 2},
+		{name: "retried-discover", server: &fakeServer{ack: msgAck, silent: 1}, wantSent: 3},
+		{name: "nak", server: &fakeServer{ack: msgNak}, wantErr: true, wantSent: 2},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.server.replies = make(chan []byte, 8)
+			openConn = func(string) (conn, error) { return tc.server, nil }
+			t.Cleanup(func() { openConn = listen })
+
+			lease, err := Obtain(context.Background(), iface)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Obtain(ctx, %s) = %v, want error: %t", iface.Name, err, tc.wantErr)
+			}
+			if tc.server.sent != tc.wantSent {
+				t.Errorf("Obtain(ctx, %s) sent %d messages, want %d", iface.Name, tc.server.sent, tc.wantSent)
+			}
+			if tc.wantErr {
+				return
+			}
+
+			if !lease.IP.Equal(net.IPv4(10, 128, 0, 5)) || lease.Mask.String() != "ffffffff" {
+				t.Errorf("Obtain(ctx, %s) leased %s/%s, want 10.128.0.5/ffffffff", iface.Name, lease.IP, lease.Mask)
+			}
+			if lease.Duration != time.Hour || len(lease.Routes) != 2 || len(lease.DNS) != 1 {
+				t.Errorf("Obtain(ctx, %s) = %+v, want a 1h lease with 2 routes and 1 DNS server", iface.Name, lease)
+			}
+		})
+	}
+}
+
+func TestObtainInvalidInterface(t *testing.T) {
+	if _, err := Obtain(context.Background(), net.Interface{Name: "lo"}); err == nil {
+		t.Errorf("Obtain(ctx, lo) succeeded for an interface without hardware address, want error")
+	}
+}
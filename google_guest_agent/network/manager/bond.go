@@ -0,0 +1,277 @@
+//  Copyright 2024 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// bondInterface is the name of the bond interface created by the agent.
+	bondInterface = "gcpbond0"
+)
+
+var (
+	// bondedInterfaces are the interfaces enslaved to the agent's bond, the
+	// network managers skip them like the invalid ones.
+	bondedInterfaces = make(map[string]bool)
+
+	// bondStateFile records the applied bond configuration, for tearing it
+	// down once it changes.
+	bondStateFile = "/run/google-guest-agent-bond.json"
+
+	// bondModes are the supported bonding driver modes.
+	bondModes = []string{"balance-rr", "active-backup", "balance-xor", "broadcast", "802.3ad", "balance-tlb", "balance-alb"}
+)
+
+// bondConfig is the configuration of the agent's bond.
+type bondConfig struct {
+	// Mode is the bonding driver mode.
+	Mode string `json:"mode"`
+	// Members are the enslaved interfaces, the bond takes the MAC address of
+	// the first one.
+	Members []string `json:"members"`
+	// Address is the first member's /32 address, moved to the bond.
+	Address string `json:"address"`
+	// Gateway is the first member's gateway, reached on-link as it is out of
+	// the /32 address.
+	Gateway string `json:"gateway,omitempty"`
+	// Subnet is the first member's subnet in CIDR notation, routed through
+	// the gateway.
+	Subnet string `json:"subnet,omitempty"`
+	// Default is whether the gateway is the default gateway, only when the
+	// primary NIC is the first member.
+	Default bool `json:"default,omitempty"`
+}
+
+// wantBond returns the bond configuration of the NICs listed by bond_nics, nil
+// if none are. ifaces are the NICs' interface names.
+func wantBond(config *cfg.Sections, nics []metadata.NetworkInterfaces, ifaces []string) (*bondConfig, error) {
+	if config.NetworkInterfaces.BondNICs == "" {
+		return nil, nil
+	}
+
+	mode := config.NetworkInterfaces.BondMode
+	if !slices.Contains(bondModes, mode) {
+		return nil, fmt.Errorf("invalid bond mode %q", mode)
+	}
+
+	res := &bondConfig{Mode: mode}
+	var first int
+	for _, field := range strings.Split(config.NetworkInterfaces.BondNICs, ",") {
+		idx, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || idx < 0 || idx >= len(ifaces) {
+			return nil, fmt.Errorf("invalid bond NIC %q", field)
+		}
+		if !shouldManageInterface(idx == 0) {
+			return nil, fmt.Errorf("the primary NIC can only be bonded with manage_primary_nic enabled")
+		}
+		if isInvalid(config, ifaces[idx]) {
+			return nil, fmt.Errorf("NIC %d can't be bonded", idx)
+		}
+		if slices.Contains(res.Members, ifaces[idx]) {
+			continue
+		}
+		if len(res.Members) == 0 {
+			first = idx
+		}
+		res.Members = append(res.Members, ifaces[idx])
+	}
+
+	if len(res.Members) < 2 {
+		return nil, fmt.Errorf("at least 2 NICs are needed for bonding, got %v", res.Members)
+	}
+
+	ni := nics[first]
+	ip := net.ParseIP(ni.IP).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("the first bond NIC has no IPv4 address")
+	}
+	// Like the DHCP leases of GCE, the address is a /32 one.
+	res.Address = fmt.Sprintf("%s/32", ip)
+	if gateway := net.ParseIP(ni.Gateway).To4(); gateway != nil {
+		res.Gateway = gateway.String()
+		if mask := net.IPMask(net.ParseIP(ni.Subnetmask).To4()); len(mask) == net.IPv4len {
+			if ones, _ := mask.Size(); ones > 0 && ones < 32 {
+				res.Subnet = (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+			}
+		}
+		res.Default = first == 0
+	}
+
+	return res, nil
+}
+
+// bondUpCommands returns the ip commands creating the bond and enslaving its
+// members. exists indicates the bond interface already exists.
+func bondUpCommands(bc *bondConfig, exists bool, protoID string) [][]string {
+	var res [][]string
+	if !exists {
+		res = append(res, []string{"link", "add", bondInterface, "type", "bond", "mode", bc.Mode})
+	}
+
+	// Interfaces must be down to be enslaved.
+	for _, member := range bc.Members {
+		res = append(res, []string{"link", "set", "dev", member, "down"})
+		res = append(res, []string{"link", "set", "dev", member, "master", bondInterface})
+	}
+
+	res = append(res, []string{"link", "set", "dev", bondInterface, "up"})
+	for _, member := range bc.Members {
+		res = append(res, []string{"link", "set", "dev", member, "up"})
+	}
+
+	res = append(res, []string{"address", "replace", bc.Address, "dev", bondInterface})
+	if bc.Gateway == "" {
+		return res
+	}
+	// The gateway is out of the /32 address, it's reached on-link and routes
+	// the subnet.
+	res = append(res, []string{"route", "replace", bc.Gateway, "dev", bondInterface, "scope", "link", "proto", protoID})
+	if bc.Subnet != "" {
+		res = append(res, []string{"route", "replace", bc.Subnet, "via", bc.Gateway, "dev", bondInterface, "proto", protoID})
+	}
+	if bc.Default {
+		res = append(res, []string{"route", "replace", "default", "via", bc.Gateway, "dev", bondInterface, "onlink", "proto", protoID})
+	}
+	return res
+}
+
+// bondDownCommands returns the ip commands releasing the members of the bond
+// and deleting it.
+func bondDownCommands(bc *bondConfig) [][]string {
+	var res [][]string
+	for _, member := range bc.Members {
+		res = append(res, []string{"link", "set", "dev", member, "nomaster"})
+	}
+	return append(res, []string{"link", "del", bondInterface})
+}
+
+// readBondState returns the recorded bond configuration, nil if none is.
+func readBondState() *bondConfig {
+	data, err := os.ReadFile(bondStateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warningf("Failed to read %s: %v", bondStateFile, err)
+		}
+		return nil
+	}
+
+	res := new(bondConfig)
+	if err := json.Unmarshal(data, res); err != nil {
+		logger.Warningf("Failed to parse %s: %v", bondStateFile, err)
+		return nil
+	}
+	return res
+}
+
+// writeBondState records the applied bond configuration, removing the record
+// if bc is nil.
+func writeBondState(bc *bondConfig) error {
+	if bc == nil {
+		if err := os.Remove(bondStateFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(bc)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(bondStateFile, data, 0644)
+}
+
+// setupBond enslaves the NICs listed by bond_nics into the agent's bond,
+// instead of the network manager svc running DHCP for them. The newly bonded
+// NICs have svc's configuration rolled back, a bond removed or changed since
+// the last run is torn down. ifaces are the NICs' interface names.
+func setupBond(ctx context.Context, config *cfg.Sections, svc Service, nics *Interfaces, ifaces []string) error {
+	// The interfaces are resolved without the previous bonded ones skipped.
+	bondedInterfaces = make(map[string]bool)
+	want, err := wantBond(config, nics.EthernetInterfaces, ifaces)
+	if err != nil {
+		logger.Errorf("Ignoring the bond configuration: %v", err)
+	}
+	applied := readBondState()
+	protoID := config.IPForwarding.EthernetProtoID
+
+	var errs []error
+	if applied != nil && !reflect.DeepEqual(applied, want) {
+		logger.Infof("Removing bond %s of %v", bondInterface, applied.Members)
+		if err := runIPCommands(ctx, bondDownCommands(applied)); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove bond %s: %w", bondInterface, err))
+		}
+		if err := writeBondState(nil); err != nil {
+			errs = append(errs, fmt.Errorf("failed to write %s: %w", bondStateFile, err))
+		}
+	}
+
+	if want == nil {
+		return errors.Join(errs...)
+	}
+	if reflect.DeepEqual(applied, want) {
+		markBonded(want)
+		return errors.Join(errs...)
+	}
+
+	var rollback []metadata.NetworkInterfaces
+	for i, iface := range ifaces {
+		if slices.Contains(want.Members, iface) && (applied == nil || !slices.Contains(applied.Members, iface)) {
+			rollback = append(rollback, nics.EthernetInterfaces[i])
+		}
+	}
+	if err := svc.RollbackNics(ctx, config, &Interfaces{EthernetInterfaces: rollback}); err != nil {
+		logger.Warningf("Failed to roll back %s configuration of bonded NICs: %v", svc.Name(), err)
+	}
+
+	_, err = net.InterfaceByName(bondInterface)
+	exists := err == nil
+
+	logger.Infof("Bonding %v into %s with mode %s", want.Members, bondInterface, want.Mode)
+	if err := runIPCommands(ctx, bondUpCommands(want, exists, protoID)); err != nil {
+		// Not recorded, the commands are retried on the next run. Meanwhile
+		// the NICs are left to the network manager.
+		errs = append(errs, fmt.Errorf("failed to set up bond %s: %w", bondInterface, err))
+		return errors.Join(errs...)
+	}
+	markBonded(want)
+
+	if err := writeBondState(want); err != nil {
+		errs = append(errs, fmt.Errorf("failed to write %s: %w", bondStateFile, err))
+	}
+	return errors.Join(errs...)
+}
+
+// markBonded records the members of bc as bonded, for the network managers to
+// skip them.
+func markBonded(bc *bondConfig) {
+	for _, member := range bc.Members {
+		bondedInterfaces[member] = true
+	}
+}
@@ -0,0 +1,201 @@
+//  Copyright 2024 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package manager
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/google/go-cmp/cmp"
+)
+
+var bondNICs = []metadata.NetworkInterfaces{
+	{Mac: "a", IP: "10.0.0.2", Gateway: "10.0.0.1", Subnetmask: "255.255.255.0"},
+	{Mac: "b", IP: "10.1.0.2", Gateway: "10.1.0.1", Subnetmask: "255.255.240.0"},
+	{Mac: "c", IP: "10.2.0.2", Gateway: "10.2.0.1"},
+	{Mac: "d", IPv6s: []string{"2600:1900::1"}},
+}
+
+func TestWantBond(t *testing.T) {
+	ifaces := []string{"eth0", "eth1", "eth2", "eth3", "invalid-e"}
+
+	tests := []struct {
+		name      string
+		nics      string
+		mode      string
+		managePri bool
+		want      *bondConfig
+		wantErr   bool
+	}{
+		{
+			name: "disabled",
+			mode: "active-backup",
+		},
+		{
+			name: "secondary-nics",
+			nics: "1, 2,1",
+			mode: "active-backup",
+			want: &bondConfig{Mode: "active-backup", Members: []string{"eth1", "eth2"}, Address: "10.1.0.2/32", Gateway: "10.1.0.1", Subnet: "10.1.0.0/20"},
+		},
+		{
+			name:      "primary-nic",
+			nics:      "0,1",
+			mode:      "balance-xor",
+			managePri: true,
+			want:      &bondConfig{Mode: "balance-xor", Members: []string{"eth0", "eth1"}, Address: "10.0.0.2/32", Gateway: "10.0.0.1", Subnet: "10.0.0.0/24", Default: true},
+		},
+		{
+			name:    "unmanaged-primary-nic",
+			nics:    "0,1",
+			mode:    "active-backup",
+			wantErr: true,
+		},
+		{
+			name:    "single-nic",
+			nics:    "1,1",
+			mode:    "active-backup",
+			wantErr: true,
+		},
+		{
+			name:    "unknown-nic",
+			nics:    "1,7",
+			mode:    "active-backup",
+			wantErr: true,
+		},
+		{
+			name:    "invalid-nic",
+			nics:    "1,4",
+			mode:    "active-backup",
+			wantErr: true,
+		},
+		{
+			name:    "ipv6-only-first-nic",
+			nics:    "3,1",
+			mode:    "active-backup",
+			wantErr: true,
+		},
+		{
+			name:    "invalid-mode",
+			nics:    "1,2",
+			mode:    "round-robin",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := cfg.Load(nil); err != nil {
+				t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+			}
+			config := cfg.Get()
+			config.NetworkInterfaces.BondNICs = tc.nics
+			config.NetworkInterfaces.BondMode = tc.mode
+			config.NetworkInterfaces.ManagePrimaryNIC = tc.managePri
+
+			got, err := wantBond(config, append(bondNICs, metadata.NetworkInterfaces{Mac: "e"}), ifaces)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("wantBond(%q) = %v, want error: %t", tc.nics, err, tc.wantErr)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("wantBond(%q) returned unexpected diff (-want,+got):\n%s", tc.nics, diff)
+			}
+		})
+	}
+}
+
+func TestSetupBond(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+	config.NetworkInterfaces.BondNICs = "1,2"
+
+	origState := bondStateFile
+	bondStateFile = filepath.Join(t.TempDir(), "bond.json")
+	origRunner := run.Client
+	t.Cleanup(func() {
+		bondStateFile = origState
+		run.Client = origRunner
+		bondedInterfaces = make(map[string]bool)
+	})
+
+	ctx := context.Background()
+	ifaces := []string{"eth0", "eth1", "eth2", "eth3"}
+	nics := &Interfaces{EthernetInterfaces: bondNICs}
+	commands := func(runner *policyRoutingMockRunner) string {
+		return strings.Join(runner.commands, "\n")
+	}
+
+	// The newly bonded NICs have the network manager's configuration rolled back.
+	runner := &policyRoutingMockRunner{}
+	run.Client = runner
+	svc := &mockService{}
+	if err := setupBond(ctx, config, svc, nics, ifaces); err != nil {
+		t.Fatalf("setupBond() failed unexpectedly with error: %v", err)
+	}
+	if !svc.rolledBack {
+		t.Errorf("setupBond() didn't roll back the configuration of the newly bonded NICs")
+	}
+	want := strings.Join([]string{
+		"ip link add gcpbond0 type bond mode active-backup",
+		"ip link set dev eth1 down",
+		"ip link set dev eth1 master gcpbond0",
+		"ip link set dev eth2 down",
+		"ip link set dev eth2 master gcpbond0",
+		"ip link set dev gcpbond0 up",
+		"ip link set dev eth1 up",
+		"ip link set dev eth2 up",
+		"ip address replace 10.1.0.2/32 dev gcpbond0",
+		"ip route replace 10.1.0.1 dev gcpbond0 scope link proto 66",
+		"ip route replace 10.1.0.0/20 via 10.1.0.1 dev gcpbond0 proto 66",
+	}, "\n")
+	if diff := cmp.Diff(want, commands(runner)); diff != "" {
+		t.Errorf("setupBond() ran unexpected commands (-want,+got):\n%s", diff)
+	}
+	if !isInvalid(config, "eth1") || !isInvalid(config, "eth2") || isInvalid(config, "eth3") {
+		t.Errorf("isInvalid() = %t, %t, %t for eth1, eth2, eth3, want true, true, false", isInvalid(config, "eth1"), isInvalid(config, "eth2"), isInvalid(config, "eth3"))
+	}
+
+	// An applied bond is left as is.
+	runner = &policyRoutingMockRunner{}
+	run.Client = runner
+	svc = &mockService{}
+	if err := setupBond(ctx, config, svc, nics, ifaces); err != nil {
+		t.Fatalf("setupBond() failed unexpectedly with error: %v", err)
+	}
+	if svc.rolledBack || len(runner.commands) != 0 {
+		t.Errorf("setupBond() = rolled back %t, ran %v for an applied bond, want nothing", svc.rolledBack, runner.commands)
+	}
+
+	// A removed bond is torn down, the NICs are back to the network manager.
+	config.NetworkInterfaces.BondNICs = ""
+	runner = &policyRoutingMockRunner{}
+	run.Client = runner
+	if err := setupBond(ctx, config, svc, nics, ifaces); err != nil {
+		t.Fatalf("setupBond() failed unexpectedly with error: %v", err)
+	}
+	want = "ip link set dev eth1 nomaster\nip link set dev eth2 nomaster\nip link del gcpbond0"
+	if diff := cmp.Diff(want, commands(runner)); diff != "" {
+		t.Errorf("setupBond() ran unexpected commands (-want,+got):\n%s", diff)
+	}
+	if isInvalid(config, "eth1") || readBondState() != nil {
+		t.Errorf("setupBond() left eth1 bonded once the bond is removed")
+	}
+}
@@ -0,0 +1,376 @@
+//  Copyright 2024 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/network/dhcp"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// builtinDHCPTimeout is the time given to the DHCP exchange of each interface.
+	builtinDHCPTimeout = 30 * time.Second
+)
+
+// builtinDHCP implements the manager.Service interface with the agent's own
+// DHCPv4 client. It's the fallback for the systems shipping no DHCP client, the
+// obtained leases are applied with ip and kept without renewals. Having no
+// DHCPv6 client, the metadata IPv6 addresses are programmed directly.
+type builtinDHCP struct {
+	// leaseDir is where the applied leases are recorded, for rolling them back.
+	leaseDir string
+}
+
+func init() {
+	// The built-in DHCP client must be the last one, it's always managing.
+	registerService(100, &builtinDHCP{
+		leaseDir: defaultBaseDhclientDir,
+	})
+}
+
+// Name returns the name of the built-in DHCP client.
+func (n *builtinDHCP) Name() string {
+	return "built-in-dhcp"
+}
+
+// Configure gives the opportunity for the Service implementation to adjust its configuration
+// based on the Guest Agent configuration.
+func (n *builtinDHCP) Configure(ctx context.Context, config *cfg.Sections) {
+}
+
+// IsManaging always returns true, the built-in DHCP client is the last resort
+// when no other network manager is found.
+func (n *builtinDHCP) IsManaging(ctx context.Context, iface string) (bool, error) {
+	return true, nil
+}
+
+// SetupEthernetInterface obtains and applies a DHCPv4 lease for the interfaces
+// with no IPv4 address, and sets the IPv6 addresses of the IPv6 interfaces.
+func (n *builtinDHCP) SetupEthernetInterface(ctx context.Context, config *cfg.Sections, nics *Interfaces) error {
+	if err := setEthernetMTU(ctx, config, nics.EthernetInterfaces); err != nil {
+		logger.Errorf("Failed to set interfaces MTU: %v", err)
+	}
+
+	googleInterfaces, googleIpv6Interfaces := interfaceListsIpv4Ipv6(config, nics.EthernetInterfaces)
+	ipv6Only := ipv6OnlyInterfaces(config, nics.EthernetInterfaces)
+
+	for i, iface := range googleInterfaces {
+		if !shouldManageInterface(i == 0) {
+			logger.Debugf("ManagePrimaryNIC is disabled, skipping built-in DHCP for %s", iface)
+			continue
+		}
+		if isInvalid(config, iface) {
+			continue
+		}
+		// The interfaces without IPv6 anymore get their stale addresses removed.
+		var ipv6s []string
+		if slices.Contains(googleIpv6Interfaces, iface) {
+			ipv6s = nics.EthernetInterfaces[i].IPv6s
+		}
+		if err := n.setupIPv6(ctx, iface, ipv6s); err != nil {
+			logger.Errorf("Failed to set up IPv6 addresses of %s: %v", iface, err)
+		}
+		if slices.Contains(ipv6Only, iface) {
+			continue
+		}
+
+		if err := n.setupInterface(ctx, iface, i == 0); err != nil {
+			logger.Errorf("Failed to set up %s with the built-in DHCP client: %v", iface, err)
+		}
+	}
+
+	if err := setResolverDNS(ctx, config, nics.EthernetInterfaces); err != nil {
+		logger.Errorf("Failed to set interfaces DNS configuration: %v", err)
+	}
+	return nil
+}
+
+// setupInterface obtains and applies a lease for iface, unless it already has
+// an IPv4 address.
+func (n *builtinDHCP) setupInterface(ctx context.Context, iface string, primary bool) error {
+	netIface, err := net.InterfaceByName(iface)
+	if err != nil {
+		return err
+	}
+
+	addrs, err := netIface.Addrs()
+	if err != nil {
+		return fmt.Errorf("failed to list %s addresses: %w", iface, err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil && !ipNet.IP.IsLinkLocalUnicast() {
+			logger.Debugf("%s already has IPv4 address %s, skipping built-in DHCP", iface, ipNet)
+			return nil
+		}
+	}
+
+	// The DHCP messages can't be sent through a link down.
+	if err := run.Quiet(ctx, "ip", "link", "set", "dev", iface, "up"); err != nil {
+		return fmt.Errorf("failed to bring %s up: %w", iface, err)
+	}
+
+	dhcpCtx, cancel := context.WithTimeout(ctx, builtinDHCPTimeout)
+	defer cancel()
+
+	lease, err := dhcp.Obtain(dhcpCtx, *netIface)
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("Applying DHCP lease of %s/%s to %s", lease.IP, net.IP(lease.Mask), iface)
+	for _, args := range leaseCommands(iface, lease, primary) {
+		if err := run.Quiet(ctx, "ip", args...); err != nil {
+			return fmt.Errorf("failed to apply DHCP lease to %s: %w", iface, err)
+		}
+	}
+
+	data, err := json.Marshal(lease)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s lease: %w", iface, err)
+	}
+	if err := os.WriteFile(n.leaseFile(iface), data, 0644); err != nil {
+		return fmt.Errorf("failed to record %s lease: %w", iface, err)
+	}
+	return nil
+}
+
+// leaseCommands returns the ip commands applying lease to iface. The default
+// route is only set for the primary interface.
+func leaseCommands(iface string, lease *dhcp.Lease, primary bool) [][]string {
+	ones, _ := lease.Mask.Size()
+	commands := [][]string{
+		{"addr", "replace", fmt.Sprintf("%s/%d", lease.IP, ones), "dev", iface},
+	}
+
+	// The classless static routes take precedence over the router option.
+	routes := lease.Routes
+	if len(routes) == 0 && lease.Router != nil {
+		// GCE leases a /32 address, the gateway is not on its subnet.
+		if ones == 32 {
+			routes = append(routes, dhcp.Route{Destination: net.IPNet{IP: lease.Router, Mask: net.CIDRMask(32, 32)}, Gateway: net.IPv4zero})
+		}
+		routes = append(routes, dhcp.Route{Destination: net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}, Gateway: lease.Router})
+	}
+
+	for _, route := range routes {
+		if ones, _ := route.Destination.Mask.Size(); ones == 0 {
+			if !primary {
+				continue
+			}
+			commands = append(commands, []string{"route", "replace", "default", "via", route.Gateway.String(), "dev", iface})
+			continue
+		}
+
+		args := []string{"route", "replace", route.Destination.String()}
+		if route.Gateway != nil && !route.Gateway.IsUnspecified() {
+			args = append(args, "via", route.Gateway.String())
+		}
+		commands = append(commands, append(args, "dev", iface))
+	}
+	return commands
+}
+
+// setupIPv6 programs the IPv6 addresses of iface offered by metadata, in place
+// of a DHCPv6 exchange, and removes the ones previously set but not offered
+// anymore. The routes are learnt from the router advertisements.
+func (n *builtinDHCP) setupIPv6(ctx context.Context, iface string, addrs []string) error {
+	commands, err := ipv6AddressCommands(iface, addrs)
+	if err != nil {
+		return err
+	}
+	if err := n.removeStaleIPv6(ctx, iface, addrs); err != nil {
+		return err
+	}
+	if len(commands) == 0 {
+		return nil
+	}
+
+	// Like with dhclient, the routes of the route information options are
+	// accepted whatever their prefix length.
+	val := fmt.Sprintf("net.ipv6.conf.%s.accept_ra_rt_info_max_plen=128", iface)
+	if err := run.Quiet(ctx, "sysctl", val); err != nil {
+		return fmt.Errorf("failed to set %s: %w", val, err)
+	}
+
+	logger.Infof("Setting IPv6 addresses %v of %s", addrs, iface)
+	for _, args := range commands {
+		if err := run.Quiet(ctx, "ip", args...); err != nil {
+			return fmt.Errorf("failed to set %s IPv6 addresses: %w", iface, err)
+		}
+	}
+
+	data, err := json.Marshal(addrs)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s IPv6 addresses: %w", iface, err)
+	}
+	if err := os.WriteFile(n.ipv6File(iface), data, 0644); err != nil {
+		return fmt.Errorf("failed to record %s IPv6 addresses: %w", iface, err)
+	}
+	return nil
+}
+
+// ipv6Prefix returns addr in CIDR notation, the metadata addresses without a
+// prefix length are single addresses.
+func ipv6Prefix(addr string) (string, error) {
+	if !strings.Contains(addr, "/") {
+		addr += "/128"
+	}
+	ip, _, err := net.ParseCIDR(addr)
+	if err != nil || ip.To4() != nil {
+		return "", fmt.Errorf("invalid IPv6 address %q", addr)
+	}
+	return addr, nil
+}
+
+// ipv6AddressCommands returns the ip commands bringing iface up and setting
+// addrs on it.
+func ipv6AddressCommands(iface string, addrs []string) ([][]string, error) {
+	if len(addrs) == 0 {
+		return nil, nil
+	}
+
+	commands := [][]string{{"link", "set", "dev", iface, "up"}}
+	for _, addr := range addrs {
+		prefix, err := ipv6Prefix(addr)
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, []string{"-6", "addr", "replace", prefix, "dev", iface})
+	}
+	return commands, nil
+}
+
+// ipv6File returns the path of the recorded IPv6 addresses of iface.
+func (n *builtinDHCP) ipv6File(iface string) string {
+	return filepath.Join(n.leaseDir, fmt.Sprintf("google-guest-agent-dhcp6.%s.addrs", iface))
+}
+
+// leaseFile returns the path of the recorded lease of iface.
+func (n *builtinDHCP) leaseFile(iface string) string {
+	return filepath.Join(n.leaseDir, fmt.Sprintf("google-guest-agent-dhcp.%s.lease", iface))
+}
+
+// SetupVlanInterface is not supported by the built-in DHCP client.
+func (n *builtinDHCP) SetupVlanInterface(ctx context.Context, config *cfg.Sections, nics *Interfaces) error {
+	if len(nics.VlanInterfaces) > 0 {
+		logger.Warningf("VLAN interfaces are not supported by the built-in DHCP client, skipping them")
+	}
+	return nil
+}
+
+// Rollback removes the addresses applied by the built-in DHCP client.
+func (n *builtinDHCP) Rollback(ctx context.Context, config *cfg.Sections, nics *Interfaces) error {
+	return n.RollbackNics(ctx, config, nics)
+}
+
+// RollbackNics removes the addresses applied by the built-in DHCP client, the
+// routes using them are removed by the kernel along with them.
+func (n *builtinDHCP) RollbackNics(ctx context.Context, config *cfg.Sections, nics *Interfaces) error {
+	ifaces, err := interfaceNames(config, nics.EthernetInterfaces)
+	if err != nil {
+		return fmt.Errorf("failed to get list of interface names: %v", err)
+	}
+
+	for _, iface := range ifaces {
+		if err := n.rollbackIPv6(ctx, iface); err != nil {
+			return err
+		}
+
+		leaseFile := n.leaseFile(iface)
+		data, err := os.ReadFile(leaseFile)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				logger.Warningf("Failed to read %s: %v", leaseFile, err)
+			}
+			continue
+		}
+
+		lease := new(dhcp.Lease)
+		if err := json.Unmarshal(data, lease); err != nil {
+			logger.Warningf("Failed to parse %s: %v", leaseFile, err)
+		} else {
+			ones, _ := lease.Mask.Size()
+			addr := fmt.Sprintf("%s/%d", lease.IP, ones)
+			logger.Infof("Removing built-in DHCP address %s from %s", addr, iface)
+			if err := run.Quiet(ctx, "ip", "addr", "del", addr, "dev", iface); err != nil {
+				logger.Warningf("Failed to remove %s from %s: %v", addr, iface, err)
+			}
+		}
+
+		if err := os.Remove(leaseFile); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", leaseFile, err)
+		}
+	}
+	return nil
+}
+
+// rollbackIPv6 removes the IPv6 addresses set on iface.
+func (n *builtinDHCP) rollbackIPv6(ctx context.Context, iface string) error {
+	return n.removeStaleIPv6(ctx, iface, nil)
+}
+
+// removeStaleIPv6 removes the IPv6 addresses recorded as set on iface which are
+// not in keep. The record is removed along with the last address.
+func (n *builtinDHCP) removeStaleIPv6(ctx context.Context, iface string, keep []string) error {
+	ipv6File := n.ipv6File(iface)
+	data, err := os.ReadFile(ipv6File)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warningf("Failed to read %s: %v", ipv6File, err)
+		}
+		return nil
+	}
+
+	var addrs []string
+	if err := json.Unmarshal(data, &addrs); err != nil {
+		logger.Warningf("Failed to parse %s: %v", ipv6File, err)
+	}
+	var kept []string
+	for _, addr := range keep {
+		if prefix, err := ipv6Prefix(addr); err == nil {
+			kept = append(kept, prefix)
+		}
+	}
+	for _, addr := range addrs {
+		prefix, err := ipv6Prefix(addr)
+		if err != nil || slices.Contains(kept, prefix) {
+			continue
+		}
+		logger.Infof("Removing built-in DHCP IPv6 address %s from %s", prefix, iface)
+		if err := run.Quiet(ctx, "ip", "-6", "addr", "del", prefix, "dev", iface); err != nil {
+			logger.Warningf("Failed to remove %s from %s: %v", prefix, iface, err)
+		}
+	}
+
+	if len(keep) > 0 {
+		return nil
+	}
+	if err := os.Remove(ipv6File); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", ipv6File, err)
+	}
+	return nil
+}
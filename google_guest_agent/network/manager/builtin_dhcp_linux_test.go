@@ -0,0 +1,258 @@
+//  Copyright 2024 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/network/dhcp"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLeaseCommands(t *testing.T) {
+	_, defaultNet, _ := net.ParseCIDR("0.0.0.0/0")
+	_, gatewayNet, _ := net.ParseCIDR("10.128.0.1/32")
+	_, otherNet, _ := net.ParseCIDR("10.1.0.0/16")
+
+	tests := []struct {
+		name    string
+		lease   *dhcp.Lease
+		primary bool
+		want    []string
+	}{
+		{
+			name:    "router-primary",
+			lease:   &dhcp.Lease{IP: net.IPv4(10, 128, 0, 5), Mask: net.CIDRMask(32, 32), Router: net.IPv4(10, 128, 0, 1)},
+			primary: true,
+			want: []string{
+				"addr replace 10.128.0.5/32 dev eth0",
+				"route replace 10.128.0.1/32 dev eth0",
+				"route replace default via 10.128.0.1 dev eth0",
+			},
+		},
+		{
+			name:  "router-secondary",
+			lease: &dhcp.Lease{IP: net.IPv4(10, 128, 0, 5), Mask: net.CIDRMask(24, 32), Router: net.IPv4(10, 128, 0, 1)},
+			want: []string{
+				"addr replace 10.128.0.5/24 dev eth0",
+			},
+		},
+		{
+			name: "classless-routes",
+			lease: &dhcp.Lease{
+				IP:     net.IPv4(10, 128, 0, 5),
+				Mask:   net.CIDRMask(32, 32),
+				Router: net.IPv4(10, 128, 0, 254),
+				Routes: []dhcp.Route{
+					{Destination: *gatewayNet, Gateway: net.IPv4zero},
+					{Destination: *otherNet, Gateway: net.IPv4(10, 128, 0, 1)},
+					{Destination: *defaultNet, Gateway: net.IPv4(10, 128, 0, 1)},
+				},
+			},
+			primary: true,
+			want: []string{
+				"addr replace 10.128.0.5/32 dev eth0",
+				"route replace 10.128.0.1/32 dev eth0",
+				"route replace 10.1.0.0/16 via 10.128.0.1 dev eth0",
+				"route replace default via 10.128.0.1 dev eth0",
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			for _, args := range leaseCommands("eth0", tc.lease, tc.primary) {
+				got = append(got, strings.Join(args, " "))
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("leaseCommands(eth0, %+v, %t) returned unexpected diff (-want +got):\n%s", tc.lease, tc.primary, diff)
+			}
+		})
+	}
+}
+
+func TestBuiltinDHCPRollback(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatalf("net.Interfaces() failed unexpectedly with error: %v", err)
+	}
+
+	var iface net.Interface
+	for _, curr := range ifaces {
+		if len(curr.HardwareAddr) > 0 {
+			iface = curr
+			break
+		}
+	}
+	if iface.Name == "" {
+		t.Skip("no interface with a MAC address found")
+	}
+
+	runner := &policyRoutingMockRunner{}
+	origClient := run.Client
+	run.Client = runner
+	t.Cleanup(func() { run.Client = origClient })
+
+	n := &builtinDHCP{leaseDir: t.TempDir()}
+	lease := &dhcp.Lease{IP: net.IPv4(10, 128, 0, 5), Mask: net.CIDRMask(32, 32)}
+	data, err := json.Marshal(lease)
+	if err != nil {
+		t.Fatalf("json.Marshal(%+v) failed unexpectedly with error: %v", lease, err)
+	}
+	leaseFile := n.leaseFile(iface.Name)
+	if err := os.WriteFile(leaseFile, data, 0644); err != nil {
+		t.Fatalf("os.WriteFile(%s) failed unexpectedly with error: %v", leaseFile, err)
+	}
+	ipv6File := n.ipv6File(iface.Name)
+	if err := os.WriteFile(ipv6File, []byte(`["2600:1900::5"]`), 0644); err != nil {
+		t.Fatalf("os.WriteFile(%s) failed unexpectedly with error: %v", ipv6File, err)
+	}
+
+	nics := &Interfaces{EthernetInterfaces: []metadata.NetworkInterfaces{{Mac: iface.HardwareAddr.String()}}}
+	if err := n.Rollback(context.Background(), config, nics); err != nil {
+		t.Fatalf("Rollback(ctx, %+v) failed unexpectedly with error: %v", nics, err)
+	}
+
+	want := []string{
+		"ip -6 addr del 2600:1900::5/128 dev " + iface.Name,
+		"ip addr del 10.128.0.5/32 dev " + iface.Name,
+	}
+	if diff := cmp.Diff(want, runner.commands); diff != "" {
+		t.Errorf("Rollback(ctx, %+v) ran unexpected commands (-want +got):\n%s", nics, diff)
+	}
+	for _, file := range []string{leaseFile, ipv6File} {
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("Rollback(ctx, %+v) did not remove %s", nics, file)
+		}
+	}
+
+	// Nothing left to roll back.
+	runner.commands = nil
+	if err := n.Rollback(context.Background(), config, nics); err != nil {
+		t.Fatalf("Rollback(ctx, %+v) failed unexpectedly with error: %v", nics, err)
+	}
+	if len(runner.commands) != 0 {
+		t.Errorf("Rollback(ctx, %+v) ran %v without a recorded lease, want none", nics, runner.commands)
+	}
+}
+
+func TestIPv6AddressCommands(t *testing.T) {
+	tests := []struct {
+		name    string
+		addrs   []string
+		want    [][]string
+		wantErr bool
+	}{
+		{
+			name: "no-address",
+		},
+		{
+			name:  "addresses",
+			addrs: []string{"2600:1900::5", "2600:1900:1::/96"},
+			want: [][]string{
+				{"link", "set", "dev", "eth1", "up"},
+				{"-6", "addr", "replace", "2600:1900::5/128", "dev", "eth1"},
+				{"-6", "addr", "replace", "2600:1900:1::/96", "dev", "eth1"},
+			},
+		},
+		{
+			name:    "ipv4-address",
+			addrs:   []string{"10.128.0.5"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid-address",
+			addrs:   []string{"2600:1900::zz"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ipv6AddressCommands("eth1", tc.addrs)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ipv6AddressCommands(eth1, %v) = %v, want error: %t", tc.addrs, err, tc.wantErr)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("ipv6AddressCommands(eth1, %v) returned unexpected diff (-want +got):\n%s", tc.addrs, diff)
+			}
+		})
+	}
+}
+
+func TestBuiltinDHCPSetupIPv6(t *testing.T) {
+	runner := &policyRoutingMockRunner{}
+	origClient := run.Client
+	run.Client = runner
+	t.Cleanup(func() { run.Client = origClient })
+
+	n := &builtinDHCP{leaseDir: t.TempDir()}
+	if err := n.setupIPv6(context.Background(), "eth1", []string{"2600:1900::5"}); err != nil {
+		t.Fatalf("setupIPv6(ctx, eth1) failed unexpectedly with error: %v", err)
+	}
+
+	want := []string{
+		"sysctl net.ipv6.conf.eth1.accept_ra_rt_info_max_plen=128",
+		"ip link set dev eth1 up",
+		"ip -6 addr replace 2600:1900::5/128 dev eth1",
+	}
+	if diff := cmp.Diff(want, runner.commands); diff != "" {
+		t.Errorf("setupIPv6(ctx, eth1) ran unexpected commands (-want +got):\n%s", diff)
+	}
+	if _, err := os.Stat(n.ipv6File("eth1")); err != nil {
+		t.Errorf("setupIPv6(ctx, eth1) did not record the addresses: %v", err)
+	}
+
+	// The addresses not offered anymore are removed.
+	runner.commands = nil
+	if err := n.setupIPv6(context.Background(), "eth1", []string{"2600:1900::6"}); err != nil {
+		t.Fatalf("setupIPv6(ctx, eth1) failed unexpectedly with error: %v", err)
+	}
+	want = []string{
+		"ip -6 addr del 2600:1900::5/128 dev eth1",
+		"sysctl net.ipv6.conf.eth1.accept_ra_rt_info_max_plen=128",
+		"ip link set dev eth1 up",
+		"ip -6 addr replace 2600:1900::6/128 dev eth1",
+	}
+	if diff := cmp.Diff(want, runner.commands); diff != "" {
+		t.Errorf("setupIPv6(ctx, eth1) ran unexpected commands (-want +got):\n%s", diff)
+	}
+
+	runner.commands = nil
+	if err := n.setupIPv6(context.Background(), "eth1", nil); err != nil {
+		t.Fatalf("setupIPv6(ctx, eth1) failed unexpectedly with error: %v", err)
+	}
+	want = []string{"ip -6 addr del 2600:1900::6/128 dev eth1"}
+	if diff := cmp.Diff(want, runner.commands); diff != "" {
+		t.Errorf("setupIPv6(ctx, eth1) ran unexpected commands (-want +got):\n%s", diff)
+	}
+	if _, err := os.Stat(n.ipv6File("eth1")); !os.IsNotExist(err) {
+		t.Errorf("setupIPv6(ctx, eth1) without addresses did not remove the record")
+	}
+}
@@ -23,8 +23,10 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"path"
 	"strings"
 
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/osinfo"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
 	"github.com/GoogleCloudPlatform/guest-agent/metadata"
@@ -39,8 +41,40 @@ var (
 
 	// execLookPath points to the function to check if a path exists.
 	execLookPath = exec.LookPath
+
+	// netInterfaces points to the function listing the network interfaces
+	// present on the system.
+	netInterfaces = net.Interfaces
 )
 
+// interfacePatterns returns the ignore_interfaces patterns of config.
+func interfacePatterns(config *cfg.Sections) []string {
+	var res []string
+	for _, pattern := range strings.Split(config.NetworkInterfaces.IgnoreInterfaces, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			res = append(res, pattern)
+		}
+	}
+	return res
+}
+
+// matchesPatterns reports whether iface matches one of the glob patterns.
+func matchesPatterns(patterns []string, iface string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, iface); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// IsIgnoredInterface reports whether iface matches the ignore_interfaces
+// patterns of config, it's managed by container networking or virtualization
+// software and must not be touched by the agent.
+func IsIgnoredInterface(config *cfg.Sections, iface string) bool {
+	return matchesPatterns(interfacePatterns(config), iface)
+}
+
 func cliExists(name string) (bool, error) {
 	_, err := execLookPath(name)
 	if err == nil {
@@ -56,7 +90,7 @@ func cliExists(name string) (bool, error) {
 // logInterfaceState logs all network interface state present on the machine.
 func logInterfaceState(ctx context.Context) {
 	logger.Infof("Getting current interface state and routes")
-	ifaces, err := net.Interfaces()
+	ifaces, err := netInterfaces()
 	if err != nil {
 		logger.Warningf("Unable to get all interface: %v, will skip logging state", err)
 	}
@@ -79,10 +113,10 @@ func logInterfaceState(ctx context.Context) {
 
 // interfaceNames extracts the names of the network interfaces from the provided list
 // of network interfaces.
-func interfaceNames(nics []metadata.NetworkInterfaces) ([]string, error) {
+func interfaceNames(config *cfg.Sections, nics []metadata.NetworkInterfaces) ([]string, error) {
 	var ifaces []string
 	for _, ni := range nics {
-		iface, err := GetInterfaceByMAC(ni.Mac)
+		iface, err := GetInterfaceByMAC(config, ni.Mac)
 		ifaceName := iface.Name
 		if err != nil {
 			if _, found := badMAC[ni.Mac]; !found {
@@ -115,22 +149,36 @@ func interfaceNames(nics []metadata.NetworkInterfaces) ([]string, error) {
 // setup implementation will start treating the first secondary NIC as the
 // primary NIC. In VLAN's case, a VLAN NIC may be improperly paired with the
 // wrong parent NIC.
-func isInvalid(iface string) bool {
+func isInvalid(config *cfg.Sections, iface string) bool {
 	invalid := strings.Contains(iface, "invalid")
 	if invalid {
 		logger.Debugf("Invalid interface %s, skipping", iface)
 	}
+	// The interfaces with a static IP configuration are set up by the agent.
+	if staticInterfaces[iface] {
+		logger.Debugf("Interface %s has a static IP configuration, skipping", iface)
+		invalid = true
+	}
+	if IsIgnoredInterface(config, iface) {
+		logger.Debugf("Interface %s matches ignore_interfaces, skipping", iface)
+		invalid = true
+	}
+	// The bonded interfaces are configured through the agent's bond.
+	if bondedInterfaces[iface] {
+		logger.Debugf("Interface %s is bonded, skipping", iface)
+		invalid = true
+	}
 	return invalid
 }
 
 // interfaceListsIpv4Ipv6 gets a list of interface names. The first list is a list of all
 // interfaces, and the second list consists of only interfaces that support IPv6.
-func interfaceListsIpv4Ipv6(nics []metadata.NetworkInterfaces) ([]string, []string) {
+func interfaceListsIpv4Ipv6(config *cfg.Sections, nics []metadata.NetworkInterfaces) ([]string, []string) {
 	var googleInterfaces []string
 	var googleIpv6Interfaces []string
 
 	for _, ni := range nics {
-		iface, err := GetInterfaceByMAC(ni.Mac)
+		iface, err := GetInterfaceByMAC(config, ni.Mac)
 		ifaceName := iface.Name
 		if err != nil {
 			if _, found := badMAC[ni.Mac]; !found {
@@ -150,13 +198,31 @@ func interfaceListsIpv4Ipv6(nics []metadata.NetworkInterfaces) ([]string, []stri
 	return googleInterfaces, googleIpv6Interfaces
 }
 
+// ipv6OnlyInterfaces returns the names of the network interfaces without an
+// IPv4 address, for which the IPv4 configuration (i.e. DHCPv4) is skipped.
+func ipv6OnlyInterfaces(config *cfg.Sections, nics []metadata.NetworkInterfaces) []string {
+	var res []string
+	for _, ni := range nics {
+		if !ni.IPv6Only() {
+			continue
+		}
+		// The interfaces not found are already reported by interfaceListsIpv4Ipv6.
+		iface, err := GetInterfaceByMAC(config, ni.Mac)
+		if err != nil {
+			continue
+		}
+		res = append(res, iface.Name)
+	}
+	return res
+}
+
 // interfacesMTUMap returns a map indexes by the interface's name with the MTU value
 // provided by the metadata descriptor.
-func interfacesMTUMap(nics []metadata.NetworkInterfaces) (map[string]int, error) {
+func interfacesMTUMap(config *cfg.Sections, nics []metadata.NetworkInterfaces) (map[string]int, error) {
 	res := make(map[string]int)
 
 	for _, ni := range nics {
-		iface, err := GetInterfaceByMAC(ni.Mac)
+		iface, err := GetInterfaceByMAC(config, ni.Mac)
 		if err != nil {
 			if _, found := badMAC[ni.Mac]; !found {
 				logger.Errorf("error getting interface: %s", err)
@@ -170,26 +236,151 @@ func interfacesMTUMap(nics []metadata.NetworkInterfaces) (map[string]int, error)
 	return res, nil
 }
 
-// GetInterfaceByMAC gets the interface given the mac string.
-func GetInterfaceByMAC(mac string) (net.Interface, error) {
+// interfaceDNS is the DNS configuration of an interface provided by the
+// metadata descriptor.
+type interfaceDNS struct {
+	// servers are the DNS servers addresses.
+	servers []string
+	// domains are the DNS search domains.
+	domains []string
+}
+
+// ipv4Servers returns the IPv4 DNS servers.
+func (d interfaceDNS) ipv4Servers() []string {
+	var res []string
+	for _, server := range d.servers {
+		if ip := net.ParseIP(server); ip != nil && ip.To4() != nil {
+			res = append(res, server)
+		}
+	}
+	return res
+}
+
+// ipv6Servers returns the IPv6 DNS servers.
+func (d interfaceDNS) ipv6Servers() []string {
+	var res []string
+	for _, server := range d.servers {
+		if ip := net.ParseIP(server); ip != nil && ip.To4() == nil {
+			res = append(res, server)
+		}
+	}
+	return res
+}
+
+// interfacesDNSMap returns a map indexed by the interface's name with the DNS
+// configuration provided by the metadata descriptor, interfaces without DNS
+// servers or search domains are not included. Invalid server addresses are
+// dropped.
+func interfacesDNSMap(config *cfg.Sections, nics []metadata.NetworkInterfaces) map[string]interfaceDNS {
+	res := make(map[string]interfaceDNS)
+
+	for _, ni := range nics {
+		if len(ni.DNSServers) == 0 && len(ni.DNSSearchDomains) == 0 {
+			continue
+		}
+
+		iface, err := GetInterfaceByMAC(config, ni.Mac)
+		if err != nil {
+			if _, found := badMAC[ni.Mac]; !found {
+				logger.Errorf("error getting interface: %s", err)
+				badMAC[ni.Mac] = iface
+			}
+			continue
+		}
+
+		var dns interfaceDNS
+		for _, server := range ni.DNSServers {
+			if net.ParseIP(server) == nil {
+				logger.Errorf("Ignoring invalid DNS server %q of interface %s", server, iface.Name)
+				continue
+			}
+			dns.servers = append(dns.servers, server)
+		}
+		dns.domains = ni.DNSSearchDomains
+		res[iface.Name] = dns
+	}
+
+	return res
+}
+
+// GetInterfaceByMAC gets the interface given the mac string, skipping the
+// interfaces ignored by config.
+func GetInterfaceByMAC(config *cfg.Sections, mac string) (net.Interface, error) {
 	hwaddr, err := net.ParseMAC(mac)
 	if err != nil {
 		return net.Interface{}, err
 	}
 
-	interfaces, err := net.Interfaces()
+	interfaces, err := netInterfaces()
 	if err != nil {
 		return net.Interface{}, fmt.Errorf("failed to get interfaces: %v", err)
 	}
 
 	for _, iface := range interfaces {
-		if iface.HardwareAddr.String() == hwaddr.String() {
+		// Container interfaces may share the address of the NIC, i.e. ipvlan.
+		if iface.HardwareAddr.String() == hwaddr.String() && !IsIgnoredInterface(config, iface.Name) {
 			return iface, nil
 		}
 	}
 	return net.Interface{}, fmt.Errorf("no interface found with MAC %s", mac)
 }
 
+// fileState is the content and mode of a configuration file, or its absence.
+type fileState struct {
+	exists bool
+	data   []byte
+	mode   os.FileMode
+}
+
+// fileSnapshot holds the configuration files state before they are changed,
+// by path.
+type fileSnapshot map[string]fileState
+
+// snapshotFiles records the current state of the files at paths.
+func snapshotFiles(paths ...string) (fileSnapshot, error) {
+	res := make(fileSnapshot)
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			res[path] = fileState{}
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat %q: %w", path, err)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %q: %w", path, err)
+		}
+		res[path] = fileState{exists: true, data: data, mode: info.Mode().Perm()}
+	}
+	return res, nil
+}
+
+// restore puts the files back in their recorded state, removing the ones that
+// didn't exist.
+func (s fileSnapshot) restore() error {
+	var errs []error
+	for path, state := range s {
+		if !state.exists {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		if err := os.WriteFile(path, state.data, state.mode); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		// WriteFile doesn't change the mode of an existing file.
+		if err := os.Chmod(path, state.mode); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
 // readIniFile reads and parses the content of filePath and loads it into ptr.
 func readIniFile(filePath string, ptr any) error {
 	opts := ini.LoadOptions{
@@ -213,7 +404,9 @@ func readIniFile(filePath string, ptr any) error {
 
 // writeIniFile writes ptr data into filePath file marshalled in a ini file format.
 func writeIniFile(filePath string, ptr any) error {
-	config := ini.Empty()
+	// Shadows must be allowed, otherwise only the first value of repeated keys
+	// (i.e. systemd-networkd's VLAN and DNS) is written.
+	config := ini.Empty(ini.LoadOptions{AllowShadows: true})
 	if err := ini.ReflectFrom(config, ptr); err != nil {
 		return fmt.Errorf("error creating .netdev config ini: %v", err)
 	}
@@ -13,3 +13,43 @@
 //  limitations under the License.
 
 package manager
+
+import (
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+)
+
+func TestIsIgnoredInterface(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+
+	tests := []struct {
+		iface string
+		want  bool
+	}{
+		{"cali1234abcd", true},
+		{"veth0a1b2c", true},
+		{"docker0", true},
+		{"cilium_host", true},
+		{"eth0", false},
+		{"ens4", false},
+		{"gcp.eth0.5", false},
+	}
+	for _, tc := range tests {
+		if got := IsIgnoredInterface(config, tc.iface); got != tc.want {
+			t.Errorf("IsIgnoredInterface(%q) = %t, want %t", tc.iface, got, tc.want)
+		}
+	}
+
+	origIgnore := config.NetworkInterfaces.IgnoreInterfaces
+	t.Cleanup(func() { config.NetworkInterfaces.IgnoreInterfaces = origIgnore })
+	config.NetworkInterfaces.IgnoreInterfaces = " eth1 , ens[5-6]"
+	for iface, want := range map[string]bool{"eth1": true, "ens5": true, "ens4": false, "veth0": false} {
+		if got := isInvalid(config, iface); got != want {
+			t.Errorf("isInvalid(config, %q) = %t with ignore_interfaces %q, want %t", iface, got, config.NetworkInterfaces.IgnoreInterfaces, want)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+//  Copyright 2024 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package manager
+
+import (
+	"context"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/google/go-cmp/cmp"
+)
+
+// conformanceInterfaces are the interfaces present on the system in the
+// conformance tests: the primary and a secondary NIC, and a container
+// interface sharing the address of the secondary NIC.
+var conformanceInterfaces = []net.Interface{
+	{Index: 1, Name: "lo", MTU: 65536, Flags: net.FlagUp | net.FlagLoopback},
+	{Index: 2, Name: "eth0", MTU: 1460, HardwareAddr: net.HardwareAddr{0x42, 0x01, 0x0a, 0x00, 0x00, 0x02}, Flags: net.FlagUp},
+	{Index: 3, Name: "cali0", MTU: 1460, HardwareAddr: net.HardwareAddr{0x42, 0x01, 0x0a, 0x01, 0x00, 0x02}, Flags: net.FlagUp},
+	{Index: 4, Name: "eth1", MTU: 1460, HardwareAddr: net.HardwareAddr{0x42, 0x01, 0x0a, 0x01, 0x00, 0x02}, Flags: net.FlagUp},
+}
+
+// conformanceState is the desired state of the conformance tests, the last
+// NIC isn't present on the system.
+func conformanceState(t *testing.T, config *cfg.Sections) *desiredState {
+	t.Helper()
+
+	mds := &metadata.Descriptor{}
+	mds.Instance.NetworkInterfaces = []metadata.NetworkInterfaces{
+		{Mac: "42:01:0a:00:00:02", IP: "10.0.0.2", Gateway: "10.0.0.1", Subnetmask: "255.255.255.0", MTU: 1460},
+		{Mac: "42:01:0a:01:00:02", IP: "10.1.0.2", Gateway: "10.1.0.1", Subnetmask: "255.255.255.0", MTU: 1460, IPv6s: []string{"2600:1900::2"}},
+		{Mac: "42:01:0a:02:00:02", IP: "10.2.0.2", Gateway: "10.2.0.1", Subnetmask: "255.255.255.0", MTU: 1460},
+	}
+	mds.Instance.VlanNetworkInterfaces = map[int]map[int]metadata.VlanInterface{
+		1: {5: {Mac: "42:01:0a:05:00:02", Vlan: 5, MTU: 1460, IP: "10.5.0.2", Gateway: "10.5.0.1"}},
+	}
+
+	state, err := buildDesiredState(config, mds)
+	if err != nil {
+		t.Fatalf("buildDesiredState() failed unexpectedly with error: %v", err)
+	}
+	return state
+}
+
+// readTree returns the content of the regular files under root, by path
+// relative to root.
+func readTree(t *testing.T, root string) map[string]string {
+	t.Helper()
+
+	res := make(map[string]string)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		res[rel] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to read %q: %v", root, err)
+	}
+	return res
+}
+
+// TestServiceConformance checks that every registered network manager service
+// able to redirect its configuration honors the same contract: it writes the
+// files it reports for the managed interfaces only, setting up the same state
+// twice changes nothing, and rolling back removes what it wrote.
+func TestServiceConformance(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+	config.NetworkInterfaces.VlanSetupEnabled = true
+
+	origRunner := run.Client
+	t.Cleanup(func() {
+		run.Client = origRunner
+		netInterfaces = net.Interfaces
+	})
+	run.Client = &policyRoutingMockRunner{}
+	netInterfaces = func() ([]net.Interface, error) {
+		return conformanceInterfaces, nil
+	}
+
+	ctx := context.Background()
+	state := conformanceState(t, config)
+	if diff := cmp.Diff([]string{"eth0", "eth1", "invalid-42:01:0a:02:00:02"}, state.interfaces); diff != "" {
+		t.Fatalf("buildDesiredState() returned unexpected interfaces (-want +got):\n%s", diff)
+	}
+
+	for _, registered := range knownNetworkManagers {
+		dr, ok := registered.(dryRunner)
+		if !ok {
+			continue
+		}
+
+		t.Run(registered.Name(), func(t *testing.T) {
+			root := t.TempDir()
+			registered.Configure(ctx, config)
+			svc, dirs := dr.withConfigRoot(root)
+			for _, dir := range dirs {
+				if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+					t.Fatalf("failed to create %q: %v", dir, err)
+				}
+			}
+			snapshotter, ok := svc.(configSnapshotter)
+			if !ok {
+				t.Fatalf("%s implements dryRunner but not configSnapshotter", svc.Name())
+			}
+
+			if err := svc.SetupEthernetInterface(ctx, config, state.ethernetNics()); err != nil {
+				t.Fatalf("SetupEthernetInterface() failed unexpectedly with error: %v", err)
+			}
+			if err := svc.SetupVlanInterface(ctx, config, state.nics()); err != nil {
+				t.Fatalf("SetupVlanInterface() failed unexpectedly with error: %v", err)
+			}
+
+			files := snapshotter.configFiles(config, state.nics())
+			if len(files) == 0 {
+				t.Fatalf("configFiles() returned no files for the managed interfaces")
+			}
+			for _, path := range files {
+				if !strings.HasPrefix(path, root) {
+					t.Errorf("configFiles() returned %q outside of the configuration root %q", path, root)
+				}
+				if _, err := os.Stat(path); err != nil {
+					t.Errorf("setup didn't write %q reported by configFiles(): %v", path, err)
+				}
+			}
+
+			applied := readTree(t, root)
+			for path := range applied {
+				for _, iface := range []string{"eth0", "cali0", "invalid"} {
+					if strings.Contains(filepath.Base(path), iface) {
+						t.Errorf("setup wrote %q for the unmanaged interface %s", path, iface)
+					}
+				}
+			}
+
+			if err := svc.SetupEthernetInterface(ctx, config, state.ethernetNics()); err != nil {
+				t.Fatalf("SetupEthernetInterface() failed unexpectedly with error: %v", err)
+			}
+			if err := svc.SetupVlanInterface(ctx, config, state.nics()); err != nil {
+				t.Fatalf("SetupVlanInterface() failed unexpectedly with error: %v", err)
+			}
+			if diff := cmp.Diff(applied, readTree(t, root)); diff != "" {
+				t.Errorf("setting up the same state again changed the configuration (-first +second):\n%s", diff)
+			}
+
+			if err := svc.Rollback(ctx, config, state.nics()); err != nil {
+				t.Fatalf("Rollback() failed unexpectedly with error: %v", err)
+			}
+			for _, path := range files {
+				if _, err := os.Stat(path); !os.IsNotExist(err) {
+					t.Errorf("Rollback() left %q behind", path)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+//  Copyright 2024 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+var (
+	// customRoutesStateFile records the applied custom routes, for removing
+	// them once they're removed from metadata and reconciling them.
+	customRoutesStateFile = "/run/google-guest-agent-custom-routes.json"
+)
+
+// customRoute is a custom route resolved to its interface.
+type customRoute struct {
+	// Interface is the route's interface name.
+	Interface string `json:"interface"`
+	// MAC is the route's interface MAC address.
+	MAC string `json:"mac"`
+	// Destination is the route's destination in CIDR notation.
+	Destination string `json:"destination"`
+	// Via is the route's next hop, the route is on-link if empty.
+	Via string `json:"via,omitempty"`
+}
+
+// RouteRepair describes the custom routes of an interface re-added by
+// ReconcileCustomRoutes.
+type RouteRepair struct {
+	// Interface is the network interface's name.
+	Interface string
+	// MAC is the network interface's MAC address.
+	MAC string
+	// Routes are the re-added routes' destinations.
+	Routes []string
+}
+
+// normalizeCustomRoute checks the addresses of a custom route, the next hop
+// must be of the destination's IP family. It returns the destination with its
+// host bits cleared, i.e. 10.8.0.0/16 for 10.8.1.1/16, as the kernel reports
+// it.
+func normalizeCustomRoute(route metadata.CustomRoute) (string, error) {
+	dst, err := netip.ParsePrefix(route.Destination)
+	if err != nil {
+		return "", fmt.Errorf("invalid destination %q", route.Destination)
+	}
+	if route.Via != "" {
+		via, err := netip.ParseAddr(route.Via)
+		if err != nil || via.Is4() != dst.Addr().Is4() {
+			return "", fmt.Errorf("invalid next hop %q for %s", route.Via, route.Destination)
+		}
+	}
+	return dst.Masked().String(), nil
+}
+
+// customRoutes resolves the valid custom routes to their interface. ifaces are
+// the interface names of nics' ethernet interfaces.
+func customRoutes(config *cfg.Sections, routes []metadata.CustomRoute, nics []metadata.NetworkInterfaces, ifaces []string) []customRoute {
+	var res []customRoute
+	for _, route := range routes {
+		if route.NIC < 0 || route.NIC >= len(ifaces) || route.NIC >= len(nics) {
+			logger.Errorf("Ignoring the custom route to %s through unknown NIC %d", route.Destination, route.NIC)
+			continue
+		}
+
+		iface := ifaces[route.NIC]
+		if strings.HasPrefix(iface, "invalid") || IsIgnoredInterface(config, iface) || bondedInterfaces[iface] {
+			logger.Debugf("Ignoring the custom route to %s through %s", route.Destination, iface)
+			continue
+		}
+		dst, err := normalizeCustomRoute(route)
+		if err != nil {
+			logger.Errorf("Ignoring the custom route of %s: %v", iface, err)
+			continue
+		}
+		res = append(res, customRoute{Interface: iface, MAC: nics[route.NIC].Mac, Destination: dst, Via: route.Via})
+	}
+	return res
+}
+
+// customRouteArgs returns the ip arguments adding (op "replace"), deleting
+// (op "del") or showing (op "show") route.
+func customRouteArgs(op string, route customRoute, protoID string) []string {
+	family := "-4"
+	if dst, err := netip.ParsePrefix(route.Destination); err == nil && !dst.Addr().Is4() {
+		family = "-6"
+	}
+
+	args := []string{family, "route", op}
+	if op == "show" {
+		args = append(args, "exact")
+	}
+	args = append(args, route.Destination)
+	if route.Via != "" && op != "show" {
+		args = append(args, "via", route.Via)
+	}
+	return append(args, "dev", route.Interface, "proto", protoID)
+}
+
+// readCustomRoutesState returns the recorded custom routes.
+func readCustomRoutesState() []customRoute {
+	data, err := os.ReadFile(customRoutesStateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warningf("Failed to read %s: %v", customRoutesStateFile, err)
+		}
+		return nil
+	}
+
+	var res []customRoute
+	if err := json.Unmarshal(data, &res); err != nil {
+		logger.Warningf("Failed to parse %s: %v", customRoutesStateFile, err)
+	}
+	return res
+}
+
+// writeCustomRoutesState records the applied custom routes.
+func writeCustomRoutesState(applied []customRoute) error {
+	if len(applied) == 0 {
+		if err := os.Remove(customRoutesStateFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(applied)
+	if err != nil {
+		return err
+	}
+	// Write then rename so a partial state is never read.
+	tmp := customRoutesStateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, customRoutesStateFile)
+}
+
+// setupCustomRoutes programs the custom routes listed by the custom-routes
+// attribute and deletes the ones removed since the last run. ifaces are the
+// interface names of nics' ethernet interfaces.
+func setupCustomRoutes(ctx context.Context, config *cfg.Sections, nics []metadata.NetworkInterfaces, ifaces []string, routes []metadata.CustomRoute) error {
+	wanted := customRoutes(config, routes, nics, ifaces)
+	protoID := config.IPForwarding.EthernetProtoID
+
+	for _, prev := range readCustomRoutesState() {
+		if slices.Contains(wanted, prev) {
+			continue
+		}
+		logger.Infof("Removing the custom route to %s through %s", prev.Destination, prev.Interface)
+		if err := run.Quiet(ctx, "ip", customRouteArgs("del", prev, protoID)...); err != nil {
+			logger.Debugf("Failed to remove the custom route to %s: %v", prev.Destination, err)
+		}
+	}
+
+	// The routes are replaced even if applied already, the network manager
+	// may have flushed them while applying its configuration.
+	var applied []customRoute
+	var errs []error
+	for _, route := range wanted {
+		if err := run.Quiet(ctx, "ip", customRouteArgs("replace", route, protoID)...); err != nil {
+			// Not recorded, the route is retried on the next run.
+			errs = append(errs, fmt.Errorf("failed to add the custom route to %s through %s: %w", route.Destination, route.Interface, err))
+			continue
+		}
+		applied = append(applied, route)
+	}
+
+	if err := writeCustomRoutesState(applied); err != nil {
+		errs = append(errs, fmt.Errorf("failed to write %s: %w", customRoutesStateFile, err))
+	}
+	return errors.Join(errs...)
+}
+
+// ReconcileCustomRoutes re-adds the applied custom routes missing from the
+// routing table (i.e. flushed by the network manager), and returns them.
+func ReconcileCustomRoutes(ctx context.Context, config *cfg.Sections) []RouteRepair {
+	protoID := config.IPForwarding.EthernetProtoID
+
+	var res []RouteRepair
+	for _, route := range readCustomRoutesState() {
+		out := run.WithOutput(ctx, "ip", customRouteArgs("show", route, protoID)...)
+		if out.ExitCode != 0 || strings.TrimSpace(out.StdOut) != "" {
+			continue
+		}
+
+		logger.Warningf("Custom route to %s through %s is missing, re-adding it.", route.Destination, route.Interface)
+		if err := run.Quiet(ctx, "ip", customRouteArgs("replace", route, protoID)...); err != nil {
+			logger.Errorf("error adding route: %v", err)
+			continue
+		}
+
+		i := slices.IndexFunc(res, func(r RouteRepair) bool { return r.Interface == route.Interface })
+		if i < 0 {
+			res = append(res, RouteRepair{Interface: route.Interface, MAC: route.MAC})
+			i = len(res) - 1
+		}
+		res[i].Routes = append(res[i].Routes, route.Destination)
+	}
+	return res
+}
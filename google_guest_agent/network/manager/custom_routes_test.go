@@ -0,0 +1,174 @@
+//  Copyright 2024 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package manager
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNormalizeCustomRoute(t *testing.T) {
+	tests := []struct {
+		route   metadata.CustomRoute
+		want    string
+		wantErr bool
+	}{
+		{route: metadata.CustomRoute{Destination: "10.8.0.0/16", Via: "10.1.0.1"}, want: "10.8.0.0/16"},
+		{route: metadata.CustomRoute{Destination: "2600:1900::/32", Via: "fe80::1"}, want: "2600:1900::/32"},
+		{route: metadata.CustomRoute{Destination: "10.8.0.0/16"}, want: "10.8.0.0/16"},
+		{route: metadata.CustomRoute{Destination: "10.8.1.1/16"}, want: "10.8.0.0/16"},
+		{route: metadata.CustomRoute{Destination: "2600:1900:0:0::1/32"}, want: "2600:1900::/32"},
+		{route: metadata.CustomRoute{Destination: "::ffff:10.8.0.0/112", Via: "fe80::1"}, want: "::ffff:10.8.0.0/112"},
+		{route: metadata.CustomRoute{Destination: "10.8.0.0"}, wantErr: true},
+		{route: metadata.CustomRoute{Destination: "10.8.0.0/16", Via: "gateway"}, wantErr: true},
+		{route: metadata.CustomRoute{Destination: "10.8.0.0/16", Via: "fe80::1"}, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		got, err := normalizeCustomRoute(tc.route)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("normalizeCustomRoute(%+v) = %v, want error: %t", tc.route, err, tc.wantErr)
+		}
+		if got != tc.want {
+			t.Errorf("normalizeCustomRoute(%+v) = %q, want %q", tc.route, got, tc.want)
+		}
+	}
+}
+
+func TestCustomRouteArgs(t *testing.T) {
+	route := customRoute{Interface: "eth1", Destination: "10.8.0.0/16", Via: "10.1.0.1"}
+	want := []string{"-4", "route", "replace", "10.8.0.0/16", "via", "10.1.0.1", "dev", "eth1", "proto", "66"}
+	if diff := cmp.Diff(want, customRouteArgs("replace", route, "66")); diff != "" {
+		t.Errorf("customRouteArgs(replace) returned unexpected diff (-want +got):\n%s", diff)
+	}
+
+	route = customRoute{Interface: "eth1", Destination: "2600:1900::/32"}
+	want = []string{"-6", "route", "show", "exact", "2600:1900::/32", "dev", "eth1", "proto", "66"}
+	if diff := cmp.Diff(want, customRouteArgs("show", route, "66")); diff != "" {
+		t.Errorf("customRouteArgs(show) returned unexpected diff (-want +got):\n%s", diff)
+	}
+
+	// IPv4-mapped IPv6 destinations are IPv6 routes.
+	route = customRoute{Interface: "eth1", Destination: "::ffff:10.8.0.0/112"}
+	want = []string{"-6", "route", "del", "::ffff:10.8.0.0/112", "dev", "eth1", "proto", "66"}
+	if diff := cmp.Diff(want, customRouteArgs("del", route, "66")); diff != "" {
+		t.Errorf("customRouteArgs(del) returned unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestSetupCustomRoutes(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+	protoID := config.IPForwarding.EthernetProtoID
+
+	origRunner := run.Client
+	origStateFile := customRoutesStateFile
+	t.Cleanup(func() {
+		run.Client = origRunner
+		customRoutesStateFile = origStateFile
+	})
+	customRoutesStateFile = filepath.Join(t.TempDir(), "custom-routes.json")
+
+	stale := customRoute{Interface: "eth1", MAC: "b", Destination: "172.16.0.0/12"}
+	kept := customRoute{Interface: "eth1", MAC: "b", Destination: "10.8.0.0/16", Via: "10.1.0.1"}
+	if err := writeCustomRoutesState([]customRoute{stale, kept}); err != nil {
+		t.Fatalf("writeCustomRoutesState() failed unexpectedly with error: %v", err)
+	}
+
+	runner := &policyRoutingMockRunner{}
+	run.Client = runner
+
+	ifaces := []string{"eth0", "eth1", "eth2", "eth3", "invalid-e"}
+	routes := []metadata.CustomRoute{
+		{Destination: "10.8.0.0/16", Via: "10.1.0.1", NIC: 1},
+		{Destination: "10.9.0.0/16", NIC: 0},
+		{Destination: "10.10.0.0/16", NIC: 4},
+		{Destination: "10.11.0.0/16", NIC: 7},
+		{Destination: "bad", NIC: 1},
+	}
+	if err := setupCustomRoutes(context.Background(), config, policyRoutingNICs, ifaces, routes); err != nil {
+		t.Fatalf("setupCustomRoutes() failed unexpectedly with error: %v", err)
+	}
+
+	added := customRoute{Interface: "eth0", MAC: "a", Destination: "10.9.0.0/16"}
+	want := []string{
+		"ip -4 route del 172.16.0.0/12 dev eth1 proto " + protoID,
+		"ip -4 route replace 10.8.0.0/16 via 10.1.0.1 dev eth1 proto " + protoID,
+		"ip -4 route replace 10.9.0.0/16 dev eth0 proto " + protoID,
+	}
+	if diff := cmp.Diff(want, runner.commands); diff != "" {
+		t.Errorf("setupCustomRoutes() ran unexpected commands (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]customRoute{kept, added}, readCustomRoutesState()); diff != "" {
+		t.Errorf("setupCustomRoutes() recorded unexpected routes (-want +got):\n%s", diff)
+	}
+
+	// Removing the attribute removes the routes.
+	runner.commands = nil
+	if err := setupCustomRoutes(context.Background(), config, policyRoutingNICs, ifaces, nil); err != nil {
+		t.Fatalf("setupCustomRoutes() failed unexpectedly with error: %v", err)
+	}
+	if len(runner.commands) != 2 || len(readCustomRoutesState()) != 0 {
+		t.Errorf("setupCustomRoutes() ran %v and recorded %v without routes, want 2 deletions and none", runner.commands, readCustomRoutesState())
+	}
+}
+
+func TestReconcileCustomRoutes(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+
+	origRunner := run.Client
+	origStateFile := customRoutesStateFile
+	t.Cleanup(func() {
+		run.Client = origRunner
+		customRoutesStateFile = origStateFile
+	})
+	customRoutesStateFile = filepath.Join(t.TempDir(), "custom-routes.json")
+
+	applied := []customRoute{
+		{Interface: "eth1", MAC: "b", Destination: "10.8.0.0/16", Via: "10.1.0.1"},
+		{Interface: "eth1", MAC: "b", Destination: "10.9.0.0/16"},
+	}
+	if err := writeCustomRoutesState(applied); err != nil {
+		t.Fatalf("writeCustomRoutesState() failed unexpectedly with error: %v", err)
+	}
+
+	// The routes are present.
+	runner := &policyRoutingMockRunner{rules: "10.8.0.0/16 via 10.1.0.1 dev eth1 proto 66\n"}
+	run.Client = runner
+	if got := ReconcileCustomRoutes(context.Background(), config); len(got) != 0 || len(runner.commands) != 0 {
+		t.Errorf("ReconcileCustomRoutes() = %+v and ran %v with the routes present, want none", got, runner.commands)
+	}
+
+	// The routes are missing.
+	runner.rules = ""
+	want := []RouteRepair{{Interface: "eth1", MAC: "b", Routes: []string{"10.8.0.0/16", "10.9.0.0/16"}}}
+	if diff := cmp.Diff(want, ReconcileCustomRoutes(context.Background(), config)); diff != "" {
+		t.Errorf("ReconcileCustomRoutes() returned unexpected diff (-want +got):\n%s", diff)
+	}
+	if len(runner.commands) != 2 {
+		t.Errorf("ReconcileCustomRoutes() ran %v, want 2 route replacements", runner.commands)
+	}
+}
@@ -0,0 +1,119 @@
+//  Copyright 2024 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package manager
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+// desiredState is the network configuration the guest should have, derived
+// from the metadata and the interfaces present on the system. Network setup
+// brings the system to this state with the network manager service managing
+// the primary interface, and is skipped when the state was already applied
+// and the system still has it, see alreadyApplied.
+type desiredState struct {
+	// ethernet are the ethernet interfaces descriptors offered by metadata.
+	ethernet []metadata.NetworkInterfaces
+	// interfaces are the system names of the ethernet interfaces, in the
+	// metadata order.
+	interfaces []string
+	// vlans are the VLAN interfaces to set up, empty if VLAN setup is disabled.
+	vlans map[string]VlanInterface
+	// vlanErr is the reason the VLAN interfaces offered by metadata couldn't
+	// be read, reported when applying the state.
+	vlanErr string
+	// staticIPs are the static IP configurations offered by metadata.
+	staticIPs []metadata.StaticIPConfig
+	// customRoutes are the custom routes offered by metadata.
+	customRoutes []metadata.CustomRoute
+}
+
+// buildDesiredState derives the desired network state from the metadata
+// descriptor mds.
+func buildDesiredState(config *cfg.Sections, mds *metadata.Descriptor) (*desiredState, error) {
+	state := &desiredState{
+		ethernet:     mds.Instance.NetworkInterfaces,
+		vlans:        map[string]VlanInterface{},
+		staticIPs:    mds.Instance.Attributes.StaticIPConfig,
+		customRoutes: mds.Instance.Attributes.CustomRoutes,
+	}
+
+	interfaces, err := interfaceNames(config, state.ethernet)
+	if err != nil {
+		return nil, fmt.Errorf("error getting interface names: %v", err)
+	}
+	state.interfaces = interfaces
+
+	if config.NetworkInterfaces.VlanSetupEnabled {
+		nics := state.nics()
+		if err := reformatVlanNics(mds, nics, interfaces); err != nil {
+			state.vlanErr = err.Error()
+		}
+		state.vlans = nics.VlanInterfaces
+	}
+	return state, nil
+}
+
+// equal reports whether s and other describe the same network state.
+func (s *desiredState) equal(other *desiredState) bool {
+	if s == nil || other == nil {
+		return s == other
+	}
+	return reflect.DeepEqual(s, other)
+}
+
+// alreadyApplied reports whether state was applied by the last network setup
+// and the system still has it: the interfaces are read from the system when
+// building state, and the configuration files written by the last setup must
+// not have been changed since. Changed files are left alone if drift_reapply
+// is disabled.
+func alreadyApplied(config *cfg.Sections, state *desiredState) bool {
+	if !appliedState.equal(state) {
+		return false
+	}
+	if !config.NetworkInterfaces.DriftReapply {
+		return true
+	}
+	if files := ConfigDrift(); len(files) > 0 {
+		logger.Infof("Network configuration files %q were changed since the last setup, applying it again.", files)
+		return false
+	}
+	return true
+}
+
+// ethernetNics returns the ethernet interfaces of the state, without VLANs.
+func (s *desiredState) ethernetNics() *Interfaces {
+	return &Interfaces{
+		EthernetInterfaces: s.ethernet,
+		VlanInterfaces:     map[string]VlanInterface{},
+	}
+}
+
+// nics returns all interfaces of the state, including the VLANs.
+func (s *desiredState) nics() *Interfaces {
+	vlans := make(map[string]VlanInterface, len(s.vlans))
+	for id, vlan := range s.vlans {
+		vlans[id] = vlan
+	}
+	return &Interfaces{
+		EthernetInterfaces: s.ethernet,
+		VlanInterfaces:     vlans,
+	}
+}
@@ -0,0 +1,138 @@
+//  Copyright 2024 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package manager
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBuildDesiredState(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+
+	t.Cleanup(func() { netInterfaces = net.Interfaces })
+	netInterfaces = func() ([]net.Interface, error) {
+		return []net.Interface{
+			{Index: 2, Name: "eth0", HardwareAddr: net.HardwareAddr{0x42, 0x01, 0x0a, 0x00, 0x00, 0x02}},
+			{Index: 3, Name: "eth1", HardwareAddr: net.HardwareAddr{0x42, 0x01, 0x0a, 0x01, 0x00, 0x02}},
+		}, nil
+	}
+
+	mds := &metadata.Descriptor{}
+	mds.Instance.NetworkInterfaces = []metadata.NetworkInterfaces{{Mac: "42:01:0a:00:00:02"}, {Mac: "42:01:0a:01:00:02"}}
+	mds.Instance.VlanNetworkInterfaces = map[int]map[int]metadata.VlanInterface{1: {5: {Vlan: 5}}}
+	mds.Instance.Attributes.CustomRoutes = []metadata.CustomRoute{{Destination: "10.8.0.0/16", Via: "10.1.0.1", NIC: 1}}
+
+	state, err := buildDesiredState(config, mds)
+	if err != nil {
+		t.Fatalf("buildDesiredState() failed unexpectedly with error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"eth0", "eth1"}, state.interfaces); diff != "" {
+		t.Errorf("buildDesiredState() returned unexpected interfaces (-want +got):\n%s", diff)
+	}
+	if len(state.vlans) != 0 {
+		t.Errorf("buildDesiredState() returned VLANs %v with VLAN setup disabled, want none", state.vlans)
+	}
+
+	// The state doesn't change until the metadata does.
+	again, err := buildDesiredState(config, mds)
+	if err != nil {
+		t.Fatalf("buildDesiredState() failed unexpectedly with error: %v", err)
+	}
+	if !state.equal(again) {
+		t.Errorf("buildDesiredState() returned different states %+v and %+v for the same metadata", state, again)
+	}
+
+	config.NetworkInterfaces.VlanSetupEnabled = true
+	vlanState, err := buildDesiredState(config, mds)
+	if err != nil {
+		t.Fatalf("buildDesiredState() failed unexpectedly with error: %v", err)
+	}
+	want := map[string]VlanInterface{"1-5": {VlanInterface: metadata.VlanInterface{Vlan: 5}, ParentInterfaceID: "eth1"}}
+	if diff := cmp.Diff(want, vlanState.vlans); diff != "" {
+		t.Errorf("buildDesiredState() returned unexpected VLANs (-want +got):\n%s", diff)
+	}
+	if state.equal(vlanState) {
+		t.Errorf("desiredState.equal() = true for states with different VLANs, want false")
+	}
+	if got := vlanState.ethernetNics(); len(got.VlanInterfaces) != 0 {
+		t.Errorf("ethernetNics() returned VLANs %v, want none", got.VlanInterfaces)
+	}
+
+	// A VLAN of an unknown parent is reported when the state is applied.
+	mds.Instance.VlanNetworkInterfaces = map[int]map[int]metadata.VlanInterface{4: {5: {Vlan: 5}}}
+	vlanState, err = buildDesiredState(config, mds)
+	if err != nil {
+		t.Fatalf("buildDesiredState() failed unexpectedly with error: %v", err)
+	}
+	if vlanState.vlanErr == "" {
+		t.Errorf("buildDesiredState() returned no VLAN error for an unknown parent interface")
+	}
+
+	var applied *desiredState
+	if applied.equal(state) {
+		t.Errorf("desiredState.equal() = true against no applied state, want false")
+	}
+}
+
+func TestAlreadyApplied(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+	t.Cleanup(ForgetApplied)
+
+	path := filepath.Join(t.TempDir(), "ifcfg-eth1")
+	if err := os.WriteFile(path, []byte("agent"), 0644); err != nil {
+		t.Fatalf("os.WriteFile(%q) failed: %v", path, err)
+	}
+
+	state := &desiredState{interfaces: []string{"eth0", "eth1"}}
+	if alreadyApplied(config, state) {
+		t.Errorf("alreadyApplied() = true before any setup, want false")
+	}
+
+	appliedState = &desiredState{interfaces: []string{"eth0", "eth1"}}
+	recordAppliedFiles(config, &snapshotMockService{files: []string{path}}, &Interfaces{})
+	if !alreadyApplied(config, state) {
+		t.Errorf("alreadyApplied() = false for the applied state, want true")
+	}
+	if alreadyApplied(config, &desiredState{interfaces: []string{"eth0"}}) {
+		t.Errorf("alreadyApplied() = true for a different state, want false")
+	}
+
+	// The configuration files were changed by another tool.
+	if err := os.WriteFile(path, []byte("other tool"), 0644); err != nil {
+		t.Fatalf("os.WriteFile(%q) failed: %v", path, err)
+	}
+	if alreadyApplied(config, state) {
+		t.Errorf("alreadyApplied() = true with changed configuration files, want false")
+	}
+
+	config.NetworkInterfaces.DriftReapply = false
+	t.Cleanup(func() { config.NetworkInterfaces.DriftReapply = true })
+	if !alreadyApplied(config, state) {
+		t.Errorf("alreadyApplied() = false with changed configuration files and drift_reapply disabled, want true")
+	}
+}
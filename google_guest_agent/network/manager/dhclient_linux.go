@@ -23,12 +23,14 @@ import (
 	"path"
 	"regexp"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/ps"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
 	"github.com/GoogleCloudPlatform/guest-agent/utils"
 	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
 )
@@ -154,6 +156,10 @@ type ipVersion struct {
 // dhclient implements the manager.Service interface for dhclient use cases.
 type dhclient struct{}
 
+func init() {
+	registerService(50, &dhclient{})
+}
+
 // Name returns the name of the network manager service.
 func (n *dhclient) Name() string {
 	return "dhclient"
@@ -178,6 +184,15 @@ func (n *dhclient) IsManaging(ctx context.Context, iface string) (bool, error) {
 // SetupEthernetInterface sets up the non-primary interfaces with dhclient, having different setup procedures
 // for IPv6 network interfaces and IPv4 network interfaces.
 func (n *dhclient) SetupEthernetInterface(ctx context.Context, config *cfg.Sections, nics *Interfaces) error {
+	// dhclient doesn't persist any link configuration, set the MTU directly.
+	if err := setEthernetMTU(ctx, config, nics.EthernetInterfaces); err != nil {
+		logger.Errorf("Failed to set interfaces MTU: %v", err)
+	}
+
+	if err := setResolverDNS(ctx, config, nics.EthernetInterfaces); err != nil {
+		logger.Errorf("Failed to set interfaces DNS configuration: %v", err)
+	}
+
 	dhcpCommand := config.NetworkInterfaces.DHCPCommand
 	if dhcpCommand != "" {
 		tokens := strings.Split(dhcpCommand, " ")
@@ -185,8 +200,8 @@ func (n *dhclient) SetupEthernetInterface(ctx context.Context, config *cfg.Secti
 	}
 
 	// Get all interfaces separated by ipv4 and ipv6.
-	googleInterfaces, googleIpv6Interfaces := interfaceListsIpv4Ipv6(nics.EthernetInterfaces)
-	obtainIpv4Interfaces, obtainIpv6Interfaces, releaseIpv6Interfaces, err := partitionInterfaces(ctx, googleInterfaces, googleIpv6Interfaces)
+	googleInterfaces, googleIpv6Interfaces := interfaceListsIpv4Ipv6(config, nics.EthernetInterfaces)
+	obtainIpv4Interfaces, obtainIpv6Interfaces, releaseIpv6Interfaces, err := partitionInterfaces(ctx, config, googleInterfaces, googleIpv6Interfaces)
 	if err != nil {
 		return fmt.Errorf("error partitioning interfaces: %v", err)
 	}
@@ -198,8 +213,13 @@ func (n *dhclient) SetupEthernetInterface(ctx context.Context, config *cfg.Secti
 		}
 	}
 
-	// Setup IPV4.
+	// Setup IPV4, IPv6-only interfaces would never get a lease.
+	ipv6Only := ipv6OnlyInterfaces(config, nics.EthernetInterfaces)
 	for _, iface := range obtainIpv4Interfaces {
+		if slices.Contains(ipv6Only, iface) {
+			logger.Debugf("%s is IPv6-only, skipping IPv4 dhclient", iface)
+			continue
+		}
 		if err := runDhclient(ctx, ipv4, iface, false); err != nil {
 			logger.Errorf("failed to run dhclient: %+x", err)
 		}
@@ -234,11 +254,37 @@ func (n *dhclient) SetupEthernetInterface(ctx context.Context, config *cfg.Secti
 	return nil
 }
 
+// setEthernetMTU sets the MTU provided by the metadata descriptor on the managed
+// interfaces whose MTU doesn't match it yet.
+func setEthernetMTU(ctx context.Context, config *cfg.Sections, nics []metadata.NetworkInterfaces) error {
+	for i, ni := range nics {
+		if ni.MTU <= 0 || !shouldManageInterface(i == 0) {
+			continue
+		}
+
+		// The interfaces not found are already reported by interfaceNames.
+		iface, err := GetInterfaceByMAC(config, ni.Mac)
+		if err != nil {
+			continue
+		}
+
+		if iface.MTU == ni.MTU {
+			continue
+		}
+
+		logger.Infof("Setting %s MTU to %d", iface.Name, ni.MTU)
+		if err := run.Quiet(ctx, "ip", "link", "set", "dev", iface.Name, "mtu", strconv.Itoa(ni.MTU)); err != nil {
+			return fmt.Errorf("failed to set %s MTU: %w", iface.Name, err)
+		}
+	}
+	return nil
+}
+
 // SetupVlanInterface calls the appropriate native commands to configure a vlan interface.
 func (n *dhclient) SetupVlanInterface(ctx context.Context, config *cfg.Sections, nics *Interfaces) error {
 	logger.Debugf("vlans: %+v", nics.VlanInterfaces)
 
-	sysInterfaces, err := net.Interfaces()
+	sysInterfaces, err := netInterfaces()
 	if err != nil {
 		return fmt.Errorf("failed to list systems interfaces: %+v", err)
 	}
@@ -325,7 +371,7 @@ func (n *dhclient) SetupVlanInterface(ctx context.Context, config *cfg.Sections,
 }
 
 func (n *dhclient) removeVlanInterfaces(ctx context.Context, keepMe []string) error {
-	sysInterfaces, err := net.Interfaces()
+	sysInterfaces, err := netInterfaces()
 	if err != nil {
 		return fmt.Errorf("failed to list systems interfaces: %+v", err)
 	}
@@ -404,7 +450,7 @@ func runDhclient(ctx context.Context, ipVersion ipVersion, nic string, release b
 // It will skip primary NIC for IPv4 if process is already running or disabled via config.
 // Secondary NICs will be configured as long as there's no already existing dhclient
 // process managing it.
-func partitionInterfaces(ctx context.Context, interfaces, ipv6Interfaces []string) ([]string, []string, []string, error) {
+func partitionInterfaces(ctx context.Context, config *cfg.Sections, interfaces, ipv6Interfaces []string) ([]string, []string, []string, error) {
 	var obtainIpv4Interfaces []string
 	var obtainIpv6Interfaces []string
 	var releaseIpv6Interfaces []string
@@ -415,7 +461,7 @@ func partitionInterfaces(ctx context.Context, interfaces, ipv6Interfaces []strin
 			logger.Debugf("ManagePrimaryNIC is disabled, skipping dhclient launch for %s", iface)
 			continue
 		}
-		if isInvalid(iface) {
+		if isInvalid(config, iface) {
 			continue
 		}
 		// On 18.04 we fallback to dhclient as networkctl is very old and has not reload support for example.
@@ -483,7 +529,7 @@ func dhclientProcessExists(_ context.Context, iface string, ipVersion ipVersion)
 
 // anyDhclientProcessExists returns true if there's at-least one dhclient process
 // running for any of the known ethernet interfaces, regarless of Ipv4/Ipv6 stack.
-func anyDhclientProcessExists(nics *Interfaces) (bool, error) {
+func anyDhclientProcessExists(config *cfg.Sections, nics *Interfaces) (bool, error) {
 	processes, err := ps.Find(".*dhclient.*")
 	if err != nil {
 		return false, fmt.Errorf("error finding dhclient process: %v", err)
@@ -493,7 +539,7 @@ func anyDhclientProcessExists(nics *Interfaces) (bool, error) {
 		return false, nil
 	}
 
-	interfaces, err := interfaceNames(nics.EthernetInterfaces)
+	interfaces, err := interfaceNames(config, nics.EthernetInterfaces)
 	if err != nil {
 		return false, fmt.Errorf("error getting interface names: %v", err)
 	}
@@ -510,8 +556,8 @@ func anyDhclientProcessExists(nics *Interfaces) (bool, error) {
 }
 
 // Rollback releases all leases from DHClient, effectively undoing the dhclient configurations.
-func (n *dhclient) Rollback(ctx context.Context, nics *Interfaces) error {
-	if err := n.RollbackNics(ctx, nics); err != nil {
+func (n *dhclient) Rollback(ctx context.Context, config *cfg.Sections, nics *Interfaces) error {
+	if err := n.RollbackNics(ctx, config, nics); err != nil {
 		return fmt.Errorf("failed to rollback ethernet interfaces: %w", err)
 	}
 
@@ -522,7 +568,7 @@ func (n *dhclient) Rollback(ctx context.Context, nics *Interfaces) error {
 	// known ethernet interfaces). Simple dhclient existence does not prove this its managed by
 	// dhcliet as in case of Debian-12 we have dhclient but NICs are managed by netplan/networkd.
 
-	managed, err := anyDhclientProcessExists(nics)
+	managed, err := anyDhclientProcessExists(config, nics)
 	if err != nil {
 		return fmt.Errorf("unable to detect if nics are dhclient managed: %w", err)
 	}
@@ -541,14 +587,14 @@ func (n *dhclient) Rollback(ctx context.Context, nics *Interfaces) error {
 
 // Rollback releases all leases from DHClient, effectively undoing the dhclient
 // configurations - only regular nics are handled.
-func (n *dhclient) RollbackNics(ctx context.Context, nics *Interfaces) error {
+func (n *dhclient) RollbackNics(ctx context.Context, config *cfg.Sections, nics *Interfaces) error {
 	// Determine if we can even rollback dhclient processes.
 	if isInstalled, err := n.isDhclientInstalled(); !isInstalled || err != nil {
 		logger.Debugf("No preconditions met for dhclient roll back, skipping.")
 		return nil
 	}
 
-	googleInterfaces, googleIpv6Interfaces := interfaceListsIpv4Ipv6(nics.EthernetInterfaces)
+	googleInterfaces, googleIpv6Interfaces := interfaceListsIpv4Ipv6(config, nics.EthernetInterfaces)
 
 	// Release all the interface leases from dhclient.
 	for _, iface := range googleInterfaces {
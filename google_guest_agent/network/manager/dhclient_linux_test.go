@@ -138,6 +138,10 @@ type dhclientProcessOpts struct {
 // dhclientTestSetup sets up the test.
 func dhclientTestSetup(t *testing.T, opts dhclientTestOpts) {
 	t.Helper()
+	// The teardown restores the mocks, the runner is restored once the test
+	// finished.
+	origClient := run.Client
+	t.Cleanup(func() { run.Client = origClient })
 	if err := cfg.Load(nil); err != nil {
 		t.Fatalf("cfg.Load(nil) = %v, nil", err)
 	}
@@ -177,7 +181,6 @@ func dhclientTestSetup(t *testing.T, opts dhclientTestOpts) {
 func dhclientTestTearDown(t *testing.T) {
 	t.Helper()
 
-	run.Client = &run.Runner{}
 	osinfoGet = osinfo.Get
 	execLookPath = exec.LookPath
 	ps.Client = &ps.LinuxClient{}
@@ -253,6 +256,11 @@ func TestDhclientIsManaging(t *testing.T) {
 // TestPartitionInterfaces tests that partitionInterfaces behaves as expected given
 // a mock set of inputs.
 func TestPartitionInterfaces(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+
 	tests := []struct {
 		// name is the name of the test.
 		name string
@@ -335,7 +343,7 @@ func TestPartitionInterfaces(t *testing.T) {
 			}
 			dhclientTestSetup(t, opts)
 
-			obtainIpv4, obtainIpv6, releaseIpv6, err := partitionInterfaces(ctx, test.testInterfaces, test.testIpv6Interfaces)
+			obtainIpv4, obtainIpv6, releaseIpv6, err := partitionInterfaces(ctx, config, test.testInterfaces, test.testIpv6Interfaces)
 			if err != nil {
 				t.Fatalf("partitionInterfaces return error when none expected: %v", err)
 			}
@@ -517,6 +525,11 @@ func TestDhclientProcessExists(t *testing.T) {
 }
 
 func TestAnyDhclientProcessExists(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+
 	ifaces, err := net.Interfaces()
 	if err != nil {
 		t.Fatalf("net.Interfaces() failed unexpectedly with error: %v", err)
@@ -577,7 +590,7 @@ func TestAnyDhclientProcessExists(t *testing.T) {
 			dhclientTestSetup(t, opts)
 			t.Cleanup(func() { dhclientTestTearDown(t) })
 
-			got, err := anyDhclientProcessExists(nics)
+			got, err := anyDhclientProcessExists(config, nics)
 			if (err != nil) != test.wantErr {
 				t.Errorf("anyDhclientProcessExists(%+v) = %v, want error: %t", nics, err, test.wantErr)
 			}
@@ -587,3 +600,59 @@ func TestAnyDhclientProcessExists(t *testing.T) {
 		})
 	}
 }
+
+// TestSetEthernetMTU tests that setEthernetMTU() only changes the interfaces
+// whose MTU differs from the metadata.
+func TestSetEthernetMTU(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatalf("net.Interfaces() failed unexpectedly with error: %v", err)
+	}
+
+	var iface net.Interface
+	for _, curr := range ifaces {
+		if len(curr.HardwareAddr) > 0 {
+			iface = curr
+			break
+		}
+	}
+	if iface.Name == "" {
+		t.Skip("no interface with a MAC address found")
+	}
+
+	dhclientTestSetup(t, dhclientTestOpts{runErr: true})
+	defer dhclientTestTearDown(t)
+
+	// dhclientTestSetup() resets the configuration, load it afterwards.
+	if err := cfg.Load([]byte("[NetworkInterfaces]\nmanage_primary_nic = true\n")); err != nil {
+		t.Fatalf("cfg.Load() failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+	defer cfg.Load(nil)
+
+	tests := []struct {
+		name    string
+		mtu     int
+		wantErr bool
+	}{
+		{name: "unset", mtu: 0},
+		{name: "unchanged", mtu: iface.MTU},
+		{name: "changed", mtu: iface.MTU + 1, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			nics := []metadata.NetworkInterfaces{{Mac: iface.HardwareAddr.String(), MTU: tc.mtu}}
+			err := setEthernetMTU(context.Background(), config, nics)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("setEthernetMTU(ctx, %+v) = %v, want error: %t", nics, err, tc.wantErr)
+			}
+
+			// The mock runner fails with the command run as the error message.
+			want := fmt.Sprintf("ip link set dev %s mtu %d", iface.Name, tc.mtu)
+			if err != nil && !strings.Contains(err.Error(), want) {
+				t.Errorf("setEthernetMTU(ctx, %+v) = %v, want command %q", nics, err, want)
+			}
+		})
+	}
+}
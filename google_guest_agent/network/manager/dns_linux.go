@@ -0,0 +1,209 @@
+//  Copyright 2024 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+//go:build linux
+
+package manager
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// resolvConfEnd terminates the agent's block of resolv.conf, started by
+	// googleComment.
+	resolvConfEnd = "# End of Google Compute Engine Guest Agent configuration."
+)
+
+var (
+	// resolvConfFile is the resolver configuration file written when
+	// systemd-resolved is not running.
+	resolvConfFile = "/etc/resolv.conf"
+)
+
+// setResolverDNS applies the metadata DNS configuration for the network
+// managers without a per interface DNS configuration. The servers and domains
+// are set per link with resolvectl if systemd-resolved is running, otherwise
+// they're written to resolv.conf.
+func setResolverDNS(ctx context.Context, config *cfg.Sections, nics []metadata.NetworkInterfaces) error {
+	dnsMap := interfacesDNSMap(config, nics)
+
+	var ifaces []string
+	for i, ni := range nics {
+		if !shouldManageInterface(i == 0) {
+			continue
+		}
+		// The interfaces not found are already reported by interfacesDNSMap.
+		iface, err := GetInterfaceByMAC(config, ni.Mac)
+		if err != nil {
+			continue
+		}
+		if _, found := dnsMap[iface.Name]; found {
+			ifaces = append(ifaces, iface.Name)
+		}
+	}
+
+	// Without any DNS configuration only a previously written resolv.conf
+	// block has to be removed.
+	if len(ifaces) > 0 && resolvedActive(ctx) {
+		for _, iface := range ifaces {
+			if err := setResolvedDNS(ctx, iface, dnsMap[iface]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	changed, err := writeResolvConf(resolvConfFile, ifaces, dnsMap)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", resolvConfFile, err)
+	}
+	if changed {
+		logger.Infof("Updated the DNS configuration of %s", resolvConfFile)
+	}
+	return nil
+}
+
+// resolvedActive returns true if resolvectl is installed and systemd-resolved
+// is running.
+func resolvedActive(ctx context.Context) bool {
+	if exists, err := cliExists("resolvectl"); err != nil || !exists {
+		return false
+	}
+	return run.Quiet(ctx, "systemctl", "is-active", "systemd-resolved.service") == nil
+}
+
+// setResolvedDNS sets the DNS servers and search domains of iface with
+// resolvectl.
+func setResolvedDNS(ctx context.Context, iface string, dns interfaceDNS) error {
+	if len(dns.servers) > 0 {
+		args := append([]string{"dns", iface}, dns.servers...)
+		if err := run.Quiet(ctx, "resolvectl", args...); err != nil {
+			return fmt.Errorf("failed to set %s DNS servers: %w", iface, err)
+		}
+	}
+
+	if len(dns.domains) > 0 {
+		args := append([]string{"domain", iface}, dns.domains...)
+		if err := run.Quiet(ctx, "resolvectl", args...); err != nil {
+			return fmt.Errorf("failed to set %s DNS search domains: %w", iface, err)
+		}
+	}
+	return nil
+}
+
+// writeResolvConf replaces the agent's blocks of the resolv.conf file at path
+// with the servers and domains of ifaces, in order. The servers block is
+// placed first so its servers are queried first. The resolver only uses the
+// last search line, so the search block is placed last and merges the
+// domains with the ones of the file's own search line. The rest of the file
+// is kept as is. A symlinked file belongs to another resolver manager and is
+// never written through. It returns true if the file was changed.
+func writeResolvConf(path string, ifaces []string, dnsMap map[string]interfaceDNS) (bool, error) {
+	mode := os.FileMode(0644)
+	info, err := os.Lstat(path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if err == nil {
+		if info.Mode()&os.ModeSymlink != 0 {
+			if len(ifaces) == 0 {
+				return false, nil
+			}
+			return false, fmt.Errorf("%s is a symlink managed by another resolver, not writing through it", path)
+		}
+		mode = info.Mode().Perm()
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	// Drop the previous blocks, looking up the file's own search domains.
+	var kept, fileDomains []string
+	inBlock := false
+	for _, line := range strings.SplitAfter(string(content), "\n") {
+		switch strings.TrimSpace(line) {
+		case googleComment:
+			inBlock = true
+			continue
+		case resolvConfEnd:
+			inBlock = false
+			continue
+		}
+		if inBlock || line == "" {
+			continue
+		}
+		kept = append(kept, line)
+		if fields := strings.Fields(line); len(fields) > 0 && (fields[0] == "search" || fields[0] == "domain") {
+			fileDomains = fields[1:]
+		}
+	}
+
+	var servers, domains []string
+	for _, iface := range ifaces {
+		for _, server := range dnsMap[iface].servers {
+			if !slices.Contains(servers, server) {
+				servers = append(servers, server)
+			}
+		}
+		for _, domain := range dnsMap[iface].domains {
+			if !slices.Contains(domains, domain) {
+				domains = append(domains, domain)
+			}
+		}
+	}
+
+	var res strings.Builder
+	if len(servers) > 0 {
+		res.WriteString(googleComment + "\n")
+		for _, server := range servers {
+			res.WriteString("nameserver " + server + "\n")
+		}
+		res.WriteString(resolvConfEnd + "\n")
+	}
+	res.WriteString(strings.Join(kept, ""))
+	if len(domains) > 0 {
+		for _, domain := range fileDomains {
+			if !slices.Contains(domains, domain) {
+				domains = append(domains, domain)
+			}
+		}
+		if res.Len() > 0 && !strings.HasSuffix(res.String(), "\n") {
+			res.WriteString("\n")
+		}
+		res.WriteString(googleComment + "\n")
+		res.WriteString("search " + strings.Join(domains, " ") + "\n")
+		res.WriteString(resolvConfEnd + "\n")
+	}
+
+	if res.String() == string(content) {
+		return false, nil
+	}
+
+	if err := os.WriteFile(path, []byte(res.String()), mode); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,251 @@
+//  Copyright 2024 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+//go:build linux
+
+package manager
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWriteResolvConf(t *testing.T) {
+	dnsMap := map[string]interfaceDNS{
+		"eth0": {servers: []string{"10.0.0.53"}, domains: []string{"corp.internal"}},
+		"eth1": {servers: []string{"10.1.0.53", "10.0.0.53"}, domains: []string{"v1.internal"}},
+	}
+	block := googleComment + "\nnameserver 10.0.0.53\nnameserver 10.1.0.53\n" + resolvConfEnd + "\n"
+	search := googleComment + "\nsearch corp.internal v1.internal google.internal\n" + resolvConfEnd + "\n"
+	user := "nameserver 169.254.169.254\nsearch google.internal\n"
+
+	tests := []struct {
+		name        string
+		content     string
+		ifaces      []string
+		want        string
+		wantChanged bool
+	}{
+		{
+			name:        "add_block",
+			content:     user,
+			ifaces:      []string{"eth0", "eth1"},
+			want:        block + user + search,
+			wantChanged: true,
+		},
+		{
+			name:        "unchanged_block",
+			content:     block + user + search,
+			ifaces:      []string{"eth0", "eth1"},
+			want:        block + user + search,
+			wantChanged: false,
+		},
+		{
+			name:        "replace_block",
+			content:     googleComment + "\nnameserver 10.9.0.53\nsearch old.internal\n" + resolvConfEnd + "\n" + user,
+			ifaces:      []string{"eth0", "eth1"},
+			want:        block + user + search,
+			wantChanged: true,
+		},
+		{
+			name:        "remove_block",
+			content:     block + user + search,
+			want:        user,
+			wantChanged: true,
+		},
+		{
+			name:        "domain_line",
+			content:     "nameserver 169.254.169.254\ndomain c.project.internal",
+			ifaces:      []string{"eth0"},
+			want:        googleComment + "\nnameserver 10.0.0.53\n" + resolvConfEnd + "\nnameserver 169.254.169.254\ndomain c.project.internal\n" + googleComment + "\nsearch corp.internal c.project.internal\n" + resolvConfEnd + "\n",
+			wantChanged: true,
+		},
+		{
+			name:        "no_configuration",
+			content:     user,
+			want:        user,
+			wantChanged: false,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "resolv.conf")
+			if err := os.WriteFile(path, []byte(tc.content), 0644); err != nil {
+				t.Fatalf("os.WriteFile(%s) failed unexpectedly with error: %v", path, err)
+			}
+
+			changed, err := writeResolvConf(path, tc.ifaces, dnsMap)
+			if err != nil {
+				t.Fatalf("writeResolvConf(%s, %v) failed unexpectedly with error: %v", path, tc.ifaces, err)
+			}
+			if changed != tc.wantChanged {
+				t.Errorf("writeResolvConf(%s, %v) = %t, want %t", path, tc.ifaces, changed, tc.wantChanged)
+			}
+
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("os.ReadFile(%s) failed unexpectedly with error: %v", path, err)
+			}
+			if diff := cmp.Diff(tc.want, string(got)); diff != "" {
+				t.Errorf("writeResolvConf(%s, %v) wrote unexpected content (-want,+got):\n%s", path, tc.ifaces, diff)
+			}
+		})
+	}
+}
+
+func TestWriteResolvConfMissingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+
+	changed, err := writeResolvConf(path, nil, nil)
+	if err != nil {
+		t.Fatalf("writeResolvConf(%s) failed unexpectedly with error: %v", path, err)
+	}
+	if changed {
+		t.Errorf("writeResolvConf(%s) = true without any configuration, want false", path)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("writeResolvConf(%s) created the file without any configuration", path)
+	}
+}
+
+func TestWriteResolvConfSymlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "stub-resolv.conf")
+	content := "nameserver 127.0.0.53\n"
+	if err := os.WriteFile(target, []byte(content), 0644); err != nil {
+		t.Fatalf("os.WriteFile(%s) failed unexpectedly with error: %v", target, err)
+	}
+	path := filepath.Join(dir, "resolv.conf")
+	if err := os.Symlink(target, path); err != nil {
+		t.Fatalf("os.Symlink(%s, %s) failed unexpectedly with error: %v", target, path, err)
+	}
+
+	if changed, err := writeResolvConf(path, nil, nil); err != nil || changed {
+		t.Errorf("writeResolvConf(%s) = (%t, %v) without any configuration, want (false, nil)", path, changed, err)
+	}
+
+	dnsMap := map[string]interfaceDNS{"eth0": {servers: []string{"10.0.0.53"}}}
+	if _, err := writeResolvConf(path, []string{"eth0"}, dnsMap); err == nil {
+		t.Errorf("writeResolvConf(%s) succeeded with a symlinked file, want error", path)
+	}
+
+	got, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatalf("os.ReadFile(%s) failed unexpectedly with error: %v", target, err)
+	}
+	if string(got) != content {
+		t.Errorf("writeResolvConf(%s) wrote %q through the symlink, want %q kept", path, got, content)
+	}
+}
+
+// resolverMockService is a network manager service writing resolv.conf.
+type resolverMockService struct {
+	dryRunMockService
+}
+
+// SetupEthernetInterface implements the Service interface.
+func (n *resolverMockService) SetupEthernetInterface(ctx context.Context, config *cfg.Sections, nics *Interfaces) error {
+	return setResolverDNS(ctx, config, nil)
+}
+
+// withConfigRoot implements the dryRunner interface.
+func (n *resolverMockService) withConfigRoot(root string) (Service, []string) {
+	return n, nil
+}
+
+func TestDryRunResolvConf(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	data := googleComment + "\nnameserver 169.254.169.254\n" + resolvConfEnd + "\nnameserver 8.8.8.8\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("os.WriteFile(%s) failed unexpectedly with error: %v", path, err)
+	}
+
+	origRunner := run.Client
+	origResolvConfFile := resolvConfFile
+	prevKnownNetworkManagers := knownNetworkManagers
+	t.Cleanup(func() {
+		run.Client = origRunner
+		resolvConfFile = origResolvConfFile
+		knownNetworkManagers = prevKnownNetworkManagers
+	})
+	run.Client = &policyRoutingMockRunner{}
+	resolvConfFile = path
+	knownNetworkManagers = []Service{&resolverMockService{dryRunMockService{mockService: mockService{isManaging: true}}}}
+
+	mds := &metadata.Descriptor{}
+	mds.Instance.NetworkInterfaces = []metadata.NetworkInterfaces{{Mac: "invalid"}}
+
+	plan, err := DryRun(context.Background(), cfg.Get(), mds)
+	if err != nil {
+		t.Fatalf("DryRun() failed unexpectedly with error: %v", err)
+	}
+
+	want := "-" + googleComment + "\n-nameserver 169.254.169.254\n-" + resolvConfEnd + "\n nameserver 8.8.8.8\n"
+	if diff := cmp.Diff(map[string]string{path: want}, plan.Files); diff != "" {
+		t.Errorf("DryRun() returned unexpected files diff (-want +got):\n%s", diff)
+	}
+	if resolvConfFile != path {
+		t.Errorf("DryRun() left resolvConfFile set to %q, want %q", resolvConfFile, path)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("os.ReadFile(%s) failed unexpectedly with error: %v", path, err)
+	}
+	if string(got) != data {
+		t.Errorf("DryRun() changed %s to %q, want %q", path, got, data)
+	}
+}
+
+func TestSetResolvedDNS(t *testing.T) {
+	orig := run.Client
+	t.Cleanup(func() { run.Client = orig })
+	runner := &policyRoutingMockRunner{}
+	run.Client = runner
+
+	dns := interfaceDNS{servers: []string{"10.1.0.53", "2600:1900::53"}, domains: []string{"corp.internal"}}
+	if err := setResolvedDNS(context.Background(), "eth1", dns); err != nil {
+		t.Fatalf("setResolvedDNS(eth1, %+v) failed unexpectedly with error: %v", dns, err)
+	}
+
+	want := []string{
+		"resolvectl dns eth1 10.1.0.53 2600:1900::53",
+		"resolvectl domain eth1 corp.internal",
+	}
+	if diff := cmp.Diff(want, runner.commands); diff != "" {
+		t.Errorf("setResolvedDNS(eth1, %+v) ran unexpected commands (-want,+got):\n%s", dns, diff)
+	}
+}
+
+func TestInterfaceDNSServers(t *testing.T) {
+	dns := interfaceDNS{servers: []string{"10.0.0.53", "2600:1900::53", "10.1.0.53"}}
+
+	if diff := cmp.Diff([]string{"10.0.0.53", "10.1.0.53"}, dns.ipv4Servers()); diff != "" {
+		t.Errorf("ipv4Servers() returned unexpected diff (-want,+got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"2600:1900::53"}, dns.ipv6Servers()); diff != "" {
+		t.Errorf("ipv6Servers() returned unexpected diff (-want,+got):\n%s", diff)
+	}
+}
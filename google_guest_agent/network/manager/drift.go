@@ -0,0 +1,101 @@
+//  Copyright 2024 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package manager
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+var (
+	// appliedFiles are the checksums of the configuration files written by
+	// the network manager service on the last setup, by path. A nil checksum
+	// records a file that didn't exist.
+	appliedFiles map[string][]byte
+
+	// appliedFilesMu protects appliedFiles.
+	appliedFilesMu sync.Mutex
+)
+
+// fileChecksum returns the checksum of the file at path, nil if it doesn't
+// exist.
+func fileChecksum(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	return sum[:], nil
+}
+
+// recordAppliedFiles records the checksums of the configuration files written
+// by svc for nics, if svc has configuration files.
+func recordAppliedFiles(config *cfg.Sections, svc Service, nics *Interfaces) {
+	res := make(map[string][]byte)
+	if s, ok := svc.(configSnapshotter); ok {
+		for _, path := range s.configFiles(config, nics) {
+			sum, err := fileChecksum(path)
+			if err != nil {
+				logger.Warningf("Failed to read %s, its changes won't be detected: %v", path, err)
+				continue
+			}
+			res[path] = sum
+		}
+	}
+
+	appliedFilesMu.Lock()
+	defer appliedFilesMu.Unlock()
+	appliedFiles = res
+}
+
+// ConfigDrift returns the configuration files written by the agent on the last
+// network setup that were changed, created or removed since by another tool.
+func ConfigDrift() []string {
+	appliedFilesMu.Lock()
+	defer appliedFilesMu.Unlock()
+
+	var res []string
+	for path, want := range appliedFiles {
+		got, err := fileChecksum(path)
+		if err != nil {
+			logger.Debugf("Failed to read %s: %v", path, err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			res = append(res, path)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// ForgetApplied makes the next network setup apply the configuration again,
+// even if the network metadata didn't change.
+func ForgetApplied() {
+	appliedState = nil
+
+	appliedFilesMu.Lock()
+	defer appliedFilesMu.Unlock()
+	appliedFiles = nil
+}
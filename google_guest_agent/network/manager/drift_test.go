@@ -0,0 +1,78 @@
+//  Copyright 2024 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package manager
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestConfigDrift(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+
+	t.Cleanup(ForgetApplied)
+
+	dir := t.TempDir()
+	changed := filepath.Join(dir, "changed")
+	removed := filepath.Join(dir, "removed")
+	kept := filepath.Join(dir, "kept")
+	created := filepath.Join(dir, "created")
+	for _, path := range []string{changed, removed, kept} {
+		if err := os.WriteFile(path, []byte("agent"), 0644); err != nil {
+			t.Fatalf("os.WriteFile(%q) failed: %v", path, err)
+		}
+	}
+
+	svc := &snapshotMockService{files: []string{changed, removed, kept, created}}
+	recordAppliedFiles(config, svc, &Interfaces{})
+	if got := ConfigDrift(); len(got) != 0 {
+		t.Errorf("ConfigDrift() = %v right after recording, want none", got)
+	}
+
+	if err := os.WriteFile(changed, []byte("other tool"), 0644); err != nil {
+		t.Fatalf("os.WriteFile(%q) failed: %v", changed, err)
+	}
+	if err := os.Remove(removed); err != nil {
+		t.Fatalf("os.Remove(%q) failed: %v", removed, err)
+	}
+	if err := os.WriteFile(created, []byte("other tool"), 0644); err != nil {
+		t.Fatalf("os.WriteFile(%q) failed: %v", created, err)
+	}
+
+	want := []string{changed, created, removed}
+	if diff := cmp.Diff(want, ConfigDrift()); diff != "" {
+		t.Errorf("ConfigDrift() returned unexpected diff (-want +got):\n%s", diff)
+	}
+
+	// Forgetting the applied configuration makes the next setup apply it again.
+	appliedState = &desiredState{}
+	ForgetApplied()
+	if appliedState != nil || len(ConfigDrift()) != 0 {
+		t.Errorf("ForgetApplied() left applied state %v and drift %v, want none", appliedState, ConfigDrift())
+	}
+
+	// Services without configuration files never drift.
+	recordAppliedFiles(config, &mockService{}, &Interfaces{})
+	if got := ConfigDrift(); len(got) != 0 {
+		t.Errorf("ConfigDrift() = %v for a service without configuration files, want none", got)
+	}
+}
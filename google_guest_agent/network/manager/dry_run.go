@@ -0,0 +1,410 @@
+//  Copyright 2024 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package manager
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+var (
+	// dryRunQueries are the read-only commands querying the system's state,
+	// they are run during a dry run. A "*" matches any single argument, the
+	// command names are matched by base name.
+	dryRunQueries = []string{
+		"ethtool -l *",
+		"ip route",
+		"ip rule list",
+		"ip -4 route show exact * dev * proto *",
+		"ip -6 route show exact * dev * proto *",
+		"ip -6 -o a s dev * scope link tentative",
+		"iptables -t mangle -S FORWARD",
+		"ip6tables -t mangle -S FORWARD",
+		"networkctl --version",
+		"nmcli -t -f DEVICE,STATE dev status",
+		"sh -c *",
+		"systemctl is-active *",
+		"systemctl status *",
+		"wicked ifstatus * --brief",
+	}
+)
+
+// dryRunner is implemented by the network manager services whose
+// configuration directories can be redirected, so their configuration can be
+// computed without touching the system's.
+type dryRunner interface {
+	// withConfigRoot returns a copy of the service writing its configuration
+	// files under root, and the directories it redirects.
+	withConfigRoot(root string) (Service, []string)
+}
+
+// Plan describes the changes SetupInterfaces would make to the system.
+type Plan struct {
+	// Manager is the name of the network manager service.
+	Manager string
+
+	// Files are the line diffs of the configuration files that would change,
+	// by path.
+	Files map[string]string
+
+	// Commands are the commands that would be run, the queries excluded.
+	Commands []string
+}
+
+// dryRunClient records the commands instead of running them, only the
+// queries are run so the services see the system's state.
+type dryRunClient struct {
+	run.RunnerInterface
+
+	// commands are the recorded commands.
+	commands []string
+}
+
+// isDryRunQuery returns true if the command is one of dryRunQueries.
+func isDryRunQuery(name string, args []string) bool {
+	cmd := append([]string{filepath.Base(name)}, args...)
+	for _, query := range dryRunQueries {
+		pattern := strings.Fields(query)
+		if len(pattern) != len(cmd) {
+			continue
+		}
+		matches := true
+		for i, token := range pattern {
+			if token != "*" && token != cmd[i] {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+// skip returns whether the command must be recorded instead of run.
+func (c *dryRunClient) skip(name string, args []string) bool {
+	if isDryRunQuery(name, args) {
+		return false
+	}
+	c.commands = append(c.commands, strings.Join(append([]string{name}, args...), " "))
+	return true
+}
+
+// Quiet implements run.RunnerInterface.
+func (c *dryRunClient) Quiet(ctx context.Context, name string, args ...string) error {
+	if c.skip(name, args) {
+		return nil
+	}
+	return c.RunnerInterface.Quiet(ctx, name, args...)
+}
+
+// WithOutput implements run.RunnerInterface.
+func (c *dryRunClient) WithOutput(ctx context.Context, name string, args ...string) *run.Result {
+	if c.skip(name, args) {
+		return &run.Result{}
+	}
+	return c.RunnerInterface.WithOutput(ctx, name, args...)
+}
+
+// WithOutputTimeout implements run.RunnerInterface.
+func (c *dryRunClient) WithOutputTimeout(ctx context.Context, timeout time.Duration, name string, args ...string) *run.Result {
+	if c.skip(name, args) {
+		return &run.Result{}
+	}
+	return c.RunnerInterface.WithOutputTimeout(ctx, timeout, name, args...)
+}
+
+// WithCombinedOutput implements run.RunnerInterface.
+func (c *dryRunClient) WithCombinedOutput(ctx context.Context, name string, args ...string) *run.Result {
+	if c.skip(name, args) {
+		return &run.Result{}
+	}
+	return c.RunnerInterface.WithCombinedOutput(ctx, name, args...)
+}
+
+// DryRun computes the configuration files the network manager service would
+// write and the commands it would run to set up the interfaces described by
+// mds, without applying them. The static IP, bond and tuning settings are not
+// covered.
+func DryRun(ctx context.Context, config *cfg.Sections, mds *metadata.Descriptor) (*Plan, error) {
+	if !config.NetworkInterfaces.Setup {
+		return nil, fmt.Errorf("network interface setup is disabled")
+	}
+
+	state, err := buildDesiredState(config, mds)
+	if err != nil {
+		return nil, err
+	}
+
+	activeService, err := detectNetworkManager(ctx, state.interfaces[0])
+	if err != nil {
+		return nil, fmt.Errorf("error detecting network manager service: %v", err)
+	}
+	activeService.manager.Configure(ctx, config)
+
+	dr, ok := activeService.manager.(dryRunner)
+	if !ok {
+		return nil, fmt.Errorf("dry run is not supported by %s", activeService.manager.Name())
+	}
+
+	root, err := os.MkdirTemp("", "google-guest-agent-dry-run")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dry run directory: %w", err)
+	}
+	defer os.RemoveAll(root)
+
+	svc, dirs := dr.withConfigRoot(root)
+	for _, dir := range dirs {
+		if err := copyDir(dir, filepath.Join(root, dir)); err != nil {
+			return nil, err
+		}
+	}
+
+	// The system files written outside of the configuration directories are
+	// redirected under root too.
+	files := dryRunFiles()
+	origFiles := make([]string, len(files))
+	for i, file := range files {
+		origFiles[i] = *file
+		shadow := filepath.Join(root, *file)
+		if err := copyFile(*file, shadow); err != nil {
+			return nil, err
+		}
+		*file = shadow
+	}
+	defer func() {
+		for i, file := range files {
+			*file = origFiles[i]
+		}
+	}()
+
+	client := &dryRunClient{RunnerInterface: run.Client}
+	origClient := run.Client
+	run.Client = client
+	defer func() { run.Client = origClient }()
+
+	if err := svc.SetupEthernetInterface(ctx, config, state.ethernetNics()); err != nil {
+		return nil, fmt.Errorf("manager(%s): error setting up ethernet interfaces: %v", svc.Name(), err)
+	}
+
+	if err := setupPolicyRouting(ctx, config, state.ethernet, state.interfaces); err != nil {
+		logger.Errorf("Failed to set up source-based policy routing: %v", err)
+	}
+
+	if err := setupVlans(ctx, config, svc, state); err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{Manager: svc.Name(), Files: make(map[string]string), Commands: client.commands}
+	for _, dir := range dirs {
+		if err := diffDir(dir, filepath.Join(root, dir), plan.Files); err != nil {
+			return nil, err
+		}
+	}
+	for i, file := range files {
+		if err := diffFile(origFiles[i], *file, plan.Files); err != nil {
+			return nil, err
+		}
+	}
+	return plan, nil
+}
+
+// copyFile copies the file src to dst if it exists, the parent directories of
+// dst are created.
+func copyFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("failed to create %q: %w", filepath.Dir(dst), err)
+	}
+	data, err := os.ReadFile(src)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %q: %w", src, err)
+	}
+	return os.WriteFile(dst, data, 0644)
+}
+
+// diffFile adds the line diff of path to res if it was changed in shadow.
+func diffFile(path, shadow string, res map[string]string) error {
+	current, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read %q: %w", path, err)
+	}
+	planned, err := os.ReadFile(shadow)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read %q: %w", shadow, err)
+	}
+	if string(current) != string(planned) {
+		res[path] = lineDiff(string(current), string(planned))
+	}
+	return nil
+}
+
+// copyDir copies the regular files of src to dst, dst is created even if src
+// doesn't exist.
+func copyDir(src, dst string) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return fmt.Errorf("failed to create %q: %w", dst, err)
+	}
+
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, data, info.Mode().Perm())
+	})
+}
+
+// readDir returns the content of the regular files in dir, by path relative
+// to dir.
+func readDir(dir string) (map[string]string, error) {
+	res := make(map[string]string)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		res[rel] = string(data)
+		return nil
+	})
+	return res, err
+}
+
+// diffDir adds the line diffs of the files of dir changed in shadow to res,
+// by path in dir.
+func diffDir(dir, shadow string, res map[string]string) error {
+	current, err := readDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read %q: %w", dir, err)
+	}
+	planned, err := readDir(shadow)
+	if err != nil {
+		return fmt.Errorf("failed to read %q: %w", shadow, err)
+	}
+
+	for rel, data := range planned {
+		if current[rel] != data {
+			res[filepath.Join(dir, rel)] = lineDiff(current[rel], data)
+		}
+	}
+	for rel, data := range current {
+		if _, found := planned[rel]; !found {
+			res[filepath.Join(dir, rel)] = lineDiff(data, "")
+		}
+	}
+	return nil
+}
+
+// splitLines splits s in lines, an empty s has none.
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// lineDiff returns the lines of old and new prefixed with "-" if removed,
+// "+" if added, or " " if kept, following their longest common subsequence.
+func lineDiff(old, new string) string {
+	a, b := splitLines(old), splitLines(new)
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var res strings.Builder
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			fmt.Fprintf(&res, " %s\n", a[i])
+			i, j = i+1, j+1
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			fmt.Fprintf(&res, "-%s\n", a[i])
+			i++
+		default:
+			fmt.Fprintf(&res, "+%s\n", b[j])
+			j++
+		}
+	}
+	return res.String()
+}
+
+// SortedFiles returns the paths of the files changed by p, sorted.
+func (p *Plan) SortedFiles() []string {
+	var res []string
+	for path := range p.Files {
+		res = append(res, path)
+	}
+	sort.Strings(res)
+	return res
+}
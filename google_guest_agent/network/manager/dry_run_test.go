@@ -0,0 +1,174 @@
+//  Copyright 2024 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package manager
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/google/go-cmp/cmp"
+)
+
+// dryRunMockService is a network manager service writing its configuration
+// files in configDir.
+type dryRunMockService struct {
+	mockService
+	configDir string
+}
+
+// SetupEthernetInterface implements the Service interface.
+func (n *dryRunMockService) SetupEthernetInterface(ctx context.Context, config *cfg.Sections, nics *Interfaces) error {
+	if err := os.Remove(filepath.Join(n.configDir, "old.conf")); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(n.configDir, "eth1.conf"), []byte("[Match]\nName=eth1\nMTU=1500\n"), 0644); err != nil {
+		return err
+	}
+	return run.Quiet(ctx, "networkctl", "reload")
+}
+
+// withConfigRoot implements the dryRunner interface.
+func (n *dryRunMockService) withConfigRoot(root string) (Service, []string) {
+	res := *n
+	res.configDir = filepath.Join(root, n.configDir)
+	return &res, []string{n.configDir}
+}
+
+func TestLineDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new string
+		want     string
+	}{
+		{
+			name: "new_file",
+			new:  "a\nb\n",
+			want: "+a\n+b\n",
+		},
+		{
+			name: "removed_file",
+			old:  "a\n",
+			want: "-a\n",
+		},
+		{
+			name: "changed_line",
+			old:  "a\nb\nc\n",
+			new:  "a\nB\nc\nd\n",
+			want: " a\n-b\n+B\n c\n+d\n",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := lineDiff(tc.old, tc.new); got != tc.want {
+				t.Errorf("lineDiff(%q, %q) = %q, want %q", tc.old, tc.new, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDryRunClient(t *testing.T) {
+	runner := &policyRoutingMockRunner{}
+	client := &dryRunClient{RunnerInterface: runner}
+	ctx := context.Background()
+
+	if err := client.Quiet(ctx, "systemctl", "is-active", "systemd-networkd.service"); err != nil {
+		t.Errorf("Quiet(systemctl is-active) failed unexpectedly with error: %v", err)
+	}
+	if err := client.Quiet(ctx, "ip", "link", "set", "eth1", "up"); err != nil {
+		t.Errorf("Quiet(ip link set) failed unexpectedly with error: %v", err)
+	}
+	client.WithOutput(ctx, "ip", "rule", "list")
+	// Arguments of a query don't make a command read-only.
+	client.WithOutput(ctx, "ip", "route", "flush", "table", "list")
+
+	if diff := cmp.Diff([]string{"systemctl is-active systemd-networkd.service"}, runner.commands); diff != "" {
+		t.Errorf("dryRunClient ran unexpected commands (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"ip link set eth1 up", "ip route flush table list"}, client.commands); diff != "" {
+		t.Errorf("dryRunClient recorded unexpected commands (-want +got):\n%s", diff)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+
+	configDir := filepath.Join(t.TempDir(), "network")
+	if err := os.MkdirAll(configDir, 0755); err != nil {
+		t.Fatalf("os.MkdirAll(%s) failed unexpectedly with error: %v", configDir, err)
+	}
+	files := map[string]string{
+		"eth1.conf": "[Match]\nName=eth1\n",
+		"old.conf":  "[Match]\nName=eth9\n",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(configDir, name), []byte(data), 0644); err != nil {
+			t.Fatalf("os.WriteFile(%s) failed unexpectedly with error: %v", name, err)
+		}
+	}
+
+	origRunner := run.Client
+	prevKnownNetworkManagers := knownNetworkManagers
+	t.Cleanup(func() {
+		run.Client = origRunner
+		knownNetworkManagers = prevKnownNetworkManagers
+	})
+	run.Client = &policyRoutingMockRunner{}
+	knownNetworkManagers = []Service{&dryRunMockService{mockService: mockService{isManaging: true}, configDir: configDir}}
+
+	mds := &metadata.Descriptor{}
+	mds.Instance.NetworkInterfaces = []metadata.NetworkInterfaces{{Mac: "invalid"}}
+
+	plan, err := DryRun(context.Background(), config, mds)
+	if err != nil {
+		t.Fatalf("DryRun() failed unexpectedly with error: %v", err)
+	}
+
+	want := &Plan{
+		Manager: "service",
+		Files: map[string]string{
+			filepath.Join(configDir, "eth1.conf"): " [Match]\n Name=eth1\n+MTU=1500\n",
+			filepath.Join(configDir, "old.conf"):  "-[Match]\n-Name=eth9\n",
+		},
+		Commands: []string{"networkctl reload"},
+	}
+	if diff := cmp.Diff(want, plan); diff != "" {
+		t.Errorf("DryRun() returned unexpected diff (-want +got):\n%s", diff)
+	}
+
+	// The system's configuration is left untouched.
+	for name, data := range files {
+		got, err := os.ReadFile(filepath.Join(configDir, name))
+		if err != nil {
+			t.Fatalf("os.ReadFile(%s) failed unexpectedly with error: %v", name, err)
+		}
+		if string(got) != data {
+			t.Errorf("DryRun() changed %s to %q, want %q", name, got, data)
+		}
+	}
+
+	knownNetworkManagers = []Service{&mockService{isManaging: true}}
+	if _, err := DryRun(context.Background(), config, mds); err == nil {
+		t.Errorf("DryRun() succeeded with a service not supporting dry runs, want error")
+	}
+}
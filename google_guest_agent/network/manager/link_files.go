@@ -0,0 +1,155 @@
+//  Copyright 2024 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// linkFilePriority is the file name prefix of the link files, taking
+	// precedence over the distributions' naming policies.
+	linkFilePriority = 10
+)
+
+// linkFileRegex matches the link files written by the agent.
+var linkFileRegex = regexp.MustCompile(`^[0-9]+-(.+)-google-guest-agent\.link$`)
+
+// udevLinkConfig is a systemd .link file, naming the interface with the
+// matching MAC address whatever the devices enumeration order is.
+type udevLinkConfig struct {
+	// GuestAgent is the guest agent section containing agent-derived config.
+	GuestAgent guestAgentSection
+
+	// Match is the systemd config's Match section.
+	Match udevLinkMatchConfig
+
+	// Link is the systemd config's Link section.
+	Link udevLinkNameConfig
+}
+
+// udevLinkMatchConfig is the [Match] section of a .link file.
+type udevLinkMatchConfig struct {
+	// MACAddress is the address of the named interface.
+	MACAddress string
+
+	// Type restricts the match to the ethernet devices, leaving out the
+	// VLAN interfaces sharing their parent's address.
+	Type string
+}
+
+// udevLinkNameConfig is the [Link] section of a .link file.
+type udevLinkNameConfig struct {
+	// Name is the name given to the interface.
+	Name string
+}
+
+// linkFile returns the path of the link file naming iface.
+func linkFile(dir, iface string) string {
+	return filepath.Join(dir, fmt.Sprintf("%d-%s-google-guest-agent.link", linkFilePriority, iface))
+}
+
+// wantLinkFiles returns the link files pinning the current name of each
+// metadata NIC to its MAC address, by path.
+func wantLinkFiles(dir string, nics []metadata.NetworkInterfaces, ifaces []string) map[string]udevLinkConfig {
+	res := make(map[string]udevLinkConfig)
+	for i, ni := range nics {
+		// The static interfaces are named too, so isInvalid() is not used.
+		if strings.HasPrefix(ifaces[i], "invalid-") {
+			continue
+		}
+		res[linkFile(dir, ifaces[i])] = udevLinkConfig{
+			GuestAgent: guestAgentSection{ManagedByGuestAgent: true},
+			Match:      udevLinkMatchConfig{MACAddress: ni.Mac, Type: "ether"},
+			Link:       udevLinkNameConfig{Name: ifaces[i]},
+		}
+	}
+	return res
+}
+
+// setupLinkFiles writes the link files giving the metadata NICs stable names
+// across reboots when enabled, and removes the ones of detached NICs. udev
+// applies them when the devices are added, i.e. at the next boot or hot-plug.
+func setupLinkFiles(ctx context.Context, config *cfg.Sections, nics []metadata.NetworkInterfaces, ifaces []string) error {
+	dir := config.Unstable.SystemdConfigDir
+	wanted := make(map[string]udevLinkConfig)
+	if config.NetworkInterfaces.StableInterfaceNames {
+		wanted = wantLinkFiles(dir, nics, ifaces)
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read content from %s: %w", dir, err)
+	}
+
+	var errs []error
+	changed := false
+
+	for _, file := range files {
+		if file.IsDir() || !linkFileRegex.MatchString(file.Name()) {
+			continue
+		}
+
+		filePath := filepath.Join(dir, file.Name())
+		if _, found := wanted[filePath]; found {
+			continue
+		}
+
+		var link udevLinkConfig
+		if err := readIniFile(filePath, &link); err != nil || !link.GuestAgent.ManagedByGuestAgent {
+			continue
+		}
+
+		logger.Infof("Removing link file %s", filePath)
+		if err := os.Remove(filePath); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove link file %s: %w", filePath, err))
+			continue
+		}
+		changed = true
+	}
+
+	for filePath, link := range wanted {
+		var curr udevLinkConfig
+		if err := readIniFile(filePath, &curr); err == nil && reflect.DeepEqual(curr, link) {
+			continue
+		}
+
+		logger.Infof("Writing link file %s naming %s", filePath, link.Link.Name)
+		if err := writeIniFile(filePath, &link); err != nil {
+			errs = append(errs, fmt.Errorf("failed to write link file %s: %w", filePath, err))
+			continue
+		}
+		changed = true
+	}
+
+	if changed {
+		if err := run.Quiet(ctx, "udevadm", "control", "--reload"); err != nil {
+			errs = append(errs, fmt.Errorf("failed to reload udev rules: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,99 @@
+//  Copyright 2024 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package manager
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+)
+
+func TestSetupLinkFiles(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+	config.Unstable.SystemdConfigDir = t.TempDir()
+	config.NetworkInterfaces.StableInterfaceNames = true
+
+	oldClient := run.Client
+	t.Cleanup(func() { run.Client = oldClient })
+	runner := &policyRoutingMockRunner{}
+	run.Client = runner
+
+	dir := config.Unstable.SystemdConfigDir
+	detached := linkFile(dir, "eth3")
+	if err := writeIniFile(detached, &udevLinkConfig{GuestAgent: guestAgentSection{ManagedByGuestAgent: true}}); err != nil {
+		t.Fatalf("writeIniFile(%q) failed: %v", detached, err)
+	}
+	userFile := filepath.Join(dir, "10-eth4-google-guest-agent.link")
+	if err := os.WriteFile(userFile, []byte("[Link]\nName=eth4\n"), 0644); err != nil {
+		t.Fatalf("os.WriteFile(%q) failed: %v", userFile, err)
+	}
+
+	nics := []metadata.NetworkInterfaces{{Mac: "42:01:0a:00:00:02"}, {Mac: "42:01:0a:01:00:02"}, {Mac: "bad"}}
+	ifaces := []string{"eth0", "eth1", "invalid-bad"}
+	ctx := context.Background()
+	if err := setupLinkFiles(ctx, config, nics, ifaces); err != nil {
+		t.Fatalf("setupLinkFiles() failed: %v", err)
+	}
+
+	for i, iface := range ifaces[:2] {
+		var got udevLinkConfig
+		if err := readIniFile(linkFile(dir, iface), &got); err != nil {
+			t.Fatalf("readIniFile(%q) failed: %v", linkFile(dir, iface), err)
+		}
+		if got.Match.MACAddress != nics[i].Mac || got.Match.Type != "ether" || got.Link.Name != iface {
+			t.Errorf("link file of %s = %+v, want MAC %s and name %s", iface, got, nics[i].Mac, iface)
+		}
+	}
+	if _, err := os.Stat(linkFile(dir, "invalid-bad")); !os.IsNotExist(err) {
+		t.Errorf("link file of invalid interface exists, want not written")
+	}
+	if _, err := os.Stat(detached); !os.IsNotExist(err) {
+		t.Errorf("link file of detached NIC %q exists, want removed", detached)
+	}
+	if _, err := os.Stat(userFile); err != nil {
+		t.Errorf("link file %q not written by the agent was removed: %v", userFile, err)
+	}
+	if len(runner.commands) != 1 || runner.commands[0] != "udevadm control --reload" {
+		t.Errorf("setupLinkFiles() ran %v, want [udevadm control --reload]", runner.commands)
+	}
+
+	// Nothing changes on a second run, udev is not reloaded.
+	runner.commands = nil
+	if err := setupLinkFiles(ctx, config, nics, ifaces); err != nil {
+		t.Fatalf("setupLinkFiles() failed: %v", err)
+	}
+	if len(runner.commands) != 0 {
+		t.Errorf("setupLinkFiles() ran %v on unchanged link files, want none", runner.commands)
+	}
+
+	// Disabling removes all the agent's link files.
+	config.NetworkInterfaces.StableInterfaceNames = false
+	if err := setupLinkFiles(ctx, config, nics, ifaces); err != nil {
+		t.Fatalf("setupLinkFiles() failed: %v", err)
+	}
+	for _, iface := range ifaces[:2] {
+		if _, err := os.Stat(linkFile(dir, iface)); !os.IsNotExist(err) {
+			t.Errorf("link file of %s exists after disabling, want removed", iface)
+		}
+	}
+}
@@ -18,10 +18,10 @@ package manager
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"net"
 	"os"
-	"reflect"
+	"sort"
 	"time"
 
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
@@ -53,10 +53,10 @@ type Service interface {
 	SetupVlanInterface(ctx context.Context, config *cfg.Sections, nics *Interfaces) error
 
 	// Rollback rolls back the changes created in Setup.
-	Rollback(ctx context.Context, nics *Interfaces) error
+	Rollback(ctx context.Context, config *cfg.Sections, nics *Interfaces) error
 
 	// RollbackNics rolls back only changes to regular nics (vlan nics are not handled).
-	RollbackNics(ctx context.Context, nics *Interfaces) error
+	RollbackNics(ctx context.Context, config *cfg.Sections, nics *Interfaces) error
 }
 
 // serviceStatus is an internal wrapper of a service implementation and its status.
@@ -123,18 +123,49 @@ const (
 var (
 	// knownNetworkManagers contains the list of known network managers. This is
 	// used to determine the network manager service that is managing the primary
-	// network interface.
+	// network interface. It's kept ordered by registration priority, see
+	// [registerService].
 	knownNetworkManagers []Service
 
+	// registeredServices are the network manager services registered by their
+	// implementations along with their detection priority.
+	registeredServices []registeredService
+
 	// osinfoGet points to the function to use for getting osInfo.
 	// Primarily used for testing.
 	osinfoGet = osinfo.Get
 
-	// seenMetadata keeps a copy of MDS descriptor that was already seen and applied
-	// in terms of VLAN/Ethernet NIC configuration by the manager.
-	seenMetadata *metadata.Descriptor
+	// appliedState keeps a copy of the desired network state that was last
+	// applied by the manager, only the desired state is memoized: the actual
+	// state is read by alreadyApplied.
+	appliedState *desiredState
 )
 
+// registeredService is a network manager service known to the manager.
+type registeredService struct {
+	// priority is the detection priority of the service, lower is probed first.
+	priority int
+	// svc is the network manager service implementation.
+	svc Service
+}
+
+// registerService makes svc known to the manager. Services are probed for the
+// primary network interface in ascending priority order, services with the same
+// priority in registration order. Implementations register themselves from an
+// init function so supporting a new network manager doesn't require changes
+// to the manager itself.
+func registerService(priority int, svc Service) {
+	registeredServices = append(registeredServices, registeredService{priority: priority, svc: svc})
+	sort.SliceStable(registeredServices, func(i, j int) bool {
+		return registeredServices[i].priority < registeredServices[j].priority
+	})
+
+	knownNetworkManagers = make([]Service, 0, len(registeredServices))
+	for _, curr := range registeredServices {
+		knownNetworkManagers = append(knownNetworkManagers, curr.svc)
+	}
+}
+
 // detectNetworkManager detects the network manager managing the primary network interface.
 // This network manager will be used to set up primary and secondary network interfaces.
 func detectNetworkManager(ctx context.Context, iface string) (*serviceStatus, error) {
@@ -174,32 +205,22 @@ func reformatVlanNics(mds *metadata.Descriptor, nics *Interfaces, ethernetInterf
 // interface if enabled in the configuration using the native network manager service detected
 // to be managing the primary network interface.
 func SetupInterfaces(ctx context.Context, config *cfg.Sections, mds *metadata.Descriptor) error {
-	if seenMetadata != nil {
-		diff := reflect.DeepEqual(mds.Instance.NetworkInterfaces, seenMetadata.Instance.NetworkInterfaces) &&
-			reflect.DeepEqual(mds.Instance.VlanNetworkInterfaces, seenMetadata.Instance.VlanNetworkInterfaces)
-
-		if diff {
-			logger.Debugf("MDS returned Ethernet NICs [%+v] and VLAN NICs [%+v] are already seen and applied, skipping", seenMetadata.Instance.NetworkInterfaces, seenMetadata.Instance.VlanNetworkInterfaces)
-			return nil
-		}
-	}
-
 	// User may have disabled network interface setup entirely.
 	if !config.NetworkInterfaces.Setup {
 		logger.Infof("Network interface setup disabled, skipping...")
 		return nil
 	}
 
-	nics := &Interfaces{
-		EthernetInterfaces: mds.Instance.NetworkInterfaces,
-		VlanInterfaces:     map[string]VlanInterface{},
+	state, err := buildDesiredState(config, mds)
+	if err != nil {
+		return err
 	}
 
-	interfaces, err := interfaceNames(nics.EthernetInterfaces)
-	if err != nil {
-		return fmt.Errorf("error getting interface names: %v", err)
+	if alreadyApplied(config, state) {
+		logger.Debugf("Desired Ethernet NICs [%+v] and VLAN NICs [%+v] are already applied, skipping", state.ethernet, state.vlans)
+		return nil
 	}
-	primaryInterface := interfaces[0]
+	primaryInterface := state.interfaces[0]
 
 	// Get the network manager.
 	activeService, err := detectNetworkManager(ctx, primaryInterface)
@@ -218,7 +239,7 @@ func SetupInterfaces(ctx context.Context, config *cfg.Sections, mds *metadata.De
 		}
 
 		logger.Infof("Rolling back %s", svc.Name())
-		if err = svc.Rollback(ctx, nics); err != nil {
+		if err = svc.Rollback(ctx, config, state.ethernetNics()); err != nil {
 			logger.Warningf("Unable to roll back config for %s: %v", svc.Name(), err)
 		}
 	}
@@ -227,20 +248,27 @@ func SetupInterfaces(ctx context.Context, config *cfg.Sections, mds *metadata.De
 
 	activeService.manager.Configure(ctx, config)
 
-	logger.Infof("Setting up %s", activeService.manager.Name())
-	if err = activeService.manager.SetupEthernetInterface(ctx, config, nics); err != nil {
-		return fmt.Errorf("manager(%s): error setting up ethernet interfaces: %v", activeService.manager.Name(), err)
+	if err := setupLinkFiles(ctx, config, state.ethernet, state.interfaces); err != nil {
+		logger.Errorf("Failed to set up stable interface names: %v", err)
 	}
 
-	if config.NetworkInterfaces.VlanSetupEnabled {
-		logger.Infof("VLAN setup is enabled via config file, setting up interfaces")
-		if err := reformatVlanNics(mds, nics, interfaces); err != nil {
-			return fmt.Errorf("unable to read vlans, invalid format: %w", err)
-		}
-		if err = activeService.manager.SetupVlanInterface(ctx, config, nics); err != nil {
-			return fmt.Errorf("manager(%s): error setting up vlan interfaces: %v", activeService.manager.Name(), err)
-		}
+	// The configuration files of the VLAN interfaces are snapshotted too,
+	// a reformat error is reported when applying.
+	nics := state.nics()
+	tx := beginTransaction(ctx, config, activeService.manager, nics, nics)
+	err = tx.commit(ctx, func() error {
+		return applyInterfaces(ctx, config, activeService.manager, state)
+	})
+	if errors.Is(err, errConnectivityLost) {
+		// Don't apply the same configuration again until it changes, the
+		// rolled back files are the ones it's compared to.
+		appliedState = state
+		recordAppliedFiles(config, activeService.manager, nics)
+	}
+	if err != nil {
+		return err
 	}
+	recordAppliedFiles(config, activeService.manager, nics)
 
 	logger.Infof("Finished setting up %s", activeService.manager.Name())
 
@@ -251,7 +279,60 @@ func SetupInterfaces(ctx context.Context, config *cfg.Sections, mds *metadata.De
 		logInterfaceState(ctx)
 	}()
 
-	seenMetadata = mds
+	appliedState = state
+	return nil
+}
+
+// applyInterfaces brings the system to the desired state using svc: it sets up
+// the static, ethernet and VLAN interfaces, the policy routing and the custom
+// routes.
+func applyInterfaces(ctx context.Context, config *cfg.Sections, svc Service, state *desiredState) error {
+	nics := state.ethernetNics()
+
+	// NICs with a static IP configuration are set up by the agent instead of
+	// the network manager.
+	if err := setupStaticInterfaces(ctx, config, svc, nics, state.interfaces, state.staticIPs); err != nil {
+		logger.Errorf("Failed to set up static IP configurations: %v", err)
+	}
+
+	if err := setupBond(ctx, config, svc, nics, state.interfaces); err != nil {
+		logger.Errorf("Failed to set up the NICs bond: %v", err)
+	}
+
+	logger.Infof("Setting up %s", svc.Name())
+	if err := svc.SetupEthernetInterface(ctx, config, nics); err != nil {
+		return fmt.Errorf("manager(%s): error setting up ethernet interfaces: %v", svc.Name(), err)
+	}
+
+	if err := setupPolicyRouting(ctx, config, state.ethernet, state.interfaces); err != nil {
+		logger.Errorf("Failed to set up source-based policy routing: %v", err)
+	}
+
+	if err := setupCustomRoutes(ctx, config, state.ethernet, state.interfaces, state.customRoutes); err != nil {
+		logger.Errorf("Failed to set up custom routes: %v", err)
+	}
+
+	if err := setupTuning(ctx, config, svc, nics, state.interfaces); err != nil {
+		logger.Errorf("Failed to set up network tuning: %v", err)
+	}
+
+	return setupVlans(ctx, config, svc, state)
+}
+
+// setupVlans sets up the VLAN interfaces of the desired state with svc, if
+// enabled in the configuration.
+func setupVlans(ctx context.Context, config *cfg.Sections, svc Service, state *desiredState) error {
+	if !config.NetworkInterfaces.VlanSetupEnabled {
+		return nil
+	}
+
+	logger.Infof("VLAN setup is enabled via config file, setting up interfaces")
+	if state.vlanErr != "" {
+		return fmt.Errorf("unable to read vlans, invalid format: %s", state.vlanErr)
+	}
+	if err := svc.SetupVlanInterface(ctx, config, state.nics()); err != nil {
+		return fmt.Errorf("manager(%s): error setting up vlan interfaces: %v", svc.Name(), err)
+	}
 	return nil
 }
 
@@ -275,7 +356,7 @@ func rollbackLeftoverConfigs(ctx context.Context, config *cfg.Sections, mds *met
 	}
 
 	for _, svc := range knownNetworkManagers {
-		if err := svc.RollbackNics(ctx, nic); err != nil {
+		if err := svc.RollbackNics(ctx, config, nic); err != nil {
 			logger.Warningf("Failed to rollback primary nic (left over) config for %s: %v", svc.Name(), err)
 		}
 	}
@@ -315,8 +396,8 @@ func restoreDebian12NetplanConfig(config *cfg.Sections) error {
 
 // FallbackToDefault will attempt to rescue broken networking by rolling back
 // all guest-agent modifications to the network configuration.
-func FallbackToDefault(ctx context.Context) error {
-	nics, err := buildInterfacesFromAllPhysicalNICs()
+func FallbackToDefault(ctx context.Context, config *cfg.Sections) error {
+	nics, err := buildInterfacesFromAllPhysicalNICs(config)
 	if err != nil {
 		return fmt.Errorf("could not build list of NICs for fallback: %v", err)
 	}
@@ -324,7 +405,7 @@ func FallbackToDefault(ctx context.Context) error {
 	// Rollback every NIC with every known network manager.
 	for _, svc := range knownNetworkManagers {
 		logger.Infof("Rolling back %s", svc.Name())
-		if err := svc.Rollback(ctx, nics); err != nil {
+		if err := svc.Rollback(ctx, config, nics); err != nil {
 			logger.Warningf("Failed to roll back config for %s: %v", svc.Name(), err)
 		}
 	}
@@ -333,20 +414,20 @@ func FallbackToDefault(ctx context.Context) error {
 }
 
 // Build a *Interfaces from all physical interfaces rather than the MDS.
-func buildInterfacesFromAllPhysicalNICs() (*Interfaces, error) {
+func buildInterfacesFromAllPhysicalNICs(config *cfg.Sections) (*Interfaces, error) {
 	nics := &Interfaces{
 		EthernetInterfaces: nil,
 		VlanInterfaces:     map[string]VlanInterface{},
 	}
 
-	interfaces, err := net.Interfaces()
+	interfaces, err := netInterfaces()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get interfaces: %v", err)
 	}
 
 	for _, iface := range interfaces {
 		mac := iface.HardwareAddr.String()
-		if mac == "" {
+		if mac == "" || IsIgnoredInterface(config, iface.Name) {
 			continue
 		}
 		nics.EthernetInterfaces = append(nics.EthernetInterfaces, metadata.NetworkInterfaces{
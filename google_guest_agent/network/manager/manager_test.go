@@ -82,7 +82,7 @@ func (n *mockService) SetupVlanInterface(context.Context, *cfg.Sections, *Interf
 }
 
 // Rollback implements the Service interface.
-func (n *mockService) Rollback(context.Context, *Interfaces) error {
+func (n *mockService) Rollback(context.Context, *cfg.Sections, *Interfaces) error {
 	n.rolledBack = true
 	if n.rollbackError {
 		return fmt.Errorf("mock error")
@@ -91,8 +91,8 @@ func (n *mockService) Rollback(context.Context, *Interfaces) error {
 }
 
 // RollbackNics implements the Service interface.
-func (n *mockService) RollbackNics(ctx context.Context, nics *Interfaces) error {
-	return n.Rollback(ctx, nics)
+func (n *mockService) RollbackNics(ctx context.Context, config *cfg.Sections, nics *Interfaces) error {
+	return n.Rollback(ctx, config, nics)
 }
 
 // managerTestSetup does pre-test setup steps.
@@ -258,6 +258,11 @@ func TestDetectNetworkManager(t *testing.T) {
 // TestRollbackToDefault ensures that all network managers are rolled back,
 // including the active manager.
 func TestFallbackToDefault(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+
 	managerTestSetup()
 	ctx := context.Background()
 
@@ -278,7 +283,7 @@ func TestFallbackToDefault(t *testing.T) {
 		},
 	}
 
-	if err := FallbackToDefault(ctx); err != nil {
+	if err := FallbackToDefault(ctx, config); err != nil {
 		t.Fatalf("FallbackToDefault(ctx) = %v, want nil", err)
 	}
 
@@ -290,14 +295,19 @@ func TestFallbackToDefault(t *testing.T) {
 }
 
 func TestBuildInterfacesFromAllPhysicalNICs(t *testing.T) {
-	nics, err := buildInterfacesFromAllPhysicalNICs()
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+
+	nics, err := buildInterfacesFromAllPhysicalNICs(config)
 	if err != nil {
 		t.Fatalf("buildInterfacesFromAllPhysicalNICs() = %v, want nil", err)
 	}
 
 	for _, nic := range nics.EthernetInterfaces {
-		if _, err := GetInterfaceByMAC(nic.Mac); err != nil {
-			t.Errorf("GetInterfaceByMAC(%q) = %v, want nil)", nic.Mac, err)
+		if _, err := GetInterfaceByMAC(config, nic.Mac); err != nil {
+			t.Errorf("GetInterfaceByMAC(config, %q) = %v, want nil)", nic.Mac, err)
 		}
 	}
 }
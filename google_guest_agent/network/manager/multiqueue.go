@@ -0,0 +1,223 @@
+//  Copyright 2024 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// multiqueueSpread spreads the NIC queues, their IRQs and transmit steering
+	// across the vCPUs.
+	multiqueueSpread = "spread"
+)
+
+var (
+	// sysfsDir is the sysfs mount point, changed for testing.
+	sysfsDir = "/sys"
+	// procfsDir is the procfs mount point, changed for testing.
+	procfsDir = "/proc"
+	// numCPU returns the number of vCPUs, changed for testing.
+	numCPU = runtime.NumCPU
+)
+
+// parseMaxCombinedChannels returns the pre-set maximum of combined channels
+// listed by ethtool -l.
+func parseMaxCombinedChannels(out string) (int, error) {
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "Current hardware settings") {
+			break
+		}
+		val, found := strings.CutPrefix(line, "Combined:")
+		if !found {
+			continue
+		}
+		return strconv.Atoi(strings.TrimSpace(val))
+	}
+	return 0, fmt.Errorf("no combined channels maximum found")
+}
+
+// queueCount returns the number of queues to use for a NIC supporting up to
+// channels combined channels on cpus vCPUs, capped by limit if not zero.
+func queueCount(channels, cpus, limit int) int {
+	res := min(channels, cpus)
+	if limit > 0 {
+		res = min(res, limit)
+	}
+	return max(res, 1)
+}
+
+// queueCPUs returns the vCPUs of queue out of queues, vCPUs are assigned to
+// the queues round-robin.
+func queueCPUs(queue, queues, cpus int) []int {
+	var res []int
+	for cpu := queue; cpu < cpus; cpu += queues {
+		res = append(res, cpu)
+	}
+	return res
+}
+
+// xpsMask returns the sysfs cpumask of the vCPUs transmitting on queue out of
+// queues.
+func xpsMask(queue, queues, cpus int) string {
+	words := make([]uint32, (cpus+31)/32)
+	for _, cpu := range queueCPUs(queue, queues, cpus) {
+		words[cpu/32] |= 1 << (cpu % 32)
+	}
+
+	var res []string
+	for i := len(words) - 1; i >= 0; i-- {
+		res = append(res, fmt.Sprintf("%08x", words[i]))
+	}
+	return strings.Join(res, ",")
+}
+
+// affinityList returns the smp_affinity_list of the vCPUs of queue out of
+// queues.
+func affinityList(queue, queues, cpus int) string {
+	var res []string
+	for _, cpu := range queueCPUs(queue, queues, cpus) {
+		res = append(res, strconv.Itoa(cpu))
+	}
+	return strings.Join(res, ",")
+}
+
+// queueIRQs returns the IRQs of iface's queues, by queue index, as named in
+// /proc/interrupts: virtio-net interfaces sit on a virtio device, i.e.
+// virtio1, whose queues raise the virtio1-input.<queue> and
+// virtio1-output.<queue> IRQs. The device's other IRQs, i.e. virtio1-config,
+// aren't queue IRQs.
+func queueIRQs(iface string) (map[int][]int, error) {
+	device, err := filepath.EvalSymlinks(filepath.Join(sysfsDir, "class", "net", iface, "device"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve the device of %s: %w", iface, err)
+	}
+	deviceName := filepath.Base(device)
+
+	content, err := os.ReadFile(filepath.Join(procfsDir, "interrupts"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the IRQs of %s: %w", iface, err)
+	}
+
+	res := make(map[int][]int)
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		irq, err := strconv.Atoi(strings.TrimSuffix(fields[0], ":"))
+		if err != nil {
+			continue
+		}
+		name := fields[len(fields)-1]
+		var queue string
+		var found bool
+		for _, kind := range []string{"-input.", "-output."} {
+			if queue, found = strings.CutPrefix(name, deviceName+kind); found {
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+		q, err := strconv.Atoi(queue)
+		if err != nil {
+			continue
+		}
+		res[q] = append(res[q], irq)
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("no queue IRQs of %s (%s) found", iface, deviceName)
+	}
+	return res, nil
+}
+
+// setupMultiqueue sets the RSS queue count of iface according to the vCPU
+// count, and spreads the IRQ affinity and XPS of the queues across the vCPUs.
+func setupMultiqueue(ctx context.Context, config *cfg.Sections, iface string) error {
+	cpus := numCPU()
+
+	res := run.WithOutput(ctx, "ethtool", "-l", iface)
+	if res.ExitCode != 0 {
+		return fmt.Errorf("failed to get the channels of %s: %s", iface, res.StdErr)
+	}
+	channels, err := parseMaxCombinedChannels(res.StdOut)
+	if err != nil {
+		return fmt.Errorf("failed to parse the channels of %s: %w", iface, err)
+	}
+	queues := queueCount(channels, cpus, config.NetworkInterfaces.MultiqueueMaxQueues)
+
+	var errs []error
+	logger.Infof("Setting %d RSS queues on %s for %d vCPUs.", queues, iface, cpus)
+	if err := run.Quiet(ctx, "ethtool", "-L", iface, "combined", strconv.Itoa(queues)); err != nil {
+		errs = append(errs, fmt.Errorf("failed to set the channels of %s: %w", iface, err))
+	}
+
+	irqs, err := queueIRQs(iface)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	for queue := 0; queue < queues; queue++ {
+		for _, irq := range irqs[queue] {
+			file := filepath.Join(procfsDir, "irq", strconv.Itoa(irq), "smp_affinity_list")
+			if err := os.WriteFile(file, []byte(affinityList(queue, queues, cpus)), 0644); err != nil {
+				errs = append(errs, fmt.Errorf("failed to set the affinity of IRQ %d: %w", irq, err))
+			}
+		}
+	}
+
+	for queue := 0; queue < queues; queue++ {
+		file := filepath.Join(sysfsDir, "class", "net", iface, "queues", fmt.Sprintf("tx-%d", queue), "xps_cpus")
+		if err := os.WriteFile(file, []byte(xpsMask(queue, queues, cpus)), 0644); err != nil {
+			errs = append(errs, fmt.Errorf("failed to set the XPS of %s tx-%d: %w", iface, queue, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// setupMultiqueueTuning applies the configured multi-queue policy to ifaces.
+func setupMultiqueueTuning(ctx context.Context, config *cfg.Sections, ifaces []string) error {
+	switch config.NetworkInterfaces.MultiqueuePolicy {
+	case "":
+		return nil
+	case multiqueueSpread:
+	default:
+		return fmt.Errorf("unknown multiqueue policy %q", config.NetworkInterfaces.MultiqueuePolicy)
+	}
+
+	if exists, err := cliExists("ethtool"); err != nil || !exists {
+		return fmt.Errorf("ethtool is not available for multi-queue tuning: %v", err)
+	}
+
+	var errs []error
+	for _, iface := range ifaces {
+		if err := setupMultiqueue(ctx, config, iface); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,210 @@
+//  Copyright 2024 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package manager
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/google/go-cmp/cmp"
+)
+
+const ethtoolChannels = `Channel parameters for eth1:
+Pre-set maximums:
+RX:		n/a
+TX:		n/a
+Other:		n/a
+Combined:	16
+Current hardware settings:
+RX:		n/a
+TX:		n/a
+Other:		n/a
+Combined:	2
+`
+
+func TestParseMaxCombinedChannels(t *testing.T) {
+	got, err := parseMaxCombinedChannels(ethtoolChannels)
+	if err != nil {
+		t.Fatalf("parseMaxCombinedChannels() failed unexpectedly with error: %v", err)
+	}
+	if got != 16 {
+		t.Errorf("parseMaxCombinedChannels() = %d, want 16", got)
+	}
+
+	if _, err := parseMaxCombinedChannels("Channel parameters for eth1:\n"); err == nil {
+		t.Errorf("parseMaxCombinedChannels() succeeded without channels, want error")
+	}
+}
+
+func TestQueueCount(t *testing.T) {
+	tests := []struct {
+		channels, cpus, limit, want int
+	}{
+		{channels: 16, cpus: 4, want: 4},
+		{channels: 2, cpus: 8, want: 2},
+		{channels: 16, cpus: 8, limit: 6, want: 6},
+		{channels: 0, cpus: 8, want: 1},
+	}
+
+	for _, tc := range tests {
+		if got := queueCount(tc.channels, tc.cpus, tc.limit); got != tc.want {
+			t.Errorf("queueCount(%d, %d, %d) = %d, want %d", tc.channels, tc.cpus, tc.limit, got, tc.want)
+		}
+	}
+}
+
+func TestXPSMask(t *testing.T) {
+	tests := []struct {
+		queue, queues, cpus int
+		want                string
+	}{
+		{queue: 0, queues: 4, cpus: 4, want: "00000001"},
+		{queue: 1, queues: 2, cpus: 8, want: "000000aa"},
+		{queue: 3, queues: 4, cpus: 40, want: "00000088,88888888"},
+	}
+
+	for _, tc := range tests {
+		if got := xpsMask(tc.queue, tc.queues, tc.cpus); got != tc.want {
+			t.Errorf("xpsMask(%d, %d, %d) = %q, want %q", tc.queue, tc.queues, tc.cpus, got, tc.want)
+		}
+	}
+}
+
+func TestAffinityList(t *testing.T) {
+	tests := []struct {
+		queue, queues, cpus int
+		want                string
+	}{
+		{queue: 0, queues: 4, cpus: 4, want: "0"},
+		{queue: 1, queues: 2, cpus: 8, want: "1,3,5,7"},
+		{queue: 3, queues: 2, cpus: 2, want: ""},
+	}
+
+	for _, tc := range tests {
+		if got := affinityList(tc.queue, tc.queues, tc.cpus); got != tc.want {
+			t.Errorf("affinityList(%d, %d, %d) = %q, want %q", tc.queue, tc.queues, tc.cpus, got, tc.want)
+		}
+	}
+}
+
+func TestSetupMultiqueueTuning(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+
+	sysfs, procfs := t.TempDir(), t.TempDir()
+	origRunner := run.Client
+	origSysfs, origProcfs, origNumCPU := sysfsDir, procfsDir, numCPU
+	t.Cleanup(func() {
+		run.Client = origRunner
+		sysfsDir, procfsDir, numCPU = origSysfs, origProcfs, origNumCPU
+		execLookPath = exec.LookPath
+	})
+	sysfsDir, procfsDir = sysfs, procfs
+	numCPU = func() int { return 4 }
+	execLookPath = func(string) (string, error) { return "/usr/sbin/ethtool", nil }
+
+	runner := &policyRoutingMockRunner{rules: ethtoolChannels}
+	run.Client = runner
+
+	// The policy is disabled by default.
+	if err := setupMultiqueueTuning(context.Background(), config, []string{"eth1"}); err != nil || len(runner.commands) != 0 {
+		t.Fatalf("setupMultiqueueTuning() = %v and ran %v by default, want no-op", err, runner.commands)
+	}
+
+	config.NetworkInterfaces.MultiqueuePolicy = "unknown"
+	if err := setupMultiqueueTuning(context.Background(), config, []string{"eth1"}); err == nil {
+		t.Errorf("setupMultiqueueTuning() with policy %q succeeded, want error", "unknown")
+	}
+
+	config.NetworkInterfaces.MultiqueuePolicy = multiqueueSpread
+	config.NetworkInterfaces.MultiqueueMaxQueues = 2
+
+	// eth1 is a virtio-net interface on the virtio1 device.
+	device := filepath.Join(sysfs, "devices", "pci0000:00", "0000:00:05.0", "virtio1")
+	if err := os.MkdirAll(device, 0755); err != nil {
+		t.Fatalf("os.MkdirAll(%s) failed unexpectedly with error: %v", device, err)
+	}
+	link := filepath.Join(sysfs, "class", "net", "eth1", "device")
+	if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+		t.Fatalf("os.MkdirAll(%s) failed unexpectedly with error: %v", link, err)
+	}
+	if err := os.Symlink(device, link); err != nil {
+		t.Fatalf("os.Symlink(%s, %s) failed unexpectedly with error: %v", device, link, err)
+	}
+	interrupts := `           CPU0       CPU1       CPU2       CPU3
+ 10:          0          0          0          0   PCI-MSI 81920-edge      virtio0-input.0
+ 24:          0          0          0          0   PCI-MSI 98304-edge      virtio1-config
+ 25:        120          0          0          0   PCI-MSI 98305-edge      virtio1-input.0
+ 26:         80          0          0          0   PCI-MSI 98306-edge      virtio1-output.0
+ 27:          0         90          0          0   PCI-MSI 98307-edge      virtio1-input.1
+ 28:          0         60          0          0   PCI-MSI 98308-edge      virtio1-output.1
+NMI:          0          0          0          0   Non-maskable interrupts
+`
+	if err := os.WriteFile(filepath.Join(procfs, "interrupts"), []byte(interrupts), 0644); err != nil {
+		t.Fatalf("os.WriteFile(%s) failed unexpectedly with error: %v", filepath.Join(procfs, "interrupts"), err)
+	}
+
+	var files []string
+	for _, irq := range []string{"10", "24", "25", "26", "27", "28"} {
+		files = append(files, filepath.Join(procfs, "irq", irq, "smp_affinity_list"))
+	}
+	for _, queue := range []string{"tx-0", "tx-1"} {
+		files = append(files, filepath.Join(sysfs, "class", "net", "eth1", "queues", queue, "xps_cpus"))
+	}
+	for _, file := range files {
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatalf("os.MkdirAll(%s) failed unexpectedly with error: %v", file, err)
+		}
+		if err := os.WriteFile(file, nil, 0644); err != nil {
+			t.Fatalf("os.WriteFile(%s) failed unexpectedly with error: %v", file, err)
+		}
+	}
+
+	if err := setupMultiqueueTuning(context.Background(), config, []string{"eth1"}); err != nil {
+		t.Fatalf("setupMultiqueueTuning() failed unexpectedly with error: %v", err)
+	}
+
+	if diff := cmp.Diff([]string{"ethtool -L eth1 combined 2"}, runner.commands); diff != "" {
+		t.Errorf("setupMultiqueueTuning() ran unexpected commands (-want +got):\n%s", diff)
+	}
+
+	want := map[string]string{
+		// The other devices' IRQs and the config IRQ are left alone.
+		filepath.Join(procfs, "irq", "10", "smp_affinity_list"):                    "",
+		filepath.Join(procfs, "irq", "24", "smp_affinity_list"):                    "",
+		filepath.Join(procfs, "irq", "25", "smp_affinity_list"):                    "0,2",
+		filepath.Join(procfs, "irq", "26", "smp_affinity_list"):                    "0,2",
+		filepath.Join(procfs, "irq", "27", "smp_affinity_list"):                    "1,3",
+		filepath.Join(procfs, "irq", "28", "smp_affinity_list"):                    "1,3",
+		filepath.Join(sysfs, "class", "net", "eth1", "queues", "tx-0", "xps_cpus"): "00000005",
+		filepath.Join(sysfs, "class", "net", "eth1", "queues", "tx-1", "xps_cpus"): "0000000a",
+	}
+	for file, val := range want {
+		got, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("os.ReadFile(%s) failed unexpectedly with error: %v", file, err)
+		}
+		if string(got) != val {
+			t.Errorf("%s = %q, want %q", file, got, val)
+		}
+	}
+}
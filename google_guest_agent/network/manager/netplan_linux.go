@@ -64,6 +64,16 @@ type netplan struct {
 	interfacePrefix string
 }
 
+func init() {
+	// Netplan generates the configuration of other network managers, it is
+	// probed before them.
+	registerService(10, &netplan{
+		netplanConfigDir:  "/run/netplan/",
+		networkdDropinDir: "/run/systemd/network/",
+		priority:          20,
+	})
+}
+
 // netplanDropin maps the netplan dropin configuration yaml entries/data
 // structure.
 type netplanDropin struct {
@@ -101,6 +111,18 @@ type netplanEthernet struct {
 	DHCPv6 *bool `yaml:"dhcp6,omitempty"`
 
 	DHCP6Overrides *netplanDHCPOverrides `yaml:"dhcp6-overrides,omitempty"`
+
+	// Nameservers sets the interface's DNS servers and search domains.
+	Nameservers *netplanNameservers `yaml:"nameservers,omitempty"`
+}
+
+// netplanNameservers sets the netplan nameservers configuration.
+type netplanNameservers struct {
+	// Addresses are the DNS servers addresses.
+	Addresses []string `yaml:"addresses,omitempty"`
+
+	// Search are the DNS search domains.
+	Search []string `yaml:"search,omitempty"`
 }
 
 // netplanDHCPOverrides sets the netplan dhcp-overrides configuration.
@@ -164,6 +186,12 @@ func (n *netplan) Name() string {
 	return "netplan"
 }
 
+// handlesRouterAdvertisements implements the raHandler interface, netplan's
+// backends process the IPv6 router advertisements themselves.
+func (n *netplan) handlesRouterAdvertisements() bool {
+	return true
+}
+
 // Configure gives the opportunity for the Service implementation to adjust its configuration
 // based on the Guest Agent configuration.
 func (n *netplan) Configure(ctx context.Context, config *cfg.Sections) {
@@ -193,22 +221,29 @@ func (n *netplan) IsManaging(ctx context.Context, iface string) (bool, error) {
 // configuration directory.
 func (n *netplan) SetupEthernetInterface(ctx context.Context, config *cfg.Sections, nics *Interfaces) error {
 	// Create a network configuration file with default configurations for each network interface.
-	googleInterfaces, googleIpv6Interfaces := interfaceListsIpv4Ipv6(nics.EthernetInterfaces)
+	googleInterfaces, googleIpv6Interfaces := interfaceListsIpv4Ipv6(config, nics.EthernetInterfaces)
+	ipv6Only := ipv6OnlyInterfaces(config, nics.EthernetInterfaces)
 
-	mtuMap, err := interfacesMTUMap(nics.EthernetInterfaces)
+	mtuMap, err := interfacesMTUMap(config, nics.EthernetInterfaces)
 	if err != nil {
 		return fmt.Errorf("error listing interface's MTU configuration: %w", err)
 	}
 
+	// Keep the current configuration, restored if netplan fails applying the new one.
+	snapshot, err := snapshotFiles(n.ethernetFiles(config, googleInterfaces)...)
+	if err != nil {
+		return fmt.Errorf("error saving current ethernet configs: %w", err)
+	}
+
 	// Write the config files.
-	reload1, err := n.writeNetplanEthernetDropin(mtuMap, googleInterfaces, googleIpv6Interfaces)
+	reload1, err := n.writeNetplanEthernetDropin(config, mtuMap, interfacesDNSMap(config, nics.EthernetInterfaces), googleInterfaces, googleIpv6Interfaces, ipv6Only)
 	if err != nil {
 		return fmt.Errorf("error writing network configs: %v", err)
 	}
 
 	// If we are running netplan+systemd-networkd we try to write networkd's drop-in for configs
 	// not mapped/supported by netplan.
-	reload2, err := n.writeNetworkdDropin(googleInterfaces, googleIpv6Interfaces)
+	reload2, err := n.writeNetworkdDropin(config, googleInterfaces, googleIpv6Interfaces, ipv6Only)
 	if err != nil {
 		return fmt.Errorf("error writing systemd-networkd's drop-in: %v", err)
 	}
@@ -216,13 +251,61 @@ func (n *netplan) SetupEthernetInterface(ctx context.Context, config *cfg.Sectio
 	// Avoid unnecessary reloads, if we've really updated some config then only do a reload.
 	if reload1 || reload2 {
 		if err := n.reloadConfigs(ctx); err != nil {
-			return fmt.Errorf("error applying ethernet interface configs: %w", err)
+			return n.restoreConfigs(ctx, snapshot, fmt.Errorf("error applying ethernet interface configs: %w", err))
 		}
 	}
 
 	return nil
 }
 
+// ethernetFiles returns the files written for the ethernet interfaces.
+func (n *netplan) ethernetFiles(config *cfg.Sections, interfaces []string) []string {
+	res := []string{n.dropinFile(netplanEthernetSuffix)}
+	for _, iface := range interfaces {
+		if !isInvalid(config, iface) {
+			res = append(res, n.networkdDropinFile(iface))
+		}
+	}
+	return res
+}
+
+// configFiles returns the netplan and networkd drop-in files written for nics.
+func (n *netplan) configFiles(config *cfg.Sections, nics *Interfaces) []string {
+	ifaces, err := interfaceNames(config, nics.EthernetInterfaces)
+	if err != nil {
+		logger.Warningf("Failed to get interface names: %v", err)
+	}
+	return append(n.ethernetFiles(config, managedInterfaces(config, ifaces)), n.vlanFiles(nics)...)
+}
+
+// reload makes netplan and systemd-networkd apply the configuration files
+// again.
+func (n *netplan) reload(ctx context.Context, config *cfg.Sections, nics *Interfaces) error {
+	return n.reloadConfigs(ctx)
+}
+
+// withConfigRoot implements the dryRunner interface.
+func (n *netplan) withConfigRoot(root string) (Service, []string) {
+	res := *n
+	res.netplanConfigDir = filepath.Join(root, n.netplanConfigDir)
+	res.networkdDropinDir = filepath.Join(root, n.networkdDropinDir)
+	return &res, []string{n.netplanConfigDir, n.networkdDropinDir}
+}
+
+// restoreConfigs rolls back the configuration files to snapshot after applyErr
+// failed applying the new ones, and applies the restored configuration.
+func (n *netplan) restoreConfigs(ctx context.Context, snapshot fileSnapshot, applyErr error) error {
+	logger.Errorf("Failed to apply netplan configuration, restoring the previous one: %v", applyErr)
+
+	if err := snapshot.restore(); err != nil {
+		return fmt.Errorf("%w, failed to restore previous configs: %v", applyErr, err)
+	}
+	if err := n.reloadConfigs(ctx); err != nil {
+		return fmt.Errorf("%w, failed to apply previous configs: %v", applyErr, err)
+	}
+	return fmt.Errorf("%w, previous configs restored", applyErr)
+}
+
 // reloadConfigs triggers config reload to make sure ethernet/vlan configs are written
 // on disk are applied by netplan.
 func (n *netplan) reloadConfigs(ctx context.Context) error {
@@ -243,7 +326,7 @@ func (n *netplan) reloadConfigs(ctx context.Context) error {
 
 // writeNetworkdDropin writes the overloading network-manager's drop-in file for the configurations
 // not supported by netplan.
-func (n *netplan) writeNetworkdDropin(interfaces, ipv6Interfaces []string) (bool, error) {
+func (n *netplan) writeNetworkdDropin(config *cfg.Sections, interfaces, ipv6Interfaces, ipv6OnlyInterfaces []string) (bool, error) {
 	var requiresReload bool
 	stat, err := os.Stat(n.networkdDropinDir)
 	if err != nil {
@@ -259,15 +342,12 @@ func (n *netplan) writeNetworkdDropin(interfaces, ipv6Interfaces []string) (bool
 			logger.Debugf("ManagePrimaryNIC is disabled, skipping writeNetworkdDropin for %s", iface)
 			continue
 		}
-		if isInvalid(iface) {
+		if isInvalid(config, iface) {
 			continue
 		}
 		logger.Debugf("writing systemd-networkd drop-in config for %s", iface)
 
-		var dhcp = "ipv4"
-		if slices.Contains(ipv6Interfaces, iface) {
-			dhcp = "yes"
-		}
+		dhcp := networkdDHCP(iface, ipv6Interfaces, ipv6OnlyInterfaces)
 
 		// Create and setup ini file.
 		data := networkdNetplanDropin{
@@ -359,7 +439,7 @@ func shouldUseDomains(idx int) *bool {
 
 // writeNetplanEthernetDropin selects the ethernet configuration, transforms it
 // into a netplan dropin format and writes it down to the netplan's drop-in directory.
-func (n *netplan) writeNetplanEthernetDropin(mtuMap map[string]int, interfaces, ipv6Interfaces []string) (bool, error) {
+func (n *netplan) writeNetplanEthernetDropin(config *cfg.Sections, mtuMap map[string]int, dnsMap map[string]interfaceDNS, interfaces, ipv6Interfaces, ipv6OnlyInterfaces []string) (bool, error) {
 	dropin := netplanDropin{
 		Network: netplanNetwork{
 			Version:   netplanConfigVersion,
@@ -372,7 +452,7 @@ func (n *netplan) writeNetplanEthernetDropin(mtuMap map[string]int, interfaces,
 			logger.Debugf("ManagePrimaryNIC is disabled, skipping writeNetplanEthernetDropin for %s", iface)
 			continue
 		}
-		if isInvalid(iface) {
+		if isInvalid(config, iface) {
 			continue
 		}
 		logger.Debugf("Adding %s(%d) to drop-in configuration.", iface, i)
@@ -390,13 +470,24 @@ func (n *netplan) writeNetplanEthernetDropin(mtuMap map[string]int, interfaces,
 			ne.MTU = &mtu
 		}
 
-		if slices.Contains(ipv6Interfaces, iface) {
+		if dns, found := dnsMap[iface]; found {
+			ne.Nameservers = &netplanNameservers{Addresses: dns.servers, Search: dns.domains}
+		}
+
+		if slices.Contains(ipv6Interfaces, iface) || slices.Contains(ipv6OnlyInterfaces, iface) {
 			ne.DHCPv6 = &trueVal
 			ne.DHCP6Overrides = &netplanDHCPOverrides{
 				UseDomains: shouldUseDomains(i),
 			}
 		}
 
+		// An IPv6-only interface would wait for a DHCPv4 lease forever.
+		if slices.Contains(ipv6OnlyInterfaces, iface) {
+			falseVal := false
+			ne.DHCPv4 = &falseVal
+			ne.DHCP4Overrides = nil
+		}
+
 		key := n.ID(iface)
 		dropin.Network.Ethernets[key] = ne
 	}
@@ -478,6 +569,12 @@ func (n *netplan) SetupVlanInterface(ctx context.Context, config *cfg.Sections,
 	var reload1, reload2, reload3 bool
 	var err error
 
+	// Keep the current configuration, restored if netplan fails applying the new one.
+	snapshot, err := snapshotFiles(n.vlanFiles(nics)...)
+	if err != nil {
+		return fmt.Errorf("error saving current vlan configs: %w", err)
+	}
+
 	toRemove, err := n.findVlanDiff(nics)
 	if err != nil {
 		return fmt.Errorf("unable to detect vlan nics to delete: %w", err)
@@ -502,13 +599,23 @@ func (n *netplan) SetupVlanInterface(ctx context.Context, config *cfg.Sections,
 
 	if reload1 || reload2 || reload3 {
 		if err = n.reloadConfigs(ctx); err != nil {
-			return fmt.Errorf("error applying vlan interface configs: %w", err)
+			return n.restoreConfigs(ctx, snapshot, fmt.Errorf("error applying vlan interface configs: %w", err))
 		}
 	}
 
 	return nil
 }
 
+// vlanFiles returns the files written for the vlan interfaces. The removed
+// vlan interfaces are deleted and not restored.
+func (n *netplan) vlanFiles(nics *Interfaces) []string {
+	res := []string{n.dropinFile(netplanVlanSuffix)}
+	for _, curr := range nics.VlanInterfaces {
+		res = append(res, n.networkdDropinFile(n.vlanInterfaceName(curr.ParentInterfaceID, curr.Vlan)))
+	}
+	return res
+}
+
 // interfaceFromLink gets the interface name from link name in netplan config.
 // Link name in some cases might not be same as interface name as we prefix with "a"
 // for precedence.
@@ -732,9 +839,9 @@ func (n *netplan) writeNetworkdVLANDropin(nics *Interfaces) (bool, error) {
 
 // rollbackConfigs is the low level implementation for Rollback and RollbackNics interface.
 // If removeVlan is true both regular nics and vlan nics are rolled back.
-func (n *netplan) rollbackConfigs(ctx context.Context, nics *Interfaces, removeVlan bool) error {
+func (n *netplan) rollbackConfigs(ctx context.Context, config *cfg.Sections, nics *Interfaces, removeVlan bool) error {
 	var reload bool
-	interfaces, err := interfaceNames(nics.EthernetInterfaces)
+	interfaces, err := interfaceNames(config, nics.EthernetInterfaces)
 	if err != nil {
 		return fmt.Errorf("failed to get list of interface names: %v", err)
 	}
@@ -754,7 +861,7 @@ func (n *netplan) rollbackConfigs(ctx context.Context, nics *Interfaces, removeV
 		deleteMe = append(deleteMe, networkdDropinFile)
 
 		// Set netplan ethernet drop-in file for removal.
-		if _, ok := existingEthernetCfgs.Network.Ethernets[iface]; ok {
+		if _, ok := existingEthernetCfgs.Network.Ethernets[n.ID(iface)]; ok {
 			deleteMe = append(deleteMe, netplanEthernetDropinFile)
 		}
 	}
@@ -794,14 +901,14 @@ func (n *netplan) rollbackConfigs(ctx context.Context, nics *Interfaces, removeV
 }
 
 // Rollback deletes the ethernet and VLAN interfaces netplan drop-in files.
-func (n *netplan) Rollback(ctx context.Context, nics *Interfaces) error {
+func (n *netplan) Rollback(ctx context.Context, config *cfg.Sections, nics *Interfaces) error {
 	logger.Infof("rolling back changes for %s", n.Name())
-	return n.rollbackConfigs(ctx, nics, true)
+	return n.rollbackConfigs(ctx, config, nics, true)
 }
 
 // Rollback deletes the ethernet interfaces netplan drop-in files - only
 // regular nics are handled.
-func (n *netplan) RollbackNics(ctx context.Context, nics *Interfaces) error {
+func (n *netplan) RollbackNics(ctx context.Context, config *cfg.Sections, nics *Interfaces) error {
 	logger.Infof("rolling back regular ethernet changes for %s", n.Name())
-	return n.rollbackConfigs(ctx, nics, false)
+	return n.rollbackConfigs(ctx, config, nics, false)
 }
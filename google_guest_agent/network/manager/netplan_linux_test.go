@@ -27,6 +27,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
 	"github.com/GoogleCloudPlatform/guest-agent/metadata"
 	"github.com/GoogleCloudPlatform/guest-agent/utils"
@@ -177,6 +178,11 @@ func makebool(b bool) *bool {
 }
 
 func TestSetupVlanInterface(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+
 	netplanCfg := t.TempDir()
 	networkdCfg := t.TempDir()
 	ctx := context.Background()
@@ -233,7 +239,7 @@ func TestSetupVlanInterface(t *testing.T) {
 
 	verifyNetworkdDropin(t, ifaces[1].Name, networkdCfg, nics)
 
-	if err := mgr.Rollback(ctx, nics); err != nil {
+	if err := mgr.Rollback(ctx, config, nics); err != nil {
 		t.Errorf("netplan.Rollback(ctx, %+v) failed unexpectedly with error: %v", nics, err)
 	}
 
@@ -494,3 +500,151 @@ func TestPartialVlanRemoval(t *testing.T) {
 		t.Errorf("netplan.rollbackVlanNics did not remove %s", ens46DropinDir)
 	}
 }
+
+// failingNetplanRunner fails the first netplan generate command.
+type failingNetplanRunner struct {
+	mockNetplanRunner
+	failed bool
+}
+
+func (m *failingNetplanRunner) Quiet(ctx context.Context, name string, args ...string) error {
+	m.mockNetplanRunner.Quiet(ctx, name, args...)
+	if name == "netplan" && !m.failed {
+		m.failed = true
+		return errors.New("invalid netplan configuration")
+	}
+	return nil
+}
+
+func TestSetupEthernetInterfaceRestoresConfigs(t *testing.T) {
+	if err := cfg.Load([]byte("[NetworkInterfaces]\nmanage_primary_nic = true")); err != nil {
+		t.Fatalf("cfg.Load() failed: %v", err)
+	}
+	defer cfg.Load(nil)
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatalf("could not list local interfaces: %+v", err)
+	}
+	var iface net.Interface
+	for _, curr := range ifaces {
+		if len(curr.HardwareAddr) > 0 {
+			iface = curr
+			break
+		}
+	}
+	if iface.Name == "" {
+		t.Skip("no local interface with a MAC address")
+	}
+
+	mgr := &netplan{netplanConfigDir: t.TempDir(), networkdDropinDir: t.TempDir(), priority: 20}
+	nics := &Interfaces{
+		EthernetInterfaces: []metadata.NetworkInterfaces{{Mac: iface.HardwareAddr.String()}},
+	}
+
+	previous := "network:\n    version: 2\n"
+	ethernetDropin := mgr.dropinFile(netplanEthernetSuffix)
+	if err := os.WriteFile(ethernetDropin, []byte(previous), 0600); err != nil {
+		t.Fatalf("os.WriteFile(%q) failed: %v", ethernetDropin, err)
+	}
+
+	orig := run.Client
+	t.Cleanup(func() { run.Client = orig })
+	runner := &failingNetplanRunner{}
+	run.Client = runner
+
+	if err := mgr.SetupEthernetInterface(context.Background(), cfg.Get(), nics); err == nil {
+		t.Fatalf("SetupEthernetInterface() succeeded with a failing netplan, want error")
+	}
+
+	got, err := os.ReadFile(ethernetDropin)
+	if err != nil {
+		t.Fatalf("os.ReadFile(%q) failed: %v", ethernetDropin, err)
+	}
+	if string(got) != previous {
+		t.Errorf("SetupEthernetInterface() left %q in %q, want the previous %q", got, ethernetDropin, previous)
+	}
+	if networkdDropin := mgr.networkdDropinFile(iface.Name); utils.FileExists(networkdDropin, utils.TypeFile) {
+		t.Errorf("SetupEthernetInterface() left the new %q", networkdDropin)
+	}
+
+	wantCmds := []string{"netplan generate", "netplan generate", "networkctl reload"}
+	if diff := cmp.Diff(wantCmds, runner.executedCommands); diff != "" {
+		t.Errorf("SetupEthernetInterface() ran unexpected commands (-want,+got)\n%s", diff)
+	}
+}
+
+// TestWriteNetplanEthernetDropinDNS tests that the metadata DNS configuration
+// is written as the interface's nameservers.
+func TestWriteNetplanEthernetDropinDNS(t *testing.T) {
+	if err := cfg.Load([]byte("[NetworkInterfaces]\nmanage_primary_nic = true")); err != nil {
+		t.Fatalf("cfg.Load() failed: %v", err)
+	}
+	config := cfg.Get()
+	defer cfg.Load(nil)
+
+	mgr := &netplan{netplanConfigDir: t.TempDir(), networkdDropinDir: t.TempDir(), priority: 20}
+	dnsMap := map[string]interfaceDNS{
+		"eth1": {servers: []string{"10.1.0.53"}, domains: []string{"corp.internal"}},
+	}
+
+	if _, err := mgr.writeNetplanEthernetDropin(config, nil, dnsMap, []string{"eth0", "eth1"}, nil, nil); err != nil {
+		t.Fatalf("writeNetplanEthernetDropin() failed: %v", err)
+	}
+
+	var got netplanDropin
+	if err := readYamlFile(mgr.dropinFile(netplanEthernetSuffix), &got); err != nil {
+		t.Fatalf("readYamlFile() failed: %v", err)
+	}
+
+	if ns := got.Network.Ethernets["eth0"].Nameservers; ns != nil {
+		t.Errorf("writeNetplanEthernetDropin() wrote eth0 nameservers %+v, want none", ns)
+	}
+	want := &netplanNameservers{Addresses: []string{"10.1.0.53"}, Search: []string{"corp.internal"}}
+	if diff := cmp.Diff(want, got.Network.Ethernets["eth1"].Nameservers); diff != "" {
+		t.Errorf("writeNetplanEthernetDropin() wrote unexpected eth1 nameservers (-want,+got)\n%s", diff)
+	}
+}
+
+// TestRollbackNicsPrefixedEthernet tests that the ethernet drop-in is removed
+// when its entries are keyed by the prefixed netplan ID.
+func TestRollbackNicsPrefixedEthernet(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatalf("could not list local interfaces: %+v", err)
+	}
+	var iface net.Interface
+	for _, curr := range ifaces {
+		if len(curr.HardwareAddr) > 0 {
+			iface = curr
+			break
+		}
+	}
+	if iface.Name == "" {
+		t.Skip("no local interface with a MAC address")
+	}
+
+	mgr := &netplan{netplanConfigDir: t.TempDir(), networkdDropinDir: t.TempDir(), priority: 20, interfacePrefix: "gcp"}
+	nics := &Interfaces{
+		EthernetInterfaces: []metadata.NetworkInterfaces{{Mac: iface.HardwareAddr.String()}},
+	}
+
+	ethernetDropin := mgr.dropinFile(netplanEthernetSuffix)
+	content := fmt.Sprintf("network:\n    version: 2\n    ethernets:\n        %s:\n            match:\n                name: %s\n", mgr.ID(iface.Name), iface.Name)
+	if err := os.WriteFile(ethernetDropin, []byte(content), 0600); err != nil {
+		t.Fatalf("os.WriteFile(%q) failed: %v", ethernetDropin, err)
+	}
+	setupNetplanRunner(t)
+
+	if err := mgr.RollbackNics(context.Background(), config, nics); err != nil {
+		t.Fatalf("RollbackNics(ctx, %+v) failed unexpectedly with error: %v", nics, err)
+	}
+	if utils.FileExists(ethernetDropin, utils.TypeFile) {
+		t.Errorf("RollbackNics(ctx, %+v) left %q behind", nics, ethernetDropin)
+	}
+}
@@ -17,15 +17,19 @@
 package manager
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
 	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+	"github.com/go-ini/ini"
 )
 
 const (
@@ -40,6 +44,12 @@ const (
 	nmConfigFileMode = 0600
 )
 
+var (
+	// errNotManaged is returned when a connection file exists but was not
+	// created by the guest agent, i.e. it's missing the guest-agent section.
+	errNotManaged = errors.New("connection is not managed by guest agent")
+)
+
 // nmConnectionSection is the connection section of NetworkManager's keyfile.
 type nmConnectionSection struct {
 	// InterfaceName is the name of the interface to configure.
@@ -54,8 +64,15 @@ type nmConnectionSection struct {
 
 // nmIPv4Section is the ipv4 section of NetworkManager's keyfile.
 type nmIPv4Section struct {
-	// Method is the IP configuration method. Supports "auto", "manual", and "link-local".
+	// Method is the IP configuration method. Supports "auto", "manual", "link-local"
+	// and "disabled".
 	Method string `ini:"method"`
+
+	// DNS is the semicolon separated list of IPv4 DNS servers.
+	DNS string `ini:"dns,omitempty"`
+
+	// DNSSearch is the semicolon separated list of DNS search domains.
+	DNSSearch string `ini:"dns-search,omitempty"`
 }
 
 // nmIPSection is the ipv6 section of NetworkManager's keyfile.
@@ -63,6 +80,13 @@ type nmIPv6Section struct {
 	// Method is the IP configuration method. Supports "auto", "manual", and "link-local".
 	Method string `ini:"method"`
 
+	// DNS is the semicolon separated list of IPv6 DNS servers.
+	DNS string `ini:"dns,omitempty"`
+
+	// DNSSearch is the semicolon separated list of DNS search domains, only set
+	// for IPv6-only interfaces.
+	DNSSearch string `ini:"dns-search,omitempty"`
+
 	// MTU is MTU configuration for the interface. Default is auto, we set it explicitly
 	// for VLAN based interfaces.
 	MTU int `ini:"mtu"`
@@ -94,7 +118,7 @@ type nmConfig struct {
 type nmEthernet struct {
 	// OverrideMacAddress requests that the device use this MAC address instead. This is
 	// required in case of VLAN NICs which otherwise by default ends up using parent NICs address.
-	OverrideMacAddress string `ini:"cloned-mac-address"`
+	OverrideMacAddress string `ini:"cloned-mac-address,omitempty"`
 
 	// MTU is MTU configuration for the interface. Default is auto, we set it explicitly
 	// for VLAN based interfaces.
@@ -124,11 +148,24 @@ type networkManager struct {
 	networkScriptsDir string
 }
 
+func init() {
+	registerService(30, &networkManager{
+		configDir:         defaultNetworkManagerConfigDir,
+		networkScriptsDir: defaultNetworkScriptsDir,
+	})
+}
+
 // Name is the name of this network manager service.
 func (n *networkManager) Name() string {
 	return "NetworkManager"
 }
 
+// handlesRouterAdvertisements implements the raHandler interface, NetworkManager
+// processes the IPv6 router advertisements itself.
+func (n *networkManager) handlesRouterAdvertisements() bool {
+	return true
+}
+
 // Configure gives the opportunity for the Service implementation to adjust its configuration
 // based on the Guest Agent configuration.
 func (n *networkManager) Configure(ctx context.Context, config *cfg.Sections) {
@@ -167,16 +204,26 @@ func (n *networkManager) IsManaging(ctx context.Context, iface string) (bool, er
 
 // Setup sets up the necessary configurations for NetworkManager.
 func (n *networkManager) SetupEthernetInterface(ctx context.Context, config *cfg.Sections, nics *Interfaces) error {
-	ifaces, err := interfaceNames(nics.EthernetInterfaces)
+	ifaces, err := interfaceNames(config, nics.EthernetInterfaces)
 	if err != nil {
 		return fmt.Errorf("error getting interfaces: %v", err)
 	}
 
-	interfaces, err := n.writeNetworkManagerConfigs(ifaces)
+	mtuMap, err := interfacesMTUMap(config, nics.EthernetInterfaces)
+	if err != nil {
+		return fmt.Errorf("error listing interface's MTU configuration: %w", err)
+	}
+
+	interfaces, err := n.writeNetworkManagerConfigs(config, mtuMap, interfacesDNSMap(config, nics.EthernetInterfaces), ifaces, ipv6OnlyInterfaces(config, nics.EthernetInterfaces))
 	if err != nil {
 		return fmt.Errorf("error writing NetworkManager connection configs: %v", err)
 	}
 
+	if len(interfaces) == 0 {
+		logger.Debugf("NetworkManager connection profiles are up to date, skipping reload")
+		return nil
+	}
+
 	// This is primarily for RHEL-7 compatibility. Without reloading, attempting to
 	// enable the connections in the next step returns a "mismatched interface" error.
 	if err := run.Quiet(ctx, "nmcli", "conn", "reload"); err != nil {
@@ -210,10 +257,16 @@ func (n *networkManager) SetupVlanInterface(ctx context.Context, config *cfg.Sec
 		return nil
 	}
 
-	if err := n.writeVLANConfigs(nics); err != nil {
+	changed, err := n.writeVLANConfigs(nics)
+	if err != nil {
 		return fmt.Errorf("error writing NetworkManager VLAN configs: %w", err)
 	}
 
+	if !changed {
+		logger.Debugf("NetworkManager VLAN connection profiles are up to date, skipping reload")
+		return nil
+	}
+
 	if err := run.Quiet(ctx, "nmcli", "conn", "reload"); err != nil {
 		return fmt.Errorf("error reloading NetworkManager config cache for VLAN interfaces: %v", err)
 	}
@@ -221,8 +274,11 @@ func (n *networkManager) SetupVlanInterface(ctx context.Context, config *cfg.Sec
 	return nil
 }
 
-// writeVLANConfigs writes NetworkManager configs for VLAN interfaces.
-func (n *networkManager) writeVLANConfigs(nics *Interfaces) error {
+// writeVLANConfigs writes NetworkManager configs for VLAN interfaces. It returns
+// true if any of the configs was created or updated.
+func (n *networkManager) writeVLANConfigs(nics *Interfaces) (bool, error) {
+	var changed bool
+
 	for _, curr := range nics.VlanInterfaces {
 		iface := n.vlanInterfaceName(curr.ParentInterfaceID, curr.Vlan)
 		cfgFile := n.networkManagerConfigFilePath(iface)
@@ -256,17 +312,63 @@ func (n *networkManager) writeVLANConfigs(nics *Interfaces) error {
 			},
 		}
 
-		if err := writeIniFile(cfgFile, &nmCfg); err != nil {
-			return fmt.Errorf("error writing vlan config for %q: %v", iface, err)
+		written, err := writeNetworkManagerConfig(cfgFile, &nmCfg)
+		if errors.Is(err, errNotManaged) {
+			logger.Infof("Skipping VLAN interface %s, %s is not managed by guest agent", iface, cfgFile)
+			continue
+		}
+		if err != nil {
+			return false, fmt.Errorf("error writing vlan config for %q: %w", iface, err)
 		}
+		changed = changed || written
+	}
 
-		// If the permission is not properly set nmcli will fail to load the file correctly.
-		if err := os.Chmod(cfgFile, nmConfigFileMode); err != nil {
-			return fmt.Errorf("error updating permissions for %s: %w", cfgFile, err)
+	return changed, nil
+}
+
+// writeNetworkManagerConfig writes config to filePath if it differs from the
+// file's current contents. Files not carrying the guest-agent ownership section
+// are left untouched and errNotManaged is returned. It returns true if the file
+// was created or updated.
+func writeNetworkManagerConfig(filePath string, config *nmConfig) (bool, error) {
+	data := new(bytes.Buffer)
+	iniCfg := ini.Empty()
+	if err := ini.ReflectFrom(iniCfg, config); err != nil {
+		return false, fmt.Errorf("error creating connection config: %w", err)
+	}
+	if _, err := iniCfg.WriteTo(data); err != nil {
+		return false, fmt.Errorf("error serializing connection config: %w", err)
+	}
+
+	current, err := os.ReadFile(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return false, fmt.Errorf("failed to read %s: %w", filePath, err)
+	}
+
+	if err == nil {
+		existing := new(nmConfig)
+		if err := readIniFile(filePath, existing); err != nil {
+			return false, fmt.Errorf("failed to load NetworkManager %q file: %w", filePath, err)
+		}
+		if !existing.GuestAgent.ManagedByGuestAgent {
+			return false, errNotManaged
+		}
+		if bytes.Equal(current, data.Bytes()) {
+			return false, nil
 		}
 	}
 
-	return nil
+	if err := os.WriteFile(filePath, data.Bytes(), nmConfigFileMode); err != nil {
+		return false, fmt.Errorf("error saving %s: %w", filePath, err)
+	}
+
+	// os.WriteFile() doesn't change the permissions of existing files, if the
+	// permission is not properly set nmcli will fail to load the file correctly.
+	if err := os.Chmod(filePath, nmConfigFileMode); err != nil {
+		return false, fmt.Errorf("error updating permissions for %s: %w", filePath, err)
+	}
+
+	return true, nil
 }
 
 // networkManagerConfigFilePath gets the config file path for the provided interface.
@@ -274,12 +376,68 @@ func (n *networkManager) networkManagerConfigFilePath(iface string) string {
 	return filepath.Join(n.configDir, fmt.Sprintf("google-guest-agent-%s.nmconnection", iface))
 }
 
+// configFiles returns the connection profiles written for nics.
+func (n *networkManager) configFiles(config *cfg.Sections, nics *Interfaces) []string {
+	ifaces, err := interfaceNames(config, nics.EthernetInterfaces)
+	if err != nil {
+		logger.Warningf("Failed to get interface names: %v", err)
+	}
+
+	var res []string
+	for _, iface := range managedInterfaces(config, ifaces) {
+		res = append(res, n.networkManagerConfigFilePath(iface))
+	}
+	for _, curr := range nics.VlanInterfaces {
+		res = append(res, n.networkManagerConfigFilePath(n.vlanInterfaceName(curr.ParentInterfaceID, curr.Vlan)))
+	}
+	return res
+}
+
+// reload makes NetworkManager read its connection profiles again and
+// reconnects the interfaces with them.
+func (n *networkManager) reload(ctx context.Context, config *cfg.Sections, nics *Interfaces) error {
+	if err := run.Quiet(ctx, "nmcli", "conn", "reload"); err != nil {
+		return fmt.Errorf("error reloading NetworkManager config cache: %v", err)
+	}
+
+	ifaces, err := interfaceNames(config, nics.EthernetInterfaces)
+	if err != nil {
+		return fmt.Errorf("error getting interfaces: %v", err)
+	}
+	for _, iface := range managedInterfaces(config, ifaces) {
+		if err := run.Quiet(ctx, "nmcli", "device", "connect", iface); err != nil {
+			return fmt.Errorf("error connecting interface %s: %v", iface, err)
+		}
+	}
+	return nil
+}
+
+// withConfigRoot implements the dryRunner interface.
+func (n *networkManager) withConfigRoot(root string) (Service, []string) {
+	res := *n
+	res.configDir = filepath.Join(root, n.configDir)
+	res.networkScriptsDir = filepath.Join(root, n.networkScriptsDir)
+	return &res, []string{n.configDir, n.networkScriptsDir}
+}
+
 func (n *networkManager) ifcfgFilePath(iface string) string {
 	return filepath.Join(n.networkScriptsDir, fmt.Sprintf("ifcfg-%s", iface))
 }
 
-// writeNetworkManagerConfigs writes the configuration files for NetworkManager.
-func (n *networkManager) writeNetworkManagerConfigs(ifaces []string) ([]string, error) {
+// nmList formats values as a keyfile list, each value is terminated by a
+// semicolon.
+func nmList(values []string) string {
+	var res strings.Builder
+	for _, value := range values {
+		res.WriteString(value + ";")
+	}
+	return res.String()
+}
+
+// writeNetworkManagerConfigs writes the configuration files for NetworkManager. It
+// returns the IDs of the connections created or updated, connections whose files
+// are up to date or not managed by guest agent are left out.
+func (n *networkManager) writeNetworkManagerConfigs(config *cfg.Sections, mtuMap map[string]int, dnsMap map[string]interfaceDNS, ifaces, ipv6OnlyInterfaces []string) ([]string, error) {
 	var result []string
 
 	for i, iface := range ifaces {
@@ -287,7 +445,7 @@ func (n *networkManager) writeNetworkManagerConfigs(ifaces []string) ([]string,
 			logger.Debugf("ManagePrimaryNIC is disabled, skipping writeNetworkManagerConfigs for %s", iface)
 			continue
 		}
-		if isInvalid(iface) {
+		if isInvalid(config, iface) {
 			continue
 		}
 		logger.Debugf("writing nmconnection file for %s", iface)
@@ -313,14 +471,34 @@ func (n *networkManager) writeNetworkManagerConfigs(ifaces []string) ([]string,
 			},
 		}
 
-		// Save the config.
-		if err := writeIniFile(configFilePath, &config); err != nil {
-			return []string{}, fmt.Errorf("error saving connection config for %s: %v", iface, err)
+		// Activating the connection would fail waiting for a DHCPv4 lease.
+		if slices.Contains(ipv6OnlyInterfaces, iface) {
+			config.Ipv4.Method = "disabled"
+		}
+
+		if mtu := mtuMap[iface]; mtu > 0 {
+			config.Ethernet = &nmEthernet{MTU: mtu}
 		}
 
-		// The permissions need to be 600 in order for nmcli to load and use the file correctly.
-		if err := os.Chmod(configFilePath, nmConfigFileMode); err != nil {
-			return []string{}, fmt.Errorf("error updating permissions for %s connection config: %v", iface, err)
+		if dns, found := dnsMap[iface]; found {
+			config.Ipv4.DNS = nmList(dns.ipv4Servers())
+			config.Ipv6.DNS = nmList(dns.ipv6Servers())
+			// NetworkManager ignores the ipv4 settings of a disabled ipv4 method.
+			if config.Ipv4.Method == "disabled" {
+				config.Ipv6.DNSSearch = nmList(dns.domains)
+			} else {
+				config.Ipv4.DNSSearch = nmList(dns.domains)
+			}
+		}
+
+		// Save the config, user created connections are never overwritten.
+		written, err := writeNetworkManagerConfig(configFilePath, &config)
+		if errors.Is(err, errNotManaged) {
+			logger.Infof("Skipping interface %s, %s is not managed by guest agent", iface, configFilePath)
+			continue
+		}
+		if err != nil {
+			return []string{}, fmt.Errorf("error saving connection config for %s: %v", iface, err)
 		}
 
 		// Clean up the files written by the old agent. Make sure they're managed
@@ -338,14 +516,20 @@ func (n *networkManager) writeNetworkManagerConfigs(ifaces []string) ([]string,
 			}
 		}
 
+		// Unchanged connections are already loaded, don't bounce them.
+		if !written {
+			logger.Debugf("nmconnection file for %s is up to date", iface)
+			continue
+		}
+
 		result = append(result, connID)
 	}
 
 	return result, nil
 }
 
-func (n *networkManager) rollbackConfigs(ctx context.Context, nics *Interfaces, removeVlan bool) error {
-	ifaces, err := interfaceNames(nics.EthernetInterfaces)
+func (n *networkManager) rollbackConfigs(ctx context.Context, config *cfg.Sections, nics *Interfaces, removeVlan bool) error {
+	ifaces, err := interfaceNames(config, nics.EthernetInterfaces)
 	if err != nil {
 		return fmt.Errorf("getting interfaces: %v", err)
 	}
@@ -389,14 +573,14 @@ func (n *networkManager) rollbackConfigs(ctx context.Context, nics *Interfaces,
 
 // Rollback deletes the configurations created by Setup() - both regular and vlan nics
 // are handed.
-func (n *networkManager) Rollback(ctx context.Context, nics *Interfaces) error {
-	return n.rollbackConfigs(ctx, nics, true)
+func (n *networkManager) Rollback(ctx context.Context, config *cfg.Sections, nics *Interfaces) error {
+	return n.rollbackConfigs(ctx, config, nics, true)
 }
 
 // Rollback deletes the configurations created by Setup() - only regular nics
 // are handled.
-func (n *networkManager) RollbackNics(ctx context.Context, nics *Interfaces) error {
-	return n.rollbackConfigs(ctx, nics, false)
+func (n *networkManager) RollbackNics(ctx context.Context, config *cfg.Sections, nics *Interfaces) error {
+	return n.rollbackConfigs(ctx, config, nics, false)
 }
 
 // removeInterface verifies .nmconnection is managed by Guest Agent and removes it.
@@ -418,12 +602,15 @@ func (n *networkManager) removeInterface(iface string) (bool, error) {
 		return false, fmt.Errorf("failed to load NetworkManager %q file: %v", configFilePath, err)
 	}
 
-	if config.GuestAgent.ManagedByGuestAgent {
-		logger.Debugf("Attempting to remove NetworkManager configuration %s", configFilePath)
+	if !config.GuestAgent.ManagedByGuestAgent {
+		logger.Debugf("NetworkManager configuration %s is not managed by guest agent, ignoring.", configFilePath)
+		return false, nil
+	}
 
-		if err = os.Remove(configFilePath); err != nil {
-			return false, fmt.Errorf("error deleting config file for %s: %v", iface, err)
-		}
+	logger.Debugf("Attempting to remove NetworkManager configuration %s", configFilePath)
+
+	if err = os.Remove(configFilePath); err != nil {
+		return false, fmt.Errorf("error deleting config file for %s: %v", iface, err)
 	}
 	return true, nil
 }
@@ -145,6 +145,10 @@ type nmStatusOpts struct {
 // nmTestSetup sets up the environment before each test.
 func nmTestSetup(t *testing.T, opts nmTestOpts) {
 	t.Helper()
+	// The teardown restores the mocks, the runner is restored once the test
+	// finished.
+	origClient := run.Client
+	t.Cleanup(func() { run.Client = origClient })
 
 	lookPathOpts := opts.lookPathOpts
 	if lookPathOpts.returnError {
@@ -173,7 +177,6 @@ func nmTestSetup(t *testing.T, opts nmTestOpts) {
 func nmTestTearDown(t *testing.T) {
 	t.Helper()
 
-	run.Client = &run.Runner{}
 	testNetworkManager.configDir = defaultNetworkManagerConfigDir
 }
 
@@ -313,6 +316,7 @@ func TestWriteNetworkManagerConfigs(t *testing.T) {
 	if err := cfg.Load(nil); err != nil {
 		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
 	}
+	config := cfg.Get()
 
 	tests := []struct {
 		// name is the name of this test.
@@ -388,7 +392,7 @@ func TestWriteNetworkManagerConfigs(t *testing.T) {
 			}
 			testNetworkManager.configDir = configDir
 
-			conns, err := testNetworkManager.writeNetworkManagerConfigs(test.testInterfaces)
+			conns, err := testNetworkManager.writeNetworkManagerConfigs(config, nil, nil, test.testInterfaces, nil)
 			if err != nil {
 				t.Fatalf("unexpected error: %v", err)
 			}
@@ -429,7 +433,141 @@ func TestWriteNetworkManagerConfigs(t *testing.T) {
 	}
 }
 
+// TestWriteNetworkManagerConfigsOwnership tests that writeNetworkManagerConfigs()
+// only reports connections it changed and never touches user created connections.
+func TestWriteNetworkManagerConfigsOwnership(t *testing.T) {
+	if err := cfg.Load([]byte("[NetworkInterfaces]\nmanage_primary_nic = true\n")); err != nil {
+		t.Fatalf("cfg.Load() failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+	defer cfg.Load(nil)
+
+	nmTestSetup(t, nmTestOpts{})
+	defer nmTestTearDown(t)
+
+	configDir := filepath.Join(t.TempDir(), "system-connections")
+	if err := os.MkdirAll(configDir, 0755); err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	testNetworkManager.configDir = configDir
+
+	userConfig := "[connection]\ninterface-name=iface1\nid=user-iface1\ntype=ethernet\n"
+	userFile := testNetworkManager.networkManagerConfigFilePath("iface1")
+	if err := os.WriteFile(userFile, []byte(userConfig), nmConfigFileMode); err != nil {
+		t.Fatalf("os.WriteFile(%s) failed unexpectedly with error: %v", userFile, err)
+	}
+
+	ifaces := []string{"iface0", "iface1"}
+
+	conns, err := testNetworkManager.writeNetworkManagerConfigs(config, nil, nil, ifaces, nil)
+	if err != nil {
+		t.Fatalf("writeNetworkManagerConfigs(%v, nil) failed unexpectedly with error: %v", ifaces, err)
+	}
+	if diff := cmp.Diff([]string{"google-guest-agent-iface0"}, conns); diff != "" {
+		t.Errorf("writeNetworkManagerConfigs(%v, nil) returned unexpected diff (-want,+got)\n%s", ifaces, diff)
+	}
+
+	// Nothing changed, nothing should be reported.
+	conns, err = testNetworkManager.writeNetworkManagerConfigs(config, nil, nil, ifaces, nil)
+	if err != nil {
+		t.Fatalf("writeNetworkManagerConfigs(%v, nil) failed unexpectedly with error: %v", ifaces, err)
+	}
+	if len(conns) != 0 {
+		t.Errorf("writeNetworkManagerConfigs(%v, nil) = %v on unchanged configs, want none", ifaces, conns)
+	}
+
+	// A changed config is rewritten.
+	conns, err = testNetworkManager.writeNetworkManagerConfigs(config, nil, nil, ifaces, []string{"iface0"})
+	if err != nil {
+		t.Fatalf("writeNetworkManagerConfigs(%v, [iface0]) failed unexpectedly with error: %v", ifaces, err)
+	}
+	if diff := cmp.Diff([]string{"google-guest-agent-iface0"}, conns); diff != "" {
+		t.Errorf("writeNetworkManagerConfigs(%v, [iface0]) returned unexpected diff (-want,+got)\n%s", ifaces, diff)
+	}
+
+	removed, err := testNetworkManager.removeInterface("iface1")
+	if err != nil {
+		t.Fatalf("removeInterface(iface1) failed unexpectedly with error: %v", err)
+	}
+	if removed {
+		t.Errorf("removeInterface(iface1) = true for a user created connection, want false")
+	}
+
+	got, err := os.ReadFile(userFile)
+	if err != nil {
+		t.Fatalf("os.ReadFile(%s) failed unexpectedly with error: %v", userFile, err)
+	}
+	if string(got) != userConfig {
+		t.Errorf("user created connection was modified, got:\n%s\nwant:\n%s", got, userConfig)
+	}
+}
+
+// TestWriteNetworkManagerConfigsDNS tests that the metadata DNS configuration
+// is written to the ipv4 and ipv6 sections of the connections.
+func TestWriteNetworkManagerConfigsDNS(t *testing.T) {
+	if err := cfg.Load([]byte("[NetworkInterfaces]\nmanage_primary_nic = true\n")); err != nil {
+		t.Fatalf("cfg.Load() failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+	defer cfg.Load(nil)
+
+	nmTestSetup(t, nmTestOpts{})
+	defer nmTestTearDown(t)
+
+	configDir := filepath.Join(t.TempDir(), "system-connections")
+	if err := os.MkdirAll(configDir, 0755); err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	testNetworkManager.configDir = configDir
+
+	dnsMap := map[string]interfaceDNS{
+		"iface0": {servers: []string{"10.0.0.53", "2600:1900::53"}, domains: []string{"corp.internal", "example.com"}},
+		"iface1": {servers: []string{"2600:1901::53"}, domains: []string{"v6.internal"}},
+	}
+	ifaces := []string{"iface0", "iface1", "iface2"}
+
+	if _, err := testNetworkManager.writeNetworkManagerConfigs(config, nil, dnsMap, ifaces, []string{"iface1"}); err != nil {
+		t.Fatalf("writeNetworkManagerConfigs(%v) failed unexpectedly with error: %v", ifaces, err)
+	}
+
+	tests := map[string]struct {
+		ipv4 nmIPv4Section
+		ipv6 nmIPv6Section
+	}{
+		"iface0": {
+			ipv4: nmIPv4Section{Method: "auto", DNS: "10.0.0.53;", DNSSearch: "corp.internal;example.com;"},
+			ipv6: nmIPv6Section{Method: "auto", DNS: "2600:1900::53;"},
+		},
+		"iface1": {
+			ipv4: nmIPv4Section{Method: "disabled"},
+			ipv6: nmIPv6Section{Method: "auto", DNS: "2600:1901::53;", DNSSearch: "v6.internal;"},
+		},
+		"iface2": {
+			ipv4: nmIPv4Section{Method: "auto"},
+			ipv6: nmIPv6Section{Method: "auto"},
+		},
+	}
+
+	for iface, want := range tests {
+		got := new(nmConfig)
+		if err := readIniFile(testNetworkManager.networkManagerConfigFilePath(iface), got); err != nil {
+			t.Fatalf("readIniFile(%s) failed unexpectedly with error: %v", iface, err)
+		}
+		if diff := cmp.Diff(want.ipv4, got.Ipv4); diff != "" {
+			t.Errorf("writeNetworkManagerConfigs() wrote unexpected %s ipv4 section (-want,+got)\n%s", iface, diff)
+		}
+		if diff := cmp.Diff(want.ipv6, got.Ipv6); diff != "" {
+			t.Errorf("writeNetworkManagerConfigs() wrote unexpected %s ipv6 section (-want,+got)\n%s", iface, diff)
+		}
+	}
+}
+
 func TestVlanInterface(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+
 	ctx := context.Background()
 	ifaces, err := net.Interfaces()
 	if err != nil {
@@ -492,7 +630,7 @@ func TestVlanInterface(t *testing.T) {
 		t.Errorf("SetupVlanInterface returned unexpected diff (-want,+got)\n%s", diff)
 	}
 
-	if err := testNetworkManager.Rollback(ctx, validNics); err != nil {
+	if err := testNetworkManager.Rollback(ctx, config, validNics); err != nil {
 		t.Fatalf("testNetworkManager.Rollback(ctx, %+v) failed unexpectedly with error: %v", validNics, err)
 	}
 
@@ -0,0 +1,222 @@
+//  Copyright 2024 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package manager
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// policyTableBase is the base of the secondary NICs routing tables, the NIC
+	// at index i using the table (and the ip rule priority) policyTableBase+i.
+	policyTableBase = 1000
+
+	// maxPolicyTables is the number of tables (and ip rule priorities) owned by
+	// the agent after policyTableBase.
+	maxPolicyTables = 64
+)
+
+// policyRoute describes the source-based routing of a secondary NIC.
+type policyRoute struct {
+	// iface is the NIC's interface name.
+	iface string
+	// table is the NIC's routing table and its ip rule priority.
+	table int
+	// source is the NIC's IPv4 address.
+	source string
+	// subnet is the NIC's subnet, empty if unknown.
+	subnet string
+	// gateway is the NIC's IPv4 gateway.
+	gateway string
+}
+
+// rule returns the ip rule list description of the route's rule.
+func (pr policyRoute) rule() string {
+	return fmt.Sprintf("from %s lookup %d", pr.source, pr.table)
+}
+
+// routeCommands returns the ip commands setting up the route's table.
+func (pr policyRoute) routeCommands(protoID string) [][]string {
+	table := strconv.Itoa(pr.table)
+
+	var res [][]string
+	if pr.subnet != "" {
+		res = append(res, []string{"route", "replace", pr.subnet, "dev", pr.iface, "proto", protoID, "table", table})
+	}
+	// The gateway is onlink, the NIC's address being a /32.
+	return append(res, []string{"route", "replace", "default", "via", pr.gateway, "dev", pr.iface, "onlink", "proto", protoID, "table", table})
+}
+
+// policyRoutes returns the source-based routing of the secondary NICs with an
+// IPv4 address and gateway. ifaces are the NICs' interface names.
+func policyRoutes(config *cfg.Sections, nics []metadata.NetworkInterfaces, ifaces []string) []policyRoute {
+	var res []policyRoute
+
+	// The primary NIC keeps using the main table.
+	for i := 1; i < len(nics) && i < len(ifaces) && i < maxPolicyTables; i++ {
+		ni := nics[i]
+		if isInvalid(config, ifaces[i]) || ni.IP == "" || ni.Gateway == "" {
+			continue
+		}
+
+		pr := policyRoute{
+			iface:   ifaces[i],
+			table:   policyTableBase + i,
+			source:  ni.IP,
+			gateway: ni.Gateway,
+		}
+
+		ip := net.ParseIP(ni.IP).To4()
+		mask := net.ParseIP(ni.Subnetmask).To4()
+		if ip != nil && mask != nil {
+			pr.subnet = (&net.IPNet{IP: ip.Mask(net.IPMask(mask)), Mask: net.IPMask(mask)}).String()
+		}
+
+		res = append(res, pr)
+	}
+
+	return res
+}
+
+// parseRules parses the ip rule list output, returning the rules by priority.
+func parseRules(out string) map[int][]string {
+	res := make(map[int][]string)
+	for _, line := range strings.Split(out, "\n") {
+		prio, rule, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		p, err := strconv.Atoi(strings.TrimSpace(prio))
+		if err != nil {
+			continue
+		}
+		res[p] = append(res[p], strings.Join(strings.Fields(rule), " "))
+	}
+	return res
+}
+
+// agentRuleSource returns the source address of rule, an ip rule list rule of
+// the priority table, if it's the source rule set up by the agent for table.
+// The other tools' rules of the agent's priorities are never touched.
+func agentRuleSource(rule string, table int) (string, bool) {
+	fields := strings.Fields(rule)
+	if len(fields) != 4 || fields[0] != "from" || fields[2] != "lookup" || fields[3] != strconv.Itoa(table) {
+		return "", false
+	}
+	if ip := net.ParseIP(fields[1]); ip == nil || ip.To4() == nil {
+		return "", false
+	}
+	return fields[1], true
+}
+
+// setupPolicyRouting sets up a routing table and a source ip rule for every
+// secondary NIC, so the traffic from its address leaves through it. The rules
+// and tables of the NICs no longer present are removed. Only the agent's own
+// rules, matching its source selector and table, are changed.
+func setupPolicyRouting(ctx context.Context, config *cfg.Sections, nics []metadata.NetworkInterfaces, ifaces []string) error {
+	if !config.NetworkInterfaces.PolicyRouting {
+		return nil
+	}
+
+	res := run.WithOutput(ctx, "ip", "rule", "list")
+	if res.ExitCode != 0 {
+		return fmt.Errorf("failed to list ip rules: %s", res.StdErr)
+	}
+	rules := parseRules(res.StdOut)
+
+	protoID := config.IPForwarding.EthernetProtoID
+	wanted := make(map[int]bool)
+
+	for _, pr := range policyRoutes(config, nics, ifaces) {
+		wanted[pr.table] = true
+
+		for _, args := range pr.routeCommands(protoID) {
+			if err := run.Quiet(ctx, "ip", args...); err != nil {
+				return fmt.Errorf("failed to set up routing table %d of %s: %w", pr.table, pr.iface, err)
+			}
+		}
+
+		var found bool
+		for _, rule := range rules[pr.table] {
+			source, ok := agentRuleSource(rule, pr.table)
+			if !ok {
+				continue
+			}
+			if rule == pr.rule() {
+				found = true
+				continue
+			}
+			if err := deleteRule(ctx, pr.table, source); err != nil {
+				return err
+			}
+		}
+		if found {
+			continue
+		}
+
+		prio := strconv.Itoa(pr.table)
+		logger.Infof("Routing traffic from %s through %s (table %d).", pr.source, pr.iface, pr.table)
+		if err := run.Quiet(ctx, "ip", "rule", "add", "from", pr.source+"/32", "table", prio, "priority", prio); err != nil {
+			return fmt.Errorf("failed to add ip rule for %s: %w", pr.iface, err)
+		}
+	}
+
+	// Remove the routing of the removed NICs.
+	for prio, existing := range rules {
+		if prio <= policyTableBase || prio >= policyTableBase+maxPolicyTables || wanted[prio] {
+			continue
+		}
+
+		var owned bool
+		for _, rule := range existing {
+			source, ok := agentRuleSource(rule, prio)
+			if !ok {
+				continue
+			}
+			owned = true
+			if err := deleteRule(ctx, prio, source); err != nil {
+				return err
+			}
+		}
+		if !owned {
+			continue
+		}
+
+		logger.Infof("Removing the source-based routing table %d.", prio)
+		if err := run.Quiet(ctx, "ip", "route", "flush", "table", strconv.Itoa(prio), "proto", protoID); err != nil {
+			return fmt.Errorf("failed to flush routing table %d: %w", prio, err)
+		}
+	}
+
+	return nil
+}
+
+// deleteRule deletes the agent's ip rule of the priority prio for source.
+func deleteRule(ctx context.Context, prio int, source string) error {
+	p := strconv.Itoa(prio)
+	if err := run.Quiet(ctx, "ip", "rule", "del", "from", source+"/32", "table", p, "priority", p); err != nil {
+		return fmt.Errorf("failed to delete ip rule %d from %s: %w", prio, source, err)
+	}
+	return nil
+}
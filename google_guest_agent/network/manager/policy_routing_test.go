@@ -0,0 +1,171 @@
+//  Copyright 2024 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package manager
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/google/go-cmp/cmp"
+)
+
+// policyRoutingMockRunner records the commands run and returns rules for ip rule list.
+type policyRoutingMockRunner struct {
+	rules    string
+	commands []string
+}
+
+func (m *policyRoutingMockRunner) Quiet(ctx context.Context, name string, args ...string) error {
+	m.commands = append(m.commands, name+" "+strings.Join(args, " "))
+	return nil
+}
+
+func (m *policyRoutingMockRunner) WithOutput(ctx context.Context, name string, args ...string) *run.Result {
+	return &run.Result{StdOut: m.rules}
+}
+
+func (m *policyRoutingMockRunner) WithOutputTimeout(ctx context.Context, timeout time.Duration, name string, args ...string) *run.Result {
+	return m.WithOutput(ctx, name, args...)
+}
+
+func (m *policyRoutingMockRunner) WithCombinedOutput(ctx context.Context, name string, args ...string) *run.Result {
+	return m.WithOutput(ctx, name, args...)
+}
+
+var policyRoutingNICs = []metadata.NetworkInterfaces{
+	{Mac: "a", IP: "10.0.0.2", Gateway: "10.0.0.1", Subnetmask: "255.255.255.0"},
+	{Mac: "b", IP: "10.1.0.2", Gateway: "10.1.0.1", Subnetmask: "255.255.240.0"},
+	{Mac: "c", IPv6s: []string{"2600:1900::1"}},
+	{Mac: "d", IP: "10.3.0.2", Gateway: "10.3.0.1"},
+	{Mac: "e", IP: "10.4.0.2", Gateway: "10.4.0.1"},
+}
+
+func TestPolicyRoutes(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+
+	ifaces := []string{"eth0", "eth1", "eth2", "eth3", "invalid-e"}
+	want := []policyRoute{
+		{iface: "eth1", table: 1001, source: "10.1.0.2", subnet: "10.1.0.0/20", gateway: "10.1.0.1"},
+		{iface: "eth3", table: 1003, source: "10.3.0.2", gateway: "10.3.0.1"},
+	}
+
+	got := policyRoutes(config, policyRoutingNICs, ifaces)
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(policyRoute{})); diff != "" {
+		t.Errorf("policyRoutes() returned unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	out := "0:\tfrom all lookup local\n1001:\tfrom 10.1.0.2 lookup 1001 \n1001:\tfrom 10.9.0.2 lookup 1001\n32766:\tfrom all lookup main\n"
+	want := map[int][]string{
+		0:     {"from all lookup local"},
+		1001:  {"from 10.1.0.2 lookup 1001", "from 10.9.0.2 lookup 1001"},
+		32766: {"from all lookup main"},
+	}
+
+	if diff := cmp.Diff(want, parseRules(out)); diff != "" {
+		t.Errorf("parseRules(%q) returned unexpected diff (-want +got):\n%s", out, diff)
+	}
+}
+
+func TestAgentRuleSource(t *testing.T) {
+	tests := []struct {
+		rule   string
+		table  int
+		want   string
+		wantOK bool
+	}{
+		{rule: "from 10.1.0.2 lookup 1001", table: 1001, want: "10.1.0.2", wantOK: true},
+		{rule: "from 10.1.0.2 lookup 1002", table: 1001},
+		{rule: "from all lookup 1001", table: 1001},
+		{rule: "from 10.1.0.2 fwmark 0x1 lookup 1001", table: 1001},
+		{rule: "from 2600:1900::1 lookup 1001", table: 1001},
+	}
+
+	for _, tc := range tests {
+		got, ok := agentRuleSource(tc.rule, tc.table)
+		if got != tc.want || ok != tc.wantOK {
+			t.Errorf("agentRuleSource(%q, %d) = (%q, %t), want (%q, %t)", tc.rule, tc.table, got, ok, tc.want, tc.wantOK)
+		}
+	}
+}
+
+func TestSetupPolicyRouting(t *testing.T) {
+	if err := cfg.Load([]byte("[NetworkInterfaces]\npolicy_routing = true")); err != nil {
+		t.Fatalf("cfg.Load() failed: %v", err)
+	}
+	defer cfg.Load(nil)
+
+	orig := run.Client
+	t.Cleanup(func() { run.Client = orig })
+
+	// Table 1001 is already set up along a stale rule, 1003 is missing and
+	// 1005 is a removed NIC's. The rules of other tools at the agent's
+	// priorities, i.e. 1003 and 1006, are left alone.
+	runner := &policyRoutingMockRunner{
+		rules: "0:\tfrom all lookup local\n" +
+			"1001:\tfrom 10.1.0.2 lookup 1001\n" +
+			"1001:\tfrom 10.9.0.2 lookup 1001\n" +
+			"1003:\tfrom all fwmark 0x3 lookup 1003\n" +
+			"1005:\tfrom 10.5.0.2 lookup 1005\n" +
+			"1006:\tfrom 10.6.0.2 lookup vpn\n" +
+			"32766:\tfrom all lookup main\n",
+	}
+	run.Client = runner
+
+	ifaces := []string{"eth0", "eth1", "eth2", "eth3", "invalid-e"}
+	if err := setupPolicyRouting(context.Background(), cfg.Get(), policyRoutingNICs, ifaces); err != nil {
+		t.Fatalf("setupPolicyRouting() failed: %v", err)
+	}
+
+	want := []string{
+		"ip route replace 10.1.0.0/20 dev eth1 proto 66 table 1001",
+		"ip route replace default via 10.1.0.1 dev eth1 onlink proto 66 table 1001",
+		"ip rule del from 10.9.0.2/32 table 1001 priority 1001",
+		"ip route replace default via 10.3.0.1 dev eth3 onlink proto 66 table 1003",
+		"ip rule add from 10.3.0.2/32 table 1003 priority 1003",
+		"ip rule del from 10.5.0.2/32 table 1005 priority 1005",
+		"ip route flush table 1005 proto 66",
+	}
+	if diff := cmp.Diff(want, runner.commands); diff != "" {
+		t.Errorf("setupPolicyRouting() ran unexpected commands (-want +got):\n%s", diff)
+	}
+}
+
+func TestSetupPolicyRoutingDisabled(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load() failed: %v", err)
+	}
+
+	orig := run.Client
+	t.Cleanup(func() { run.Client = orig })
+	runner := &policyRoutingMockRunner{rules: "1005:\tfrom 10.5.0.2 lookup 1005\n"}
+	run.Client = runner
+
+	if err := setupPolicyRouting(context.Background(), cfg.Get(), policyRoutingNICs, []string{"eth0", "eth1"}); err != nil {
+		t.Fatalf("setupPolicyRouting() failed: %v", err)
+	}
+	if len(runner.commands) != 0 {
+		t.Errorf("setupPolicyRouting() ran %v with policy routing disabled, want no command", runner.commands)
+	}
+}
@@ -0,0 +1,224 @@
+//  Copyright 2024 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+var (
+	// staticInterfaces are the interfaces with a static IP configuration, the
+	// network managers skip them like the invalid ones.
+	staticInterfaces = make(map[string]bool)
+
+	// staticIPStateFile records the applied static IP configurations by
+	// interface, for removing them once they change.
+	staticIPStateFile = "/run/google-guest-agent-static-ip.json"
+)
+
+// validateStaticIPConfig checks the addresses of a static IP configuration.
+func validateStaticIPConfig(sc metadata.StaticIPConfig) error {
+	ip, _, err := net.ParseCIDR(sc.Address)
+	if err != nil || ip.To4() == nil {
+		return fmt.Errorf("invalid IPv4 address %q", sc.Address)
+	}
+	if sc.Gateway != "" && net.ParseIP(sc.Gateway) == nil {
+		return fmt.Errorf("invalid gateway %q", sc.Gateway)
+	}
+	for _, route := range sc.Routes {
+		if _, _, err := net.ParseCIDR(route.Destination); err != nil {
+			return fmt.Errorf("invalid route destination %q", route.Destination)
+		}
+		if route.Gateway != "" && net.ParseIP(route.Gateway) == nil {
+			return fmt.Errorf("invalid route gateway %q", route.Gateway)
+		}
+	}
+	return nil
+}
+
+// staticIPConfigs returns the valid static IP configurations of the managed
+// interfaces, indexed by interface name. ifaces are the NICs' interface names.
+func staticIPConfigs(config *cfg.Sections, configs []metadata.StaticIPConfig, ifaces []string) map[string]metadata.StaticIPConfig {
+	res := make(map[string]metadata.StaticIPConfig)
+
+	for _, sc := range configs {
+		if sc.NIC < 0 || sc.NIC >= len(ifaces) {
+			logger.Errorf("Ignoring the static IP configuration of unknown NIC %d", sc.NIC)
+			continue
+		}
+		if !shouldManageInterface(sc.NIC == 0) {
+			logger.Debugf("ManagePrimaryNIC is disabled, ignoring the static IP configuration of the primary NIC")
+			continue
+		}
+
+		iface := ifaces[sc.NIC]
+		if isInvalid(config, iface) {
+			continue
+		}
+		if err := validateStaticIPConfig(sc); err != nil {
+			logger.Errorf("Ignoring the static IP configuration of %s: %v", iface, err)
+			continue
+		}
+		res[iface] = sc
+	}
+
+	return res
+}
+
+// staticIPCommands returns the ip commands adding (op "replace") or deleting
+// (op "del") the static IP configuration sc of iface. The default route is
+// only set for the primary interface.
+func staticIPCommands(op, iface string, sc metadata.StaticIPConfig, primary bool, protoID string) [][]string {
+	var res [][]string
+
+	if op == "replace" {
+		res = append(res, []string{"link", "set", "dev", iface, "up"})
+		res = append(res, []string{"address", op, sc.Address, "dev", iface})
+	}
+
+	if primary && sc.Gateway != "" {
+		res = append(res, []string{"route", op, "default", "via", sc.Gateway, "dev", iface, "proto", protoID})
+	}
+
+	for _, route := range sc.Routes {
+		args := []string{"route", op, route.Destination}
+		if route.Gateway != "" {
+			args = append(args, "via", route.Gateway)
+		}
+		res = append(res, append(args, "dev", iface, "proto", protoID))
+	}
+
+	if op == "del" {
+		res = append(res, []string{"address", op, sc.Address, "dev", iface})
+	}
+
+	return res
+}
+
+// runIPCommands runs the ip commands, stopping at the first failure.
+func runIPCommands(ctx context.Context, commands [][]string) error {
+	for _, args := range commands {
+		if err := run.Quiet(ctx, "ip", args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readStaticIPState returns the recorded static IP configurations.
+func readStaticIPState() map[string]metadata.StaticIPConfig {
+	res := make(map[string]metadata.StaticIPConfig)
+
+	data, err := os.ReadFile(staticIPStateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warningf("Failed to read %s: %v", staticIPStateFile, err)
+		}
+		return res
+	}
+
+	if err := json.Unmarshal(data, &res); err != nil {
+		logger.Warningf("Failed to parse %s: %v", staticIPStateFile, err)
+	}
+	return res
+}
+
+// writeStaticIPState records the applied static IP configurations.
+func writeStaticIPState(applied map[string]metadata.StaticIPConfig) error {
+	if len(applied) == 0 {
+		if err := os.Remove(staticIPStateFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(applied)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(staticIPStateFile, data, 0644)
+}
+
+// setupStaticInterfaces programs the static IP configuration of the NICs
+// listed by the static-ip-config attribute, instead of the network manager
+// svc running DHCP for them. The newly static NICs have svc's configuration
+// rolled back, the configurations removed or changed since the last run are
+// deleted. ifaces are the NICs' interface names.
+func setupStaticInterfaces(ctx context.Context, config *cfg.Sections, svc Service, nics *Interfaces, ifaces []string, configs []metadata.StaticIPConfig) error {
+	// The interfaces are resolved without the previous static ones skipped.
+	staticInterfaces = make(map[string]bool)
+	wanted := staticIPConfigs(config, configs, ifaces)
+	applied := readStaticIPState()
+	protoID := config.IPForwarding.EthernetProtoID
+
+	var rollback []metadata.NetworkInterfaces
+	for _, sc := range wanted {
+		if _, found := applied[ifaces[sc.NIC]]; !found {
+			rollback = append(rollback, nics.EthernetInterfaces[sc.NIC])
+		}
+	}
+	if len(rollback) > 0 {
+		if err := svc.RollbackNics(ctx, config, &Interfaces{EthernetInterfaces: rollback}); err != nil {
+			logger.Warningf("Failed to roll back %s configuration of static NICs: %v", svc.Name(), err)
+		}
+	}
+
+	for iface, prev := range applied {
+		if curr, found := wanted[iface]; found && reflect.DeepEqual(curr, prev) {
+			continue
+		}
+
+		logger.Infof("Removing the static IP configuration of %s", iface)
+		for _, args := range staticIPCommands("del", iface, prev, prev.NIC == 0, protoID) {
+			if err := run.Quiet(ctx, "ip", args...); err != nil {
+				logger.Debugf("Failed to remove static IP configuration of %s: %v", iface, err)
+			}
+		}
+		delete(applied, iface)
+	}
+
+	var errs []error
+	for iface, sc := range wanted {
+		staticInterfaces[iface] = true
+		if _, found := applied[iface]; found {
+			continue
+		}
+
+		logger.Infof("Setting up the static IP configuration of %s", iface)
+		if err := runIPCommands(ctx, staticIPCommands("replace", iface, sc, sc.NIC == 0, protoID)); err != nil {
+			// Not recorded, the commands are retried on the next run.
+			errs = append(errs, fmt.Errorf("failed to set up static IP configuration of %s: %w", iface, err))
+			continue
+		}
+		applied[iface] = sc
+	}
+
+	if err := writeStaticIPState(applied); err != nil {
+		errs = append(errs, fmt.Errorf("failed to write %s: %w", staticIPStateFile, err))
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,162 @@
+//  Copyright 2024 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package manager
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestStaticIPConfigs(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+
+	ifaces := []string{"eth0", "eth1", "invalid-c", "eth3"}
+	configs := []metadata.StaticIPConfig{
+		{NIC: 0, Address: "10.0.0.2/24"},
+		{NIC: 1, Address: "192.168.1.10/24", Routes: []metadata.StaticRoute{{Destination: "10.8.0.0/16", Gateway: "192.168.1.1"}}},
+		{NIC: 2, Address: "192.168.2.10/24"},
+		{NIC: 3, Address: "2600:1900::10/64"},
+		{NIC: 4, Address: "192.168.4.10/24"},
+	}
+
+	want := map[string]metadata.StaticIPConfig{"eth1": configs[1]}
+	if diff := cmp.Diff(want, staticIPConfigs(config, configs, ifaces)); diff != "" {
+		t.Errorf("staticIPConfigs() returned unexpected diff (-want,+got):\n%s", diff)
+	}
+}
+
+func TestStaticIPCommands(t *testing.T) {
+	sc := metadata.StaticIPConfig{
+		NIC:     0,
+		Address: "10.0.0.2/24",
+		Gateway: "10.0.0.1",
+		Routes:  []metadata.StaticRoute{{Destination: "10.8.0.0/16", Gateway: "10.0.0.254"}, {Destination: "10.9.0.0/16"}},
+	}
+
+	tests := []struct {
+		name    string
+		op      string
+		primary bool
+		want    []string
+	}{
+		{
+			name:    "replace_primary",
+			op:      "replace",
+			primary: true,
+			want: []string{
+				"link set dev eth0 up",
+				"address replace 10.0.0.2/24 dev eth0",
+				"route replace default via 10.0.0.1 dev eth0 proto 66",
+				"route replace 10.8.0.0/16 via 10.0.0.254 dev eth0 proto 66",
+				"route replace 10.9.0.0/16 dev eth0 proto 66",
+			},
+		},
+		{
+			name: "del_secondary",
+			op:   "del",
+			want: []string{
+				"route del 10.8.0.0/16 via 10.0.0.254 dev eth0 proto 66",
+				"route del 10.9.0.0/16 dev eth0 proto 66",
+				"address del 10.0.0.2/24 dev eth0",
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			for _, args := range staticIPCommands(tc.op, "eth0", sc, tc.primary, "66") {
+				got = append(got, strings.Join(args, " "))
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("staticIPCommands(%s) returned unexpected diff (-want,+got):\n%s", tc.op, diff)
+			}
+		})
+	}
+}
+
+func TestSetupStaticInterfaces(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+
+	origState := staticIPStateFile
+	staticIPStateFile = filepath.Join(t.TempDir(), "static-ip.json")
+	origRunner := run.Client
+	t.Cleanup(func() {
+		staticIPStateFile = origState
+		run.Client = origRunner
+		staticInterfaces = make(map[string]bool)
+	})
+
+	ctx := context.Background()
+	ifaces := []string{"eth0", "eth1"}
+	nics := &Interfaces{EthernetInterfaces: []metadata.NetworkInterfaces{{Mac: "a"}, {Mac: "b"}}}
+	configs := []metadata.StaticIPConfig{{NIC: 1, Address: "192.168.1.10/24"}}
+
+	// A newly static NIC has the network manager's configuration rolled back.
+	runner := &policyRoutingMockRunner{}
+	run.Client = runner
+	svc := &mockService{}
+	if err := setupStaticInterfaces(ctx, cfg.Get(), svc, nics, ifaces, configs); err != nil {
+		t.Fatalf("setupStaticInterfaces() failed unexpectedly with error: %v", err)
+	}
+	if !svc.rolledBack {
+		t.Errorf("setupStaticInterfaces() didn't roll back the configuration of the newly static NIC")
+	}
+	want := []string{"ip link set dev eth1 up", "ip address replace 192.168.1.10/24 dev eth1"}
+	if diff := cmp.Diff(want, runner.commands); diff != "" {
+		t.Errorf("setupStaticInterfaces() ran unexpected commands (-want,+got):\n%s", diff)
+	}
+	if !isInvalid(config, "eth1") || isInvalid(config, "eth0") {
+		t.Errorf("isInvalid() = %t, %t for eth1, eth0, want true, false", isInvalid(config, "eth1"), isInvalid(config, "eth0"))
+	}
+
+	// An applied configuration is left as is.
+	runner = &policyRoutingMockRunner{}
+	run.Client = runner
+	svc = &mockService{}
+	if err := setupStaticInterfaces(ctx, cfg.Get(), svc, nics, ifaces, configs); err != nil {
+		t.Fatalf("setupStaticInterfaces() failed unexpectedly with error: %v", err)
+	}
+	if svc.rolledBack || len(runner.commands) != 0 {
+		t.Errorf("setupStaticInterfaces() = rolled back %t, ran %v for an applied configuration, want nothing", svc.rolledBack, runner.commands)
+	}
+
+	// A removed configuration is deleted, the NIC is back to the network manager.
+	runner = &policyRoutingMockRunner{}
+	run.Client = runner
+	if err := setupStaticInterfaces(ctx, cfg.Get(), svc, nics, ifaces, nil); err != nil {
+		t.Fatalf("setupStaticInterfaces() failed unexpectedly with error: %v", err)
+	}
+	want = []string{"ip address del 192.168.1.10/24 dev eth1"}
+	if diff := cmp.Diff(want, runner.commands); diff != "" {
+		t.Errorf("setupStaticInterfaces() ran unexpected commands (-want,+got):\n%s", diff)
+	}
+	if isInvalid(config, "eth1") {
+		t.Errorf("isInvalid(config, eth1) = true once its static configuration is removed, want false")
+	}
+}
@@ -26,6 +26,7 @@ import (
 	"slices"
 	"strconv"
 	"strings"
+	"unicode"
 
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
@@ -62,6 +63,24 @@ type systemdNetworkd struct {
 	// deprecatedPriority is the priority previously supported by us and
 	// requires us to roll it back.
 	deprecatedPriority int
+
+	// dns is the list of additional DNS servers set in the .network configs.
+	dns []string
+
+	// domains is the list of additional search domains set in the .network configs.
+	domains []string
+
+	// routeMetric is the metric of the DHCP routes, zero leaves systemd's default.
+	routeMetric int
+}
+
+func init() {
+	registerService(40, &systemdNetworkd{
+		configDir:          "/usr/lib/systemd/network",
+		networkCtlKeys:     []string{"AdministrativeState", "SetupState"},
+		priority:           defaultSystemdNetworkdPriority,
+		deprecatedPriority: deprecatedPriority,
+	})
 }
 
 // guestAgentManaged define an interface for configurations to identify if
@@ -84,7 +103,7 @@ type systemdMatchConfig struct {
 // systemdLinkConfig contains the systemd-networkd's link configuration section.
 type systemdLinkConfig struct {
 	// MACAddress is the address to be set to the link.
-	MACAddress string
+	MACAddress string `ini:",omitempty"`
 
 	// MTUBytes is the systemd-networkd's Link's MTU configuration in bytes.
 	MTUBytes int
@@ -99,6 +118,12 @@ type systemdNetworkConfig struct {
 	// used for resolving domain names that do not match any link's domain.
 	DNSDefaultRoute bool
 
+	// DNS is the list of DNS servers configured for the link.
+	DNS []string `ini:"DNS,omitempty,allowshadow"`
+
+	// Domains is the space separated list of the link's search domains.
+	Domains string `ini:"Domains,omitempty"`
+
 	// VLAN specifies the VLANs this network should be member of.
 	VLANS []string `ini:"VLAN,omitempty,allowshadow"`
 }
@@ -116,6 +141,9 @@ type systemdDHCPConfig struct {
 	// RoutesToNTP defines if routes to the NTP servers received from the DHCP
 	// shoud be configured/installed.
 	RoutesToNTP bool
+
+	// RouteMetric is the metric of the routes received from the DHCP.
+	RouteMetric int `ini:",omitempty"`
 }
 
 // systemdConfig wraps the interface configuration for systemd-networkd.
@@ -175,10 +203,52 @@ func (n *systemdNetworkd) Name() string {
 	return "systemd-networkd"
 }
 
+// handlesRouterAdvertisements implements the raHandler interface, systemd-networkd
+// processes the IPv6 router advertisements itself.
+func (n *systemdNetworkd) handlesRouterAdvertisements() bool {
+	return true
+}
+
 // Configure gives the opportunity for the Service implementation to adjust its configuration
 // based on the Guest Agent configuration.
 func (n *systemdNetworkd) Configure(ctx context.Context, config *cfg.Sections) {
 	n.configDir = config.Unstable.SystemdConfigDir
+
+	n.priority = defaultSystemdNetworkdPriority
+	if config.NetworkInterfaces.NetworkdPriority > 0 {
+		n.priority = config.NetworkInterfaces.NetworkdPriority
+	}
+
+	n.dns = configList(config.NetworkInterfaces.NetworkdDNS)
+	n.domains = configList(config.NetworkInterfaces.NetworkdDomains)
+	n.routeMetric = config.NetworkInterfaces.NetworkdRouteMetric
+}
+
+// configList splits a comma or space separated configuration value.
+func configList(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+}
+
+// applySettings adds the user configured settings to a .network config. The
+// DHCP sections are created with systemd's defaults if they are missing.
+func (n *systemdNetworkd) applySettings(config *systemdConfig) {
+	config.Network.DNS = n.dns
+	config.Network.Domains = strings.Join(n.domains, " ")
+
+	if n.routeMetric == 0 {
+		return
+	}
+
+	if config.DHCPv4 == nil {
+		config.DHCPv4 = &systemdDHCPConfig{RoutesToDNS: true, RoutesToNTP: true}
+	}
+	if config.DHCPv6 == nil {
+		config.DHCPv6 = &systemdDHCPConfig{RoutesToDNS: true, RoutesToNTP: true}
+	}
+	config.DHCPv4.RouteMetric = n.routeMetric
+	config.DHCPv6.RouteMetric = n.routeMetric
 }
 
 // IsManaging checks whether systemd-networkd is managing the provided interface.
@@ -239,15 +309,22 @@ func (n *systemdNetworkd) IsManaging(ctx context.Context, iface string) (bool, e
 // configuration files to the specified configuration directory.
 func (n *systemdNetworkd) SetupEthernetInterface(ctx context.Context, config *cfg.Sections, nics *Interfaces) error {
 	// Create a network configuration file with default configurations for each network interface.
-	googleInterfaces, googleIpv6Interfaces := interfaceListsIpv4Ipv6(nics.EthernetInterfaces)
+	googleInterfaces, googleIpv6Interfaces := interfaceListsIpv4Ipv6(config, nics.EthernetInterfaces)
+	ipv6Only := ipv6OnlyInterfaces(config, nics.EthernetInterfaces)
+
+	mtuMap, err := interfacesMTUMap(config, nics.EthernetInterfaces)
+	if err != nil {
+		return fmt.Errorf("error listing interface's MTU configuration: %w", err)
+	}
+	dnsMap := interfacesDNSMap(config, nics.EthernetInterfaces)
 
 	// Write the config files.
-	if err := n.writeEthernetConfig(googleInterfaces, googleIpv6Interfaces); err != nil {
+	if err := n.writeEthernetConfig(config, mtuMap, dnsMap, googleInterfaces, googleIpv6Interfaces, ipv6Only); err != nil {
 		return fmt.Errorf("error writing network configs: %v", err)
 	}
 
 	// Make sure to rollback previously supported and now deprecated .network and .netdev
-	// config files.
+	// config files, as well as the ones written with a no longer configured priority.
 	for _, iface := range googleInterfaces {
 		if _, err := n.rollbackNetwork(n.deprecatedNetworkFile(iface)); err != nil {
 			logger.Infof("Failed to rollback .network file: %v", err)
@@ -256,6 +333,15 @@ func (n *systemdNetworkd) SetupEthernetInterface(ctx context.Context, config *cf
 		if _, err := n.rollbackNetwork(n.deprecatedNetdevFile(iface)); err != nil {
 			logger.Infof("Failed to rollback .netdev file: %v", err)
 		}
+
+		if n.priority == defaultSystemdNetworkdPriority {
+			continue
+		}
+
+		defaultFile := filepath.Join(n.configDir, fmt.Sprintf("%d-%s-google-guest-agent.network", defaultSystemdNetworkdPriority, iface))
+		if _, err := n.rollbackNetwork(defaultFile); err != nil {
+			logger.Infof("Failed to rollback .network file: %v", err)
+		}
 	}
 
 	// Avoid restarting systemd-networkd.
@@ -291,6 +377,7 @@ func (n *systemdNetworkd) SetupVlanInterface(ctx context.Context, config *cfg.Se
 				MTUBytes:   curr.MTU,
 			},
 		}
+		n.applySettings(&networkConfig)
 
 		if err := networkConfig.write(n, iface); err != nil {
 			return fmt.Errorf("failed to write systemd's vlan .network config: %+v", err)
@@ -453,6 +540,39 @@ func (n *systemdNetworkd) netdevFile(iface string) string {
 	return filepath.Join(n.configDir, fmt.Sprintf("%d-%s-google-guest-agent.netdev", n.priority, iface))
 }
 
+// configFiles returns the .network and .netdev files written for nics.
+func (n *systemdNetworkd) configFiles(config *cfg.Sections, nics *Interfaces) []string {
+	ifaces, err := interfaceNames(config, nics.EthernetInterfaces)
+	if err != nil {
+		logger.Warningf("Failed to get interface names: %v", err)
+	}
+
+	var res []string
+	for _, iface := range managedInterfaces(config, ifaces) {
+		res = append(res, n.networkFile(iface))
+	}
+	for _, curr := range nics.VlanInterfaces {
+		iface := fmt.Sprintf("gcp.%s.%d", curr.ParentInterfaceID, curr.Vlan)
+		res = append(res, n.networkFile(iface), n.netdevFile(iface))
+	}
+	return res
+}
+
+// reload makes systemd-networkd apply its configuration files again.
+func (n *systemdNetworkd) reload(ctx context.Context, config *cfg.Sections, nics *Interfaces) error {
+	if err := run.Quiet(ctx, "networkctl", "reload"); err != nil {
+		return fmt.Errorf("error reloading systemd-networkd network configs: %v", err)
+	}
+	return nil
+}
+
+// withConfigRoot implements the dryRunner interface.
+func (n *systemdNetworkd) withConfigRoot(root string) (Service, []string) {
+	res := *n
+	res.configDir = filepath.Join(root, n.configDir)
+	return &res, []string{n.configDir}
+}
+
 // deprecatedNetdevFile returns the older and deprecated networkd's netdev file. It's
 // present mainly to allow us to roll it back.
 func (n *systemdNetworkd) deprecatedNetdevFile(iface string) string {
@@ -503,23 +623,32 @@ func (sc systemdConfig) isGuestAgentManaged() bool {
 	return sc.GuestAgent.ManagedByGuestAgent
 }
 
+// networkdDHCP returns the systemd-networkd DHCP setting of iface, "ipv4"
+// unless the interface has IPv6.
+func networkdDHCP(iface string, ipv6Interfaces, ipv6OnlyInterfaces []string) string {
+	if slices.Contains(ipv6OnlyInterfaces, iface) {
+		return "ipv6"
+	}
+	if slices.Contains(ipv6Interfaces, iface) {
+		return "yes"
+	}
+	return "ipv4"
+}
+
 // writeEthernetConfig writes the systemd config for all the provided interfaces in the
 // provided directory using the given priority.
-func (n *systemdNetworkd) writeEthernetConfig(interfaces, ipv6Interfaces []string) error {
+func (n *systemdNetworkd) writeEthernetConfig(config *cfg.Sections, mtuMap map[string]int, dnsMap map[string]interfaceDNS, interfaces, ipv6Interfaces, ipv6OnlyInterfaces []string) error {
 	for i, iface := range interfaces {
 		if !shouldManageInterface(i == 0) {
 			logger.Debugf("ManagePrimaryNIC is disabled, skipping systemdNetworkd writeEthernetConfig for %s", iface)
 			continue
 		}
-		if isInvalid(iface) {
+		if isInvalid(config, iface) {
 			continue
 		}
 		logger.Debugf("write systemd-networkd network config for %s", iface)
 
-		var dhcp = "ipv4"
-		if slices.Contains(ipv6Interfaces, iface) {
-			dhcp = "yes"
-		}
+		dhcp := networkdDHCP(iface, ipv6Interfaces, ipv6OnlyInterfaces)
 
 		// Create and setup ini file.
 		data := systemdConfig{
@@ -549,6 +678,19 @@ func (n *systemdNetworkd) writeEthernetConfig(interfaces, ipv6Interfaces []strin
 			}
 		}
 
+		if mtu := mtuMap[iface]; mtu > 0 {
+			data.Link = &systemdLinkConfig{MTUBytes: mtu}
+		}
+
+		n.applySettings(&data)
+
+		// The metadata servers and domains are per link, systemd-resolved
+		// routes the lookups of the link's domains to its servers.
+		if dns, found := dnsMap[iface]; found {
+			data.Network.DNS = slices.Concat(data.Network.DNS, dns.servers)
+			data.Network.Domains = strings.Join(slices.Concat(strings.Fields(data.Network.Domains), dns.domains), " ")
+		}
+
 		if err := data.write(n, iface); err != nil {
 			return fmt.Errorf("failed to write systemd's ethernet interface config: %+v", err)
 		}
@@ -559,22 +701,22 @@ func (n *systemdNetworkd) writeEthernetConfig(interfaces, ipv6Interfaces []strin
 
 // Rollback deletes the configuration files created by the agent for
 // systemd-networkd - both regular and vlan nics are handled.
-func (n *systemdNetworkd) Rollback(ctx context.Context, nics *Interfaces) error {
-	return n.rollbackConfigs(ctx, nics, true)
+func (n *systemdNetworkd) Rollback(ctx context.Context, config *cfg.Sections, nics *Interfaces) error {
+	return n.rollbackConfigs(ctx, config, nics, true)
 }
 
 // Rollback deletes the configuration files created by the agent for
 // systemd-networkd - only regular nics are handled.
-func (n *systemdNetworkd) RollbackNics(ctx context.Context, nics *Interfaces) error {
-	return n.rollbackConfigs(ctx, nics, false)
+func (n *systemdNetworkd) RollbackNics(ctx context.Context, config *cfg.Sections, nics *Interfaces) error {
+	return n.rollbackConfigs(ctx, config, nics, false)
 }
 
 // rollbackConfigs is the low level implementation of Rollback and RollbackNics
 // interface. If removeVlan is true both regular nics and vlan nics are removed
 // otherwise only regular nics are removed.
-func (n *systemdNetworkd) rollbackConfigs(ctx context.Context, nics *Interfaces, removeVlan bool) error {
+func (n *systemdNetworkd) rollbackConfigs(ctx context.Context, config *cfg.Sections, nics *Interfaces, removeVlan bool) error {
 	logger.Infof("rolling back changes for %s", n.Name())
-	interfaces, err := interfaceNames(nics.EthernetInterfaces)
+	interfaces, err := interfaceNames(config, nics.EthernetInterfaces)
 	if err != nil {
 		return fmt.Errorf("failed to get list of interface names: %v", err)
 	}
@@ -31,6 +31,7 @@ import (
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
 	"github.com/GoogleCloudPlatform/guest-agent/metadata"
 	"github.com/go-ini/ini"
+	"github.com/google/go-cmp/cmp"
 )
 
 // mockSystemd is the test systemd-networkd implementation to use for testing.
@@ -181,6 +182,10 @@ func (s systemdMockRunner) WithCombinedOutput(ctx context.Context, name string,
 // systemdTestSetup sets up the environment before each test.
 func systemdTestSetup(t *testing.T, opts systemdTestOpts) {
 	t.Helper()
+	// The teardown restores the mocks, the runner is restored once the test
+	// finished.
+	origClient := run.Client
+	t.Cleanup(func() { run.Client = origClient })
 	mockDir := path.Join(t.TempDir(), "systemd", "network")
 	mockSystemd.configDir = mockDir
 
@@ -218,7 +223,6 @@ func systemdTestTearDown(t *testing.T) {
 	t.Helper()
 
 	execLookPath = exec.LookPath
-	run.Client = &run.Runner{}
 }
 
 // TestSystemdNetworkdIsManaging tests whether IsManaging behaves correctly given some
@@ -433,6 +437,7 @@ func TestSystemdNetworkdConfig(t *testing.T) {
 	if err := cfg.Load(nil); err != nil {
 		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
 	}
+	config := cfg.Get()
 
 	tests := []struct {
 		// name is the name of the test.
@@ -516,7 +521,7 @@ func TestSystemdNetworkdConfig(t *testing.T) {
 			cfg.Get().NetworkInterfaces.ManagePrimaryNIC = test.managePrimary
 			systemdTestSetup(t, systemdTestOpts{})
 
-			if err := mockSystemd.writeEthernetConfig(test.testInterfaces, test.testIpv6Interfaces); err != nil {
+			if err := mockSystemd.writeEthernetConfig(config, nil, nil, test.testInterfaces, test.testIpv6Interfaces, nil); err != nil {
 				t.Fatalf("unexpected error: %v", err)
 			}
 
@@ -699,3 +704,71 @@ func TestSetupVlanInterfaceSuccess(t *testing.T) {
 		})
 	}
 }
+
+// TestNetworkdDHCP tests the DHCP setting of IPv4, dual-stack and IPv6-only interfaces.
+func TestNetworkdDHCP(t *testing.T) {
+	ipv6Interfaces := []string{"eth1", "eth2"}
+	ipv6OnlyInterfaces := []string{"eth2"}
+
+	for iface, want := range map[string]string{"eth0": "ipv4", "eth1": "yes", "eth2": "ipv6"} {
+		if got := networkdDHCP(iface, ipv6Interfaces, ipv6OnlyInterfaces); got != want {
+			t.Errorf("networkdDHCP(%s, %v, %v) = %q, want %q", iface, ipv6Interfaces, ipv6OnlyInterfaces, got, want)
+		}
+	}
+}
+
+// TestSystemdNetworkdSettings tests that the user configured settings and priority,
+// as well as the metadata MTU and DNS, are applied to the written .network configs.
+func TestSystemdNetworkdSettings(t *testing.T) {
+	configDir := t.TempDir()
+	config := fmt.Sprintf("[NetworkInterfaces]\nmanage_primary_nic = true\nnetworkd_priority = 30\nnetworkd_dns = 10.0.0.2, 10.0.0.3\nnetworkd_domains = example.com internal\nnetworkd_route_metric = 200\n[Unstable]\nsystemd_config_dir = %s\n", configDir)
+	if err := cfg.Load([]byte(config)); err != nil {
+		t.Fatalf("cfg.Load() failed unexpectedly with error: %v", err)
+	}
+	defer cfg.Load(nil)
+
+	networkd := &systemdNetworkd{priority: defaultSystemdNetworkdPriority, deprecatedPriority: deprecatedPriority}
+	networkd.Configure(context.Background(), cfg.Get())
+
+	dnsMap := map[string]interfaceDNS{"iface1": {servers: []string{"10.1.0.53"}, domains: []string{"corp.internal"}}}
+	if err := networkd.writeEthernetConfig(cfg.Get(), map[string]int{"iface1": 8896}, dnsMap, []string{"iface0", "iface1"}, nil, nil); err != nil {
+		t.Fatalf("writeEthernetConfig() failed unexpectedly with error: %v", err)
+	}
+
+	tests := map[string]*systemdConfig{
+		"30-iface0-google-guest-agent.network": {
+			GuestAgent: guestAgentSection{ManagedByGuestAgent: true},
+			Match:      systemdMatchConfig{Name: "iface0"},
+			Network: systemdNetworkConfig{
+				DHCP:            "ipv4",
+				DNSDefaultRoute: true,
+				DNS:             []string{"10.0.0.2", "10.0.0.3"},
+				Domains:         "example.com internal",
+			},
+			DHCPv4: &systemdDHCPConfig{RoutesToDNS: true, RoutesToNTP: true, RouteMetric: 200},
+			DHCPv6: &systemdDHCPConfig{RoutesToDNS: true, RoutesToNTP: true, RouteMetric: 200},
+		},
+		"30-iface1-google-guest-agent.network": {
+			GuestAgent: guestAgentSection{ManagedByGuestAgent: true},
+			Match:      systemdMatchConfig{Name: "iface1"},
+			Network: systemdNetworkConfig{
+				DHCP:    "ipv4",
+				DNS:     []string{"10.0.0.2", "10.0.0.3", "10.1.0.53"},
+				Domains: "example.com internal corp.internal",
+			},
+			DHCPv4: &systemdDHCPConfig{RouteMetric: 200},
+			DHCPv6: &systemdDHCPConfig{RouteMetric: 200},
+			Link:   &systemdLinkConfig{MTUBytes: 8896},
+		},
+	}
+
+	for file, want := range tests {
+		got := new(systemdConfig)
+		if err := readIniFile(path.Join(configDir, file), got); err != nil {
+			t.Fatalf("readIniFile(%s) failed unexpectedly with error: %v", file, err)
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("writeEthernetConfig() wrote unexpected %s (-want +got):\n%s", file, diff)
+		}
+	}
+}
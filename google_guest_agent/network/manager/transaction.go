@@ -0,0 +1,183 @@
+//  Copyright 2024 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+// errConnectivityLost is returned when a network configuration is rolled back
+// because the metadata server became unreachable.
+var errConnectivityLost = errors.New("metadata server unreachable")
+
+var (
+	// mdsAddresses are the metadata server addresses dialed to verify the
+	// instance connectivity.
+	mdsAddresses = []string{"169.254.169.254:80", "[fd20:ce::254]:80"}
+
+	// mdsReachable reports whether the metadata server can be reached, it's
+	// replaced in tests.
+	mdsReachable = dialMDS
+
+	// connectivityTimeout is how long the metadata server is waited for after
+	// applying a network configuration before rolling it back.
+	connectivityTimeout = 30 * time.Second
+
+	// connectivityInterval is the time between two connectivity checks.
+	connectivityInterval = 2 * time.Second
+)
+
+// configSnapshotter is implemented by the network manager services whose
+// configuration files can be restored when a network transaction is rolled
+// back.
+type configSnapshotter interface {
+	// configFiles returns the configuration files the service writes for nics.
+	configFiles(config *cfg.Sections, nics *Interfaces) []string
+
+	// reload makes the service apply its configuration files again.
+	reload(ctx context.Context, config *cfg.Sections, nics *Interfaces) error
+}
+
+// networkTransaction wraps the application of a network configuration so it's
+// rolled back if the instance loses its connectivity to the metadata server,
+// and with it most likely the SSH access. Only the network manager service's
+// configuration is rolled back, the static IP, bond, policy routing, custom
+// routes and tuning changes the agent makes itself are not.
+type networkTransaction struct {
+	// config is the configuration the network is set up with.
+	config *cfg.Sections
+	// svc is the network manager service applying the configuration.
+	svc Service
+	// nics are the interfaces being configured.
+	nics *Interfaces
+	// snapshot is the state of svc's configuration files before applying, nil
+	// if svc doesn't implement configSnapshotter or they couldn't be read.
+	snapshot fileSnapshot
+	// verify indicates the connectivity is checked after applying, the
+	// metadata server was reachable before.
+	verify bool
+}
+
+// dialMDS reports whether a TCP connection can be opened to one of the
+// metadata server addresses.
+func dialMDS(ctx context.Context) bool {
+	dialer := net.Dialer{Timeout: time.Second}
+	for _, addr := range mdsAddresses {
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			continue
+		}
+		conn.Close()
+		return true
+	}
+	return false
+}
+
+// waitConnectivity waits up to connectivityTimeout for the metadata server to
+// be reachable.
+func waitConnectivity(ctx context.Context) bool {
+	ctx, cancel := context.WithTimeout(ctx, connectivityTimeout)
+	defer cancel()
+
+	for {
+		if mdsReachable(ctx) {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(connectivityInterval):
+		}
+	}
+}
+
+// beginTransaction snapshots the configuration of svc for nics before it's
+// changed. snapshotNics are nics with the VLAN interfaces expected to be
+// set up, so their files are snapshotted too.
+func beginTransaction(ctx context.Context, config *cfg.Sections, svc Service, nics, snapshotNics *Interfaces) *networkTransaction {
+	t := &networkTransaction{config: config, svc: svc, nics: nics}
+
+	// Without connectivity there is nothing to lose, i.e. the configuration
+	// is what brings the network up.
+	if !config.NetworkInterfaces.VerifyConnectivity || !mdsReachable(ctx) {
+		return t
+	}
+	t.verify = true
+
+	if s, ok := svc.(configSnapshotter); ok {
+		snapshot, err := snapshotFiles(s.configFiles(config, snapshotNics)...)
+		if err != nil {
+			logger.Warningf("Failed to snapshot %s configuration, its NICs configuration will be rolled back instead: %v", svc.Name(), err)
+		} else {
+			t.snapshot = snapshot
+		}
+	}
+	return t
+}
+
+// commit runs apply and verifies the metadata server is still reachable,
+// rolling the configuration back otherwise.
+func (t *networkTransaction) commit(ctx context.Context, apply func() error) error {
+	applyErr := apply()
+	if !t.verify || waitConnectivity(ctx) {
+		return applyErr
+	}
+
+	logger.Errorf("Metadata server unreachable after applying %s configuration, rolling it back", t.svc.Name())
+	err := fmt.Errorf("%w after applying %s configuration, rolled back", errConnectivityLost, t.svc.Name())
+	if rbErr := t.rollback(ctx); rbErr != nil {
+		err = fmt.Errorf("%w after applying %s configuration, failed to roll back: %v", errConnectivityLost, t.svc.Name(), rbErr)
+	}
+	return errors.Join(err, applyErr)
+}
+
+// rollback restores the snapshotted configuration files, or rolls back the
+// NICs configuration when they can't be restored.
+func (t *networkTransaction) rollback(ctx context.Context) error {
+	if s, ok := t.svc.(configSnapshotter); ok && t.snapshot != nil {
+		err := t.snapshot.restore()
+		if err == nil {
+			err = s.reload(ctx, t.config, t.nics)
+		}
+		if err == nil {
+			return nil
+		}
+		logger.Errorf("Failed to restore %s configuration, rolling back its NICs configuration: %v", t.svc.Name(), err)
+	}
+
+	if err := t.svc.RollbackNics(ctx, t.config, t.nics); err != nil {
+		return fmt.Errorf("failed to roll back %s NICs configuration: %w", t.svc.Name(), err)
+	}
+	return nil
+}
+
+// managedInterfaces returns the interfaces of ifaces configured by the agent.
+func managedInterfaces(config *cfg.Sections, ifaces []string) []string {
+	var res []string
+	for i, iface := range ifaces {
+		if !shouldManageInterface(i == 0) || isInvalid(config, iface) {
+			continue
+		}
+		res = append(res, iface)
+	}
+	return res
+}
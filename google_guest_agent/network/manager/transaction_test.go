@@ -0,0 +1,179 @@
+//  Copyright 2024 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package manager
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+)
+
+// snapshotMockService is a mockService whose configuration files can be
+// snapshotted.
+type snapshotMockService struct {
+	mockService
+
+	// files are the configuration files of the service.
+	files []string
+
+	// reloaded indicates whether the configuration was reloaded.
+	reloaded bool
+}
+
+// configFiles implements the configSnapshotter interface.
+func (n *snapshotMockService) configFiles(*cfg.Sections, *Interfaces) []string {
+	return n.files
+}
+
+// reload implements the configSnapshotter interface.
+func (n *snapshotMockService) reload(context.Context, *cfg.Sections, *Interfaces) error {
+	n.reloaded = true
+	return nil
+}
+
+// transactionTestSetup makes the connectivity checks return the values of
+// reachable in turn, the last one being repeated.
+func transactionTestSetup(t *testing.T, reachable ...bool) {
+	t.Helper()
+
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+
+	oldReachable, oldTimeout, oldInterval := mdsReachable, connectivityTimeout, connectivityInterval
+	t.Cleanup(func() {
+		mdsReachable, connectivityTimeout, connectivityInterval = oldReachable, oldTimeout, oldInterval
+	})
+
+	connectivityTimeout = 100 * time.Millisecond
+	connectivityInterval = time.Millisecond
+	mdsReachable = func(context.Context) bool {
+		res := reachable[0]
+		if len(reachable) > 1 {
+			reachable = reachable[1:]
+		}
+		return res
+	}
+}
+
+func TestWaitConnectivity(t *testing.T) {
+	transactionTestSetup(t, false, false, true)
+	if !waitConnectivity(context.Background()) {
+		t.Errorf("waitConnectivity(ctx) = false, want true")
+	}
+
+	transactionTestSetup(t, false)
+	if waitConnectivity(context.Background()) {
+		t.Errorf("waitConnectivity(ctx) = true, want false")
+	}
+}
+
+func TestNetworkTransaction(t *testing.T) {
+	tests := []struct {
+		name string
+		// reachable are the connectivity check results.
+		reachable []bool
+		// verify is the verify_connectivity configuration.
+		verify bool
+		// wantErr indicates whether the connectivity is expected to be lost.
+		wantErr bool
+	}{
+		{
+			name:      "connectivity-kept",
+			reachable: []bool{true},
+			verify:    true,
+		},
+		{
+			name:      "connectivity-lost",
+			reachable: []bool{true, false},
+			verify:    true,
+			wantErr:   true,
+		},
+		{
+			name:      "unreachable-before",
+			reachable: []bool{false},
+			verify:    true,
+		},
+		{
+			name:      "verify-disabled",
+			reachable: []bool{true, false},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			transactionTestSetup(t, tc.reachable...)
+			config := cfg.Get()
+			config.NetworkInterfaces.VerifyConnectivity = tc.verify
+
+			dir := t.TempDir()
+			existing := filepath.Join(dir, "existing")
+			added := filepath.Join(dir, "added")
+			if err := os.WriteFile(existing, []byte("old"), 0644); err != nil {
+				t.Fatalf("os.WriteFile(%q) failed: %v", existing, err)
+			}
+
+			svc := &snapshotMockService{files: []string{existing, added}}
+			ctx := context.Background()
+			tx := beginTransaction(ctx, config, svc, &Interfaces{}, &Interfaces{})
+			err := tx.commit(ctx, func() error {
+				if err := os.WriteFile(existing, []byte("new"), 0644); err != nil {
+					return err
+				}
+				return os.WriteFile(added, []byte("new"), 0644)
+			})
+
+			if got := errors.Is(err, errConnectivityLost); got != tc.wantErr {
+				t.Fatalf("commit() = %v, want connectivity lost: %t", err, tc.wantErr)
+			}
+			if svc.reloaded != tc.wantErr {
+				t.Errorf("commit() reloaded = %t, want %t", svc.reloaded, tc.wantErr)
+			}
+
+			wantExisting := "new"
+			if tc.wantErr {
+				wantExisting = "old"
+			}
+			if data, _ := os.ReadFile(existing); string(data) != wantExisting {
+				t.Errorf("commit() left %q with %q, want %q", existing, data, wantExisting)
+			}
+			if _, err := os.Stat(added); os.IsNotExist(err) != tc.wantErr {
+				t.Errorf("commit() left %q existing: %t, want %t", added, !os.IsNotExist(err), !tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestNetworkTransactionRollbackNics(t *testing.T) {
+	transactionTestSetup(t, true, false)
+
+	svc := &mockService{}
+	ctx := context.Background()
+	tx := beginTransaction(ctx, cfg.Get(), svc, &Interfaces{}, &Interfaces{})
+	applyErr := errors.New("apply error")
+	err := tx.commit(ctx, func() error { return applyErr })
+
+	if !errors.Is(err, errConnectivityLost) || !errors.Is(err, applyErr) {
+		t.Errorf("commit() = %v, want %v and %v", err, errConnectivityLost, applyErr)
+	}
+	if !svc.rolledBack {
+		t.Errorf("commit() rolledBack = false, want true")
+	}
+}
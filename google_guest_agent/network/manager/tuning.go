@@ -0,0 +1,283 @@
+//  Copyright 2024 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// mssClampComment tags the MSS clamping rules owned by the agent.
+	mssClampComment = "google-guest-agent-mss-clamp"
+	// mssClampTable is the nftables table holding the MSS clamping rules when
+	// iptables is not available.
+	mssClampTable = "google-guest-agent-mss-clamp"
+)
+
+var (
+	// mssClamped is true once MSS clamping rules were set up since the agent
+	// started, they are removed when the clamping is disabled.
+	mssClamped bool
+)
+
+// raHandler is implemented by the network manager services processing the IPv6
+// router advertisements in userspace, they turn the kernel's processing off so
+// the agent must leave it alone.
+type raHandler interface {
+	// handlesRouterAdvertisements reports whether the service processes the
+	// router advertisements of the interfaces it manages.
+	handlesRouterAdvertisements() bool
+}
+
+// raSysctls returns the key=value sysctls making the kernel's router
+// advertisement processing of iface consistent with svc. When the kernel
+// processes them, the RAs are accepted even if forwarding is enabled so the
+// IPv6 default route survives a failover, and SLAAC is turned off since the
+// addresses are set from DHCPv6 or metadata.
+func raSysctls(config *cfg.Sections, svc Service, ni metadata.NetworkInterfaces, iface string) []string {
+	if !config.NetworkInterfaces.ManageRouterAdvertisements || len(ni.IPv6s) == 0 {
+		return nil
+	}
+	if h, ok := svc.(raHandler); ok && h.handlesRouterAdvertisements() {
+		return nil
+	}
+
+	var res []string
+	// An explicitly configured accept_ra takes precedence.
+	if config.NetworkInterfaces.AcceptRA == "" {
+		res = append(res, fmt.Sprintf("net.ipv6.conf.%s.accept_ra=2", iface))
+	}
+	return append(res, fmt.Sprintf("net.ipv6.conf.%s.autoconf=0", iface))
+}
+
+// interfaceSysctls returns the key=value network sysctls configured for iface,
+// the empty settings are left untouched.
+func interfaceSysctls(config *cfg.Sections, iface string) ([]string, error) {
+	settings := []struct {
+		key, value string
+	}{
+		{fmt.Sprintf("net.ipv4.conf.%s.rp_filter", iface), config.NetworkInterfaces.RPFilter},
+		{fmt.Sprintf("net.ipv4.conf.%s.arp_announce", iface), config.NetworkInterfaces.ARPAnnounce},
+		{fmt.Sprintf("net.ipv6.conf.%s.accept_ra", iface), config.NetworkInterfaces.AcceptRA},
+	}
+
+	var res []string
+	for _, setting := range settings {
+		if setting.value == "" {
+			continue
+		}
+		if _, err := strconv.Atoi(setting.value); err != nil {
+			return nil, fmt.Errorf("invalid %s value %q", setting.key, setting.value)
+		}
+		res = append(res, setting.key+"="+setting.value)
+	}
+	return res, nil
+}
+
+// mssClampArgs returns the iptables arguments appending (op "-A") or deleting
+// (op "-D") the rule clamping the MSS of the TCP connections forwarded
+// through iface to the path MTU.
+func mssClampArgs(op, iface string) []string {
+	return []string{"-t", "mangle", op, "FORWARD", "-o", iface, "-p", "tcp", "--tcp-flags", "SYN,RST", "SYN",
+		"-m", "comment", "--comment", mssClampComment, "-j", "TCPMSS", "--clamp-mss-to-pmtu"}
+}
+
+// parseMSSClampRules returns the interfaces of the agent's MSS clamping rules
+// listed by iptables -S.
+func parseMSSClampRules(out string) []string {
+	var res []string
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.Contains(line, mssClampComment) {
+			continue
+		}
+		fields := strings.Fields(line)
+		if i := slices.Index(fields, "-o"); i >= 0 && i+1 < len(fields) {
+			res = append(res, fields[i+1])
+		}
+	}
+	return res
+}
+
+// nftMSSClampRuleset returns the nft script replacing the agent's MSS
+// clamping table with the one clamping the MSS of the TCP connections
+// forwarded through ifaces to the path MTU, or removing it if ifaces is empty.
+func nftMSSClampRuleset(ifaces []string) string {
+	// Adding the table first makes its deletion succeed if it doesn't exist.
+	res := fmt.Sprintf("table inet %s\ndelete table inet %s\n", mssClampTable, mssClampTable)
+	if len(ifaces) == 0 {
+		return res
+	}
+	var quoted []string
+	for _, iface := range ifaces {
+		quoted = append(quoted, strconv.Quote(iface))
+	}
+	return res + fmt.Sprintf("table inet %s {\n"+
+		"\tchain forward {\n"+
+		"\t\ttype filter hook forward priority -150; policy accept;\n"+
+		"\t\toifname { %s } tcp flags & (syn|rst) == syn tcp option maxseg size set rt mtu\n"+
+		"\t}\n"+
+		"}\n", mssClampTable, strings.Join(quoted, ", "))
+}
+
+// setupNftMSSClamp replaces the agent's nftables MSS clamping table with the
+// one of ifaces.
+func setupNftMSSClamp(ctx context.Context, ifaces []string) error {
+	f, err := os.CreateTemp("", "google-guest-agent-mss-clamp-*.nft")
+	if err != nil {
+		return fmt.Errorf("failed to create nft script: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(nftMSSClampRuleset(ifaces))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write nft script: %w", err)
+	}
+
+	if len(ifaces) > 0 {
+		logger.Infof("Clamping the TCP MSS of %s to the path MTU with nft.", strings.Join(ifaces, ", "))
+	} else {
+		logger.Infof("Removing the nft MSS clamping table.")
+	}
+	if err := run.Quiet(ctx, "nft", "-f", f.Name()); err != nil {
+		return fmt.Errorf("failed to set up the nft MSS clamping table: %w", err)
+	}
+	return nil
+}
+
+// setupMSSClamp adds the MSS clamping rules of ifaces with iptables and
+// ip6tables, and removes the ones of the other interfaces. The rules are set
+// up in a nftables table when iptables is not available. Nothing is done if
+// ifaces is empty and no rules were set up since the agent started.
+func setupMSSClamp(ctx context.Context, ifaces []string) error {
+	if len(ifaces) == 0 && !mssClamped {
+		return nil
+	}
+	mssClamped = true
+
+	iptables, err := cliExists("iptables")
+	if err != nil {
+		return err
+	}
+	if !iptables {
+		nft, err := cliExists("nft")
+		if err != nil {
+			return err
+		}
+		if !nft {
+			if len(ifaces) > 0 {
+				return fmt.Errorf("neither iptables nor nft is available for MSS clamping")
+			}
+			return nil
+		}
+		if err := setupNftMSSClamp(ctx, ifaces); err != nil {
+			return err
+		}
+		mssClamped = len(ifaces) > 0
+		return nil
+	}
+
+	var errs []error
+	for _, cmd := range []string{"iptables", "ip6tables"} {
+		exists, err := cliExists(cmd)
+		if err != nil || !exists {
+			if len(ifaces) > 0 {
+				errs = append(errs, fmt.Errorf("%s is not available for MSS clamping: %v", cmd, err))
+			}
+			continue
+		}
+
+		res := run.WithOutput(ctx, cmd, "-t", "mangle", "-S", "FORWARD")
+		if res.ExitCode != 0 {
+			errs = append(errs, fmt.Errorf("failed to list %s mangle rules: %s", cmd, res.StdErr))
+			continue
+		}
+		existing := parseMSSClampRules(res.StdOut)
+
+		for _, iface := range ifaces {
+			if slices.Contains(existing, iface) {
+				continue
+			}
+			logger.Infof("Clamping the TCP MSS of %s to the path MTU with %s.", iface, cmd)
+			if err := run.Quiet(ctx, cmd, mssClampArgs("-A", iface)...); err != nil {
+				errs = append(errs, fmt.Errorf("failed to add %s MSS clamping rule of %s: %w", cmd, iface, err))
+			}
+		}
+
+		for _, iface := range existing {
+			if slices.Contains(ifaces, iface) {
+				continue
+			}
+			logger.Infof("Removing the %s MSS clamping rule of %s.", cmd, iface)
+			if err := run.Quiet(ctx, cmd, mssClampArgs("-D", iface)...); err != nil {
+				errs = append(errs, fmt.Errorf("failed to remove %s MSS clamping rule of %s: %w", cmd, iface, err))
+			}
+		}
+	}
+	// The rules are removed again on the next setup if their removal failed.
+	mssClamped = len(ifaces) > 0 || len(errs) > 0
+	return errors.Join(errs...)
+}
+
+// setupTuning applies the configured network sysctls, router advertisement
+// settings, multi-queue policy and MSS clamping to the interfaces managed by
+// the agent. ifaces are the interface names of nics' ethernet interfaces.
+func setupTuning(ctx context.Context, config *cfg.Sections, svc Service, nics *Interfaces, ifaces []string) error {
+	managed := managedInterfaces(config, ifaces)
+
+	var errs []error
+	for i, iface := range ifaces {
+		if !slices.Contains(managed, iface) || i >= len(nics.EthernetInterfaces) {
+			continue
+		}
+		sysctls, err := interfaceSysctls(config, iface)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		sysctls = append(sysctls, raSysctls(config, svc, nics.EthernetInterfaces[i], iface)...)
+		for _, val := range sysctls {
+			if err := run.Quiet(ctx, "sysctl", val); err != nil {
+				errs = append(errs, fmt.Errorf("failed to set %s: %w", val, err))
+			}
+		}
+	}
+
+	if err := setupMultiqueueTuning(ctx, config, managed); err != nil {
+		errs = append(errs, err)
+	}
+
+	var clamped []string
+	if config.NetworkInterfaces.MSSClamp {
+		clamped = managed
+	}
+	if err := setupMSSClamp(ctx, clamped); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
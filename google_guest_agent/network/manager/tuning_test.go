@@ -0,0 +1,253 @@
+//  Copyright 2024 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package manager
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestInterfaceSysctls(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+
+	got, err := interfaceSysctls(config, "eth1")
+	if err != nil || len(got) != 0 {
+		t.Errorf("interfaceSysctls(eth1) = %v, %v by default, want none", got, err)
+	}
+
+	config.NetworkInterfaces.RPFilter = "2"
+	config.NetworkInterfaces.AcceptRA = "0"
+	want := []string{"net.ipv4.conf.eth1.rp_filter=2", "net.ipv6.conf.eth1.accept_ra=0"}
+	got, err = interfaceSysctls(config, "eth1")
+	if err != nil {
+		t.Fatalf("interfaceSysctls(eth1) failed unexpectedly with error: %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("interfaceSysctls(eth1) returned unexpected diff (-want +got):\n%s", diff)
+	}
+
+	config.NetworkInterfaces.ARPAnnounce = "best"
+	if _, err := interfaceSysctls(config, "eth1"); err == nil {
+		t.Errorf("interfaceSysctls(eth1) with arp_announce %q succeeded, want error", "best")
+	}
+}
+
+// raMockService is a network manager service processing the router
+// advertisements itself.
+type raMockService struct {
+	mockService
+}
+
+func (n *raMockService) handlesRouterAdvertisements() bool {
+	return true
+}
+
+func TestRASysctls(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+	ipv6NIC := metadata.NetworkInterfaces{Mac: "a", IPv6s: []string{"2600:1900::1"}}
+
+	// The router advertisements are left alone by default.
+	if got := raSysctls(config, &mockService{}, ipv6NIC, "eth1"); len(got) != 0 {
+		t.Errorf("raSysctls() = %v by default, want none", got)
+	}
+	config.NetworkInterfaces.ManageRouterAdvertisements = true
+
+	tests := []struct {
+		name     string
+		svc      Service
+		ni       metadata.NetworkInterfaces
+		acceptRA string
+		want     []string
+	}{
+		{
+			name: "kernel_ra",
+			svc:  &mockService{},
+			ni:   ipv6NIC,
+			want: []string{"net.ipv6.conf.eth1.accept_ra=2", "net.ipv6.conf.eth1.autoconf=0"},
+		},
+		{
+			name:     "configured_accept_ra",
+			svc:      &mockService{},
+			ni:       ipv6NIC,
+			acceptRA: "0",
+			want:     []string{"net.ipv6.conf.eth1.autoconf=0"},
+		},
+		{
+			name: "ipv4_only",
+			svc:  &mockService{},
+			ni:   metadata.NetworkInterfaces{Mac: "a", IP: "10.0.0.2"},
+		},
+		{
+			name: "userspace_ra",
+			svc:  &raMockService{},
+			ni:   ipv6NIC,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config.NetworkInterfaces.AcceptRA = tc.acceptRA
+			got := raSysctls(config, tc.svc, tc.ni, "eth1")
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("raSysctls() returned unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	config.NetworkInterfaces.AcceptRA = ""
+	config.NetworkInterfaces.ManageRouterAdvertisements = false
+	if got := raSysctls(config, &mockService{}, ipv6NIC, "eth1"); len(got) != 0 {
+		t.Errorf("raSysctls() = %v with manage_router_advertisements disabled, want none", got)
+	}
+}
+
+func TestParseMSSClampRules(t *testing.T) {
+	out := "-P FORWARD ACCEPT\n" +
+		"-A FORWARD -o eth1 -p tcp -m tcp --tcp-flags SYN,RST SYN -m comment --comment google-guest-agent-mss-clamp -j TCPMSS --clamp-mss-to-pmtu\n" +
+		"-A FORWARD -o eth2 -p tcp -m tcp --tcp-flags SYN,RST SYN -j TCPMSS --set-mss 1400\n" +
+		"-A FORWARD -o eth3 -p tcp -m tcp --tcp-flags SYN,RST SYN -m comment --comment google-guest-agent-mss-clamp -j TCPMSS --clamp-mss-to-pmtu\n"
+
+	want := []string{"eth1", "eth3"}
+	if diff := cmp.Diff(want, parseMSSClampRules(out)); diff != "" {
+		t.Errorf("parseMSSClampRules() returned unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestSetupTuning(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+	config.NetworkInterfaces.MSSClamp = true
+	config.NetworkInterfaces.RPFilter = "2"
+	config.NetworkInterfaces.ManageRouterAdvertisements = true
+
+	origRunner := run.Client
+	t.Cleanup(func() {
+		run.Client = origRunner
+		execLookPath = exec.LookPath
+		mssClamped = false
+	})
+	execLookPath = func(name string) (string, error) {
+		if name == "iptables" {
+			return "/usr/sbin/iptables", nil
+		}
+		return "", exec.ErrNotFound
+	}
+
+	// eth1 is clamped already, eth3 is no longer managed.
+	runner := &policyRoutingMockRunner{
+		rules: "-A FORWARD -o eth1 -m comment --comment google-guest-agent-mss-clamp -j TCPMSS --clamp-mss-to-pmtu\n" +
+			"-A FORWARD -o eth3 -m comment --comment google-guest-agent-mss-clamp -j TCPMSS --clamp-mss-to-pmtu\n",
+	}
+	run.Client = runner
+
+	nics := &Interfaces{EthernetInterfaces: policyRoutingNICs}
+	ifaces := []string{"eth0", "eth1", "eth2", "invalid-d"}
+	err := setupTuning(context.Background(), config, &mockService{}, nics, ifaces)
+	if err == nil {
+		t.Errorf("setupTuning() succeeded without ip6tables, want error")
+	}
+
+	want := []string{
+		"sysctl net.ipv4.conf.eth1.rp_filter=2",
+		"sysctl net.ipv4.conf.eth2.rp_filter=2",
+		"sysctl net.ipv6.conf.eth2.accept_ra=2",
+		"sysctl net.ipv6.conf.eth2.autoconf=0",
+		"iptables " + strings.Join(mssClampArgs("-A", "eth2"), " "),
+		"iptables " + strings.Join(mssClampArgs("-D", "eth3"), " "),
+	}
+	if diff := cmp.Diff(want, runner.commands); diff != "" {
+		t.Errorf("setupTuning() ran unexpected commands (-want +got):\n%s", diff)
+	}
+}
+
+func TestNftMSSClampRuleset(t *testing.T) {
+	want := "table inet google-guest-agent-mss-clamp\n" +
+		"delete table inet google-guest-agent-mss-clamp\n" +
+		"table inet google-guest-agent-mss-clamp {\n" +
+		"\tchain forward {\n" +
+		"\t\ttype filter hook forward priority -150; policy accept;\n" +
+		"\t\toifname { \"eth1\", \"eth2\" } tcp flags & (syn|rst) == syn tcp option maxseg size set rt mtu\n" +
+		"\t}\n" +
+		"}\n"
+	if diff := cmp.Diff(want, nftMSSClampRuleset([]string{"eth1", "eth2"})); diff != "" {
+		t.Errorf("nftMSSClampRuleset(eth1, eth2) returned unexpected diff (-want +got):\n%s", diff)
+	}
+
+	want = "table inet google-guest-agent-mss-clamp\ndelete table inet google-guest-agent-mss-clamp\n"
+	if diff := cmp.Diff(want, nftMSSClampRuleset(nil)); diff != "" {
+		t.Errorf("nftMSSClampRuleset(nil) returned unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestSetupMSSClampNft(t *testing.T) {
+	origRunner := run.Client
+	t.Cleanup(func() {
+		run.Client = origRunner
+		execLookPath = exec.LookPath
+		mssClamped = false
+	})
+	execLookPath = func(name string) (string, error) {
+		if name == "nft" {
+			return "/usr/sbin/nft", nil
+		}
+		return "", exec.ErrNotFound
+	}
+	runner := &policyRoutingMockRunner{}
+	run.Client = runner
+	ctx := context.Background()
+
+	// Disabled from the start, nothing to remove.
+	if err := setupMSSClamp(ctx, nil); err != nil {
+		t.Fatalf("setupMSSClamp(nil) failed unexpectedly with error: %v", err)
+	}
+	if len(runner.commands) != 0 {
+		t.Errorf("setupMSSClamp(nil) ran %v, want no commands", runner.commands)
+	}
+
+	if err := setupMSSClamp(ctx, []string{"eth1"}); err != nil {
+		t.Fatalf("setupMSSClamp(eth1) failed unexpectedly with error: %v", err)
+	}
+	if err := setupMSSClamp(ctx, nil); err != nil {
+		t.Fatalf("setupMSSClamp(nil) failed unexpectedly with error: %v", err)
+	}
+	if err := setupMSSClamp(ctx, nil); err != nil {
+		t.Fatalf("setupMSSClamp(nil) failed unexpectedly with error: %v", err)
+	}
+
+	// The table is set up, then removed once.
+	if len(runner.commands) != 2 {
+		t.Fatalf("setupMSSClamp() ran %v, want 2 nft commands", runner.commands)
+	}
+	for _, cmd := range runner.commands {
+		if !strings.HasPrefix(cmd, "nft -f ") {
+			t.Errorf("setupMSSClamp() ran %q, want nft -f", cmd)
+		}
+	}
+}
@@ -40,6 +40,12 @@ type wicked struct {
 	wickedCommand string
 }
 
+func init() {
+	registerService(20, &wicked{
+		configDir: defaultWickedConfigDir,
+	})
+}
+
 const (
 	// defaultWickedConfigDir is the default location for wicked configuration files.
 	defaultWickedConfigDir = "/etc/sysconfig/network"
@@ -91,17 +97,27 @@ func (n *wicked) IsManaging(ctx context.Context, iface string) (bool, error) {
 }
 
 // SetupEthernetInterface writes the necessary configuration files for each interface and enables them.
-func (n *wicked) SetupEthernetInterface(ctx context.Context, cfg *cfg.Sections, nics *Interfaces) error {
-	ifaces, err := interfaceNames(nics.EthernetInterfaces)
+func (n *wicked) SetupEthernetInterface(ctx context.Context, config *cfg.Sections, nics *Interfaces) error {
+	ifaces, err := interfaceNames(config, nics.EthernetInterfaces)
 	if err != nil {
 		return fmt.Errorf("failed to get network interfaces: %v", err)
 	}
 
-	changed, err := n.writeEthernetConfigs(ifaces)
+	mtuMap, err := interfacesMTUMap(config, nics.EthernetInterfaces)
+	if err != nil {
+		return fmt.Errorf("error listing interface's MTU configuration: %w", err)
+	}
+
+	changed, err := n.writeEthernetConfigs(config, mtuMap, ifaces, ipv6OnlyInterfaces(config, nics.EthernetInterfaces))
 	if err != nil {
 		return fmt.Errorf("error writing wicked configurations: %v", err)
 	}
 
+	// ifcfg files have no per interface DNS configuration.
+	if err := setResolverDNS(ctx, config, nics.EthernetInterfaces); err != nil {
+		logger.Errorf("Failed to set interfaces DNS configuration: %v", err)
+	}
+
 	// https://manpages.opensuse.org/Tumbleweed/wicked/wicked.8.en.html#ifreload_-_checks_whether_a_configuration_has_changed,_and_applies_accordingly.
 	// Only apply configuration changes for interfaces for which configurations
 	// were written or changed.
@@ -212,7 +228,7 @@ func (n *wicked) cleanupVlanInterfaces(ctx context.Context, keepMe []string) err
 
 // writeEthernetConfigs writes config files for the given ifaces in the given configuration
 // directory.
-func (n *wicked) writeEthernetConfigs(ifaces []string) ([]string, error) {
+func (n *wicked) writeEthernetConfigs(config *cfg.Sections, mtuMap map[string]int, ifaces, ipv6OnlyInterfaces []string) ([]string, error) {
 	var priority = 10100
 	var changed []string
 
@@ -222,7 +238,7 @@ func (n *wicked) writeEthernetConfigs(ifaces []string) ([]string, error) {
 			logger.Debugf("ManagePrimaryNIC is disabled, skipping wicked writeEthernetConfig for %s", iface)
 			continue
 		}
-		if isInvalid(iface) {
+		if isInvalid(config, iface) {
 			continue
 		}
 		logger.Debugf("write enabling ifcfg-%s config", iface)
@@ -234,13 +250,21 @@ func (n *wicked) writeEthernetConfigs(ifaces []string) ([]string, error) {
 			continue
 		}
 
+		// NOTE: 'dhcp' is the dhcp4+dhcp6 option.
+		bootProto := "dhcp"
+		if slices.Contains(ipv6OnlyInterfaces, iface) {
+			bootProto = "dhcp6"
+		}
+
 		contents := []string{
 			googleComment,
 			"STARTMODE=hotplug",
-			// NOTE: 'dhcp' is the dhcp4+dhcp6 option.
-			"BOOTPROTO=dhcp",
+			"BOOTPROTO=" + bootProto,
 			fmt.Sprintf("DHCLIENT_ROUTE_PRIORITY=%d", priority),
 		}
+		if mtu := mtuMap[iface]; mtu > 0 {
+			contents = append(contents, fmt.Sprintf("MTU=%d", mtu))
+		}
 		contentBytes := []byte(strings.Join(contents, "\n"))
 
 		// Write the file.
@@ -258,6 +282,50 @@ func (n *wicked) ifcfgFilePath(iface string) string {
 	return filepath.Join(n.configDir, fmt.Sprintf("ifcfg-%s", iface))
 }
 
+// configFiles returns the ifcfg files written for nics.
+func (n *wicked) configFiles(config *cfg.Sections, nics *Interfaces) []string {
+	ifaces, err := interfaceNames(config, nics.EthernetInterfaces)
+	if err != nil {
+		logger.Warningf("Failed to get interface names: %v", err)
+	}
+
+	var res []string
+	for _, iface := range managedInterfaces(config, ifaces) {
+		res = append(res, n.ifcfgFilePath(iface))
+	}
+	for _, curr := range nics.VlanInterfaces {
+		res = append(res, n.ifcfgFilePath(fmt.Sprintf("gcp.%s.%d", curr.ParentInterfaceID, curr.Vlan)))
+	}
+	return res
+}
+
+// reload makes wicked apply the ifcfg files of nics again.
+func (n *wicked) reload(ctx context.Context, config *cfg.Sections, nics *Interfaces) error {
+	ifaces, err := interfaceNames(config, nics.EthernetInterfaces)
+	if err != nil {
+		return fmt.Errorf("error getting interfaces: %v", err)
+	}
+
+	args := append([]string{"ifreload"}, managedInterfaces(config, ifaces)...)
+	for _, curr := range nics.VlanInterfaces {
+		args = append(args, fmt.Sprintf("gcp.%s.%d", curr.ParentInterfaceID, curr.Vlan))
+	}
+	if len(args) == 1 {
+		return nil
+	}
+	if err := run.Quiet(ctx, n.wickedCommand, args...); err != nil {
+		return fmt.Errorf("error reloading interfaces: %v", err)
+	}
+	return nil
+}
+
+// withConfigRoot implements the dryRunner interface.
+func (n *wicked) withConfigRoot(root string) (Service, []string) {
+	res := *n
+	res.configDir = filepath.Join(root, n.configDir)
+	return &res, []string{n.configDir}
+}
+
 func (n *wicked) removeInterface(ctx context.Context, iface string) error {
 	configFilePath := n.ifcfgFilePath(iface)
 
@@ -313,13 +381,13 @@ func (n *wicked) removeInterface(ctx context.Context, iface string) error {
 }
 
 // Rollback deletes all the ifcfg files written by Setup, then reloads wicked.service.
-func (n *wicked) Rollback(ctx context.Context, nics *Interfaces) error {
-	if err := n.RollbackNics(ctx, nics); err != nil {
+func (n *wicked) Rollback(ctx context.Context, config *cfg.Sections, nics *Interfaces) error {
+	if err := n.RollbackNics(ctx, config, nics); err != nil {
 		return fmt.Errorf("failed to rollback wicked ethernet interfaces: %w", err)
 	}
 
 	for _, curr := range nics.VlanInterfaces {
-		iface := fmt.Sprintf("%s.%d", curr.ParentInterfaceID, curr.Vlan)
+		iface := fmt.Sprintf("gcp.%s.%d", curr.ParentInterfaceID, curr.Vlan)
 		if err := n.removeInterface(ctx, iface); err != nil {
 			return fmt.Errorf("failed to rollback wicked vlan ethernet interface: %+v", err)
 		}
@@ -330,8 +398,8 @@ func (n *wicked) Rollback(ctx context.Context, nics *Interfaces) error {
 
 // Rollback deletes all the ifcfg files written by Setup for regular nics only,
 // then reloads wicked.service.
-func (n *wicked) RollbackNics(ctx context.Context, nics *Interfaces) error {
-	ifaces, err := interfaceNames(nics.EthernetInterfaces)
+func (n *wicked) RollbackNics(ctx context.Context, config *cfg.Sections, nics *Interfaces) error {
+	ifaces, err := interfaceNames(config, nics.EthernetInterfaces)
 	if err != nil {
 		return fmt.Errorf("failed to get network interfaces: %v", err)
 	}
@@ -27,6 +27,7 @@ import (
 
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
 )
 
 var (
@@ -123,6 +124,10 @@ func (w wickedMockRunner) WithCombinedOutput(ctx context.Context, name string, a
 // wickedTestSetup sets up the environment for each test using the provided options.
 func wickedTestSetup(t *testing.T, opts wickedTestOpts) {
 	t.Helper()
+	// The teardown restores the mocks, the runner is restored once the test
+	// finished.
+	origClient := run.Client
+	t.Cleanup(func() { run.Client = origClient })
 
 	// Change the configuration directory of the mock wicked service.
 	tempDir := path.Join(t.TempDir(), "sysconfig", "network")
@@ -141,7 +146,6 @@ func wickedTestSetup(t *testing.T, opts wickedTestOpts) {
 func wickedTestTearDown(t *testing.T) {
 	t.Helper()
 
-	run.Client = &run.Runner{}
 }
 
 // TestIsManaging tests whether IsManaging returns expected values provided
@@ -242,6 +246,7 @@ func TestWriteEthernetConfigs(t *testing.T) {
 	if err := cfg.Load(nil); err != nil {
 		t.Errorf("cfg.Load(nil) failed unexpectedly with error: %v", err)
 	}
+	config := cfg.Get()
 
 	tests := []struct {
 		// name is the name of the test.
@@ -281,7 +286,7 @@ func TestWriteEthernetConfigs(t *testing.T) {
 		t.Run(test.name, func(t *testing.T) {
 			wickedTestSetup(t, wickedTestOpts{})
 
-			written, err := mockWicked.writeEthernetConfigs(test.testInterfaces)
+			written, err := mockWicked.writeEthernetConfigs(config, nil, test.testInterfaces, nil)
 			if err != nil {
 				t.Fatalf("unexpected error: %v", err)
 			}
@@ -324,3 +329,63 @@ func TestWriteEthernetConfigs(t *testing.T) {
 		})
 	}
 }
+
+// TestWriteEthernetConfigsIPv6Only tests that IPv6-only interfaces only use DHCPv6.
+func TestWriteEthernetConfigsIPv6Only(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Errorf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+
+	wickedTestSetup(t, wickedTestOpts{})
+	defer wickedTestTearDown(t)
+
+	if _, err := mockWicked.writeEthernetConfigs(config, nil, []string{"iface0", "iface1", "iface2"}, []string{"iface2"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := map[string]string{"iface1": "BOOTPROTO=dhcp", "iface2": "BOOTPROTO=dhcp6"}
+	for iface, bootProto := range want {
+		contents, err := os.ReadFile(mockWicked.ifcfgFilePath(iface))
+		if err != nil {
+			t.Fatalf("error reading config file of %s: %v", iface, err)
+		}
+		if !slices.Contains(strings.Split(string(contents), "\n"), bootProto) {
+			t.Errorf("config file of %s is %q, want it to contain %q", iface, contents, bootProto)
+		}
+	}
+}
+
+// TestRollbackVlan tests that Rollback removes the VLAN interfaces' ifcfg
+// files written by SetupVlanInterface.
+func TestRollbackVlan(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+
+	wickedTestSetup(t, wickedTestOpts{})
+	defer wickedTestTearDown(t)
+
+	nics := &Interfaces{
+		EthernetInterfaces: []metadata.NetworkInterfaces{{Mac: "invalid-mac"}},
+		VlanInterfaces: map[string]VlanInterface{
+			"0-5": {
+				VlanInterface:     metadata.VlanInterface{Vlan: 5},
+				ParentInterfaceID: "eth1",
+			},
+		},
+	}
+
+	vlanFile := mockWicked.ifcfgFilePath("gcp.eth1.5")
+	if err := os.WriteFile(vlanFile, []byte(googleComment+"\nETHERDEVICE=eth1\n"), 0644); err != nil {
+		t.Fatalf("os.WriteFile(%q) failed: %v", vlanFile, err)
+	}
+
+	if err := mockWicked.Rollback(context.Background(), config, nics); err != nil {
+		t.Fatalf("Rollback(ctx, %+v) failed unexpectedly with error: %v", nics, err)
+	}
+	if _, err := os.Stat(vlanFile); !os.IsNotExist(err) {
+		t.Errorf("Rollback(ctx, %+v) left %q behind", nics, vlanFile)
+	}
+}
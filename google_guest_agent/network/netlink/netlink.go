@@ -0,0 +1,42 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package netlink programs the kernel's routes through netlink rather than
+// running the ip command, the routes are accessed through Client.
+package netlink
+
+import (
+	"net"
+)
+
+var (
+	// Client is the netlink implementation programming the routes, it's
+	// replaced by a fake in tests.
+	Client Interface = newClient()
+)
+
+// Interface defines the route operations the agent needs.
+type Interface interface {
+	// LocalRoutes returns the destinations of the local routes of iface
+	// installed with the routing protocol proto.
+	LocalRoutes(iface string, proto int) ([]*net.IPNet, error)
+
+	// AddLocalRoute adds a local route to dst on iface with the routing
+	// protocol proto, IPv4 routes have the host scope.
+	AddLocalRoute(dst *net.IPNet, iface string, proto int) error
+
+	// DeleteLocalRoute deletes the local route to dst on iface with the
+	// routing protocol proto.
+	DeleteLocalRoute(dst *net.IPNet, iface string, proto int) error
+}
@@ -0,0 +1,340 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package netlink
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// seq is the sequence number of the last netlink request.
+var seq atomic.Uint32
+
+// handle implements Interface with rtnetlink requests.
+type handle struct{}
+
+// newClient returns the rtnetlink implementation.
+func newClient() Interface {
+	return handle{}
+}
+
+// attribute is a route attribute (rtattr) of a request.
+type attribute struct {
+	typ   uint16
+	value []byte
+}
+
+// message is a netlink message received from the kernel.
+type message struct {
+	typ  uint16
+	seq  uint32
+	data []byte
+}
+
+// route is the part of a RTM_NEWROUTE message the agent cares about.
+type route struct {
+	family   uint8
+	dstLen   uint8
+	table    uint32
+	protocol uint8
+	scope    uint8
+	typ      uint8
+	dst      net.IP
+	oif      uint32
+}
+
+// align rounds l up to the netlink alignment (4 bytes).
+func align(l int) int {
+	return (l + unix.NLMSG_ALIGNTO - 1) & ^(unix.NLMSG_ALIGNTO - 1)
+}
+
+// marshalRequest encodes a route request, the message header, the rtmsg
+// and its attributes.
+func marshalRequest(typ, flags uint16, seq uint32, rtm *unix.RtMsg, attrs []attribute) []byte {
+	b := make([]byte, unix.NLMSG_HDRLEN+unix.SizeofRtMsg)
+
+	body := b[unix.NLMSG_HDRLEN:]
+	body[0] = rtm.Family
+	body[1] = rtm.Dst_len
+	body[2] = rtm.Src_len
+	body[3] = rtm.Tos
+	body[4] = rtm.Table
+	body[5] = rtm.Protocol
+	body[6] = rtm.Scope
+	body[7] = rtm.Type
+	binary.NativeEndian.PutUint32(body[8:12], rtm.Flags)
+
+	for _, attr := range attrs {
+		l := unix.SizeofRtAttr + len(attr.value)
+		a := make([]byte, align(l))
+		binary.NativeEndian.PutUint16(a[0:2], uint16(l))
+		binary.NativeEndian.PutUint16(a[2:4], attr.typ)
+		copy(a[unix.SizeofRtAttr:], attr.value)
+		b = append(b, a...)
+	}
+
+	binary.NativeEndian.PutUint32(b[0:4], uint32(len(b)))
+	binary.NativeEndian.PutUint16(b[4:6], typ)
+	binary.NativeEndian.PutUint16(b[6:8], flags)
+	binary.NativeEndian.PutUint32(b[8:12], seq)
+	return b
+}
+
+// parseMessages splits b in netlink messages.
+func parseMessages(b []byte) ([]message, error) {
+	var res []message
+	for len(b) >= unix.NLMSG_HDRLEN {
+		l := int(binary.NativeEndian.Uint32(b[0:4]))
+		if l < unix.NLMSG_HDRLEN || l > len(b) {
+			return nil, fmt.Errorf("invalid netlink message length %d", l)
+		}
+		res = append(res, message{
+			typ:  binary.NativeEndian.Uint16(b[4:6]),
+			seq:  binary.NativeEndian.Uint32(b[8:12]),
+			data: b[unix.NLMSG_HDRLEN:l],
+		})
+		if align(l) >= len(b) {
+			break
+		}
+		b = b[align(l):]
+	}
+	return res, nil
+}
+
+// parseRoute decodes the rtmsg and the attributes of a RTM_NEWROUTE message.
+func parseRoute(data []byte) (*route, error) {
+	if len(data) < unix.SizeofRtMsg {
+		return nil, fmt.Errorf("route message too short: %d bytes", len(data))
+	}
+
+	r := &route{
+		family:   data[0],
+		dstLen:   data[1],
+		table:    uint32(data[4]),
+		protocol: data[5],
+		scope:    data[6],
+		typ:      data[7],
+	}
+
+	b := data[unix.SizeofRtMsg:]
+	for len(b) >= unix.SizeofRtAttr {
+		l := int(binary.NativeEndian.Uint16(b[0:2]))
+		if l < unix.SizeofRtAttr || l > len(b) {
+			return nil, fmt.Errorf("invalid route attribute length %d", l)
+		}
+		value := b[unix.SizeofRtAttr:l]
+
+		switch binary.NativeEndian.Uint16(b[2:4]) {
+		case unix.RTA_DST:
+			r.dst = net.IP(append([]byte(nil), value...))
+		case unix.RTA_OIF:
+			if len(value) >= 4 {
+				r.oif = binary.NativeEndian.Uint32(value)
+			}
+		case unix.RTA_TABLE:
+			if len(value) >= 4 {
+				r.table = binary.NativeEndian.Uint32(value)
+			}
+		}
+
+		if align(l) >= len(b) {
+			break
+		}
+		b = b[align(l):]
+	}
+
+	return r, nil
+}
+
+// request sends a route request to the kernel and returns its replies. An
+// acknowledgement carrying an error is returned as a syscall.Errno.
+func request(typ, flags uint16, rtm *unix.RtMsg, attrs []attribute) ([]message, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netlink socket: %w", err)
+	}
+	defer unix.Close(fd)
+
+	kernel := &unix.SockaddrNetlink{Family: unix.AF_NETLINK}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, fmt.Errorf("failed to bind netlink socket: %w", err)
+	}
+
+	id := seq.Add(1)
+	if err := unix.Sendto(fd, marshalRequest(typ, unix.NLM_F_REQUEST|flags, id, rtm, attrs), 0, kernel); err != nil {
+		return nil, fmt.Errorf("failed to send netlink request: %w", err)
+	}
+
+	var res []message
+	buf := make([]byte, 8*os.Getpagesize())
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read netlink reply: %w", err)
+		}
+
+		msgs, err := parseMessages(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, msg := range msgs {
+			if msg.seq != id {
+				continue
+			}
+
+			switch msg.typ {
+			case unix.NLMSG_DONE:
+				return res, nil
+			case unix.NLMSG_ERROR:
+				if len(msg.data) < 4 {
+					return nil, errors.New("truncated netlink error message")
+				}
+				if code := int32(binary.NativeEndian.Uint32(msg.data[0:4])); code != 0 {
+					return nil, syscall.Errno(-code)
+				}
+				return res, nil
+			default:
+				// Copy the data out, buf is reused by the next read.
+				msg.data = append([]byte(nil), msg.data...)
+				res = append(res, msg)
+			}
+		}
+	}
+}
+
+// localRouteRequest returns the rtmsg and the attributes describing the
+// local route to dst on the interface index.
+func localRouteRequest(dst *net.IPNet, index int, proto int) (*unix.RtMsg, []attribute, error) {
+	family, scope, ip := uint8(unix.AF_INET), uint8(unix.RT_SCOPE_HOST), dst.IP.Mask(dst.Mask).To4()
+	if ip == nil {
+		family, scope, ip = unix.AF_INET6, unix.RT_SCOPE_UNIVERSE, dst.IP.Mask(dst.Mask).To16()
+	}
+	if ip == nil {
+		return nil, nil, fmt.Errorf("invalid route destination %q", dst)
+	}
+
+	ones, bits := dst.Mask.Size()
+	if bits != len(ip)*8 {
+		return nil, nil, fmt.Errorf("invalid route destination mask %q", dst)
+	}
+
+	oif := make([]byte, 4)
+	binary.NativeEndian.PutUint32(oif, uint32(index))
+
+	rtm := &unix.RtMsg{
+		Family:   family,
+		Dst_len:  uint8(ones),
+		Table:    unix.RT_TABLE_LOCAL,
+		Protocol: uint8(proto),
+		Scope:    scope,
+		Type:     unix.RTN_LOCAL,
+	}
+
+	attrs := []attribute{
+		{typ: unix.RTA_DST, value: ip},
+		{typ: unix.RTA_OIF, value: oif},
+	}
+
+	return rtm, attrs, nil
+}
+
+// LocalRoutes dumps the IPv4 and IPv6 routes and returns the local ones of
+// iface installed with the protocol proto.
+func (handle) LocalRoutes(iface string, proto int) ([]*net.IPNet, error) {
+	link, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get interface %q: %w", iface, err)
+	}
+
+	var res []*net.IPNet
+	for _, family := range []uint8{unix.AF_INET, unix.AF_INET6} {
+		msgs, err := request(unix.RTM_GETROUTE, unix.NLM_F_DUMP, &unix.RtMsg{Family: family}, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list routes: %w", err)
+		}
+
+		for _, msg := range msgs {
+			if msg.typ != unix.RTM_NEWROUTE {
+				continue
+			}
+
+			r, err := parseRoute(msg.data)
+			if err != nil {
+				return nil, err
+			}
+
+			if !localRouteMatches(r, link.Index, proto) {
+				continue
+			}
+
+			bits := 8 * len(r.dst)
+			res = append(res, &net.IPNet{IP: r.dst, Mask: net.CIDRMask(int(r.dstLen), bits)})
+		}
+	}
+
+	return res, nil
+}
+
+// localRouteMatches reports whether r is a local route on the interface
+// index installed with the protocol proto, IPv4 ones must have the host
+// scope.
+func localRouteMatches(r *route, index int, proto int) bool {
+	if r.table != unix.RT_TABLE_LOCAL || r.typ != unix.RTN_LOCAL || r.dst == nil {
+		return false
+	}
+	if int(r.protocol) != proto || int(r.oif) != index {
+		return false
+	}
+	return r.family != unix.AF_INET || r.scope == unix.RT_SCOPE_HOST
+}
+
+// AddLocalRoute adds the local route to dst on iface.
+func (handle) AddLocalRoute(dst *net.IPNet, iface string, proto int) error {
+	return localRoute(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_EXCL, dst, iface, proto)
+}
+
+// DeleteLocalRoute deletes the local route to dst on iface.
+func (handle) DeleteLocalRoute(dst *net.IPNet, iface string, proto int) error {
+	return localRoute(unix.RTM_DELROUTE, 0, dst, iface, proto)
+}
+
+// localRoute sends the acknowledged route request typ for the local route
+// to dst on iface.
+func localRoute(typ, flags uint16, dst *net.IPNet, iface string, proto int) error {
+	link, err := net.InterfaceByName(iface)
+	if err != nil {
+		return fmt.Errorf("failed to get interface %q: %w", iface, err)
+	}
+
+	rtm, attrs, err := localRouteRequest(dst, link.Index, proto)
+	if err != nil {
+		return err
+	}
+
+	if _, err := request(typ, flags|unix.NLM_F_ACK, rtm, attrs); err != nil {
+		return fmt.Errorf("route request for %s on %s failed: %w", dst, iface, err)
+	}
+	return nil
+}
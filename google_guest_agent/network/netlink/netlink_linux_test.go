@@ -0,0 +1,135 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package netlink
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestLocalRouteRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		dst    string
+		family uint8
+		scope  uint8
+		dstLen uint8
+		ip     string
+	}{
+		{
+			name:   "ipv4_host",
+			dst:    "10.138.0.13/32",
+			family: unix.AF_INET,
+			scope:  unix.RT_SCOPE_HOST,
+			dstLen: 32,
+			ip:     "10.138.0.13",
+		},
+		{
+			name:   "ipv4_range",
+			dst:    "10.1.0.0/24",
+			family: unix.AF_INET,
+			scope:  unix.RT_SCOPE_HOST,
+			dstLen: 24,
+			ip:     "10.1.0.0",
+		},
+		{
+			name:   "ipv6_range",
+			dst:    "2600:1900::/96",
+			family: unix.AF_INET6,
+			scope:  unix.RT_SCOPE_UNIVERSE,
+			dstLen: 96,
+			ip:     "2600:1900::",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, dst, err := net.ParseCIDR(tc.dst)
+			if err != nil {
+				t.Fatalf("net.ParseCIDR(%q) failed unexpectedly with error: %v", tc.dst, err)
+			}
+
+			rtm, attrs, err := localRouteRequest(dst, 2, 66)
+			if err != nil {
+				t.Fatalf("localRouteRequest(%s, 2, 66) failed unexpectedly with error: %v", dst, err)
+			}
+
+			b := marshalRequest(unix.RTM_NEWROUTE, unix.NLM_F_REQUEST, 7, rtm, attrs)
+			msgs, err := parseMessages(b)
+			if err != nil {
+				t.Fatalf("parseMessages() failed unexpectedly with error: %v", err)
+			}
+			if len(msgs) != 1 || msgs[0].typ != unix.RTM_NEWROUTE || msgs[0].seq != 7 {
+				t.Fatalf("parseMessages() = %+v, want one RTM_NEWROUTE message with seq 7", msgs)
+			}
+
+			r, err := parseRoute(msgs[0].data)
+			if err != nil {
+				t.Fatalf("parseRoute() failed unexpectedly with error: %v", err)
+			}
+
+			if r.family != tc.family || r.scope != tc.scope || r.dstLen != tc.dstLen {
+				t.Errorf("parseRoute() = family %d, scope %d, dst len %d, want %d, %d, %d", r.family, r.scope, r.dstLen, tc.family, tc.scope, tc.dstLen)
+			}
+			if !r.dst.Equal(net.ParseIP(tc.ip)) {
+				t.Errorf("parseRoute() dst = %s, want %s", r.dst, tc.ip)
+			}
+			if !localRouteMatches(r, 2, 66) {
+				t.Errorf("localRouteMatches(%+v, 2, 66) = false, want true", r)
+			}
+			if localRouteMatches(r, 3, 66) || localRouteMatches(r, 2, 2) {
+				t.Errorf("localRouteMatches(%+v) matched a different interface or protocol", r)
+			}
+		})
+	}
+}
+
+func TestLocalRouteRequestInvalid(t *testing.T) {
+	dst := &net.IPNet{IP: net.ParseIP("10.0.0.1").To4(), Mask: net.CIDRMask(64, 128)}
+	if _, _, err := localRouteRequest(dst, 1, 66); err == nil {
+		t.Errorf("localRouteRequest(%s, 1, 66) succeeded, want error", dst)
+	}
+}
+
+func TestParseMessagesInvalid(t *testing.T) {
+	b := make([]byte, unix.NLMSG_HDRLEN)
+	binary.NativeEndian.PutUint32(b[0:4], 64)
+
+	if _, err := parseMessages(b); err == nil {
+		t.Errorf("parseMessages() succeeded on a truncated message, want error")
+	}
+}
+
+func TestLocalRouteMatchesScope(t *testing.T) {
+	r := &route{
+		family:   syscall.AF_INET,
+		table:    unix.RT_TABLE_LOCAL,
+		typ:      unix.RTN_LOCAL,
+		protocol: 66,
+		scope:    unix.RT_SCOPE_UNIVERSE,
+		dst:      net.ParseIP("10.0.0.1").To4(),
+		oif:      2,
+	}
+
+	if localRouteMatches(r, 2, 66) {
+		t.Errorf("localRouteMatches(%+v, 2, 66) = true for a non host scoped IPv4 route, want false", r)
+	}
+}
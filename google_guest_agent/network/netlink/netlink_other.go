@@ -0,0 +1,48 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+
+package netlink
+
+import (
+	"errors"
+	"net"
+)
+
+// errUnsupported is returned by all the operations on non Linux systems.
+var errUnsupported = errors.New("netlink is only supported on Linux")
+
+// unsupported implements Interface on non Linux systems.
+type unsupported struct{}
+
+// newClient returns the unsupported implementation.
+func newClient() Interface {
+	return unsupported{}
+}
+
+// LocalRoutes is not supported.
+func (unsupported) LocalRoutes(string, int) ([]*net.IPNet, error) {
+	return nil, errUnsupported
+}
+
+// AddLocalRoute is not supported.
+func (unsupported) AddLocalRoute(*net.IPNet, string, int) error {
+	return errUnsupported
+}
+
+// DeleteLocalRoute is not supported.
+func (unsupported) DeleteLocalRoute(*net.IPNet, string, int) error {
+	return errUnsupported
+}
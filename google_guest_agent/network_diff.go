@@ -0,0 +1,179 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	network "github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/network/manager"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+// networkDiffAction is the subcommand printing the changes the agent would make
+// to the network configuration.
+const networkDiffAction = "network-diff"
+
+// nicDiff describes the changes to the routes and addresses of a NIC.
+type nicDiff struct {
+	// iface is the NIC's interface name.
+	iface string
+	// addRoutes are the forwarded IPs and alias ranges to route to the NIC.
+	addRoutes []string
+	// removeRoutes are the routes to remove.
+	removeRoutes []string
+	// missingAddrs are the metadata addresses not set on the NIC.
+	missingAddrs []string
+}
+
+// empty returns whether d has no change.
+func (d nicDiff) empty() bool {
+	return len(d.addRoutes) == 0 && len(d.removeRoutes) == 0 && len(d.missingAddrs) == 0
+}
+
+// diffNIC compares the routes and addresses of iface with the ones metadata
+// describes for ni.
+func diffNIC(config *cfg.Sections, ni metadata.NetworkInterfaces, iface string, routes, addrs []string) nicDiff {
+	res := nicDiff{iface: iface}
+	if config.NetworkInterfaces.IPForwarding {
+		res.addRoutes, res.removeRoutes = compareRoutes(trimSuffix32(routes), trimSuffix32(wantForwardedIPs(config, ni)))
+	}
+
+	for _, addr := range append([]string{ni.IP}, ni.IPv6s...) {
+		if addr != "" && !slices.Contains(addrs, addr) {
+			res.missingAddrs = append(res.missingAddrs, addr)
+		}
+	}
+	return res
+}
+
+// interfaceAddrs returns the addresses of iface without their prefix length.
+func interfaceAddrs(iface net.Interface) ([]string, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var res []string
+	for _, addr := range addrs {
+		res = append(res, strings.SplitN(addr.String(), "/", 2)[0])
+	}
+	return res, nil
+}
+
+// writeNetworkDiff prints plan and diffs to w.
+func writeNetworkDiff(w io.Writer, plan *network.Plan, diffs []nicDiff) {
+	if plan != nil {
+		fmt.Fprintf(w, "Network manager: %s\n", plan.Manager)
+		for _, path := range plan.SortedFiles() {
+			fmt.Fprintf(w, "\n--- %s\n%s", path, plan.Files[path])
+		}
+		if len(plan.Commands) > 0 {
+			fmt.Fprintf(w, "\nCommands:\n")
+			for _, cmd := range plan.Commands {
+				fmt.Fprintf(w, "  %s\n", cmd)
+			}
+		}
+	}
+
+	for _, d := range diffs {
+		if d.empty() {
+			continue
+		}
+		fmt.Fprintf(w, "\nInterface %s:\n", d.iface)
+		for _, route := range d.addRoutes {
+			fmt.Fprintf(w, "  +route %s\n", route)
+		}
+		for _, route := range d.removeRoutes {
+			fmt.Fprintf(w, "  -route %s\n", route)
+		}
+		for _, addr := range d.missingAddrs {
+			fmt.Fprintf(w, "  +address %s\n", addr)
+		}
+	}
+}
+
+// networkDiff prints the changes the agent would make to the network
+// configuration for the current metadata, without applying them. It returns
+// the process exit code.
+func networkDiff(ctx context.Context, w io.Writer) int {
+	opts := logger.LogOpts{LoggerName: programName, DisableCloudLogging: true, DisableLocalLogging: true}
+	opts.FormatFunction = logFormat
+	opts.Writers = []io.Writer{os.Stderr}
+	if err := logger.Init(ctx, opts); err != nil {
+		fmt.Fprintf(os.Stderr, "Error initializing logger: %v\n", err)
+		return 1
+	}
+	defer logger.Close()
+
+	config := cfg.Get()
+	md, err := metadata.New().Get(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get metadata: %v\n", err)
+		return 1
+	}
+
+	var plan *network.Plan
+	// Guest Agent does not manage interfaces on Windows.
+	if runtime.GOOS != "windows" {
+		plan, err = network.DryRun(ctx, config, md)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to compute the network configuration: %v\n", err)
+		}
+	}
+
+	var diffs []nicDiff
+	for _, ni := range md.Instance.NetworkInterfaces {
+		iface, err := network.GetInterfaceByMAC(config, ni.Mac)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to get interface %s: %v\n", ni.Mac, err)
+			continue
+		}
+
+		addrs, err := interfaceAddrs(iface)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to get the addresses of %s: %v\n", iface.Name, err)
+			continue
+		}
+
+		var routes []string
+		if runtime.GOOS == "windows" {
+			// getForwardsFromRegistry migrates the old registry entries, only
+			// read them.
+			routes, err = readRegMultiString(addressKey, ni.Mac)
+			if err == errRegNotExist {
+				err = nil
+			}
+		} else {
+			routes, err = getLocalRoutes(ctx, config, iface.Name)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to get the routes of %s: %v\n", iface.Name, err)
+			continue
+		}
+		diffs = append(diffs, diffNIC(config, ni, iface.Name, routes, addrs))
+	}
+
+	writeNetworkDiff(w, plan, diffs)
+	return 0
+}
@@ -0,0 +1,78 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	network "github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/network/manager"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDiffNIC(t *testing.T) {
+	config := &cfg.Sections{
+		NetworkInterfaces: &cfg.NetworkInterfaces{IPForwarding: true},
+		IPForwarding:      &cfg.IPForwarding{},
+	}
+	ni := metadata.NetworkInterfaces{
+		IP:           "10.0.0.2",
+		IPv6s:        []string{"2600:1900::2"},
+		ForwardedIps: []string{"10.0.0.10", "10.0.0.11"},
+	}
+
+	got := diffNIC(config, ni, "eth0", []string{"10.0.0.11/32", "10.0.0.12"}, []string{"10.0.0.2", "fe80::1"})
+	want := nicDiff{
+		iface:        "eth0",
+		addRoutes:    []string{"10.0.0.10"},
+		removeRoutes: []string{"10.0.0.12"},
+		missingAddrs: []string{"2600:1900::2"},
+	}
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(nicDiff{})); diff != "" {
+		t.Errorf("diffNIC() returned unexpected diff (-want +got):\n%s", diff)
+	}
+
+	config.NetworkInterfaces.IPForwarding = false
+	got = diffNIC(config, ni, "eth0", nil, []string{"10.0.0.2", "2600:1900::2"})
+	if !got.empty() {
+		t.Errorf("diffNIC() = %+v with IP forwarding disabled, want no change", got)
+	}
+}
+
+func TestWriteNetworkDiff(t *testing.T) {
+	plan := &network.Plan{
+		Manager:  "systemd-networkd",
+		Files:    map[string]string{"/etc/b.network": "+MTU=1460\n", "/etc/a.network": "-[Match]\n"},
+		Commands: []string{"networkctl reload"},
+	}
+	diffs := []nicDiff{
+		{iface: "eth0"},
+		{iface: "eth1", addRoutes: []string{"10.1.0.10"}, missingAddrs: []string{"10.1.0.2"}},
+	}
+
+	var buf bytes.Buffer
+	writeNetworkDiff(&buf, plan, diffs)
+
+	want := "Network manager: systemd-networkd\n" +
+		"\n--- /etc/a.network\n-[Match]\n" +
+		"\n--- /etc/b.network\n+MTU=1460\n" +
+		"\nCommands:\n  networkctl reload\n" +
+		"\nInterface eth1:\n  +route 10.1.0.10\n  +address 10.1.0.2\n"
+	if diff := cmp.Diff(want, buf.String()); diff != "" {
+		t.Errorf("writeNetworkDiff() returned unexpected diff (-want +got):\n%s", diff)
+	}
+}
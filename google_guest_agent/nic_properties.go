@@ -0,0 +1,129 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	network "github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/network/manager"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+var (
+	// nicPropertyKeywordExp matches the registry keywords of the NIC advanced
+	// properties, i.e. *JumboPacket.
+	nicPropertyKeywordExp = regexp.MustCompile(`^\*?[A-Za-z0-9_]+$`)
+	// nicPropertyValueExp matches the registry values of the NIC advanced
+	// properties.
+	nicPropertyValueExp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+)
+
+// nicProperty is a Windows NIC advanced property.
+type nicProperty struct {
+	// keyword is the property's registry keyword.
+	keyword string
+	// value is the property's registry value.
+	value string
+}
+
+// nicPropertiesSetting returns the NIC advanced properties set in the config
+// file, instance or project attributes, in this order of precedence.
+func nicPropertiesSetting(config *cfg.Sections, md *metadata.Descriptor) string {
+	if config.NetworkInterfaces.WindowsNICProperties != "" {
+		return config.NetworkInterfaces.WindowsNICProperties
+	}
+	if md.Instance.Attributes.WindowsNICProperties != "" {
+		return md.Instance.Attributes.WindowsNICProperties
+	}
+	return md.Project.Attributes.WindowsNICProperties
+}
+
+// parseNICProperties parses a comma separated list of keyword=value NIC
+// advanced properties.
+func parseNICProperties(s string) ([]nicProperty, error) {
+	var res []nicProperty
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		keyword, value, found := strings.Cut(entry, "=")
+		keyword, value = strings.TrimSpace(keyword), strings.TrimSpace(value)
+		if !found || !nicPropertyKeywordExp.MatchString(keyword) || !nicPropertyValueExp.MatchString(value) {
+			return nil, fmt.Errorf("invalid NIC property %q", entry)
+		}
+		res = append(res, nicProperty{keyword: keyword, value: value})
+	}
+	return res, nil
+}
+
+// psQuote quotes s as a PowerShell single-quoted string.
+func psQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// nicPropertyGetCommand returns the PowerShell command printing the current
+// value of prop on iface.
+func nicPropertyGetCommand(iface string, prop nicProperty) string {
+	return fmt.Sprintf("(Get-NetAdapterAdvancedProperty -Name %s -RegistryKeyword %s).RegistryValue", psQuote(iface), psQuote(prop.keyword))
+}
+
+// nicPropertySetCommand returns the PowerShell command setting prop on iface.
+func nicPropertySetCommand(iface string, prop nicProperty) string {
+	return fmt.Sprintf("Set-NetAdapterAdvancedProperty -Name %s -RegistryKeyword %s -RegistryValue %s", psQuote(iface), psQuote(prop.keyword), psQuote(prop.value))
+}
+
+// setWindowsNICProperties sets the configured advanced properties on the
+// interfaces whose properties don't match them yet, setting a property
+// restarts the adapter.
+func setWindowsNICProperties(ctx context.Context, config *cfg.Sections, md *metadata.Descriptor) {
+	props, err := parseNICProperties(nicPropertiesSetting(config, md))
+	if err != nil {
+		logger.Errorf("Failed to parse the NIC advanced properties: %v", err)
+		return
+	}
+	if len(props) == 0 {
+		return
+	}
+
+	for _, ni := range md.Instance.NetworkInterfaces {
+		iface, err := network.GetInterfaceByMAC(config, ni.Mac)
+		if err != nil {
+			continue
+		}
+
+		for _, prop := range props {
+			res := run.WithOutput(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command", nicPropertyGetCommand(iface.Name, prop))
+			if res.ExitCode != 0 {
+				logger.Errorf("Failed to get %s %s property: %s", iface.Name, prop.keyword, res.StdErr)
+				continue
+			}
+			if strings.TrimSpace(res.StdOut) == prop.value {
+				continue
+			}
+
+			logger.Infof("Setting %s %s property to %s", iface.Name, prop.keyword, prop.value)
+			if err := run.Quiet(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command", nicPropertySetCommand(iface.Name, prop)); err != nil {
+				logger.Errorf("Failed to set %s %s property: %v", iface.Name, prop.keyword, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseNICProperties(t *testing.T) {
+	tests := []struct {
+		name    string
+		setting string
+		want    []nicProperty
+		wantErr bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:    "valid",
+			setting: "*JumboPacket=9014, *NumRssQueues = 8,",
+			want:    []nicProperty{{keyword: "*JumboPacket", value: "9014"}, {keyword: "*NumRssQueues", value: "8"}},
+		},
+		{
+			name:    "missing_value",
+			setting: "*JumboPacket",
+			wantErr: true,
+		},
+		{
+			name:    "injection",
+			setting: "*JumboPacket=9014'; Restart-Computer; '",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseNICProperties(tc.setting)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("parseNICProperties(%q) = error %v, want error: %t", tc.setting, err, tc.wantErr)
+			}
+			if diff := cmp.Diff(tc.want, got, cmp.AllowUnexported(nicProperty{})); diff != "" {
+				t.Errorf("parseNICProperties(%q) returned unexpected diff (-want +got):\n%s", tc.setting, diff)
+			}
+		})
+	}
+}
+
+func TestNICPropertiesSetting(t *testing.T) {
+	config := &cfg.Sections{NetworkInterfaces: &cfg.NetworkInterfaces{}}
+	md := &metadata.Descriptor{}
+	md.Project.Attributes.WindowsNICProperties = "*JumboPacket=1514"
+
+	if got := nicPropertiesSetting(config, md); got != "*JumboPacket=1514" {
+		t.Errorf("nicPropertiesSetting() = %q, want project attribute", got)
+	}
+
+	md.Instance.Attributes.WindowsNICProperties = "*JumboPacket=9014"
+	if got := nicPropertiesSetting(config, md); got != "*JumboPacket=9014" {
+		t.Errorf("nicPropertiesSetting() = %q, want instance attribute", got)
+	}
+
+	config.NetworkInterfaces.WindowsNICProperties = "*NumRssQueues=4"
+	if got := nicPropertiesSetting(config, md); got != "*NumRssQueues=4" {
+		t.Errorf("nicPropertiesSetting() = %q, want config setting", got)
+	}
+}
+
+func TestNICPropertyCommands(t *testing.T) {
+	prop := nicProperty{keyword: "*JumboPacket", value: "9014"}
+
+	wantGet := "(Get-NetAdapterAdvancedProperty -Name 'Ethernet ''2''' -RegistryKeyword '*JumboPacket').RegistryValue"
+	if got := nicPropertyGetCommand("Ethernet '2'", prop); got != wantGet {
+		t.Errorf("nicPropertyGetCommand() = %q, want %q", got, wantGet)
+	}
+
+	wantSet := "Set-NetAdapterAdvancedProperty -Name 'Ethernet' -RegistryKeyword '*JumboPacket' -RegistryValue '9014'"
+	if got := nicPropertySetCommand("Ethernet", prop); got != wantSet {
+		t.Errorf("nicPropertySetCommand() = %q, want %q", got, wantSet)
+	}
+}
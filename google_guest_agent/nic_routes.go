@@ -0,0 +1,196 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	network "github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/network/manager"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+var (
+	// nicRoutesKey records, by NIC MAC address, the routes added by the agent
+	// on Windows.
+	nicRoutesKey = regKeyBase + `\Routes`
+)
+
+// nicRoute formats a route of the static-ip-config attribute as recorded in
+// the registry, the destination followed by the next hop of gateway routes.
+func nicRoute(route metadata.StaticRoute) string {
+	if route.Gateway == "" {
+		return route.Destination
+	}
+	return route.Destination + " via " + route.Gateway
+}
+
+// parseNICRoute parses a route formatted by nicRoute into an entry of the
+// interface index. On-link routes have an unspecified next hop.
+func parseNICRoute(route string, index int32) (ipForwardEntry, error) {
+	fields := strings.Fields(route)
+	if len(fields) != 1 && (len(fields) != 3 || fields[1] != "via") {
+		return ipForwardEntry{}, fmt.Errorf("invalid route %q", route)
+	}
+
+	_, dst, err := net.ParseCIDR(fields[0])
+	if err != nil || dst.IP.To4() == nil {
+		return ipForwardEntry{}, fmt.Errorf("invalid IPv4 route destination %q", fields[0])
+	}
+
+	nextHop := net.IPv4zero
+	if len(fields) == 3 {
+		if nextHop = net.ParseIP(fields[2]).To4(); nextHop == nil {
+			return ipForwardEntry{}, fmt.Errorf("invalid IPv4 route next hop %q", fields[2])
+		}
+	}
+
+	return ipForwardEntry{
+		ipForwardDest:    dst.IP.To4(),
+		ipForwardMask:    dst.Mask,
+		ipForwardNextHop: nextHop,
+		ipForwardIfIndex: index,
+	}, nil
+}
+
+// wantNICRoutes returns the routes the static-ip-config attribute sets for the
+// NIC at index nic.
+func wantNICRoutes(configs []metadata.StaticIPConfig, nic int) []string {
+	var res []string
+	for _, sc := range configs {
+		if sc.NIC != nic {
+			continue
+		}
+		for _, route := range sc.Routes {
+			res = append(res, nicRoute(route))
+		}
+	}
+	return res
+}
+
+// hasIPForwardEntry returns true if fes contains the route fe, compared by
+// destination, mask, next hop and interface.
+func hasIPForwardEntry(fes []ipForwardEntry, fe ipForwardEntry) bool {
+	return slices.ContainsFunc(fes, func(curr ipForwardEntry) bool {
+		return curr.ipForwardDest.Equal(fe.ipForwardDest) && slices.Equal(curr.ipForwardMask, fe.ipForwardMask) &&
+			curr.ipForwardNextHop.Equal(fe.ipForwardNextHop) && curr.ipForwardIfIndex == fe.ipForwardIfIndex
+	})
+}
+
+// interfaceRouteMetric returns the lowest metric of the routes of the
+// interface index, the metric of the routes added to it.
+func interfaceRouteMetric(fes []ipForwardEntry, index int32) (int32, error) {
+	metric := int32(-1)
+	for _, fe := range fes {
+		if fe.ipForwardIfIndex == index && (metric < 0 || fe.ipForwardMetric1 < metric) {
+			metric = fe.ipForwardMetric1
+		}
+	}
+	if metric < 0 {
+		return 0, fmt.Errorf("no route found on interface %d", index)
+	}
+	return metric, nil
+}
+
+// setWindowsNICRoutes programs the routes of the static-ip-config attribute on
+// their NIC with the IP Helper API. The routes added are recorded in the
+// registry so the ones removed from metadata are deleted, and the recorded
+// ones missing from the routing table are added again.
+func setWindowsNICRoutes(config *cfg.Sections, nics []metadata.NetworkInterfaces, configs []metadata.StaticIPConfig) {
+	fes, err := getIPForwardEntries()
+	if err != nil {
+		logger.Errorf("Failed to list routes: %v", err)
+		return
+	}
+
+	for i, ni := range nics {
+		iface, err := network.GetInterfaceByMAC(config, ni.Mac)
+		if err != nil {
+			continue
+		}
+		index := int32(iface.Index)
+
+		recorded, err := readRegMultiString(nicRoutesKey, ni.Mac)
+		if err != nil && err != errRegNotExist {
+			logger.Errorf("Failed to read recorded routes of %s: %v", iface.Name, err)
+			continue
+		}
+
+		// Only the recorded routes still in the routing table are configured.
+		var configured []string
+		for _, route := range recorded {
+			if fe, err := parseNICRoute(route, index); err == nil && hasIPForwardEntry(fes, fe) {
+				configured = append(configured, route)
+			}
+		}
+
+		want := wantNICRoutes(configs, i)
+		toAdd, toRm := compareRoutes(configured, want)
+		if len(toAdd) == 0 && len(toRm) == 0 && len(recorded) == len(configured) {
+			continue
+		}
+
+		var entries []string
+		for _, route := range want {
+			if !slices.Contains(toAdd, route) {
+				entries = append(entries, route)
+				continue
+			}
+
+			if err := addNICRoute(fes, route, index); err != nil {
+				logger.Errorf("Failed to add route %q on %s: %v", route, iface.Name, err)
+				continue
+			}
+			logger.Infof("Added route %q on %s", route, iface.Name)
+			entries = append(entries, route)
+		}
+
+		for _, route := range toRm {
+			fe, err := parseNICRoute(route, index)
+			if err == nil {
+				err = removeIPForwardEntry(fe)
+			}
+			if err != nil {
+				logger.Errorf("Failed to remove route %q on %s: %v", route, iface.Name, err)
+				// Keep the routes we failed to remove recorded.
+				entries = append(entries, route)
+				continue
+			}
+			logger.Infof("Removed route %q on %s", route, iface.Name)
+		}
+
+		if err := writeRegMultiString(nicRoutesKey, ni.Mac, entries); err != nil {
+			logger.Errorf("Failed to record routes of %s: %v", iface.Name, err)
+		}
+	}
+}
+
+// addNICRoute adds route to the interface index, with the metric of its
+// existing routes.
+func addNICRoute(fes []ipForwardEntry, route string, index int32) error {
+	fe, err := parseNICRoute(route, index)
+	if err != nil {
+		return err
+	}
+
+	if fe.ipForwardMetric1, err = interfaceRouteMetric(fes, index); err != nil {
+		return err
+	}
+	return addIPForwardEntry(fe)
+}
@@ -0,0 +1,115 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+)
+
+func TestParseNICRoute(t *testing.T) {
+	tests := []struct {
+		route   string
+		dest    string
+		mask    net.IPMask
+		nextHop string
+		wantErr bool
+	}{
+		{route: "10.8.0.0/16 via 192.168.1.1", dest: "10.8.0.0", mask: net.CIDRMask(16, 32), nextHop: "192.168.1.1"},
+		{route: "10.9.0.0/24", dest: "10.9.0.0", mask: net.CIDRMask(24, 32), nextHop: "0.0.0.0"},
+		{route: "10.8.0.0/16 192.168.1.1", wantErr: true},
+		{route: "2600:1900::/96", wantErr: true},
+		{route: "10.8.0.0/16 via invalid", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.route, func(t *testing.T) {
+			fe, err := parseNICRoute(tc.route, 3)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("parseNICRoute(%q, 3) = %v, want error: %t", tc.route, err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+
+			if !fe.ipForwardDest.Equal(net.ParseIP(tc.dest)) || !slices.Equal(fe.ipForwardMask, tc.mask) ||
+				!fe.ipForwardNextHop.Equal(net.ParseIP(tc.nextHop)) || fe.ipForwardIfIndex != 3 {
+				t.Errorf("parseNICRoute(%q, 3) = %+v, want %s/%s via %s on 3", tc.route, fe, tc.dest, tc.mask, tc.nextHop)
+			}
+		})
+	}
+}
+
+func TestWantNICRoutes(t *testing.T) {
+	configs := []metadata.StaticIPConfig{
+		{NIC: 0, Routes: []metadata.StaticRoute{{Destination: "10.8.0.0/16", Gateway: "10.0.0.1"}}},
+		{NIC: 1, Routes: []metadata.StaticRoute{{Destination: "10.9.0.0/16", Gateway: "10.1.0.1"}, {Destination: "10.10.0.0/24"}}},
+	}
+
+	want := []string{"10.9.0.0/16 via 10.1.0.1", "10.10.0.0/24"}
+	if got := wantNICRoutes(configs, 1); !slices.Equal(got, want) {
+		t.Errorf("wantNICRoutes(%+v, 1) = %v, want %v", configs, got, want)
+	}
+	if got := wantNICRoutes(configs, 2); len(got) != 0 {
+		t.Errorf("wantNICRoutes(%+v, 2) = %v, want none", configs, got)
+	}
+}
+
+func TestInterfaceRouteMetric(t *testing.T) {
+	fes := []ipForwardEntry{
+		{ipForwardDest: net.IPv4zero, ipForwardIfIndex: 2, ipForwardMetric1: 25},
+		{ipForwardDest: net.ParseIP("10.0.0.0"), ipForwardIfIndex: 2, ipForwardMetric1: 20},
+		{ipForwardDest: net.ParseIP("10.1.0.0"), ipForwardIfIndex: 3, ipForwardMetric1: 5},
+	}
+
+	metric, err := interfaceRouteMetric(fes, 2)
+	if err != nil {
+		t.Fatalf("interfaceRouteMetric(2) failed unexpectedly with error: %v", err)
+	}
+	if metric != 20 {
+		t.Errorf("interfaceRouteMetric(2) = %d, want 20", metric)
+	}
+
+	if _, err := interfaceRouteMetric(fes, 4); err == nil {
+		t.Errorf("interfaceRouteMetric(4) succeeded for an interface without routes, want error")
+	}
+}
+
+func TestHasIPForwardEntry(t *testing.T) {
+	fe, err := parseNICRoute("10.8.0.0/16 via 192.168.1.1", 3)
+	if err != nil {
+		t.Fatalf("parseNICRoute() failed unexpectedly with error: %v", err)
+	}
+
+	// The routing table returns 4 byte addresses.
+	fes := []ipForwardEntry{{
+		ipForwardDest:    net.IP{10, 8, 0, 0},
+		ipForwardMask:    net.IPMask{255, 255, 0, 0},
+		ipForwardNextHop: net.IP{192, 168, 1, 1},
+		ipForwardIfIndex: 3,
+	}}
+
+	if !hasIPForwardEntry(fes, fe) {
+		t.Errorf("hasIPForwardEntry(%+v, %+v) = false, want true", fes, fe)
+	}
+
+	fe.ipForwardIfIndex = 4
+	if hasIPForwardEntry(fes, fe) {
+		t.Errorf("hasIPForwardEntry(%+v, %+v) = true for another interface, want false", fes, fe)
+	}
+}
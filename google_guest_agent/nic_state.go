@@ -0,0 +1,134 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+// nicStateNamespace is the guest attributes namespace the NICs state is
+// published to, the key being the NIC index i.e. guest-agent-network/nic0.
+const nicStateNamespace = "guest-agent-network"
+
+var (
+	// nicMetrics are the apply counters of the NICs, by MAC address.
+	nicMetrics = make(map[string]*nicApplyMetrics)
+	// nicMetricsMu protects nicMetrics.
+	nicMetricsMu sync.Mutex
+)
+
+// nicApplyMetrics counts the network configuration applies of a NIC since the
+// agent started.
+type nicApplyMetrics struct {
+	// Applies is the number of times the NIC configuration was applied.
+	Applies int `json:"applies"`
+	// Failures is the number of failed applies.
+	Failures int `json:"failures"`
+	// ConsecutiveFailures is the number of failed applies since the last
+	// successful one.
+	ConsecutiveFailures int `json:"consecutiveFailures"`
+}
+
+// nicState is the state of a NIC managed by the agent, published to guest
+// attributes for fleet-wide verification.
+type nicState struct {
+	// MAC is the NIC's MAC address.
+	MAC string `json:"mac"`
+	// Interface is the NIC's interface name, empty if it wasn't found.
+	Interface string `json:"interface,omitempty"`
+	// Routes are the forwarded IPs, target-instance IPs and alias IPs routed
+	// or assigned to the NIC by the agent.
+	Routes []string `json:"routes,omitempty"`
+	// AliasIPs are the NIC's alias IP ranges offered by metadata.
+	AliasIPs []string `json:"aliasIPs,omitempty"`
+	// Succeeded is true if the last apply had no error.
+	Succeeded bool `json:"succeeded"`
+	// Error is the last apply's error message.
+	Error string `json:"error,omitempty"`
+	// LastApply is when the NIC configuration was last applied.
+	LastApply time.Time `json:"lastApply"`
+	// Metrics are the NIC's apply counters.
+	Metrics nicApplyMetrics `json:"metrics"`
+}
+
+// nicStates are the states of the metadata NICs, in metadata order.
+type nicStates []*nicState
+
+// newNICStates returns the initial states of nics.
+func newNICStates(nics []metadata.NetworkInterfaces) nicStates {
+	var res nicStates
+	for _, ni := range nics {
+		res = append(res, &nicState{MAC: ni.Mac, AliasIPs: ni.IPAliases})
+	}
+	return res
+}
+
+// fail records err as the apply error of every NIC.
+func (s nicStates) fail(err error) {
+	for _, state := range s {
+		state.Error = err.Error()
+	}
+}
+
+// finish sets the apply result and metrics of the NICs.
+func (s nicStates) finish(now time.Time) {
+	nicMetricsMu.Lock()
+	defer nicMetricsMu.Unlock()
+
+	for _, state := range s {
+		metrics, found := nicMetrics[state.MAC]
+		if !found {
+			metrics = &nicApplyMetrics{}
+			nicMetrics[state.MAC] = metrics
+		}
+
+		state.Succeeded = state.Error == ""
+		state.LastApply = now
+		metrics.Applies++
+		if state.Succeeded {
+			metrics.ConsecutiveFailures = 0
+		} else {
+			metrics.Failures++
+			metrics.ConsecutiveFailures++
+		}
+		state.Metrics = *metrics
+	}
+}
+
+// publish finishes the NICs state and writes it to guest attributes.
+func (s nicStates) publish(ctx context.Context, client metadata.MDSClientInterface) {
+	s.finish(time.Now())
+
+	for i, state := range s {
+		data, err := json.Marshal(state)
+		if err != nil {
+			logger.Errorf("Failed to marshal NIC %d state: %v", i, err)
+			continue
+		}
+
+		key := fmt.Sprintf("%s/nic%d", nicStateNamespace, i)
+		// Guest attributes may be disabled for the instance.
+		if err := client.WriteGuestAttributes(ctx, key, string(data)); err != nil {
+			logger.Debugf("Failed to publish NIC %d state to guest attributes: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+)
+
+// guestAttributesClient records the guest attributes written, its other
+// methods are not implemented.
+type guestAttributesClient struct {
+	metadata.MDSClientInterface
+	attributes map[string]string
+}
+
+func (c *guestAttributesClient) WriteGuestAttributes(_ context.Context, key, value string) error {
+	c.attributes[key] = value
+	return nil
+}
+
+func TestNICStatesPublish(t *testing.T) {
+	t.Cleanup(func() { nicMetrics = make(map[string]*nicApplyMetrics) })
+
+	nics := []metadata.NetworkInterfaces{
+		{Mac: "a", IPAliases: []string{"10.1.0.0/24"}},
+		{Mac: "b"},
+	}
+	client := &guestAttributesClient{attributes: make(map[string]string)}
+	ctx := context.Background()
+
+	states := newNICStates(nics)
+	states[0].Interface = "eth0"
+	states[0].Routes = []string{"10.1.0.0/24"}
+	states[1].Error = "route error"
+	states.publish(ctx, client)
+
+	// A second apply failing for all the NICs.
+	states = newNICStates(nics)
+	states.fail(errors.New("setup error"))
+	states.publish(ctx, client)
+
+	// The last one succeeding for the first NIC.
+	states = newNICStates(nics)
+	states[1].Error = "route error"
+	states.publish(ctx, client)
+
+	want := map[string]nicApplyMetrics{
+		"guest-agent-network/nic0": {Applies: 3, Failures: 1},
+		"guest-agent-network/nic1": {Applies: 3, Failures: 3, ConsecutiveFailures: 3},
+	}
+	for key, wantMetrics := range want {
+		var got nicState
+		if err := json.Unmarshal([]byte(client.attributes[key]), &got); err != nil {
+			t.Fatalf("json.Unmarshal(%q) failed: %v", client.attributes[key], err)
+		}
+		if got.Metrics != wantMetrics {
+			t.Errorf("%s metrics = %+v, want %+v", key, got.Metrics, wantMetrics)
+		}
+		if got.Succeeded != (wantMetrics.ConsecutiveFailures == 0) {
+			t.Errorf("%s succeeded = %t, want %t", key, got.Succeeded, !got.Succeeded)
+		}
+		if got.LastApply.IsZero() {
+			t.Errorf("%s lastApply is zero, want set", key)
+		}
+	}
+
+	var nic0 nicState
+	if err := json.Unmarshal([]byte(client.attributes["guest-agent-network/nic0"]), &nic0); err != nil {
+		t.Fatalf("json.Unmarshal() failed: %v", err)
+	}
+	if nic0.MAC != "a" || len(nic0.AliasIPs) != 1 || nic0.Error != "" {
+		t.Errorf("nic0 state = %+v, want MAC a with its alias IP and no error", nic0)
+	}
+}
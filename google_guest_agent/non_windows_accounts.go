@@ -20,16 +20,18 @@ import (
 	"context"
 	"fmt"
 	"os"
-	"os/exec"
 	"path"
 	"runtime"
 	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-agent/sshkeys"
 	"github.com/GoogleCloudPlatform/guest-agent/utils"
 	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
 )
@@ -39,6 +41,10 @@ var (
 	// keys file. Avoids necessity of re-reading all files on every change.
 	sshKeys         map[string][]string
 	googleUsersFile = "/var/lib/google/google_users"
+
+	// accountsMu serializes the accounts setup, it also runs when metadata
+	// SSH keys expire.
+	accountsMu sync.Mutex
 )
 
 // compareStringSlice returns true if two string slices are equal, false
@@ -47,11 +53,10 @@ func compareStringSlice(first, second []string) bool {
 	if len(first) != len(second) {
 		return false
 	}
-	for _, list := range [][]string{first, second} {
-		sortfunc := func(i, j int) bool { return list[i] < list[j] }
-		list = append([]string{}, list...)
-		sort.Slice(list, sortfunc)
-	}
+	// Compare sorted copies, the order of the keys in metadata doesn't matter.
+	first, second = slices.Clone(first), slices.Clone(second)
+	sort.Strings(first)
+	sort.Strings(second)
 	for idx := range first {
 		if first[idx] != second[idx] {
 			return false
@@ -70,9 +75,25 @@ func removeExpiredKeys(keys []string) []string {
 	return validKeys
 }
 
+// keysExpired reports whether any on-disk key has expired.
+func keysExpired() bool {
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+	for _, keys := range sshKeys {
+		if len(keys) != len(removeExpiredKeys(keys)) {
+			return true
+		}
+	}
+	return false
+}
+
 type accountsMgr struct{}
 
 func (a *accountsMgr) Diff(ctx context.Context) (bool, error) {
+	// If a debounced key sync is due.
+	if keySyncPending {
+		return true, nil
+	}
 	// If any keys have changed.
 	if !compareStringSlice(newMetadata.Instance.Attributes.SSHKeys, oldMetadata.Instance.Attributes.SSHKeys) {
 		return true, nil
@@ -85,10 +106,8 @@ func (a *accountsMgr) Diff(ctx context.Context) (bool, error) {
 	}
 
 	// If any on-disk keys have expired.
-	for _, keys := range sshKeys {
-		if len(keys) != len(removeExpiredKeys(keys)) {
-			return true, nil
-		}
+	if keysExpired() {
+		return true, nil
 	}
 	// If we've just disabled OS Login.
 	oldOslogin, _, _, _ := getOSLoginEnabled(oldMetadata)
@@ -111,6 +130,8 @@ func (a *accountsMgr) Disabled(ctx context.Context) (bool, error) {
 }
 
 func (a *accountsMgr) Set(ctx context.Context) error {
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
 	config := cfg.Get()
 
 	if sshKeys == nil {
@@ -119,7 +140,7 @@ func (a *accountsMgr) Set(ctx context.Context) error {
 	}
 
 	logger.Debugf("create sudoers file if needed")
-	if err := createSudoersFile(); err != nil {
+	if err := createSudoersFile(ctx, config); err != nil {
 		logger.Errorf("Error creating google-sudoers file: %v.", err)
 	}
 	logger.Debugf("create sudoers group if needed")
@@ -127,13 +148,32 @@ func (a *accountsMgr) Set(ctx context.Context) error {
 		logger.Errorf("Error creating google-sudoers group: %v.", err)
 	}
 
-	mdkeys := newMetadata.Instance.Attributes.SSHKeys
+	if deferKeySync(ctx, config) {
+		return nil
+	}
+	keySyncPending = false
+	defer func() { lastKeySync = time.Now() }()
+
+	mdkeys := slices.Clone(newMetadata.Instance.Attributes.SSHKeys)
 	if !newMetadata.Instance.Attributes.BlockProjectKeys {
 		mdkeys = append(mdkeys, newMetadata.Project.Attributes.SSHKeys...)
 	}
 
 	mdKeyMap := getUserKeys(mdkeys)
 
+	// Read the passwd database once rather than once per metadata user.
+	passwdDB, err := readPasswd()
+	if err != nil {
+		logger.Errorf("Couldn't read the passwd database: %v.", err)
+	}
+	userExists := func(user string) bool {
+		if passwdDB != nil {
+			return passwdDB[user] != nil
+		}
+		_, err := getPasswd(user)
+		return err == nil
+	}
+
 	logger.Debugf("read google users file")
 	gUsers, err := readGoogleUsersFile()
 	if err != nil {
@@ -141,14 +181,25 @@ func (a *accountsMgr) Set(ctx context.Context) error {
 		logger.Errorf("Couldn't read google_users file: %v.", err)
 	}
 
+	// The break-glass user is not a Google user, it's never removed.
+	if breakGlass := config.Accounts.BreakGlassUser; breakGlass != "" {
+		if _, ok := mdKeyMap[breakGlass]; ok {
+			logger.Warningf("Ignoring metadata SSH keys of break-glass user %s.", breakGlass)
+			delete(mdKeyMap, breakGlass)
+		}
+		delete(gUsers, breakGlass)
+		delete(sshKeys, breakGlass)
+	}
+
 	// Update SSH keys, creating Google users as needed.
 	for user, userKeys := range mdKeyMap {
-		if _, err := getPasswd(user); err != nil {
+		if !userExists(user) {
 			logger.Infof("Creating user %s.", user)
 			if err := createGoogleUser(ctx, config, user); err != nil {
 				logger.Errorf("Error creating user: %s.", err)
 				continue
 			}
+			auditAccount(auditUserAdd, user, auditSourceMetadata)
 			gUsers[user] = ""
 		}
 		if _, ok := gUsers[user]; !ok {
@@ -158,11 +209,13 @@ func (a *accountsMgr) Set(ctx context.Context) error {
 			}
 		}
 		if !compareStringSlice(userKeys, sshKeys[user]) {
-			logger.Infof("Updating keys for user %s.", user)
+			added, removed := diffKeys(sshKeys[user], userKeys)
+			logger.Infof("Updating keys for user %s, %d added and %d removed.", user, len(added), len(removed))
 			if err := updateAuthorizedKeysFile(ctx, user, userKeys); err != nil {
 				logger.Errorf("Error updating SSH keys for %s: %v.", user, err)
 				continue
 			}
+			auditKeyChanges(user, auditSourceMetadata, sshKeys[user], userKeys)
 			sshKeys[user] = userKeys
 		}
 	}
@@ -174,11 +227,32 @@ func (a *accountsMgr) Set(ctx context.Context) error {
 			err = removeGoogleUser(ctx, config, user)
 			if err != nil {
 				logger.Errorf("Error removing user: %v.", err)
+			} else {
+				auditKeyChanges(user, auditSourceMetadata, sshKeys[user], nil)
+				auditAccount(auditUserRemove, user, auditSourceMetadata)
 			}
 			delete(sshKeys, user)
 		}
 	}
 
+	// The limits configuration may have changed since the users were created,
+	// the passwd database is read again for the users created above.
+	limitsUsers := make(map[string]int)
+	if passwdDB, err = readPasswd(); err != nil {
+		logger.Errorf("Couldn't read the passwd database: %v.", err)
+	}
+	for user := range mdKeyMap {
+		if entry := passwdDB[user]; entry != nil {
+			limitsUsers[user] = entry.UID
+		}
+	}
+	if err := applyUserLimits(ctx, config, limitsUsers); err != nil {
+		logger.Errorf("Error applying resource limits: %v.", err)
+	}
+
+	// Remove the keys when they expire, metadata may not change by then.
+	scheduleKeyCleanup(ctx, sshKeys)
+
 	// Update the google_users file if we've added or removed any users.
 	logger.Debugf("write google_users file")
 	if err := writeGoogleUsersFile(); err != nil {
@@ -196,6 +270,44 @@ func (a *accountsMgr) Set(ctx context.Context) error {
 	return nil
 }
 
+var (
+	// breakGlassKeys are the keys of the break-glass user written last.
+	breakGlassKeys []string
+	// breakGlassWritten is true once the break-glass user's keys were written.
+	breakGlassWritten bool
+)
+
+// provisionBreakGlassUser creates the break-glass user if needed and writes its
+// keys. If the keys can't be fetched the ones written last are left in place.
+func provisionBreakGlassUser(ctx context.Context, config *cfg.Sections) error {
+	user := config.Accounts.BreakGlassUser
+	// A failed fetch is retried on the next refresh.
+	breakGlassFetched = time.Now()
+	keys, err := getBreakGlassKeys(ctx, mdsClient, config)
+	if err != nil {
+		return err
+	}
+
+	if _, err := getPasswd(user); err != nil {
+		logger.Infof("Creating break-glass user %s.", user)
+		if err := createGoogleUser(ctx, config, user); err != nil {
+			return err
+		}
+		auditAccount(auditUserAdd, user, auditSourceBreakGlass)
+	}
+	if breakGlassWritten && compareStringSlice(keys, breakGlassKeys) {
+		return nil
+	}
+
+	logger.Infof("Updating keys for break-glass user %s.", user)
+	if err := updateAuthorizedKeysFile(ctx, user, keys); err != nil {
+		return err
+	}
+	auditKeyChanges(user, auditSourceBreakGlass, breakGlassKeys, keys)
+	breakGlassKeys, breakGlassWritten = keys, true
+	return nil
+}
+
 var badSSHKeys []string
 
 // getUserKeys returns the keys which are not expired and non-expiring key.
@@ -205,30 +317,19 @@ var badSSHKeys []string
 // user:ssh-rsa [KEY_VALUE] google-ssh {"userName":"[USERNAME]","expireOn":"[EXPIRE_TIME]"}
 // user:[KEY_OPTIONS] ssh-rsa [KEY_VALUE]
 func getUserKeys(mdkeys []string) map[string][]string {
-	mdKeyMap := make(map[string][]string)
-	for i := 0; i < len(mdkeys); i++ {
-		trimmedKey := strings.Trim(mdkeys[i], " ")
-		if trimmedKey != "" {
-			user, keyVal, err := utils.GetUserKey(trimmedKey)
-			if err == nil {
-				err = utils.ValidateUserKey(user, keyVal)
-			}
-
-			if err != nil {
-				if !slices.Contains(badSSHKeys, trimmedKey) {
-					logger.Errorf("%s: %s", err.Error(), trimmedKey)
-					badSSHKeys = append(badSSHKeys, trimmedKey)
-				}
-				continue
-			}
-
-			// key which is not expired or non-expiring key, add it.
-			userKeys := mdKeyMap[user]
-			userKeys = append(userKeys, keyVal)
-			mdKeyMap[user] = userKeys
+	res := sshkeys.Parse(mdkeys)
+	for _, lineErr := range res.Errors {
+		trimmedKey := strings.Trim(lineErr.Text, " ")
+		if !slices.Contains(badSSHKeys, trimmedKey) {
+			logger.Errorf("%s: %s", lineErr.Err.Error(), trimmedKey)
+			badSSHKeys = append(badSSHKeys, trimmedKey)
 		}
 	}
-	return mdKeyMap
+	if len(res.Duplicates) > 0 {
+		logger.Debugf("Ignoring %d duplicate metadata SSH keys.", len(res.Duplicates))
+	}
+	// Keys which are not expired or non-expiring keys.
+	return res.UserKeys()
 }
 
 // passwdEntry is a user.User with omitted passwd fields restored.
@@ -242,44 +343,41 @@ type passwdEntry struct {
 	Shell    string
 }
 
-// getPasswd returns a passwdEntry from the local passwd database. Code adapted from os/user
-func getPasswd(user string) (*passwdEntry, error) {
-	prefix := []byte(user + ":")
-	colon := []byte{':'}
-
-	parse := func(line []byte) (*passwdEntry, error) {
-		if !bytes.HasPrefix(line, prefix) || bytes.Count(line, colon) < 6 {
-			return nil, nil
-		}
-		// kevin:x:1005:1006::/home/kevin:/usr/bin/zsh
-		parts := strings.SplitN(string(line), ":", 7)
-		if len(parts) < 7 {
-			return nil, fmt.Errorf("invalid passwd entry for %s", user)
-		}
-		uid, err := strconv.Atoi(parts[2])
-		if err != nil {
-			return nil, fmt.Errorf("invalid passwd entry for %s", user)
-		}
-		gid, err := strconv.Atoi(parts[3])
-		if err != nil {
-			return nil, fmt.Errorf("invalid passwd entry for %s", user)
-		}
-		u := &passwdEntry{
-			Username: parts[0],
-			Passwd:   parts[1],
-			UID:      uid,
-			GID:      gid,
-			Name:     parts[4],
-			HomeDir:  parts[5],
-			Shell:    parts[6],
-		}
-		return u, nil
+// parsePasswdEntry parses a line of the passwd database.
+func parsePasswdEntry(line string) (*passwdEntry, error) {
+	// kevin:x:1005:1006::/home/kevin:/usr/bin/zsh
+	parts := strings.SplitN(line, ":", 7)
+	if len(parts) < 7 {
+		return nil, fmt.Errorf("invalid passwd entry for %s", parts[0])
+	}
+	uid, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid passwd entry for %s", parts[0])
 	}
+	gid, err := strconv.Atoi(parts[3])
+	if err != nil {
+		return nil, fmt.Errorf("invalid passwd entry for %s", parts[0])
+	}
+	return &passwdEntry{
+		Username: parts[0],
+		Passwd:   parts[1],
+		UID:      uid,
+		GID:      gid,
+		Name:     parts[4],
+		HomeDir:  parts[5],
+		Shell:    parts[6],
+	}, nil
+}
 
+// scanPasswd calls fn with each entry line of the local passwd database until
+// fn returns false.
+func scanPasswd(fn func(line []byte) bool) error {
 	passwd, err := os.Open("/etc/passwd")
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer passwd.Close()
+
 	bs := bufio.NewScanner(passwd)
 	for bs.Scan() {
 		line := bs.Bytes()
@@ -290,14 +388,54 @@ func getPasswd(user string) (*passwdEntry, error) {
 		if len(line) == 0 || line[0] == '#' {
 			continue
 		}
-		v, err := parse(line)
-		if v != nil || err != nil {
-			return v, err
+		if !fn(line) {
+			break
 		}
 	}
+	return bs.Err()
+}
+
+// getPasswd returns a passwdEntry from the local passwd database. Code adapted from os/user
+func getPasswd(user string) (*passwdEntry, error) {
+	prefix := []byte(user + ":")
+	colon := []byte{':'}
+
+	var entry *passwdEntry
+	var parseErr error
+	err := scanPasswd(func(line []byte) bool {
+		if !bytes.HasPrefix(line, prefix) || bytes.Count(line, colon) < 6 {
+			return true
+		}
+		entry, parseErr = parsePasswdEntry(string(line))
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil || parseErr != nil {
+		return entry, parseErr
+	}
 	return nil, fmt.Errorf("user not found")
 }
 
+// readPasswd returns the entries of the local passwd database by user name,
+// invalid entries are skipped.
+func readPasswd() (map[string]*passwdEntry, error) {
+	entries := make(map[string]*passwdEntry)
+	err := scanPasswd(func(line []byte) bool {
+		if entry, err := parsePasswdEntry(string(line)); err == nil {
+			if _, ok := entries[entry.Username]; !ok {
+				entries[entry.Username] = entry
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
 func writeGoogleUsersFile() error {
 	dir := path.Dir(googleUsersFile)
 	if _, err := os.Stat(dir); err != nil {
@@ -341,17 +479,36 @@ func createUserGroupCmd(cmd, user, group string) (string, []string) {
 	return tokens[0], tokens[1:]
 }
 
+// defaultHomeBase is the directory containing the home directories when
+// home_base isn't configured.
+const defaultHomeBase = "/home"
+
+// userHomeDir returns the home directory of a user created by the agent.
+func userHomeDir(config *cfg.Sections, username string) string {
+	base := config.Accounts.HomeBase
+	if base == "" {
+		base = defaultHomeBase
+	}
+	return path.Join(base, username)
+}
+
 // createGoogleUser creates a Google managed user account if needed and adds it
 // to the configured groups.
 func createGoogleUser(ctx context.Context, config *cfg.Sections, user string) error {
 	var uid, gid string
 	if config.Accounts.ReuseHomedir {
-		uid, gid = getUIDAndGID(fmt.Sprintf("/home/%s", user))
+		uid, gid = getUIDAndGID(userHomeDir(config, user))
 	}
 
 	if err := createUser(ctx, user, uid, gid); err != nil {
 		return err
 	}
+	// A reused home directory may come from elsewhere with a wrong context.
+	if passwd, err := getPasswd(user); err == nil && passwd.HomeDir != "" {
+		if err := restoreSELinuxContext(ctx, config.Accounts.ReuseHomedir, passwd.HomeDir); err != nil {
+			logger.Errorf("Error restoring SELinux context of %s: %v.", passwd.HomeDir, err)
+		}
+	}
 	groups := config.Accounts.Groups
 	for _, group := range strings.Split(groups, ",") {
 		addUserToGroup(ctx, user, group)
@@ -362,12 +519,41 @@ func createGoogleUser(ctx context.Context, config *cfg.Sections, user string) er
 // removeGoogleUser removes Google managed users. If deprovision_remove is true, the
 // user and its home directory are removed. Otherwise, SSH keys and sudoer
 // permissions are removed but the user remains on the system. Group membership
-// is not changed.
+// is not changed. The configured deprovisioning hooks run before and after the
+// removal, a failing pre-removal hook doesn't prevent the removal. Protected
+// users are never deleted, only their SSH keys and sudoer permissions are
+// removed.
 func removeGoogleUser(ctx context.Context, config *cfg.Sections, user string) error {
-	if config.Accounts.DeprovisionRemove {
+	remove := config.Accounts.DeprovisionRemove
+	if pattern, ok := protectedUserPattern(config, user); ok && remove {
+		logger.Infof("User %s matches protected user pattern %q, revoking its keys without deleting it.", user, pattern)
+		remove = false
+	}
+	if err := runDeprovisionHook(ctx, config.Accounts.DeprovisionPreCmd, user); err != nil {
+		logger.Errorf("Error running pre-deprovisioning hook: %v.", err)
+	}
+	if err := deprovisionGoogleUser(ctx, config, user, remove); err != nil {
+		return err
+	}
+	return runDeprovisionHook(ctx, config.Accounts.DeprovisionPostCmd, user)
+}
+
+// deprovisionGoogleUser deletes the user if remove is true, or revokes its SSH
+// keys and sudoer permissions.
+func deprovisionGoogleUser(ctx context.Context, config *cfg.Sections, user string, remove bool) error {
+	if remove {
+		passwd, passwdErr := getPasswd(user)
 		userdel := config.Accounts.UserDelCmd
 		name, args := createUserGroupCmd(userdel, user, "")
-		return run.Quiet(ctx, name, args...)
+		if err := run.Quiet(ctx, name, args...); err != nil {
+			return err
+		}
+		if passwdErr == nil {
+			if err := removeUserLimits(ctx, user, passwd.UID); err != nil {
+				logger.Errorf("Error removing resource limits of %s: %v.", user, err)
+			}
+		}
+		return nil
 	}
 	if err := updateAuthorizedKeysFile(ctx, user, []string{}); err != nil {
 		return err
@@ -377,22 +563,6 @@ func removeGoogleUser(ctx context.Context, config *cfg.Sections, user string) er
 	return run.Quiet(ctx, name, args...)
 }
 
-// createSudoersFile creates the google_sudoers configuration file if it does
-// not exist and specifies the group 'google-sudoers' should have all
-// permissions.
-func createSudoersFile() error {
-	sudoFile, err := os.OpenFile("/etc/sudoers.d/google_sudoers", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0440)
-	if err != nil {
-		if os.IsExist(err) {
-			return nil
-		}
-		return err
-	}
-	defer sudoFile.Close()
-	fmt.Fprintf(sudoFile, "%%google-sudoers ALL=(ALL:ALL) NOPASSWD:ALL\n")
-	return nil
-}
-
 // createSudoersGroup creates the google-sudoers group if it does not exist.
 func createSudoersGroup(ctx context.Context, config *cfg.Sections) error {
 	groupadd := config.Accounts.GroupAddCmd
@@ -441,6 +611,12 @@ func updateAuthorizedKeysFile(ctx context.Context, user string, keys []string) e
 			return err
 		}
 	}
+	// Also fixes the .ssh directories created without the SSH home context,
+	// even if the keys didn't change.
+	if err := restoreSELinuxContext(ctx, false, sshpath); err != nil {
+		return err
+	}
+
 	akpath := path.Join(sshpath, "authorized_keys")
 	tempPath := akpath + ".google"
 	akcontents, err := os.ReadFile(akpath)
@@ -448,34 +624,22 @@ func updateAuthorizedKeysFile(ctx context.Context, user string, keys []string) e
 		return err
 	}
 
-	var isgoogle bool
-	var userKeys []string
-	for _, key := range strings.Split(string(akcontents), "\n") {
-		if key == "" {
-			continue
-		}
-		if isgoogle {
-			isgoogle = false
-			continue
-		}
-		if key == gcomment {
-			isgoogle = true
-			continue
-		}
-		userKeys = append(userKeys, key)
+	proposed := patchAuthorizedKeys(akcontents, gcomment, keys)
+	// Keys cached before a restart or reordered in metadata often match the
+	// file already, don't rewrite it.
+	if akcontents != nil && bytes.Equal(proposed, akcontents) {
+		return nil
 	}
 
-	newfile, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE, 0600)
+	newfile, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return err
 	}
 	defer newfile.Close()
 
-	for _, key := range userKeys {
-		fmt.Fprintf(newfile, "%s\n", key)
-	}
-	for _, key := range keys {
-		fmt.Fprintf(newfile, "%s\n%s\n", gcomment, key)
+	if _, err := newfile.Write(proposed); err != nil {
+		os.Remove(tempPath)
+		return err
 	}
 	err = os.Chown(tempPath, passwd.UID, passwd.GID)
 	if err != nil {
@@ -486,11 +650,11 @@ func updateAuthorizedKeysFile(ctx context.Context, user string, keys []string) e
 		return fmt.Errorf("error setting ownership of new keys file: %v", err)
 	}
 
-	_, err = exec.LookPath("restorecon")
-	if err == nil {
-		if err := run.Quiet(ctx, "restorecon", tempPath); err != nil {
-			return fmt.Errorf("error setting selinux context: %+v", err)
-		}
+	// The temporary file lives in the .ssh directory and is labeled like the
+	// authorized keys file, label it before it's moved into place.
+	if err := restoreSELinuxContext(ctx, false, tempPath); err != nil {
+		os.Remove(tempPath)
+		return err
 	}
 
 	return os.Rename(tempPath, akpath)
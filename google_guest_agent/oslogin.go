@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"reflect"
 	"runtime"
 	"slices"
 	"strings"
@@ -112,7 +113,8 @@ func (o *osloginMgr) Diff(ctx context.Context) (bool, error) {
 		(oldTwoFactor != twofactor) ||
 		(oldEnable != enable) ||
 		(oldSkey != skey) ||
-		(oldReqCerts != reqCerts), nil
+		(oldReqCerts != reqCerts) ||
+		!reflect.DeepEqual(getSSHTrustedCA(oldMetadata), getSSHTrustedCA(newMetadata)), nil
 }
 
 func (o *osloginMgr) Timeout(ctx context.Context) (bool, error) {
@@ -143,8 +145,25 @@ func (o *osloginMgr) Set(ctx context.Context) error {
 		// Idea: could we simply return early here, if there's really nothing to do?
 	}
 
+	// OS Login brings its own certificate authorities.
+	ca := getSSHTrustedCA(newMetadata)
+	if enable && ca.enabled() {
+		logger.Warningf("OS Login is enabled, ignoring the SSH certificate authorities from metadata")
+		ca = sshTrustedCA{}
+	}
+
+	logger.Debugf("Updating SSH certificate authorities...")
+	if err := writeSSHTrustedCAFiles(ca); err != nil {
+		logger.Errorf("Error updating SSH certificate authorities: %v.", err)
+	}
+
+	// A configuration that was already invalid before our changes (e.g. sshd
+	// without host keys yet) is not rolled back.
+	baselineErr := validateSSHDConfig(ctx)
+	tx := &configTransaction{}
+
 	logger.Debugf("Updating SSH config...")
-	if err := writeSSHConfig(enable, twofactor, skey, reqCerts); err != nil {
+	if err := writeSSHConfig(tx, enable, twofactor, skey, reqCerts, ca); err != nil {
 		logger.Errorf("Error updating SSH config: %v.", err)
 	}
 
@@ -153,11 +172,34 @@ func (o *osloginMgr) Set(ctx context.Context) error {
 		logger.Errorf("Error updating NSS config: %v.", err)
 	}
 
+	sssd := osloginBackend() == osloginBackendSSSD
+	// sssdAccess is whether sssd's access control applies to the logins, which
+	// requires sssd to be installed.
+	var sssdAccess bool
+	logger.Debugf("Updating sssd config...")
+	if changed, err := writeSSSDConfig(enable && sssd); err != nil {
+		logger.Errorf("Error updating sssd config: %v.", err)
+	} else {
+		sssdAccess = enable && sssd
+		if changed {
+			if err := systemctlReloadOrRestart(ctx, "sssd"); err != nil {
+				logger.Errorf("Error restarting sssd: %v.", err)
+			}
+		}
+	}
+
 	logger.Debugf("Updating PAM config...")
-	if err := writePAMConfig(enable, twofactor); err != nil {
+	if err := writePAMConfig(tx, enable, twofactor, sssdAccess); err != nil {
 		logger.Errorf("Error updating PAM config: %v.", err)
 	}
 
+	if err := validateSSHDConfig(ctx); err != nil && baselineErr == nil {
+		logger.Errorf("Invalid SSH configuration, rolling back SSH and PAM config changes: %v.", err)
+		if err := tx.rollback(); err != nil {
+			logger.Errorf("Error rolling back SSH and PAM config: %v.", err)
+		}
+	}
+
 	logger.Debugf("Updating group.conf...")
 	if err := writeGroupConf(enable); err != nil {
 		logger.Errorf("Error updating group.conf: %v.", err)
@@ -193,13 +235,10 @@ func (o *osloginMgr) Set(ctx context.Context) error {
 			logger.Errorf("Error creating OS Login sudoers file: %v.", err)
 		}
 
-		// Refresh the NSS cache asynchronously; this can take a while and shouldn't block.
-		go func() {
-			logger.Debugf("Starting OS Login NSS cache fill asynchronously...")
-			if err := run.Quiet(ctx, "google_oslogin_nss_cache"); err != nil {
-				logger.Errorf("Error updating NSS cache: %v.", err)
-			}
-		}()
+		// sssd maintains its own cache of the OS Login users and groups.
+		if !sssd {
+			refreshOSLoginCache(ctx)
+		}
 	}
 
 	return nil
@@ -285,13 +324,7 @@ func filterGoogleLines(contents string) []string {
 
 func writeConfigFile(path, contents string) error {
 	logger.Debugf("writing %s", path)
-	file, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0777)
-	if err != nil {
-		return err
-	}
-	defer closeFile(file)
-	file.WriteString(contents)
-	return nil
+	return replaceConfigFile(path, contents)
 }
 
 func updateSSHConfig(sshConfig string, enable, twofactor, skey, reqCerts bool) string {
@@ -357,16 +390,18 @@ func updateSSHConfig(sshConfig string, enable, twofactor, skey, reqCerts bool) s
 	return strings.Join(filtered, "\n") + "\n"
 }
 
-func writeSSHConfig(enable, twofactor, skey, reqCerts bool) error {
+func writeSSHConfig(tx *configTransaction, enable, twofactor, skey, reqCerts bool, ca sshTrustedCA) error {
 	sshConfig, err := os.ReadFile("/etc/ssh/sshd_config")
 	if err != nil {
 		return err
 	}
 	proposed := updateSSHConfig(string(sshConfig), enable, twofactor, skey, reqCerts)
+	proposed = updateSSHTrustedCAConfig(proposed, ca)
 	if proposed == string(sshConfig) {
 		return nil
 	}
-	return writeConfigFile("/etc/ssh/sshd_config", proposed)
+	logger.Debugf("writing /etc/ssh/sshd_config")
+	return tx.replace("/etc/ssh/sshd_config", proposed)
 }
 
 func updateNSSwitchConfig(nsswitch string, enable bool) string {
@@ -399,7 +434,16 @@ func writeNSSwitchConfig(enable bool) error {
 		logger.Warningf("Error reading NSSwitch config file: %v", err)
 		return err
 	}
-	proposed := updateNSSwitchConfig(string(nsswitch), enable)
+	var proposed string
+	if osloginBackend() == osloginBackendSSSD {
+		// The OS Login NSS modules are only used through sssd.
+		proposed = updateNSSwitchConfig(string(nsswitch), false)
+		if enable {
+			proposed = updateNSSwitchConfigSSSD(proposed)
+		}
+	} else {
+		proposed = updateNSSwitchConfig(string(nsswitch), enable)
+	}
 	if proposed == string(nsswitch) {
 		logger.Debugf("NSSwitch config file is as expected. No changes needed.")
 		return nil
@@ -412,9 +456,16 @@ func writeNSSwitchConfig(enable bool) error {
 	return writeConfigFile("/etc/nsswitch.conf", proposed)
 }
 
-func updatePAMsshdPamless(pamsshd string, enable, twofactor bool) string {
+// updatePAMsshdPamless returns the sshd PAM configuration with the OS Login
+// entries if enable is true. With sssdAccess the account stack also checks
+// sssd's access control, i.e. the sssd_allow_groups. The local users are
+// accepted before it and the users unknown to sssd are left to the other
+// modules.
+func updatePAMsshdPamless(pamsshd string, enable, twofactor, sssdAccess bool) string {
 	authOSLogin := "auth       [success=done perm_denied=die default=ignore] pam_oslogin_login.so"
 	authGroup := "auth       [default=ignore] pam_group.so"
+	accountLocal := "account    sufficient pam_localuser.so"
+	accountSSSD := "account    [default=bad success=ok user_unknown=ignore] pam_sss.so"
 	sessionHomeDir := "session    [success=ok default=ignore] pam_mkhomedir.so"
 
 	if runtime.GOOS == "freebsd" {
@@ -429,7 +480,12 @@ func updatePAMsshdPamless(pamsshd string, enable, twofactor bool) string {
 		if twofactor {
 			topOfFile = append(topOfFile, authOSLogin)
 		}
-		topOfFile = append(topOfFile, authGroup, googleBlockEnd)
+		topOfFile = append(topOfFile, authGroup)
+		if sssdAccess {
+			// The local users, i.e. root, are accepted without asking sssd.
+			topOfFile = append(topOfFile, accountLocal, accountSSSD)
+		}
+		topOfFile = append(topOfFile, googleBlockEnd)
 		bottomOfFile := []string{googleBlockStart, sessionHomeDir, googleBlockEnd}
 		filtered = append(topOfFile, filtered...)
 		filtered = append(filtered, bottomOfFile...)
@@ -437,15 +493,16 @@ func updatePAMsshdPamless(pamsshd string, enable, twofactor bool) string {
 	return strings.Join(filtered, "\n") + "\n"
 }
 
-func writePAMConfig(enable, twofactor bool) error {
+func writePAMConfig(tx *configTransaction, enable, twofactor, sssdAccess bool) error {
 	pamsshd, err := os.ReadFile("/etc/pam.d/sshd")
 	if err != nil {
 		return err
 	}
 
-	proposed := updatePAMsshdPamless(string(pamsshd), enable, twofactor)
+	proposed := updatePAMsshdPamless(string(pamsshd), enable, twofactor, sssdAccess)
 	if proposed != string(pamsshd) {
-		if err := writeConfigFile("/etc/pam.d/sshd", proposed); err != nil {
+		logger.Debugf("writing /etc/pam.d/sshd")
+		if err := tx.replace("/etc/pam.d/sshd", proposed); err != nil {
 			return err
 		}
 	}
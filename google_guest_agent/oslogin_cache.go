@@ -0,0 +1,200 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// osloginCacheWatcherID is the OS Login cache watcher job's ID.
+	osloginCacheWatcherID = "oslogin-cache-watcher"
+
+	// defaultOSLoginCacheWatchInterval is used if cache_watch_interval is not
+	// a valid duration, disabling the polling.
+	defaultOSLoginCacheWatchInterval time.Duration = 0
+
+	// osloginPageSize is the number of users or groups requested per page.
+	osloginPageSize = 1000
+)
+
+var (
+	// osloginCacheMu protects osloginCacheRefreshing and osloginCachePending.
+	osloginCacheMu sync.Mutex
+	// osloginCacheRefreshing is true while the NSS cache is being refreshed.
+	osloginCacheRefreshing bool
+	// osloginCachePending is true if a refresh was requested while another
+	// one was running, it may have fetched outdated data.
+	osloginCachePending bool
+	// refreshOSLoginNSSCache fills the OS Login NSS cache, overridden in tests.
+	refreshOSLoginNSSCache = func(ctx context.Context) error {
+		return run.Quiet(ctx, "google_oslogin_nss_cache")
+	}
+)
+
+// osloginCacheWatcher periodically polls the OS Login users and groups from
+// the metadata server and refreshes the NSS cache as soon as they change, IAM
+// changes otherwise only show up at the next periodic cache refresh.
+type osloginCacheWatcher struct {
+	// client is the metadata server client.
+	client metadata.MDSClientInterface
+	// digest is the digest of the users and groups seen by the last poll,
+	// empty before the first one.
+	digest string
+}
+
+// newOSLoginCacheWatcher returns an OS Login cache watcher polling client.
+func newOSLoginCacheWatcher(client metadata.MDSClientInterface) *osloginCacheWatcher {
+	return &osloginCacheWatcher{client: client}
+}
+
+// ID returns the OS Login cache watcher job's ID.
+func (w *osloginCacheWatcher) ID() string {
+	return osloginCacheWatcherID
+}
+
+// Interval returns the configured polling interval.
+func (w *osloginCacheWatcher) Interval() (time.Duration, bool) {
+	return osloginCacheWatchInterval(), false
+}
+
+// ShouldEnable returns true on Linux if the polling is not disabled and the
+// NSS backend is used, sssd maintains its own cache.
+func (w *osloginCacheWatcher) ShouldEnable(ctx context.Context) bool {
+	return runtime.GOOS != "windows" && osloginCacheWatchInterval() > 0 && osloginBackend() == osloginBackendNSS
+}
+
+// Run polls the OS Login users and groups and refreshes the NSS cache if they
+// changed since the last poll. Nothing is polled while OS Login is disabled.
+func (w *osloginCacheWatcher) Run(ctx context.Context) (bool, error) {
+	// The metadata is replaced by the updates running concurrently.
+	updateMu.Lock()
+	md := newMetadata
+	updateMu.Unlock()
+	if md == nil {
+		return true, nil
+	}
+	if enable, _, _, _ := getOSLoginEnabled(md); !enable {
+		w.digest = ""
+		return true, nil
+	}
+
+	digest, err := osloginDigest(ctx, w.client)
+	if err != nil {
+		return true, err
+	}
+	if w.digest != "" && w.digest != digest {
+		logger.Infof("OS Login users or groups changed, refreshing the NSS cache.")
+		refreshOSLoginCache(ctx)
+	}
+	w.digest = digest
+	return true, nil
+}
+
+// osloginDigest returns a digest of the OS Login users and groups.
+func osloginDigest(ctx context.Context, client metadata.MDSClientInterface) (string, error) {
+	h := sha256.New()
+	for _, list := range []struct{ key, field string }{
+		{"oslogin/users", "loginProfiles"},
+		{"oslogin/groups", "posixGroups"},
+	} {
+		token := ""
+		for {
+			key := fmt.Sprintf("%s?pagesize=%d", list.key, osloginPageSize)
+			if token != "" {
+				key += "&pagetoken=" + url.QueryEscape(token)
+			}
+			resp, err := client.GetKey(ctx, key, nil)
+			if err != nil {
+				return "", fmt.Errorf("failed to get %s: %w", list.key, err)
+			}
+
+			var page map[string]json.RawMessage
+			if err := json.Unmarshal([]byte(resp), &page); err != nil {
+				return "", fmt.Errorf("failed to parse %s: %w", list.key, err)
+			}
+			h.Write(page[list.field])
+
+			token = ""
+			if next, ok := page["nextPageToken"]; ok {
+				if err := json.Unmarshal(next, &token); err != nil {
+					return "", fmt.Errorf("failed to parse %s page token: %w", list.key, err)
+				}
+			}
+			// The last page's token is "0".
+			if token == "" || token == "0" {
+				break
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// refreshOSLoginCache refreshes the OS Login NSS cache asynchronously, this can
+// take a while and shouldn't block. A refresh requested while another one is
+// running is run after it.
+func refreshOSLoginCache(ctx context.Context) {
+	osloginCacheMu.Lock()
+	defer osloginCacheMu.Unlock()
+	if osloginCacheRefreshing {
+		osloginCachePending = true
+		return
+	}
+	osloginCacheRefreshing = true
+
+	// The refresh outlives the run which requested it.
+	ctx = backgroundContext(ctx)
+	go func() {
+		for {
+			logger.Debugf("Starting OS Login NSS cache fill asynchronously...")
+			if err := refreshOSLoginNSSCache(ctx); err != nil {
+				logger.Errorf("Error updating NSS cache: %v.", err)
+			}
+
+			osloginCacheMu.Lock()
+			if !osloginCachePending {
+				osloginCacheRefreshing = false
+				osloginCacheMu.Unlock()
+				return
+			}
+			osloginCachePending = false
+			osloginCacheMu.Unlock()
+		}
+	}()
+}
+
+// osloginCacheWatchInterval returns the configured OS Login cache polling
+// interval.
+func osloginCacheWatchInterval() time.Duration {
+	interval, err := time.ParseDuration(cfg.Get().OSLogin.CacheWatchInterval)
+	if err != nil {
+		logger.Errorf("cache_watch_interval configuration is not a valid duration string, disabling the OS Login cache polling")
+		return defaultOSLoginCacheWatchInterval
+	}
+	return interval
+}
@@ -0,0 +1,145 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+)
+
+// osloginMDSClient serves OS Login users and groups pages by key.
+type osloginMDSClient struct {
+	pages map[string]string
+}
+
+func (c *osloginMDSClient) Get(ctx context.Context) (*metadata.Descriptor, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (c *osloginMDSClient) GetKey(ctx context.Context, key string, headers map[string]string) (string, error) {
+	page, ok := c.pages[key]
+	if !ok {
+		return "", fmt.Errorf("unexpected key %q", key)
+	}
+	return page, nil
+}
+
+func (c *osloginMDSClient) GetKeyRecursive(ctx context.Context, key string) (string, error) {
+	return "", fmt.Errorf("not implemented")
+}
+
+func (c *osloginMDSClient) Watch(ctx context.Context) (*metadata.Descriptor, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (c *osloginMDSClient) WatchKey(ctx context.Context, key string) (string, error) {
+	return "", fmt.Errorf("not implemented")
+}
+
+func (c *osloginMDSClient) WriteGuestAttributes(ctx context.Context, key, value string) error {
+	return fmt.Errorf("not implemented")
+}
+
+func TestOSLoginDigest(t *testing.T) {
+	ctx := context.Background()
+	client := &osloginMDSClient{pages: map[string]string{
+		"oslogin/users?pagesize=1000":               `{"loginProfiles": [{"name": "1"}], "nextPageToken": "abc"}`,
+		"oslogin/users?pagesize=1000&pagetoken=abc": `{"loginProfiles": [{"name": "2"}], "nextPageToken": "0"}`,
+		"oslogin/groups?pagesize=1000":              `{"posixGroups": [{"name": "g1", "gid": 1001}]}`,
+	}}
+
+	digest, err := osloginDigest(ctx, client)
+	if err != nil {
+		t.Fatalf("osloginDigest() failed unexpectedly with error: %v", err)
+	}
+	if again, err := osloginDigest(ctx, client); err != nil || again != digest {
+		t.Errorf("osloginDigest() = %q, %v on unchanged data, want %q, nil", again, err, digest)
+	}
+
+	client.pages["oslogin/users?pagesize=1000&pagetoken=abc"] = `{"loginProfiles": [{"name": "3"}], "nextPageToken": "0"}`
+	if changed, err := osloginDigest(ctx, client); err != nil || changed == digest {
+		t.Errorf("osloginDigest() = %q, %v on changed users, want a new digest", changed, err)
+	}
+
+	client.pages["oslogin/groups?pagesize=1000"] = `invalid`
+	if _, err := osloginDigest(ctx, client); err == nil {
+		t.Errorf("osloginDigest() succeeded with an invalid groups page, want error")
+	}
+}
+
+func TestOSLoginCacheWatcher(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	refreshes := 0
+	refreshed := make(chan bool, 1)
+	origMetadata, origRefresh := newMetadata, refreshOSLoginNSSCache
+	t.Cleanup(func() { newMetadata, refreshOSLoginNSSCache = origMetadata, origRefresh })
+	refreshOSLoginNSSCache = func(context.Context) error {
+		mu.Lock()
+		refreshes++
+		mu.Unlock()
+		refreshed <- true
+		return nil
+	}
+
+	enable := true
+	newMetadata = &metadata.Descriptor{}
+	newMetadata.Instance.Attributes.EnableOSLogin = &enable
+	client := &osloginMDSClient{pages: map[string]string{
+		"oslogin/users?pagesize=1000":  `{"loginProfiles": [{"name": "1"}]}`,
+		"oslogin/groups?pagesize=1000": `{"posixGroups": []}`,
+	}}
+	watcher := newOSLoginCacheWatcher(client)
+
+	// The first poll only records the users and groups.
+	for i := 0; i < 2; i++ {
+		if _, err := watcher.Run(ctx); err != nil {
+			t.Fatalf("Run() failed unexpectedly with error: %v", err)
+		}
+	}
+
+	client.pages["oslogin/groups?pagesize=1000"] = `{"posixGroups": [{"name": "g1", "gid": 1001}]}`
+	if _, err := watcher.Run(ctx); err != nil {
+		t.Fatalf("Run() failed unexpectedly with error: %v", err)
+	}
+	select {
+	case <-refreshed:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Run() didn't refresh the NSS cache after a groups change")
+	}
+
+	// Disabling OS Login stops the polling.
+	enable = false
+	client.pages = nil
+	if _, err := watcher.Run(ctx); err != nil {
+		t.Errorf("Run() with OS Login disabled failed unexpectedly with error: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if refreshes != 1 {
+		t.Errorf("Run() refreshed the NSS cache %d times, want 1", refreshes)
+	}
+}
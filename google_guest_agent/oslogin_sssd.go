@@ -0,0 +1,141 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// osloginBackendNSS resolves OS Login users and groups with the OS Login
+	// NSS modules and the cache refreshed by the agent.
+	osloginBackendNSS = "nss"
+	// osloginBackendSSSD resolves OS Login users and groups with an sssd
+	// domain proxying to the OS Login NSS module.
+	osloginBackendSSSD = "sssd"
+	// sssdOSLoginDomain is the name of the sssd domain serving OS Login users.
+	sssdOSLoginDomain = "google-oslogin"
+)
+
+var (
+	// sssdConfigFile is the sssd configuration snippet managed by the agent.
+	sssdConfigFile = "/etc/sssd/conf.d/google-oslogin.conf"
+)
+
+// osloginBackend returns the configured OS Login backend, falling back to the
+// NSS backend for unknown values.
+func osloginBackend() string {
+	backend := strings.ToLower(strings.TrimSpace(cfg.Get().OSLogin.Backend))
+	switch backend {
+	case osloginBackendSSSD:
+		return osloginBackendSSSD
+	case "", osloginBackendNSS:
+		return osloginBackendNSS
+	default:
+		logger.Errorf("Unknown OS Login backend %q, falling back to %q", backend, osloginBackendNSS)
+		return osloginBackendNSS
+	}
+}
+
+// sssdConfig returns the sssd configuration of the OS Login domain. Users are
+// only allowed to log in if they are members of allowGroups, if not empty.
+func sssdConfig(allowGroups []string) string {
+	lines := []string{
+		googleComment,
+		fmt.Sprintf("[domain/%s]", sssdOSLoginDomain),
+		"enabled = true",
+		"id_provider = proxy",
+		"proxy_lib_name = oslogin",
+		"auth_provider = none",
+		"enumerate = false",
+		"cache_credentials = false",
+	}
+	if len(allowGroups) == 0 {
+		lines = append(lines, "access_provider = permit")
+	} else {
+		lines = append(lines, "access_provider = simple", "simple_allow_groups = "+strings.Join(allowGroups, ", "))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// sssdAllowGroups returns the groups configured with sssd_allow_groups.
+func sssdAllowGroups() []string {
+	var groups []string
+	for _, group := range strings.Split(cfg.Get().OSLogin.SSSDAllowGroups, ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// writeSSSDConfig writes the sssd OS Login domain configuration if enable is
+// true, removes it otherwise. It returns true if the configuration changed.
+func writeSSSDConfig(enable bool) (bool, error) {
+	current, err := os.ReadFile(sssdConfigFile)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	exists := err == nil
+
+	if !enable {
+		if !exists {
+			return false, nil
+		}
+		return true, os.Remove(sssdConfigFile)
+	}
+
+	proposed := sssdConfig(sssdAllowGroups())
+	if exists && string(current) == proposed {
+		return false, nil
+	}
+
+	// sssd must be installed, the agent only adds its domain.
+	sssdDir := filepath.Dir(filepath.Dir(sssdConfigFile))
+	if _, err := os.Stat(sssdDir); err != nil {
+		return false, fmt.Errorf("sssd is not installed: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(sssdConfigFile), 0711); err != nil {
+		return false, err
+	}
+	if err := replaceConfigFile(sssdConfigFile, proposed); err != nil {
+		return false, err
+	}
+	// sssd refuses configuration snippets readable by other users.
+	return true, os.Chmod(sssdConfigFile, 0600)
+}
+
+// updateNSSwitchConfigSSSD adds the sss NSS module to the passwd and group
+// databases of nsswitch. It is not removed when OS Login is disabled as sssd
+// may serve other domains.
+func updateNSSwitchConfigSSSD(nsswitch string) string {
+	var filtered []string
+	for _, line := range strings.Split(nsswitch, "\n") {
+		if strings.HasPrefix(line, "passwd:") || strings.HasPrefix(line, "group:") {
+			if !slices.Contains(strings.Fields(line)[1:], "sss") {
+				line += " sss"
+			}
+		}
+		filtered = append(filtered, line)
+	}
+	return strings.Join(filtered, "\n")
+}
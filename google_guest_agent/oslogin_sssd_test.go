@@ -0,0 +1,125 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+)
+
+func TestOSLoginBackend(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+	t.Cleanup(func() { config.OSLogin.Backend = osloginBackendNSS })
+
+	tests := []struct {
+		backend string
+		want    string
+	}{
+		{backend: "nss", want: osloginBackendNSS},
+		{backend: "", want: osloginBackendNSS},
+		{backend: " SSSD ", want: osloginBackendSSSD},
+		{backend: "ldap", want: osloginBackendNSS},
+	}
+
+	for _, tc := range tests {
+		config.OSLogin.Backend = tc.backend
+		if got := osloginBackend(); got != tc.want {
+			t.Errorf("osloginBackend() = %q for backend %q, want %q", got, tc.backend, tc.want)
+		}
+	}
+}
+
+func TestSSSDConfig(t *testing.T) {
+	if got := sssdConfig(nil); !strings.Contains(got, "access_provider = permit\n") {
+		t.Errorf("sssdConfig(nil) = %q, want access_provider = permit", got)
+	}
+
+	got := sssdConfig([]string{"admins", "ops"})
+	for _, want := range []string{"[domain/google-oslogin]\n", "proxy_lib_name = oslogin\n", "access_provider = simple\n", "simple_allow_groups = admins, ops\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("sssdConfig([admins ops]) = %q, want it to contain %q", got, want)
+		}
+	}
+}
+
+func TestWriteSSSDConfig(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+	config.OSLogin.SSSDAllowGroups = " admins, ,ops"
+	t.Cleanup(func() { config.OSLogin.SSSDAllowGroups = "" })
+
+	origFile := sssdConfigFile
+	t.Cleanup(func() { sssdConfigFile = origFile })
+	sssdConfigFile = filepath.Join(t.TempDir(), "sssd", "conf.d", "google-oslogin.conf")
+
+	if _, err := writeSSSDConfig(true); err == nil {
+		t.Errorf("writeSSSDConfig(true) succeeded without sssd installed, want error")
+	}
+
+	if err := os.Mkdir(filepath.Dir(filepath.Dir(sssdConfigFile)), 0755); err != nil {
+		t.Fatalf("os.Mkdir() failed unexpectedly with error: %v", err)
+	}
+
+	steps := []struct {
+		enable      bool
+		wantChanged bool
+		wantExists  bool
+	}{
+		{enable: true, wantChanged: true, wantExists: true},
+		{enable: true, wantChanged: false, wantExists: true},
+		{enable: false, wantChanged: true, wantExists: false},
+		{enable: false, wantChanged: false, wantExists: false},
+	}
+
+	for i, step := range steps {
+		changed, err := writeSSSDConfig(step.enable)
+		if err != nil {
+			t.Fatalf("step %d: writeSSSDConfig(%t) failed unexpectedly with error: %v", i, step.enable, err)
+		}
+		if changed != step.wantChanged {
+			t.Errorf("step %d: writeSSSDConfig(%t) = %t, want %t", i, step.enable, changed, step.wantChanged)
+		}
+
+		info, err := os.Stat(sssdConfigFile)
+		if exists := err == nil; exists != step.wantExists {
+			t.Fatalf("step %d: %s exists: %t, want %t", i, sssdConfigFile, exists, step.wantExists)
+		}
+		if step.wantExists && info.Mode().Perm() != 0600 {
+			t.Errorf("step %d: %s has mode %v, want %v", i, sssdConfigFile, info.Mode().Perm(), os.FileMode(0600))
+		}
+	}
+}
+
+func TestUpdateNSSwitchConfigSSSD(t *testing.T) {
+	contents := "passwd: files\ngroup: files sss\nshadow: files\n"
+	want := "passwd: files sss\ngroup: files sss\nshadow: files\n"
+
+	got := updateNSSwitchConfigSSSD(contents)
+	if got != want {
+		t.Errorf("updateNSSwitchConfigSSSD(%q) = %q, want %q", contents, got, want)
+	}
+	if again := updateNSSwitchConfigSSSD(got); again != got {
+		t.Errorf("updateNSSwitchConfigSSSD(%q) = %q, want it unchanged", got, again)
+	}
+}
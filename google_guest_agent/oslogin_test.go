@@ -579,12 +579,34 @@ func TestUpdateSSHConfig(t *testing.T) {
 func TestUpdatePAMsshdPamless(t *testing.T) {
 	authOSLogin := "auth       [success=done perm_denied=die default=ignore] pam_oslogin_login.so"
 	authGroup := "auth       [default=ignore] pam_group.so"
+	accountLocal := "account    sufficient pam_localuser.so"
+	accountSSSD := "account    [default=bad success=ok user_unknown=ignore] pam_sss.so"
 	sessionHomeDir := "session    [success=ok default=ignore] pam_mkhomedir.so"
 
 	var tests = []struct {
-		contents, want    []string
-		enable, twofactor bool
+		contents, want                []string
+		enable, twofactor, sssdAccess bool
 	}{
+		{
+			contents: []string{
+				"line1",
+				"line2",
+			},
+			want: []string{
+				googleBlockStart,
+				authGroup,
+				accountLocal,
+				accountSSSD,
+				googleBlockEnd,
+				"line1",
+				"line2",
+				googleBlockStart,
+				sessionHomeDir,
+				googleBlockEnd,
+			},
+			enable:     true,
+			sssdAccess: true,
+		},
 		{
 			contents: []string{
 				"line1",
@@ -645,7 +667,7 @@ func TestUpdatePAMsshdPamless(t *testing.T) {
 			contents := strings.Join(tt.contents, "\n") + "\n"
 			want := strings.Join(tt.want, "\n") + "\n"
 
-			if res := updatePAMsshdPamless(contents, tt.enable, tt.twofactor); res != want {
+			if res := updatePAMsshdPamless(contents, tt.enable, tt.twofactor, tt.sssdAccess); res != want {
 				t.Errorf("want:\n%v\ngot:\n%v\n", want, res)
 			}
 		})
@@ -0,0 +1,261 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// remoteAccessCertRotatorID is the RDP and WinRM certificate rotation
+	// job's ID.
+	remoteAccessCertRotatorID = "remote-access-cert-rotation"
+
+	// remoteAccessCertName is the friendly name identifying the certificates
+	// managed by the agent in the local machine's personal store.
+	remoteAccessCertName = "Google Compute Engine Remote Access"
+
+	// maxRemoteAccessCertCheckInterval bounds the interval at which the
+	// certificate's age is checked, the agent restarts would otherwise postpone
+	// the rotation.
+	maxRemoteAccessCertCheckInterval = time.Hour
+
+	// defaultRemoteAccessCertRotationInterval is used if rotation_interval is
+	// not a valid duration.
+	defaultRemoteAccessCertRotationInterval = 30 * 24 * time.Hour
+
+	// rdpServiceAccount is the NETWORK SERVICE account's SID, the Remote
+	// Desktop Services run as it and read the certificate's private key.
+	rdpServiceAccount = "*S-1-5-20"
+)
+
+var (
+	// thumbprintExp matches a certificate's SHA1 thumbprint.
+	thumbprintExp = regexp.MustCompile(`^[0-9A-F]{40}$`)
+)
+
+// remoteAccessCert is a certificate managed by the agent.
+type remoteAccessCert struct {
+	thumbprint string
+	notBefore  time.Time
+}
+
+// remoteAccessCertRotator generates a self-signed TLS certificate, replaces
+// it once older than the configured rotation interval, binds it to the RDP
+// and WinRM HTTPS listeners and publishes its thumbprint to the guest
+// attributes.
+type remoteAccessCertRotator struct {
+	client metadata.MDSClientInterface
+	// bound is the thumbprint of the certificate last bound and published.
+	bound string
+}
+
+// newRemoteAccessCertRotator returns the RDP and WinRM certificate rotation
+// job publishing the thumbprints with client.
+func newRemoteAccessCertRotator(client metadata.MDSClientInterface) *remoteAccessCertRotator {
+	return &remoteAccessCertRotator{client: client}
+}
+
+// ID returns the certificate rotation job's ID.
+func (r *remoteAccessCertRotator) ID() string {
+	return remoteAccessCertRotatorID
+}
+
+// Interval returns the interval at which the certificate's age is checked.
+func (r *remoteAccessCertRotator) Interval() (time.Duration, bool) {
+	return min(remoteAccessCertRotationInterval(), maxRemoteAccessCertCheckInterval), true
+}
+
+// ShouldEnable returns true on Windows if the certificate of RDP or WinRM is
+// managed.
+func (r *remoteAccessCertRotator) ShouldEnable(ctx context.Context) bool {
+	config := cfg.Get().RemoteAccessCerts
+	return runtime.GOOS == "windows" && config != nil && (config.RDP || config.WinRM)
+}
+
+// Run replaces the certificate if it's missing or due, binds it to the
+// listeners and publishes its thumbprint if it changed.
+func (r *remoteAccessCertRotator) Run(ctx context.Context) (bool, error) {
+	config := cfg.Get().RemoteAccessCerts
+	interval := remoteAccessCertRotationInterval()
+
+	cert, err := currentRemoteAccessCert(ctx)
+	if err != nil {
+		return true, err
+	}
+
+	thumbprint := cert.thumbprint
+	if thumbprint == "" || time.Since(cert.notBefore) >= interval {
+		logger.Infof("Generating a new RDP and WinRM certificate.")
+		if thumbprint, err = createRemoteAccessCert(ctx, 2*interval); err != nil {
+			return true, fmt.Errorf("failed to generate the RDP and WinRM certificate: %w", err)
+		}
+	}
+	if thumbprint == r.bound {
+		return true, nil
+	}
+
+	var errs []error
+	if config.RDP {
+		if err := runPowerShell(ctx, certKeyGrantCommand(`LocalMachine\My\`+thumbprint, []string{rdpServiceAccount})); err != nil {
+			errs = append(errs, fmt.Errorf("failed to grant the Remote Desktop Services access to the RDP certificate's key: %w", err))
+		} else if err := runPowerShell(ctx, rdpCertBindCommand(thumbprint)); err != nil {
+			errs = append(errs, fmt.Errorf("failed to bind the RDP certificate: %w", err))
+		}
+	}
+	if config.WinRM {
+		if err := runPowerShell(ctx, winRMCertBindCommand(thumbprint)); err != nil {
+			errs = append(errs, fmt.Errorf("failed to bind the WinRM certificate: %w", err))
+		}
+	}
+	if len(errs) > 0 {
+		return true, errors.Join(errs...)
+	}
+
+	for key, enabled := range map[string]bool{
+		"remoteaccess/rdp-thumbprint":   config.RDP,
+		"remoteaccess/winrm-thumbprint": config.WinRM,
+	} {
+		if !enabled {
+			continue
+		}
+		if err := r.client.WriteGuestAttributes(ctx, key, thumbprint); err != nil {
+			logger.Errorf("Failed to publish %s guest attribute: %v", key, err)
+		}
+	}
+
+	// The previous certificates are no longer bound to any listener.
+	if err := runPowerShell(ctx, remoteAccessCertCleanupCommand(thumbprint)); err != nil {
+		logger.Errorf("Failed to remove the previous RDP and WinRM certificates: %v", err)
+	}
+	r.bound = thumbprint
+	return true, nil
+}
+
+// runPowerShell runs a PowerShell command.
+func runPowerShell(ctx context.Context, command string) error {
+	_, err := runPowerShellOutput(ctx, command)
+	return err
+}
+
+// runPowerShellOutput runs a PowerShell command returning its trimmed output.
+func runPowerShellOutput(ctx context.Context, command string) (string, error) {
+	res := run.WithOutput(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command", command)
+	if res.ExitCode != 0 {
+		return "", fmt.Errorf("%s", strings.TrimSpace(res.StdErr))
+	}
+	return strings.TrimSpace(res.StdOut), nil
+}
+
+// currentRemoteAccessCert returns the most recent certificate managed by the
+// agent, its thumbprint is empty if there is none.
+func currentRemoteAccessCert(ctx context.Context) (remoteAccessCert, error) {
+	out, err := runPowerShellOutput(ctx, remoteAccessCertQueryCommand())
+	if err != nil {
+		return remoteAccessCert{}, fmt.Errorf("failed to look up the RDP and WinRM certificate: %w", err)
+	}
+	return parseRemoteAccessCert(out)
+}
+
+// parseRemoteAccessCert parses the "<thumbprint> <not before>" output of the
+// certificate query command.
+func parseRemoteAccessCert(out string) (remoteAccessCert, error) {
+	if out == "" {
+		return remoteAccessCert{}, nil
+	}
+	thumbprint, date, found := strings.Cut(out, " ")
+	if !found || !thumbprintExp.MatchString(thumbprint) {
+		return remoteAccessCert{}, fmt.Errorf("unexpected certificate %q", out)
+	}
+	notBefore, err := time.Parse(time.RFC3339, strings.TrimSpace(date))
+	if err != nil {
+		return remoteAccessCert{}, fmt.Errorf("unexpected certificate date %q: %w", date, err)
+	}
+	return remoteAccessCert{thumbprint: thumbprint, notBefore: notBefore}, nil
+}
+
+// createRemoteAccessCert generates a self-signed server certificate valid for
+// validity and returns its thumbprint.
+func createRemoteAccessCert(ctx context.Context, validity time.Duration) (string, error) {
+	thumbprint, err := runPowerShellOutput(ctx, remoteAccessCertCreateCommand(validity))
+	if err != nil {
+		return "", err
+	}
+	if !thumbprintExp.MatchString(thumbprint) {
+		return "", fmt.Errorf("unexpected certificate thumbprint %q", thumbprint)
+	}
+	return thumbprint, nil
+}
+
+// remoteAccessCertQueryCommand returns the PowerShell command printing the
+// thumbprint and issuance date of the most recent certificate managed by the
+// agent.
+func remoteAccessCertQueryCommand() string {
+	return fmt.Sprintf("Get-ChildItem Cert:\\LocalMachine\\My | Where-Object FriendlyName -eq %s | "+
+		"Sort-Object NotBefore -Descending | Select-Object -First 1 | "+
+		"ForEach-Object { $_.Thumbprint + ' ' + $_.NotBefore.ToUniversalTime().ToString('yyyy-MM-ddTHH:mm:ssZ') }", psQuote(remoteAccessCertName))
+}
+
+// remoteAccessCertCreateCommand returns the PowerShell command generating a
+// certificate valid for validity and printing its thumbprint.
+func remoteAccessCertCreateCommand(validity time.Duration) string {
+	return fmt.Sprintf("(New-SelfSignedCertificate -DnsName ([System.Net.Dns]::GetHostEntry('').HostName), $env:COMPUTERNAME "+
+		"-CertStoreLocation Cert:\\LocalMachine\\My -FriendlyName %s -KeyAlgorithm RSA -KeyLength 3072 -KeyExportPolicy NonExportable "+
+		"-TextExtension @('2.5.29.37={text}1.3.6.1.5.5.7.3.1') -NotAfter (Get-Date).AddHours(%d)).Thumbprint", psQuote(remoteAccessCertName), int64(validity.Hours()))
+}
+
+// rdpCertBindCommand returns the PowerShell command binding the certificate
+// to the RDP listener.
+func rdpCertBindCommand(thumbprint string) string {
+	return fmt.Sprintf("Get-CimInstance -Namespace root/cimv2/TerminalServices -ClassName Win32_TSGeneralSetting -Filter \"TerminalName='RDP-tcp'\" | "+
+		"Set-CimInstance -Property @{SSLCertificateSHA1Hash=%s}", psQuote(thumbprint))
+}
+
+// winRMCertBindCommand returns the PowerShell command binding the certificate
+// to the WinRM HTTPS listener, creating the listener if needed.
+func winRMCertBindCommand(thumbprint string) string {
+	return fmt.Sprintf("$l = Get-ChildItem WSMan:\\localhost\\Listener | Where-Object { $_.Keys -contains 'Transport=HTTPS' } | Select-Object -First 1; "+
+		"if ($l) { Set-Item -Path (Join-Path $l.PSPath 'CertificateThumbprint') -Value %[1]s -Force } "+
+		"else { New-Item -Path WSMan:\\localhost\\Listener -Transport HTTPS -Address * -CertificateThumbprint %[1]s -Force | Out-Null }", psQuote(thumbprint))
+}
+
+// remoteAccessCertCleanupCommand returns the PowerShell command removing the
+// certificates managed by the agent other than thumbprint.
+func remoteAccessCertCleanupCommand(thumbprint string) string {
+	return fmt.Sprintf("Get-ChildItem Cert:\\LocalMachine\\My | Where-Object { $_.FriendlyName -eq %s -and $_.Thumbprint -ne %s } | Remove-Item",
+		psQuote(remoteAccessCertName), psQuote(thumbprint))
+}
+
+// remoteAccessCertRotationInterval returns the configured certificate
+// rotation interval.
+func remoteAccessCertRotationInterval() time.Duration {
+	interval, err := time.ParseDuration(cfg.Get().RemoteAccessCerts.RotationInterval)
+	if err != nil || interval <= 0 {
+		logger.Errorf("RemoteAccessCerts rotation_interval configuration is not a valid duration string, falling back to %s", defaultRemoteAccessCertRotationInterval)
+		return defaultRemoteAccessCertRotationInterval
+	}
+	return interval
+}
@@ -0,0 +1,171 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+)
+
+const (
+	testOldThumbprint = "0123456789ABCDEF0123456789ABCDEF01234567"
+	testNewThumbprint = "89ABCDEF0123456789ABCDEF0123456789ABCDEF"
+)
+
+// certMockRunner fakes the certificate PowerShell commands, the query
+// returns current and the creation makes testNewThumbprint current.
+type certMockRunner struct {
+	current  string
+	commands []string
+}
+
+func (r *certMockRunner) Quiet(ctx context.Context, name string, args ...string) error {
+	return nil
+}
+
+func (r *certMockRunner) WithOutput(ctx context.Context, name string, args ...string) *run.Result {
+	command := args[len(args)-1]
+	r.commands = append(r.commands, command)
+	switch {
+	case strings.HasPrefix(command, "Get-ChildItem") && strings.Contains(command, "Sort-Object"):
+		return &run.Result{StdOut: r.current + "\r\n"}
+	case strings.HasPrefix(command, "(New-SelfSignedCertificate"):
+		r.current = testNewThumbprint + " " + time.Now().UTC().Format(time.RFC3339)
+		return &run.Result{StdOut: testNewThumbprint + "\r\n"}
+	}
+	return &run.Result{}
+}
+
+func (r *certMockRunner) WithOutputTimeout(ctx context.Context, timeout time.Duration, name string, args ...string) *run.Result {
+	return r.WithOutput(ctx, name, args...)
+}
+
+func (r *certMockRunner) WithCombinedOutput(ctx context.Context, name string, args ...string) *run.Result {
+	return r.WithOutput(ctx, name, args...)
+}
+
+func TestParseRemoteAccessCert(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		want    remoteAccessCert
+		wantErr bool
+	}{
+		{
+			name: "none",
+			out:  "",
+			want: remoteAccessCert{},
+		},
+		{
+			name: "valid",
+			out:  testOldThumbprint + " 2024-01-02T03:04:05Z",
+			want: remoteAccessCert{thumbprint: testOldThumbprint, notBefore: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)},
+		},
+		{
+			name:    "invalid_thumbprint",
+			out:     "abc 2024-01-02T03:04:05Z",
+			wantErr: true,
+		},
+		{
+			name:    "invalid_date",
+			out:     testOldThumbprint + " yesterday",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseRemoteAccessCert(tc.out)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("parseRemoteAccessCert(%q) = error %v, want error: %t", tc.out, err, tc.wantErr)
+			}
+			if got.thumbprint != tc.want.thumbprint || !got.notBefore.Equal(tc.want.notBefore) {
+				t.Errorf("parseRemoteAccessCert(%q) = %+v, want %+v", tc.out, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRemoteAccessCertRotatorRun(t *testing.T) {
+	ctx := context.Background()
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get().RemoteAccessCerts
+	config.RDP, config.WinRM = true, true
+	t.Cleanup(func() { config.RDP, config.WinRM = false, false })
+
+	origClient := run.Client
+	t.Cleanup(func() { run.Client = origClient })
+	runner := &certMockRunner{current: testOldThumbprint + " 2000-01-01T00:00:00Z"}
+	run.Client = runner
+
+	client := &guestAttributesClient{attributes: make(map[string]string)}
+	rotator := newRemoteAccessCertRotator(client)
+
+	if _, err := rotator.Run(ctx); err != nil {
+		t.Fatalf("rotator.Run() failed unexpectedly with error: %v", err)
+	}
+
+	for _, key := range []string{"remoteaccess/rdp-thumbprint", "remoteaccess/winrm-thumbprint"} {
+		if got := client.attributes[key]; got != testNewThumbprint {
+			t.Errorf("rotator.Run() published %s = %q, want %q", key, got, testNewThumbprint)
+		}
+	}
+	var grants, binds, cleanups int
+	for _, command := range runner.commands {
+		if strings.Contains(command, testNewThumbprint) && strings.Contains(command, "icacls") && strings.Contains(command, rdpServiceAccount+":R") {
+			grants++
+		}
+		if strings.Contains(command, testNewThumbprint) && (strings.Contains(command, "SSLCertificateSHA1Hash") || strings.Contains(command, "WSMan:")) {
+			binds++
+		}
+		if strings.Contains(command, "Remove-Item") {
+			cleanups++
+		}
+	}
+	if grants != 1 || binds != 2 || cleanups != 1 {
+		t.Errorf("rotator.Run() ran %d key grants, %d binds and %d cleanups, want 1, 2 and 1: %v", grants, binds, cleanups, runner.commands)
+	}
+
+	// The new certificate isn't due, nothing else should run.
+	runner.commands = nil
+	if _, err := rotator.Run(ctx); err != nil {
+		t.Fatalf("rotator.Run() failed unexpectedly with error: %v", err)
+	}
+	if len(runner.commands) != 1 {
+		t.Errorf("rotator.Run() ran %v with a current certificate, want only the query", runner.commands)
+	}
+}
+
+func TestRemoteAccessCertCommandsQuoting(t *testing.T) {
+	for _, command := range []string{
+		rdpCertBindCommand("a'b"),
+		winRMCertBindCommand("a'b"),
+		remoteAccessCertCleanupCommand("a'b"),
+	} {
+		if !strings.Contains(command, "'a''b'") {
+			t.Errorf("command %q doesn't quote the thumbprint", command)
+		}
+	}
+	if got := remoteAccessCertCreateCommand(48 * time.Hour); !strings.Contains(got, "AddHours(48)") {
+		t.Errorf("remoteAccessCertCreateCommand(48h) = %q, want a 48 hours validity", got)
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"runtime"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/events/routes"
+	network "github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/network/manager"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// routeReconcilerID is the route reconciler job's ID.
+	routeReconcilerID = "route-reconciler"
+
+	// defaultRouteReconcileInterval is used if route_reconcile_interval is not
+	// a valid duration.
+	defaultRouteReconcileInterval = time.Minute
+)
+
+// routeReconciler periodically verifies the local routes of the forwarded IPs
+// and alias IP ranges, and the custom routes, re-adding the ones removed
+// behind the agent's back (i.e. by ip route flush). The address manager only
+// runs on metadata changes.
+type routeReconciler struct {
+	// watcher reports the repairs as events, if not nil.
+	watcher *routes.Watcher
+}
+
+// newRouteReconciler returns a route reconciler reporting its repairs to watcher.
+func newRouteReconciler(watcher *routes.Watcher) *routeReconciler {
+	return &routeReconciler{watcher: watcher}
+}
+
+// ID returns the route reconciler job's ID.
+func (r *routeReconciler) ID() string {
+	return routeReconcilerID
+}
+
+// Interval returns the configured reconciliation interval, the first run
+// happens one interval after the address manager's initial setup.
+func (r *routeReconciler) Interval() (time.Duration, bool) {
+	return routeReconcileInterval(), false
+}
+
+// ShouldEnable returns true on Linux if IP forwarding or the network interface
+// setup is enabled and the reconciliation is not disabled.
+func (r *routeReconciler) ShouldEnable(ctx context.Context) bool {
+	config := cfg.Get()
+	enabled := config.NetworkInterfaces.IPForwarding || config.NetworkInterfaces.Setup
+	return runtime.GOOS != "windows" && enabled && routeReconcileInterval() > 0
+}
+
+// Run re-adds the missing local and custom routes and reports them.
+func (r *routeReconciler) Run(ctx context.Context) (bool, error) {
+	config := cfg.Get()
+
+	// The metadata is replaced by the updates running concurrently.
+	updateMu.Lock()
+	var nics []metadata.NetworkInterfaces
+	if newMetadata != nil {
+		nics = newMetadata.Instance.NetworkInterfaces
+	}
+	noMetadata := newMetadata == nil
+	updateMu.Unlock()
+	if noMetadata || pausedForMaintenance(routeReconcilerID) {
+		return true, nil
+	}
+
+	disabled, err := addressManager.Disabled(ctx)
+	if err != nil || disabled {
+		return true, err
+	}
+
+	routesMu.Lock()
+	defer routesMu.Unlock()
+
+	var repairs []routes.Repair
+	if config.NetworkInterfaces.IPForwarding {
+		repairs = repairLocalRoutes(ctx, config, nics)
+	}
+	if config.NetworkInterfaces.Setup {
+		for _, repair := range network.ReconcileCustomRoutes(ctx, config) {
+			repairs = append(repairs, routes.Repair{Interface: repair.Interface, MAC: repair.MAC, Routes: repair.Routes})
+		}
+	}
+
+	if r.watcher != nil {
+		r.watcher.Report(repairs)
+	}
+	return true, nil
+}
+
+// repairLocalRoutes re-adds the missing local routes of the forwarded IPs and
+// alias IP ranges of nics, and returns them.
+func repairLocalRoutes(ctx context.Context, config *cfg.Sections, nics []metadata.NetworkInterfaces) []routes.Repair {
+	var repairs []routes.Repair
+	for _, ni := range nics {
+		// The interfaces not found are already reported by the address manager.
+		iface, err := network.GetInterfaceByMAC(config, ni.Mac)
+		if err != nil {
+			continue
+		}
+
+		configured, err := getLocalRoutes(ctx, config, iface.Name)
+		if err != nil {
+			logger.Errorf("Error getting routes of %s: %v", iface.Name, err)
+			continue
+		}
+
+		toAdd, _ := compareRoutes(trimSuffix32(configured), trimSuffix32(wantForwardedIPs(config, ni)))
+		if len(toAdd) == 0 {
+			continue
+		}
+
+		logger.Warningf("Routes %q of %s are missing, re-adding them.", toAdd, iface.Name)
+
+		var added []string
+		for _, ip := range toAdd {
+			if err := addLocalRoute(ctx, config, ip, iface.Name); err != nil {
+				logger.Errorf("error adding route: %v", err)
+				continue
+			}
+			added = append(added, ip)
+		}
+
+		if len(added) > 0 {
+			repairs = append(repairs, routes.Repair{Interface: iface.Name, MAC: ni.Mac, Routes: added})
+		}
+	}
+	return repairs
+}
+
+// routeReconcileInterval returns the configured route reconciliation interval.
+func routeReconcileInterval() time.Duration {
+	interval, err := time.ParseDuration(cfg.Get().IPForwarding.RouteReconcileInterval)
+	if err != nil {
+		logger.Errorf("route_reconcile_interval configuration is not a valid duration string, falling back to %s", defaultRouteReconcileInterval)
+		return defaultRouteReconcileInterval
+	}
+	return interval
+}
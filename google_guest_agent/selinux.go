@@ -0,0 +1,64 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+var (
+	// selinuxEnforceFile exists when the selinuxfs is mounted, that is when
+	// SELinux is enabled.
+	selinuxEnforceFile = "/sys/fs/selinux/enforce"
+	// restoreconLookPath looks up the restorecon binary, overridden in tests.
+	restoreconLookPath = exec.LookPath
+)
+
+// selinuxEnabled returns true if SELinux is enabled on the system.
+func selinuxEnabled() bool {
+	_, err := os.Stat(selinuxEnforceFile)
+	return err == nil
+}
+
+// restoreSELinuxContext resets the SELinux context of the paths to the policy
+// defaults, files created by the agent otherwise inherit the context of their
+// parent directory and sshd is denied access on enforcing systems. It does
+// nothing if SELinux is disabled.
+func restoreSELinuxContext(ctx context.Context, recursive bool, paths ...string) error {
+	if !selinuxEnabled() || len(paths) == 0 {
+		return nil
+	}
+	restorecon, err := restoreconLookPath("restorecon")
+	if err != nil {
+		logger.Warningf("SELinux is enabled but restorecon is not available, not restoring context of %v.", paths)
+		return nil
+	}
+
+	var args []string
+	if recursive {
+		args = append(args, "-R")
+	}
+	args = append(args, paths...)
+	if err := run.Quiet(ctx, restorecon, args...); err != nil {
+		return fmt.Errorf("error setting selinux context of %v: %w", paths, err)
+	}
+	return nil
+}
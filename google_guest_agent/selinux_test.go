@@ -0,0 +1,95 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/google/go-cmp/cmp"
+)
+
+// restoreconMockRunner records the commands it runs.
+type restoreconMockRunner struct {
+	commands []string
+}
+
+func (r *restoreconMockRunner) Quiet(ctx context.Context, name string, args ...string) error {
+	r.commands = append(r.commands, strings.Join(append([]string{name}, args...), " "))
+	return nil
+}
+
+func (r *restoreconMockRunner) WithOutput(ctx context.Context, name string, args ...string) *run.Result {
+	return &run.Result{ExitCode: 1}
+}
+
+func (r *restoreconMockRunner) WithOutputTimeout(ctx context.Context, timeout time.Duration, name string, args ...string) *run.Result {
+	return &run.Result{ExitCode: 1}
+}
+
+func (r *restoreconMockRunner) WithCombinedOutput(ctx context.Context, name string, args ...string) *run.Result {
+	return &run.Result{ExitCode: 1}
+}
+
+func TestRestoreSELinuxContext(t *testing.T) {
+	ctx := context.Background()
+	origFile, origClient := selinuxEnforceFile, run.Client
+	t.Cleanup(func() {
+		selinuxEnforceFile, run.Client = origFile, origClient
+		restoreconLookPath = exec.LookPath
+	})
+	runner := &restoreconMockRunner{}
+	run.Client = runner
+	restoreconLookPath = func(string) (string, error) { return "/sbin/restorecon", nil }
+
+	// SELinux disabled.
+	selinuxEnforceFile = filepath.Join(t.TempDir(), "enforce")
+	if err := restoreSELinuxContext(ctx, false, "/home/user/.ssh"); err != nil {
+		t.Errorf("restoreSELinuxContext() failed unexpectedly with error: %v", err)
+	}
+	if len(runner.commands) != 0 {
+		t.Errorf("restoreSELinuxContext() ran %v with SELinux disabled, want no command", runner.commands)
+	}
+
+	if err := os.WriteFile(selinuxEnforceFile, []byte("1"), 0644); err != nil {
+		t.Fatalf("os.WriteFile(%s) failed unexpectedly with error: %v", selinuxEnforceFile, err)
+	}
+	if err := restoreSELinuxContext(ctx, false, "/home/user/.ssh"); err != nil {
+		t.Errorf("restoreSELinuxContext() failed unexpectedly with error: %v", err)
+	}
+	if err := restoreSELinuxContext(ctx, true, "/home/user"); err != nil {
+		t.Errorf("restoreSELinuxContext() failed unexpectedly with error: %v", err)
+	}
+
+	// Missing restorecon is not an error.
+	restoreconLookPath = func(string) (string, error) { return "", exec.ErrNotFound }
+	if err := restoreSELinuxContext(ctx, false, "/home/user/.ssh"); err != nil {
+		t.Errorf("restoreSELinuxContext() without restorecon failed unexpectedly with error: %v", err)
+	}
+
+	want := []string{
+		"/sbin/restorecon /home/user/.ssh",
+		"/sbin/restorecon -R /home/user",
+	}
+	if diff := cmp.Diff(want, runner.commands); diff != "" {
+		t.Errorf("restoreSELinuxContext() ran unexpected commands (-want +got):\n%s", diff)
+	}
+}
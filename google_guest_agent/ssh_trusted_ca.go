@@ -0,0 +1,220 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-agent/utils"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// trustedUserCAKeysFile is the sshd TrustedUserCAKeys file holding the
+	// certificate authorities published in metadata.
+	trustedUserCAKeysFile = "/etc/ssh/google_trusted_user_ca_keys"
+
+	// authorizedPrincipalsDir holds the principals file of each user with
+	// principals published in metadata.
+	authorizedPrincipalsDir = "/etc/ssh/google_authorized_principals"
+
+	// authorizedPrincipalsCommandFile is the sshd AuthorizedPrincipalsCommand
+	// printing the principals of a user.
+	authorizedPrincipalsCommandFile = "/etc/ssh/google_authorized_principals_command"
+)
+
+// authorizedPrincipalsCommand returns the script printing the principals file
+// of the user passed as argument or, without one, the user name so the users
+// without published principals keep logging in with certificates listing
+// their name.
+func authorizedPrincipalsCommand() string {
+	return strings.Join([]string{
+		"#!/bin/sh",
+		"# Written by the Google guest agent, do not edit.",
+		fmt.Sprintf(`if [ -f "%s/$1" ]; then`, authorizedPrincipalsDir),
+		fmt.Sprintf(`	exec cat "%s/$1"`, authorizedPrincipalsDir),
+		"fi",
+		`printf '%s\n' "$1"`,
+	}, "\n") + "\n"
+}
+
+// sshTrustedCA is the certificate based SSH configuration published in
+// metadata.
+type sshTrustedCA struct {
+	// keys are the public keys of the certificate authorities trusted to sign
+	// user certificates.
+	keys []string
+	// principals are the certificate principals accepted for each user, by
+	// user. Without principals a certificate must list the user name.
+	principals map[string][]string
+}
+
+// enabled reports whether certificate based SSH is configured.
+func (c sshTrustedCA) enabled() bool {
+	return len(c.keys) > 0
+}
+
+// getSSHTrustedCA returns the certificate based SSH configuration of md,
+// instance attributes take precedence over the project ones. Invalid
+// entries are logged and skipped.
+func getSSHTrustedCA(md *metadata.Descriptor) sshTrustedCA {
+	keys := md.Project.Attributes.SSHTrustedCAKeys
+	if md.Instance.Attributes.SSHTrustedCAKeys != nil {
+		keys = md.Instance.Attributes.SSHTrustedCAKeys
+	}
+	principals := md.Project.Attributes.SSHAuthorizedPrincipals
+	if md.Instance.Attributes.SSHAuthorizedPrincipals != nil {
+		principals = md.Instance.Attributes.SSHAuthorizedPrincipals
+	}
+
+	var res sshTrustedCA
+	for _, key := range keys {
+		key = strings.TrimSpace(key)
+		if key == "" || strings.HasPrefix(key, "#") {
+			continue
+		}
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key)); err != nil {
+			logger.Errorf("Ignoring invalid SSH certificate authority key %q: %v", key, err)
+			continue
+		}
+		if !slices.Contains(res.keys, key) {
+			res.keys = append(res.keys, key)
+		}
+	}
+
+	for _, entry := range principals {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		user, list, err := parsePrincipals(entry)
+		if err != nil {
+			logger.Errorf("Ignoring invalid SSH authorized principals entry %q: %v", entry, err)
+			continue
+		}
+		if res.principals == nil {
+			res.principals = make(map[string][]string)
+		}
+		for _, principal := range list {
+			if !slices.Contains(res.principals[user], principal) {
+				res.principals[user] = append(res.principals[user], principal)
+			}
+		}
+	}
+	return res
+}
+
+// parsePrincipals parses a user:principal[,principal...] entry.
+func parsePrincipals(entry string) (string, []string, error) {
+	user, list, found := strings.Cut(entry, ":")
+	if !found {
+		return "", nil, fmt.Errorf("unrecognized format, expecting user:principal[,principal...]")
+	}
+	user = strings.TrimSpace(user)
+	if err := utils.ValidateUser(user); err != nil {
+		return "", nil, err
+	}
+	// The user name is the name of its principals file.
+	if user == "." || user == ".." || strings.ContainsRune(user, os.PathSeparator) {
+		return "", nil, fmt.Errorf("invalid username %q", user)
+	}
+
+	var res []string
+	for _, principal := range strings.Split(list, ",") {
+		principal = strings.TrimSpace(principal)
+		if principal == "" || strings.ContainsAny(principal, " \t") {
+			return "", nil, fmt.Errorf("invalid principal %q", principal)
+		}
+		res = append(res, principal)
+	}
+	return user, res, nil
+}
+
+// updateSSHTrustedCAConfig adds the directives trusting the certificate
+// authorities of ca to sshConfig, which has no Google control blocks. sshd
+// uses the first value of a directive, so they go ahead of the user's config.
+func updateSSHTrustedCAConfig(sshConfig string, ca sshTrustedCA) string {
+	if !ca.enabled() {
+		return sshConfig
+	}
+
+	block := []string{googleBlockStart, "TrustedUserCAKeys " + trustedUserCAKeysFile}
+	if len(ca.principals) > 0 {
+		block = append(block, "AuthorizedPrincipalsCommand "+authorizedPrincipalsCommandFile+" %u", "AuthorizedPrincipalsCommandUser root")
+	}
+	block = append(block, googleBlockEnd)
+	return strings.Join(block, "\n") + "\n" + sshConfig
+}
+
+// writeSSHTrustedCAFiles writes the trusted certificate authorities and the
+// principals files of ca, removing the ones no longer published.
+func writeSSHTrustedCAFiles(ca sshTrustedCA) error {
+	if !ca.enabled() {
+		if err := os.Remove(trustedUserCAKeysFile); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %q: %w", trustedUserCAKeysFile, err)
+		}
+		if err := os.RemoveAll(authorizedPrincipalsDir); err != nil {
+			return fmt.Errorf("failed to remove %q: %w", authorizedPrincipalsDir, err)
+		}
+		if err := os.Remove(authorizedPrincipalsCommandFile); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %q: %w", authorizedPrincipalsCommandFile, err)
+		}
+		return nil
+	}
+
+	if err := utils.WriteFile([]byte(strings.Join(ca.keys, "\n")+"\n"), trustedUserCAKeysFile, 0644); err != nil {
+		return fmt.Errorf("failed to write %q: %w", trustedUserCAKeysFile, err)
+	}
+
+	if err := os.MkdirAll(authorizedPrincipalsDir, 0755); err != nil {
+		return fmt.Errorf("failed to create %q: %w", authorizedPrincipalsDir, err)
+	}
+	entries, err := os.ReadDir(authorizedPrincipalsDir)
+	if err != nil {
+		return fmt.Errorf("failed to read %q: %w", authorizedPrincipalsDir, err)
+	}
+	for _, entry := range entries {
+		if _, ok := ca.principals[entry.Name()]; ok {
+			continue
+		}
+		if err := os.Remove(filepath.Join(authorizedPrincipalsDir, entry.Name())); err != nil {
+			return fmt.Errorf("failed to remove the principals of %s: %w", entry.Name(), err)
+		}
+	}
+	for user, principals := range ca.principals {
+		path := filepath.Join(authorizedPrincipalsDir, user)
+		if err := os.WriteFile(path, []byte(strings.Join(principals, "\n")+"\n"), 0644); err != nil {
+			return fmt.Errorf("failed to write the principals of %s: %w", user, err)
+		}
+	}
+
+	if len(ca.principals) == 0 {
+		if err := os.Remove(authorizedPrincipalsCommandFile); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %q: %w", authorizedPrincipalsCommandFile, err)
+		}
+		return nil
+	}
+	// sshd only runs a command owned by root and not writable by others.
+	if err := utils.WriteFile([]byte(authorizedPrincipalsCommand()), authorizedPrincipalsCommandFile, 0755); err != nil {
+		return fmt.Errorf("failed to write %q: %w", authorizedPrincipalsCommandFile, err)
+	}
+	return nil
+}
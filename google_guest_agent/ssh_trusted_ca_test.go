@@ -0,0 +1,142 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/google/go-cmp/cmp"
+)
+
+const testCAKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIJ3tXdpdr3xIFhy5E4QG8ws8YjLVUqZqmMGqT7n9bVBz ca@example.com"
+
+func TestGetSSHTrustedCA(t *testing.T) {
+	md := &metadata.Descriptor{}
+	md.Project.Attributes.SSHTrustedCAKeys = []string{"ssh-rsa project-ca"}
+	md.Project.Attributes.SSHAuthorizedPrincipals = []string{"bob:ops"}
+	md.Instance.Attributes.SSHTrustedCAKeys = []string{"# comment", testCAKey, "not a key", "", testCAKey}
+	md.Instance.Attributes.SSHAuthorizedPrincipals = []string{
+		"alice:admins, alice@example.com",
+		"alice:admins",
+		"../etc:root",
+		"carol",
+		"dave:two words",
+	}
+
+	want := sshTrustedCA{
+		keys:       []string{testCAKey},
+		principals: map[string][]string{"alice": {"admins", "alice@example.com"}},
+	}
+	if diff := cmp.Diff(want, getSSHTrustedCA(md), cmp.AllowUnexported(sshTrustedCA{})); diff != "" {
+		t.Errorf("getSSHTrustedCA() returned unexpected diff (-want +got):\n%s", diff)
+	}
+
+	if got := getSSHTrustedCA(&metadata.Descriptor{}); got.enabled() {
+		t.Errorf("getSSHTrustedCA() = %+v without metadata, want disabled", got)
+	}
+}
+
+func TestUpdateSSHTrustedCAConfig(t *testing.T) {
+	sshConfig := "PermitRootLogin no\n"
+	if got := updateSSHTrustedCAConfig(sshConfig, sshTrustedCA{}); got != sshConfig {
+		t.Errorf("updateSSHTrustedCAConfig() = %q without certificate authorities, want %q", got, sshConfig)
+	}
+
+	want := strings.Join([]string{
+		googleBlockStart,
+		"TrustedUserCAKeys " + trustedUserCAKeysFile,
+		"AuthorizedPrincipalsCommand " + authorizedPrincipalsCommandFile + " %u",
+		"AuthorizedPrincipalsCommandUser root",
+		googleBlockEnd,
+		"PermitRootLogin no",
+	}, "\n") + "\n"
+	ca := sshTrustedCA{keys: []string{testCAKey}, principals: map[string][]string{"alice": {"admins"}}}
+	if got := updateSSHTrustedCAConfig(sshConfig, ca); got != want {
+		t.Errorf("updateSSHTrustedCAConfig() = %q, want %q", got, want)
+	}
+}
+
+func TestWriteSSHTrustedCAFiles(t *testing.T) {
+	root := t.TempDir()
+	origKeysFile, origPrincipalsDir, origCommandFile := trustedUserCAKeysFile, authorizedPrincipalsDir, authorizedPrincipalsCommandFile
+	t.Cleanup(func() {
+		trustedUserCAKeysFile, authorizedPrincipalsDir, authorizedPrincipalsCommandFile = origKeysFile, origPrincipalsDir, origCommandFile
+	})
+	trustedUserCAKeysFile = filepath.Join(root, "trusted_user_ca_keys")
+	authorizedPrincipalsDir = filepath.Join(root, "principals")
+	authorizedPrincipalsCommandFile = filepath.Join(root, "principals_command")
+
+	if err := os.MkdirAll(authorizedPrincipalsDir, 0755); err != nil {
+		t.Fatalf("os.MkdirAll(%q) failed unexpectedly with error: %v", authorizedPrincipalsDir, err)
+	}
+	stale := filepath.Join(authorizedPrincipalsDir, "bob")
+	if err := os.WriteFile(stale, []byte("ops\n"), 0644); err != nil {
+		t.Fatalf("os.WriteFile(%q) failed unexpectedly with error: %v", stale, err)
+	}
+
+	ca := sshTrustedCA{keys: []string{testCAKey}, principals: map[string][]string{"alice": {"admins", "alice@example.com"}}}
+	if err := writeSSHTrustedCAFiles(ca); err != nil {
+		t.Fatalf("writeSSHTrustedCAFiles() failed unexpectedly with error: %v", err)
+	}
+
+	files := map[string]string{
+		trustedUserCAKeysFile:                           testCAKey + "\n",
+		filepath.Join(authorizedPrincipalsDir, "alice"): "admins\nalice@example.com\n",
+	}
+	for path, want := range files {
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("os.ReadFile(%q) failed unexpectedly with error: %v", path, err)
+		}
+		if string(got) != want {
+			t.Errorf("writeSSHTrustedCAFiles() wrote %q to %q, want %q", got, path, want)
+		}
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("writeSSHTrustedCAFiles() kept the principals of bob, want them removed")
+	}
+
+	// The users without principals are accepted with their name.
+	for user, want := range map[string]string{"alice": "admins\nalice@example.com\n", "carol": "carol\n"} {
+		got, err := exec.Command(authorizedPrincipalsCommandFile, user).Output()
+		if err != nil {
+			t.Fatalf("%s %s failed unexpectedly with error: %v", authorizedPrincipalsCommandFile, user, err)
+		}
+		if string(got) != want {
+			t.Errorf("%s %s = %q, want %q", authorizedPrincipalsCommandFile, user, got, want)
+		}
+	}
+
+	if err := writeSSHTrustedCAFiles(sshTrustedCA{keys: []string{testCAKey}}); err != nil {
+		t.Fatalf("writeSSHTrustedCAFiles() failed unexpectedly with error: %v", err)
+	}
+	if _, err := os.Stat(authorizedPrincipalsCommandFile); !os.IsNotExist(err) {
+		t.Errorf("writeSSHTrustedCAFiles() kept %q without principals, want it removed", authorizedPrincipalsCommandFile)
+	}
+
+	if err := writeSSHTrustedCAFiles(sshTrustedCA{}); err != nil {
+		t.Fatalf("writeSSHTrustedCAFiles() failed unexpectedly with error: %v", err)
+	}
+	for _, path := range []string{trustedUserCAKeysFile, authorizedPrincipalsDir, authorizedPrincipalsCommandFile} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("writeSSHTrustedCAFiles() kept %q without certificate authorities, want it removed", path)
+		}
+	}
+}
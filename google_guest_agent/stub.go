@@ -51,3 +51,31 @@ func getWindowsExeVersion(ctx context.Context, path string) (versionInfo, error)
 func checkWindowsServiceRunning(ctx context.Context, servicename string) bool {
 	return false
 }
+
+func adminAuthorizedKeysFile() string {
+	return ""
+}
+
+func userSSHDir(user string) (string, error) {
+	return "", errors.New("user profiles are not supported")
+}
+
+func writeAuthorizedKeysFile(path, user string, content []byte) error {
+	return nil
+}
+
+func detectDegradedMode() string {
+	return ""
+}
+
+func isAccessDenied(err error) bool {
+	return false
+}
+
+func setDirectoryAccess(dir, sddl string) error {
+	return nil
+}
+
+func configureServiceRecovery(name string) error {
+	return nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// defaultSudoersTemplate is the sudoers rule granting the google-sudoers
+	// group full permissions.
+	defaultSudoersTemplate = "%{group} ALL=(ALL:ALL) NOPASSWD:ALL"
+)
+
+var (
+	// sudoersFile is the sudoers drop-in file managed by the agent.
+	sudoersFile = "/etc/sudoers.d/google_sudoers"
+	// sudoersHashFile records the SHA256 of the sudoers content the agent
+	// last wrote, a file with another content was edited by an admin.
+	sudoersHashFile = "/var/lib/google-guest-agent/google_sudoers.sha256"
+	// visudoLookPath looks up the visudo binary, overridden in tests.
+	visudoLookPath = exec.LookPath
+)
+
+// renderSudoers returns the sudoers content of the configured template. The
+// {group} placeholder is replaced with the google-sudoers group and the \n
+// escape sequence separates multiple rules.
+func renderSudoers(template string) string {
+	if strings.TrimSpace(template) == "" {
+		template = defaultSudoersTemplate
+	}
+	content := strings.ReplaceAll(template, "{group}", "google-sudoers")
+	content = strings.ReplaceAll(content, `\n`, "\n")
+	return strings.TrimRight(content, "\n") + "\n"
+}
+
+// sudoersHash returns the hex encoded SHA256 of the sudoers content.
+func sudoersHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// ownedSudoersFile returns whether the existing sudoers content is still the
+// one the agent wrote: its hash was recorded, or it's the default content
+// written by the agents not recording it.
+func ownedSudoersFile(existing []byte) bool {
+	if string(existing) == renderSudoers(defaultSudoersTemplate) {
+		return true
+	}
+	recorded, err := os.ReadFile(sudoersHashFile)
+	return err == nil && strings.TrimSpace(string(recorded)) == sudoersHash(existing)
+}
+
+// createSudoersFile writes the google_sudoers configuration file from the
+// sudoers_template configuration if it's missing or still the one the agent
+// wrote, a file edited by an admin is left alone. The content is validated
+// with visudo before being installed so an invalid template never breaks
+// sudo.
+func createSudoersFile(ctx context.Context, config *cfg.Sections) error {
+	template := config.Accounts.SudoersTemplate
+	content := renderSudoers(template)
+
+	existing, err := os.ReadFile(sudoersFile)
+	if err == nil && string(existing) == content {
+		return nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil && !ownedSudoersFile(existing) {
+		logger.Debugf("Not updating %s, it was changed since the agent wrote it.", sudoersFile)
+		return nil
+	}
+
+	// Files containing a '.' are skipped by sudo's includedir, the temporary
+	// file is therefore never read by sudo.
+	tmp := filepath.Join(filepath.Dir(sudoersFile), "."+filepath.Base(sudoersFile)+".tmp")
+	if err := os.WriteFile(tmp, []byte(content), 0440); err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	if err := validateSudoers(ctx, tmp, content); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, sudoersFile); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(sudoersHashFile), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(sudoersHashFile, []byte(sudoersHash([]byte(content))+"\n"), 0600); err != nil {
+		return fmt.Errorf("failed to record the sudoers file hash: %w", err)
+	}
+	auditAccount(auditSudoersUpdate, "", auditSourceConfig)
+	return nil
+}
+
+// validateSudoers checks the sudoers file at path with visudo. Without visudo
+// only the default content, known to be valid, is accepted.
+func validateSudoers(ctx context.Context, path, content string) error {
+	visudo, err := visudoLookPath("visudo")
+	if err != nil {
+		if content == renderSudoers(defaultSudoersTemplate) {
+			return nil
+		}
+		return fmt.Errorf("unable to validate sudoers template, visudo not found: %w", err)
+	}
+	res := run.WithCombinedOutput(ctx, visudo, "-c", "-f", path)
+	if res.ExitCode != 0 {
+		return fmt.Errorf("invalid sudoers template: %s", strings.TrimSpace(res.Combined))
+	}
+	return nil
+}
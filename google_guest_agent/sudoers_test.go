@@ -0,0 +1,176 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+)
+
+// visudoMockRunner rejects the sudoers files containing a "Defaults!" rule.
+type visudoMockRunner struct {
+	calls int
+}
+
+func (r *visudoMockRunner) Quiet(ctx context.Context, name string, args ...string) error {
+	return nil
+}
+
+func (r *visudoMockRunner) WithOutput(ctx context.Context, name string, args ...string) *run.Result {
+	return r.WithCombinedOutput(ctx, name, args...)
+}
+
+func (r *visudoMockRunner) WithOutputTimeout(ctx context.Context, timeout time.Duration, name string, args ...string) *run.Result {
+	return r.WithCombinedOutput(ctx, name, args...)
+}
+
+func (r *visudoMockRunner) WithCombinedOutput(ctx context.Context, name string, args ...string) *run.Result {
+	r.calls++
+	content, err := os.ReadFile(args[len(args)-1])
+	if err != nil {
+		return &run.Result{ExitCode: 1, Combined: err.Error()}
+	}
+	if strings.Contains(string(content), "Defaults!") {
+		return &run.Result{ExitCode: 1, Combined: "syntax error near line 2"}
+	}
+	return &run.Result{}
+}
+
+func TestRenderSudoers(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"", "%google-sudoers ALL=(ALL:ALL) NOPASSWD:ALL\n"},
+		{defaultSudoersTemplate, "%google-sudoers ALL=(ALL:ALL) NOPASSWD:ALL\n"},
+		{`%{group} ALL=(ALL:ALL) ALL`, "%google-sudoers ALL=(ALL:ALL) ALL\n"},
+		{
+			`Cmnd_Alias GOOGLE_CMDS = /usr/bin/systemctl\n%{group} ALL=(root) NOPASSWD:GOOGLE_CMDS\n`,
+			"Cmnd_Alias GOOGLE_CMDS = /usr/bin/systemctl\n%google-sudoers ALL=(root) NOPASSWD:GOOGLE_CMDS\n",
+		},
+	}
+
+	for _, tc := range tests {
+		if got := renderSudoers(tc.template); got != tc.want {
+			t.Errorf("renderSudoers(%q) = %q, want %q", tc.template, got, tc.want)
+		}
+	}
+}
+
+func TestCreateSudoersFile(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+	ctx := context.Background()
+
+	origFile, origHashFile, origClient := sudoersFile, sudoersHashFile, run.Client
+	t.Cleanup(func() {
+		sudoersFile, sudoersHashFile, run.Client = origFile, origHashFile, origClient
+		visudoLookPath = exec.LookPath
+		writeAccountAuditRecord = defaultWriteAccountAuditRecord
+	})
+	var audited []string
+	writeAccountAuditRecord = func(record *accountAuditRecord) {
+		audited = append(audited, record.Action)
+	}
+	sudoersFile = filepath.Join(t.TempDir(), "google_sudoers")
+	sudoersHashFile = filepath.Join(t.TempDir(), "google_sudoers.sha256")
+	runner := &visudoMockRunner{}
+	run.Client = runner
+	visudoLookPath = func(string) (string, error) { return "/usr/sbin/visudo", nil }
+
+	assertContent := func(want string) {
+		t.Helper()
+		got, err := os.ReadFile(sudoersFile)
+		if err != nil {
+			t.Fatalf("os.ReadFile(%s) failed unexpectedly with error: %v", sudoersFile, err)
+		}
+		if string(got) != want {
+			t.Errorf("sudoers file content = %q, want %q", got, want)
+		}
+	}
+
+	if err := createSudoersFile(ctx, config); err != nil {
+		t.Fatalf("createSudoersFile() failed unexpectedly with error: %v", err)
+	}
+	assertContent("%google-sudoers ALL=(ALL:ALL) NOPASSWD:ALL\n")
+
+	// Unchanged content is neither validated nor rewritten.
+	calls := runner.calls
+	if err := createSudoersFile(ctx, config); err != nil {
+		t.Fatalf("createSudoersFile() failed unexpectedly with error: %v", err)
+	}
+	if runner.calls != calls {
+		t.Errorf("createSudoersFile() ran visudo for unchanged content")
+	}
+
+	config.Accounts.SudoersTemplate = `%{group} ALL=(ALL:ALL) ALL`
+	if err := createSudoersFile(ctx, config); err != nil {
+		t.Fatalf("createSudoersFile() failed unexpectedly with error: %v", err)
+	}
+	assertContent("%google-sudoers ALL=(ALL:ALL) ALL\n")
+
+	// An invalid template leaves the installed file untouched.
+	config.Accounts.SudoersTemplate = `%{group} ALL=(ALL:ALL) ALL\nDefaults!`
+	if err := createSudoersFile(ctx, config); err == nil {
+		t.Errorf("createSudoersFile() succeeded with an invalid template, want error")
+	}
+	assertContent("%google-sudoers ALL=(ALL:ALL) ALL\n")
+
+	// Without visudo only the default template is installed.
+	visudoLookPath = func(string) (string, error) { return "", exec.ErrNotFound }
+	config.Accounts.SudoersTemplate = `%{group} ALL=(ALL:ALL) NOPASSWD:ALL\n`
+	if err := createSudoersFile(ctx, config); err != nil {
+		t.Fatalf("createSudoersFile() failed unexpectedly with error: %v", err)
+	}
+	assertContent("%google-sudoers ALL=(ALL:ALL) NOPASSWD:ALL\n")
+
+	config.Accounts.SudoersTemplate = `%{group} ALL=(ALL:ALL) ALL`
+	if err := createSudoersFile(ctx, config); err == nil {
+		t.Errorf("createSudoersFile() succeeded without visudo, want error")
+	}
+
+	// A file edited by an admin is left alone.
+	edited := "%google-sudoers ALL=(ALL:ALL) NOPASSWD:/usr/bin/systemctl\n"
+	if err := os.WriteFile(sudoersFile, []byte(edited), 0440); err != nil {
+		t.Fatalf("os.WriteFile(%s) failed unexpectedly with error: %v", sudoersFile, err)
+	}
+	visudoLookPath = func(string) (string, error) { return "/usr/sbin/visudo", nil }
+	if err := createSudoersFile(ctx, config); err != nil {
+		t.Fatalf("createSudoersFile() failed unexpectedly with error: %v", err)
+	}
+	assertContent(edited)
+
+	if len(audited) != 3 {
+		t.Errorf("createSudoersFile() recorded %d sudoers updates, want 3", len(audited))
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(sudoersFile))
+	if err != nil {
+		t.Fatalf("os.ReadDir() failed unexpectedly with error: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("sudoers directory has %d entries, want only the sudoers file", len(entries))
+	}
+}
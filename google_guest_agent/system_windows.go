@@ -16,12 +16,15 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
 
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
 	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+	"golang.org/x/sys/windows"
 	"golang.org/x/sys/windows/registry"
+	"golang.org/x/sys/windows/svc/mgr"
 )
 
 var errRegNotExist = registry.ErrNotExist
@@ -129,3 +132,64 @@ func getWindowsExeVersion(ctx context.Context, path string) (versionInfo, error)
 	}
 	return parseVersionInfo([]byte(res.StdOut))
 }
+
+// detectDegradedMode returns why the agent can't manage the system's network,
+// running in a Windows container or without administrator privileges, empty
+// if it can.
+func detectDegradedMode() string {
+	// ContainerType is set in process and Hyper-V isolated containers.
+	if _, err := readRegInteger(`SYSTEM\CurrentControlSet\Control`, "ContainerType"); err == nil {
+		return "running in a Windows container"
+	}
+	if !windows.GetCurrentProcessToken().IsElevated() {
+		return "running without administrator privileges"
+	}
+	return ""
+}
+
+// isAccessDenied returns whether err is an access denied Windows error.
+func isAccessDenied(err error) bool {
+	return errors.Is(err, windows.ERROR_ACCESS_DENIED)
+}
+
+// setDirectoryAccess replaces the owner and access of dir with the owner and
+// protected DACL of sddl, the permissions of its parent are not inherited
+// anymore. The inheritable entries apply to the files of dir.
+func setDirectoryAccess(dir, sddl string) error {
+	sd, err := windows.SecurityDescriptorFromString(sddl)
+	if err != nil {
+		return fmt.Errorf("error parsing security descriptor %q: %v", sddl, err)
+	}
+	owner, _, err := sd.Owner()
+	if err != nil {
+		return fmt.Errorf("error getting the owner of %q: %v", sddl, err)
+	}
+	dacl, _, err := sd.DACL()
+	if err != nil {
+		return fmt.Errorf("error getting the DACL of %q: %v", sddl, err)
+	}
+	secInfo := windows.SECURITY_INFORMATION(windows.OWNER_SECURITY_INFORMATION | windows.DACL_SECURITY_INFORMATION | windows.PROTECTED_DACL_SECURITY_INFORMATION)
+	if err := windows.SetNamedSecurityInfo(dir, windows.SE_FILE_OBJECT, secInfo, owner, nil, dacl, nil); err != nil {
+		return fmt.Errorf("error setting the access of %q: %v", dir, err)
+	}
+	return nil
+}
+
+// configureServiceRecovery makes the service's recovery actions also apply
+// when it stops with an error, not only when it crashes. The actions
+// themselves are set by the installer, see packaging/googet/agent_install.ps1.
+func configureServiceRecovery(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(name)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	return s.SetRecoveryActionsOnNonCrashFailures(true)
+}
@@ -0,0 +1,190 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+var (
+	// limitsDir is the pam_limits drop-in directory.
+	limitsDir = "/etc/security/limits.d"
+	// systemdSystemDir is the directory of the systemd unit drop-ins.
+	systemdSystemDir = "/etc/systemd/system"
+)
+
+// userLimitsFile returns the pam_limits drop-in of user.
+func userLimitsFile(user string) string {
+	return filepath.Join(limitsDir, fmt.Sprintf("google-%s.conf", user))
+}
+
+// userSliceFile returns the drop-in of the systemd user slice of uid.
+func userSliceFile(uid int) string {
+	return filepath.Join(systemdSystemDir, fmt.Sprintf("user-%d.slice.d", uid), "50-google-guest-agent.conf")
+}
+
+// validLimit returns true if value is a valid pam_limits value.
+func validLimit(value string) bool {
+	if value == "unlimited" || value == "infinity" {
+		return true
+	}
+	_, err := strconv.ParseUint(value, 10, 64)
+	return err == nil
+}
+
+// userLimits returns the pam_limits drop-in content setting the configured
+// soft and hard limits of user, empty if none is configured.
+func userLimits(config *cfg.Sections, user string) string {
+	var lines []string
+	for _, l := range []struct{ item, value string }{
+		{"nofile", config.Accounts.LimitNoFile},
+		{"nproc", config.Accounts.LimitNProc},
+	} {
+		value := strings.TrimSpace(l.value)
+		if value == "" {
+			continue
+		}
+		if !validLimit(value) {
+			logger.Errorf("Ignoring invalid limit_%s configuration %q", l.item, value)
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s - %s %s", user, l.item, value))
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(append([]string{googleComment}, lines...), "\n") + "\n"
+}
+
+// userSlice returns the systemd user slice drop-in content setting the
+// configured slice properties, empty if none is configured.
+func userSlice(config *cfg.Sections) string {
+	var props []string
+	for _, prop := range strings.Split(config.Accounts.UserSliceProperties, ",") {
+		prop = strings.TrimSpace(prop)
+		if prop == "" {
+			continue
+		}
+		if key, _, found := strings.Cut(prop, "="); !found || strings.TrimSpace(key) == "" {
+			logger.Errorf("Ignoring invalid user slice property %q", prop)
+			continue
+		}
+		props = append(props, prop)
+	}
+	if len(props) == 0 {
+		return ""
+	}
+	return strings.Join(append([]string{googleComment, "[Slice]"}, props...), "\n") + "\n"
+}
+
+// writeManagedFile writes contents to path, or removes path if contents is
+// empty. It returns true if the file changed.
+func writeManagedFile(path, contents string) (bool, error) {
+	current, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	exists := err == nil
+
+	if contents == "" {
+		if !exists {
+			return false, nil
+		}
+		return true, os.Remove(path)
+	}
+	if exists && string(current) == contents {
+		return false, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return false, err
+	}
+	return true, replaceConfigFile(path, contents)
+}
+
+// writeUserLimits writes the configured resource limits and user slice
+// properties of user, removing the ones no longer configured. It returns true
+// if the user slice changed.
+func writeUserLimits(config *cfg.Sections, user string, uid int) (bool, error) {
+	if _, err := writeManagedFile(userLimitsFile(user), userLimits(config, user)); err != nil {
+		return false, fmt.Errorf("failed to write limits of user %s: %w", user, err)
+	}
+	slice := userSlice(config)
+	changed, err := writeManagedFile(userSliceFile(uid), slice)
+	if err != nil {
+		return false, fmt.Errorf("failed to write user slice of user %s: %w", user, err)
+	}
+	if changed && slice == "" {
+		removeUserSliceDir(uid)
+	}
+	return changed, nil
+}
+
+// applyUserLimits writes the resource limits of users, their UIDs by name, so
+// configuration changes reach the existing users. systemd is reloaded once if
+// a user slice changed.
+func applyUserLimits(ctx context.Context, config *cfg.Sections, users map[string]int) error {
+	var errs []error
+	var reload bool
+	for user, uid := range users {
+		changed, err := writeUserLimits(config, user, uid)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		reload = reload || changed
+	}
+	if reload {
+		if err := run.Quiet(ctx, "systemctl", "daemon-reload"); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// removeUserSliceDir removes the drop-in directory of the user slice of uid
+// if it's empty.
+func removeUserSliceDir(uid int) {
+	dir := filepath.Dir(userSliceFile(uid))
+	if err := os.Remove(dir); err != nil && !os.IsNotExist(err) {
+		logger.Debugf("Not removing %s: %v", dir, err)
+	}
+}
+
+// removeUserLimits removes the resource limits and user slice properties of
+// a deleted user.
+func removeUserLimits(ctx context.Context, user string, uid int) error {
+	if _, err := writeManagedFile(userLimitsFile(user), ""); err != nil {
+		return err
+	}
+	changed, err := writeManagedFile(userSliceFile(uid), "")
+	if err != nil {
+		return err
+	}
+	if changed {
+		removeUserSliceDir(uid)
+		return run.Quiet(ctx, "systemctl", "daemon-reload")
+	}
+	return nil
+}
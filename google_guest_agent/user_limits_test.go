@@ -0,0 +1,122 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+)
+
+func TestUserLimits(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+	t.Cleanup(func() {
+		config.Accounts.LimitNoFile, config.Accounts.LimitNProc, config.Accounts.UserSliceProperties = "", "", ""
+	})
+
+	if got := userLimits(config, "user"); got != "" {
+		t.Errorf("userLimits(user) = %q by default, want none", got)
+	}
+	if got := userSlice(config); got != "" {
+		t.Errorf("userSlice() = %q by default, want none", got)
+	}
+
+	config.Accounts.LimitNoFile = "65536"
+	config.Accounts.LimitNProc = "lots"
+	config.Accounts.UserSliceProperties = "MemoryMax=4G, TasksMax=512,invalid"
+
+	wantLimits := googleComment + "\nuser - nofile 65536\n"
+	if got := userLimits(config, "user"); got != wantLimits {
+		t.Errorf("userLimits(user) = %q, want %q", got, wantLimits)
+	}
+	wantSlice := googleComment + "\n[Slice]\nMemoryMax=4G\nTasksMax=512\n"
+	if got := userSlice(config); got != wantSlice {
+		t.Errorf("userSlice() = %q, want %q", got, wantSlice)
+	}
+}
+
+func TestApplyAndRemoveUserLimits(t *testing.T) {
+	ctx := context.Background()
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	config := cfg.Get()
+	config.Accounts.LimitNProc = "4096"
+	config.Accounts.UserSliceProperties = "TasksMax=512"
+
+	origLimitsDir, origSystemdDir, origClient := limitsDir, systemdSystemDir, run.Client
+	t.Cleanup(func() {
+		limitsDir, systemdSystemDir, run.Client = origLimitsDir, origSystemdDir, origClient
+		config.Accounts.LimitNProc, config.Accounts.UserSliceProperties = "", ""
+	})
+	limitsDir = filepath.Join(t.TempDir(), "limits.d")
+	systemdSystemDir = t.TempDir()
+	runner := &restoreconMockRunner{}
+	run.Client = runner
+
+	for i := 0; i < 2; i++ {
+		if err := applyUserLimits(ctx, config, map[string]int{"user": 1001}); err != nil {
+			t.Fatalf("applyUserLimits(user) failed unexpectedly with error: %v", err)
+		}
+	}
+	for _, path := range []string{userLimitsFile("user"), userSliceFile(1001)} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("applyUserLimits(user) didn't write %s: %v", path, err)
+		}
+	}
+
+	if len(runner.commands) != 1 || runner.commands[0] != "systemctl daemon-reload" {
+		t.Errorf("applyUserLimits(user) ran %v, want a single systemctl daemon-reload", runner.commands)
+	}
+
+	// Configuration changes reach the existing users.
+	config.Accounts.LimitNProc, config.Accounts.UserSliceProperties = "8192", ""
+	if err := applyUserLimits(ctx, config, map[string]int{"user": 1001}); err != nil {
+		t.Fatalf("applyUserLimits(user) failed unexpectedly with error: %v", err)
+	}
+	if got, err := os.ReadFile(userLimitsFile("user")); err != nil || string(got) != googleComment+"\nuser - nproc 8192\n" {
+		t.Errorf("applyUserLimits(user) wrote %q (%v), want the updated limit", got, err)
+	}
+	if _, err := os.Stat(filepath.Dir(userSliceFile(1001))); !os.IsNotExist(err) {
+		t.Errorf("applyUserLimits(user) kept the unconfigured user slice %s", filepath.Dir(userSliceFile(1001)))
+	}
+	if len(runner.commands) != 2 {
+		t.Errorf("applyUserLimits(user) ran %v, want a second systemctl daemon-reload", runner.commands)
+	}
+
+	config.Accounts.UserSliceProperties = "TasksMax=512"
+	if err := applyUserLimits(ctx, config, map[string]int{"user": 1001}); err != nil {
+		t.Fatalf("applyUserLimits(user) failed unexpectedly with error: %v", err)
+	}
+
+	if err := removeUserLimits(ctx, "user", 1001); err != nil {
+		t.Fatalf("removeUserLimits(user) failed unexpectedly with error: %v", err)
+	}
+	for _, path := range []string{userLimitsFile("user"), filepath.Dir(userSliceFile(1001))} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("removeUserLimits(user) kept %s", path)
+		}
+	}
+	if len(runner.commands) != 4 {
+		t.Errorf("removeUserLimits(user) ran %v, want a fourth systemctl daemon-reload", runner.commands)
+	}
+}
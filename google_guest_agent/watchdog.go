@@ -0,0 +1,189 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/eventlog"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// watchdogJobID is the watchdog job's ID.
+	watchdogJobID = "watchdog"
+	// defaultWatchdogCheckInterval is used if check_interval is not a valid
+	// duration.
+	defaultWatchdogCheckInterval = time.Minute
+	// defaultStallTimeout is used if stall_timeout is not a valid duration.
+	defaultStallTimeout = 30 * time.Minute
+	// watchdogCancelGrace is the time a restarted subsystem's run has to
+	// return before the agent is restarted.
+	watchdogCancelGrace = 2 * time.Minute
+)
+
+// agentWatchdog watches the managers' runs.
+var agentWatchdog = newWatchdog()
+
+// watchedRun is a subsystem's ongoing run.
+type watchedRun struct {
+	started time.Time
+	cancel  context.CancelFunc
+	// canceled is when the watchdog canceled the run, zero if it didn't.
+	canceled time.Time
+}
+
+// watchdog restarts the subsystems whose runs don't complete within the stall
+// timeout by canceling their context, i.e. a manager wedged on a command
+// holding the metadata update. The subsystem runs again on the next update.
+// If the run doesn't return either, the agent exits to be restarted by its
+// service manager.
+type watchdog struct {
+	mu   sync.Mutex
+	runs map[string]*watchedRun
+	// exit exits the agent, overridden in tests.
+	exit func(code int)
+}
+
+// newWatchdog returns a watchdog without runs.
+func newWatchdog() *watchdog {
+	return &watchdog{runs: make(map[string]*watchedRun), exit: os.Exit}
+}
+
+// watch records the start of the subsystem's run, it returns the run's context
+// and the function to call when the run returns. The run's context is only
+// canceled by a stall or when ctx is, returning from the run doesn't cancel
+// it. Work the run starts in the background must use backgroundContext.
+func (w *watchdog) watch(ctx context.Context, name string) (context.Context, func()) {
+	runCtx := context.WithValue(context.WithoutCancel(ctx), backgroundCtxKey{}, backgroundContext(ctx))
+	runCtx, cancel := context.WithCancel(runCtx)
+	stop := context.AfterFunc(ctx, cancel)
+	run := &watchedRun{started: time.Now(), cancel: cancel}
+
+	w.mu.Lock()
+	w.runs[name] = run
+	w.mu.Unlock()
+
+	return runCtx, func() {
+		stop()
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		// A later run of the same subsystem may have replaced it.
+		if w.runs[name] == run {
+			delete(w.runs, name)
+		}
+	}
+}
+
+// backgroundCtxKey is the context key of the context a watched run was
+// started with.
+type backgroundCtxKey struct{}
+
+// backgroundContext returns the context of the work started in the background
+// by a run watched with ctx, i.e. timers and goroutines outliving the run:
+// the context the run was started with, not canceled when the run is
+// restarted. It returns ctx if it's not a watched run's context.
+func backgroundContext(ctx context.Context) context.Context {
+	if parent, ok := ctx.Value(backgroundCtxKey{}).(context.Context); ok {
+		return parent
+	}
+	return ctx
+}
+
+// check restarts the runs started stallTimeout before now, and exits if a
+// restarted run didn't return within watchdogCancelGrace.
+func (w *watchdog) check(now time.Time, stallTimeout time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for name, run := range w.runs {
+		switch {
+		case run.canceled.IsZero() && now.Sub(run.started) > stallTimeout:
+			eventlog.Warningf(eventlog.SubsystemRestarted, "%s didn't complete within %s, restarting it.", name, stallTimeout)
+			run.cancel()
+			run.canceled = now
+		case !run.canceled.IsZero() && now.Sub(run.canceled) > watchdogCancelGrace:
+			eventlog.Errorf(eventlog.AgentRestarting, "%s didn't stop within %s of its restart, restarting the agent.", name, watchdogCancelGrace)
+			eventlog.Close()
+			logger.Close()
+			w.exit(1)
+			return
+		}
+	}
+}
+
+// watchdogJob periodically checks the agent watchdog's runs.
+type watchdogJob struct {
+	watchdog *watchdog
+}
+
+// newWatchdogJob returns the job checking the agent watchdog.
+func newWatchdogJob() *watchdogJob {
+	return &watchdogJob{watchdog: agentWatchdog}
+}
+
+// ID returns the watchdog job's ID.
+func (j *watchdogJob) ID() string {
+	return watchdogJobID
+}
+
+// Interval returns the configured check interval.
+func (j *watchdogJob) Interval() (time.Duration, bool) {
+	interval, err := time.ParseDuration(cfg.Get().Watchdog.CheckInterval)
+	if err != nil || interval <= 0 {
+		logger.Errorf("Watchdog check_interval configuration is not a valid duration string, falling back to %s", defaultWatchdogCheckInterval)
+		return defaultWatchdogCheckInterval, false
+	}
+	return interval, false
+}
+
+// ShouldEnable returns true if the watchdog is enabled.
+func (j *watchdogJob) ShouldEnable(ctx context.Context) bool {
+	return cfg.Get().Watchdog.Enable
+}
+
+// Run checks the watchdog's runs against the configured stall timeout.
+func (j *watchdogJob) Run(ctx context.Context) (bool, error) {
+	j.watchdog.check(time.Now(), stallTimeout())
+	return true, nil
+}
+
+// stallTimeout returns the configured stall timeout.
+func stallTimeout() time.Duration {
+	timeout, err := time.ParseDuration(cfg.Get().Watchdog.StallTimeout)
+	if err != nil || timeout <= 0 {
+		logger.Errorf("Watchdog stall_timeout configuration is not a valid duration string, falling back to %s", defaultStallTimeout)
+		return defaultStallTimeout
+	}
+	return timeout
+}
+
+// setupServiceRecovery configures the agent's Windows service to be restarted
+// when it stops with an error, reporting the outcome to the event log.
+func setupServiceRecovery() {
+	if runtime.GOOS != "windows" || !cfg.Get().Watchdog.ServiceRecovery {
+		return
+	}
+	if err := configureServiceRecovery(serviceName); err != nil {
+		eventlog.Errorf(eventlog.ServiceRecoveryFailed, "Failed to configure the %s service recovery actions: %v", serviceName, err)
+		return
+	}
+	eventlog.Infof(eventlog.ServiceRecoveryConfigured, "Configured the %s service to also restart when it stops with an error.", serviceName)
+}
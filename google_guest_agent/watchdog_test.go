@@ -0,0 +1,93 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWatchdog(t *testing.T) {
+	w := newWatchdog()
+	exitCode := -1
+	w.exit = func(code int) { exitCode = code }
+	stall := time.Minute
+
+	ctx, done := w.watch(context.Background(), "addressMgr")
+	start := time.Now()
+
+	w.check(start.Add(stall/2), stall)
+	if ctx.Err() != nil {
+		t.Fatalf("check() canceled the run before the stall timeout")
+	}
+
+	w.check(start.Add(2*stall), stall)
+	if ctx.Err() == nil {
+		t.Fatalf("check() didn't cancel the run after the stall timeout")
+	}
+	if exitCode != -1 {
+		t.Fatalf("check() exited with %d right after restarting the run, want no exit", exitCode)
+	}
+
+	w.check(start.Add(2*stall+2*watchdogCancelGrace), stall)
+	if exitCode != 1 {
+		t.Errorf("check() exit code = %d after the run didn't return, want 1", exitCode)
+	}
+
+	done()
+	if len(w.runs) != 0 {
+		t.Errorf("watchdog runs = %v after the run returned, want none", w.runs)
+	}
+}
+
+func TestWatchdogRunReplaced(t *testing.T) {
+	w := newWatchdog()
+	_, first := w.watch(context.Background(), "wsfcManager")
+	_, second := w.watch(context.Background(), "wsfcManager")
+
+	first()
+	if _, ok := w.runs["wsfcManager"]; !ok {
+		t.Errorf("returning the first run removed the second run")
+	}
+	second()
+	if len(w.runs) != 0 {
+		t.Errorf("watchdog runs = %v after the runs returned, want none", w.runs)
+	}
+}
+
+func TestWatchdogDoneKeepsContext(t *testing.T) {
+	w := newWatchdog()
+	parent, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ctx, done := w.watch(parent, "accountsMgr")
+	if backgroundContext(ctx) != parent {
+		t.Errorf("backgroundContext() didn't return the context the run was started with")
+	}
+	done()
+	if ctx.Err() != nil {
+		t.Errorf("returning from the run canceled its context: %v", ctx.Err())
+	}
+
+	ctx, done = w.watch(parent, "accountsMgr")
+	defer done()
+	cancel()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Errorf("canceling the parent context didn't cancel the run's context")
+	}
+}
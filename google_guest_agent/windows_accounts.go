@@ -33,6 +33,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/GoogleCloudPlatform/guest-agent/eventlog"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
 	"github.com/GoogleCloudPlatform/guest-agent/metadata"
 	"github.com/GoogleCloudPlatform/guest-agent/utils"
@@ -106,6 +107,52 @@ type credsJSON struct {
 	Exponent          string `json:"exponent,omitempty"`
 	Modulus           string `json:"modulus,omitempty"`
 	HashFunction      string `json:"hashFunction,omitempty"`
+	Algorithm         string `json:"algorithm,omitempty"`
+}
+
+const (
+	// algorithmRSAOAEP encrypts the password with RSA-OAEP and the hash
+	// function requested with hashFunction, SHA-1 by default.
+	algorithmRSAOAEP = "RSA-OAEP"
+	// algorithmRSAOAEP256 encrypts the password with RSA-OAEP and SHA-256.
+	algorithmRSAOAEP256 = "RSA-OAEP-256"
+)
+
+// supportedKeySizes are the supported sizes, in bits, of the keys the
+// password is encrypted with.
+var supportedKeySizes = []int{2048, 3072, 4096}
+
+// passwordEncryption returns the algorithm and hash function negotiated by
+// the request k.
+func passwordEncryption(k metadata.WindowsKey) (string, string, hash.Hash, error) {
+	algorithm, hashFunction := k.Algorithm, k.HashFunction
+	switch algorithm {
+	case "", algorithmRSAOAEP:
+		algorithm = algorithmRSAOAEP
+		if hashFunction == "" {
+			hashFunction = "sha1"
+		}
+	case algorithmRSAOAEP256:
+		if hashFunction == "" {
+			hashFunction = "sha256"
+		}
+		if hashFunction != "sha256" {
+			return "", "", nil, fmt.Errorf("hash function %q is not supported by %s", hashFunction, algorithm)
+		}
+	default:
+		return "", "", nil, fmt.Errorf("unknown algorithm requested: %q", algorithm)
+	}
+
+	switch hashFunction {
+	case "sha1":
+		return algorithm, hashFunction, sha1.New(), nil
+	case "sha256":
+		return algorithm, hashFunction, sha256.New(), nil
+	case "sha512":
+		return algorithm, hashFunction, sha512.New(), nil
+	default:
+		return "", "", nil, fmt.Errorf("unknown hash function requested: %q", hashFunction)
+	}
 }
 
 func printCreds(creds *credsJSON) error {
@@ -123,20 +170,22 @@ func createOrResetPwd(ctx context.Context, k metadata.WindowsKey) (*credsJSON, e
 		return nil, fmt.Errorf("error creating password: %v", err)
 	}
 	if _, err := userExists(k.UserName); err == nil {
-		logger.Infof("Resetting password for user %s", k.UserName)
+		eventlog.Infof(eventlog.PasswordReset, "Resetting password for user %s", k.UserName)
 		if err := resetPwd(k.UserName, pwd); err != nil {
 			return nil, fmt.Errorf("error running resetPwd: %v", err)
 		}
+		auditAccount(auditPasswordReset, k.UserName, auditSourceWindowsKeys)
 		if k.AddToAdministrators != nil && *k.AddToAdministrators {
 			if err := addUserToGroup(ctx, k.UserName, "Administrators"); err != nil {
 				return nil, fmt.Errorf("error running addUserToGroup: %v", err)
 			}
 		}
 	} else {
-		logger.Infof("Creating user %s", k.UserName)
+		eventlog.Infof(eventlog.UserCreated, "Creating user %s", k.UserName)
 		if err := createUser(ctx, k.UserName, pwd, ""); err != nil {
 			return nil, fmt.Errorf("error running createUser: %v", err)
 		}
+		auditAccount(auditUserAdd, k.UserName, auditSourceWindowsKeys)
 		if k.AddToAdministrators == nil || *k.AddToAdministrators {
 			if err := addUserToGroup(ctx, k.UserName, "Administrators"); err != nil {
 				return nil, fmt.Errorf("error running addUserToGroup: %v", err)
@@ -155,10 +204,11 @@ func createSSHUser(ctx context.Context, user string) error {
 	if _, err := userExists(user); err == nil {
 		return nil
 	}
-	logger.Infof("Creating user %s", user)
+	eventlog.Infof(eventlog.UserCreated, "Creating user %s", user)
 	if err := createUser(ctx, user, pwd, ""); err != nil {
 		return fmt.Errorf("error running createUser: %v", err)
 	}
+	auditAccount(auditUserAdd, user, auditSourceMetadata)
 
 	if err := addUserToGroup(ctx, user, "Administrators"); err != nil {
 		return fmt.Errorf("error running addUserToGroup: %v", err)
@@ -181,20 +231,13 @@ func createcredsJSON(k metadata.WindowsKey, pwd string) (*credsJSON, error) {
 		E: int(new(big.Int).SetBytes(exp).Int64()),
 	}
 
-	if k.HashFunction == "" {
-		k.HashFunction = "sha1"
+	if !slices.Contains(supportedKeySizes, key.N.BitLen()) {
+		return nil, fmt.Errorf("unsupported key size %d, supported sizes are %v", key.N.BitLen(), supportedKeySizes)
 	}
 
-	var hashFunc hash.Hash
-	switch k.HashFunction {
-	case "sha1":
-		hashFunc = sha1.New()
-	case "sha256":
-		hashFunc = sha256.New()
-	case "sha512":
-		hashFunc = sha512.New()
-	default:
-		return nil, fmt.Errorf("unknown hash function requested: %q", k.HashFunction)
+	algorithm, hashFunction, hashFunc, err := passwordEncryption(k)
+	if err != nil {
+		return nil, err
 	}
 
 	encPwd, err := rsa.EncryptOAEP(hashFunc, rand.Reader, key, []byte(pwd), nil)
@@ -207,7 +250,8 @@ func createcredsJSON(k metadata.WindowsKey, pwd string) (*credsJSON, error) {
 		Exponent:          k.Exponent,
 		Modulus:           k.Modulus,
 		UserName:          k.UserName,
-		HashFunction:      k.HashFunction,
+		HashFunction:      hashFunction,
+		Algorithm:         algorithm,
 		EncryptedPassword: base64.StdEncoding.EncodeToString(encPwd),
 	}, nil
 }
@@ -248,6 +292,9 @@ func (a *winAccountsMgr) Diff(ctx context.Context) (bool, error) {
 	if newMetadata.Instance.Attributes.BlockProjectKeys != oldMetadata.Instance.Attributes.BlockProjectKeys {
 		return true, nil
 	}
+	if !reflect.DeepEqual(gmsaAccounts(newMetadata), gmsaAccounts(oldMetadata)) {
+		return true, nil
+	}
 
 	return false, nil
 }
@@ -340,6 +387,7 @@ func (a *winAccountsMgr) Set(ctx context.Context) error {
 	oldSSHEnable := getWinSSHEnabled(oldMetadata)
 	sshEnable := getWinSSHEnabled(newMetadata)
 
+	var mdKeyMap map[string][]string
 	if sshEnable {
 		if sshEnable != oldSSHEnable {
 			err := verifyWinSSHVersion(ctx)
@@ -362,7 +410,7 @@ func (a *winAccountsMgr) Set(ctx context.Context) error {
 			mdkeys = append(mdkeys, newMetadata.Project.Attributes.SSHKeys...)
 		}
 
-		mdKeyMap := getUserKeys(mdkeys)
+		mdKeyMap = getUserKeys(mdkeys)
 
 		for user := range mdKeyMap {
 			if err := createSSHUser(ctx, user); err != nil {
@@ -371,6 +419,20 @@ func (a *winAccountsMgr) Set(ctx context.Context) error {
 		}
 	}
 
+	// Without the files OpenSSH gets the keys from the agent's
+	// AuthorizedKeysCommand.
+	if cfg.Get().Accounts.WindowsAuthorizedKeysFiles {
+		if err := provisionAuthorizedKeys(mdKeyMap); err != nil {
+			logger.Errorf("Error provisioning OpenSSH authorized keys files: %v", err)
+		}
+	} else if err := removeAuthorizedKeys(); err != nil {
+		logger.Errorf("Error removing OpenSSH authorized keys files: %v", err)
+	}
+
+	if err := setGMSAccounts(ctx, gmsaAccounts(newMetadata)); err != nil {
+		logger.Errorf("Error setting up gMSAs: %v", err)
+	}
+
 	newKeys := newMetadata.Instance.Attributes.WindowsKeys
 	regKeys, err := readRegMultiString(regKeyBase, accountRegKey)
 	if err != nil && err != errRegNotExist {
@@ -385,12 +447,13 @@ func (a *winAccountsMgr) Set(ctx context.Context) error {
 			printCreds(creds)
 			continue
 		}
-		logger.Errorf("error setting password: %s", err)
+		eventlog.Errorf(eventlog.PasswordResetFailed, "error setting password: %s", err)
 		creds = &credsJSON{
 			PasswordFound: false,
 			Exponent:      key.Exponent,
 			Modulus:       key.Modulus,
 			UserName:      key.UserName,
+			Algorithm:     key.Algorithm,
 			ErrorMessage:  err.Error(),
 		}
 		printCreds(creds)
@@ -207,6 +207,73 @@ func TestCreatecredsJSON(t *testing.T) {
 	}
 }
 
+func TestCreatecredsJSONAlgorithms(t *testing.T) {
+	pwd := "password"
+	tests := []struct {
+		name         string
+		bits         int
+		algorithm    string
+		hashFunction string
+		wantHash     string
+		wantErr      bool
+	}{
+		{name: "default_3072", bits: 3072, wantHash: "sha1"},
+		{name: "rsa_oaep_sha256", bits: 2048, algorithm: algorithmRSAOAEP, hashFunction: "sha256", wantHash: "sha256"},
+		{name: "rsa_oaep_256_3072", bits: 3072, algorithm: algorithmRSAOAEP256, wantHash: "sha256"},
+		{name: "rsa_oaep_256_4096", bits: 4096, algorithm: algorithmRSAOAEP256, hashFunction: "sha256", wantHash: "sha256"},
+		{name: "rsa_oaep_256_sha1", bits: 2048, algorithm: algorithmRSAOAEP256, hashFunction: "sha1", wantErr: true},
+		{name: "unknown_algorithm", bits: 2048, algorithm: "RSA1_5", wantErr: true},
+		{name: "unsupported_key_size", bits: 1024, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			prv, err := rsa.GenerateKey(rand.Reader, tc.bits)
+			if err != nil {
+				t.Fatalf("error generating key: %v", err)
+			}
+			k := metadata.WindowsKey{
+				Exponent:     base64.StdEncoding.EncodeToString(new(big.Int).SetInt64(int64(prv.PublicKey.E)).Bytes()),
+				Modulus:      base64.StdEncoding.EncodeToString(prv.PublicKey.N.Bytes()),
+				UserName:     "username",
+				Algorithm:    tc.algorithm,
+				HashFunction: tc.hashFunction,
+			}
+			c, err := createcredsJSON(k, pwd)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("createcredsJSON(%+v) succeeded, want error", k)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("createcredsJSON(%+v) failed unexpectedly with error: %v", k, err)
+			}
+
+			wantAlgorithm := tc.algorithm
+			if wantAlgorithm == "" {
+				wantAlgorithm = algorithmRSAOAEP
+			}
+			if c.Algorithm != wantAlgorithm || c.HashFunction != tc.wantHash {
+				t.Errorf("createcredsJSON(%+v) negotiated %s/%s, want %s/%s", k, c.Algorithm, c.HashFunction, wantAlgorithm, tc.wantHash)
+			}
+
+			hashFunc := map[string]hash.Hash{"sha1": sha1.New(), "sha256": sha256.New()}[tc.wantHash]
+			bPwd, err := base64.StdEncoding.DecodeString(c.EncryptedPassword)
+			if err != nil {
+				t.Fatalf("error base64 decoding encoded pwd: %v", err)
+			}
+			decPwd, err := rsa.DecryptOAEP(hashFunc, rand.Reader, prv, bPwd, nil)
+			if err != nil {
+				t.Fatalf("error decrypting password: %v", err)
+			}
+			if pwd != string(decPwd) {
+				t.Errorf("decrypted password does not match expected, got: %s, want: %s", string(decPwd), pwd)
+			}
+		})
+	}
+}
+
 func TestCompareAccounts(t *testing.T) {
 	var tests = []struct {
 		newKeys    metadata.WindowsKeys
@@ -0,0 +1,304 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-agent/retry"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// windowsActivationJobID is the Windows activation job's ID.
+	windowsActivationJobID = "windows-activation"
+	// windowsActivationAttribute is the guest attribute the activation state
+	// is published to.
+	windowsActivationAttribute = "guest-agent-activation/status"
+	// defaultWindowsActivationCheckInterval is used if check_interval is not a
+	// valid duration.
+	defaultWindowsActivationCheckInterval = time.Hour
+	// kmsHostLookupTimeout bounds the KMS host's name resolution.
+	kmsHostLookupTimeout = 10 * time.Second
+
+	// licenseStatusLicensed is the LicenseStatus of an activated product.
+	licenseStatusLicensed = 1
+	// kmsClientChannel is in the description of the products activated
+	// against a KMS host.
+	kmsClientChannel = "VOLUME_KMSCLIENT"
+
+	// windowsLicenseCommand prints the license state of the Windows products
+	// with a product key installed as a JSON list.
+	windowsLicenseCommand = "ConvertTo-Json -Compress -InputObject @(Get-CimInstance SoftwareLicensingProduct " +
+		"-Filter \"ApplicationID='55c92734-d682-4d71-983e-d6ec3f16059f' AND PartialProductKey IS NOT NULL\" | " +
+		"Select-Object Name, Description, LicenseStatus, KeyManagementServiceMachine, KeyManagementServicePort, GracePeriodRemaining)"
+)
+
+var (
+	// activationRetryPolicy is the backoff of the activation attempts.
+	activationRetryPolicy = retry.Policy{MaxAttempts: 5, BackoffFactor: 2, Jitter: 30 * time.Second}
+
+	// lookupHost resolves the KMS host, overridden in tests.
+	lookupHost = net.DefaultResolver.LookupHost
+
+	// gceKMSHosts are the GCE KMS host and its address, the KMS clients
+	// pointed to another host are left alone.
+	gceKMSHosts = []string{"kms.windows.googlecloud.com", "35.190.247.13"}
+
+	// licenseStatusNames are the names of the SoftwareLicensingProduct
+	// LicenseStatus values.
+	licenseStatusNames = []string{"Unlicensed", "Licensed", "OOBGrace", "OOTGrace", "NonGenuineGrace", "Notification", "ExtendedGrace"}
+)
+
+// windowsProduct is the license state of a Windows product.
+type windowsProduct struct {
+	Name                        string
+	Description                 string
+	LicenseStatus               int
+	KeyManagementServiceMachine string
+	KeyManagementServicePort    int
+	// GracePeriodRemaining is the remaining time, in minutes, before the
+	// activation expires.
+	GracePeriodRemaining int
+}
+
+// kmsClient returns whether the product is activated against a KMS host.
+func (p windowsProduct) kmsClient() bool {
+	return strings.Contains(p.Description, kmsClientChannel)
+}
+
+// windowsActivationStatus is the published activation state.
+type windowsActivationStatus struct {
+	// Product is the Windows product's name.
+	Product string `json:"product"`
+	// Status is the product's license status, i.e. Licensed or Notification.
+	Status string `json:"status"`
+	// Activated is whether the product is activated.
+	Activated bool `json:"activated"`
+	// KMSHost is the KMS host the product is activated against.
+	KMSHost string `json:"kmsHost,omitempty"`
+	// GraceMinutes is the remaining time before the activation expires.
+	GraceMinutes int `json:"graceMinutes"`
+	// Error is the last activation failure.
+	Error string `json:"error,omitempty"`
+}
+
+// windowsActivationJob activates Windows against the GCE KMS host when it's
+// not activated, retrying with backoff, and publishes the activation state to
+// the guest attributes.
+type windowsActivationJob struct {
+	client metadata.MDSClientInterface
+}
+
+// newWindowsActivationJob returns the Windows activation job publishing the
+// activation state with client.
+func newWindowsActivationJob(client metadata.MDSClientInterface) *windowsActivationJob {
+	return &windowsActivationJob{client: client}
+}
+
+// ID returns the Windows activation job's ID.
+func (j *windowsActivationJob) ID() string {
+	return windowsActivationJobID
+}
+
+// Interval returns the configured check interval.
+func (j *windowsActivationJob) Interval() (time.Duration, bool) {
+	interval, err := time.ParseDuration(cfg.Get().WindowsActivation.CheckInterval)
+	if err != nil || interval <= 0 {
+		logger.Errorf("WindowsActivation check_interval configuration is not a valid duration string, falling back to %s", defaultWindowsActivationCheckInterval)
+		return defaultWindowsActivationCheckInterval, true
+	}
+	return interval, true
+}
+
+// ShouldEnable returns true on Windows if the activation is managed.
+func (j *windowsActivationJob) ShouldEnable(ctx context.Context) bool {
+	return runtime.GOOS == "windows" && cfg.Get().WindowsActivation.Enable
+}
+
+// Run points the KMS client to the KMS host, activates Windows if it's not
+// activated and publishes the activation state.
+func (j *windowsActivationJob) Run(ctx context.Context) (bool, error) {
+	if pausedForMaintenance(j.ID()) {
+		return true, nil
+	}
+
+	config := cfg.Get().WindowsActivation
+
+	product, err := windowsLicense(ctx)
+	if err != nil {
+		return true, err
+	}
+
+	var activationErr error
+	if product.kmsClient() && !gceKMSHost(product.KeyManagementServiceMachine, config) {
+		logger.Debugf("The KMS client is pointed to %s, not activating it.", product.KeyManagementServiceMachine)
+	} else if product.kmsClient() {
+		activationErr = j.activate(ctx, config, &product)
+		if activationErr != nil {
+			logger.Errorf("Failed to activate Windows: %v", activationErr)
+		}
+	} else if product.LicenseStatus != licenseStatusLicensed {
+		logger.Warningf("Windows is not activated and %q is not a KMS client, not activating it.", product.Name)
+	}
+
+	data, err := json.Marshal(newWindowsActivationStatus(product, activationErr))
+	if err != nil {
+		return true, fmt.Errorf("failed to marshal the Windows activation status: %w", err)
+	}
+	if err := j.client.WriteGuestAttributes(ctx, windowsActivationAttribute, string(data)); err != nil {
+		return true, fmt.Errorf("failed to publish the Windows activation status: %w", err)
+	}
+	return true, nil
+}
+
+// activate sets the KMS host of the product if it changed, and activates it
+// if it's not activated. product is updated with the resulting state.
+func (j *windowsActivationJob) activate(ctx context.Context, config *cfg.WindowsActivation, product *windowsProduct) error {
+	host, err := kmsHost(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	if !strings.EqualFold(product.KeyManagementServiceMachine, host) || product.KeyManagementServicePort != config.KMSPort {
+		logger.Infof("Setting the KMS host to %s:%d.", host, config.KMSPort)
+		if err := runSlmgr(ctx, "/skms", net.JoinHostPort(host, strconv.Itoa(config.KMSPort))); err != nil {
+			return fmt.Errorf("failed to set the KMS host: %w", err)
+		}
+	}
+	if product.LicenseStatus == licenseStatusLicensed {
+		return nil
+	}
+
+	logger.Infof("Activating Windows against %s:%d.", host, config.KMSPort)
+	err = retry.Run(ctx, activationRetryPolicy, func() error {
+		if err := runSlmgr(ctx, "/ato"); err != nil {
+			return err
+		}
+		p, err := windowsLicense(ctx)
+		if err != nil {
+			return err
+		}
+		*product = p
+		if p.LicenseStatus != licenseStatusLicensed {
+			return fmt.Errorf("license status is %s", licenseStatusName(p.LicenseStatus))
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to activate against %s: %w", host, err)
+	}
+	logger.Infof("Windows is activated.")
+	return nil
+}
+
+// gceKMSHost returns whether the KMS client's host is unset or a GCE KMS host,
+// the customer's own KMS hosts must be kept.
+func gceKMSHost(host string, config *cfg.WindowsActivation) bool {
+	if host == "" {
+		return true
+	}
+	hosts := append([]string{config.KMSHost, config.KMSFallbackIP}, gceKMSHosts...)
+	return slices.ContainsFunc(hosts, func(h string) bool {
+		return h != "" && strings.EqualFold(h, host)
+	})
+}
+
+// kmsHost returns the configured KMS host, or its fallback address if it
+// doesn't resolve, i.e. with custom DNS servers not forwarding to the
+// internal DNS.
+func kmsHost(ctx context.Context, config *cfg.WindowsActivation) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, kmsHostLookupTimeout)
+	defer cancel()
+
+	if _, err := lookupHost(ctx, config.KMSHost); err != nil {
+		if config.KMSFallbackIP == "" {
+			return "", fmt.Errorf("failed to resolve the KMS host %s: %w", config.KMSHost, err)
+		}
+		logger.Warningf("Failed to resolve the KMS host %s, falling back to %s: %v", config.KMSHost, config.KMSFallbackIP, err)
+		return config.KMSFallbackIP, nil
+	}
+	return config.KMSHost, nil
+}
+
+// runSlmgr runs the Software Licensing Management Tool with args.
+func runSlmgr(ctx context.Context, args ...string) error {
+	slmgr := filepath.Join(os.Getenv("SystemRoot"), "System32", "slmgr.vbs")
+	return run.Quiet(ctx, "cscript", append([]string{"//nologo", slmgr}, args...)...)
+}
+
+// windowsLicense returns the license state of the Windows product.
+func windowsLicense(ctx context.Context) (windowsProduct, error) {
+	out, err := runPowerShellOutput(ctx, windowsLicenseCommand)
+	if err != nil {
+		return windowsProduct{}, fmt.Errorf("failed to get the Windows license status: %w", err)
+	}
+	return parseWindowsLicense(out)
+}
+
+// parseWindowsLicense parses the JSON list of the Windows products, the KMS
+// client one being preferred.
+func parseWindowsLicense(out string) (windowsProduct, error) {
+	var products []windowsProduct
+	if err := json.Unmarshal([]byte(out), &products); err != nil {
+		return windowsProduct{}, fmt.Errorf("failed to parse the Windows license status: %w", err)
+	}
+	if len(products) == 0 {
+		return windowsProduct{}, errors.New("no Windows product key installed")
+	}
+	for _, p := range products {
+		if p.kmsClient() {
+			return p, nil
+		}
+	}
+	return products[0], nil
+}
+
+// licenseStatusName returns the name of the LicenseStatus value.
+func licenseStatusName(status int) string {
+	if status < 0 || status >= len(licenseStatusNames) {
+		return strconv.Itoa(status)
+	}
+	return licenseStatusNames[status]
+}
+
+// newWindowsActivationStatus returns the published state of the product.
+func newWindowsActivationStatus(product windowsProduct, err error) windowsActivationStatus {
+	status := windowsActivationStatus{
+		Product:      product.Name,
+		Status:       licenseStatusName(product.LicenseStatus),
+		Activated:    product.LicenseStatus == licenseStatusLicensed,
+		KMSHost:      product.KeyManagementServiceMachine,
+		GraceMinutes: product.GracePeriodRemaining,
+	}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	return status
+}
@@ -0,0 +1,145 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseWindowsLicense(t *testing.T) {
+	kms := windowsProduct{
+		Name:                        "Windows(R), ServerDatacenter edition",
+		Description:                 "Windows(R) Operating System, VOLUME_KMSCLIENT channel",
+		LicenseStatus:               1,
+		KeyManagementServiceMachine: "kms.windows.googlecloud.com",
+		KeyManagementServicePort:    1688,
+		GracePeriodRemaining:        259200,
+	}
+
+	tests := []struct {
+		name    string
+		out     string
+		want    windowsProduct
+		wantErr bool
+	}{
+		{
+			name: "kms_client",
+			out: `[{"Name":"Windows(R), ServerStandard edition","Description":"Windows(R) Operating System, RETAIL channel","LicenseStatus":5,"KeyManagementServiceMachine":null,"KeyManagementServicePort":0,"GracePeriodRemaining":0},` +
+				`{"Name":"Windows(R), ServerDatacenter edition","Description":"Windows(R) Operating System, VOLUME_KMSCLIENT channel","LicenseStatus":1,"KeyManagementServiceMachine":"kms.windows.googlecloud.com","KeyManagementServicePort":1688,"GracePeriodRemaining":259200}]`,
+			want: kms,
+		},
+		{
+			name: "retail",
+			out:  `[{"Name":"Windows(R), Professional edition","Description":"Windows(R) Operating System, RETAIL channel","LicenseStatus":5}]`,
+			want: windowsProduct{Name: "Windows(R), Professional edition", Description: "Windows(R) Operating System, RETAIL channel", LicenseStatus: 5},
+		},
+		{name: "no_product", out: `[]`, wantErr: true},
+		{name: "invalid", out: `Get-CimInstance : Access denied`, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseWindowsLicense(tc.out)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("parseWindowsLicense(%q) = error %v, want error %t", tc.out, err, tc.wantErr)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("parseWindowsLicense(%q) returned unexpected diff (-want +got):\n%s", tc.out, diff)
+			}
+		})
+	}
+}
+
+func TestKMSHost(t *testing.T) {
+	origLookupHost := lookupHost
+	t.Cleanup(func() { lookupHost = origLookupHost })
+
+	tests := []struct {
+		name       string
+		resolves   bool
+		fallbackIP string
+		want       string
+		wantErr    bool
+	}{
+		{name: "resolves", resolves: true, fallbackIP: "35.190.247.13", want: "kms.windows.googlecloud.com"},
+		{name: "fallback", fallbackIP: "35.190.247.13", want: "35.190.247.13"},
+		{name: "no_fallback", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			lookupHost = func(ctx context.Context, host string) ([]string, error) {
+				if !tc.resolves {
+					return nil, errors.New("no such host")
+				}
+				return []string{"35.190.247.13"}, nil
+			}
+			config := &cfg.WindowsActivation{KMSHost: "kms.windows.googlecloud.com", KMSFallbackIP: tc.fallbackIP}
+
+			got, err := kmsHost(context.Background(), config)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("kmsHost(ctx, %+v) = error %v, want error %t", config, err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("kmsHost(ctx, %+v) = %q, want %q", config, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGCEKMSHost(t *testing.T) {
+	config := &cfg.WindowsActivation{KMSHost: "kms.example.internal", KMSFallbackIP: "10.0.0.5"}
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{host: "", want: true},
+		{host: "kms.example.internal", want: true},
+		{host: "10.0.0.5", want: true},
+		{host: "KMS.windows.googlecloud.com", want: true},
+		{host: "35.190.247.13", want: true},
+		{host: "kms.corp.example.com"},
+	}
+
+	for _, tc := range tests {
+		if got := gceKMSHost(tc.host, config); got != tc.want {
+			t.Errorf("gceKMSHost(%q, %+v) = %t, want %t", tc.host, config, got, tc.want)
+		}
+	}
+}
+
+func TestNewWindowsActivationStatus(t *testing.T) {
+	product := windowsProduct{Name: "Windows(R), ServerDatacenter edition", LicenseStatus: 5, KeyManagementServiceMachine: "35.190.247.13"}
+	want := windowsActivationStatus{
+		Product: "Windows(R), ServerDatacenter edition",
+		Status:  "Notification",
+		KMSHost: "35.190.247.13",
+		Error:   "activation failed",
+	}
+
+	got := newWindowsActivationStatus(product, errors.New("activation failed"))
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("newWindowsActivationStatus(%+v) returned unexpected diff (-want +got):\n%s", product, diff)
+	}
+
+	if got := licenseStatusName(42); got != "42" {
+		t.Errorf("licenseStatusName(42) = %q, want 42", got)
+	}
+}
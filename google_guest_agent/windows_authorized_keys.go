@@ -0,0 +1,196 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// authorizedKeysRegKey lists the users whose OpenSSH authorized keys file
+	// was written by the agent.
+	authorizedKeysRegKey = "AuthorizedKeysUsers"
+
+	// authorizedKeysHeader marks the authorized keys files written by the
+	// agent, the files without it are never changed.
+	authorizedKeysHeader = "# Added by Google Compute Engine Guest Agent."
+)
+
+// authorizedKeysContent returns the content of an authorized keys file
+// holding keys.
+func authorizedKeysContent(keys []string) []byte {
+	return []byte(authorizedKeysHeader + "\n" + strings.Join(keys, "\n") + "\n")
+}
+
+// adminAuthorizedKeys returns the keys of all users, by user, sorted by user.
+// Every metadata SSH user is an administrator on Windows, and OpenSSH reads
+// the keys of the administrators from a single file.
+func adminAuthorizedKeys(keys map[string][]string) []string {
+	var users []string
+	for user := range keys {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+
+	var res []string
+	for _, user := range users {
+		res = append(res, keys[user]...)
+	}
+	return res
+}
+
+// isManagedAuthorizedKeys reports whether the authorized keys file at path
+// is missing or was written by the agent.
+func isManagedAuthorizedKeys(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return false, scanner.Err()
+	}
+	return scanner.Text() == authorizedKeysHeader, nil
+}
+
+// managedAuthorizedKeys returns the keys of the authorized keys file at path
+// written by the agent, none if it's missing.
+func managedAuthorizedKeys(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var keys []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && line != authorizedKeysHeader {
+			keys = append(keys, line)
+		}
+	}
+	return keys, nil
+}
+
+// writeManagedAuthorizedKeys writes keys to the authorized keys file at path
+// of user, an empty user being the administrators, or removes it without
+// keys. Files not written by the agent are left untouched. The key changes of
+// the users' files are audited, the administrators file holds the same keys.
+func writeManagedAuthorizedKeys(path, user string, keys []string) error {
+	managed, err := isManagedAuthorizedKeys(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %q: %w", path, err)
+	}
+	if !managed {
+		logger.Warningf("Not changing %q, it wasn't written by the agent.", path)
+		return nil
+	}
+	prevKeys, err := managedAuthorizedKeys(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %q: %w", path, err)
+	}
+
+	if len(keys) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %q: %w", path, err)
+		}
+	} else if err := writeAuthorizedKeysFile(path, user, authorizedKeysContent(keys)); err != nil {
+		return err
+	}
+	if user != "" {
+		auditKeyChanges(user, auditSourceMetadata, prevKeys, keys)
+	}
+	return nil
+}
+
+// provisionAuthorizedKeys writes keys, by user, to the OpenSSH authorized keys
+// files of the administrators and of each user with a profile, and removes
+// the keys of the users no longer present. No keys removes all of them.
+func provisionAuthorizedKeys(keys map[string][]string) error {
+	var errs []error
+	if err := writeManagedAuthorizedKeys(adminAuthorizedKeysFile(), "", adminAuthorizedKeys(keys)); err != nil {
+		errs = append(errs, err)
+	}
+
+	prevUsers, err := readRegMultiString(regKeyBase, authorizedKeysRegKey)
+	if err != nil && err != errRegNotExist {
+		return fmt.Errorf("failed to read the users with authorized keys: %w", err)
+	}
+	for _, user := range prevUsers {
+		if _, ok := keys[user]; ok {
+			continue
+		}
+		dir, err := userSSHDir(user)
+		if err != nil {
+			logger.Debugf("Not removing the authorized keys of %s: %v", user, err)
+			continue
+		}
+		if err := writeManagedAuthorizedKeys(filepath.Join(dir, "authorized_keys"), user, nil); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	var users []string
+	for user, userKeys := range keys {
+		// The profile is created on the first logon, through the
+		// administrators file until then.
+		dir, err := userSSHDir(user)
+		if err != nil {
+			logger.Debugf("Not writing the authorized keys of %s: %v", user, err)
+			continue
+		}
+		if err := writeManagedAuthorizedKeys(filepath.Join(dir, "authorized_keys"), user, userKeys); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		users = append(users, user)
+	}
+	sort.Strings(users)
+
+	if err := writeRegMultiString(regKeyBase, authorizedKeysRegKey, users); err != nil {
+		errs = append(errs, fmt.Errorf("failed to record the users with authorized keys: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// removeAuthorizedKeys removes the authorized keys files written by the agent
+// once the files are turned off. It does nothing if no files were recorded.
+func removeAuthorizedKeys() error {
+	if _, err := readRegMultiString(regKeyBase, authorizedKeysRegKey); err != nil {
+		if err == errRegNotExist {
+			return nil
+		}
+		return fmt.Errorf("failed to read the users with authorized keys: %w", err)
+	}
+
+	logger.Infof("Removing the OpenSSH authorized keys files written by the agent.")
+	if err := provisionAuthorizedKeys(nil); err != nil {
+		return err
+	}
+	return deleteRegKey(regKeyBase, authorizedKeysRegKey)
+}
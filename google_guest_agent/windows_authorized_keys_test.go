@@ -0,0 +1,80 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestAdminAuthorizedKeys(t *testing.T) {
+	keys := map[string][]string{
+		"userb": {"ssh-ed25519 BBBB userb"},
+		"usera": {"ssh-rsa AAAA usera", "ssh-ed25519 CCCC usera"},
+	}
+	want := []string{"ssh-rsa AAAA usera", "ssh-ed25519 CCCC usera", "ssh-ed25519 BBBB userb"}
+	if diff := cmp.Diff(want, adminAuthorizedKeys(keys)); diff != "" {
+		t.Errorf("adminAuthorizedKeys() returned unexpected diff (-want +got):\n%s", diff)
+	}
+
+	wantContent := authorizedKeysHeader + "\nssh-rsa AAAA usera\n"
+	if got := string(authorizedKeysContent([]string{"ssh-rsa AAAA usera"})); got != wantContent {
+		t.Errorf("authorizedKeysContent() = %q, want %q", got, wantContent)
+	}
+}
+
+func TestWriteManagedAuthorizedKeys(t *testing.T) {
+	t.Cleanup(func() { writeAccountAuditRecord = defaultWriteAccountAuditRecord })
+	var audited []string
+	writeAccountAuditRecord = func(record *accountAuditRecord) {
+		audited = append(audited, record.Action+":"+record.User)
+	}
+	dir := t.TempDir()
+	managed := filepath.Join(dir, "managed")
+	if err := os.WriteFile(managed, authorizedKeysContent([]string{"ssh-rsa AAAA usera"}), 0600); err != nil {
+		t.Fatalf("os.WriteFile(%q) failed unexpectedly with error: %v", managed, err)
+	}
+	user := filepath.Join(dir, "user")
+	if err := os.WriteFile(user, []byte("ssh-rsa DDDD mine\n"), 0600); err != nil {
+		t.Fatalf("os.WriteFile(%q) failed unexpectedly with error: %v", user, err)
+	}
+
+	for path, want := range map[string]bool{managed: true, user: false, filepath.Join(dir, "missing"): true} {
+		got, err := isManagedAuthorizedKeys(path)
+		if err != nil || got != want {
+			t.Errorf("isManagedAuthorizedKeys(%q) = %t, %v, want %t, nil", path, got, err, want)
+		}
+	}
+
+	// Without keys the files written by the agent are removed, the others kept.
+	for _, path := range []string{managed, user} {
+		if err := writeManagedAuthorizedKeys(path, "usera", nil); err != nil {
+			t.Errorf("writeManagedAuthorizedKeys(%q) failed unexpectedly with error: %v", path, err)
+		}
+	}
+	if _, err := os.Stat(managed); !os.IsNotExist(err) {
+		t.Errorf("writeManagedAuthorizedKeys(%q) kept the file without keys, want it removed", managed)
+	}
+	if _, err := os.Stat(user); err != nil {
+		t.Errorf("writeManagedAuthorizedKeys(%q) removed a file not written by the agent", user)
+	}
+	// Only the removal from the file written by the agent is audited.
+	if diff := cmp.Diff([]string{"key-remove:usera"}, audited); diff != "" {
+		t.Errorf("writeManagedAuthorizedKeys() audited unexpected diff (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,338 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+const (
+	// windowsCertsRegKey is the registry value listing the certificates
+	// installed by the agent, as store\thumbprint paths.
+	windowsCertsRegKey = "Certificates"
+	// defaultCertStore is the store certificates are installed in by default.
+	defaultCertStore = `LocalMachine\My`
+	// windowsCertsRefreshInterval is the interval at which the certificates'
+	// content is fetched again, the attributes and secrets they are read from
+	// can change without the windows-certificates attribute changing.
+	windowsCertsRefreshInterval = time.Hour
+)
+
+var (
+	// certStoreExp matches the supported certificate stores.
+	certStoreExp = regexp.MustCompile(`^LocalMachine\\[A-Za-z]+$`)
+
+	// windowsCertsRefreshed is when the certificates were last installed.
+	windowsCertsRefreshed time.Time
+)
+
+// windowsCertsMgr installs the windows-certificates in the local machine's
+// certificate stores and removes the ones no longer listed.
+type windowsCertsMgr struct {
+	// fakeWindows forces Disabled to run as if it was running in a windows system.
+	// mostly target for unit tests.
+	fakeWindows bool
+}
+
+func (m *windowsCertsMgr) Diff(ctx context.Context) (bool, error) {
+	return !reflect.DeepEqual(newMetadata.Instance.Attributes.WindowsCertificates, oldMetadata.Instance.Attributes.WindowsCertificates), nil
+}
+
+// Timeout returns true once the certificates' content is due to be refreshed,
+// i.e. a rotated secret.
+func (m *windowsCertsMgr) Timeout(ctx context.Context) (bool, error) {
+	if len(newMetadata.Instance.Attributes.WindowsCertificates) == 0 {
+		return false, nil
+	}
+	return time.Since(windowsCertsRefreshed) >= windowsCertsRefreshInterval, nil
+}
+
+func (m *windowsCertsMgr) Disabled(ctx context.Context) (bool, error) {
+	return !m.fakeWindows && runtime.GOOS != "windows", nil
+}
+
+// certImport is a certificate ready to be imported.
+type certImport struct {
+	// thumbprint is the certificate's SHA1 thumbprint.
+	thumbprint string
+	// data is the PFX encoded certificate and private key, or the DER encoded
+	// certificate if it has no private key.
+	data []byte
+	// password is the PFX password.
+	password string
+}
+
+// hasKey returns whether the certificate comes with its private key.
+func (c certImport) hasKey() bool {
+	return c.password != ""
+}
+
+// certThumbprint returns the SHA1 thumbprint of the certificate.
+func certThumbprint(cert *x509.Certificate) string {
+	sum := sha1.Sum(cert.Raw)
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// newCertImport returns the import of the certificate and private key, the
+// PFX being re-encrypted with a random password.
+func newCertImport(key any, cert *x509.Certificate, chain []*x509.Certificate) (certImport, error) {
+	if key == nil {
+		return certImport{thumbprint: certThumbprint(cert), data: cert.Raw}, nil
+	}
+
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return certImport{}, err
+	}
+	password := base64.RawURLEncoding.EncodeToString(b)
+	// Windows Server 2016 doesn't support the AES encrypted PFX files.
+	data, err := pkcs12.LegacyDES.Encode(key, cert, chain, password)
+	if err != nil {
+		return certImport{}, err
+	}
+	return certImport{thumbprint: certThumbprint(cert), data: data, password: password}, nil
+}
+
+// parseCertificate parses the PEM encoded certificate, with its optional
+// chain and private key, or the raw or base64 encoded PFX content.
+func parseCertificate(content []byte, password string) (certImport, error) {
+	if block, _ := pem.Decode(content); block != nil {
+		var certs []*x509.Certificate
+		var key any
+		for rest := content; ; {
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			switch {
+			case block.Type == "CERTIFICATE":
+				cert, err := x509.ParseCertificate(block.Bytes)
+				if err != nil {
+					return certImport{}, fmt.Errorf("failed to parse certificate: %w", err)
+				}
+				certs = append(certs, cert)
+			case strings.HasSuffix(block.Type, "PRIVATE KEY"):
+				var err error
+				if key, err = parsePrivateKey(block); err != nil {
+					return certImport{}, err
+				}
+			}
+		}
+		if len(certs) == 0 {
+			return certImport{}, errors.New("no certificate found")
+		}
+		return newCertImport(key, certs[0], certs[1:])
+	}
+
+	pfx := content
+	if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content))); err == nil {
+		pfx = decoded
+	}
+	key, cert, chain, err := pkcs12.DecodeChain(pfx, password)
+	if err != nil {
+		return certImport{}, fmt.Errorf("failed to decode PFX: %w", err)
+	}
+	return newCertImport(key, cert, chain)
+}
+
+// parsePrivateKey parses a PKCS#8, PKCS#1 or EC private key.
+func parsePrivateKey(block *pem.Block) (any, error) {
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	return nil, fmt.Errorf("unsupported private key type %q", block.Type)
+}
+
+// getCertificateContent returns the certificate's content and PFX password
+// from the instance attribute or Secret Manager, the secret taking precedence.
+func getCertificateContent(ctx context.Context, client metadata.MDSClientInterface, c metadata.WindowsCertificate) ([]byte, string, error) {
+	var content string
+	var err error
+	switch {
+	case c.Secret != "":
+		content, err = accessSecret(ctx, client, c.Secret)
+	case c.Attribute != "":
+		content, err = client.GetKey(ctx, "instance/attributes/"+c.Attribute, nil)
+	default:
+		return nil, "", errors.New("no certificate source set")
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	var password string
+	if c.PasswordSecret != "" {
+		if password, err = accessSecret(ctx, client, c.PasswordSecret); err != nil {
+			return nil, "", err
+		}
+	}
+	return []byte(content), strings.TrimSpace(password), nil
+}
+
+// certImportCommand returns the PowerShell command importing the certificate
+// file in store, its private key being non-exportable.
+func certImportCommand(store, file string, c certImport) string {
+	location := psQuote(`Cert:\` + store)
+	if !c.hasKey() {
+		return fmt.Sprintf("Import-Certificate -FilePath %s -CertStoreLocation %s | Out-Null", psQuote(file), location)
+	}
+	return fmt.Sprintf("Import-PfxCertificate -FilePath %s -CertStoreLocation %s -Password (ConvertTo-SecureString %s -AsPlainText -Force) | Out-Null",
+		psQuote(file), location, psQuote(c.password))
+}
+
+// certKeyGrantCommand returns the PowerShell command granting the accounts
+// read access to the private key file of the certificate at path, a CNG or
+// legacy CSP key.
+func certKeyGrantCommand(path string, accounts []string) string {
+	var grants []string
+	for _, a := range accounts {
+		grants = append(grants, fmt.Sprintf("icacls $f /grant %s | Out-Null; if ($LASTEXITCODE -ne 0) { throw 'icacls failed' }", psQuote(a+":R")))
+	}
+	return fmt.Sprintf("$c = Get-Item %s; "+
+		"$k = [System.Security.Cryptography.X509Certificates.RSACertificateExtensions]::GetRSAPrivateKey($c); "+
+		"if (-not $k) { $k = [System.Security.Cryptography.X509Certificates.ECDsaCertificateExtensions]::GetECDsaPrivateKey($c) }; "+
+		"if ($k.Key) { $f = Join-Path $env:ProgramData ('Microsoft\\Crypto\\Keys\\' + $k.Key.UniqueName) } "+
+		"else { $f = Join-Path $env:ProgramData ('Microsoft\\Crypto\\RSA\\MachineKeys\\' + $k.CspKeyContainerInfo.UniqueKeyContainerName) }; %s",
+		psQuote(`Cert:\`+path), strings.Join(grants, "; "))
+}
+
+// certRemoveCommand returns the PowerShell command removing the certificate
+// at path and its private key.
+func certRemoveCommand(path string) string {
+	return fmt.Sprintf("Remove-Item -Path %s -DeleteKey -ErrorAction SilentlyContinue", psQuote(`Cert:\`+path))
+}
+
+// installCertificate imports the certificate in store and grants the
+// accounts access to its private key. It returns the certificate's path.
+func installCertificate(ctx context.Context, store string, c certImport, accounts []string) (string, error) {
+	f, err := os.CreateTemp("", "gce-certificate")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(c.data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err := runPowerShell(ctx, certImportCommand(store, f.Name(), c)); err != nil {
+		return "", fmt.Errorf("failed to import certificate: %w", err)
+	}
+	path := store + `\` + c.thumbprint
+	if c.hasKey() && len(accounts) > 0 {
+		if err := runPowerShell(ctx, certKeyGrantCommand(path, accounts)); err != nil {
+			return path, fmt.Errorf("failed to grant access to the private key: %w", err)
+		}
+	}
+	return path, nil
+}
+
+func (m *windowsCertsMgr) Set(ctx context.Context) error {
+	installed, err := readRegMultiString(regKeyBase, windowsCertsRegKey)
+	if err != nil && err != errRegNotExist {
+		return err
+	}
+
+	// On refreshes, the certificates with unchanged content are not imported
+	// again.
+	changed := !reflect.DeepEqual(newMetadata.Instance.Attributes.WindowsCertificates, oldMetadata.Instance.Attributes.WindowsCertificates)
+	windowsCertsRefreshed = time.Now()
+
+	var paths []string
+	// failed is whether a certificate couldn't be fetched, the certificates
+	// installed before are kept as it could be one of them.
+	var failed bool
+	for i, c := range newMetadata.Instance.Attributes.WindowsCertificates {
+		store := c.Store
+		if store == "" {
+			store = defaultCertStore
+		}
+		if !certStoreExp.MatchString(store) {
+			logger.Errorf("Unsupported certificate store %q of certificate %d, skipping it", store, i)
+			continue
+		}
+
+		content, password, err := getCertificateContent(ctx, mdsClient, c)
+		if err != nil {
+			logger.Errorf("Failed to get certificate %d: %v", i, err)
+			failed = true
+			continue
+		}
+		ci, err := parseCertificate(content, password)
+		if err != nil {
+			logger.Errorf("Failed to parse certificate %d: %v", i, err)
+			failed = true
+			continue
+		}
+
+		if path := store + `\` + ci.thumbprint; !changed && slices.Contains(installed, path) {
+			paths = append(paths, path)
+			continue
+		}
+
+		logger.Infof("Installing certificate %s in %s", ci.thumbprint, store)
+		path, err := installCertificate(ctx, store, ci, c.Accounts)
+		if path != "" {
+			paths = append(paths, path)
+		}
+		if err != nil {
+			logger.Errorf("Failed to install certificate %s in %s: %v", ci.thumbprint, store, err)
+		}
+	}
+
+	for _, path := range installed {
+		if slices.Contains(paths, path) {
+			continue
+		}
+		if failed {
+			paths = append(paths, path)
+			continue
+		}
+		logger.Infof("Removing certificate %s", path)
+		if err := runPowerShell(ctx, certRemoveCommand(path)); err != nil {
+			logger.Errorf("Failed to remove certificate %s: %v", path, err)
+			paths = append(paths, path)
+		}
+	}
+
+	return writeRegMultiString(regKeyBase, windowsCertsRegKey, paths)
+}
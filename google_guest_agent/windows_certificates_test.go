@@ -0,0 +1,162 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// testCertificate returns a self-signed certificate and its private key.
+func testCertificate(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey() failed: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate() failed: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate() failed: %v", err)
+	}
+	return cert, key
+}
+
+func TestParseCertificate(t *testing.T) {
+	cert, key := testCertificate(t)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("x509.MarshalPKCS8PrivateKey() failed: %v", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	pfx, err := pkcs12.Modern.Encode(key, cert, nil, "pfx-password")
+	if err != nil {
+		t.Fatalf("pkcs12.Encode() failed: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		content  []byte
+		password string
+		wantKey  bool
+	}{
+		{"pem certificate", certPEM, "", false},
+		{"pem certificate and key", append(keyPEM, certPEM...), "", true},
+		{"raw pfx", pfx, "pfx-password", true},
+		{"base64 pfx", []byte(base64.StdEncoding.EncodeToString(pfx) + "\n"), "pfx-password", true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseCertificate(tc.content, tc.password)
+			if err != nil {
+				t.Fatalf("parseCertificate() failed: %v", err)
+			}
+			if got.thumbprint != certThumbprint(cert) {
+				t.Errorf("parseCertificate() thumbprint = %s, want %s", got.thumbprint, certThumbprint(cert))
+			}
+			if got.hasKey() != tc.wantKey {
+				t.Fatalf("parseCertificate() hasKey = %t, want %t", got.hasKey(), tc.wantKey)
+			}
+			if !tc.wantKey {
+				if !bytes.Equal(got.data, cert.Raw) {
+					t.Errorf("parseCertificate() data isn't the DER encoded certificate")
+				}
+				return
+			}
+			if _, _, err := pkcs12.Decode(got.data, got.password); err != nil {
+				t.Errorf("parseCertificate() PFX can't be decoded with its password: %v", err)
+			}
+		})
+	}
+
+	if _, err := parseCertificate(pfx, "wrong"); err == nil {
+		t.Errorf("parseCertificate() succeeded with the wrong PFX password, want error")
+	}
+	if _, err := parseCertificate(keyPEM, ""); err == nil {
+		t.Errorf("parseCertificate() succeeded without certificate, want error")
+	}
+}
+
+func TestCertCommands(t *testing.T) {
+	got := certImportCommand(`LocalMachine\Root`, `C:\tmp\c`, certImport{})
+	if !strings.HasPrefix(got, `Import-Certificate -FilePath 'C:\tmp\c' -CertStoreLocation 'Cert:\LocalMachine\Root'`) {
+		t.Errorf("certImportCommand() = %q, want a certificate import", got)
+	}
+	got = certImportCommand(`LocalMachine\My`, `C:\tmp\c`, certImport{password: "pw"})
+	if !strings.HasPrefix(got, "Import-PfxCertificate") || strings.Contains(got, "-Exportable") {
+		t.Errorf("certImportCommand() = %q, want a non-exportable PFX import", got)
+	}
+
+	got = certKeyGrantCommand(`LocalMachine\My\ABCD`, []string{`NT SERVICE\W3SVC`, "IIS_IUSRS"})
+	for _, want := range []string{`Get-Item 'Cert:\LocalMachine\My\ABCD'`, `/grant 'NT SERVICE\W3SVC:R'`, `/grant 'IIS_IUSRS:R'`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("certKeyGrantCommand() = %q, want it to contain %q", got, want)
+		}
+	}
+
+	want := `Remove-Item -Path 'Cert:\LocalMachine\My\ABCD' -DeleteKey -ErrorAction SilentlyContinue`
+	if got := certRemoveCommand(`LocalMachine\My\ABCD`); got != want {
+		t.Errorf("certRemoveCommand() = %q, want %q", got, want)
+	}
+}
+
+func TestWindowsCertsTimeout(t *testing.T) {
+	origMetadata, origRefreshed := newMetadata, windowsCertsRefreshed
+	t.Cleanup(func() { newMetadata, windowsCertsRefreshed = origMetadata, origRefreshed })
+
+	mgr := &windowsCertsMgr{fakeWindows: true}
+	ctx := context.Background()
+
+	newMetadata = &metadata.Descriptor{}
+	if timeout, _ := mgr.Timeout(ctx); timeout {
+		t.Errorf("Timeout() = true without certificates, want false")
+	}
+
+	newMetadata.Instance.Attributes.WindowsCertificates = metadata.WindowsCertificates{{Attribute: "cert"}}
+	windowsCertsRefreshed = time.Now()
+	if timeout, _ := mgr.Timeout(ctx); timeout {
+		t.Errorf("Timeout() = true right after a refresh, want false")
+	}
+
+	windowsCertsRefreshed = time.Now().Add(-windowsCertsRefreshInterval)
+	if timeout, _ := mgr.Timeout(ctx); !timeout {
+		t.Errorf("Timeout() = false %s after a refresh, want true", windowsCertsRefreshInterval)
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// firewallRulesRegKey is the registry value listing the firewall rules
+	// created by the agent.
+	firewallRulesRegKey = "FirewallRules"
+	// firewallRuleGroup is the group of the firewall rules created by the
+	// agent, rules of the group not wanted anymore are removed.
+	firewallRuleGroup = "Google Compute Engine Agent"
+	// wsfcFirewallRule is the name of the WSFC health check agent's rule.
+	wsfcFirewallRule = "GCEGuestAgent-WSFC"
+)
+
+var (
+	// firewallRulesChecked is whether the firewall rules were reconciled since
+	// the agent started, the rules could have been removed behind its back.
+	firewallRulesChecked bool
+
+	// healthCheckSourceRanges are the source ranges of the Google Cloud load
+	// balancers' health checks, allowed by default.
+	healthCheckSourceRanges = []string{"35.191.0.0/16", "130.211.0.0/22"}
+)
+
+// firewallRule is an inbound rule allowing connections to a listener of the
+// agent.
+type firewallRule struct {
+	// Name is the rule's unique name.
+	Name string
+	// DisplayName is the rule's name shown to users.
+	DisplayName string
+	// Protocol is the listener's protocol, i.e. TCP.
+	Protocol string
+	// LocalPort is the listener's port.
+	LocalPort string
+	// RemoteAddresses are the addresses and CIDR ranges allowed to connect,
+	// empty allows any.
+	RemoteAddresses []string
+	// Program is the path of the agent's executable, empty allows any program.
+	Program string
+}
+
+// String returns the rule's configuration as recorded in the registry.
+func (r firewallRule) String() string {
+	return strings.Join([]string{r.Name, r.Protocol, r.LocalPort, strings.Join(r.RemoteAddresses, ","), r.Program}, "|")
+}
+
+// createCommand returns the PowerShell command creating the rule.
+func (r firewallRule) createCommand() string {
+	remote := "Any"
+	if len(r.RemoteAddresses) > 0 {
+		var quoted []string
+		for _, addr := range r.RemoteAddresses {
+			quoted = append(quoted, psQuote(addr))
+		}
+		remote = strings.Join(quoted, ",")
+	}
+	cmd := fmt.Sprintf("New-NetFirewallRule -Name %s -DisplayName %s -Group %s -Direction Inbound -Action Allow -Protocol %s -LocalPort %s -RemoteAddress %s",
+		psQuote(r.Name), psQuote(r.DisplayName), psQuote(firewallRuleGroup), r.Protocol, psQuote(r.LocalPort), remote)
+	if r.Program != "" {
+		cmd += " -Program " + psQuote(r.Program)
+	}
+	return cmd + " | Out-Null"
+}
+
+// firewallRuleListCommand returns the PowerShell command printing the names
+// of the agent's rules, one per line.
+func firewallRuleListCommand() string {
+	return fmt.Sprintf("Get-NetFirewallRule -Group %s -ErrorAction SilentlyContinue | ForEach-Object { $_.Name }", psQuote(firewallRuleGroup))
+}
+
+// firewallRuleRemoveCommand returns the PowerShell command removing the rule.
+func firewallRuleRemoveCommand(name string) string {
+	return "Remove-NetFirewallRule -Name " + psQuote(name)
+}
+
+// wantFirewallRules returns the rules of the agent's listeners enabled by
+// config and the WSFC manager, allowing program.
+func wantFirewallRules(config *cfg.Sections, wsfc *wsfcManager, program string) []firewallRule {
+	var rules []firewallRule
+	if wsfc.agentNewState == running {
+		var remote []string
+		if config.WSFC != nil {
+			for _, source := range strings.Split(config.WSFC.AllowedSources, ",") {
+				if source = strings.TrimSpace(source); source != "" {
+					remote = append(remote, source)
+				}
+			}
+		}
+		if len(remote) == 0 {
+			remote = healthCheckSourceRanges
+		}
+		rules = append(rules, firewallRule{
+			Name:            wsfcFirewallRule,
+			DisplayName:     "Google Compute Engine WSFC health check",
+			Protocol:        "TCP",
+			LocalPort:       wsfc.agentNewPort,
+			RemoteAddresses: remote,
+			Program:         program,
+		})
+	}
+	return rules
+}
+
+// currentFirewallRules returns the rules wanted for the current configuration
+// and metadata.
+func currentFirewallRules() []firewallRule {
+	program, err := os.Executable()
+	if err != nil {
+		logger.Errorf("Failed to get the agent's executable, not restricting its firewall rules to it: %v", err)
+	}
+	return wantFirewallRules(cfg.Get(), newWsfcManager(), program)
+}
+
+// windowsFirewallMgr creates the Windows Firewall rules of the agent's
+// listeners, i.e. the WSFC health check agent's port, and removes them when
+// the listeners are disabled.
+type windowsFirewallMgr struct {
+	// fakeWindows forces Disabled to run as if it was running in a windows system.
+	// mostly target for unit tests.
+	fakeWindows bool
+}
+
+func (m *windowsFirewallMgr) Diff(ctx context.Context) (bool, error) {
+	if !firewallRulesChecked {
+		return true, nil
+	}
+	applied, err := readRegMultiString(regKeyBase, firewallRulesRegKey)
+	if err != nil && err != errRegNotExist {
+		return false, err
+	}
+	var want []string
+	for _, rule := range currentFirewallRules() {
+		want = append(want, rule.String())
+	}
+	return !slices.Equal(want, applied), nil
+}
+
+func (m *windowsFirewallMgr) Timeout(ctx context.Context) (bool, error) {
+	return false, nil
+}
+
+func (m *windowsFirewallMgr) Disabled(ctx context.Context) (bool, error) {
+	if !m.fakeWindows && runtime.GOOS != "windows" {
+		return true, nil
+	}
+	return !cfg.Get().WindowsFirewall.Enable, nil
+}
+
+func (m *windowsFirewallMgr) Set(ctx context.Context) error {
+	// Changing the firewall rules requires administrator privileges.
+	if skipDegraded("windowsFirewallMgr") {
+		return nil
+	}
+
+	applied, err := readRegMultiString(regKeyBase, firewallRulesRegKey)
+	if err != nil && err != errRegNotExist {
+		return err
+	}
+	out, err := runPowerShellOutput(ctx, firewallRuleListCommand())
+	if err != nil {
+		return fmt.Errorf("failed to list the firewall rules: %w", err)
+	}
+	existing := strings.Fields(out)
+
+	var specs, names []string
+	var failed bool
+	for _, rule := range currentFirewallRules() {
+		names = append(names, rule.Name)
+		if slices.Contains(existing, rule.Name) {
+			if slices.Contains(applied, rule.String()) {
+				specs = append(specs, rule.String())
+				continue
+			}
+			if err := runPowerShell(ctx, firewallRuleRemoveCommand(rule.Name)); err != nil {
+				logger.Errorf("Failed to remove firewall rule %s: %v", rule.Name, err)
+				failed = true
+				continue
+			}
+		}
+		logger.Infof("Creating firewall rule %s allowing %s port %s", rule.Name, rule.Protocol, rule.LocalPort)
+		if err := runPowerShell(ctx, rule.createCommand()); err != nil {
+			logger.Errorf("Failed to create firewall rule %s: %v", rule.Name, err)
+			failed = true
+			continue
+		}
+		specs = append(specs, rule.String())
+	}
+
+	for _, name := range existing {
+		if slices.Contains(names, name) {
+			continue
+		}
+		logger.Infof("Removing firewall rule %s", name)
+		if err := runPowerShell(ctx, firewallRuleRemoveCommand(name)); err != nil {
+			logger.Errorf("Failed to remove firewall rule %s: %v", name, err)
+			failed = true
+		}
+	}
+
+	// Failed rules are retried on the next update.
+	firewallRulesChecked = !failed
+	return writeRegMultiString(regKeyBase, firewallRulesRegKey, specs)
+}
@@ -0,0 +1,119 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWantFirewallRules(t *testing.T) {
+	program := `C:\Program Files\Google\Compute Engine\agent\GCEWindowsAgent.exe`
+	tests := []struct {
+		name   string
+		config *cfg.Sections
+		wsfc   *wsfcManager
+		want   []firewallRule
+	}{
+		{
+			name:   "wsfc_stopped",
+			config: &cfg.Sections{},
+			wsfc:   &wsfcManager{agentNewState: stopped, agentNewPort: wsfcDefaultAgentPort},
+		},
+		{
+			name:   "wsfc_running",
+			config: &cfg.Sections{},
+			wsfc:   &wsfcManager{agentNewState: running, agentNewPort: "1234"},
+			want: []firewallRule{{
+				Name:            wsfcFirewallRule,
+				DisplayName:     "Google Compute Engine WSFC health check",
+				Protocol:        "TCP",
+				LocalPort:       "1234",
+				RemoteAddresses: []string{"35.191.0.0/16", "130.211.0.0/22"},
+				Program:         program,
+			}},
+		},
+		{
+			name:   "wsfc_allowed_sources",
+			config: &cfg.Sections{WSFC: &cfg.WSFC{AllowedSources: "10.0.0.1, 10.128.0.0/9,"}},
+			wsfc:   &wsfcManager{agentNewState: running, agentNewPort: wsfcDefaultAgentPort},
+			want: []firewallRule{{
+				Name:            wsfcFirewallRule,
+				DisplayName:     "Google Compute Engine WSFC health check",
+				Protocol:        "TCP",
+				LocalPort:       wsfcDefaultAgentPort,
+				RemoteAddresses: []string{"10.0.0.1", "10.128.0.0/9"},
+				Program:         program,
+			}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := wantFirewallRules(tc.config, tc.wsfc, program)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("wantFirewallRules() returned unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFirewallRuleCommands(t *testing.T) {
+	rule := firewallRule{
+		Name:            wsfcFirewallRule,
+		DisplayName:     "Google Compute Engine WSFC health check",
+		Protocol:        "TCP",
+		LocalPort:       "59998",
+		RemoteAddresses: []string{"10.0.0.1", "10.128.0.0/9"},
+		Program:         `C:\agent's\GCEWindowsAgent.exe`,
+	}
+
+	want := `New-NetFirewallRule -Name 'GCEGuestAgent-WSFC' -DisplayName 'Google Compute Engine WSFC health check' -Group 'Google Compute Engine Agent' -Direction Inbound -Action Allow -Protocol TCP -LocalPort '59998' -RemoteAddress '10.0.0.1','10.128.0.0/9' -Program 'C:\agent''s\GCEWindowsAgent.exe' | Out-Null`
+	if got := rule.createCommand(); got != want {
+		t.Errorf("createCommand() = %q, want %q", got, want)
+	}
+
+	rule.RemoteAddresses, rule.Program = nil, ""
+	want = `New-NetFirewallRule -Name 'GCEGuestAgent-WSFC' -DisplayName 'Google Compute Engine WSFC health check' -Group 'Google Compute Engine Agent' -Direction Inbound -Action Allow -Protocol TCP -LocalPort '59998' -RemoteAddress Any | Out-Null`
+	if got := rule.createCommand(); got != want {
+		t.Errorf("createCommand() = %q, want %q", got, want)
+	}
+
+	if got, want := rule.String(), "GCEGuestAgent-WSFC|TCP|59998||"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestWindowsFirewallMgrDisabled(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+
+	mgr := &windowsFirewallMgr{fakeWindows: true}
+	disabled, err := mgr.Disabled(context.Background())
+	if err != nil || disabled {
+		t.Errorf("Disabled() = %t, %v, want false, nil by default", disabled, err)
+	}
+
+	cfg.Get().WindowsFirewall.Enable = false
+	t.Cleanup(func() { cfg.Get().WindowsFirewall.Enable = true })
+	disabled, err = mgr.Disabled(context.Background())
+	if err != nil || !disabled {
+		t.Errorf("Disabled() = %t, %v, want true, nil with enable = false", disabled, err)
+	}
+}
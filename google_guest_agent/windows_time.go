@@ -0,0 +1,258 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// windowsTimeJobID is the Windows Time service configuration job's ID.
+	windowsTimeJobID = "windows-time"
+	// windowsTimeAttribute is the guest attribute the sync state is published
+	// to.
+	windowsTimeAttribute = "guest-agent-time/status"
+	// ntpClientRegKey is the registry key of the Windows Time NTP client.
+	ntpClientRegKey = `HKLM\SYSTEM\CurrentControlSet\Services\W32Time\TimeProviders\NtpClient`
+	// ntpPeerFlags are the flags of the NTP peer: SpecialInterval (0x1) and
+	// Client (0x8), the peer is polled every SpecialPollInterval.
+	ntpPeerFlags = "0x9"
+	// defaultWindowsTimeCheckInterval is used if check_interval is not a
+	// valid duration.
+	defaultWindowsTimeCheckInterval = time.Hour
+)
+
+// defaultTimeServers are the NTP servers Windows and the GCE images sync with
+// by default, only their configuration is replaced.
+var defaultTimeServers = []string{"time.windows.com", "metadata.google.internal"}
+
+// stripchartOffsetExp matches the offset of a w32tm /stripchart sample, i.e.
+// "18:00:00, +00.0012345s".
+var stripchartOffsetExp = regexp.MustCompile(`, ([+-]?[0-9]+\.[0-9]+)s\s*$`)
+
+// windowsTimeStatus is the published Windows Time sync state.
+type windowsTimeStatus struct {
+	// Source is the time source the service last synced with.
+	Source string `json:"source"`
+	// Synced is whether the service is synchronized.
+	Synced bool `json:"synced"`
+	// LastSync is the time of the last successful sync, as printed by w32tm.
+	LastSync string `json:"lastSync"`
+	// OffsetSeconds is the local clock offset from the NTP server.
+	OffsetSeconds *float64 `json:"offsetSeconds,omitempty"`
+}
+
+// windowsTimeJob configures the Windows Time service to sync with the
+// metadata NTP server, and publishes its sync state and clock drift to the
+// guest attributes.
+type windowsTimeJob struct {
+	client metadata.MDSClientInterface
+}
+
+// newWindowsTimeJob returns the Windows Time service configuration job
+// publishing the sync state with client.
+func newWindowsTimeJob(client metadata.MDSClientInterface) *windowsTimeJob {
+	return &windowsTimeJob{client: client}
+}
+
+// ID returns the Windows Time service configuration job's ID.
+func (j *windowsTimeJob) ID() string {
+	return windowsTimeJobID
+}
+
+// Interval returns the configured check interval.
+func (j *windowsTimeJob) Interval() (time.Duration, bool) {
+	interval, err := time.ParseDuration(cfg.Get().WindowsTime.CheckInterval)
+	if err != nil || interval <= 0 {
+		logger.Errorf("WindowsTime check_interval configuration is not a valid duration string, falling back to %s", defaultWindowsTimeCheckInterval)
+		return defaultWindowsTimeCheckInterval, true
+	}
+	return interval, true
+}
+
+// ShouldEnable returns true on Windows if the Windows Time service is
+// managed.
+func (j *windowsTimeJob) ShouldEnable(ctx context.Context) bool {
+	return runtime.GOOS == "windows" && cfg.Get().WindowsTime.Enable
+}
+
+// Run configures the Windows Time service if its configuration differs, then
+// publishes its sync state.
+func (j *windowsTimeJob) Run(ctx context.Context) (bool, error) {
+	if pausedForMaintenance(j.ID()) {
+		return true, nil
+	}
+
+	config := cfg.Get().WindowsTime
+
+	if !checkWindowsServiceRunning(ctx, "w32time") {
+		logger.Infof("Starting the Windows Time service.")
+		if err := run.Quiet(ctx, "net", "start", "w32time"); err != nil {
+			return true, fmt.Errorf("failed to start the Windows Time service: %w", err)
+		}
+	}
+
+	res := run.WithOutput(ctx, "w32tm", "/query", "/configuration")
+	if res.ExitCode != 0 {
+		return true, fmt.Errorf("failed to query the Windows Time configuration: %s", res.Error())
+	}
+	current := parseW32tmOutput(res.StdOut)
+
+	switch {
+	case current["Type"] == "NT5DS":
+		// Domain members sync with the domain hierarchy.
+		logger.Debugf("Windows Time syncs with the domain hierarchy, not configuring it.")
+	case windowsTimeConfigured(current, config):
+		logger.Debugf("Windows Time is already configured.")
+	case !defaultTimeSource(current, config):
+		// The customer's own NTP servers are kept.
+		logger.Debugf("Windows Time syncs with %q, not configuring it.", current["NtpServer"])
+	default:
+		logger.Infof("Configuring Windows Time to sync with %s every %ds.", config.NTPServer, config.PollInterval)
+		if err := configureWindowsTime(ctx, config); err != nil {
+			return true, err
+		}
+	}
+
+	status := j.status(ctx, config.NTPServer)
+	if !status.Synced {
+		logger.Warningf("Windows Time is not synchronized (source %q).", status.Source)
+	}
+	data, err := json.Marshal(status)
+	if err != nil {
+		return true, fmt.Errorf("failed to marshal the Windows Time status: %w", err)
+	}
+	if err := j.client.WriteGuestAttributes(ctx, windowsTimeAttribute, string(data)); err != nil {
+		return true, fmt.Errorf("failed to publish the Windows Time status: %w", err)
+	}
+	return true, nil
+}
+
+// parseW32tmOutput parses the "Name: value (origin)" lines of w32tm /query
+// output, the first occurrence of a name is kept.
+func parseW32tmOutput(out string) map[string]string {
+	res := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		name, value, found := strings.Cut(strings.TrimSpace(line), ": ")
+		if !found {
+			continue
+		}
+		if _, ok := res[name]; ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if i := strings.LastIndex(value, " ("); i > 0 && strings.HasSuffix(value, ")") {
+			value = value[:i]
+		}
+		res[name] = value
+	}
+	return res
+}
+
+// windowsTimeConfigured returns whether the current Windows Time
+// configuration matches config.
+func windowsTimeConfigured(current map[string]string, config *cfg.WindowsTime) bool {
+	return current["Type"] == "NTP" &&
+		strings.EqualFold(current["NtpServer"], config.NTPServer+","+ntpPeerFlags) &&
+		current["SpecialPollInterval"] == strconv.Itoa(config.PollInterval)
+}
+
+// defaultTimeSource returns whether the Windows Time service syncs with the
+// Windows or GCE default NTP servers, or with config's server.
+func defaultTimeSource(current map[string]string, config *cfg.WindowsTime) bool {
+	if current["Type"] != "NTP" {
+		return false
+	}
+	for _, peer := range strings.Fields(current["NtpServer"]) {
+		host, _, _ := strings.Cut(peer, ",")
+		if !strings.EqualFold(host, config.NTPServer) && !slices.ContainsFunc(defaultTimeServers, func(server string) bool {
+			return strings.EqualFold(host, server)
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+// configureWindowsTime sets the NTP server and polling interval of the
+// Windows Time service and resyncs it.
+func configureWindowsTime(ctx context.Context, config *cfg.WindowsTime) error {
+	commands := [][]string{
+		{"w32tm", "/config", "/manualpeerlist:" + config.NTPServer + "," + ntpPeerFlags, "/syncfromflags:manual"},
+		{"reg", "add", ntpClientRegKey, "/v", "SpecialPollInterval", "/t", "REG_DWORD", "/d", strconv.Itoa(config.PollInterval), "/f"},
+		{"w32tm", "/config", "/update"},
+		{"w32tm", "/resync", "/nowait"},
+	}
+	for _, cmd := range commands {
+		if err := run.Quiet(ctx, cmd[0], cmd[1:]...); err != nil {
+			return fmt.Errorf("failed to run %s: %w", strings.Join(cmd, " "), err)
+		}
+	}
+	return nil
+}
+
+// parseStripchartOffset returns the clock offset of the last w32tm
+// /stripchart sample.
+func parseStripchartOffset(out string) (float64, error) {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	m := stripchartOffsetExp.FindStringSubmatch(lines[len(lines)-1])
+	if m == nil {
+		return 0, fmt.Errorf("no offset found in %q", lines[len(lines)-1])
+	}
+	return strconv.ParseFloat(m[1], 64)
+}
+
+// status returns the Windows Time sync state and the clock offset from
+// server.
+func (j *windowsTimeJob) status(ctx context.Context, server string) windowsTimeStatus {
+	var status windowsTimeStatus
+
+	res := run.WithOutput(ctx, "w32tm", "/query", "/status")
+	if res.ExitCode != 0 {
+		logger.Errorf("Failed to query the Windows Time status: %s", res.Error())
+	} else {
+		values := parseW32tmOutput(res.StdOut)
+		status.Source = values["Source"]
+		status.LastSync = values["Last Successful Sync Time"]
+		// Leap indicator 3 is an unsynchronized clock.
+		status.Synced = values["Leap Indicator"] != "" && !strings.HasPrefix(values["Leap Indicator"], "3")
+	}
+
+	res = run.WithOutput(ctx, "w32tm", "/stripchart", "/computer:"+server, "/samples:1", "/dataonly")
+	if res.ExitCode != 0 {
+		logger.Errorf("Failed to measure the clock offset from %s: %s", server, res.Error())
+		return status
+	}
+	offset, err := parseStripchartOffset(res.StdOut)
+	if err != nil {
+		logger.Errorf("Failed to measure the clock offset from %s: %v", server, err)
+		return status
+	}
+	status.OffsetSeconds = &offset
+	return status
+}
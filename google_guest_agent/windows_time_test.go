@@ -0,0 +1,110 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+)
+
+const w32tmConfiguration = `[Configuration]
+
+EventLogFlags: 2 (Local)
+AnnounceFlags: 10 (Local)
+
+[TimeProviders]
+
+NtpClient (Local)
+DllName: C:\Windows\system32\w32time.dll (Local)
+Enabled: 1 (Local)
+SpecialPollInterval: 1024 (Local)
+Type: NTP (Local)
+NtpServer: metadata.google.internal,0x9 (Local)
+
+NtpServer (Local)
+Enabled: 0 (Local)
+`
+
+func TestParseW32tmOutput(t *testing.T) {
+	got := parseW32tmOutput(w32tmConfiguration)
+	for name, want := range map[string]string{
+		"Type":                "NTP",
+		"NtpServer":           "metadata.google.internal,0x9",
+		"SpecialPollInterval": "1024",
+		"Enabled":             "1",
+		"DllName":             `C:\Windows\system32\w32time.dll`,
+	} {
+		if got[name] != want {
+			t.Errorf("parseW32tmOutput()[%s] = %q, want %q", name, got[name], want)
+		}
+	}
+
+	status := parseW32tmOutput("Leap Indicator: 3(not synchronized)\r\nSource: Local CMOS Clock\r\n")
+	if status["Leap Indicator"] != "3(not synchronized)" || status["Source"] != "Local CMOS Clock" {
+		t.Errorf("parseW32tmOutput() = %v, want the status values", status)
+	}
+}
+
+func TestWindowsTimeConfigured(t *testing.T) {
+	current := parseW32tmOutput(w32tmConfiguration)
+	config := &cfg.WindowsTime{NTPServer: "metadata.google.internal", PollInterval: 1024}
+	if !windowsTimeConfigured(current, config) {
+		t.Errorf("windowsTimeConfigured(%v, %+v) = false, want true", current, config)
+	}
+
+	config.PollInterval = 64
+	if windowsTimeConfigured(current, config) {
+		t.Errorf("windowsTimeConfigured(%v, %+v) = true with a different poll interval, want false", current, config)
+	}
+}
+
+func TestDefaultTimeSource(t *testing.T) {
+	config := &cfg.WindowsTime{NTPServer: "ntp.example.com", PollInterval: 1024}
+	tests := []struct {
+		typ       string
+		ntpServer string
+		want      bool
+	}{
+		{typ: "NTP", ntpServer: "time.windows.com,0x8", want: true},
+		{typ: "NTP", ntpServer: "metadata.google.internal,0x1", want: true},
+		{typ: "NTP", ntpServer: "ntp.example.com,0x9", want: true},
+		{typ: "NTP", ntpServer: "time.windows.com,0x8 ntp.corp.example.com,0x8"},
+		{typ: "NTP", ntpServer: "ntp.corp.example.com,0x8"},
+		{typ: "NoSync", ntpServer: "time.windows.com,0x8"},
+	}
+
+	for _, tc := range tests {
+		current := map[string]string{"Type": tc.typ, "NtpServer": tc.ntpServer}
+		if got := defaultTimeSource(current, config); got != tc.want {
+			t.Errorf("defaultTimeSource(%v, %+v) = %t, want %t", current, config, got, tc.want)
+		}
+	}
+}
+
+func TestParseStripchartOffset(t *testing.T) {
+	out := "Tracking metadata.google.internal [169.254.169.254:123].\r\nCollecting 1 samples.\r\n18:00:00, -00.0012500s\r\n"
+	got, err := parseStripchartOffset(out)
+	if err != nil {
+		t.Fatalf("parseStripchartOffset() failed: %v", err)
+	}
+	if got != -0.00125 {
+		t.Errorf("parseStripchartOffset() = %v, want -0.00125", got)
+	}
+
+	if _, err := parseStripchartOffset("18:00:00, error: 0x800705B4\r\n"); err == nil {
+		t.Errorf("parseStripchartOffset() succeeded on an error sample, want error")
+	}
+}
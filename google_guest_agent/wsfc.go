@@ -16,6 +16,9 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
 	"net"
 	"strings"
 	"sync"
@@ -74,6 +77,10 @@ func newWsfcManager() *wsfcManager {
 	}() {
 		newState = running
 	}
+	// The agent can't manage the cluster addresses in degraded mode.
+	if newState == running && skipDegraded("wsfcManager") {
+		newState = stopped
+	}
 
 	newPort := wsfcDefaultAgentPort
 	if config.WSFC != nil && config.WSFC.Port != "" {
@@ -144,6 +151,94 @@ type wsfcAgent struct {
 	port      string
 	waitGroup *sync.WaitGroup
 	listener  *net.TCPListener
+	security  *wsfcSecurity
+}
+
+// wsfcSecurity restricts who can query the health check agent.
+type wsfcSecurity struct {
+	// tlsConfig is the TLS configuration of the listener, nil if it serves
+	// plaintext.
+	tlsConfig *tls.Config
+	// allowedSources are the networks connections are accepted from, empty
+	// allows all sources.
+	allowedSources []*net.IPNet
+	// sharedSecret is the secret requests must be prefixed with, empty if
+	// not required.
+	sharedSecret string
+}
+
+// newWsfcSecurity returns the health check agent's security settings
+// configured in config.
+func newWsfcSecurity(config *cfg.WSFC) (*wsfcSecurity, error) {
+	res := &wsfcSecurity{}
+	if config == nil {
+		return res, nil
+	}
+
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load wsfc agent certificate: %w", err)
+		}
+		res.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+
+	for _, source := range strings.Split(config.AllowedSources, ",") {
+		source = strings.TrimSpace(source)
+		if source == "" {
+			continue
+		}
+		if !strings.Contains(source, "/") {
+			ip := net.ParseIP(source)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid wsfc allowed source %q", source)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			res.allowedSources = append(res.allowedSources, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid wsfc allowed source %q: %w", source, err)
+		}
+		res.allowedSources = append(res.allowedSources, ipNet)
+	}
+
+	res.sharedSecret = config.SharedSecret
+	return res, nil
+}
+
+// allowed returns true if connections from addr are accepted.
+func (s *wsfcSecurity) allowed(addr net.Addr) bool {
+	if s == nil || len(s.allowedSources) == 0 {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range s.allowedSources {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRequest returns the address queried by request, and false if the
+// request is not authenticated with the shared secret.
+func (s *wsfcSecurity) parseRequest(request string) (string, bool) {
+	if s == nil || s.sharedSecret == "" {
+		return strings.TrimSpace(request), true
+	}
+	fields := strings.Fields(request)
+	if len(fields) != 2 || subtle.ConstantTimeCompare([]byte(fields[0]), []byte(s.sharedSecret)) != 1 {
+		return "", false
+	}
+	return fields[1], true
 }
 
 // Start agent and taking tcp request
@@ -154,6 +249,11 @@ func (a *wsfcAgent) run() error {
 	}
 
 	logger.Infof("Starting wsfc agent...")
+	security, err := newWsfcSecurity(cfg.Get().WSFC)
+	if err != nil {
+		return err
+	}
+
 	listenerAddr, err := net.ResolveTCPAddr("tcp", ":"+a.port)
 	if err != nil {
 		return err
@@ -164,10 +264,16 @@ func (a *wsfcAgent) run() error {
 		return err
 	}
 
+	var acceptor net.Listener = listener
+	if security.tlsConfig != nil {
+		acceptor = tls.NewListener(listener, security.tlsConfig)
+	}
+	a.security = security
+
 	// goroutine for handling request
 	go func() {
 		for {
-			conn, err := listener.Accept()
+			conn, err := acceptor.Accept()
 			if err != nil {
 				// if err is not due to listener closed, return
 				if opErr, ok := err.(*net.OpError); ok && strings.Contains(opErr.Error(), "closed") {
@@ -178,6 +284,11 @@ func (a *wsfcAgent) run() error {
 				logger.Errorf("wsfc agent - error on accepting request: %s", err)
 				continue
 			}
+			if !security.allowed(conn.RemoteAddr()) {
+				logger.Warningf("wsfc agent - rejected connection from %s, not an allowed source", conn.RemoteAddr())
+				closer(conn)
+				continue
+			}
 			a.waitGroup.Add(1)
 			go a.handleHealthCheckRequest(conn)
 		}
@@ -205,7 +316,11 @@ func (a *wsfcAgent) handleHealthCheckRequest(conn net.Conn) {
 		return
 	}
 
-	wsfcIP := strings.TrimSpace(string(buf[:reqLen]))
+	wsfcIP, ok := a.security.parseRequest(string(buf[:reqLen]))
+	if !ok {
+		logger.Warningf("wsfc - rejected health check request from %s, invalid shared secret", conn.RemoteAddr())
+		return
+	}
 	reply, err := checkIPExist(wsfcIP)
 	if err != nil {
 		logger.Errorf("wsfc - error on checking local ip: %s", err)
@@ -17,12 +17,25 @@ package main
 import (
 	"bufio"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"math/big"
 	"net"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
 	"github.com/GoogleCloudPlatform/guest-agent/metadata"
 )
 
@@ -292,3 +305,144 @@ func TestGetWsfcAgentInstance(t *testing.T) {
 		t.Errorf("getWsfcAgentInstance is not returning same instance")
 	}
 }
+
+func TestNewWsfcSecurity(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  *cfg.WSFC
+		allowed map[string]bool
+		wantErr bool
+	}{
+		{name: "no_config", allowed: map[string]bool{"10.0.0.1": true}},
+		{name: "no_sources", config: &cfg.WSFC{}, allowed: map[string]bool{"10.0.0.1": true}},
+		{
+			name:    "sources",
+			config:  &cfg.WSFC{AllowedSources: "10.0.0.1, 192.168.0.0/16,fd00::1"},
+			allowed: map[string]bool{"10.0.0.1": true, "10.0.0.2": false, "192.168.10.1": true, "fd00::1": true, "fd00::2": false},
+		},
+		{name: "invalid_ip", config: &cfg.WSFC{AllowedSources: "10.0.0"}, wantErr: true},
+		{name: "invalid_cidr", config: &cfg.WSFC{AllowedSources: "10.0.0.0/33"}, wantErr: true},
+		{name: "missing_key", config: &cfg.WSFC{CertFile: "cert.pem"}, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			security, err := newWsfcSecurity(tc.config)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("newWsfcSecurity(%+v) = error %v, want error: %t", tc.config, err, tc.wantErr)
+			}
+			for ip, want := range tc.allowed {
+				if got := security.allowed(&net.TCPAddr{IP: net.ParseIP(ip)}); got != want {
+					t.Errorf("wsfcSecurity.allowed(%s) = %t, want %t", ip, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWsfcSecurityParseRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		secret   string
+		request  string
+		wantIP   string
+		wantAuth bool
+	}{
+		{name: "no_secret", request: "10.0.0.1\n", wantIP: "10.0.0.1", wantAuth: true},
+		{name: "valid_secret", secret: "secret", request: "secret 10.0.0.1\n", wantIP: "10.0.0.1", wantAuth: true},
+		{name: "invalid_secret", secret: "secret", request: "other 10.0.0.1"},
+		{name: "missing_secret", secret: "secret", request: "10.0.0.1"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			security := &wsfcSecurity{sharedSecret: tc.secret}
+			ip, ok := security.parseRequest(tc.request)
+			if ip != tc.wantIP || ok != tc.wantAuth {
+				t.Errorf("wsfcSecurity.parseRequest(%q) = (%q, %t), want (%q, %t)", tc.request, ip, ok, tc.wantIP, tc.wantAuth)
+			}
+		})
+	}
+}
+
+// writeTestCertificate writes a self-signed localhost certificate and its key
+// to dir, returning their paths and the certificate pool trusting it.
+func writeTestCertificate(t *testing.T, dir string) (string, string, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey() failed unexpectedly with error: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate() failed unexpectedly with error: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("x509.MarshalECPrivateKey() failed unexpectedly with error: %v", err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("os.WriteFile(%s) failed unexpectedly with error: %v", certFile, err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("os.WriteFile(%s) failed unexpectedly with error: %v", keyFile, err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate() failed unexpectedly with error: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestWsfcAgentTLSAndSecret(t *testing.T) {
+	certFile, keyFile, pool := writeTestCertificate(t, t.TempDir())
+	config := fmt.Sprintf("[wsfc]\ncert_file = %s\nkey_file = %s\nshared_secret = secret\nallowed_sources = 127.0.0.1\n", certFile, keyFile)
+	if err := cfg.Load([]byte(config)); err != nil {
+		t.Fatalf("cfg.Load() failed unexpectedly with error: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := cfg.Load(nil); err != nil {
+			t.Errorf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+		}
+	})
+
+	agent := &wsfcAgent{port: "59997", waitGroup: &sync.WaitGroup{}}
+	if err := agent.run(); err != nil {
+		t.Fatalf("wsfcAgent.run() failed unexpectedly with error: %v", err)
+	}
+	defer agent.stop()
+
+	query := func(request string) (string, error) {
+		conn, err := tls.Dial("tcp", "127.0.0.1:"+agent.getPort(), &tls.Config{RootCAs: pool, ServerName: "localhost"})
+		if err != nil {
+			return "", err
+		}
+		defer closer(conn)
+		fmt.Fprint(conn, request)
+		return bufio.NewReader(conn).ReadString('\n')
+	}
+
+	if got, _ := query("secret 255.255.255.256"); got != "0" {
+		t.Errorf("health check with the shared secret = %q, want %q", got, "0")
+	}
+	if got, _ := query("other 255.255.255.256"); got != "" {
+		t.Errorf("health check with an invalid shared secret = %q, want no reply", got)
+	}
+	if got, err := getHealthCheckResponce("secret 255.255.255.256", agent); err == nil && got != "" {
+		t.Errorf("plaintext health check = %q, want no reply", got)
+	}
+}
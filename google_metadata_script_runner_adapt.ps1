@@ -22,7 +22,7 @@
     known service binary.
 
    .EXAMPLE
-    .\google_metadata_script_runner_adapt.ps1 <startup|shutdown|specialize>
+    .\google_metadata_script_runner_adapt.ps1 <startup|shutdown|specialize|generalize>
 #>
 
 #requires -version 3.0
@@ -0,0 +1,43 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+// WindowsCertificate is a certificate installed in a Windows certificate
+// store, set with the windows-certificates attribute. Its PEM or PFX content
+// is read from an instance attribute or a Secret Manager secret version.
+type WindowsCertificate struct {
+	// Store is the local machine store the certificate is installed in, i.e.
+	// LocalMachine\My.
+	Store string `json:"store"`
+	// Attribute is the instance attribute holding the certificate.
+	Attribute string `json:"attribute"`
+	// Secret is the Secret Manager secret version holding the certificate,
+	// i.e. projects/<project>/secrets/<secret>/versions/latest.
+	Secret string `json:"secret"`
+	// PasswordSecret is the Secret Manager secret version holding the PFX
+	// password, if any.
+	PasswordSecret string `json:"passwordSecret"`
+	// Accounts are the accounts granted read access to the private key.
+	Accounts []string `json:"accounts"`
+}
+
+// WindowsCertificates is a slice of WindowsCertificate.
+type WindowsCertificates []WindowsCertificate
+
+// UnmarshalJSON unmarshals b into WindowsCertificates, the attribute's value
+// is a JSON list encoded as a string. An invalid value is logged and ignored.
+func (s *WindowsCertificates) UnmarshalJSON(b []byte) error {
+	return unmarshalJSONList(b, "windows-certificates", (*[]WindowsCertificate)(s))
+}
@@ -0,0 +1,36 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+// CustomRoute is a route programmed by the agent, set with the custom-routes
+// instance attribute.
+type CustomRoute struct {
+	// Destination is the route's destination in CIDR notation.
+	Destination string `json:"destination"`
+	// Via is the route's next hop, the route is on-link if empty.
+	Via string `json:"via"`
+	// NIC is the index of the route's network interface in the instance's
+	// NetworkInterfaces.
+	NIC int `json:"nic"`
+}
+
+// CustomRoutes is a slice of CustomRoute.
+type CustomRoutes []CustomRoute
+
+// UnmarshalJSON unmarshals b into CustomRoutes, the attribute's value is a
+// JSON list encoded as a string. An invalid value is logged and ignored.
+func (s *CustomRoutes) UnmarshalJSON(b []byte) error {
+	return unmarshalJSONList(b, "custom-routes", (*[]CustomRoute)(s))
+}
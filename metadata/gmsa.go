@@ -0,0 +1,34 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+// GMSAccount is a group Managed Service Account installed on Windows and run
+// as by services, set with the windows-gmsa attribute.
+type GMSAccount struct {
+	// Account is the gMSA name, optionally prefixed with its NetBIOS domain
+	// name, i.e. CORP\svc-web.
+	Account string `json:"account"`
+	// Services are the names of the services run as the gMSA.
+	Services []string `json:"services"`
+}
+
+// GMSAccounts is a slice of GMSAccount.
+type GMSAccounts []GMSAccount
+
+// UnmarshalJSON unmarshals b into GMSAccounts, the attribute's value is a
+// JSON list encoded as a string. An invalid value is logged and ignored.
+func (s *GMSAccounts) UnmarshalJSON(b []byte) error {
+	return unmarshalJSONList(b, "windows-gmsa", (*[]GMSAccount)(s))
+}
@@ -0,0 +1,35 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+// LogonScript is a PowerShell script run at user logon on Windows, set with
+// the windows-logon-scripts attribute.
+type LogonScript struct {
+	// Name identifies the script and its scheduled task.
+	Name string `json:"name"`
+	// User is the user whose logon runs the script, any user if empty.
+	User string `json:"user"`
+	// Script is the PowerShell script's content.
+	Script string `json:"script"`
+}
+
+// LogonScripts is a slice of LogonScript.
+type LogonScripts []LogonScript
+
+// UnmarshalJSON unmarshals b into LogonScripts, the attribute's value is a
+// JSON list encoded as a string. An invalid value is logged and ignored.
+func (s *LogonScripts) UnmarshalJSON(b []byte) error {
+	return unmarshalJSONList(b, "windows-logon-scripts", (*[]LogonScript)(s))
+}
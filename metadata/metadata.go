@@ -18,13 +18,17 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/GoogleCloudPlatform/guest-agent/retry"
@@ -35,6 +39,10 @@ const (
 	defaultMetadataURL = "http://169.254.169.254/computeMetadata/v1/"
 	defaultEtag        = "NONE"
 
+	// defaultIPv6Host is the metadata server's IPv6 address, the only one
+	// reachable from IPv6-only instances.
+	defaultIPv6Host = "[fd20:ce::254]"
+
 	// defaultHangtimeout is the timeout parameter passed to metadata as the hang timeout.
 	defaultHangTimeout = 60
 
@@ -74,14 +82,23 @@ type requestConfig struct {
 // the metadata layer.
 type Client struct {
 	metadataURL string
-	etag        string
-	httpClient  *http.Client
+	// etagMu protects etag, updated by the longpolls.
+	etagMu     sync.Mutex
+	etag       string
+	httpClient *http.Client
+	// ipv6Host is the host tried when the metadata server can't be dialed at
+	// metadataURL, empty if none.
+	ipv6Host string
+	// useIPv6Host is set once the metadata server was only reachable at
+	// ipv6Host, the following requests using it directly.
+	useIPv6Host atomic.Bool
 }
 
 // New allocates and configures a new Client instance.
 func New() *Client {
 	return &Client{
 		metadataURL: defaultMetadataURL,
+		ipv6Host:    defaultIPv6Host,
 		etag:        defaultEtag,
 		httpClient: &http.Client{
 			Timeout: defaultClientTimeout * time.Second,
@@ -164,6 +181,24 @@ type NetworkInterfaces struct {
 	Mac               string
 	DHCPv6Refresh     string
 	MTU               int
+	// IP is the interface's IPv4 address, empty for an IPv6-only interface.
+	IP string
+	// IPv6s are the interface's IPv6 addresses.
+	IPv6s []string
+	// Gateway is the interface's IPv4 gateway.
+	Gateway string
+	// Subnetmask is the interface's IPv4 subnet mask.
+	Subnetmask string
+	// DNSServers are the interface's DNS servers, IPv4 or IPv6 addresses.
+	DNSServers []string
+	// DNSSearchDomains are the interface's DNS search domains.
+	DNSSearchDomains []string
+}
+
+// IPv6Only returns true if the interface has IPv6 addresses and no IPv4
+// address.
+func (ni NetworkInterfaces) IPv6Only() bool {
+	return ni.IP == "" && len(ni.IPv6s) > 0
 }
 
 // VlanInterface describes the instances vlan network interfaces configurations.
@@ -225,6 +260,36 @@ type Attributes struct {
 	WSFCAddresses             string
 	WSFCAgentPort             string
 	DisableTelemetry          bool
+	StaticIPConfig            StaticIPConfigs
+	WindowsNICProperties      string
+	CustomRoutes              CustomRoutes
+	SSHTrustedCAKeys          []string
+	SSHAuthorizedPrincipals   []string
+	LogonScripts              LogonScripts
+	GMSAccounts               GMSAccounts
+	WindowsCertificates       WindowsCertificates
+}
+
+// unmarshalJSONList unmarshals b into list, the value of the attribute name
+// being a JSON list encoded as a string. An invalid list is logged and ignored.
+func unmarshalJSONList[T any](b []byte, name string, list *[]T) error {
+	var value string
+
+	if err := json.Unmarshal(b, &value); err != nil {
+		return err
+	}
+	if value == "" {
+		return nil
+	}
+
+	var items []T
+	if err := json.Unmarshal([]byte(value), &items); err != nil {
+		logger.Errorf("failed to unmarshal %s from metadata: %s", name, err)
+		return nil
+	}
+
+	*list = items
+	return nil
 }
 
 // UnmarshalJSON unmarshals b into Attribute.
@@ -236,26 +301,34 @@ func (a *Attributes) UnmarshalJSON(b []byte) error {
 	}
 	// Unmarshal to literal JSON types before doing anything else.
 	type inner struct {
-		CreatedBy                 string      `json:"created-by"`
-		BlockProjectKeys          string      `json:"block-project-ssh-keys"`
-		Diagnostics               string      `json:"diagnostics"`
-		DisableAccountManager     string      `json:"disable-account-manager"`
-		DisableAddressManager     string      `json:"disable-address-manager"`
-		EnableDiagnostics         string      `json:"enable-diagnostics"`
-		EnableOSLogin             string      `json:"enable-oslogin"`
-		EnableWindowsSSH          string      `json:"enable-windows-ssh"`
-		EnableWSFC                string      `json:"enable-wsfc"`
-		OldSSHKeys                string      `json:"sshKeys"`
-		SSHKeys                   string      `json:"ssh-keys"`
-		TwoFactor                 string      `json:"enable-oslogin-2fa"`
-		SecurityKey               string      `json:"enable-oslogin-sk"`
-		RequireCerts              string      `json:"enable-oslogin-certificates"`
-		WindowsKeys               WindowsKeys `json:"windows-keys"`
-		WSFCAddresses             string      `json:"wsfc-addrs"`
-		WSFCAgentPort             string      `json:"wsfc-agent-port"`
-		DisableTelemetry          string      `json:"disable-guest-telemetry"`
-		DisableHTTPSMdsSetup      string      `json:"disable-https-mds-setup"`
-		HTTPSMDSEnableNativeStore string      `json:"enable-https-mds-native-cert-store"`
+		CreatedBy                 string              `json:"created-by"`
+		BlockProjectKeys          string              `json:"block-project-ssh-keys"`
+		Diagnostics               string              `json:"diagnostics"`
+		DisableAccountManager     string              `json:"disable-account-manager"`
+		DisableAddressManager     string              `json:"disable-address-manager"`
+		EnableDiagnostics         string              `json:"enable-diagnostics"`
+		EnableOSLogin             string              `json:"enable-oslogin"`
+		EnableWindowsSSH          string              `json:"enable-windows-ssh"`
+		EnableWSFC                string              `json:"enable-wsfc"`
+		OldSSHKeys                string              `json:"sshKeys"`
+		SSHKeys                   string              `json:"ssh-keys"`
+		TwoFactor                 string              `json:"enable-oslogin-2fa"`
+		SecurityKey               string              `json:"enable-oslogin-sk"`
+		RequireCerts              string              `json:"enable-oslogin-certificates"`
+		WindowsKeys               WindowsKeys         `json:"windows-keys"`
+		WSFCAddresses             string              `json:"wsfc-addrs"`
+		WSFCAgentPort             string              `json:"wsfc-agent-port"`
+		DisableTelemetry          string              `json:"disable-guest-telemetry"`
+		DisableHTTPSMdsSetup      string              `json:"disable-https-mds-setup"`
+		HTTPSMDSEnableNativeStore string              `json:"enable-https-mds-native-cert-store"`
+		StaticIPConfig            StaticIPConfigs     `json:"static-ip-config"`
+		WindowsNICProperties      string              `json:"windows-nic-properties"`
+		CustomRoutes              CustomRoutes        `json:"custom-routes"`
+		SSHTrustedCAKeys          string              `json:"ssh-trusted-ca-keys"`
+		SSHAuthorizedPrincipals   string              `json:"ssh-authorized-principals"`
+		LogonScripts              LogonScripts        `json:"windows-logon-scripts"`
+		GMSAccounts               GMSAccounts         `json:"windows-gmsa"`
+		WindowsCertificates       WindowsCertificates `json:"windows-certificates"`
 	}
 	var temp inner
 	if err := json.Unmarshal(b, &temp); err != nil {
@@ -265,6 +338,12 @@ func (a *Attributes) UnmarshalJSON(b []byte) error {
 	a.WSFCAddresses = temp.WSFCAddresses
 	a.WSFCAgentPort = temp.WSFCAgentPort
 	a.WindowsKeys = temp.WindowsKeys
+	a.StaticIPConfig = temp.StaticIPConfig
+	a.WindowsNICProperties = temp.WindowsNICProperties
+	a.CustomRoutes = temp.CustomRoutes
+	a.LogonScripts = temp.LogonScripts
+	a.GMSAccounts = temp.GMSAccounts
+	a.WindowsCertificates = temp.WindowsCertificates
 	a.CreatedBy = temp.CreatedBy
 
 	value, err := strconv.ParseBool(temp.DisableHTTPSMdsSetup)
@@ -327,10 +406,25 @@ func (a *Attributes) UnmarshalJSON(b []byte) error {
 		a.BlockProjectKeys = true
 		a.SSHKeys = append(a.SSHKeys, strings.Split(temp.OldSSHKeys, "\n")...)
 	}
+	if temp.SSHTrustedCAKeys != "" {
+		a.SSHTrustedCAKeys = strings.Split(temp.SSHTrustedCAKeys, "\n")
+	}
+	if temp.SSHAuthorizedPrincipals != "" {
+		a.SSHAuthorizedPrincipals = strings.Split(temp.SSHAuthorizedPrincipals, "\n")
+	}
 	return nil
 }
 
+// ETag returns the etag of the metadata returned by the last longpoll.
+func (c *Client) ETag() string {
+	c.etagMu.Lock()
+	defer c.etagMu.Unlock()
+	return c.etag
+}
+
 func (c *Client) updateEtag(resp *http.Response) bool {
+	c.etagMu.Lock()
+	defer c.etagMu.Unlock()
 	oldEtag := c.etag
 	c.etag = resp.Header.Get("etag")
 	if c.etag == "" {
@@ -400,12 +494,17 @@ func (c *Client) retry(ctx context.Context, cfg requestConfig) (string, error) {
 	return retry.RunWithResponse(ctx, policy, fn)
 }
 
-// GetKey gets a specific metadata key.
+// GetKey gets a specific metadata key. The key may have a query string, i.e.
+// instance/service-accounts/default/identity?audience=aud.
 func (c *Client) GetKey(ctx context.Context, key string, headers map[string]string) (string, error) {
+	key, query, _ := strings.Cut(key, "?")
 	reqURL, err := url.JoinPath(c.metadataURL, key)
 	if err != nil {
 		return "", fmt.Errorf("failed to form metadata url: %+v", err)
 	}
+	if query != "" {
+		reqURL += "?" + query
+	}
 
 	cfg := requestConfig{
 		baseURL: reqURL,
@@ -508,6 +607,35 @@ func (c *Client) WriteGuestAttributes(ctx context.Context, key, value string) er
 	return retry.Run(ctx, policy, putCall)
 }
 
+// DeleteGuestAttributes does a delete call to mds removing a guest attribute.
+func (c *Client) DeleteGuestAttributes(ctx context.Context, key string) error {
+	logger.Debugf("delete guest attribute %q", key)
+
+	finalURL, err := url.JoinPath(c.metadataURL, "instance/guest-attributes/", key)
+	if err != nil {
+		return fmt.Errorf("failed to form metadata url: %+v", err)
+	}
+
+	logger.Debugf("Requesting(DELETE) MDS URL: %s", finalURL)
+
+	// This is a arbitrary retry number.
+	policy := retry.Policy{MaxAttempts: 10, Jitter: backoffDuration, BackoffFactor: 1}
+
+	deleteCall := func() error {
+		req, err := http.NewRequest("DELETE", finalURL, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Add("Metadata-Flavor", "Google")
+		req = req.WithContext(ctx)
+		_, err = c.httpClient.Do(req)
+
+		return err
+	}
+
+	return retry.Run(ctx, policy, deleteCall)
+}
+
 func (c *Client) do(ctx context.Context, cfg requestConfig) (*http.Response, error) {
 	finalURL, err := url.Parse(cfg.baseURL)
 	if err != nil {
@@ -518,7 +646,7 @@ func (c *Client) do(ctx context.Context, cfg requestConfig) (*http.Response, err
 
 	if cfg.hang {
 		values.Add("wait_for_change", "true")
-		values.Add("last_etag", c.etag)
+		values.Add("last_etag", c.ETag())
 	}
 
 	if cfg.timeout > 0 {
@@ -534,18 +662,21 @@ func (c *Client) do(ctx context.Context, cfg requestConfig) (*http.Response, err
 	}
 
 	finalURL.RawQuery = values.Encode()
-	logger.Debugf("Requesting(GET) MDS URL: %s", finalURL.String())
-
-	req, err := http.NewRequestWithContext(ctx, "GET", finalURL.String(), nil)
-	if err != nil {
-		return nil, err
+	if c.ipv6Host != "" && c.useIPv6Host.Load() {
+		finalURL.Host = c.ipv6Host
 	}
 
-	req.Header.Add("Metadata-Flavor", "Google")
-	for k, v := range cfg.headers {
-		req.Header.Add(k, v)
+	resp, err := c.send(ctx, finalURL.String(), cfg.headers)
+
+	// IPv6-only instances have no route to the metadata server's IPv4 address.
+	if err != nil && ctx.Err() == nil && c.ipv6Host != "" && finalURL.Host != c.ipv6Host && isDialError(err) {
+		finalURL.Host = c.ipv6Host
+		if ipv6Resp, ipv6Err := c.send(ctx, finalURL.String(), cfg.headers); ipv6Err == nil {
+			logger.Infof("Metadata server unreachable over IPv4, using its IPv6 address %s.", c.ipv6Host)
+			c.useIPv6Host.Store(true)
+			resp, err = ipv6Resp, nil
+		}
 	}
-	resp, err := c.httpClient.Do(req)
 
 	// If we are canceling httpClient will also wrap the context's error so
 	// check first the context.
@@ -574,3 +705,26 @@ func (c *Client) do(ctx context.Context, cfg requestConfig) (*http.Response, err
 
 	return resp, nil
 }
+
+// send sends a GET request for reqURL to the metadata server.
+func (c *Client) send(ctx context.Context, reqURL string, headers map[string]string) (*http.Response, error) {
+	logger.Debugf("Requesting(GET) MDS URL: %s", reqURL)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Add("Metadata-Flavor", "Google")
+	for k, v := range headers {
+		req.Header.Add(k, v)
+	}
+	return c.httpClient.Do(req)
+}
+
+// isDialError returns true if err is a failure to connect to the server, as
+// opposed to a failed request.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
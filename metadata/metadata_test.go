@@ -353,3 +353,242 @@ func TestVlanInterfaces(t *testing.T) {
 		t.Errorf("json.Unmarshal(%s, &md) returned unexpected diff (-want,+got):\n %s", cfg, diff)
 	}
 }
+
+func TestGetKeyQuery(t *testing.T) {
+	var gotReqURI string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotReqURI = r.RequestURI
+		fmt.Fprint(w, "token")
+	})
+	testsrv := httptest.NewServer(handler)
+	defer testsrv.Close()
+
+	client := New()
+	client.metadataURL = testsrv.URL
+
+	if _, err := client.GetKey(context.Background(), "instance/service-accounts/default/identity?audience=https%3A%2F%2Fexample.com&format=full", nil); err != nil {
+		t.Fatal(err)
+	}
+	wantURI := "/instance/service-accounts/default/identity?audience=https%3A%2F%2Fexample.com&format=full"
+	if gotReqURI != wantURI {
+		t.Errorf("did not get expected request uri, got :%q, want: %q", gotReqURI, wantURI)
+	}
+}
+
+func TestIPv6HostFallback(t *testing.T) {
+	var requests int
+	testsrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprint(w, "value")
+	}))
+	defer testsrv.Close()
+
+	srvURL, err := url.Parse(testsrv.URL)
+	if err != nil {
+		t.Fatalf("url.Parse(%q) failed: %v", testsrv.URL, err)
+	}
+
+	// Nothing listens on port 1, dialing it fails like an IPv4 metadata server
+	// address without route.
+	client := New()
+	client.metadataURL = "http://127.0.0.1:1/computeMetadata/v1/"
+	client.ipv6Host = srvURL.Host
+
+	for i := 0; i < 2; i++ {
+		got, err := client.GetKey(context.Background(), "instance/id", nil)
+		if err != nil {
+			t.Fatalf("GetKey() failed with the IPv6 host available: %v", err)
+		}
+		if got != "value" {
+			t.Errorf("GetKey() = %q, want %q", got, "value")
+		}
+	}
+	if !client.useIPv6Host.Load() {
+		t.Errorf("GetKey() didn't switch to the IPv6 host")
+	}
+	if requests != 2 {
+		t.Errorf("IPv6 host got %d requests, want 2", requests)
+	}
+}
+
+func TestNetworkInterfacesIPv6Only(t *testing.T) {
+	cfg := `{"instance": {"networkInterfaces": [
+		{"mac": "a", "ip": "10.128.0.2"},
+		{"mac": "b", "ip": "10.128.0.3", "ipv6s": ["2600:1900::1"], "dhcpv6Refresh": "1"},
+		{"mac": "c", "ipv6s": ["2600:1900::2"], "dhcpv6Refresh": "1"}
+	]}}`
+
+	var md *Descriptor
+	if err := json.Unmarshal([]byte(cfg), &md); err != nil {
+		t.Fatalf("json.Unmarshal(%s, &md) failed unexpectedly with error: %v", cfg, err)
+	}
+
+	want := []bool{false, false, true}
+	for i, ni := range md.Instance.NetworkInterfaces {
+		if got := ni.IPv6Only(); got != want[i] {
+			t.Errorf("NetworkInterfaces(%+v).IPv6Only() = %t, want %t", ni, got, want[i])
+		}
+	}
+}
+
+func TestNetworkInterfacesDNS(t *testing.T) {
+	cfg := `{"instance": {"networkInterfaces": [
+		{"mac": "a", "ip": "10.128.0.2"},
+		{"mac": "b", "ip": "10.129.0.2", "dnsServers": ["10.129.0.53", "2600:1900::53"], "dnsSearchDomains": ["corp.internal"]}
+	]}}`
+
+	var md *Descriptor
+	if err := json.Unmarshal([]byte(cfg), &md); err != nil {
+		t.Fatalf("json.Unmarshal(%s, &md) failed unexpectedly with error: %v", cfg, err)
+	}
+
+	nics := md.Instance.NetworkInterfaces
+	if len(nics[0].DNSServers) != 0 || len(nics[0].DNSSearchDomains) != 0 {
+		t.Errorf("NetworkInterfaces[0] = %+v, want no DNS configuration", nics[0])
+	}
+	if diff := cmp.Diff([]string{"10.129.0.53", "2600:1900::53"}, nics[1].DNSServers); diff != "" {
+		t.Errorf("NetworkInterfaces[1].DNSServers returned unexpected diff (-want,+got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"corp.internal"}, nics[1].DNSSearchDomains); diff != "" {
+		t.Errorf("NetworkInterfaces[1].DNSSearchDomains returned unexpected diff (-want,+got):\n%s", diff)
+	}
+}
+
+func TestStaticIPConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  StaticIPConfigs
+	}{
+		{
+			name:  "unset",
+			value: `""`,
+		},
+		{
+			name:  "invalid",
+			value: `"[{\"nic\": \"one\"}]"`,
+		},
+		{
+			name:  "valid",
+			value: `"[{\"nic\": 1, \"address\": \"192.168.1.10/24\", \"gateway\": \"192.168.1.1\", \"routes\": [{\"destination\": \"10.8.0.0/16\", \"gateway\": \"192.168.1.254\"}]}]"`,
+			want: StaticIPConfigs{
+				{
+					NIC:     1,
+					Address: "192.168.1.10/24",
+					Gateway: "192.168.1.1",
+					Routes:  []StaticRoute{{Destination: "10.8.0.0/16", Gateway: "192.168.1.254"}},
+				},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			attrs := fmt.Sprintf(`{"static-ip-config": %s}`, tc.value)
+
+			var got Attributes
+			if err := json.Unmarshal([]byte(attrs), &got); err != nil {
+				t.Fatalf("json.Unmarshal(%s) failed unexpectedly with error: %v", attrs, err)
+			}
+			if diff := cmp.Diff(tc.want, got.StaticIPConfig); diff != "" {
+				t.Errorf("json.Unmarshal(%s) returned unexpected static IP config diff (-want,+got):\n%s", attrs, diff)
+			}
+		})
+	}
+}
+
+func TestCustomRoutes(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  CustomRoutes
+	}{
+		{
+			name:  "unset",
+			value: `""`,
+		},
+		{
+			name:  "invalid",
+			value: `"[{\"nic\": \"one\"}]"`,
+		},
+		{
+			name:  "valid",
+			value: `"[{\"destination\": \"10.8.0.0/16\", \"via\": \"192.168.1.254\", \"nic\": 1}, {\"destination\": \"172.16.0.0/12\"}]"`,
+			want: CustomRoutes{
+				{Destination: "10.8.0.0/16", Via: "192.168.1.254", NIC: 1},
+				{Destination: "172.16.0.0/12"},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			attrs := fmt.Sprintf(`{"custom-routes": %s}`, tc.value)
+
+			var got Attributes
+			if err := json.Unmarshal([]byte(attrs), &got); err != nil {
+				t.Fatalf("json.Unmarshal(%s) failed unexpectedly with error: %v", attrs, err)
+			}
+			if diff := cmp.Diff(tc.want, got.CustomRoutes); diff != "" {
+				t.Errorf("json.Unmarshal(%s) returned unexpected custom routes diff (-want,+got):\n%s", attrs, diff)
+			}
+		})
+	}
+}
+
+func TestLogonScripts(t *testing.T) {
+	attrs := `{"windows-logon-scripts": "[{\"name\": \"drives\", \"user\": \"alice\", \"script\": \"Get-Date\"}, {\"name\": \"all\", \"script\": \"Get-Host\"}]"}`
+	want := LogonScripts{{Name: "drives", User: "alice", Script: "Get-Date"}, {Name: "all", Script: "Get-Host"}}
+
+	var got Attributes
+	if err := json.Unmarshal([]byte(attrs), &got); err != nil {
+		t.Fatalf("json.Unmarshal(%s) failed unexpectedly with error: %v", attrs, err)
+	}
+	if diff := cmp.Diff(want, got.LogonScripts); diff != "" {
+		t.Errorf("json.Unmarshal(%s) returned unexpected logon scripts diff (-want,+got):\n%s", attrs, diff)
+	}
+}
+
+func TestGMSAccounts(t *testing.T) {
+	attrs := `{"windows-gmsa": "[{\"account\": \"CORP\\\\svc-web\", \"services\": [\"W3SVC\", \"WAS\"]}]"}`
+	want := GMSAccounts{{Account: `CORP\svc-web`, Services: []string{"W3SVC", "WAS"}}}
+
+	var got Attributes
+	if err := json.Unmarshal([]byte(attrs), &got); err != nil {
+		t.Fatalf("json.Unmarshal(%s) failed unexpectedly with error: %v", attrs, err)
+	}
+	if diff := cmp.Diff(want, got.GMSAccounts); diff != "" {
+		t.Errorf("json.Unmarshal(%s) returned unexpected gMSA diff (-want,+got):\n%s", attrs, diff)
+	}
+}
+
+func TestWindowsCertificates(t *testing.T) {
+	attrs := `{"windows-certificates": "[{\"store\": \"LocalMachine\\\\My\", \"secret\": \"projects/p/secrets/web/versions/latest\", \"accounts\": [\"IIS_IUSRS\"]}, {\"attribute\": \"corp-root-ca\"}]"}`
+	want := WindowsCertificates{
+		{Store: `LocalMachine\My`, Secret: "projects/p/secrets/web/versions/latest", Accounts: []string{"IIS_IUSRS"}},
+		{Attribute: "corp-root-ca"},
+	}
+
+	var got Attributes
+	if err := json.Unmarshal([]byte(attrs), &got); err != nil {
+		t.Fatalf("json.Unmarshal(%s) failed unexpectedly with error: %v", attrs, err)
+	}
+	if diff := cmp.Diff(want, got.WindowsCertificates); diff != "" {
+		t.Errorf("json.Unmarshal(%s) returned unexpected certificates diff (-want,+got):\n%s", attrs, diff)
+	}
+}
+
+func TestSSHTrustedCAAttributes(t *testing.T) {
+	attrs := `{"ssh-trusted-ca-keys": "ssh-ed25519 AAAA ca1\nssh-rsa BBBB ca2", "ssh-authorized-principals": "alice:admins,alice@example.com"}`
+
+	var got Attributes
+	if err := json.Unmarshal([]byte(attrs), &got); err != nil {
+		t.Fatalf("json.Unmarshal(%s) failed unexpectedly with error: %v", attrs, err)
+	}
+	if diff := cmp.Diff([]string{"ssh-ed25519 AAAA ca1", "ssh-rsa BBBB ca2"}, got.SSHTrustedCAKeys); diff != "" {
+		t.Errorf("json.Unmarshal(%s) returned unexpected trusted CA keys diff (-want,+got):\n%s", attrs, diff)
+	}
+	if diff := cmp.Diff([]string{"alice:admins,alice@example.com"}, got.SSHAuthorizedPrincipals); diff != "" {
+		t.Errorf("json.Unmarshal(%s) returned unexpected principals diff (-want,+got):\n%s", attrs, diff)
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+// StaticIPConfig describes the static addressing of a network interface, set
+// with the static-ip-config instance attribute.
+type StaticIPConfig struct {
+	// NIC is the index of the network interface in the instance's
+	// NetworkInterfaces.
+	NIC int `json:"nic"`
+	// Address is the interface's IPv4 address in CIDR notation.
+	Address string `json:"address"`
+	// Gateway is the default gateway, only used for the primary interface.
+	Gateway string `json:"gateway"`
+	// Routes are the additional routes through the interface.
+	Routes []StaticRoute `json:"routes"`
+}
+
+// StaticRoute is a route of a StaticIPConfig.
+type StaticRoute struct {
+	// Destination is the route's destination in CIDR notation.
+	Destination string `json:"destination"`
+	// Gateway is the route's next hop, the route is on-link if empty.
+	Gateway string `json:"gateway"`
+}
+
+// StaticIPConfigs is a slice of StaticIPConfig.
+type StaticIPConfigs []StaticIPConfig
+
+// UnmarshalJSON unmarshals b into StaticIPConfigs, the attribute's value is a
+// JSON list encoded as a string. An invalid value is logged and ignored.
+func (s *StaticIPConfigs) UnmarshalJSON(b []byte) error {
+	return unmarshalJSONList(b, "static-ip-config", (*[]StaticIPConfig)(s))
+}
@@ -30,6 +30,7 @@ type WindowsKey struct {
 	Modulus             string
 	UserName            string
 	HashFunction        string
+	Algorithm           string
 	AddToAdministrators *bool
 	PasswordLength      int
 }
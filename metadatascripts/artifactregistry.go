@@ -0,0 +1,44 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+)
+
+// artifactRegistryHost is the Artifact Registry API host, the files of which
+// are always downloaded with the service account's access token.
+const artifactRegistryHost = "artifactregistry.googleapis.com"
+
+var (
+	// arRegex matches the Artifact Registry generic repository script URLs:
+	// ar://<location>/<project>/<repository>/<package>/<version>/<file>
+	arRegex = regexp.MustCompile(`^ar://([a-z0-9-]+)/([^/]+)/([^/]+)/([^/]+)/([^/]+)/([^/]+)$`)
+)
+
+// artifactRegistryURL returns the download URL of an Artifact Registry script
+// URL, empty if path is not one.
+func artifactRegistryURL(path string) string {
+	match := arRegex.FindStringSubmatch(path)
+	if len(match) != 7 {
+		return ""
+	}
+	location, project, repository := match[1], match[2], match[3]
+	file := url.PathEscape(fmt.Sprintf("%s:%s:%s", match[4], match[5], match[6]))
+	return fmt.Sprintf("https://%s/download/v1/projects/%s/locations/%s/repositories/%s/files/%s:download?alt=media",
+		artifactRegistryHost, url.PathEscape(project), location, url.PathEscape(repository), file)
+}
@@ -0,0 +1,45 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import "testing"
+
+func TestArtifactRegistryURL(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{
+			path: "ar://us-central1/my-project/scripts/setup/1.0.0/setup.sh",
+			want: "https://artifactregistry.googleapis.com/download/v1/projects/my-project/locations/us-central1/repositories/scripts/files/setup:1.0.0:setup.sh:download?alt=media",
+		},
+		{
+			path: "ar://europe-west1/example.com:my-project/scripts/setup/v2/setup script.ps1",
+			want: "https://artifactregistry.googleapis.com/download/v1/projects/example.com:my-project/locations/europe-west1/repositories/scripts/files/setup:v2:setup%20script.ps1:download?alt=media",
+		},
+		{
+			path: "ar://us-central1/my-project/scripts/setup/setup.sh",
+		},
+		{
+			path: "gs://bucket/setup.sh",
+		},
+	}
+
+	for _, tc := range tests {
+		if got := artifactRegistryURL(tc.path); got != tc.want {
+			t.Errorf("artifactRegistryURL(%q) = %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
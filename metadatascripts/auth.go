@@ -0,0 +1,109 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+)
+
+const (
+	// accessTokenKey is the metadata key of the default service account's
+	// OAuth access token.
+	accessTokenKey = "/instance/service-accounts/default/token"
+	// identityTokenKey is the metadata key of the default service account's
+	// identity token, the audience being passed as query parameter.
+	identityTokenKey = "/instance/service-accounts/default/identity"
+)
+
+// accessToken is the metadata server's access token response.
+type accessToken struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+}
+
+// authHostMatches returns true if host is one of the comma separated hosts, a
+// *.example.com entry matching the example.com subdomains.
+func authHostMatches(host string, hosts string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range strings.Split(hosts, ",") {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "" {
+			continue
+		}
+		if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+			if strings.HasSuffix(host, suffix) && host != strings.TrimPrefix(suffix, ".") {
+				return true
+			}
+			continue
+		}
+		if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// urlAuthorization returns the Authorization header value to download the
+// script at rawURL with, empty if the URL is not authenticated. Only HTTPS
+// URLs on the configured hosts get the service account's token: an identity
+// token if an audience is configured, an OAuth access token otherwise.
+// Artifact Registry URLs always get an access token.
+func urlAuthorization(ctx context.Context, rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "https" {
+		return "", nil
+	}
+	if u.Hostname() == artifactRegistryHost {
+		return accessTokenAuthorization(ctx)
+	}
+
+	config := cfg.Get().MetadataScripts
+	if config.URLAuthHosts == "" || !authHostMatches(u.Hostname(), config.URLAuthHosts) {
+		return "", nil
+	}
+
+	if audience := strings.TrimSpace(config.URLAuthAudience); audience != "" {
+		query := url.Values{"audience": {audience}, "format": {"full"}}
+		token, err := getMetadataKey(ctx, identityTokenKey+"?"+query.Encode())
+		if err != nil {
+			return "", fmt.Errorf("failed to get identity token: %v", err)
+		}
+		return "Bearer " + strings.TrimSpace(token), nil
+	}
+	return accessTokenAuthorization(ctx)
+}
+
+// accessTokenAuthorization returns the Authorization header value with the
+// service account's OAuth access token.
+func accessTokenAuthorization(ctx context.Context) (string, error) {
+	resp, err := getMetadataKey(ctx, accessTokenKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to get access token: %v", err)
+	}
+	var token accessToken
+	if err := json.Unmarshal([]byte(resp), &token); err != nil {
+		return "", fmt.Errorf("failed to parse access token: %v", err)
+	}
+	if token.TokenType == "" {
+		token.TokenType = "Bearer"
+	}
+	return token.TokenType + " " + token.AccessToken, nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"context"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+)
+
+func TestAuthHostMatches(t *testing.T) {
+	hosts := "artifacts.example.com, *.internal.example.com"
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{host: "artifacts.example.com", want: true},
+		{host: "ARTIFACTS.example.com", want: true},
+		{host: "scripts.internal.example.com", want: true},
+		{host: "internal.example.com", want: false},
+		{host: "evilinternal.example.com", want: false},
+		{host: "example.com", want: false},
+		{host: "artifacts.example.com.evil.com", want: false},
+	}
+
+	for _, tc := range tests {
+		if got := authHostMatches(tc.host, hosts); got != tc.want {
+			t.Errorf("authHostMatches(%q, %q) = %t, want %t", tc.host, hosts, got, tc.want)
+		}
+	}
+}
+
+func TestURLAuthorization(t *testing.T) {
+	originalClient := client
+	t.Cleanup(func() { client = originalClient })
+	client = &keysMDSClient{keys: map[string]string{
+		accessTokenKey: `{"access_token":"access","expires_in":3599,"token_type":"Bearer"}`,
+		identityTokenKey + "?audience=https%3A%2F%2Fartifacts.example.com&format=full": "identity\n",
+	}}
+
+	tests := []struct {
+		name   string
+		config string
+		url    string
+		want   string
+	}{
+		{
+			name: "disabled",
+			url:  "https://artifacts.example.com/script.sh",
+		},
+		{
+			name:   "access_token",
+			config: "url_auth_hosts = artifacts.example.com",
+			url:    "https://artifacts.example.com/script.sh",
+			want:   "Bearer access",
+		},
+		{
+			name:   "identity_token",
+			config: "url_auth_hosts = artifacts.example.com\nurl_auth_audience = https://artifacts.example.com",
+			url:    "https://artifacts.example.com/script.sh",
+			want:   "Bearer identity",
+		},
+		{
+			name:   "other_host",
+			config: "url_auth_hosts = artifacts.example.com",
+			url:    "https://other.example.com/script.sh",
+		},
+		{
+			name: "artifact_registry",
+			url:  artifactRegistryURL("ar://us-central1/my-project/scripts/setup/1.0.0/setup.sh"),
+			want: "Bearer access",
+		},
+		{
+			name:   "plain_http",
+			config: "url_auth_hosts = artifacts.example.com",
+			url:    "http://artifacts.example.com/script.sh",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := cfg.Load([]byte("[MetadataScripts]\n" + tc.config)); err != nil {
+				t.Fatalf("cfg.Load() failed: %v", err)
+			}
+			defer cfg.Load(nil)
+
+			got, err := urlAuthorization(context.Background(), tc.url)
+			if err != nil {
+				t.Fatalf("urlAuthorization(%q) failed: %v", tc.url, err)
+			}
+			if got != tc.want {
+				t.Errorf("urlAuthorization(%q) = %q, want %q", tc.url, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// authenticodeValid is the status of a valid Authenticode signature made
+	// with a certificate trusted by Windows.
+	authenticodeValid = "Valid"
+	// authenticodeScript gets the Authenticode signature of the file at the
+	// GCE_SCRIPT_PATH environment variable, the path not being quoted in the
+	// command.
+	authenticodeScript = `$s = Get-AuthenticodeSignature -LiteralPath $env:GCE_SCRIPT_PATH; ` +
+		`[pscustomobject]@{Status = $s.Status.ToString(); StatusMessage = $s.StatusMessage; ` +
+		`Subject = $s.SignerCertificate.Subject; Thumbprint = $s.SignerCertificate.Thumbprint} | ConvertTo-Json -Compress`
+)
+
+// authenticodeSignature is the Authenticode signature of a script.
+type authenticodeSignature struct {
+	// Status is the signature's status, i.e. Valid or NotSigned.
+	Status string
+	// StatusMessage describes the status.
+	StatusMessage string
+	// Subject is the signer certificate's subject.
+	Subject string
+	// Thumbprint is the signer certificate's SHA1 thumbprint.
+	Thumbprint string
+}
+
+var (
+	// getAuthenticodeSignature returns the Authenticode signature of the
+	// script at filePath. Replaceable by unit tests.
+	getAuthenticodeSignature = func(ctx context.Context, filePath string) (*authenticodeSignature, error) {
+		cmd := exec.CommandContext(ctx, "powershell.exe", "-NoProfile", "-NoLogo", "-NonInteractive", "-Command", authenticodeScript)
+		cmd.Env = append(os.Environ(), "GCE_SCRIPT_PATH="+filePath)
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to run Get-AuthenticodeSignature: %v", err)
+		}
+		var sig authenticodeSignature
+		if err := json.Unmarshal(out, &sig); err != nil {
+			return nil, fmt.Errorf("failed to parse Get-AuthenticodeSignature output: %v", err)
+		}
+		return &sig, nil
+	}
+)
+
+// commonName returns the CN attribute of a certificate subject, empty if none.
+func commonName(subject string) string {
+	for _, attr := range strings.Split(subject, ",") {
+		if name, value, ok := strings.Cut(strings.TrimSpace(attr), "="); ok && strings.EqualFold(name, "CN") {
+			return strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+	return ""
+}
+
+// publisherAllowed returns true if the signer is one of the comma separated
+// publishers, identified by certificate thumbprint or common name. Any signer
+// is allowed if publishers is empty.
+func publisherAllowed(sig *authenticodeSignature, publishers string) bool {
+	if strings.TrimSpace(publishers) == "" {
+		return true
+	}
+	thumbprint := strings.ReplaceAll(sig.Thumbprint, " ", "")
+	cn := commonName(sig.Subject)
+	for _, publisher := range strings.Split(publishers, ",") {
+		publisher = strings.TrimSpace(publisher)
+		if publisher == "" {
+			continue
+		}
+		if strings.EqualFold(strings.ReplaceAll(publisher, " ", ""), thumbprint) || (cn != "" && strings.EqualFold(publisher, cn)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAuthenticode checks the PowerShell script at filePath has a valid
+// Authenticode signature made by one of the allowed publishers. Rejections
+// are logged for auditing.
+func checkAuthenticode(ctx context.Context, metadataKey string, filePath string) error {
+	sig, err := getAuthenticodeSignature(ctx, filePath)
+	if err != nil {
+		logger.Warningf("Authenticode policy rejected %s: unable to check its signature: %v", metadataKey, err)
+		return fmt.Errorf("unable to check Authenticode signature: %v", err)
+	}
+
+	if sig.Status != authenticodeValid {
+		logger.Warningf("Authenticode policy rejected %s: signature status %s (%s).", metadataKey, sig.Status, sig.StatusMessage)
+		return fmt.Errorf("authenticode signature is not valid: %s", sig.Status)
+	}
+	if !publisherAllowed(sig, cfg.Get().MetadataScripts.AuthenticodePublishers) {
+		logger.Warningf("Authenticode policy rejected %s: signer %q (thumbprint %s) is not an allowed publisher.", metadataKey, sig.Subject, sig.Thumbprint)
+		return fmt.Errorf("authenticode signer %q is not an allowed publisher", sig.Subject)
+	}
+
+	logger.Infof("%s is Authenticode signed by %q (thumbprint %s).", metadataKey, sig.Subject, sig.Thumbprint)
+	return nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+)
+
+func TestCommonName(t *testing.T) {
+	tests := map[string]string{
+		"CN=Example Corp, O=Example Corp, L=Mountain View, C=US": "Example Corp",
+		`O=Example, CN="Example Signing"`:                        "Example Signing",
+		"O=Example":                                              "",
+		"":                                                       "",
+	}
+	for subject, want := range tests {
+		if got := commonName(subject); got != want {
+			t.Errorf("commonName(%q) = %q, want %q", subject, got, want)
+		}
+	}
+}
+
+func TestPublisherAllowed(t *testing.T) {
+	sig := &authenticodeSignature{
+		Status:     authenticodeValid,
+		Subject:    "CN=Example Corp, O=Example Corp, C=US",
+		Thumbprint: "0123456789ABCDEF0123456789ABCDEF01234567",
+	}
+
+	tests := []struct {
+		publishers string
+		want       bool
+	}{
+		{publishers: "", want: true},
+		{publishers: "example corp", want: true},
+		{publishers: "Other Corp, 0123456789abcdef0123456789abcdef01234567", want: true},
+		{publishers: "01 23 45 67 89 AB CD EF 01 23 45 67 89 AB CD EF 01 23 45 67", want: true},
+		{publishers: "Other Corp, FFFF", want: false},
+		{publishers: "Example", want: false},
+	}
+
+	for _, tc := range tests {
+		if got := publisherAllowed(sig, tc.publishers); got != tc.want {
+			t.Errorf("publisherAllowed(%q) = %t, want %t", tc.publishers, got, tc.want)
+		}
+	}
+}
+
+func TestCheckAuthenticode(t *testing.T) {
+	if err := cfg.Load([]byte("[MetadataScripts]\nrequire_authenticode = true\nauthenticode_publishers = Example Corp")); err != nil {
+		t.Fatalf("cfg.Load() failed: %v", err)
+	}
+	defer cfg.Load(nil)
+
+	orig := getAuthenticodeSignature
+	t.Cleanup(func() { getAuthenticodeSignature = orig })
+
+	tests := []struct {
+		name    string
+		sig     *authenticodeSignature
+		err     error
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			sig:  &authenticodeSignature{Status: authenticodeValid, Subject: "CN=Example Corp", Thumbprint: "AB"},
+		},
+		{
+			name:    "not_signed",
+			sig:     &authenticodeSignature{Status: "NotSigned", StatusMessage: "The file is not digitally signed."},
+			wantErr: true,
+		},
+		{
+			name:    "hash_mismatch",
+			sig:     &authenticodeSignature{Status: "HashMismatch", Subject: "CN=Example Corp", Thumbprint: "AB"},
+			wantErr: true,
+		},
+		{
+			name:    "other_publisher",
+			sig:     &authenticodeSignature{Status: authenticodeValid, Subject: "CN=Other Corp", Thumbprint: "CD"},
+			wantErr: true,
+		},
+		{
+			name:    "check_error",
+			err:     errors.New("powershell failed"),
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			getAuthenticodeSignature = func(context.Context, string) (*authenticodeSignature, error) {
+				return tc.sig, tc.err
+			}
+			if err := checkAuthenticode(context.Background(), "windows-startup-script-ps1", "script.ps1"); (err != nil) != tc.wantErr {
+				t.Errorf("checkAuthenticode() = %v, want error: %t", err, tc.wantErr)
+			}
+		})
+	}
+}
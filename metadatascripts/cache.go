@@ -0,0 +1,141 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+// scriptCache is the local cache of the downloaded scripts. There's a single
+// entry per URL, holding the content and the version (GCS generation or HTTP
+// ETag) it was downloaded at.
+type scriptCache struct {
+	dir string
+}
+
+// newScriptCache returns the configured script cache, nil if disabled.
+func newScriptCache() *scriptCache {
+	config := cfg.Get().MetadataScripts
+	if !config.DownloadCache {
+		return nil
+	}
+	if config.DownloadCacheDir != "" {
+		return &scriptCache{dir: config.DownloadCacheDir}
+	}
+	if runtime.GOOS == "windows" {
+		return &scriptCache{dir: filepath.Join(os.Getenv("ProgramData"), "Google", "Compute Engine", "metadata-scripts-cache")}
+	}
+	return &scriptCache{dir: "/var/cache/google-metadata-scripts"}
+}
+
+// entryPath returns the path of a URL's cached content, its version is stored
+// along with it with the .version extension.
+func (c *scriptCache) entryPath(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
+
+// version returns the cached version of url, empty if url is not cached.
+func (c *scriptCache) version(url string) string {
+	data, err := os.ReadFile(c.entryPath(url) + ".version")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// copyTo copies the cached content of url to file.
+func (c *scriptCache) copyTo(url string, file *os.File) error {
+	src, err := os.Open(c.entryPath(url))
+	if err != nil {
+		return fmt.Errorf("failed to open cache entry: %v", err)
+	}
+	defer src.Close()
+
+	if _, err := io.Copy(file, src); err != nil {
+		return fmt.Errorf("failed to copy cache entry: %v", err)
+	}
+	return nil
+}
+
+// store caches the content of file as the given version of url. The file's
+// offset is left at its end.
+func (c *scriptCache) store(url string, version string, file *os.File) error {
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return fmt.Errorf("failed to create cache directory: %v", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind script file: %v", err)
+	}
+	defer file.Seek(0, io.SeekEnd)
+
+	// The content is written to a temporary file and renamed, an interrupted
+	// write must never leave a truncated script behind.
+	fpath := c.entryPath(url)
+	tmp, err := os.CreateTemp(c.dir, "entry")
+	if err != nil {
+		return fmt.Errorf("failed to create cache entry: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, file); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write cache entry: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close cache entry: %v", err)
+	}
+
+	// Remove the version first, a content without version is never used.
+	c.invalidate(url)
+	if err := os.Rename(tmp.Name(), fpath); err != nil {
+		return fmt.Errorf("failed to write cache entry: %v", err)
+	}
+	if err := os.WriteFile(fpath+".version", []byte(version), 0600); err != nil {
+		return fmt.Errorf("failed to write cache entry version: %v", err)
+	}
+	return nil
+}
+
+// invalidate removes the cached version of url, its content is not used anymore.
+func (c *scriptCache) invalidate(url string) {
+	os.Remove(c.entryPath(url) + ".version")
+}
+
+// useCachedScript copies the cached content of url to file, on failure file is
+// emptied so the script can be downloaded to it.
+func useCachedScript(cache *scriptCache, url string, file *os.File) error {
+	err := cache.copyTo(url, file)
+	if err == nil {
+		return nil
+	}
+
+	logger.Warningf("Failed to use cached %q: %v", url, err)
+	cache.invalidate(url)
+	if err := resetFile(file); err != nil {
+		return err
+	}
+	return err
+}
@@ -0,0 +1,118 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+)
+
+func TestScriptCache(t *testing.T) {
+	cache := &scriptCache{dir: filepath.Join(t.TempDir(), "cache")}
+	url := "gs://bucket/object"
+
+	if got := cache.version(url); got != "" {
+		t.Errorf("version(%q) = %q for an empty cache, want empty", url, got)
+	}
+
+	src, err := os.Create(filepath.Join(t.TempDir(), "src"))
+	if err != nil {
+		t.Fatalf("failed to create test file: %v", err)
+	}
+	defer src.Close()
+	if _, err := src.WriteString("echo cached"); err != nil {
+		t.Fatalf("failed to write test file: %v", err)
+	}
+
+	if err := cache.store(url, "42", src); err != nil {
+		t.Fatalf("store(%q) failed: %v", url, err)
+	}
+	if got := cache.version(url); got != "42" {
+		t.Errorf("version(%q) = %q, want %q", url, got, "42")
+	}
+
+	dst, err := os.Create(filepath.Join(t.TempDir(), "dst"))
+	if err != nil {
+		t.Fatalf("failed to create test file: %v", err)
+	}
+	defer dst.Close()
+	if err := cache.copyTo(url, dst); err != nil {
+		t.Fatalf("copyTo(%q) failed: %v", url, err)
+	}
+	got, err := os.ReadFile(dst.Name())
+	if err != nil {
+		t.Fatalf("failed to read test file: %v", err)
+	}
+	if string(got) != "echo cached" {
+		t.Errorf("copyTo(%q) wrote %q, want %q", url, got, "echo cached")
+	}
+
+	cache.invalidate(url)
+	if got := cache.version(url); got != "" {
+		t.Errorf("version(%q) = %q after invalidate, want empty", url, got)
+	}
+}
+
+func TestDownloadURLCache(t *testing.T) {
+	// Reset original value.
+	defer cfg.Load(nil)
+	cacheCfg := fmt.Sprintf("[MetadataScripts]\ndownload_cache = true\ndownload_cache_dir = %s", filepath.Join(t.TempDir(), "cache"))
+	if err := cfg.Load([]byte(cacheCfg)); err != nil {
+		t.Fatalf("cfg.Load() failed: %v", err)
+	}
+
+	downloads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		downloads++
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprint(w, "echo hello")
+	}))
+	defer server.Close()
+
+	for i := 0; i < 2; i++ {
+		fpath := filepath.Join(t.TempDir(), "script")
+		f, err := os.OpenFile(fpath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+		if err != nil {
+			t.Fatalf("failed to setup test file: %v", err)
+		}
+		if err := downloadURL(context.Background(), server.URL, f); err != nil {
+			t.Fatalf("downloadURL(%s) failed: %v", server.URL, err)
+		}
+		f.Close()
+
+		got, err := os.ReadFile(fpath)
+		if err != nil {
+			t.Fatalf("failed to read test file: %v", err)
+		}
+		if string(got) != "echo hello" {
+			t.Errorf("downloadURL(%s) wrote %q, want %q", server.URL, got, "echo hello")
+		}
+	}
+
+	if downloads != 1 {
+		t.Errorf("script was downloaded %d times, want 1", downloads)
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// checksumSuffix is the suffix of the metadata key holding the expected
+// SHA256 digest of a script URL's content, i.e. startup-script-url-sha256.
+const checksumSuffix = "-sha256"
+
+// checksumKeys returns the checksum companion keys of the URL keys in wanted.
+func checksumKeys(wanted []string) []string {
+	var keys []string
+	for _, key := range wanted {
+		if strings.HasSuffix(key, "-url") {
+			keys = append(keys, key+checksumSuffix)
+		}
+	}
+	return keys
+}
+
+// verifyChecksum checks the SHA256 digest of the file at filePath matches the
+// expected hex encoded digest.
+func verifyChecksum(filePath string, expected string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("error opening script file: %v", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("error reading script file: %v", err)
+	}
+
+	got := hex.EncodeToString(h.Sum(nil))
+	if want := strings.ToLower(strings.TrimSpace(expected)); got != want {
+		return fmt.Errorf("script checksum mismatch, got sha256 %q, want %q", got, want)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestChecksumKeys(t *testing.T) {
+	wanted := []string{"startup-script", "startup-script-url"}
+	want := []string{"startup-script-url-sha256"}
+	if got := checksumKeys(wanted); !reflect.DeepEqual(got, want) {
+		t.Errorf("checksumKeys(%v) = %v, want %v", wanted, got, want)
+	}
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "script")
+	if err := os.WriteFile(filePath, []byte("echo hello\n"), 0755); err != nil {
+		t.Fatalf("failed to write test script: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		checksum string
+		wantErr  bool
+	}{
+		{
+			name:     "match",
+			checksum: "5dbad7dd0b9b122dcd9956884390f4aac4738caba8ff53498a7ab6718b176c30",
+		},
+		{
+			name:     "match_uppercase_whitespace",
+			checksum: " 5DBAD7DD0B9B122DCD9956884390F4AAC4738CABA8FF53498A7AB6718B176C30\n",
+		},
+		{
+			name:     "mismatch",
+			checksum: "0000000000000000000000000000000000000000000000000000000000000000",
+			wantErr:  true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := verifyChecksum(filePath, tc.checksum); (err != nil) != tc.wantErr {
+				t.Errorf("verifyChecksum(%q, %q) = %v, want error: %t", filePath, tc.checksum, err, tc.wantErr)
+			}
+		})
+	}
+
+	if err := verifyChecksum(filepath.Join(t.TempDir(), "missing"), "abc"); err == nil {
+		t.Errorf("verifyChecksum() succeeded for a missing file, want error")
+	}
+}
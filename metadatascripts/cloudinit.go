@@ -0,0 +1,147 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// cloudInitDefer skips the startup scripts when cloud-init is present,
+	// leaving their execution to it.
+	cloudInitDefer = "defer"
+	// cloudInitFence runs the startup scripts at most once per boot, whether
+	// started by the runner's service or by cloud-init.
+	cloudInitFence = "fence"
+
+	// defaultCloudInitSemaphore is the default semaphore file fencing the
+	// startup scripts' execution.
+	defaultCloudInitSemaphore = "/run/google-metadata-scripts/startup.sem"
+)
+
+var (
+	// cloudInitPresent returns true if cloud-init is installed and enabled.
+	// Replaceable by unit tests.
+	cloudInitPresent = func() bool {
+		if runtime.GOOS != "linux" {
+			return false
+		}
+		if _, err := os.Stat("/etc/cloud/cloud-init.disabled"); err == nil {
+			return false
+		}
+		_, err := lookPath("cloud-init")
+		return err == nil
+	}
+
+	// bootID returns the current boot's unique identifier. Replaceable by unit
+	// tests.
+	bootID = func() (string, error) {
+		data, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+)
+
+// cloudInitSemaphore returns the configured semaphore file or the default one.
+func cloudInitSemaphore() string {
+	if path := cfg.Get().MetadataScripts.CloudInitSemaphore; path != "" {
+		return path
+	}
+	return defaultCloudInitSemaphore
+}
+
+// acquireFence atomically creates the semaphore file recording the boot id,
+// returning false if it was already acquired during this boot. A semaphore
+// left by a previous boot is replaced.
+func acquireFence(path string, boot string) (bool, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return false, fmt.Errorf("failed to create semaphore directory: %v", err)
+	}
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = f.WriteString(boot)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			return true, err
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return false, fmt.Errorf("failed to create semaphore: %v", err)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return false, fmt.Errorf("failed to read semaphore: %v", err)
+		}
+		if err == nil && strings.TrimSpace(string(data)) == boot {
+			return false, nil
+		}
+		// Stale semaphore of a previous boot, a concurrent removal is fine as
+		// only one creation succeeds.
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return false, fmt.Errorf("failed to remove stale semaphore: %v", err)
+		}
+	}
+}
+
+// coordinateCloudInit returns true if the phase's scripts should run according
+// to the configured cloud-init coordination mode, which only applies to the
+// startup phase.
+func coordinateCloudInit(phase string) bool {
+	if phase != "startup" {
+		return true
+	}
+
+	switch mode := strings.ToLower(strings.TrimSpace(cfg.Get().MetadataScripts.CloudInitMode)); mode {
+	case "":
+		return true
+	case cloudInitDefer:
+		if cloudInitPresent() {
+			logger.Infof("cloud-init is present, deferring startup scripts to it.")
+			return false
+		}
+		return true
+	case cloudInitFence:
+		boot, err := bootID()
+		if err != nil {
+			logger.Warningf("Unable to get the boot id, not fencing startup scripts: %v", err)
+			return true
+		}
+		path := cloudInitSemaphore()
+		acquired, err := acquireFence(path, boot)
+		if err != nil {
+			logger.Warningf("Unable to acquire %s, not fencing startup scripts: %v", path, err)
+			return true
+		}
+		if !acquired {
+			logger.Infof("Startup scripts already ran during this boot (%s is held), not running them again.", path)
+		}
+		return acquired
+	default:
+		logger.Warningf("Unknown cloud_init_mode %q, ignoring it", mode)
+		return true
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+)
+
+func TestAcquireFence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dir", "startup.sem")
+
+	for i, want := range []bool{true, false} {
+		acquired, err := acquireFence(path, "boot-1")
+		if err != nil {
+			t.Fatalf("acquireFence(%q, boot-1) attempt %d failed: %v", path, i, err)
+		}
+		if acquired != want {
+			t.Errorf("acquireFence(%q, boot-1) attempt %d = %t, want %t", path, i, acquired, want)
+		}
+	}
+
+	acquired, err := acquireFence(path, "boot-2")
+	if err != nil {
+		t.Fatalf("acquireFence(%q, boot-2) failed: %v", path, err)
+	}
+	if !acquired {
+		t.Errorf("acquireFence(%q, boot-2) = false, want stale semaphore to be replaced", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("os.ReadFile(%q) failed: %v", path, err)
+	}
+	if string(data) != "boot-2" {
+		t.Errorf("semaphore content = %q, want %q", data, "boot-2")
+	}
+}
+
+func TestCoordinateCloudInit(t *testing.T) {
+	origPresent, origBootID := cloudInitPresent, bootID
+	t.Cleanup(func() {
+		cloudInitPresent = origPresent
+		bootID = origBootID
+	})
+	bootID = func() (string, error) { return "boot-1", nil }
+
+	tests := []struct {
+		name    string
+		mode    string
+		phase   string
+		present bool
+		want    []bool
+	}{
+		{name: "disabled", mode: "", phase: "startup", present: true, want: []bool{true, true}},
+		{name: "defer_present", mode: "defer", phase: "startup", present: true, want: []bool{false}},
+		{name: "defer_absent", mode: "defer", phase: "startup", present: false, want: []bool{true}},
+		{name: "fence", mode: "fence", phase: "startup", present: true, want: []bool{true, false}},
+		{name: "fence_shutdown", mode: "fence", phase: "shutdown", present: true, want: []bool{true, true}},
+		{name: "unknown", mode: "invalid", phase: "startup", present: true, want: []bool{true}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			semaphore := filepath.Join(t.TempDir(), "startup.sem")
+			config := fmt.Sprintf("[MetadataScripts]\ncloud_init_mode = %s\ncloud_init_semaphore = %s", tc.mode, semaphore)
+			if err := cfg.Load([]byte(config)); err != nil {
+				t.Fatalf("cfg.Load() failed: %v", err)
+			}
+			defer cfg.Load(nil)
+			cloudInitPresent = func() bool { return tc.present }
+
+			for i, want := range tc.want {
+				if got := coordinateCloudInit(tc.phase); got != want {
+					t.Errorf("coordinateCloudInit(%q) call %d = %t, want %t", tc.phase, i, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// containerImageSuffix is the suffix of the metadata key holding the
+	// container image a phase's scripts run in, i.e. startup-container-image.
+	containerImageSuffix = "-container-image"
+	// containerScriptDir is where the script's directory is mounted in the
+	// container.
+	containerScriptDir = "/metadata-scripts"
+)
+
+var (
+	// containerRuntimes are the supported container runtimes, in detection
+	// order.
+	containerRuntimes = []string{"docker", "podman", "ctr"}
+
+	// lookPath finds a container runtime binary. Replaceable by unit tests.
+	lookPath = exec.LookPath
+
+	// envFileDir is the directory of the containers' environment files, the
+	// system's temporary directory if empty. Replaceable by unit tests.
+	envFileDir = ""
+
+	// runContainerCmd runs a container runtime command other than the script
+	// itself, i.e. pulling an image. Replaceable by unit tests.
+	runContainerCmd = func(name string, args ...string) error {
+		out, err := exec.Command(name, args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s %s failed: %v, output: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+)
+
+// containerImageKey returns the metadata key of the container image of the
+// wanted keys' phase, i.e. startup-container-image for startup-script.
+func containerImageKey(wanted []string) string {
+	return phaseKey(wanted, containerImageSuffix)
+}
+
+// containerScriptCommand returns the command running the script in the
+// container, the image must provide a POSIX shell or pwsh for ps1 scripts.
+func containerScriptCommand(script string) []string {
+	if strings.HasSuffix(script, ".ps1") {
+		return append(append([]string{"pwsh"}, pwshArgs...), script)
+	}
+	return []string{"/bin/sh", "-c", script}
+}
+
+// detectContainerRuntime returns the path of the first installed container
+// runtime.
+func detectContainerRuntime() (string, error) {
+	for _, name := range containerRuntimes {
+		if p, err := lookPath(name); err == nil {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("no container runtime found, one of %s must be installed", strings.Join(containerRuntimes, ", "))
+}
+
+// writeEnvFile writes the env environment variables to a new environment file
+// only readable by its owner, so their values don't show in the process list.
+// The variables whose value spans multiple lines can't be represented and are
+// skipped.
+func writeEnvFile(env []string) (string, error) {
+	f, err := os.CreateTemp(envFileDir, "google-metadata-script-env-")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	// CreateTemp already creates the file with 0600, make sure it stays so.
+	if err := f.Chmod(0600); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	var content strings.Builder
+	for _, e := range env {
+		if strings.ContainsAny(e, "\r\n") {
+			envName, _, _ := strings.Cut(e, "=")
+			logger.Warningf("Not passing %s to the script container, its value spans multiple lines.", envName)
+			continue
+		}
+		content.WriteString(e + "\n")
+	}
+	if _, err := f.WriteString(content.String()); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// containerCommand returns the command running the script at filePath in a
+// container of the image, along with the cleanup function removing the
+// container and its environment file. The script's directory is mounted
+// read-only in the container, which uses the host network to reach the
+// metadata server. The env environment variables are passed through an
+// environment file.
+func containerCommand(image string, metadataKey string, filePath string, env []string) (string, []string, func(), error) {
+	if runtime.GOOS != "linux" {
+		return "", nil, nil, errors.New("container mode is only supported on Linux")
+	}
+	rt, err := detectContainerRuntime()
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	name := fmt.Sprintf("google-metadata-script-%s-%d", metadataKey, os.Getpid())
+	command := containerScriptCommand(path.Join(containerScriptDir, filepath.Base(filePath)))
+
+	var args []string
+	var cleanup func()
+	if filepath.Base(rt) == "ctr" {
+		// ctr doesn't pull images on run.
+		if err := runContainerCmd(rt, "images", "pull", image); err != nil {
+			return "", nil, nil, fmt.Errorf("failed to pull %s: %v", image, err)
+		}
+		args = []string{"run", "--rm", "--net-host",
+			"--mount", fmt.Sprintf("type=bind,src=%s,dst=%s,options=rbind:ro", filepath.Dir(filePath), containerScriptDir)}
+		cleanup = func() {
+			runContainerCmd(rt, "tasks", "kill", "--signal", "SIGKILL", name)
+			runContainerCmd(rt, "containers", "delete", name)
+		}
+	} else {
+		args = []string{"run", "--rm", "--name", name, "--network", "host",
+			"--volume", fmt.Sprintf("%s:%s:ro", filepath.Dir(filePath), containerScriptDir)}
+		cleanup = func() {
+			// The container is already removed if the script finished.
+			if err := runContainerCmd(rt, "rm", "--force", name); err != nil {
+				logger.Debugf("Failed to remove container %s: %v", name, err)
+			}
+		}
+	}
+
+	if len(env) > 0 {
+		envFile, err := writeEnvFile(env)
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("failed to write the container's environment file: %v", err)
+		}
+		args = append(args, "--env-file", envFile)
+		removeContainer := cleanup
+		cleanup = func() {
+			removeContainer()
+			if err := os.Remove(envFile); err != nil {
+				logger.Debugf("Failed to remove environment file %s: %v", envFile, err)
+			}
+		}
+	}
+
+	if filepath.Base(rt) == "ctr" {
+		args = append(args, image, name)
+	} else {
+		args = append(args, "--entrypoint", "", image)
+	}
+	return rt, append(args, command...), cleanup, nil
+}
@@ -0,0 +1,198 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestContainerImageKey(t *testing.T) {
+	tests := []struct {
+		wanted []string
+		want   string
+	}{
+		{wanted: []string{"startup-script", "startup-script-ps1", "startup-script-url"}, want: "startup-container-image"},
+		{wanted: []string{"shutdown-script-1-url"}, want: "shutdown-container-image"},
+		{wanted: []string{"windows-startup-script-ps1"}, want: "windows-startup-container-image"},
+		{wanted: nil, want: ""},
+	}
+
+	for _, tc := range tests {
+		if got := containerImageKey(tc.wanted); got != tc.want {
+			t.Errorf("containerImageKey(%v) = %q, want %q", tc.wanted, got, tc.want)
+		}
+	}
+}
+
+func TestContainerCommand(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("container mode is only supported on Linux")
+	}
+
+	origLookPath, origRunContainerCmd, origEnvFileDir := lookPath, runContainerCmd, envFileDir
+	t.Cleanup(func() {
+		lookPath = origLookPath
+		runContainerCmd = origRunContainerCmd
+		envFileDir = origEnvFileDir
+	})
+
+	var cmds []string
+	runContainerCmd = func(name string, args ...string) error {
+		cmds = append(cmds, strings.Join(append([]string{name}, args...), " "))
+		return nil
+	}
+
+	containerName := fmt.Sprintf("google-metadata-script-startup-script-%d", os.Getpid())
+	tests := []struct {
+		name         string
+		installed    string
+		filePath     string
+		wantArgs     []string
+		wantCmds     []string
+		wantCleanups []string
+	}{
+		{
+			name:      "docker",
+			installed: "docker",
+			filePath:  "/run/metadata-scripts123/startup-script",
+			wantArgs: []string{"run", "--rm", "--name", containerName, "--network", "host",
+				"--volume", "/run/metadata-scripts123:/metadata-scripts:ro", "--env-file", "ENV_FILE",
+				"--entrypoint", "", "debian:12", "/bin/sh", "-c", "/metadata-scripts/startup-script"},
+			wantCleanups: []string{"/usr/bin/docker rm --force " + containerName},
+		},
+		{
+			name:      "podman_pwsh",
+			installed: "podman",
+			filePath:  "/run/metadata-scripts123/startup-script.ps1",
+			wantArgs: []string{"run", "--rm", "--name", containerName, "--network", "host",
+				"--volume", "/run/metadata-scripts123:/metadata-scripts:ro", "--env-file", "ENV_FILE",
+				"--entrypoint", "", "debian:12", "pwsh", "-NoProfile", "-NoLogo", "-NonInteractive", "-File", "/metadata-scripts/startup-script.ps1"},
+			wantCleanups: []string{"/usr/bin/podman rm --force " + containerName},
+		},
+		{
+			name:      "ctr",
+			installed: "ctr",
+			filePath:  "/run/metadata-scripts123/startup-script",
+			wantArgs: []string{"run", "--rm", "--net-host",
+				"--mount", "type=bind,src=/run/metadata-scripts123,dst=/metadata-scripts,options=rbind:ro", "--env-file", "ENV_FILE",
+				"debian:12", containerName, "/bin/sh", "-c", "/metadata-scripts/startup-script"},
+			wantCmds: []string{"/usr/bin/ctr images pull debian:12"},
+			wantCleanups: []string{
+				"/usr/bin/ctr tasks kill --signal SIGKILL " + containerName,
+				"/usr/bin/ctr containers delete " + containerName,
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cmds = nil
+			envFileDir = t.TempDir()
+			lookPath = func(name string) (string, error) {
+				if name == tc.installed {
+					return "/usr/bin/" + name, nil
+				}
+				return "", errors.New("not found")
+			}
+
+			name, args, cleanup, err := containerCommand("debian:12", "startup-script", tc.filePath, []string{"FOO=bar", "MULTI=a\nb"})
+			if err != nil {
+				t.Fatalf("containerCommand() failed: %v", err)
+			}
+
+			// The environment file's name is random, check its content and
+			// permissions instead.
+			var envFile string
+			for i, arg := range args {
+				if arg == "--env-file" && i+1 < len(args) {
+					envFile = args[i+1]
+					args[i+1] = "ENV_FILE"
+				}
+			}
+			info, err := os.Stat(envFile)
+			if err != nil {
+				t.Fatalf("os.Stat(%s) failed unexpectedly with error: %v", envFile, err)
+			}
+			if info.Mode().Perm() != 0600 {
+				t.Errorf("containerCommand() wrote the environment file with mode %v, want 0600", info.Mode().Perm())
+			}
+			content, err := os.ReadFile(envFile)
+			if err != nil {
+				t.Fatalf("os.ReadFile(%s) failed unexpectedly with error: %v", envFile, err)
+			}
+			if string(content) != "FOO=bar\n" {
+				t.Errorf("containerCommand() wrote environment file %q, want %q", content, "FOO=bar\n")
+			}
+			if name != "/usr/bin/"+tc.installed {
+				t.Errorf("containerCommand() = %q, want %q", name, "/usr/bin/"+tc.installed)
+			}
+			if diff := cmp.Diff(tc.wantArgs, args); diff != "" {
+				t.Errorf("containerCommand() returned unexpected args diff (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.wantCmds, cmds); diff != "" {
+				t.Errorf("containerCommand() ran unexpected commands diff (-want +got):\n%s", diff)
+			}
+
+			cmds = nil
+			cleanup()
+			if diff := cmp.Diff(tc.wantCleanups, cmds); diff != "" {
+				t.Errorf("cleanup() ran unexpected commands diff (-want +got):\n%s", diff)
+			}
+			if _, err := os.Stat(envFile); !os.IsNotExist(err) {
+				t.Errorf("cleanup() left the environment file %s", envFile)
+			}
+		})
+	}
+
+	lookPath = func(string) (string, error) { return "", errors.New("not found") }
+	if _, _, _, err := containerCommand("debian:12", "startup-script", "/tmp/startup-script", nil); err == nil {
+		t.Errorf("containerCommand() succeeded without container runtime, want error")
+	}
+}
+
+func TestPrepareScriptCommandContainerUnsandboxed(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("container mode is only supported on Linux")
+	}
+
+	if err := cfg.Load([]byte("[MetadataScripts]\nsandbox_memory_max = 512M")); err != nil {
+		t.Fatalf("cfg.Load() failed: %v", err)
+	}
+	origLookPath := lookPath
+	t.Cleanup(func() {
+		lookPath = origLookPath
+		cfg.Load(nil)
+	})
+	lookPath = func(name string) (string, error) { return "/usr/bin/" + name, nil }
+
+	name, _, cleanup, err := prepareScriptCommand("/run/metadata-scripts123/startup-script", "startup-script", scriptOptions{containerImage: "debian:12"})
+	if err != nil {
+		t.Fatalf("prepareScriptCommand() failed: %v", err)
+	}
+	if name != "/usr/bin/docker" {
+		t.Errorf("prepareScriptCommand() = %q with a sandbox configured, want the container runtime run directly", name)
+	}
+	if cleanup == nil {
+		t.Errorf("prepareScriptCommand() returned no cleanup function")
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+// dependenciesSuffix is the suffix of the metadata key holding the
+// dependencies manifest of a phase's scripts, i.e. startup-dependencies.
+const dependenciesSuffix = "-dependencies"
+
+// dependenciesKey returns the metadata key of the dependencies manifest of the
+// wanted keys' phase, i.e. startup-dependencies for startup-script.
+func dependenciesKey(wanted []string) string {
+	return phaseKey(wanted, dependenciesSuffix)
+}
+
+// parseDependencies parses the dependencies manifest, one "<key>: <key>..."
+// line per script listing the scripts it depends on, separated by commas or
+// spaces. Lines starting with # are ignored, as are the scripts that are not
+// in keys.
+func parseDependencies(manifest string, keys []string) (map[string][]string, error) {
+	found := make(map[string]bool)
+	for _, key := range keys {
+		found[key] = true
+	}
+
+	deps := make(map[string][]string)
+	for i, line := range strings.Split(manifest, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, list, ok := strings.Cut(line, ":")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("line %d: %q is not a <key>: <dependencies> line", i+1, line)
+		}
+		if !found[key] {
+			logger.Warningf("Ignoring the dependencies of %s, no such script in metadata.", key)
+			continue
+		}
+		for _, dep := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+			if !found[dep] {
+				logger.Warningf("Ignoring the %s dependency of %s, no such script in metadata.", dep, key)
+				continue
+			}
+			deps[key] = append(deps[key], dep)
+		}
+	}
+	return deps, checkCycles(keys, deps)
+}
+
+// checkCycles returns an error if the dependencies have a cycle.
+func checkCycles(keys []string, deps map[string][]string) error {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int)
+	var visit func(key string, path []string) error
+	visit = func(key string, path []string) error {
+		switch state[key] {
+		case visiting:
+			return fmt.Errorf("dependency cycle %s", strings.Join(append(path, key), " -> "))
+		case visited:
+			return nil
+		}
+		state[key] = visiting
+		for _, dep := range deps[key] {
+			if err := visit(dep, append(path, key)); err != nil {
+				return err
+			}
+		}
+		state[key] = visited
+		return nil
+	}
+
+	for _, key := range keys {
+		if err := visit(key, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxParallelScripts returns the configured number of scripts run at the same
+// time, at least 1.
+func maxParallelScripts() int {
+	if n := cfg.Get().MetadataScripts.MaxParallelScripts; n > 0 {
+		return n
+	}
+	return 1
+}
+
+// runGraph runs the phase's scripts in parallel, a script starting once all
+// its dependencies succeeded. The scripts depending on a failed script are
+// not run. The results are in the phase's keys order.
+func (p *Phase) runGraph(phaseCtx context.Context, deps map[string][]string) []ScriptResult {
+	results := make([]ScriptResult, len(p.Keys))
+	done := make(map[string]chan struct{})
+	for _, key := range p.Keys {
+		done[key] = make(chan struct{})
+	}
+
+	var mu sync.Mutex
+	succeeded := make(map[string]bool)
+	slots := make(chan struct{}, maxParallelScripts())
+
+	var wg sync.WaitGroup
+	for i, key := range p.Keys {
+		wg.Add(1)
+		go func(i int, key string) {
+			defer wg.Done()
+			defer close(done[key])
+
+			for _, dep := range deps[key] {
+				<-done[dep]
+				mu.Lock()
+				ok := succeeded[dep]
+				mu.Unlock()
+				if !ok {
+					now := time.Now()
+					err := fmt.Errorf("not running %s, its dependency %s failed", key, dep)
+					logger.Warningf("Script %q failed with error: %v", key, err)
+					results[i] = newScriptResult(key, now, now, err)
+					return
+				}
+			}
+
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			var err error
+			results[i], err = p.runOne(phaseCtx, key)
+
+			mu.Lock()
+			succeeded[key] = err == nil
+			mu.Unlock()
+		}(i, key)
+	}
+	wg.Wait()
+	return results
+}
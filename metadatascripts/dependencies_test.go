@@ -0,0 +1,143 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseDependencies(t *testing.T) {
+	keys := []string{"startup-script", "startup-script-1", "startup-script-2-url"}
+
+	tests := []struct {
+		name     string
+		manifest string
+		want     map[string][]string
+		wantErr  bool
+	}{
+		{
+			name:     "valid",
+			manifest: "# comment\nstartup-script-1: startup-script\n\nstartup-script-2-url: startup-script, startup-script-1\n",
+			want: map[string][]string{
+				"startup-script-1":     {"startup-script"},
+				"startup-script-2-url": {"startup-script", "startup-script-1"},
+			},
+		},
+		{
+			name:     "unknown_keys",
+			manifest: "startup-script-9: startup-script\nstartup-script-1: startup-script-8 startup-script",
+			want:     map[string][]string{"startup-script-1": {"startup-script"}},
+		},
+		{
+			name:     "no_dependencies",
+			manifest: "startup-script:",
+			want:     map[string][]string{},
+		},
+		{
+			name:     "malformed",
+			manifest: "startup-script-1 startup-script",
+			wantErr:  true,
+		},
+		{
+			name:     "cycle",
+			manifest: "startup-script: startup-script-2-url\nstartup-script-1: startup-script\nstartup-script-2-url: startup-script-1",
+			wantErr:  true,
+		},
+		{
+			name:     "self_dependency",
+			manifest: "startup-script: startup-script",
+			wantErr:  true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseDependencies(tc.manifest, keys)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("parseDependencies(%q) = %v, want error: %t", tc.manifest, err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("parseDependencies(%q) returned unexpected diff (-want +got):\n%s", tc.manifest, diff)
+			}
+		})
+	}
+}
+
+func TestDependenciesKey(t *testing.T) {
+	if got, want := dependenciesKey([]string{"windows-startup-script-ps1"}), "windows-startup-dependencies"; got != want {
+		t.Errorf("dependenciesKey() = %q, want %q", got, want)
+	}
+}
+
+func TestRunGraph(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test relies on a POSIX shell")
+	}
+
+	out := filepath.Join(t.TempDir(), "out")
+	p := &Phase{
+		Name: "startup",
+		Keys: []string{"startup-script-1", "startup-script-2", "startup-script-3", "startup-script-4", "startup-script-5"},
+		Scripts: map[string]string{
+			"startup-script-1":     "sleep 0.2; printf 1 >> " + out,
+			"startup-script-2":     "printf 2 >> " + out,
+			"startup-script-3":     "printf 3 >> " + out,
+			"startup-script-4":     "exit 1",
+			"startup-script-5":     "printf 5 >> " + out,
+			"startup-dependencies": "startup-script-2: startup-script-1\nstartup-script-5: startup-script-4",
+		},
+		wanted: []string{"startup-script", "startup-script-ps1", "startup-script-url"},
+	}
+
+	deps := p.dependencies()
+	if deps == nil {
+		t.Fatalf("dependencies() = nil, want the manifest's dependencies")
+	}
+	results := p.runGraph(context.Background(), deps)
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("failed to read scripts output: %v", err)
+	}
+	// The independent script 3 doesn't wait for script 1, script 2 does and
+	// script 5 doesn't run as script 4 failed.
+	if got, want := string(data), "312"; got != want {
+		t.Errorf("scripts output = %q, want %q", got, want)
+	}
+
+	var got []string
+	for _, res := range results {
+		got = append(got, res.Script)
+	}
+	if diff := cmp.Diff(p.Keys, got); diff != "" {
+		t.Errorf("runGraph() results order unexpected diff (-want +got):\n%s", diff)
+	}
+	if results[3].ExitCode != 1 {
+		t.Errorf("startup-script-4 exit code = %d, want 1", results[3].ExitCode)
+	}
+	if !strings.Contains(results[4].Error, "dependency startup-script-4 failed") {
+		t.Errorf("startup-script-5 error = %q, want failed dependency error", results[4].Error)
+	}
+}
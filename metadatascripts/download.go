@@ -0,0 +1,113 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/retry"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+var (
+	// downloadRetryPolicy retries the transient download errors with an
+	// exponential backoff, bounded by the download timeout.
+	downloadRetryPolicy = retry.Policy{MaxAttempts: 10, BackoffFactor: 2, Jitter: time.Second, ShouldRetry: isTransientDownloadError}
+)
+
+// permanentError is a download error that's not worth retrying, i.e. the
+// script doesn't exist or access is denied.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// isTransientDownloadError returns true if the download may succeed if retried.
+func isTransientDownloadError(err error) bool {
+	var perm *permanentError
+	return !errors.As(err, &perm) && !errors.Is(err, storage.ErrObjectNotExist) &&
+		!errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// httpStatusError returns the error of an unexpected HTTP status, client
+// errors other than timeouts and throttling are permanent.
+func httpStatusError(url string, res *http.Response) error {
+	err := fmt.Errorf("GET %q, bad status: %s", url, res.Status)
+	if res.StatusCode >= 400 && res.StatusCode < 500 &&
+		res.StatusCode != http.StatusRequestTimeout && res.StatusCode != http.StatusTooManyRequests {
+		return &permanentError{err: err}
+	}
+	return err
+}
+
+// downloadTimeout returns the configured overall download deadline of a
+// script, 0 if none.
+func downloadTimeout() time.Duration {
+	return parseTimeout("download_timeout", cfg.Get().MetadataScripts.DownloadTimeout)
+}
+
+// resetFile empties file so a download can start over.
+func resetFile(file *os.File) error {
+	if err := file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate script file: %v", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind script file: %v", err)
+	}
+	return nil
+}
+
+// resumableDownload downloads to file the content read from the readers
+// returned by open. A failed download is retried, resuming at the offset
+// already written to file: open must return the content starting at offset,
+// or reset file and return the whole content.
+func resumableDownload(ctx context.Context, name string, file *os.File, open func(ctx context.Context, offset int64) (io.ReadCloser, error)) error {
+	return retry.Run(ctx, downloadRetryPolicy, func() error {
+		offset, err := file.Seek(0, io.SeekEnd)
+		if err != nil {
+			return &permanentError{err: fmt.Errorf("failed to seek script file: %v", err)}
+		}
+		if offset > 0 {
+			logger.Infof("Resuming download of %s at byte %d.", name, offset)
+		}
+
+		r, err := open(ctx, offset)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		if _, err := io.Copy(file, r); err != nil {
+			logger.Infof("Download of %s was interrupted: %v", name, err)
+			return err
+		}
+		return nil
+	})
+}
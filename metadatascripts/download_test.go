@@ -0,0 +1,245 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"google.golang.org/api/option"
+)
+
+// interruptingHandler serves content, the first request being interrupted
+// half way. It records the Range and If-Range headers it was requested with.
+type interruptingHandler struct {
+	content     string
+	ignoreRange bool
+	// etag and lastModified are the validators of the content, if set.
+	etag, lastModified string
+
+	mu       sync.Mutex
+	ranges   []string
+	ifRanges []string
+}
+
+func (h *interruptingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	h.ranges = append(h.ranges, r.Header.Get("Range"))
+	h.ifRanges = append(h.ifRanges, r.Header.Get("If-Range"))
+	first := len(h.ranges) == 1
+	h.mu.Unlock()
+
+	if h.etag != "" {
+		w.Header().Set("ETag", h.etag)
+	}
+	if h.lastModified != "" {
+		w.Header().Set("Last-Modified", h.lastModified)
+	}
+	if first {
+		// Announce the whole content but only send half of it.
+		w.Header().Set("Content-Length", strconv.Itoa(len(h.content)))
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, h.content[:len(h.content)/2])
+		panic(http.ErrAbortHandler)
+	}
+
+	if rng := r.Header.Get("Range"); rng != "" && !h.ignoreRange {
+		offset, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+		if err != nil || offset > len(h.content) {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.WriteHeader(http.StatusPartialContent)
+		fmt.Fprint(w, h.content[offset:])
+		return
+	}
+	fmt.Fprint(w, h.content)
+}
+
+func TestDownloadURLResume(t *testing.T) {
+	origPolicy := downloadRetryPolicy
+	t.Cleanup(func() { downloadRetryPolicy = origPolicy })
+	downloadRetryPolicy.Jitter = time.Millisecond
+	content := strings.Repeat("echo resumed download\n", 1000)
+
+	lastModified := "Mon, 02 Jan 2006 15:04:05 GMT"
+	rng := fmt.Sprintf("bytes=%d-", len(content)/2)
+
+	tests := []struct {
+		name               string
+		ignoreRange        bool
+		etag, lastModified string
+		wantRanges         []string
+		wantIfRanges       []string
+	}{
+		{
+			name:         "resumed",
+			etag:         `"v1"`,
+			wantRanges:   []string{"", rng},
+			wantIfRanges: []string{"", `"v1"`},
+		},
+		{
+			name:         "range_not_supported",
+			ignoreRange:  true,
+			etag:         `"v1"`,
+			wantRanges:   []string{"", rng},
+			wantIfRanges: []string{"", `"v1"`},
+		},
+		{
+			name:         "last_modified",
+			lastModified: lastModified,
+			wantRanges:   []string{"", rng},
+			wantIfRanges: []string{"", lastModified},
+		},
+		{
+			name:         "weak_etag",
+			etag:         `W/"v1"`,
+			lastModified: lastModified,
+			wantRanges:   []string{"", rng},
+			wantIfRanges: []string{"", lastModified},
+		},
+		{
+			name:         "no_validator",
+			wantRanges:   []string{"", ""},
+			wantIfRanges: []string{"", ""},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := &interruptingHandler{content: content, ignoreRange: tc.ignoreRange, etag: tc.etag, lastModified: tc.lastModified}
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			fpath := filepath.Join(t.TempDir(), "script")
+			f, err := os.OpenFile(fpath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+			if err != nil {
+				t.Fatalf("failed to setup test file: %v", err)
+			}
+			defer f.Close()
+
+			if err := downloadURL(context.Background(), server.URL, f); err != nil {
+				t.Fatalf("downloadURL(%s) failed: %v", server.URL, err)
+			}
+			got, err := os.ReadFile(fpath)
+			if err != nil {
+				t.Fatalf("failed to read test file: %v", err)
+			}
+			if string(got) != content {
+				t.Errorf("downloadURL(%s) wrote %d bytes, want the %d bytes of content", server.URL, len(got), len(content))
+			}
+
+			handler.mu.Lock()
+			defer handler.mu.Unlock()
+			if len(handler.ranges) != len(tc.wantRanges) {
+				t.Fatalf("server got %d requests, want %d", len(handler.ranges), len(tc.wantRanges))
+			}
+			for i, want := range tc.wantRanges {
+				if handler.ranges[i] != want {
+					t.Errorf("request %d Range = %q, want %q", i, handler.ranges[i], want)
+				}
+				if handler.ifRanges[i] != tc.wantIfRanges[i] {
+					t.Errorf("request %d If-Range = %q, want %q", i, handler.ifRanges[i], tc.wantIfRanges[i])
+				}
+			}
+		})
+	}
+}
+
+func TestIsTransientDownloadError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "network", err: errors.New("connection reset by peer"), want: true},
+		{name: "server", err: httpStatusError("url", &http.Response{StatusCode: 503, Status: "503 Service Unavailable"}), want: true},
+		{name: "throttled", err: httpStatusError("url", &http.Response{StatusCode: 429, Status: "429 Too Many Requests"}), want: true},
+		{name: "forbidden", err: httpStatusError("url", &http.Response{StatusCode: 403, Status: "403 Forbidden"})},
+		{name: "object_not_exist", err: fmt.Errorf("download: %w", storage.ErrObjectNotExist)},
+		{name: "deadline", err: context.DeadlineExceeded},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isTransientDownloadError(tc.err); got != tc.want {
+				t.Errorf("isTransientDownloadError(%v) = %t, want %t", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDownloadTimeout(t *testing.T) {
+	if got, want := downloadTimeout(), 10*time.Minute; got != want {
+		t.Errorf("downloadTimeout() = %v, want default %v", got, want)
+	}
+
+	if err := cfg.Load([]byte("[MetadataScripts]\ndownload_timeout =")); err != nil {
+		t.Fatalf("cfg.Load() failed: %v", err)
+	}
+	defer cfg.Load(nil)
+	if got := downloadTimeout(); got != 0 {
+		t.Errorf("downloadTimeout() = %v, want no timeout", got)
+	}
+}
+
+func TestDownloadGSURLResume(t *testing.T) {
+	ctx := context.Background()
+	origPolicy := downloadRetryPolicy
+	t.Cleanup(func() { downloadRetryPolicy = origPolicy })
+	downloadRetryPolicy.Jitter = time.Millisecond
+	content := strings.Repeat("echo resumed download\n", 1000)
+
+	handler := &interruptingHandler{content: content}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	var err error
+	testStorageClient, err = storage.NewClient(ctx, option.WithHTTPClient(&http.Client{Transport: &http.Transport{}}), option.WithEndpoint(server.URL))
+	if err != nil {
+		t.Fatalf("Failed to setup test storage client, err: %+v", err)
+	}
+	defer func() { testStorageClient = nil }()
+
+	fpath := filepath.Join(t.TempDir(), "script")
+	f, err := os.OpenFile(fpath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		t.Fatalf("failed to setup test file: %v", err)
+	}
+	defer f.Close()
+
+	if err := downloadGSURL(ctx, "bucket", "object", f); err != nil {
+		t.Fatalf("downloadGSURL() failed: %v", err)
+	}
+	got, err := os.ReadFile(fpath)
+	if err != nil {
+		t.Fatalf("failed to read test file: %v", err)
+	}
+	if string(got) != content {
+		t.Errorf("downloadGSURL() wrote %d bytes, want the %d bytes of content", len(got), len(content))
+	}
+}
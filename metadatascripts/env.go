@@ -0,0 +1,73 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// scriptEnvKey is the metadata key holding the environment variables of
+	// all the scripts, one NAME=value per line.
+	scriptEnvKey = "script-env"
+	// envSuffix is the suffix of the metadata key holding the environment
+	// variables of a single script, i.e. startup-script-env.
+	envSuffix = "-env"
+)
+
+var envNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// parseEnv parses NAME=value lines, blank lines and lines starting with # are
+// skipped. The variables are added to env, overriding the ones already set.
+func parseEnv(key string, value string, env map[string]string, order *[]string) error {
+	for i, line := range strings.Split(value, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if trimmed := strings.TrimSpace(line); trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		name, val, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !envNameRegex.MatchString(name) {
+			// Don't log the line, it may hold a secret.
+			return fmt.Errorf("invalid environment variable on line %d of %s", i+1, key)
+		}
+		if _, found := env[name]; !found {
+			*order = append(*order, name)
+		}
+		env[name] = val
+	}
+	return nil
+}
+
+// scriptEnv returns the environment variables set for the script key, in the
+// NAME=value form. The script's own variables override the ones set for all
+// scripts.
+func scriptEnv(key string, scripts map[string]string) ([]string, error) {
+	env := make(map[string]string)
+	var order []string
+	for _, envKey := range []string{scriptEnvKey, key + envSuffix} {
+		if err := parseEnv(envKey, scripts[envKey], env, &order); err != nil {
+			return nil, err
+		}
+	}
+
+	var res []string
+	for _, name := range order {
+		res = append(res, name+"="+env[name])
+	}
+	return res, nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestScriptEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		scripts map[string]string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:    "no_env",
+			scripts: map[string]string{"startup-script": "echo"},
+		},
+		{
+			name: "all_scripts",
+			scripts: map[string]string{
+				"script-env": "FOO=bar\n\n# comment\nBAZ=a=b\r\n",
+			},
+			want: []string{"FOO=bar", "BAZ=a=b"},
+		},
+		{
+			name: "script_overrides",
+			scripts: map[string]string{
+				"script-env":          "FOO=bar\nBAZ=qux",
+				"startup-script-env":  "FOO=override\nEMPTY=",
+				"shutdown-script-env": "FOO=other",
+			},
+			want: []string{"FOO=override", "BAZ=qux", "EMPTY="},
+		},
+		{
+			name:    "missing_separator",
+			scripts: map[string]string{"startup-script-env": "FOO"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid_name",
+			scripts: map[string]string{"script-env": "1FOO=bar"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := scriptEnv("startup-script", tc.scripts)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("scriptEnv() = %v, want error: %t", err, tc.wantErr)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("scriptEnv() returned unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRunScriptEnv(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test relies on a POSIX shell")
+	}
+
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	filePath := filepath.Join(dir, "startup-script")
+	if err := os.WriteFile(filePath, []byte(`printf %s "$FOO" > `+out), 0755); err != nil {
+		t.Fatalf("failed to write test script: %v", err)
+	}
+
+	if err := runScript(context.Background(), filePath, "startup-script", scriptOptions{env: []string{"FOO=bar"}}); err != nil {
+		t.Fatalf("runScript() failed: %v", err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("failed to read script output: %v", err)
+	}
+	if string(got) != "bar" {
+		t.Errorf("script got FOO=%q, want %q", got, "bar")
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// scriptInfix separates a script key's prefix (i.e. startup) from its suffix
+// (i.e. url). Numbered keys have their number right after it, i.e.
+// startup-script-2-url or windows-startup-script-1-ps1.
+const scriptInfix = "-script"
+
+// numberedKey is a numbered script key found in metadata.
+type numberedKey struct {
+	key string
+	// num is the key's number, keys run in ascending number order.
+	num int
+	// wantedIdx is the index of the key's unnumbered form in the wanted keys,
+	// keys with the same number run in the wanted keys order.
+	wantedIdx int
+}
+
+// numberedKeyRegex returns the regex matching the numbered forms of a wanted
+// key, the only submatch being the number.
+func numberedKeyRegex(wanted string) *regexp.Regexp {
+	idx := strings.Index(wanted, scriptInfix)
+	if idx < 0 {
+		return nil
+	}
+	base := wanted[:idx+len(scriptInfix)]
+	suffix := wanted[idx+len(scriptInfix):]
+	return regexp.MustCompile(fmt.Sprintf(`^%s-([0-9]+)%s$`, regexp.QuoteMeta(base), regexp.QuoteMeta(suffix)))
+}
+
+// findNumberedKeys returns the numbered forms of the wanted keys set in md,
+// sorted in execution order.
+func findNumberedKeys(md map[string]string, wanted []string) []string {
+	var found []numberedKey
+	for i, key := range wanted {
+		re := numberedKeyRegex(key)
+		if re == nil {
+			continue
+		}
+		for mdKey := range md {
+			match := re.FindStringSubmatch(mdKey)
+			if len(match) != 2 {
+				continue
+			}
+			num, err := strconv.Atoi(match[1])
+			if err != nil {
+				continue
+			}
+			found = append(found, numberedKey{key: mdKey, num: num, wantedIdx: i})
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].num != found[j].num {
+			return found[i].num < found[j].num
+		}
+		if found[i].wantedIdx != found[j].wantedIdx {
+			return found[i].wantedIdx < found[j].wantedIdx
+		}
+		// Same number written differently, i.e. startup-script-1 and startup-script-01.
+		return found[i].key < found[j].key
+	})
+
+	var keys []string
+	for _, k := range found {
+		keys = append(keys, k.key)
+	}
+	return keys
+}
+
+// misnumberedKeys returns the keys of md numbering a wanted key after its
+// suffix (i.e. startup-script-url-2), which are not run, mapped to their
+// correct form (i.e. startup-script-2-url).
+func misnumberedKeys(md map[string]string, wanted []string) map[string]string {
+	res := make(map[string]string)
+	for _, key := range wanted {
+		idx := strings.Index(key, scriptInfix)
+		if idx < 0 || idx+len(scriptInfix) == len(key) {
+			continue
+		}
+		base := key[:idx+len(scriptInfix)]
+		suffix := key[idx+len(scriptInfix):]
+		re := regexp.MustCompile(fmt.Sprintf(`^%s-([0-9]+)$`, regexp.QuoteMeta(key)))
+		for mdKey := range md {
+			if match := re.FindStringSubmatch(mdKey); len(match) == 2 {
+				res[mdKey] = fmt.Sprintf("%s-%s%s", base, match[1], suffix)
+			}
+		}
+	}
+	return res
+}
+
+// companionKeys returns the companion keys of the script keys, i.e. their
+// checksum, timeout, signature, environment and run-once keys, along with the
+// environment key of all the scripts.
+func companionKeys(keys []string) []string {
+	companions := append(checksumKeys(keys), scriptEnvKey)
+	for _, key := range keys {
+		companions = append(companions, key+timeoutSuffix, key+signatureSuffix, key+envSuffix, key+runOnceSuffix)
+	}
+	return companions
+}
+
+// phaseKey returns the metadata key of a setting of the wanted keys' phase,
+// made of the phase's key prefix and the setting's suffix, i.e.
+// startup-container-image for startup-script and -container-image.
+func phaseKey(wanted []string, suffix string) string {
+	if len(wanted) == 0 {
+		return ""
+	}
+	idx := strings.Index(wanted[0], scriptInfix)
+	if idx < 0 {
+		return ""
+	}
+	return wanted[0][:idx] + suffix
+}
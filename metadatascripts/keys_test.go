@@ -0,0 +1,91 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFindNumberedKeys(t *testing.T) {
+	tests := []struct {
+		name   string
+		wanted []string
+		md     map[string]string
+		want   []string
+	}{
+		{
+			name:   "linux",
+			wanted: []string{"startup-script", "startup-script-url"},
+			md: map[string]string{
+				"startup-script":              "base",
+				"startup-script-10":           "ten",
+				"startup-script-2":            "two",
+				"startup-script-1-url":        "one-url",
+				"startup-script-1":            "one",
+				"startup-script-1-url-sha256": "digest",
+				"startup-script-x":            "not numbered",
+				"shutdown-script-1":           "other phase",
+			},
+			want: []string{"startup-script-1", "startup-script-1-url", "startup-script-2", "startup-script-10"},
+		},
+		{
+			name:   "windows",
+			wanted: []string{"windows-startup-script-ps1", "windows-startup-script-cmd"},
+			md: map[string]string{
+				"windows-startup-script-2-ps1": "two",
+				"windows-startup-script-1-cmd": "one-cmd",
+				"windows-startup-script-1-ps1": "one-ps1",
+				"windows-startup-script-ps1-1": "suffix must come last",
+			},
+			want: []string{"windows-startup-script-1-ps1", "windows-startup-script-1-cmd", "windows-startup-script-2-ps1"},
+		},
+		{
+			name:   "none",
+			wanted: []string{"startup-script"},
+			md:     map[string]string{"startup-script": "base"},
+			want:   nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := findNumberedKeys(tc.md, tc.wanted); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("findNumberedKeys(%v, %v) = %v, want %v", tc.md, tc.wanted, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMisnumberedKeys(t *testing.T) {
+	wanted := []string{"startup-script", "startup-script-ps1", "startup-script-url"}
+	md := map[string]string{
+		"startup-script-1":          "numbered",
+		"startup-script-2-url":      "numbered url",
+		"startup-script-url-2":      "misnumbered url",
+		"startup-script-ps1-10":     "misnumbered ps1",
+		"startup-script-url-sha256": "digest",
+		"startup-script-url-part-1": "part",
+		"shutdown-script-url-1":     "other phase",
+	}
+	want := map[string]string{
+		"startup-script-url-2":  "startup-script-2-url",
+		"startup-script-ps1-10": "startup-script-10-ps1",
+	}
+
+	if got := misnumberedKeys(md, wanted); !reflect.DeepEqual(got, want) {
+		t.Errorf("misnumberedKeys(%v, %v) = %v, want %v", md, wanted, got, want)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// ScriptStarted is the type of the event emitted when a script starts.
+	ScriptStarted = "script-started"
+	// ScriptFinished is the type of the event emitted when a script finished,
+	// retries included.
+	ScriptFinished = "script-finished"
+)
+
+// ScriptEvent is a script lifecycle event.
+type ScriptEvent struct {
+	// Type is the event's type, ScriptStarted or ScriptFinished.
+	Type string `json:"type"`
+	// Phase is the phase running the script, i.e. startup.
+	Phase string `json:"phase"`
+	// Script is the script's metadata key or local script path.
+	Script string `json:"script"`
+	// Time is when the event happened.
+	Time time.Time `json:"time"`
+	// Result is the finished script's result, nil for ScriptStarted.
+	Result *ScriptResult `json:"result,omitempty"`
+}
+
+var (
+	// eventHandler is called with the scripts' lifecycle events, nil if none.
+	eventHandler func(ScriptEvent)
+	// eventHandlerMutex protects eventHandler.
+	eventHandlerMutex sync.RWMutex
+)
+
+// SetEventHandler sets the function called with the lifecycle events of the
+// scripts run by this process, nil removing it. The handler is called from
+// the goroutine running the script and must not block for long.
+func SetEventHandler(handler func(ScriptEvent)) {
+	eventHandlerMutex.Lock()
+	defer eventHandlerMutex.Unlock()
+	eventHandler = handler
+}
+
+// emitEvent calls the event handler, if any, with the event.
+func emitEvent(ev ScriptEvent) {
+	eventHandlerMutex.RLock()
+	handler := eventHandler
+	eventHandlerMutex.RUnlock()
+	if handler != nil {
+		handler(ev)
+	}
+}
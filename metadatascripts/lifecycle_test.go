@@ -0,0 +1,63 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"context"
+	"runtime"
+	"testing"
+)
+
+func TestRunOneEmitsEvents(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test relies on a POSIX shell")
+	}
+
+	var events []ScriptEvent
+	SetEventHandler(func(ev ScriptEvent) { events = append(events, ev) })
+	t.Cleanup(func() { SetEventHandler(nil) })
+
+	p := &Phase{
+		Name:    "startup",
+		Keys:    []string{"startup-script"},
+		Scripts: map[string]string{"startup-script": "exit 5"},
+	}
+	if _, err := p.runOne(context.Background(), "startup-script"); err == nil {
+		t.Fatalf("runOne() succeeded for a failing script, want error")
+	}
+
+	if len(events) != 2 {
+		t.Fatalf("runOne() emitted %d events, want 2: %+v", len(events), events)
+	}
+	started, finished := events[0], events[1]
+	if started.Type != ScriptStarted || started.Phase != "startup" || started.Script != "startup-script" || started.Result != nil {
+		t.Errorf("first event = %+v, want a %s event of startup-script without result", started, ScriptStarted)
+	}
+	if finished.Type != ScriptFinished || finished.Script != "startup-script" || finished.Result == nil {
+		t.Fatalf("second event = %+v, want a %s event of startup-script with result", finished, ScriptFinished)
+	}
+	if finished.Result.ExitCode != 5 {
+		t.Errorf("finished event exit code = %d, want 5", finished.Result.ExitCode)
+	}
+	if finished.Time.Before(started.Time) {
+		t.Errorf("finished event time %v is before started event time %v", finished.Time, started.Time)
+	}
+}
+
+func TestEmitEventWithoutHandler(t *testing.T) {
+	SetEventHandler(nil)
+	// Must not panic.
+	emitEvent(ScriptEvent{Type: ScriptStarted, Script: "startup-script"})
+}
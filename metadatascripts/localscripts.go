@@ -0,0 +1,126 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+var (
+	// localScriptPhases are the phases also running the scripts of their local
+	// directory, i.e. /etc/google/shutdown.d.
+	localScriptPhases = map[string]bool{"shutdown": true, "graceful-shutdown": true}
+
+	// ignoredLocalSuffixes are the suffixes of the files left by editors and
+	// package managers, which are not run.
+	ignoredLocalSuffixes = []string{"~", ".bak", ".swp", ".rpmsave", ".rpmnew", ".rpmorig", ".dpkg-old", ".dpkg-new", ".dpkg-dist", ".dpkg-tmp"}
+)
+
+// localScriptsDir returns the directory of the phase's local scripts, in the
+// configured base directory or the OS default one.
+func localScriptsDir(phase string) string {
+	base := cfg.Get().MetadataScripts.LocalScriptsDir
+	if base == "" {
+		if runtime.GOOS == "windows" {
+			base = filepath.Join(os.Getenv("ProgramData"), "Google", "Compute Engine")
+		} else {
+			base = "/etc/google"
+		}
+	}
+	return filepath.Join(base, phase+".d")
+}
+
+// isLocalScript returns true if the directory entry is a script to run: a
+// regular file that's not hidden nor an editor or package manager leftover,
+// executable on Linux and with a script extension on Windows.
+func isLocalScript(entry os.DirEntry) bool {
+	name := entry.Name()
+	if strings.HasPrefix(name, ".") || !entry.Type().IsRegular() {
+		return false
+	}
+	for _, suffix := range ignoredLocalSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return false
+		}
+	}
+	if runtime.GOOS == "windows" {
+		switch strings.ToLower(filepath.Ext(name)) {
+		case ".ps1", ".cmd", ".bat", ".exe":
+			return true
+		}
+		return false
+	}
+	info, err := entry.Info()
+	return err == nil && info.Mode().Perm()&0111 != 0
+}
+
+// findLocalScripts returns the paths of the scripts in dir, in lexical order.
+// A missing directory has no scripts, a world-writable one is refused on
+// Linux.
+func findLocalScripts(dir string) ([]string, error) {
+	info, err := os.Stat(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0002 != 0 {
+		return nil, fmt.Errorf("%s is world-writable, not running its scripts", dir)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var scripts []string
+	for _, entry := range entries {
+		if isLocalScript(entry) {
+			scripts = append(scripts, filepath.Join(dir, entry.Name()))
+		} else {
+			logger.Debugf("Skipping %s, not a script to run.", filepath.Join(dir, entry.Name()))
+		}
+	}
+	return scripts, nil
+}
+
+// runLocalScript runs a copy of the local script at path, so the sandbox
+// setup doesn't change the ownership of the local scripts directory.
+func (p *Phase) runLocalScript(ctx context.Context, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %v", path, err)
+	}
+	tmpDir, err := os.MkdirTemp(cfg.Get().MetadataScripts.RunDir, "metadata-scripts")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tmpFile := filepath.Join(tmpDir, filepath.Base(path))
+	if err := os.WriteFile(tmpFile, data, 0755); err != nil {
+		return fmt.Errorf("error writing temp file: %v", err)
+	}
+	return runScript(ctx, tmpFile, filepath.Base(path), scriptOptions{phase: p.Name})
+}
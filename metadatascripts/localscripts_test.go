@@ -0,0 +1,134 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLocalScriptsDir(t *testing.T) {
+	if err := cfg.Load([]byte("[MetadataScripts]\nlocal_scripts_dir = /opt/google")); err != nil {
+		t.Fatalf("cfg.Load() failed: %v", err)
+	}
+	defer cfg.Load(nil)
+
+	if got, want := localScriptsDir("graceful-shutdown"), filepath.Join("/opt/google", "graceful-shutdown.d"); got != want {
+		t.Errorf("localScriptsDir(graceful-shutdown) = %q, want %q", got, want)
+	}
+}
+
+func TestFindLocalScripts(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test relies on executable permissions")
+	}
+
+	dir := filepath.Join(t.TempDir(), "shutdown.d")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("os.Mkdir(%q) failed: %v", dir, err)
+	}
+	files := map[string]os.FileMode{
+		"20-flush":        0755,
+		"10-drain":        0700,
+		"30-readme":       0644,
+		".hidden":         0755,
+		"40-hook~":        0755,
+		"50-hook.rpmsave": 0755,
+	}
+	for name, mode := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"), mode); err != nil {
+			t.Fatalf("os.WriteFile(%q) failed: %v", name, err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "60-dir"), 0755); err != nil {
+		t.Fatalf("os.Mkdir() failed: %v", err)
+	}
+
+	got, err := findLocalScripts(dir)
+	if err != nil {
+		t.Fatalf("findLocalScripts(%q) failed: %v", dir, err)
+	}
+	want := []string{filepath.Join(dir, "10-drain"), filepath.Join(dir, "20-flush")}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("findLocalScripts(%q) returned unexpected diff (-want +got):\n%s", dir, diff)
+	}
+
+	if got, err := findLocalScripts(filepath.Join(dir, "missing")); err != nil || got != nil {
+		t.Errorf("findLocalScripts(missing) = (%v, %v), want (nil, nil)", got, err)
+	}
+
+	if err := os.Chmod(dir, 0777); err != nil {
+		t.Fatalf("os.Chmod(%q) failed: %v", dir, err)
+	}
+	if _, err := findLocalScripts(dir); err == nil {
+		t.Errorf("findLocalScripts(%q) succeeded for a world-writable directory, want error", dir)
+	}
+}
+
+func TestRunLocalScripts(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test relies on a POSIX shell")
+	}
+
+	base := t.TempDir()
+	if err := cfg.Load([]byte("[MetadataScripts]\nlocal_scripts_dir = " + base)); err != nil {
+		t.Fatalf("cfg.Load() failed: %v", err)
+	}
+	defer cfg.Load(nil)
+
+	dir := localScriptsDir("shutdown")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("os.Mkdir(%q) failed: %v", dir, err)
+	}
+	out := filepath.Join(base, "out")
+	for name, script := range map[string]string{"10-first": "printf 1 >> " + out, "20-second": "printf 2 >> " + out + "; exit 4"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			t.Fatalf("os.WriteFile(%q) failed: %v", name, err)
+		}
+	}
+
+	local, err := findLocalScripts(dir)
+	if err != nil {
+		t.Fatalf("findLocalScripts(%q) failed: %v", dir, err)
+	}
+	p := &Phase{Name: "shutdown", Local: local}
+
+	plan := p.Plan()
+	if len(plan) != 2 || plan[0].Key != "10-first" || plan[0].Source != filepath.Join(dir, "10-first") {
+		t.Errorf("Plan() = %+v, want the local scripts", plan)
+	}
+
+	var results []ScriptResult
+	for _, path := range p.Local {
+		res, _ := p.runOne(context.Background(), path)
+		results = append(results, res)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("failed to read scripts output: %v", err)
+	}
+	if got, want := string(data), "12"; got != want {
+		t.Errorf("local scripts output = %q, want %q", got, want)
+	}
+	if results[0].ExitCode != 0 || results[1].ExitCode != 4 {
+		t.Errorf("local scripts exit codes = %d, %d, want 0, 4", results[0].ExitCode, results[1].ExitCode)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+)
+
+// outputLimiter throttles and caps the output lines a script logs, it's
+// shared by the script's stdout and stderr streams.
+type outputLimiter struct {
+	mu sync.Mutex
+	// rate is the number of lines logged per second, 0 if unlimited. Up to a
+	// second's worth of lines may be logged at once.
+	rate int
+	// maxBytes is the number of bytes logged before the output is truncated,
+	// 0 if unlimited.
+	maxBytes int64
+	// now returns the current time. Replaceable by unit tests.
+	now func() time.Time
+
+	tokens    float64
+	last      time.Time
+	written   int64
+	dropped   int
+	truncated bool
+}
+
+// newOutputLimiter returns the output limiter of a script with the configured
+// limits.
+func newOutputLimiter() *outputLimiter {
+	config := cfg.Get().MetadataScripts
+	return &outputLimiter{rate: config.OutputRateLimit, maxBytes: config.OutputMaxBytes, now: time.Now}
+}
+
+// allow returns whether the line is logged, along with a marker to log before
+// it, if any, reporting the lines dropped so far.
+func (l *outputLimiter) allow(line string) (bool, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.truncated {
+		return false, ""
+	}
+	if l.maxBytes > 0 && l.written+int64(len(line)) > l.maxBytes {
+		l.truncated = true
+		return false, fmt.Sprintf("[output truncated after %d bytes, the rest of the output is not logged]", l.written)
+	}
+
+	if l.rate > 0 {
+		now := l.now()
+		if l.last.IsZero() {
+			l.tokens = float64(l.rate)
+		} else {
+			l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+			if l.tokens > float64(l.rate) {
+				l.tokens = float64(l.rate)
+			}
+		}
+		l.last = now
+		if l.tokens < 1 {
+			l.dropped++
+			return false, ""
+		}
+		l.tokens--
+	}
+
+	l.written += int64(len(line))
+	return true, l.droppedMarker()
+}
+
+// finish returns the marker reporting the lines dropped since the last logged
+// line, if any.
+func (l *outputLimiter) finish() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.droppedMarker()
+}
+
+// droppedMarker returns the marker reporting the dropped lines and resets
+// their count. The caller must hold the mutex.
+func (l *outputLimiter) droppedMarker() string {
+	if l.dropped == 0 {
+		return ""
+	}
+	marker := fmt.Sprintf("[%d lines dropped, output exceeded %d lines per second]", l.dropped, l.rate)
+	l.dropped = 0
+	return marker
+}
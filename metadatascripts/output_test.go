@@ -0,0 +1,100 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+)
+
+func TestOutputLimiterRate(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := &outputLimiter{rate: 2, now: func() time.Time { return now }}
+
+	steps := []struct {
+		advance    time.Duration
+		wantOK     bool
+		wantMarker string
+	}{
+		{wantOK: true},
+		{wantOK: true},
+		{wantOK: false},
+		{wantOK: false},
+		{advance: 500 * time.Millisecond, wantOK: true, wantMarker: "[2 lines dropped, output exceeded 2 lines per second]"},
+		{wantOK: false},
+	}
+	for i, step := range steps {
+		now = now.Add(step.advance)
+		ok, marker := l.allow("line")
+		if ok != step.wantOK || marker != step.wantMarker {
+			t.Errorf("allow() step %d = (%t, %q), want (%t, %q)", i, ok, marker, step.wantOK, step.wantMarker)
+		}
+	}
+
+	if got, want := l.finish(), "[1 lines dropped, output exceeded 2 lines per second]"; got != want {
+		t.Errorf("finish() = %q, want %q", got, want)
+	}
+	if got := l.finish(); got != "" {
+		t.Errorf("finish() = %q after the dropped lines were reported, want empty", got)
+	}
+}
+
+func TestOutputLimiterMaxBytes(t *testing.T) {
+	l := &outputLimiter{maxBytes: 10, now: time.Now}
+
+	if ok, marker := l.allow("12345"); !ok || marker != "" {
+		t.Errorf("allow(12345) = (%t, %q), want (true, \"\")", ok, marker)
+	}
+	ok, marker := l.allow("123456")
+	if ok || !strings.Contains(marker, "output truncated after 5 bytes") {
+		t.Errorf("allow(123456) = (%t, %q), want false and truncation marker", ok, marker)
+	}
+	if ok, marker := l.allow("1"); ok || marker != "" {
+		t.Errorf("allow(1) after truncation = (%t, %q), want (false, \"\")", ok, marker)
+	}
+}
+
+func TestNewOutputLimiter(t *testing.T) {
+	if err := cfg.Load([]byte("[MetadataScripts]\noutput_rate_limit = 100\noutput_max_bytes = 1048576")); err != nil {
+		t.Fatalf("cfg.Load() failed: %v", err)
+	}
+	defer cfg.Load(nil)
+
+	l := newOutputLimiter()
+	if l.rate != 100 || l.maxBytes != 1048576 {
+		t.Errorf("newOutputLimiter() = rate %d, max bytes %d, want rate 100, max bytes 1048576", l.rate, l.maxBytes)
+	}
+
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed: %v", err)
+	}
+	l = newOutputLimiter()
+	if l.rate != 100 || l.maxBytes != 10485760 {
+		t.Errorf("newOutputLimiter() = rate %d, max bytes %d with the default config, want rate 100, max bytes 10485760", l.rate, l.maxBytes)
+	}
+
+	if err := cfg.Load([]byte("[MetadataScripts]\noutput_rate_limit = 0\noutput_max_bytes = 0")); err != nil {
+		t.Fatalf("cfg.Load() failed: %v", err)
+	}
+	l = newOutputLimiter()
+	for i := 0; i < 1000; i++ {
+		if ok, _ := l.allow(strings.Repeat("x", 1024)); !ok {
+			t.Fatalf("allow() with the limits disabled dropped a line, want unlimited output")
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// partsSuffix is the suffix of the metadata key declaring the number of
+	// parts of a multi-part script, i.e. startup-script-parts.
+	partsSuffix = "-parts"
+	// partSuffix is the suffix of a multi-part script's part keys, followed by
+	// the part number starting at 1, i.e. startup-script-part-1.
+	partSuffix = "-part-"
+)
+
+// isMultiPart returns true if key is declared as a multi-part script in md.
+func isMultiPart(md map[string]string, key string) bool {
+	return strings.TrimSpace(md[key+partsSuffix]) != ""
+}
+
+// multiPartKeys returns the keys of a multi-part script set in md: its parts
+// declaration, its parts and its checksum.
+func multiPartKeys(md map[string]string, key string) []string {
+	re := regexp.MustCompile(fmt.Sprintf(`^%s[0-9]+$`, regexp.QuoteMeta(key+partSuffix)))
+
+	keys := []string{key + partsSuffix}
+	if _, ok := md[key+checksumSuffix]; ok {
+		keys = append(keys, key+checksumSuffix)
+	}
+	for mdKey := range md {
+		if re.MatchString(mdKey) {
+			keys = append(keys, mdKey)
+		}
+	}
+	return keys
+}
+
+// assembleScript returns the script's content, reassembling it from its parts
+// if it's a multi-part script. The assembled script is verified against the
+// script's checksum key if set.
+func assembleScript(key string, scripts map[string]string) (string, error) {
+	if !isMultiPart(scripts, key) {
+		return scripts[key], nil
+	}
+
+	count, err := strconv.Atoi(strings.TrimSpace(scripts[key+partsSuffix]))
+	if err != nil || count < 1 {
+		return "", fmt.Errorf("invalid %s%s value %q", key, partsSuffix, scripts[key+partsSuffix])
+	}
+	if scripts[key] != "" {
+		logger.Warningf("%s is a multi-part script, ignoring its value", key)
+	}
+
+	// The parts are concatenated as is, a script can be split anywhere.
+	var script strings.Builder
+	for i := 1; i <= count; i++ {
+		part, ok := scripts[fmt.Sprintf("%s%s%d", key, partSuffix, i)]
+		if !ok {
+			return "", fmt.Errorf("%s part %d of %d is missing", key, i, count)
+		}
+		script.WriteString(part)
+	}
+
+	if checksum := scripts[key+checksumSuffix]; checksum != "" {
+		sum := sha256.Sum256([]byte(script.String()))
+		got := hex.EncodeToString(sum[:])
+		if want := strings.ToLower(strings.TrimSpace(checksum)); got != want {
+			return "", fmt.Errorf("%s assembled script checksum mismatch, got sha256 %q, want %q", key, got, want)
+		}
+	}
+	return script.String(), nil
+}
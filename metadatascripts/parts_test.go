@@ -0,0 +1,109 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMultiPartKeys(t *testing.T) {
+	md := map[string]string{
+		"startup-script-parts":  "2",
+		"startup-script-part-1": "echo ",
+		"startup-script-part-2": "hello",
+		"startup-script-sha256": "digest",
+		"startup-script-part-x": "not a part",
+		"startup-script-1":      "numbered script",
+	}
+	want := []string{"startup-script-part-1", "startup-script-part-2", "startup-script-parts", "startup-script-sha256"}
+
+	got := multiPartKeys(md, "startup-script")
+	sort.Strings(got)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("multiPartKeys() returned unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestAssembleScript(t *testing.T) {
+	tests := []struct {
+		name    string
+		scripts map[string]string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "single_part",
+			scripts: map[string]string{"startup-script": "echo hello"},
+			want:    "echo hello",
+		},
+		{
+			name: "multi_part",
+			scripts: map[string]string{
+				"startup-script-parts":  "2",
+				"startup-script-part-1": "echo he",
+				"startup-script-part-2": "llo",
+			},
+			want: "echo hello",
+		},
+		{
+			name: "multi_part_checksum",
+			scripts: map[string]string{
+				"startup-script-parts":  "2",
+				"startup-script-part-1": "echo hello",
+				"startup-script-part-2": "\n",
+				"startup-script-sha256": "5dbad7dd0b9b122dcd9956884390f4aac4738caba8ff53498a7ab6718b176c30",
+			},
+			want: "echo hello\n",
+		},
+		{
+			name: "checksum_mismatch",
+			scripts: map[string]string{
+				"startup-script-parts":  "1",
+				"startup-script-part-1": "echo tampered",
+				"startup-script-sha256": "5dbad7dd0b9b122dcd9956884390f4aac4738caba8ff53498a7ab6718b176c30",
+			},
+			wantErr: true,
+		},
+		{
+			name: "missing_part",
+			scripts: map[string]string{
+				"startup-script-parts":  "3",
+				"startup-script-part-1": "echo ",
+				"startup-script-part-3": "hello",
+			},
+			wantErr: true,
+		},
+		{
+			name:    "invalid_count",
+			scripts: map[string]string{"startup-script-parts": "two"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := assembleScript("startup-script", tc.scripts)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("assembleScript() = %v, want error: %t", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("assembleScript() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"context"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/eventlog"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/maintenance"
+	"github.com/GoogleCloudPlatform/guest-agent/retry"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+// Phase holds the scripts of a phase found in metadata and in its local
+// scripts directory.
+type Phase struct {
+	// Name is the phase's name, i.e. startup.
+	Name string
+	// Keys are the metadata keys of the phase's scripts, in execution order.
+	Keys []string
+	// Scripts maps the script keys and their companion keys to their values.
+	Scripts map[string]string
+	// Local are the paths of the phase's local scripts, in execution order.
+	Local []string
+
+	// wanted are the phase's base keys on this OS.
+	wanted []string
+	// specialize is the state of the specialize flow the phase resumes, nil
+	// for the other phases.
+	specialize *specializeState
+}
+
+// CheckPhase returns an error if the phase is unknown or disabled on this OS.
+func CheckPhase(phase string) error {
+	_, err := getWantedKeys(phase, runtime.GOOS)
+	return err
+}
+
+// Discover returns the scripts of the phase set in the instance metadata or,
+// if none, in the project metadata, along with the shutdown and graceful
+// shutdown phases' local scripts. An error is returned for unknown or
+// disabled phases.
+func Discover(ctx context.Context, phase string) (*Phase, error) {
+	wanted, err := getWantedKeys(phase, runtime.GOOS)
+	if err != nil {
+		return nil, err
+	}
+	keys, scripts, err := getExistingKeys(ctx, wanted)
+	if err != nil {
+		return nil, err
+	}
+
+	var local []string
+	if localScriptPhases[phase] {
+		dir := localScriptsDir(phase)
+		if local, err = findLocalScripts(dir); err != nil {
+			logger.Errorf("Failed to read the %s scripts of %s: %v", phase, dir, err)
+		}
+	}
+	return &Phase{Name: phase, Keys: keys, Scripts: scripts, Local: local, wanted: wanted}, nil
+}
+
+// Plan returns how the phase's scripts would be run, without downloading or
+// running them.
+func (p *Phase) Plan() []PlanEntry {
+	return append(buildPlan(p.Keys, p.Scripts), buildLocalPlan(p.Local)...)
+}
+
+// Run runs the phase's scripts, each within its timeout and all of them within
+// the phase's timeout, and publishes their results to guest attributes. The
+// scripts run in order unless the phase has a dependencies manifest, then the
+// independent scripts run in parallel. A failed script doesn't stop the
+// scripts that don't depend on it from running. The local scripts run last.
+func (p *Phase) Run(ctx context.Context) []ScriptResult {
+	if len(p.Keys) == 0 && len(p.Local) == 0 {
+		logger.Infof("No %s scripts to run.", p.Name)
+		return nil
+	}
+
+	phaseCtx := ctx
+	if timeout := phaseTimeout(p.Name); timeout > 0 {
+		var cancel context.CancelFunc
+		phaseCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var results []ScriptResult
+	if deps := p.dependencies(); deps != nil {
+		results = p.runGraph(phaseCtx, deps)
+	} else {
+		for _, key := range p.Keys {
+			res, _ := p.runOne(phaseCtx, key)
+			results = append(results, res)
+		}
+	}
+	// The local scripts run after the metadata ones, in lexical order.
+	for _, path := range p.Local {
+		res, _ := p.runOne(phaseCtx, path)
+		results = append(results, res)
+	}
+	// The results must be published even if the phase timed out.
+	publishResults(ctx, p.Name, results)
+
+	logger.Infof("Finished running %s scripts.", p.Name)
+	return results
+}
+
+// dependencies returns the scripts' dependencies set in the phase's manifest,
+// nil if the scripts run in order.
+func (p *Phase) dependencies() map[string][]string {
+	key := dependenciesKey(p.wanted)
+	manifest, ok := p.Scripts[key]
+	if !ok {
+		return nil
+	}
+	deps, err := parseDependencies(manifest, p.Keys)
+	if err != nil {
+		logger.Errorf("Invalid %s, running the scripts in order: %v", key, err)
+		return nil
+	}
+	return deps
+}
+
+// runOne runs a script within its timeout and the phase's context, returning
+// its result and error. A failed script is retried following the phase's
+// retry policy, each attempt having the script's timeout.
+func (p *Phase) runOne(phaseCtx context.Context, key string) (ScriptResult, error) {
+	started, succeeded, failed := scriptEventIDs(p.Name)
+	if p.specialize != nil && p.specialize.skip(key) {
+		logger.Infof("Skipping %s, it completed before the %s phase was interrupted.", key, p.Name)
+		now := time.Now()
+		return newScriptResult(key, now, now, nil), nil
+	}
+	eventlog.Infof(started, "Found %s in metadata.", key)
+	start := time.Now()
+	emitEvent(ScriptEvent{Type: ScriptStarted, Phase: p.Name, Script: key, Time: start})
+	policy := scriptRetryPolicy(p.Name)
+	timeout := scriptTimeout(key, p.Scripts)
+
+	var attempts int
+	var err error
+	if p.specialize != nil {
+		err = p.specialize.start(key)
+	}
+	if err == nil {
+		retry.Run(phaseCtx, policy, func() error {
+			attempts++
+			if attempts > 1 {
+				logger.Infof("Retrying %s after error %v, attempt %d of %d.", key, err, attempts, policy.MaxAttempts)
+			}
+			err = runWithTimeout(phaseCtx, p.Name, key, timeout, func(ctx context.Context) error {
+				return p.runScript(ctx, key)
+			})
+			return err
+		})
+	}
+
+	res := newScriptResult(key, start, time.Now(), err)
+	res.Attempts = attempts
+	if p.specialize != nil {
+		p.specialize.finish(res)
+	}
+	emitEvent(ScriptEvent{Type: ScriptFinished, Phase: p.Name, Script: key, Time: res.EndTime, Result: &res})
+	if err != nil {
+		eventlog.Warningf(failed, "Script %q failed with error: %v", key, err)
+		return res, err
+	}
+	eventlog.Infof(succeeded, "%s exit status 0", key)
+	return res, nil
+}
+
+// scriptEventIDs returns the IDs of the started, succeeded and failed events
+// of the phase's scripts, the shutdown scripts being part of the shutdown
+// events.
+func scriptEventIDs(phase string) (eventlog.ID, eventlog.ID, eventlog.ID) {
+	if phase == "shutdown" || phase == "graceful-shutdown" {
+		return eventlog.ShutdownScriptStarted, eventlog.ShutdownScriptSucceeded, eventlog.ShutdownScriptFailed
+	}
+	return eventlog.ScriptStarted, eventlog.ScriptSucceeded, eventlog.ScriptFailed
+}
+
+// runScript resolves the script's value and options from its companion keys
+// and runs it, local scripts being run in place.
+func (p *Phase) runScript(ctx context.Context, key string) error {
+	if filepath.IsAbs(key) {
+		return p.runLocalScript(ctx, key)
+	}
+	value, err := assembleScript(key, p.Scripts)
+	if err != nil {
+		return err
+	}
+	env, err := scriptEnv(key, p.Scripts)
+	if err != nil {
+		return err
+	}
+	opts := scriptOptions{
+		phase:          p.Name,
+		signature:      p.Scripts[key+signatureSuffix],
+		env:            env,
+		runOnce:        isRunOnce(key, p.Scripts),
+		containerImage: strings.TrimSpace(p.Scripts[containerImageKey(p.wanted)]),
+	}
+	// Multi-part scripts were verified while being assembled.
+	if !isMultiPart(p.Scripts, key) {
+		opts.checksum = p.Scripts[key+checksumSuffix]
+	}
+	return setupAndRunScript(ctx, key, value, opts)
+}
+
+// RunPhase discovers and runs the phase's scripts, returning their results.
+// The phase doesn't run if the maintenance mode is on, unless it's generalize,
+// if it's out of the Windows sysprep sequence or if the cloud-init
+// coordination leaves it to cloud-init. Generalize turns the maintenance mode
+// on until the next boot.
+func RunPhase(ctx context.Context, phase string) ([]ScriptResult, error) {
+	// The generalize scripts prepare the image the maintenance is for.
+	if on, reason := maintenance.Enabled(); on && phase != "generalize" {
+		logger.Infof("Not running %s scripts, maintenance mode is on: %s.", phase, reason)
+		return nil, nil
+	}
+
+	p, err := Discover(ctx, phase)
+	if err != nil {
+		return nil, err
+	}
+
+	if runtime.GOOS == "windows" {
+		if err := checkSysprepSequence(phase); err != nil {
+			logger.Warningf("Not running %s scripts: %v", phase, err)
+			return nil, nil
+		}
+	}
+	if !coordinateCloudInit(phase) {
+		return nil, nil
+	}
+
+	switch phase {
+	case "specialize":
+		return p.runSpecialize(ctx), nil
+	case "generalize":
+		results := p.Run(ctx)
+		resetSpecializeState()
+		// The image is captured next, nothing must change until it boots.
+		if err := maintenance.Enable("sysprep generalize"); err != nil {
+			logger.Errorf("Failed to turn the maintenance mode on: %v", err)
+		}
+		return results, nil
+	}
+	return p.Run(ctx), nil
+}
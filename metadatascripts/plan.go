@@ -0,0 +1,215 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+)
+
+// PlanEntry is how a script would be run.
+type PlanEntry struct {
+	// Key is the script's metadata key.
+	Key string
+	// Source is where the script comes from: inline, its URL or its parts.
+	Source string
+	// Command is the command running the script, <script> standing for the
+	// script file.
+	Command string
+	// Timeout is the script's timeout, 0 if none.
+	Timeout time.Duration
+	// Checksum is true if the script's checksum is verified.
+	Checksum bool
+	// Signature is true if the script's signature is set in metadata.
+	Signature bool
+	// Env are the names of the environment variables set for the script.
+	Env []string
+	// RunOnce is true if the script is skipped once its content ran.
+	RunOnce bool
+	// Container is the image of the container the script runs in, if any.
+	Container string
+	// DependsOn are the scripts that must succeed before the script runs, set
+	// if the phase's scripts run in parallel.
+	DependsOn []string
+	// Error is why the script would not run, if any.
+	Error string
+}
+
+// planFile returns the name of the file the script would be written to, which
+// determines how it's run.
+func planFile(key string, value string, scriptURL *url.URL) string {
+	if runtime.GOOS == "windows" {
+		return normalizeFilePathForWindows("<script>", key, scriptURL)
+	}
+	// The shebang of URL scripts is only known once they are downloaded.
+	var firstLine string
+	if scriptURL == nil {
+		firstLine, _, _ = strings.Cut(strings.TrimLeft(value, " \n\v\f\t\r"), "\n")
+	}
+	if isPowerShellScript(key, "", scriptURL) || isPwshShebang(strings.TrimRight(firstLine, "\r")) {
+		return "<script>.ps1"
+	}
+	return "<script>"
+}
+
+// buildPlan resolves how each of the found scripts would be run, in execution
+// order, without downloading or running them.
+func buildPlan(keys []string, scripts map[string]string) []PlanEntry {
+	var deps map[string][]string
+	if manifest, ok := scripts[dependenciesKey(keys)]; ok {
+		if d, err := parseDependencies(manifest, keys); err == nil {
+			deps = d
+		}
+	}
+
+	var plan []PlanEntry
+	for _, key := range keys {
+		entry := PlanEntry{
+			Key:       key,
+			Source:    "inline",
+			Timeout:   scriptTimeout(key, scripts),
+			Signature: scripts[key+signatureSuffix] != "",
+			RunOnce:   isRunOnce(key, scripts),
+			Container: strings.TrimSpace(scripts[containerImageKey(keys)]),
+			DependsOn: deps[key],
+		}
+
+		value, err := assembleScript(key, scripts)
+		if err != nil {
+			entry.Error = err.Error()
+			plan = append(plan, entry)
+			continue
+		}
+
+		var scriptURL *url.URL
+		switch {
+		case isMultiPart(scripts, key):
+			entry.Source = fmt.Sprintf("%s parts", strings.TrimSpace(scripts[key+partsSuffix]))
+			entry.Checksum = scripts[key+checksumSuffix] != ""
+		case strings.HasSuffix(key, "-url"):
+			entry.Source = strings.TrimSpace(value)
+			entry.Checksum = scripts[key+checksumSuffix] != ""
+			if scriptURL, err = url.Parse(entry.Source); err != nil {
+				entry.Error = err.Error()
+			}
+		}
+
+		env, err := scriptEnv(key, scripts)
+		if err != nil && entry.Error == "" {
+			entry.Error = err.Error()
+		}
+		for _, v := range env {
+			name, _, _ := strings.Cut(v, "=")
+			entry.Env = append(entry.Env, name)
+		}
+
+		file := planFile(key, value, scriptURL)
+		if entry.Container != "" {
+			entry.Command = strings.Join(containerScriptCommand(file), " ")
+			plan = append(plan, entry)
+			continue
+		}
+		name, args, err := scriptCommand(file)
+		if err != nil {
+			if entry.Error == "" {
+				entry.Error = err.Error()
+			}
+		} else {
+			entry.Command = strings.Join(append([]string{name}, args...), " ")
+		}
+
+		plan = append(plan, entry)
+	}
+	return plan
+}
+
+// buildLocalPlan resolves how each of the local scripts would be run, in
+// execution order.
+func buildLocalPlan(paths []string) []PlanEntry {
+	var plan []PlanEntry
+	for _, path := range paths {
+		entry := PlanEntry{Key: filepath.Base(path), Source: path, Timeout: scriptTimeout(path, nil)}
+		name, args, err := scriptCommand(path)
+		if err != nil {
+			entry.Error = err.Error()
+		} else {
+			entry.Command = strings.Join(append([]string{name}, args...), " ")
+		}
+		plan = append(plan, entry)
+	}
+	return plan
+}
+
+// PrintPlan writes the phase's execution plan to w.
+func PrintPlan(w io.Writer, phase string, plan []PlanEntry) {
+	if len(plan) == 0 {
+		fmt.Fprintf(w, "No %s scripts to run.\n", phase)
+		return
+	}
+
+	config := cfg.Get().MetadataScripts
+	fmt.Fprintf(w, "Execution plan for %s scripts:\n", phase)
+	if timeout := phaseTimeout(phase); timeout > 0 {
+		fmt.Fprintf(w, "  phase timeout: %s\n", timeout)
+	}
+	if sandboxEnabled(config) {
+		fmt.Fprintf(w, "  sandboxed: yes\n")
+	}
+	if config.RequireSignature {
+		fmt.Fprintf(w, "  signatures required: yes\n")
+	}
+	if runtime.GOOS == "windows" && config.RequireAuthenticode {
+		fmt.Fprintf(w, "  authenticode required: yes\n")
+	}
+
+	for i, entry := range plan {
+		fmt.Fprintf(w, "%d. %s\n", i+1, entry.Key)
+		fmt.Fprintf(w, "  source: %s\n", entry.Source)
+		if entry.Container != "" {
+			fmt.Fprintf(w, "  container: %s\n", entry.Container)
+		}
+		if entry.Command != "" {
+			fmt.Fprintf(w, "  command: %s\n", entry.Command)
+		}
+		if entry.Timeout > 0 {
+			fmt.Fprintf(w, "  timeout: %s\n", entry.Timeout)
+		}
+		if entry.Checksum {
+			fmt.Fprintf(w, "  checksum: sha256\n")
+		}
+		if entry.Signature {
+			fmt.Fprintf(w, "  signature: metadata\n")
+		}
+		if len(entry.Env) > 0 {
+			fmt.Fprintf(w, "  env: %s\n", strings.Join(entry.Env, ", "))
+		}
+		if entry.RunOnce {
+			fmt.Fprintf(w, "  run once: yes\n")
+		}
+		if len(entry.DependsOn) > 0 {
+			fmt.Fprintf(w, "  depends on: %s\n", strings.Join(entry.DependsOn, ", "))
+		}
+		if entry.Error != "" {
+			fmt.Fprintf(w, "  error: %s\n", entry.Error)
+		}
+	}
+}
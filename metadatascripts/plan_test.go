@@ -0,0 +1,106 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"bytes"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBuildPlan(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test relies on the Linux script commands")
+	}
+
+	keys := []string{"startup-script", "startup-script-url", "startup-script-1", "startup-script-2"}
+	scripts := map[string]string{
+		"startup-script":              "\n#!/bin/bash\necho hello",
+		"startup-script-timeout":      "1m",
+		"startup-script-sig":          "signature",
+		"startup-script-url":          " gs://bucket/script.sh ",
+		"startup-script-url-sha256":   "digest",
+		"startup-script-1-parts":      "2",
+		"startup-script-1-part-1":     "echo ",
+		"startup-script-1-part-2":     "hello",
+		"startup-script-2-parts":      "2",
+		"startup-script-2-part-1":     "echo ",
+		"script-env":                  "FOO=bar",
+		"startup-script-url-env":      "BAZ=qux",
+		"startup-script-1-run-once":   "true",
+		"startup-script-url-timeout":  "invalid",
+		"shutdown-script":             "echo not planned",
+		"shutdown-script-url-timeout": "1m",
+	}
+
+	want := []PlanEntry{
+		{
+			Key:       "startup-script",
+			Source:    "inline",
+			Command:   "/bin/bash -c <script>",
+			Timeout:   time.Minute,
+			Signature: true,
+			Env:       []string{"FOO"},
+		},
+		{
+			Key:      "startup-script-url",
+			Source:   "gs://bucket/script.sh",
+			Command:  "/bin/bash -c <script>",
+			Checksum: true,
+			Env:      []string{"FOO", "BAZ"},
+		},
+		{
+			Key:     "startup-script-1",
+			Source:  "2 parts",
+			Command: "/bin/bash -c <script>",
+			Env:     []string{"FOO"},
+			RunOnce: true,
+		},
+		{
+			Key:    "startup-script-2",
+			Source: "inline",
+			Error:  "startup-script-2 part 2 of 2 is missing",
+		},
+	}
+
+	got := buildPlan(keys, scripts)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("buildPlan() returned unexpected diff (-want +got):\n%s", diff)
+	}
+
+	var buf bytes.Buffer
+	PrintPlan(&buf, "startup", got)
+	for _, line := range []string{
+		"Execution plan for startup scripts:",
+		"1. startup-script\n  source: inline\n  command: /bin/bash -c <script>\n  timeout: 1m0s\n  signature: metadata\n  env: FOO\n",
+		"  checksum: sha256\n",
+		"  run once: yes\n",
+		"  error: startup-script-2 part 2 of 2 is missing\n",
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("PrintPlan() = %q, want it to contain %q", buf.String(), line)
+		}
+	}
+
+	buf.Reset()
+	PrintPlan(&buf, "shutdown", nil)
+	if got, want := buf.String(), "No shutdown scripts to run.\n"; got != want {
+		t.Errorf("PrintPlan() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"bufio"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// isPowerShellScript returns true if a script must be run with PowerShell
+// Core: it's set with a ps1 key, its URL has the ps1 extension or its shebang
+// runs pwsh.
+func isPowerShellScript(metadataKey string, filePath string, gcsScriptURL *url.URL) bool {
+	if strings.HasSuffix(metadataKey, "-ps1") {
+		return true
+	}
+	if gcsScriptURL != nil && strings.HasSuffix(gcsScriptURL.Path, ".ps1") {
+		return true
+	}
+	return hasPwshShebang(filePath)
+}
+
+// hasPwshShebang returns true if the file's shebang interpreter is pwsh, i.e.
+// #!/usr/bin/pwsh or #!/usr/bin/env pwsh.
+func hasPwshShebang(filePath string) bool {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	in := bufio.NewScanner(f)
+	if !in.Scan() {
+		return false
+	}
+	return isPwshShebang(in.Text())
+}
+
+// isPwshShebang returns true if line is a shebang running pwsh.
+func isPwshShebang(line string) bool {
+	if !strings.HasPrefix(line, "#!") {
+		return false
+	}
+
+	fields := strings.Fields(strings.TrimPrefix(line, "#!"))
+	if len(fields) == 0 {
+		return false
+	}
+	interpreter := path.Base(fields[0])
+	if interpreter == "env" && len(fields) > 1 {
+		interpreter = fields[1]
+	}
+	return interpreter == "pwsh" || interpreter == "pwsh-preview"
+}
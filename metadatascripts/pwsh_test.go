@@ -0,0 +1,61 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsPowerShellScript(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		content string
+		url     string
+		want    bool
+	}{
+		{name: "ps1_key", key: "startup-script-ps1", content: "Write-Host hi", want: true},
+		{name: "ps1_url", key: "startup-script-url", url: "gs://bucket/script.ps1", want: true},
+		{name: "sh_url", key: "startup-script-url", url: "gs://bucket/script.sh", content: "echo hi"},
+		{name: "pwsh_shebang", key: "startup-script", content: "#!/usr/bin/pwsh\nWrite-Host hi", want: true},
+		{name: "env_pwsh_shebang", key: "startup-script", content: "#!/usr/bin/env pwsh\nWrite-Host hi", want: true},
+		{name: "bash_shebang", key: "startup-script", content: "#!/bin/bash\necho hi"},
+		{name: "no_shebang", key: "startup-script", content: "echo pwsh"},
+		{name: "empty", key: "startup-script"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			filePath := filepath.Join(t.TempDir(), tc.key)
+			if err := os.WriteFile(filePath, []byte(tc.content), 0755); err != nil {
+				t.Fatalf("failed to write test script: %v", err)
+			}
+			var scriptURL *url.URL
+			if tc.url != "" {
+				var err error
+				if scriptURL, err = url.Parse(tc.url); err != nil {
+					t.Fatalf("failed to parse %q: %v", tc.url, err)
+				}
+			}
+
+			if got := isPowerShellScript(tc.key, filePath, scriptURL); got != tc.want {
+				t.Errorf("isPowerShellScript(%q, %q, %v) = %t, want %t", tc.key, tc.content, scriptURL, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// resultsNamespace is the guest attributes namespace the phases' results
+	// are published to, the key being the phase i.e. metadata-scripts/startup.
+	resultsNamespace = "metadata-scripts"
+	// maxErrorLines is the number of stderr lines kept for a failed script.
+	maxErrorLines = 10
+	// maxErrorLineLen is the length error lines are truncated to.
+	maxErrorLineLen = 256
+)
+
+// PhaseResult is the result of a metadata scripts phase published to guest
+// attributes.
+type PhaseResult struct {
+	// Succeeded is true if all the phase's scripts exited with status 0.
+	Succeeded bool `json:"succeeded"`
+	// Scripts are the results of each script in execution order.
+	Scripts []ScriptResult `json:"scripts"`
+}
+
+// ScriptResult is the result of a single metadata script.
+type ScriptResult struct {
+	// Script is the script's metadata key.
+	Script string `json:"script"`
+	// ExitCode is the script's exit status, -1 if the script couldn't be run.
+	ExitCode int `json:"exitCode"`
+	// StartTime is when the script was set up.
+	StartTime time.Time `json:"startTime"`
+	// EndTime is when the script finished.
+	EndTime time.Time `json:"endTime"`
+	// Error is the error message if the script failed.
+	Error string `json:"error,omitempty"`
+	// LastErrorLines are the last (truncated) stderr lines of a failed script.
+	LastErrorLines []string `json:"lastErrorLines,omitempty"`
+	// Attempts is the number of times the script ran, more than 1 if it was
+	// retried.
+	Attempts int `json:"attempts,omitempty"`
+}
+
+// scriptError is returned by runCmd when the command fails, it carries the
+// command's last stderr lines.
+type scriptError struct {
+	err       error
+	lastLines []string
+}
+
+func (e *scriptError) Error() string {
+	return e.err.Error()
+}
+
+func (e *scriptError) Unwrap() error {
+	return e.err
+}
+
+// lineTail keeps the last maxErrorLines lines written to it.
+type lineTail struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+// add adds a line to the tail, truncating it if too long.
+func (t *lineTail) add(line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(line) > maxErrorLineLen {
+		line = line[:maxErrorLineLen]
+	}
+	t.lines = append(t.lines, line)
+	if len(t.lines) > maxErrorLines {
+		t.lines = t.lines[len(t.lines)-maxErrorLines:]
+	}
+}
+
+// get returns a copy of the lines kept.
+func (t *lineTail) get() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.lines...)
+}
+
+// newScriptResult returns the result of a script given the error returned
+// running it.
+func newScriptResult(name string, start, end time.Time, err error) ScriptResult {
+	res := ScriptResult{Script: name, StartTime: start, EndTime: end}
+	if err == nil {
+		return res
+	}
+
+	res.ExitCode = -1
+	res.Error = err.Error()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		res.ExitCode = exitErr.ExitCode()
+	}
+	var scriptErr *scriptError
+	if errors.As(err, &scriptErr) {
+		res.LastErrorLines = scriptErr.lastLines
+	}
+	return res
+}
+
+// publishResults writes the phase's scripts results to guest attributes.
+func publishResults(ctx context.Context, phase string, results []ScriptResult) {
+	phaseResult := PhaseResult{Succeeded: true, Scripts: results}
+	for _, res := range results {
+		if res.ExitCode != 0 {
+			phaseResult.Succeeded = false
+		}
+	}
+
+	data, err := json.Marshal(phaseResult)
+	if err != nil {
+		logger.Errorf("Failed to marshal %s scripts results: %v", phase, err)
+		return
+	}
+
+	if err := client.WriteGuestAttributes(ctx, resultsNamespace+"/"+phase, string(data)); err != nil {
+		logger.Warningf("Failed to publish %s scripts results to guest attributes: %v", phase, err)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// attrsMDSClient records the guest attributes written.
+type attrsMDSClient struct {
+	mdsClient
+	attrs map[string]string
+}
+
+func (mds *attrsMDSClient) WriteGuestAttributes(ctx context.Context, key string, value string) error {
+	mds.attrs[key] = value
+	return nil
+}
+
+func TestLineTail(t *testing.T) {
+	tail := &lineTail{}
+	for i := 0; i < maxErrorLines+2; i++ {
+		tail.add(fmt.Sprintf("line %d", i))
+	}
+	tail.add(strings.Repeat("x", maxErrorLineLen+10))
+
+	got := tail.get()
+	if len(got) != maxErrorLines {
+		t.Fatalf("lineTail kept %d lines, want %d", len(got), maxErrorLines)
+	}
+	if got[0] != "line 3" {
+		t.Errorf("lineTail first line = %q, want %q", got[0], "line 3")
+	}
+	if last := got[len(got)-1]; len(last) != maxErrorLineLen {
+		t.Errorf("lineTail last line length = %d, want %d", len(last), maxErrorLineLen)
+	}
+}
+
+func TestNewScriptResult(t *testing.T) {
+	start := time.Now()
+	end := start.Add(time.Second)
+
+	if got := newScriptResult("startup-script", start, end, nil); got.ExitCode != 0 || got.Error != "" {
+		t.Errorf("newScriptResult(nil) = %+v, want exit code 0 and no error", got)
+	}
+
+	got := newScriptResult("startup-script-url", start, end, fmt.Errorf("download failed"))
+	if got.ExitCode != -1 {
+		t.Errorf("newScriptResult(download failed) exit code = %d, want -1", got.ExitCode)
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	err := exec.Command("/bin/sh", "-c", "exit 3").Run()
+	lines := []string{"something failed"}
+	got = newScriptResult("startup-script", start, end, &scriptError{err: err, lastLines: lines})
+	if got.ExitCode != 3 {
+		t.Errorf("newScriptResult(exit 3) exit code = %d, want 3", got.ExitCode)
+	}
+	if !reflect.DeepEqual(got.LastErrorLines, lines) {
+		t.Errorf("newScriptResult(exit 3) last error lines = %v, want %v", got.LastErrorLines, lines)
+	}
+}
+
+func TestPublishResults(t *testing.T) {
+	originalClient := client
+	t.Cleanup(func() { client = originalClient })
+	mds := &attrsMDSClient{attrs: make(map[string]string)}
+	client = mds
+
+	results := []ScriptResult{
+		{Script: "startup-script", ExitCode: 0},
+		{Script: "startup-script-url", ExitCode: 1},
+	}
+	publishResults(context.Background(), "startup", results)
+
+	var got PhaseResult
+	if err := json.Unmarshal([]byte(mds.attrs["metadata-scripts/startup"]), &got); err != nil {
+		t.Fatalf("failed to unmarshal published results: %v", err)
+	}
+	if got.Succeeded {
+		t.Errorf("published results succeeded = true, want false")
+	}
+	if len(got.Scripts) != len(results) {
+		t.Errorf("published %d script results, want %d", len(got.Scripts), len(results))
+	}
+}
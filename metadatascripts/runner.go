@@ -0,0 +1,770 @@
+// Copyright 2017 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metadatascripts discovers, downloads and runs the metadata scripts
+// of Google Compute Engine instances. It's used by the metadata script runner
+// and by the other tools running metadata-defined scripts, i.e. the graceful
+// shutdown handler.
+package metadatascripts
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-agent/retry"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	storageURL     = "storage.googleapis.com"
+	bucket         = "([a-z0-9][-_.a-z0-9]*)"
+	object         = "(.+)"
+	defaultTimeout = 20 * time.Second
+)
+
+var (
+	powerShellArgs = []string{"-NoProfile", "-NoLogo", "-ExecutionPolicy", "Unrestricted", "-File"}
+	// ErrUsage is returned for an unknown phase.
+	ErrUsage = fmt.Errorf("no valid arguments specified. Specify one of \"startup\", \"shutdown\", \"specialize\", \"generalize\", \"graceful-shutdown\", \"pre-suspend\", \"post-resume\" or \"hibernate\"")
+	// pwshArgs are the PowerShell Core arguments used on Linux, where the
+	// execution policy doesn't apply.
+	pwshArgs = []string{"-NoProfile", "-NoLogo", "-NonInteractive", "-File"}
+
+	// Many of the Google Storage URLs are supported below.
+	// It is preferred that customers specify their object using
+	// its gs://<bucket>/<object> URL.
+	gsRegex = regexp.MustCompile(fmt.Sprintf(`^gs://%s/%s$`, bucket, object))
+
+	// Check for the Google Storage URLs:
+	// http://<bucket>.storage.googleapis.com/<object>
+	// https://<bucket>.storage.googleapis.com/<object>
+	gsHTTPRegex1 = regexp.MustCompile(fmt.Sprintf(`^http[s]?://%s\.storage\.googleapis\.com/%s$`, bucket, object))
+
+	// http://storage.cloud.google.com/<bucket>/<object>
+	// https://storage.cloud.google.com/<bucket>/<object>
+	gsHTTPRegex2 = regexp.MustCompile(fmt.Sprintf(`^http[s]?://storage\.cloud\.google\.com/%s/%s$`, bucket, object))
+
+	// Check for the other possible Google Storage URLs:
+	// http://storage.googleapis.com/<bucket>/<object>
+	// https://storage.googleapis.com/<bucket>/<object>
+	//
+	// The following are deprecated but also checked:
+	// http://commondatastorage.googleapis.com/<bucket>/<object>
+	// https://commondatastorage.googleapis.com/<bucket>/<object>
+	gsHTTPRegex3 = regexp.MustCompile(fmt.Sprintf(`^http[s]?://(?:commondata)?storage\.googleapis\.com/%s/%s$`, bucket, object))
+
+	// testStorageClient is used to override GCS client in unit tests.
+	testStorageClient *storage.Client
+
+	client metadata.MDSClientInterface
+	// defaultRetryPolicy is default policy to retry up to 3 times, only wait 1 second between retries.
+	defaultRetryPolicy = retry.Policy{MaxAttempts: 3, BackoffFactor: 1, Jitter: time.Second}
+)
+
+func init() {
+	client = metadata.New()
+}
+
+func newStorageClient(ctx context.Context) (*storage.Client, error) {
+	if testStorageClient != nil {
+		return testStorageClient, nil
+	}
+	return storage.NewClient(ctx)
+}
+
+func downloadGSURL(ctx context.Context, bucket, object string, file *os.File) error {
+	client, err := newStorageClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create storage client: %v", err)
+	}
+	defer client.Close()
+
+	obj := client.Bucket(bucket).Object(object)
+	gsURL := fmt.Sprintf("gs://%s/%s", bucket, object)
+
+	// The cached script is used if the object's generation didn't change.
+	var generation string
+	cache := newScriptCache()
+	if cache != nil {
+		attrs, err := retry.RunWithResponse(ctx, defaultRetryPolicy, func() (*storage.ObjectAttrs, error) {
+			return obj.Attrs(ctx)
+		})
+		if err != nil {
+			logger.Debugf("Failed to get %s attributes, not using the download cache: %v", gsURL, err)
+		} else {
+			generation = strconv.FormatInt(attrs.Generation, 10)
+			if cache.version(gsURL) == generation {
+				if err := useCachedScript(cache, gsURL, file); err == nil {
+					logger.Infof("Using cached %s, generation %s.", gsURL, generation)
+					return nil
+				}
+			}
+		}
+	}
+
+	// A resumed download reads the same generation, the object may have been
+	// overwritten since the download started.
+	var readGeneration int64
+	err = resumableDownload(ctx, gsURL, file, func(ctx context.Context, offset int64) (io.ReadCloser, error) {
+		o := obj
+		if readGeneration != 0 {
+			o = obj.Generation(readGeneration)
+		}
+		r, err := o.NewRangeReader(ctx, offset, -1)
+		if err != nil {
+			return nil, err
+		}
+		if readGeneration == 0 {
+			readGeneration = r.Attrs.Generation
+		}
+		return r, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if generation != "" {
+		if err := cache.store(gsURL, generation, file); err != nil {
+			logger.Warningf("Failed to cache %s: %v", gsURL, err)
+		}
+	}
+	return nil
+}
+
+func downloadURL(ctx context.Context, url string, file *os.File) error {
+	// The cached script is used if the server reports it's not modified.
+	var etag string
+	cache := newScriptCache()
+	if cache != nil {
+		etag = cache.version(url)
+	}
+
+	auth, err := urlAuthorization(ctx, url)
+	if err != nil {
+		return err
+	}
+
+	var notModified bool
+	// validator identifies the downloaded content, a range is only requested
+	// along with it so that it's only served if the content didn't change.
+	var newETag, validator string
+	err = resumableDownload(ctx, url, file, func(ctx context.Context, offset int64) (io.ReadCloser, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, &permanentError{err: err}
+		}
+		if offset > 0 && validator == "" {
+			logger.Infof("%q has no ETag or Last-Modified, restarting the download.", url)
+			if err := resetFile(file); err != nil {
+				return nil, &permanentError{err: err}
+			}
+			offset = 0
+		}
+		if offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+			req.Header.Set("If-Range", validator)
+		} else if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case res.StatusCode == http.StatusNotModified && offset == 0 && etag != "":
+			res.Body.Close()
+			notModified = true
+			return http.NoBody, nil
+		case res.StatusCode == http.StatusPartialContent && offset > 0:
+			return res.Body, nil
+		case res.StatusCode == http.StatusOK:
+			if offset > 0 {
+				// The range was not served, the content is downloaded again.
+				if err := resetFile(file); err != nil {
+					res.Body.Close()
+					return nil, &permanentError{err: err}
+				}
+			}
+			newETag = res.Header.Get("ETag")
+			validator = rangeValidator(res.Header)
+			return res.Body, nil
+		case res.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+			res.Body.Close()
+			if err := resetFile(file); err != nil {
+				return nil, &permanentError{err: err}
+			}
+			return nil, fmt.Errorf("GET %q, range not satisfiable, restarting the download", url)
+		}
+		res.Body.Close()
+		return nil, httpStatusError(url, res)
+	})
+	if err != nil {
+		return err
+	}
+
+	if notModified {
+		if err := useCachedScript(cache, url, file); err != nil {
+			// The cache entry was invalidated, download it again.
+			return downloadURL(ctx, url, file)
+		}
+		logger.Infof("Using cached %q, ETag %s.", url, etag)
+		return nil
+	}
+
+	if cache != nil && newETag != "" {
+		if err := cache.store(url, newETag, file); err != nil {
+			logger.Warningf("Failed to cache %q: %v", url, err)
+		}
+	}
+	return nil
+}
+
+// rangeValidator returns the If-Range validator of a response, its strong
+// ETag or else its Last-Modified date. Weak ETags can't be used with If-Range.
+func rangeValidator(header http.Header) string {
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return header.Get("Last-Modified")
+}
+
+// downloadScript downloads the script at path to file, within the configured
+// download timeout.
+func downloadScript(ctx context.Context, path string, file *os.File) error {
+	if timeout := downloadTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// Startup scripts may run before DNS is running on some systems,
+	// particularly once a system is promoted to a domain controller.
+	// Try to lookup storage.googleapis.com and sleep for up to 100s if
+	// we get an error.
+	policy := retry.Policy{MaxAttempts: 20, BackoffFactor: 1, Jitter: time.Second * 5}
+	err := retry.Run(ctx, policy, func() error {
+		_, err := net.LookupHost(storageURL)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("%q lookup failed, err: %+v", storageURL, err)
+	}
+
+	if arURL := artifactRegistryURL(path); arURL != "" {
+		return downloadURL(ctx, arURL, file)
+	}
+
+	bucket, object := parseGCS(path)
+	if bucket != "" && object != "" {
+		err = downloadGSURL(ctx, bucket, object, file)
+		if err == nil {
+			logger.Debugf("Succesfull download using GSURL, bucket: %s, object: %s, file: %+v",
+				bucket, object, file)
+			return nil
+		}
+
+		logger.Infof("Failed to download object [%s] from GCS bucket [%s], err: %+v", object, bucket, err)
+		if err := resetFile(file); err != nil {
+			return err
+		}
+
+		logger.Infof("Trying unauthenticated download")
+		path = fmt.Sprintf("https://%s/%s/%s", storageURL, bucket, object)
+	}
+
+	// Fall back to an HTTP GET of the URL.
+	return downloadURL(ctx, path, file)
+}
+
+func parseGCS(path string) (string, string) {
+	for _, re := range []*regexp.Regexp{gsRegex, gsHTTPRegex1, gsHTTPRegex2, gsHTTPRegex3} {
+		match := re.FindStringSubmatch(path)
+		if len(match) == 3 {
+			return match[1], match[2]
+		}
+	}
+	return "", ""
+}
+
+func getMetadataKey(ctx context.Context, key string) (string, error) {
+	md, err := getMetadata(ctx, key, false)
+	if err != nil {
+		return "", err
+	}
+	return string(md), nil
+}
+
+func getMetadataAttributes(ctx context.Context, key string) (map[string]string, error) {
+	md, err := getMetadata(ctx, key, true)
+	if err != nil {
+		return nil, err
+	}
+	var att map[string]string
+	return att, json.Unmarshal(md, &att)
+}
+
+func getMetadata(ctx context.Context, key string, recurse bool) ([]byte, error) {
+	var resp string
+	var err error
+
+	if recurse {
+		resp, err = client.GetKeyRecursive(ctx, key)
+	} else {
+		resp, err = client.GetKey(ctx, key, nil)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to get %q from MDS, with recursive flag set to %t: %w", key, recurse, err)
+	}
+
+	return []byte(resp), nil
+}
+
+func normalizeFilePathForWindows(filePath string, metadataKey string, gcsScriptURL *url.URL) string {
+	// If either the metadataKey ends in one of these extensions OR if this is a url startup script and if the
+	// url path ends in one of these extensions, append the extension to the filePath name so that Windows can recognize it.
+	for _, ext := range []string{"bat", "cmd", "ps1", "exe"} {
+		if strings.HasSuffix(metadataKey, "-"+ext) || (gcsScriptURL != nil && strings.HasSuffix(gcsScriptURL.Path, "."+ext)) {
+			filePath = fmt.Sprintf("%s.%s", filePath, ext)
+			break
+		}
+	}
+	return filePath
+}
+
+func writeScriptToFile(ctx context.Context, value string, filePath string, gcsScriptURL *url.URL) error {
+	// Create or download files.
+	if gcsScriptURL != nil {
+		file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+		if err != nil {
+			return fmt.Errorf("error opening temp file: %v", err)
+		}
+		if err := downloadScript(ctx, value, file); err != nil {
+			file.Close()
+			return err
+		}
+		if err := file.Close(); err != nil {
+			return fmt.Errorf("error closing temp file: %v", err)
+		}
+	} else {
+		// Trim leading spaces and newlines.
+		value = strings.TrimLeft(value, " \n\v\f\t\r")
+		if err := os.WriteFile(filePath, []byte(value), 0755); err != nil {
+			return fmt.Errorf("error writing temp file: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// scriptOptions are the options of a script, set with its companion keys.
+type scriptOptions struct {
+	// phase is the phase running the script, i.e. startup, labeling its output.
+	phase string
+	// checksum is the expected SHA256 digest of the downloaded script.
+	checksum string
+	// signature is the script's detached signature set in metadata.
+	signature string
+	// env are the environment variables added to the script's environment.
+	env []string
+	// runOnce skips the script if the same content already ran successfully.
+	runOnce bool
+	// containerImage is the image of the container the script runs in, the
+	// script runs on the host if empty.
+	containerImage string
+}
+
+// setupAndRunScript writes or downloads the script and runs it, if the
+// checksum is set the downloaded script's SHA256 digest must match it. When
+// signatures are required the script must be signed.
+func setupAndRunScript(ctx context.Context, metadataKey string, value string, opts scriptOptions) error {
+	// Make sure that the URL is valid for URL startup scripts
+	var gcsScriptURL *url.URL
+	if strings.HasSuffix(metadataKey, "-url") {
+		var err error
+		gcsScriptURL, err = url.Parse(strings.TrimSpace(value))
+		if err != nil {
+			return err
+		}
+	}
+
+	// Make temp directory.
+	tmpDir, err := os.MkdirTemp(cfg.Get().MetadataScripts.RunDir, "metadata-scripts")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tmpFile := filepath.Join(tmpDir, metadataKey)
+	if runtime.GOOS == "windows" {
+		tmpFile = normalizeFilePathForWindows(tmpFile, metadataKey, gcsScriptURL)
+	}
+
+	if err := writeScriptToFile(ctx, value, tmpFile, gcsScriptURL); err != nil {
+		return fmt.Errorf("unable to write script to file: %v", err)
+	}
+
+	if runtime.GOOS != "windows" && isPowerShellScript(metadataKey, tmpFile, gcsScriptURL) {
+		// PowerShell only runs files with the ps1 extension.
+		if err := os.Rename(tmpFile, tmpFile+".ps1"); err != nil {
+			return fmt.Errorf("unable to rename PowerShell script: %v", err)
+		}
+		tmpFile += ".ps1"
+	}
+
+	if opts.checksum != "" {
+		if err := verifyChecksum(tmpFile, opts.checksum); err != nil {
+			return fmt.Errorf("refusing to run %s: %v", metadataKey, err)
+		}
+	}
+
+	if cfg.Get().MetadataScripts.RequireSignature {
+		var scriptURL string
+		if gcsScriptURL != nil {
+			scriptURL = strings.TrimSpace(value)
+		}
+		if err := checkSignature(ctx, tmpFile, opts.signature, scriptURL); err != nil {
+			return fmt.Errorf("refusing to run %s: %v", metadataKey, err)
+		}
+	}
+
+	if cfg.Get().MetadataScripts.ExpandTemplates && !strings.HasSuffix(tmpFile, ".exe") {
+		data, err := getTemplateData(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to get template data: %v", err)
+		}
+		if err := expandTemplate(tmpFile, data); err != nil {
+			return fmt.Errorf("refusing to run %s: %v", metadataKey, err)
+		}
+	}
+
+	// The signature covers the file PowerShell runs, i.e. after expansion.
+	if runtime.GOOS == "windows" && cfg.Get().MetadataScripts.RequireAuthenticode && strings.HasSuffix(tmpFile, ".ps1") {
+		if err := checkAuthenticode(ctx, metadataKey, tmpFile); err != nil {
+			return fmt.Errorf("refusing to run %s: %v", metadataKey, err)
+		}
+	}
+
+	var fingerprint string
+	if opts.runOnce {
+		if fingerprint, err = fileFingerprint(tmpFile); err != nil {
+			return fmt.Errorf("unable to fingerprint %s: %v", metadataKey, err)
+		}
+		if alreadyRan(metadataKey, fingerprint) {
+			logger.Infof("%s already ran with the same content, skipping it.", metadataKey)
+			return nil
+		}
+	}
+
+	if err := runScript(ctx, tmpFile, metadataKey, opts); err != nil {
+		return err
+	}
+
+	if opts.runOnce {
+		if err := recordRun(metadataKey, fingerprint); err != nil {
+			logger.Warningf("Failed to record %s run: %v", metadataKey, err)
+		}
+	}
+	return nil
+}
+
+// scriptCommand returns the command running the script at filePath.
+func scriptCommand(filePath string) (string, []string, error) {
+	if strings.HasSuffix(filePath, ".ps1") {
+		if runtime.GOOS == "windows" {
+			return "powershell.exe", append(powerShellArgs, filePath), nil
+		}
+		pwsh, err := exec.LookPath("pwsh")
+		if err != nil {
+			return "", nil, fmt.Errorf("PowerShell Core (pwsh) is not installed: %v", err)
+		}
+		return pwsh, append(pwshArgs, filePath), nil
+	}
+	if runtime.GOOS == "windows" {
+		return filePath, nil, nil
+	}
+	return cfg.Get().MetadataScripts.DefaultShell, []string{"-c", filePath}, nil
+}
+
+// Craft the command to run.
+// The script and the processes it started are killed when ctx is done.
+func runScript(ctx context.Context, filePath string, metadataKey string, opts scriptOptions) error {
+	name, args, cleanup, err := prepareScriptCommand(filePath, metadataKey, opts)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	if len(opts.env) > 0 {
+		cmd.Env = append(os.Environ(), opts.env...)
+	}
+	setKillOnCancel(cmd)
+	return runCmd(cmd, opts.phase, metadataKey)
+}
+
+// prepareScriptCommand returns the command running the script at filePath,
+// in its container or sandbox, along with the function cleaning them up once
+// the script finished. Containers are run outside of the sandbox, the
+// container runtime isolates the script and its client must be able to reach
+// the runtime's daemon.
+func prepareScriptCommand(filePath string, metadataKey string, opts scriptOptions) (string, []string, func(), error) {
+	if opts.containerImage != "" {
+		name, args, cleanup, err := containerCommand(opts.containerImage, metadataKey, filePath, opts.env)
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("failed to set up script container: %v", err)
+		}
+		return name, args, cleanup, nil
+	}
+
+	name, args, err := scriptCommand(filePath)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	name, args, teardown, err := setupSandbox(metadataKey, filePath, name, args)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("failed to set up script sandbox: %v", err)
+	}
+	return name, args, teardown, nil
+}
+
+// runCmd runs the command streaming its stdout and stderr lines to the logger,
+// which also sends them to Cloud Logging when enabled.
+func runCmd(c *exec.Cmd, phase string, name string) error {
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer outR.Close()
+
+	errR, errW, err := os.Pipe()
+	if err != nil {
+		outW.Close()
+		return err
+	}
+	defer errR.Close()
+
+	c.Stdout = outW
+	c.Stderr = errW
+
+	err = c.Start()
+	outW.Close()
+	errW.Close()
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	tail := &lineTail{}
+	limiter := newOutputLimiter()
+	for stream, r := range map[string]io.Reader{"stdout": outR, "stderr": errR} {
+		var streamTail *lineTail
+		if stream == "stderr" {
+			streamTail = tail
+		}
+		wg.Add(1)
+		go func(stream string, r io.Reader, tail *lineTail) {
+			defer wg.Done()
+			streamOutput(r, phase, name, stream, tail, limiter)
+		}(stream, r, streamTail)
+	}
+	wg.Wait()
+	if marker := limiter.finish(); marker != "" {
+		logOutput(phase, name, "stdout", marker)
+	}
+
+	if err := c.Wait(); err != nil {
+		return &scriptError{err: err, lastLines: tail.get()}
+	}
+	return nil
+}
+
+// streamOutput logs each line read from r as soon as it's read, labeled with
+// the phase, script and stream so they can be filtered in Cloud Logging. The
+// logged lines are throttled and capped by limiter, a marker reporting the
+// dropped ones. If tail is not nil all the lines are also added to it.
+func streamOutput(r io.Reader, phase string, name string, stream string, tail *lineTail, limiter *outputLimiter) {
+	in := bufio.NewScanner(r)
+	for in.Scan() {
+		if tail != nil {
+			tail.add(in.Text())
+		}
+		ok, marker := limiter.allow(in.Text())
+		if marker != "" {
+			logOutput(phase, name, stream, marker)
+		}
+		if ok {
+			logOutput(phase, name, stream, in.Text())
+		}
+	}
+	if err := in.Err(); err != nil {
+		logger.Errorf("error while communicating with %q script: %v", name, err)
+	}
+}
+
+// logOutput logs a line of the script's output stream.
+func logOutput(phase string, name string, stream string, line string) {
+	logger.Log(logger.LogEntry{
+		Message: fmt.Sprintf("%s: %s", name, line),
+		Labels: map[string]string{
+			"phase":  phase,
+			"script": name,
+			"stream": stream,
+		},
+		Severity: logger.Info,
+		// One more than the default for logOutput itself, the output is
+		// reported as logged by runCmd as it was before it was streamed.
+		CallDepth: 3,
+	})
+}
+
+// getWantedKeys returns the list of keys to check for a given phase and OS.
+func getWantedKeys(phase string, os string) ([]string, error) {
+	prefix := phase
+	switch prefix {
+	case "specialize":
+		prefix = "sysprep-specialize"
+		if !cfg.Get().MetadataScripts.SysprepSpecialize {
+			return nil, fmt.Errorf("sysprep specialize scripts disabled in instance config")
+		}
+	case "generalize":
+		prefix = "sysprep-generalize"
+		if !cfg.Get().MetadataScripts.SysprepGeneralize {
+			return nil, fmt.Errorf("sysprep generalize scripts disabled in instance config")
+		}
+	case "startup":
+		if os == "windows" {
+			prefix = "windows-" + prefix
+			if !cfg.Get().MetadataScripts.StartupWindows {
+				return nil, fmt.Errorf("windows startup scripts disabled in instance config")
+			}
+		} else {
+			if !cfg.Get().MetadataScripts.Startup {
+				return nil, fmt.Errorf("startup scripts disabled in instance config")
+			}
+		}
+	case "shutdown":
+		if os == "windows" {
+			prefix = "windows-" + prefix
+			if !cfg.Get().MetadataScripts.ShutdownWindows {
+				return nil, fmt.Errorf("windows shutdown scripts disabled in instance config")
+			}
+		} else {
+			if !cfg.Get().MetadataScripts.Shutdown {
+				return nil, fmt.Errorf("shutdown scripts disabled in instance config")
+			}
+		}
+	case "graceful-shutdown", "pre-suspend", "post-resume", "hibernate":
+		if os == "windows" {
+			prefix = "windows-" + prefix
+		}
+	default:
+		return nil, ErrUsage
+	}
+
+	var mdkeys []string
+	var suffixes []string
+	if os == "windows" {
+		suffixes = []string{"ps1", "cmd", "bat", "url"}
+	} else {
+		// The ps1 scripts are run with PowerShell Core on Linux.
+		suffixes = []string{"ps1", "url"}
+		// The 'bare' startup-script or shutdown-script key, not supported on Windows.
+		mdkeys = append(mdkeys, fmt.Sprintf("%s-script", prefix))
+	}
+
+	for _, suffix := range suffixes {
+		mdkeys = append(mdkeys, fmt.Sprintf("%s-script-%s", prefix, suffix))
+	}
+
+	return mdkeys, nil
+}
+
+func parseMetadata(md map[string]string, wanted []string) map[string]string {
+	found := make(map[string]string)
+	for _, key := range wanted {
+		val, ok := md[key]
+		if !ok || val == "" {
+			continue
+		}
+		found[key] = val
+	}
+	return found
+}
+
+// getExistingKeys returns the wanted keys and their numbered forms that are set
+// in metadata, in execution order, along with their values. The companion keys
+// of the found keys, the multi-part scripts' keys and the phase's container
+// image and dependencies keys are read from the same attributes.
+func getExistingKeys(ctx context.Context, wanted []string) ([]string, map[string]string, error) {
+	for _, attrs := range []string{"/instance/attributes", "/project/attributes"} {
+		md, err := getMetadataAttributes(ctx, attrs)
+		if err != nil {
+			return nil, nil, err
+		}
+		keys := append(append([]string{}, wanted...), findNumberedKeys(md, wanted)...)
+		for key, want := range misnumberedKeys(md, wanted) {
+			logger.Errorf("Ignoring %s, the number of a script key goes before its suffix, i.e. %s.", key, want)
+		}
+		found := parseMetadata(md, keys)
+		for _, key := range keys {
+			if !isMultiPart(md, key) {
+				continue
+			}
+			// A multi-part script is found even if its own key is not set.
+			found[key] = md[key]
+			for _, partKey := range multiPartKeys(md, key) {
+				found[partKey] = md[partKey]
+			}
+		}
+		if len(found) == 0 {
+			continue
+		}
+		companions := append(companionKeys(keys), containerImageKey(wanted), dependenciesKey(wanted))
+		for key, val := range parseMetadata(md, companions) {
+			found[key] = val
+		}
+
+		var ordered []string
+		for _, key := range keys {
+			if _, ok := found[key]; ok {
+				ordered = append(ordered, key)
+			}
+		}
+		return ordered, found, nil
+	}
+	return nil, nil, nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+// runOnceSuffix is the suffix of the metadata key enabling a script's run-once
+// mode, i.e. startup-script-run-once.
+const runOnceSuffix = "-run-once"
+
+// isRunOnce returns true if the script key's run-once mode is enabled.
+func isRunOnce(key string, scripts map[string]string) bool {
+	value, ok := scripts[key+runOnceSuffix]
+	if !ok {
+		return false
+	}
+	runOnce, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		logger.Errorf("%s%s %q is not a valid boolean, ignoring it", key, runOnceSuffix, value)
+		return false
+	}
+	return runOnce
+}
+
+// runOnceDir returns the configured run-once directory or the OS default one.
+func runOnceDir() string {
+	if dir := cfg.Get().MetadataScripts.RunOnceDir; dir != "" {
+		return dir
+	}
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("ProgramData"), "Google", "Compute Engine", "metadata-scripts-run-once")
+	}
+	return "/var/lib/google-metadata-scripts/run-once"
+}
+
+// fileFingerprint returns the hex encoded SHA256 digest of the file's content.
+func fileFingerprint(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// alreadyRan returns true if the script key ran successfully with the content
+// of the given fingerprint.
+func alreadyRan(key string, fingerprint string) bool {
+	data, err := os.ReadFile(filepath.Join(runOnceDir(), key))
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(string(data)) == fingerprint
+}
+
+// recordRun records the script key ran successfully with the content of the
+// given fingerprint.
+func recordRun(key string, fingerprint string) error {
+	dir := runOnceDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create run-once directory: %v", err)
+	}
+	return os.WriteFile(filepath.Join(dir, key), []byte(fingerprint), 0600)
+}
@@ -0,0 +1,101 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+)
+
+func TestIsRunOnce(t *testing.T) {
+	scripts := map[string]string{
+		"startup-script-run-once":     "true",
+		"startup-script-url-run-once": "invalid",
+		"startup-script-1-run-once":   " FALSE ",
+	}
+	for key, want := range map[string]bool{
+		"startup-script":     true,
+		"startup-script-url": false,
+		"startup-script-1":   false,
+		"startup-script-2":   false,
+	} {
+		if got := isRunOnce(key, scripts); got != want {
+			t.Errorf("isRunOnce(%q) = %t, want %t", key, got, want)
+		}
+	}
+}
+
+func TestSetupAndRunScriptRunOnce(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test relies on a POSIX shell")
+	}
+
+	dir := t.TempDir()
+	if err := cfg.Load([]byte(fmt.Sprintf("[MetadataScripts]\nrun_once_dir = %s", filepath.Join(dir, "run-once")))); err != nil {
+		t.Fatalf("cfg.Load() failed: %v", err)
+	}
+	defer cfg.Load(nil)
+
+	out := filepath.Join(dir, "out")
+	runs := func() string {
+		data, err := os.ReadFile(out)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatalf("failed to read script output: %v", err)
+		}
+		return string(data)
+	}
+
+	ctx := context.Background()
+	opts := scriptOptions{runOnce: true}
+	steps := []struct {
+		script  string
+		wantErr bool
+		want    string
+	}{
+		// The script runs the first time.
+		{script: "printf a >> " + out, want: "a"},
+		// The same content is skipped.
+		{script: "printf a >> " + out, want: "a"},
+		// A new content runs.
+		{script: "printf b >> " + out, want: "ab"},
+		// A failed run is not recorded, it runs again.
+		{script: "printf c >> " + out + "; exit 1", wantErr: true, want: "abc"},
+		{script: "printf c >> " + out + "; exit 1", wantErr: true, want: "abcc"},
+	}
+
+	for i, step := range steps {
+		err := setupAndRunScript(ctx, "startup-script", step.script, opts)
+		if (err != nil) != step.wantErr {
+			t.Fatalf("step %d: setupAndRunScript() = %v, want error: %t", i, err, step.wantErr)
+		}
+		if got := runs(); got != step.want {
+			t.Errorf("step %d: script output = %q, want %q", i, got, step.want)
+		}
+	}
+
+	// Without run-once the script always runs.
+	if err := setupAndRunScript(ctx, "startup-script", "printf b >> "+out, scriptOptions{}); err != nil {
+		t.Fatalf("setupAndRunScript() failed: %v", err)
+	}
+	if got, want := runs(), "abccb"; got != want {
+		t.Errorf("script output = %q, want %q", got, want)
+	}
+}
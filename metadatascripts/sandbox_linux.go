@@ -0,0 +1,113 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package metadatascripts
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+var (
+	// stopUnit stops a systemd unit. Replaceable by unit tests.
+	stopUnit = func(unit string) error {
+		return exec.Command("systemctl", "stop", unit).Run()
+	}
+)
+
+// sandboxArgs returns the command wrapping a script's command in the sandbox:
+// a transient systemd scope owning the script's cgroup, running as the
+// configured user and optionally in new mount and PID namespaces.
+func sandboxArgs(config *cfg.MetadataScripts, unit string) []string {
+	args := []string{"systemd-run", "--scope", "--quiet", "--collect", "--unit=" + unit}
+	if config.SandboxCPUQuota != "" {
+		args = append(args, "--property=CPUQuota="+config.SandboxCPUQuota)
+	}
+	if config.SandboxMemoryMax != "" {
+		args = append(args, "--property=MemoryMax="+config.SandboxMemoryMax)
+	}
+	if config.SandboxUser != "" {
+		args = append(args, "--uid="+config.SandboxUser)
+	}
+	args = append(args, "--")
+	if config.SandboxNamespaces {
+		// The script's processes are all killed when the namespace's init exits.
+		args = append(args, "unshare", "--mount", "--pid", "--fork", "--mount-proc")
+	}
+	return args
+}
+
+// chownScript gives the sandbox user the ownership of the script and its
+// temporary directory.
+func chownScript(username string, filePath string) error {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return fmt.Errorf("failed to lookup user %q: %v", username, err)
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("invalid uid %q: %v", u.Uid, err)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return fmt.Errorf("invalid gid %q: %v", u.Gid, err)
+	}
+
+	for _, fpath := range []string{filepath.Dir(filePath), filePath} {
+		if err := os.Chown(fpath, uid, gid); err != nil {
+			return fmt.Errorf("failed to change %q ownership: %v", fpath, err)
+		}
+	}
+	return nil
+}
+
+// setupSandbox returns the command running the script in the configured
+// sandbox and the function tearing the sandbox down once the script finished.
+// If no sandbox is configured the command is returned unchanged.
+func setupSandbox(key, filePath, name string, args []string) (string, []string, func(), error) {
+	config := cfg.Get().MetadataScripts
+	if !sandboxEnabled(config) {
+		return name, args, func() {}, nil
+	}
+
+	if config.SandboxUser != "" {
+		if err := chownScript(config.SandboxUser, filePath); err != nil {
+			return "", nil, nil, err
+		}
+	}
+
+	unit := fmt.Sprintf("google-metadata-script-%s-%d.scope", key, os.Getpid())
+	sandbox := sandboxArgs(config, unit)
+	sandbox = append(sandbox, name)
+	sandbox = append(sandbox, args...)
+
+	// Stopping the scope kills the processes left behind by the script, i.e.
+	// daemonized processes that escaped its process group.
+	teardown := func() {
+		if err := stopUnit(unit); err != nil {
+			logger.Debugf("failed to stop %s, it's likely already gone: %v", unit, err)
+		}
+	}
+	return sandbox[0], sandbox[1:], teardown, nil
+}
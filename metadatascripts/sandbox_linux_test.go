@@ -0,0 +1,96 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package metadatascripts
+
+import (
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSandboxArgs(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *cfg.MetadataScripts
+		want   []string
+	}{
+		{
+			name:   "cgroup_only",
+			config: &cfg.MetadataScripts{SandboxMemoryMax: "512M"},
+			want:   []string{"systemd-run", "--scope", "--quiet", "--collect", "--unit=test.scope", "--property=MemoryMax=512M", "--"},
+		},
+		{
+			name: "all_options",
+			config: &cfg.MetadataScripts{
+				SandboxUser:       "nobody",
+				SandboxCPUQuota:   "50%",
+				SandboxMemoryMax:  "1G",
+				SandboxNamespaces: true,
+			},
+			want: []string{"systemd-run", "--scope", "--quiet", "--collect", "--unit=test.scope",
+				"--property=CPUQuota=50%", "--property=MemoryMax=1G", "--uid=nobody", "--",
+				"unshare", "--mount", "--pid", "--fork", "--mount-proc"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.want, sandboxArgs(tc.config, "test.scope")); diff != "" {
+				t.Errorf("sandboxArgs() returned unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSetupSandbox(t *testing.T) {
+	// Reset original value.
+	defer cfg.Load(nil)
+
+	name, args, teardown, err := setupSandbox("startup-script", "/tmp/script", "/bin/bash", []string{"-c", "/tmp/script"})
+	if err != nil {
+		t.Fatalf("setupSandbox() failed without sandbox: %v", err)
+	}
+	teardown()
+	if name != "/bin/bash" || !cmp.Equal(args, []string{"-c", "/tmp/script"}) {
+		t.Errorf("setupSandbox() = %q %v without sandbox, want the command unchanged", name, args)
+	}
+
+	if err := cfg.Load([]byte("[MetadataScripts]\nsandbox_memory_max = 512M")); err != nil {
+		t.Fatalf("cfg.Load() failed: %v", err)
+	}
+	originalStopUnit := stopUnit
+	t.Cleanup(func() { stopUnit = originalStopUnit })
+	var stopped string
+	stopUnit = func(unit string) error {
+		stopped = unit
+		return nil
+	}
+
+	name, args, teardown, err = setupSandbox("startup-script", "/tmp/script", "/bin/bash", []string{"-c", "/tmp/script"})
+	if err != nil {
+		t.Fatalf("setupSandbox() failed: %v", err)
+	}
+	if name != "systemd-run" || args[len(args)-3] != "/bin/bash" {
+		t.Errorf("setupSandbox() = %q %v, want the command wrapped by systemd-run", name, args)
+	}
+	teardown()
+	if stopped == "" {
+		t.Errorf("teardown didn't stop the sandbox scope")
+	}
+}
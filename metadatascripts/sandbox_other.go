@@ -0,0 +1,33 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package metadatascripts
+
+import (
+	"fmt"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+)
+
+// setupSandbox returns the command unchanged, the scripts sandbox is only
+// supported on Linux. Scripts are not run unsandboxed if a sandbox is configured.
+func setupSandbox(key, filePath, name string, args []string) (string, []string, func(), error) {
+	if sandboxEnabled(cfg.Get().MetadataScripts) {
+		return "", nil, nil, fmt.Errorf("scripts sandbox is only supported on Linux")
+	}
+	return name, args, func() {}, nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"errors"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/retry"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+// defaultScriptRetryBackoff is the delay before the first retry of a failed
+// script if none is configured.
+const defaultScriptRetryBackoff = 10 * time.Second
+
+// parseExitCodes parses a comma separated list of exit codes, the invalid ones
+// being ignored.
+func parseExitCodes(name string, value string) map[int]bool {
+	codes := make(map[int]bool)
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		code, err := strconv.Atoi(field)
+		if err != nil {
+			logger.Errorf("%s %q is not a valid exit code, ignoring it", name, field)
+			continue
+		}
+		codes[code] = true
+	}
+	return codes
+}
+
+// retriableExitCode returns a function telling if a script error is worth
+// retrying: the script ran and exited with one of the codes, or any non-zero
+// code if codes is empty. Scripts that couldn't be set up or were killed are
+// not retried.
+func retriableExitCode(codes map[int]bool) retry.IsRetriable {
+	return func(err error) bool {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() < 0 {
+			return false
+		}
+		return len(codes) == 0 || codes[exitErr.ExitCode()]
+	}
+}
+
+// scriptRetryPolicy returns the retry policy of the phase's failed scripts,
+// the backoff doubling after each attempt. The policy makes a single attempt
+// if retries are not configured for the phase.
+func scriptRetryPolicy(phase string) retry.Policy {
+	config := cfg.Get().MetadataScripts
+	var attempts int
+	var backoff, exitCodes string
+	switch phase {
+	case "startup":
+		attempts, backoff, exitCodes = config.StartupRetryAttempts, config.StartupRetryBackoff, config.StartupRetryExitCodes
+	case "shutdown":
+		attempts, backoff, exitCodes = config.ShutdownRetryAttempts, config.ShutdownRetryBackoff, config.ShutdownRetryExitCodes
+	}
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	jitter := parseTimeout(phase+"_retry_backoff", backoff)
+	if jitter == 0 {
+		jitter = defaultScriptRetryBackoff
+	}
+	return retry.Policy{
+		MaxAttempts:   attempts,
+		BackoffFactor: 2,
+		Jitter:        jitter,
+		ShouldRetry:   retriableExitCode(parseExitCodes(phase+"_retry_exit_codes", exitCodes)),
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+)
+
+func TestScriptRetryPolicy(t *testing.T) {
+	if err := cfg.Load([]byte("[MetadataScripts]\nstartup_retry_attempts = 3\nstartup_retry_backoff = 5s\nstartup_retry_exit_codes = 100, invalid")); err != nil {
+		t.Fatalf("cfg.Load() failed: %v", err)
+	}
+	defer cfg.Load(nil)
+
+	policy := scriptRetryPolicy("startup")
+	if policy.MaxAttempts != 3 || policy.Jitter != 5*time.Second || policy.BackoffFactor != 2 {
+		t.Errorf("scriptRetryPolicy(startup) = %+v, want 3 attempts, 5s backoff doubled", policy)
+	}
+
+	if policy := scriptRetryPolicy("shutdown"); policy.MaxAttempts != 1 || policy.Jitter != defaultScriptRetryBackoff {
+		t.Errorf("scriptRetryPolicy(shutdown) = %+v, want a single attempt", policy)
+	}
+	if policy := scriptRetryPolicy("specialize"); policy.MaxAttempts != 1 {
+		t.Errorf("scriptRetryPolicy(specialize) = %+v, want a single attempt", policy)
+	}
+}
+
+func TestRetriableExitCode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test relies on a POSIX shell")
+	}
+
+	exit := func(code string) error {
+		return exec.Command("/bin/sh", "-c", "exit "+code).Run()
+	}
+
+	tests := []struct {
+		name  string
+		codes map[int]bool
+		err   error
+		want  bool
+	}{
+		{name: "any_code", err: exit("1"), want: true},
+		{name: "listed_code", codes: map[int]bool{100: true}, err: exit("100"), want: true},
+		{name: "unlisted_code", codes: map[int]bool{100: true}, err: exit("1"), want: false},
+		{name: "wrapped", err: &scriptError{err: exit("2")}, want: true},
+		{name: "setup_error", err: errors.New("refusing to run startup-script"), want: false},
+	}
+
+	for _, tc := range tests {
+		if got := retriableExitCode(tc.codes)(tc.err); got != tc.want {
+			t.Errorf("%s: retriableExitCode(%v)(%v) = %t, want %t", tc.name, tc.codes, tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestRunOneRetries(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test relies on a POSIX shell")
+	}
+	if err := cfg.Load([]byte("[MetadataScripts]\nstartup_retry_attempts = 3\nstartup_retry_backoff = 10ms")); err != nil {
+		t.Fatalf("cfg.Load() failed: %v", err)
+	}
+	defer cfg.Load(nil)
+
+	// The script fails until it ran twice.
+	counter := filepath.Join(t.TempDir(), "counter")
+	p := &Phase{
+		Name: "startup",
+		Keys: []string{"startup-script"},
+		Scripts: map[string]string{
+			"startup-script": "printf x >> " + counter + "; [ $(wc -c < " + counter + ") -ge 2 ]",
+		},
+	}
+
+	res, err := p.runOne(context.Background(), "startup-script")
+	if err != nil {
+		t.Fatalf("runOne() failed: %v", err)
+	}
+	if res.Attempts != 2 || res.ExitCode != 0 {
+		t.Errorf("runOne() = %d attempts, exit code %d, want 2 attempts, exit code 0", res.Attempts, res.ExitCode)
+	}
+
+	p.Scripts["startup-script"] = "exit 3"
+	res, err = p.runOne(context.Background(), "startup-script")
+	if err == nil {
+		t.Fatalf("runOne() succeeded for a failing script, want error")
+	}
+	if res.Attempts != 3 || res.ExitCode != 3 {
+		t.Errorf("runOne() = %d attempts, exit code %d, want 3 attempts, exit code 3", res.Attempts, res.ExitCode)
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"golang.org/x/crypto/openpgp"
+)
+
+const (
+	// signatureSuffix is the suffix of the metadata key holding a script's
+	// detached signature, i.e. startup-script-sig.
+	signatureSuffix = "-sig"
+	// sidecarSuffix is appended to a script URL to get its detached signature
+	// object when no signature key is set, i.e. gs://bucket/script.sh.sig.
+	sidecarSuffix = ".sig"
+	// pgpArmorPrefix starts an armored OpenPGP block.
+	pgpArmorPrefix = "-----BEGIN PGP"
+)
+
+// signatureVerifier verifies a detached signature of a script.
+type signatureVerifier interface {
+	verify(data, signature []byte) error
+}
+
+// publicKeyVerifier verifies base64 encoded signatures of the script's SHA256
+// digest, as made by cosign sign-blob.
+type publicKeyVerifier struct {
+	key crypto.PublicKey
+}
+
+func (v publicKeyVerifier) verify(data, signature []byte) error {
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		return fmt.Errorf("signature is not base64 encoded: %v", err)
+	}
+	digest := sha256.Sum256(data)
+
+	switch key := v.key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest[:], sig) {
+			return errors.New("invalid ECDSA signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, data, sig) {
+			return errors.New("invalid ed25519 signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported public key type %T", v.key)
+	}
+}
+
+// pgpVerifier verifies armored or binary OpenPGP detached signatures. The
+// x/crypto/openpgp package is frozen but still verifies the signatures made
+// with gpg, which the existing signing pipelines rely on.
+type pgpVerifier struct {
+	keyring openpgp.EntityList
+}
+
+func (v pgpVerifier) verify(data, signature []byte) error {
+	var err error
+	if bytes.HasPrefix(bytes.TrimSpace(signature), []byte(pgpArmorPrefix)) {
+		_, err = openpgp.CheckArmoredDetachedSignature(v.keyring, bytes.NewReader(data), bytes.NewReader(signature))
+	} else {
+		_, err = openpgp.CheckDetachedSignature(v.keyring, bytes.NewReader(data), bytes.NewReader(signature))
+	}
+	return err
+}
+
+// loadSignatureKey reads a PEM encoded public key or an armored OpenPGP key
+// from the file at path.
+func loadSignatureKey(path string) (signatureVerifier, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading signature key: %v", err)
+	}
+
+	if bytes.Contains(data, []byte(pgpArmorPrefix)) {
+		keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing OpenPGP key %s: %v", path, err)
+		}
+		return pgpVerifier{keyring: keyring}, nil
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is neither a PEM encoded nor an OpenPGP key", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing public key %s: %v", path, err)
+	}
+	return publicKeyVerifier{key: key}, nil
+}
+
+// loadSignatureKeys reads the comma separated list of signature key files.
+func loadSignatureKeys(paths string) ([]signatureVerifier, error) {
+	var verifiers []signatureVerifier
+	for _, path := range strings.Split(paths, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		v, err := loadSignatureKey(path)
+		if err != nil {
+			return nil, err
+		}
+		verifiers = append(verifiers, v)
+	}
+	if len(verifiers) == 0 {
+		return nil, errors.New("no signature_keys configured")
+	}
+	return verifiers, nil
+}
+
+// verifySignature checks signature is a valid signature of data made with
+// one of the verifiers' keys.
+func verifySignature(data, signature []byte, verifiers []signatureVerifier) error {
+	var errs []error
+	for _, v := range verifiers {
+		err := v.verify(data, signature)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	return fmt.Errorf("signature not verified by any of the %d signature keys: %w", len(verifiers), errors.Join(errs...))
+}
+
+// checkSignature verifies the script at filePath is signed with one of the
+// configured signature keys. The signature is the script's signature key value
+// or, for URL scripts without one, the URL's sidecar object.
+func checkSignature(ctx context.Context, filePath string, signature string, scriptURL string) error {
+	if signature == "" && scriptURL != "" {
+		sigFile := filePath + sidecarSuffix
+		file, err := os.OpenFile(sigFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return fmt.Errorf("error opening signature file: %v", err)
+		}
+		err = downloadScript(ctx, scriptURL+sidecarSuffix, file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("unable to download script signature: %v", err)
+		}
+		data, err := os.ReadFile(sigFile)
+		if err != nil {
+			return fmt.Errorf("error reading signature file: %v", err)
+		}
+		signature = string(data)
+	}
+	if strings.TrimSpace(signature) == "" {
+		return errors.New("script is not signed")
+	}
+
+	verifiers, err := loadSignatureKeys(cfg.Get().MetadataScripts.SignatureKeys)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return fmt.Errorf("error reading script file: %v", err)
+	}
+	return verifySignature(data, []byte(signature), verifiers)
+}
@@ -0,0 +1,232 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// writePublicKey writes the PEM encoded public key to a file in dir.
+func writePublicKey(t *testing.T, dir string, name string, pub crypto.PublicKey) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatalf("x509.MarshalPKIXPublicKey() failed: %v", err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatalf("os.WriteFile(%s) failed: %v", path, err)
+	}
+	return path
+}
+
+// newPGPKey writes a new armored OpenPGP public key to a file in dir and
+// returns its path along with the entity to sign with.
+func newPGPKey(t *testing.T, dir string) (string, *openpgp.Entity) {
+	t.Helper()
+	entity, err := openpgp.NewEntity("test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatalf("openpgp.NewEntity() failed: %v", err)
+	}
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatalf("armor.Encode() failed: %v", err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatalf("entity.Serialize() failed: %v", err)
+	}
+	w.Close()
+	path := filepath.Join(dir, "pgp.asc")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("os.WriteFile(%s) failed: %v", path, err)
+	}
+	return path, entity
+}
+
+func TestVerifySignature(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte("#!/bin/bash\necho hello\n")
+	digest := sha256.Sum256(data)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey() failed: %v", err)
+	}
+	ecSig, err := ecdsa.SignASN1(rand.Reader, ecKey, digest[:])
+	if err != nil {
+		t.Fatalf("ecdsa.SignASN1() failed: %v", err)
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey() failed: %v", err)
+	}
+	rsaSig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("rsa.SignPKCS1v15() failed: %v", err)
+	}
+
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey() failed: %v", err)
+	}
+	edSig := ed25519.Sign(edKey, data)
+
+	pgpPath, entity := newPGPKey(t, dir)
+	var armoredSig, binarySig bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&armoredSig, entity, bytes.NewReader(data), nil); err != nil {
+		t.Fatalf("openpgp.ArmoredDetachSign() failed: %v", err)
+	}
+	if err := openpgp.DetachSign(&binarySig, entity, bytes.NewReader(data), nil); err != nil {
+		t.Fatalf("openpgp.DetachSign() failed: %v", err)
+	}
+
+	ecPath := writePublicKey(t, dir, "ecdsa.pem", &ecKey.PublicKey)
+	keys := fmt.Sprintf("%s, %s, %s, %s", ecPath, writePublicKey(t, dir, "rsa.pem", &rsaKey.PublicKey), writePublicKey(t, dir, "ed25519.pem", edPub), pgpPath)
+	verifiers, err := loadSignatureKeys(keys)
+	if err != nil {
+		t.Fatalf("loadSignatureKeys(%q) failed: %v", keys, err)
+	}
+
+	tests := []struct {
+		name      string
+		data      []byte
+		signature []byte
+		wantErr   bool
+	}{
+		{
+			name:      "ecdsa",
+			data:      data,
+			signature: []byte(base64.StdEncoding.EncodeToString(ecSig) + "\n"),
+		},
+		{
+			name:      "rsa",
+			data:      data,
+			signature: []byte(base64.StdEncoding.EncodeToString(rsaSig)),
+		},
+		{
+			name:      "ed25519",
+			data:      data,
+			signature: []byte(base64.StdEncoding.EncodeToString(edSig)),
+		},
+		{
+			name:      "pgp_armored",
+			data:      data,
+			signature: armoredSig.Bytes(),
+		},
+		{
+			name:      "pgp_binary",
+			data:      data,
+			signature: binarySig.Bytes(),
+		},
+		{
+			name:      "tampered_script",
+			data:      []byte("#!/bin/bash\necho tampered\n"),
+			signature: []byte(base64.StdEncoding.EncodeToString(ecSig)),
+			wantErr:   true,
+		},
+		{
+			name:      "invalid_signature",
+			data:      data,
+			signature: []byte("not a signature"),
+			wantErr:   true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := verifySignature(tc.data, tc.signature, verifiers); (err != nil) != tc.wantErr {
+				t.Errorf("verifySignature() = %v, want error: %t", err, tc.wantErr)
+			}
+		})
+	}
+
+	// A signature made with a key that's not configured is rejected.
+	ecOnly, err := loadSignatureKeys(ecPath)
+	if err != nil {
+		t.Fatalf("loadSignatureKeys(%q) failed: %v", ecPath, err)
+	}
+	if err := verifySignature(data, []byte(base64.StdEncoding.EncodeToString(rsaSig)), ecOnly); err == nil {
+		t.Errorf("verifySignature() with an unknown key succeeded, want error")
+	}
+}
+
+func TestLoadSignatureKeysError(t *testing.T) {
+	dir := t.TempDir()
+	invalid := filepath.Join(dir, "invalid.pem")
+	if err := os.WriteFile(invalid, []byte("not a key"), 0644); err != nil {
+		t.Fatalf("os.WriteFile(%s) failed: %v", invalid, err)
+	}
+
+	for _, paths := range []string{"", " , ", invalid, filepath.Join(dir, "missing.pem")} {
+		if _, err := loadSignatureKeys(paths); err == nil {
+			t.Errorf("loadSignatureKeys(%q) succeeded, want error", paths)
+		}
+	}
+}
+
+func TestCheckSignature(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte("echo hello\n")
+	digest := sha256.Sum256(data)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey() failed: %v", err)
+	}
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatalf("ecdsa.SignASN1() failed: %v", err)
+	}
+	keyPath := writePublicKey(t, dir, "key.pem", &key.PublicKey)
+
+	script := filepath.Join(dir, "startup-script")
+	if err := os.WriteFile(script, data, 0755); err != nil {
+		t.Fatalf("os.WriteFile(%s) failed: %v", script, err)
+	}
+
+	if err := cfg.Load([]byte(fmt.Sprintf("[MetadataScripts]\nrequire_signature = true\nsignature_keys = %s", keyPath))); err != nil {
+		t.Fatalf("cfg.Load() failed: %v", err)
+	}
+	defer cfg.Load(nil)
+
+	ctx := context.Background()
+	if err := checkSignature(ctx, script, base64.StdEncoding.EncodeToString(sig), ""); err != nil {
+		t.Errorf("checkSignature() with a valid signature failed: %v", err)
+	}
+	if err := checkSignature(ctx, script, "", ""); err == nil {
+		t.Errorf("checkSignature() without a signature succeeded, want error")
+	}
+}
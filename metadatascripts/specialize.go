@@ -0,0 +1,246 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+// specializePhase is a phase of the specialize flow.
+type specializePhase string
+
+const (
+	// specializeRunning is the phase of a flow running its scripts, or
+	// interrupted while running them, i.e. by a reboot.
+	specializeRunning specializePhase = "running"
+	// specializeCompleted is the phase of a flow whose scripts all succeeded.
+	specializeCompleted specializePhase = "completed"
+	// specializeFailed is the phase of a flow that ran all its scripts, some
+	// of them failing.
+	specializeFailed specializePhase = "failed"
+
+	// maxSpecializeAttempts is the number of times a script interrupted while
+	// running is started before it's considered failed, so a script rebooting
+	// the instance each time doesn't loop forever.
+	maxSpecializeAttempts = 3
+)
+
+var (
+	// getSpecializeStateFile returns the path of the specialize state file.
+	// Replaceable by unit tests.
+	getSpecializeStateFile = specializeStateFile
+)
+
+// specializeState is the persisted state of the specialize flow, so a flow
+// interrupted by a reboot resumes where it stopped instead of running the
+// completed scripts again, and its outcome is recorded.
+type specializeState struct {
+	// InstanceID is the ID of the instance the flow ran on, the state of
+	// another instance, i.e. carried over by an image not generalized with
+	// the generalize scripts, is discarded.
+	InstanceID string `json:"instanceId"`
+	// Phase is the flow's phase.
+	Phase specializePhase `json:"phase"`
+	// Completed are the scripts that succeeded.
+	Completed []string `json:"completed,omitempty"`
+	// Failed maps the scripts that failed to their error.
+	Failed map[string]string `json:"failed,omitempty"`
+	// Running maps the scripts running, or running when the flow was
+	// interrupted, to the number of times they were started.
+	Running map[string]int `json:"running,omitempty"`
+	// Updated is the time of the last transition.
+	Updated time.Time `json:"updated"`
+
+	// mu protects the state, the scripts running in parallel.
+	mu sync.Mutex
+	// path is the state file.
+	path string
+}
+
+// specializeStateFile returns the path of the specialize state file.
+func specializeStateFile() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("ProgramData"), "Google", "Compute Engine", "specialize-state.json")
+	}
+	return "/var/lib/google-metadata-scripts/specialize-state.json"
+}
+
+// loadSpecializeState returns the specialize flow's state on the instance,
+// a new flow if it never ran or its state can't be read.
+func loadSpecializeState(instanceID string) *specializeState {
+	path := getSpecializeStateFile()
+	state := &specializeState{path: path}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		logger.Errorf("Failed to read the specialize state, starting over: %v", err)
+	case json.Unmarshal(data, state) != nil:
+		logger.Errorf("Invalid specialize state in %s, starting over", path)
+	}
+
+	if state.InstanceID != instanceID {
+		if state.InstanceID != "" {
+			logger.Infof("Discarding the specialize state of instance %s.", state.InstanceID)
+		}
+		state = &specializeState{InstanceID: instanceID, path: path}
+	}
+	return state
+}
+
+// done returns whether the flow reached a final phase.
+func (s *specializeState) done() bool {
+	return s.Phase == specializeCompleted || s.Phase == specializeFailed
+}
+
+// begin moves a new or interrupted flow to the running phase.
+func (s *specializeState) begin() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Phase == specializeRunning {
+		logger.Warningf("Resuming the interrupted specialize scripts, %d completed, %d interrupted.", len(s.Completed), len(s.Running))
+	}
+	s.Phase = specializeRunning
+	s.save()
+}
+
+// skip returns whether the script completed before the flow was interrupted.
+func (s *specializeState) skip(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Contains(s.Completed, key)
+}
+
+// start records the script is starting, or returns an error if it was
+// interrupted too many times.
+func (s *specializeState) start(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Running[key] >= maxSpecializeAttempts {
+		return fmt.Errorf("%s was interrupted %d times, not running it again", key, s.Running[key])
+	}
+	if s.Running == nil {
+		s.Running = make(map[string]int)
+	}
+	s.Running[key]++
+	s.save()
+	return nil
+}
+
+// finish records the script's result.
+func (s *specializeState) finish(res ScriptResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.Running, res.Script)
+	if res.Error == "" {
+		s.Completed = append(s.Completed, res.Script)
+	} else {
+		if s.Failed == nil {
+			s.Failed = make(map[string]string)
+		}
+		s.Failed[res.Script] = res.Error
+	}
+	s.save()
+}
+
+// end moves the flow to its final phase once all its scripts ran, the
+// scripts not run because a dependency failed failing it too.
+func (s *specializeState) end(results []ScriptResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, res := range results {
+		if _, ok := s.Failed[res.Script]; res.Error == "" || ok {
+			continue
+		}
+		if s.Failed == nil {
+			s.Failed = make(map[string]string)
+		}
+		s.Failed[res.Script] = res.Error
+	}
+	s.Phase = specializeCompleted
+	if len(s.Failed) > 0 {
+		s.Phase = specializeFailed
+	}
+	logger.Infof("Specialize scripts %s: %d completed, %d failed.", s.Phase, len(s.Completed), len(s.Failed))
+	s.save()
+}
+
+// save writes the state, failures are logged as the scripts must run anyway.
+// The caller must hold s.mu.
+func (s *specializeState) save() {
+	s.Updated = time.Now().UTC()
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(s.path), 0700)
+	}
+	// The state is renamed in place so an interruption doesn't leave it
+	// truncated.
+	if err == nil {
+		err = os.WriteFile(s.path+".tmp", data, 0600)
+	}
+	if err == nil {
+		err = os.Rename(s.path+".tmp", s.path)
+	}
+	if err != nil {
+		logger.Errorf("Failed to save the specialize state: %v", err)
+	}
+}
+
+// runSpecialize runs the specialize scripts, resuming the flow where it
+// stopped if it was interrupted. A flow that already completed or failed
+// doesn't run again.
+func (p *Phase) runSpecialize(ctx context.Context) []ScriptResult {
+	instanceID, err := getMetadataKey(ctx, "/instance/id")
+	if err != nil {
+		logger.Errorf("Failed to get the instance ID, running the specialize scripts without tracking them: %v", err)
+		return p.Run(ctx)
+	}
+
+	state := loadSpecializeState(strings.TrimSpace(instanceID))
+	if state.done() {
+		logger.Infof("Specialize scripts already %s on %s, not running them again.", state.Phase, state.Updated.Format(time.RFC3339))
+		return nil
+	}
+
+	state.begin()
+	p.specialize = state
+	results := p.Run(ctx)
+	state.end(results)
+	return results
+}
+
+// resetSpecializeState removes the specialize state before the image is
+// generalized, its instances running the specialize flow from scratch.
+func resetSpecializeState() {
+	if err := os.Remove(getSpecializeStateFile()); err != nil && !os.IsNotExist(err) {
+		logger.Errorf("Failed to remove the specialize state: %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// setSpecializeStateFile points the specialize state file to a temporary
+// directory for the test's duration.
+func setSpecializeStateFile(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "state", "specialize-state.json")
+	orig := getSpecializeStateFile
+	t.Cleanup(func() { getSpecializeStateFile = orig })
+	getSpecializeStateFile = func() string { return path }
+	return path
+}
+
+func TestSpecializeStateTransitions(t *testing.T) {
+	setSpecializeStateFile(t)
+
+	state := loadSpecializeState("1234")
+	if state.Phase != "" || state.done() {
+		t.Fatalf("loadSpecializeState(1234) = phase %q, want a new flow", state.Phase)
+	}
+	state.begin()
+	for _, key := range []string{"sysprep-specialize-script-ps1", "sysprep-specialize-script-cmd"} {
+		if err := state.start(key); err != nil {
+			t.Fatalf("start(%s) failed unexpectedly with error: %v", key, err)
+		}
+	}
+	state.finish(ScriptResult{Script: "sysprep-specialize-script-ps1"})
+
+	// The instance rebooted while running the cmd script.
+	resumed := loadSpecializeState("1234")
+	if resumed.Phase != specializeRunning {
+		t.Errorf("loadSpecializeState(1234) = phase %q, want %q", resumed.Phase, specializeRunning)
+	}
+	if !resumed.skip("sysprep-specialize-script-ps1") || resumed.skip("sysprep-specialize-script-cmd") {
+		t.Errorf("skip() = %v, want only the completed script skipped", resumed.Completed)
+	}
+	if diff := cmp.Diff(map[string]int{"sysprep-specialize-script-cmd": 1}, resumed.Running); diff != "" {
+		t.Errorf("loadSpecializeState(1234) returned unexpected running scripts (-want +got):\n%s", diff)
+	}
+
+	resumed.begin()
+	if err := resumed.start("sysprep-specialize-script-cmd"); err != nil {
+		t.Fatalf("start(sysprep-specialize-script-cmd) failed unexpectedly with error: %v", err)
+	}
+	res := ScriptResult{Script: "sysprep-specialize-script-cmd", ExitCode: 1, Error: "exit status 1"}
+	resumed.finish(res)
+	resumed.end([]ScriptResult{{Script: "sysprep-specialize-script-ps1"}, res})
+
+	final := loadSpecializeState("1234")
+	if final.Phase != specializeFailed || !final.done() {
+		t.Errorf("loadSpecializeState(1234) = phase %q, want %q", final.Phase, specializeFailed)
+	}
+	if diff := cmp.Diff(map[string]string{"sysprep-specialize-script-cmd": "exit status 1"}, final.Failed); diff != "" {
+		t.Errorf("loadSpecializeState(1234) returned unexpected failed scripts (-want +got):\n%s", diff)
+	}
+	if len(final.Running) != 0 {
+		t.Errorf("loadSpecializeState(1234) = running %v, want none", final.Running)
+	}
+
+	// Another instance created from an image carrying the state.
+	if other := loadSpecializeState("5678"); other.Phase != "" || len(other.Completed) != 0 {
+		t.Errorf("loadSpecializeState(5678) = %+v, want a new flow", other)
+	}
+}
+
+func TestSpecializeStateInterrupted(t *testing.T) {
+	setSpecializeStateFile(t)
+
+	state := loadSpecializeState("1234")
+	state.begin()
+	for i := 0; i < maxSpecializeAttempts; i++ {
+		if err := state.start("sysprep-specialize-script-ps1"); err != nil {
+			t.Fatalf("start() attempt %d failed unexpectedly with error: %v", i+1, err)
+		}
+	}
+
+	p := &Phase{Name: "specialize", specialize: state}
+	res, err := p.runOne(context.Background(), "sysprep-specialize-script-ps1")
+	if err == nil {
+		t.Fatalf("runOne() succeeded running a script interrupted %d times, want error", maxSpecializeAttempts)
+	}
+	if res.Attempts != 0 {
+		t.Errorf("runOne() = %d attempts, want the script not run", res.Attempts)
+	}
+	if _, ok := state.Failed["sysprep-specialize-script-ps1"]; !ok {
+		t.Errorf("runOne() didn't record the script as failed, failed: %v", state.Failed)
+	}
+
+	state.Completed = append(state.Completed, "sysprep-specialize-script-cmd")
+	if _, err := p.runOne(context.Background(), "sysprep-specialize-script-cmd"); err != nil {
+		t.Errorf("runOne() of a completed script failed with error: %v, want it skipped", err)
+	}
+}
+
+func TestSpecializeStateInvalid(t *testing.T) {
+	path := setSpecializeStateFile(t)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatalf("os.MkdirAll() failed: %v", err)
+	}
+	if err := os.WriteFile(path, []byte("{truncated"), 0600); err != nil {
+		t.Fatalf("os.WriteFile() failed: %v", err)
+	}
+
+	state := loadSpecializeState("1234")
+	if state.Phase != "" || state.InstanceID != "1234" {
+		t.Errorf("loadSpecializeState(1234) = %+v, want a new flow", state)
+	}
+
+	resetSpecializeState()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("resetSpecializeState() left %s, stat error: %v", path, err)
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"fmt"
+
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+// imageStateComplete is the Windows image state once setup has completed, the
+// image being deployed.
+const imageStateComplete = "IMAGE_STATE_COMPLETE"
+
+var (
+	// getImageState returns the Windows setup image state. Replaceable by unit
+	// tests.
+	getImageState = imageState
+)
+
+// checkSysprepSequence checks the sysprep phase runs at the right point of the
+// Windows setup sequence: generalize scripts run on a deployed image, before
+// sysprep generalizes it, and specialize scripts run while setup hasn't
+// completed yet. Other phases and unknown image states are not checked.
+func checkSysprepSequence(phase string) error {
+	if phase != "generalize" && phase != "specialize" {
+		return nil
+	}
+
+	state, err := getImageState()
+	if err != nil {
+		logger.Warningf("Unable to get the Windows image state, not checking the %s phase sequence: %v", phase, err)
+		return nil
+	}
+	logger.Debugf("Windows image state is %s", state)
+
+	switch {
+	case phase == "generalize" && state != imageStateComplete:
+		return fmt.Errorf("image is already generalized (image state %s), generalize scripts must run before sysprep", state)
+	case phase == "specialize" && state == imageStateComplete:
+		return fmt.Errorf("windows setup has already completed (image state %s), specialize scripts only run during the specialize pass", state)
+	}
+	return nil
+}
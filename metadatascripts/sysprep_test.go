@@ -0,0 +1,64 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+)
+
+func TestCheckSysprepSequence(t *testing.T) {
+	tests := []struct {
+		phase   string
+		state   string
+		err     error
+		wantErr bool
+	}{
+		{phase: "generalize", state: imageStateComplete},
+		{phase: "generalize", state: "IMAGE_STATE_GENERALIZE_RESEAL_TO_OOBE", wantErr: true},
+		{phase: "specialize", state: "IMAGE_STATE_GENERALIZE_RESEAL_TO_OOBE"},
+		{phase: "specialize", state: "IMAGE_STATE_SPECIALIZE_RESEAL_TO_OOBE"},
+		{phase: "specialize", state: imageStateComplete, wantErr: true},
+		{phase: "specialize", err: errors.New("registry error")},
+		{phase: "startup", state: "IMAGE_STATE_GENERALIZE_RESEAL_TO_OOBE"},
+	}
+
+	orig := getImageState
+	t.Cleanup(func() { getImageState = orig })
+
+	for _, tc := range tests {
+		t.Run(tc.phase+"_"+tc.state, func(t *testing.T) {
+			getImageState = func() (string, error) { return tc.state, tc.err }
+			if err := checkSysprepSequence(tc.phase); (err != nil) != tc.wantErr {
+				t.Errorf("checkSysprepSequence(%q) = %v, want error: %t", tc.phase, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestSysprepPhasesDisabled(t *testing.T) {
+	if err := cfg.Load([]byte("[MetadataScripts]\nsysprep_specialize = false\nsysprep_generalize = false")); err != nil {
+		t.Fatalf("cfg.Load() failed: %v", err)
+	}
+	defer cfg.Load(nil)
+
+	for _, phase := range []string{"specialize", "generalize"} {
+		if _, err := getWantedKeys(phase, "windows"); err == nil {
+			t.Errorf("getWantedKeys(%q) succeeded with the phase disabled, want error", phase)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+package metadatascripts
+
+import "golang.org/x/sys/windows/registry"
+
+// setupStateKey is the registry key holding the Windows setup state.
+const setupStateKey = `SOFTWARE\Microsoft\Windows\CurrentVersion\Setup\State`
+
+// imageState returns the Windows setup image state, i.e. IMAGE_STATE_COMPLETE
+// once setup has completed.
+func imageState() (string, error) {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, setupStateKey, registry.QUERY_VALUE)
+	if err != nil {
+		return "", err
+	}
+	defer k.Close()
+
+	state, _, err := k.GetStringValue("ImageState")
+	return state, err
+}
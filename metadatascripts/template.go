@@ -0,0 +1,114 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+var (
+	// templateData is the data the scripts' templates are expanded with, it's
+	// read from the metadata server once per run.
+	templateData   *TemplateData
+	templateDataMu sync.Mutex
+)
+
+// TemplateData is the instance data available to the scripts' templates, i.e.
+// {{.InstanceName}} or {{.Zone}}.
+type TemplateData struct {
+	InstanceName     string
+	InstanceID       string
+	Hostname         string
+	Zone             string
+	Region           string
+	MachineType      string
+	ProjectID        string
+	NumericProjectID string
+}
+
+// getTemplateData returns the template data, reading it from the metadata
+// server on the first call.
+func getTemplateData(ctx context.Context) (*TemplateData, error) {
+	templateDataMu.Lock()
+	defer templateDataMu.Unlock()
+
+	if templateData != nil {
+		return templateData, nil
+	}
+
+	data := &TemplateData{}
+	for key, field := range map[string]*string{
+		"/instance/name":              &data.InstanceName,
+		"/instance/id":                &data.InstanceID,
+		"/instance/hostname":          &data.Hostname,
+		"/instance/zone":              &data.Zone,
+		"/instance/machine-type":      &data.MachineType,
+		"/project/project-id":         &data.ProjectID,
+		"/project/numeric-project-id": &data.NumericProjectID,
+	} {
+		val, err := getMetadataKey(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		*field = strings.TrimSpace(val)
+	}
+
+	// The zone and machine type are resource names, i.e.
+	// projects/123/zones/us-central1-a.
+	data.Zone = path.Base(data.Zone)
+	data.MachineType = path.Base(data.MachineType)
+	if idx := strings.LastIndex(data.Zone, "-"); idx > 0 {
+		data.Region = data.Zone[:idx]
+	}
+
+	templateData = data
+	return templateData, nil
+}
+
+// expandTemplate expands the template placeholders of the script at filePath
+// in place. Unknown placeholders are an error, the script must not run with
+// part of it left unexpanded.
+func expandTemplate(filePath string, data *TemplateData) error {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return fmt.Errorf("error reading script file: %v", err)
+	}
+
+	tmpl, err := template.New(path.Base(filePath)).Option("missingkey=error").Parse(string(content))
+	if err != nil {
+		return fmt.Errorf("error parsing script template: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return fmt.Errorf("error expanding script template: %v", err)
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return fmt.Errorf("error reading script file: %v", err)
+	}
+	if err := os.WriteFile(filePath, buf.Bytes(), info.Mode()); err != nil {
+		return fmt.Errorf("error writing script file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// keysMDSClient serves GetKey calls from a map.
+type keysMDSClient struct {
+	mdsClient
+	keys map[string]string
+}
+
+func (mds *keysMDSClient) GetKey(ctx context.Context, key string, headers map[string]string) (string, error) {
+	val, ok := mds.keys[key]
+	if !ok {
+		return "", fmt.Errorf("key %q not found", key)
+	}
+	return val, nil
+}
+
+func TestGetTemplateData(t *testing.T) {
+	originalClient := client
+	t.Cleanup(func() {
+		client = originalClient
+		templateData = nil
+	})
+	templateData = nil
+	client = &keysMDSClient{keys: map[string]string{
+		"/instance/name":              "my-instance",
+		"/instance/id":                "1234",
+		"/instance/hostname":          "my-instance.c.my-project.internal",
+		"/instance/zone":              "projects/5678/zones/us-central1-a",
+		"/instance/machine-type":      "projects/5678/machineTypes/e2-medium",
+		"/project/project-id":         "my-project",
+		"/project/numeric-project-id": "5678",
+	}}
+
+	got, err := getTemplateData(context.Background())
+	if err != nil {
+		t.Fatalf("getTemplateData() failed: %v", err)
+	}
+	want := &TemplateData{
+		InstanceName:     "my-instance",
+		InstanceID:       "1234",
+		Hostname:         "my-instance.c.my-project.internal",
+		Zone:             "us-central1-a",
+		Region:           "us-central1",
+		MachineType:      "e2-medium",
+		ProjectID:        "my-project",
+		NumericProjectID: "5678",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("getTemplateData() returned unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestExpandTemplate(t *testing.T) {
+	data := &TemplateData{InstanceName: "my-instance", Zone: "us-central1-a", ProjectID: "my-project"}
+
+	tests := []struct {
+		name    string
+		content string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "placeholders",
+			content: "echo {{.InstanceName}} {{.Zone}} {{.ProjectID}}",
+			want:    "echo my-instance us-central1-a my-project",
+		},
+		{
+			name:    "escaped",
+			content: `docker ps --format '{{"{{"}}.Names}}'`,
+			want:    "docker ps --format '{{.Names}}'",
+		},
+		{
+			name:    "no_placeholders",
+			content: "echo hello",
+			want:    "echo hello",
+		},
+		{
+			name:    "unknown_placeholder",
+			content: "docker ps --format '{{.Names}}'",
+			wantErr: true,
+		},
+		{
+			name:    "invalid_template",
+			content: "echo {{",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			filePath := filepath.Join(t.TempDir(), "startup-script")
+			if err := os.WriteFile(filePath, []byte(tc.content), 0755); err != nil {
+				t.Fatalf("failed to write test script: %v", err)
+			}
+
+			err := expandTemplate(filePath, data)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("expandTemplate(%q) = %v, want error: %t", tc.content, err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+
+			got, err := os.ReadFile(filePath)
+			if err != nil {
+				t.Fatalf("failed to read test script: %v", err)
+			}
+			if string(got) != tc.want {
+				t.Errorf("expandTemplate(%q) wrote %q, want %q", tc.content, got, tc.want)
+			}
+		})
+	}
+}
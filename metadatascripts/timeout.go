@@ -0,0 +1,97 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+// timeoutSuffix is the suffix of the metadata key holding a script's timeout,
+// i.e. startup-script-timeout.
+const timeoutSuffix = "-timeout"
+
+// parseTimeout parses a timeout duration string, an empty or invalid string
+// means no timeout.
+func parseTimeout(name string, value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout < 0 {
+		logger.Errorf("%s %q is not a valid duration string, ignoring it", name, value)
+		return 0
+	}
+	return timeout
+}
+
+// phaseTimeout returns the configured timeout of the whole phase, 0 if the
+// phase has no timeout.
+func phaseTimeout(phase string) time.Duration {
+	config := cfg.Get().MetadataScripts
+	switch phase {
+	case "startup":
+		return parseTimeout("startup_timeout", config.StartupTimeout)
+	case "shutdown":
+		return parseTimeout("shutdown_timeout", config.ShutdownTimeout)
+	case "specialize":
+		return parseTimeout("sysprep_specialize_timeout", config.SysprepSpecializeTimeout)
+	case "generalize":
+		return parseTimeout("sysprep_generalize_timeout", config.SysprepGeneralizeTimeout)
+	}
+	return 0
+}
+
+// scriptTimeout returns the timeout of a script, its <key>-timeout metadata
+// key takes precedence over the configured default.
+func scriptTimeout(key string, scripts map[string]string) time.Duration {
+	if value, ok := scripts[key+timeoutSuffix]; ok {
+		return parseTimeout(key+timeoutSuffix, value)
+	}
+	return parseTimeout("script_timeout", cfg.Get().MetadataScripts.ScriptTimeout)
+}
+
+// runWithTimeout runs a script bounded by its timeout (0 means none) and the
+// phase's context, logging which of them was hit.
+func runWithTimeout(phaseCtx context.Context, phase string, key string, timeout time.Duration, run func(context.Context) error) error {
+	if phaseCtx.Err() != nil {
+		return fmt.Errorf("%s phase timed out, not running %s", phase, key)
+	}
+
+	ctx := phaseCtx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(phaseCtx, timeout)
+		defer cancel()
+	}
+
+	err := run(ctx)
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+
+	if phaseCtx.Err() != nil {
+		logger.Errorf("%s phase timed out, %s was killed", phase, key)
+		return fmt.Errorf("%s phase timed out: %w", phase, err)
+	}
+	logger.Errorf("%s timed out after %s and was killed", key, timeout)
+	return fmt.Errorf("timed out after %s: %w", timeout, err)
+}
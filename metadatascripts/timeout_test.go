@@ -0,0 +1,120 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadatascripts
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+)
+
+func TestParseTimeout(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{" 5m ", 5 * time.Minute},
+		{"invalid", 0},
+		{"-1s", 0},
+	}
+
+	for _, tc := range tests {
+		if got := parseTimeout("test", tc.value); got != tc.want {
+			t.Errorf("parseTimeout(%q) = %v, want %v", tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestScriptTimeout(t *testing.T) {
+	// Reset original value.
+	defer cfg.Load(nil)
+	if err := cfg.Load([]byte("[MetadataScripts]\nscript_timeout = 10m\nstartup_timeout = 1h")); err != nil {
+		t.Fatalf("cfg.Load() failed: %v", err)
+	}
+
+	scripts := map[string]string{
+		"startup-script":             "echo",
+		"startup-script-url":         "gs://bucket/object",
+		"startup-script-url-timeout": "30s",
+	}
+	if got := scriptTimeout("startup-script-url", scripts); got != 30*time.Second {
+		t.Errorf("scriptTimeout(startup-script-url) = %v, want %v", got, 30*time.Second)
+	}
+	if got := scriptTimeout("startup-script", scripts); got != 10*time.Minute {
+		t.Errorf("scriptTimeout(startup-script) = %v, want %v", got, 10*time.Minute)
+	}
+	if got := phaseTimeout("startup"); got != time.Hour {
+		t.Errorf("phaseTimeout(startup) = %v, want %v", got, time.Hour)
+	}
+	if got := phaseTimeout("graceful-shutdown"); got != 0 {
+		t.Errorf("phaseTimeout(graceful-shutdown) = %v, want 0", got)
+	}
+}
+
+func TestRunWithTimeout(t *testing.T) {
+	block := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	if err := runWithTimeout(context.Background(), "startup", "startup-script", 10*time.Millisecond, block); err == nil {
+		t.Errorf("runWithTimeout() succeeded for a script timeout, want error")
+	}
+
+	phaseCtx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := runWithTimeout(phaseCtx, "startup", "startup-script", 0, block); err == nil {
+		t.Errorf("runWithTimeout() succeeded for a phase timeout, want error")
+	}
+
+	ran := false
+	err := runWithTimeout(phaseCtx, "startup", "startup-script-url", 0, func(context.Context) error {
+		ran = true
+		return nil
+	})
+	if err == nil || ran {
+		t.Errorf("runWithTimeout() = %v and ran script: %t after phase timeout, want error and script not run", err, ran)
+	}
+}
+
+func TestRunScriptKilledOnTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test relies on a POSIX shell")
+	}
+
+	// The background process keeps the output open, it must be killed along
+	// with the script.
+	filePath := filepath.Join(t.TempDir(), "startup-script")
+	if err := os.WriteFile(filePath, []byte("sleep 30 &\nsleep 30\n"), 0755); err != nil {
+		t.Fatalf("failed to write test script: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := runScript(ctx, filePath, "startup-script", scriptOptions{}); err == nil {
+		t.Errorf("runScript() succeeded for a timed out script, want error")
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("runScript() returned after %v, want the script to be killed on timeout", elapsed)
+	}
+}
@@ -74,14 +74,14 @@ func RunWithResponse[T any](ctx context.Context, policy Policy, f func() (T, err
 		}
 
 		if err != nil && !isRetriable(policy, err) {
-			return res, fmt.Errorf("giving up, retry policy returned false on error: %+v", err)
+			return res, fmt.Errorf("giving up, retry policy returned false on error: %w", err)
 		}
 
 		logger.Debugf("Attempt %d failed with error %+v", attempt, err)
 
 		// Return early, no need to wait if all retries have exhausted.
 		if attempt+1 >= policy.MaxAttempts {
-			return res, fmt.Errorf("exhausted all (%d) retries, last error: %+v", policy.MaxAttempts, err)
+			return res, fmt.Errorf("exhausted all (%d) retries, last error: %w", policy.MaxAttempts, err)
 		}
 
 		select {
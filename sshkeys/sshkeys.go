@@ -0,0 +1,162 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sshkeys parses, validates and deduplicates the SSH keys of the
+// ssh-keys metadata attributes, in the "user:key comment" format.
+package sshkeys
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+// Entry is a valid metadata SSH key.
+type Entry struct {
+	// Line is the 1-based position of the entry in the parsed lines.
+	Line int
+	// User is the user the key grants access to.
+	User string
+	// Key is the authorized key as found in metadata, without the user.
+	Key string
+	// Canonical identifies the key material whatever its options and
+	// comment, i.e. "ssh-ed25519 AAAA...".
+	Canonical string
+	// ExpireOn is the expiration time of google-ssh keys, zero for the keys
+	// that never expire.
+	ExpireOn time.Time
+}
+
+// expiresAfter reports whether e expires after other, keys that never expire
+// expire after all the others.
+func (e Entry) expiresAfter(other Entry) bool {
+	if e.ExpireOn.IsZero() {
+		return !other.ExpireOn.IsZero()
+	}
+	return !other.ExpireOn.IsZero() && e.ExpireOn.After(other.ExpireOn)
+}
+
+// LineError reports an invalid metadata SSH key line.
+type LineError struct {
+	// Line is the 1-based position of the line in the parsed lines.
+	Line int
+	// Text is the invalid line.
+	Text string
+	// Err is the reason the line is invalid, expired keys wrap
+	// utils.ErrExpiredKey.
+	Err error
+}
+
+// Error returns the error message with the line's position.
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+// Unwrap returns the reason the line is invalid.
+func (e *LineError) Unwrap() error {
+	return e.Err
+}
+
+// Result is the outcome of parsing metadata SSH key lines.
+type Result struct {
+	// Entries are the valid keys in order of appearance, without duplicates.
+	Entries []Entry
+	// Duplicates are the valid keys dropped as they grant the same user the
+	// same key material as one of Entries.
+	Duplicates []Entry
+	// Errors are the invalid lines, blank lines are ignored.
+	Errors []*LineError
+}
+
+// UserKeys returns the keys of Entries by user.
+func (r *Result) UserKeys() map[string][]string {
+	res := make(map[string][]string)
+	for _, entry := range r.Entries {
+		res[entry.User] = append(res[entry.User], entry.Key)
+	}
+	return res
+}
+
+// Canonical returns the key type and base64 encoded key material of an
+// authorized key, dropping its options and comment.
+func Canonical(key string) (string, error) {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.TrimSpace(key)))
+	if err != nil {
+		return "", err
+	}
+	return pub.Type() + " " + base64.StdEncoding.EncodeToString(pub.Marshal()), nil
+}
+
+// ParseLine parses and validates a "user:key comment" line. Expired keys
+// return an error wrapping utils.ErrExpiredKey.
+func ParseLine(line string) (Entry, error) {
+	user, key, err := utils.GetUserKey(line)
+	if err != nil {
+		return Entry{}, err
+	}
+	if err := utils.ValidateUserKey(user, key); err != nil {
+		return Entry{}, err
+	}
+	canonical, err := Canonical(key)
+	if err != nil {
+		return Entry{}, err
+	}
+	expireOn, _, err := utils.KeyExpiration(key)
+	if err != nil {
+		return Entry{}, err
+	}
+	return Entry{User: user, Key: key, Canonical: canonical, ExpireOn: expireOn}, nil
+}
+
+// Parse parses the lines of the ssh-keys metadata attributes. Equivalent
+// entries, granting the same user the same key material, are deduplicated
+// keeping the one expiring last in place of the first one.
+func Parse(lines []string) *Result {
+	res := &Result{}
+	seen := make(map[string]int)
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		entry, err := ParseLine(line)
+		if err != nil {
+			res.Errors = append(res.Errors, &LineError{Line: i + 1, Text: line, Err: err})
+			continue
+		}
+		entry.Line = i + 1
+
+		id := entry.User + ":" + entry.Canonical
+		idx, ok := seen[id]
+		if !ok {
+			seen[id] = len(res.Entries)
+			res.Entries = append(res.Entries, entry)
+			continue
+		}
+		if kept := res.Entries[idx]; entry.expiresAfter(kept) {
+			res.Entries[idx], entry = entry, kept
+		}
+		res.Duplicates = append(res.Duplicates, entry)
+	}
+	return res
+}
+
+// ParseString parses the newline separated value of an ssh-keys metadata
+// attribute.
+func ParseString(value string) *Result {
+	return Parse(strings.Split(value, "\n"))
+}
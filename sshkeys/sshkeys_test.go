@@ -0,0 +1,134 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sshkeys
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/utils"
+)
+
+func TestCanonical(t *testing.T) {
+	key := "ssh-rsa " + utils.MakeRandRSAPubKey(t)
+	want, err := Canonical(key)
+	if err != nil {
+		t.Fatalf("Canonical(%q) failed unexpectedly with error: %v", key, err)
+	}
+
+	for _, variant := range []string{
+		key + " alice@host",
+		`no-pty,command="/bin/true" ` + key,
+		"  " + key + "  ",
+	} {
+		got, err := Canonical(variant)
+		if err != nil {
+			t.Fatalf("Canonical(%q) failed unexpectedly with error: %v", variant, err)
+		}
+		if got != want {
+			t.Errorf("Canonical(%q) = %q, want %q", variant, got, want)
+		}
+	}
+
+	if _, err := Canonical("ssh-rsa notakey"); err == nil {
+		t.Errorf("Canonical(ssh-rsa notakey) succeeded, want error")
+	}
+}
+
+func TestParse(t *testing.T) {
+	key1 := "ssh-rsa " + utils.MakeRandRSAPubKey(t)
+	key2 := "ssh-rsa " + utils.MakeRandRSAPubKey(t)
+	soon := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	later := time.Now().Add(48 * time.Hour).UTC().Format(time.RFC3339)
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	googleSSH := func(key, expireOn string) string {
+		return key + ` google-ssh {"userName":"alice@example.com","expireOn":"` + expireOn + `"}`
+	}
+
+	lines := []string{
+		"alice:" + googleSSH(key1, soon),
+		"",
+		"bob:" + key1,
+		"alice:" + googleSSH(key1, later),
+		"alice:" + key1 + " another comment",
+		"malformed",
+		"carol:ssh-rsa notakey",
+		"dave:" + googleSSH(key2, past),
+		"alice:" + key2,
+	}
+
+	res := Parse(lines)
+
+	type entry struct {
+		line int
+		user string
+		key  string
+	}
+	var got []entry
+	for _, e := range res.Entries {
+		got = append(got, entry{e.Line, e.User, e.Key})
+	}
+	want := []entry{
+		// The non-expiring duplicate of line 5 replaces the first key.
+		{5, "alice", key1 + " another comment"},
+		{3, "bob", key1},
+		{9, "alice", key2},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Parse() returned entries %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Parse() entry %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	var dupLines []int
+	for _, d := range res.Duplicates {
+		dupLines = append(dupLines, d.Line)
+	}
+	if len(dupLines) != 2 || dupLines[0] != 1 || dupLines[1] != 4 {
+		t.Errorf("Parse() returned duplicates at lines %v, want [1 4]", dupLines)
+	}
+
+	var errLines []int
+	for _, e := range res.Errors {
+		errLines = append(errLines, e.Line)
+		if !strings.HasPrefix(e.Error(), "line ") {
+			t.Errorf("LineError.Error() = %q, want the line position", e.Error())
+		}
+	}
+	if len(errLines) != 3 || errLines[0] != 6 || errLines[1] != 7 || errLines[2] != 8 {
+		t.Errorf("Parse() returned errors at lines %v, want [6 7 8]", errLines)
+	}
+	if len(res.Errors) == 3 && !errors.Is(res.Errors[2], utils.ErrExpiredKey) {
+		t.Errorf("Parse() error %v for an expired key, want utils.ErrExpiredKey", res.Errors[2])
+	}
+
+	userKeys := res.UserKeys()
+	if len(userKeys["alice"]) != 2 || len(userKeys["bob"]) != 1 {
+		t.Errorf("Result.UserKeys() = %v, want 2 keys for alice and 1 for bob", userKeys)
+	}
+}
+
+func TestParseString(t *testing.T) {
+	key := "sk-ssh-ed25519@openssh.com " + utils.MakeRandSKEd25519PubKey(t)
+	res := ParseString("alice:" + key + "\n\nalice:" + key + "\n")
+	if len(res.Entries) != 1 || len(res.Duplicates) != 1 || len(res.Errors) != 0 {
+		t.Errorf("ParseString() = %+v, want 1 entry and 1 duplicate", res)
+	}
+}
@@ -17,8 +17,10 @@
 package utils
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"regexp"
 	"strings"
 	"time"
@@ -26,6 +28,9 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
+// ErrExpiredKey is returned for the keys whose expiration time is past.
+var ErrExpiredKey = errors.New("invalid ssh key entry - expired key")
+
 type sshExpiration struct {
 	ExpireOn string
 	UserName string
@@ -34,50 +39,71 @@ type sshExpiration struct {
 // CheckExpiredKey validates whether a key has expired.
 // Keys with invalid expiration formats will result in an error.
 func CheckExpiredKey(key string) error {
+	expireOn, expiring, err := KeyExpiration(key)
+	if err != nil {
+		return err
+	}
+	if expiring && expireOn.Before(time.Now()) {
+		return ErrExpiredKey
+	}
+	return nil
+}
+
+// KeyExpiration returns the expiration time of a key and true for google-ssh
+// keys, false for non-expiring keys. Keys with invalid expiration formats will
+// result in an error.
+func KeyExpiration(key string) (time.Time, bool, error) {
 	trimmedKey := strings.Trim(key, " ")
 	if trimmedKey == "" {
-		return errors.New("invalid ssh key entry - empty key")
+		return time.Time{}, false, errors.New("invalid ssh key entry - empty key")
 	}
 	_, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(trimmedKey))
 	if err != nil {
-		return err
+		return time.Time{}, false, err
 	}
 	if !strings.HasPrefix(comment, "google-ssh") {
 		// Non-expiring key.
-		return nil
+		return time.Time{}, false, nil
 	}
 	fields := strings.SplitN(comment, " ", 2)
 	if len(fields) < 2 {
 		// expiring key without expiration format.
-		return errors.New("invalid ssh key entry - expiration missing")
+		return time.Time{}, false, errors.New("invalid ssh key entry - expiration missing")
 	}
 	lkey := &sshExpiration{}
 	if err := json.Unmarshal([]byte(fields[1]), lkey); err != nil {
 		// invalid expiration format.
-		return err
+		return time.Time{}, false, err
 	}
-	expired, err := CheckExpired(lkey.ExpireOn)
+	expireOn, err := ParseExpireOn(lkey.ExpireOn)
 	if err != nil {
-		return err
+		return time.Time{}, false, err
 	}
-	if expired {
-		return errors.New("invalid ssh key entry - expired key")
-	}
-	return nil
+	return expireOn, true, nil
 }
 
 // CheckExpired takes a time string and determines if it represents a time in the past.
 func CheckExpired(expireOn string) (bool, error) {
+	t, err := ParseExpireOn(expireOn)
+	if err != nil {
+		return true, err
+	}
+	return t.Before(time.Now()), nil
+
+}
+
+// ParseExpireOn parses an expireOn time string, either in RFC3339 or with a
+// numeric zone without colon.
+func ParseExpireOn(expireOn string) (time.Time, error) {
 	t, err := time.Parse(time.RFC3339, expireOn)
 	if err != nil {
 		t2, err2 := time.Parse("2006-01-02T15:04:05-0700", expireOn)
 		if err2 != nil {
-			return true, err //Return RFC3339 error
+			return time.Time{}, err //Return RFC3339 error
 		}
 		t = t2
 	}
-	return t.Before(time.Now()), nil
-
+	return t, nil
 }
 
 // ValidateUser checks for the presence of a characters which should not be
@@ -119,12 +145,45 @@ func GetUserKey(rawKey string) (string, string, error) {
 	return user, key[idx+1:], nil
 }
 
+// ValidateKey checks that key is a well formed authorized key whose declared
+// type matches the type of the encoded key, as sshd rejects mismatching keys.
+// It applies to all key types, including the FIDO security keys
+// (sk-ssh-ed25519@openssh.com and sk-ecdsa-sha2-nistp256@openssh.com).
+func ValidateKey(key string) error {
+	trimmedKey := strings.Trim(key, " ")
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(trimmedKey))
+	if err != nil {
+		return fmt.Errorf("invalid ssh key entry - %v", err)
+	}
+
+	// The encoded key follows its declared type, possibly after options.
+	fields := strings.Fields(trimmedKey)
+	for i := 1; i < len(fields); i++ {
+		blob, err := base64.StdEncoding.DecodeString(fields[i])
+		if err != nil {
+			continue
+		}
+		if _, err := ssh.ParsePublicKey(blob); err != nil {
+			continue
+		}
+		if fields[i-1] != pub.Type() {
+			return fmt.Errorf("invalid ssh key entry - declared type %q doesn't match the %q key", fields[i-1], pub.Type())
+		}
+		return nil
+	}
+	return nil
+}
+
 // ValidateUserKey takes an user and a key received from GetUserKey() and
-// validate the user for special characters and the key for expiration
+// validate the user for special characters and the key for format and
+// expiration
 func ValidateUserKey(user, key string) error {
 	if err := ValidateUser(user); err != nil {
 		return err
 	}
+	if err := ValidateKey(key); err != nil {
+		return err
+	}
 	if err := CheckExpiredKey(key); err != nil {
 		return err
 	}
@@ -17,6 +17,7 @@ package utils
 import (
 	"fmt"
 	"testing"
+	"time"
 )
 
 func TestGetUserKey(t *testing.T) {
@@ -50,6 +51,7 @@ func TestGetUserKey(t *testing.T) {
 
 func TestValidateUserKey(t *testing.T) {
 	pubKey := MakeRandRSAPubKey(t)
+	skKey := MakeRandSKEd25519PubKey(t)
 
 	table := []struct {
 		user   string
@@ -68,6 +70,11 @@ func TestValidateUserKey(t *testing.T) {
 		{"usera", fmt.Sprintf(`restrict,pty ssh-rsa %s google-ssh {"userName":"usera@example.com","expireOn":"2095-04-23T12:34:56+0000"}`, pubKey), false},
 		{"    ", "", true},
 		{"userb", "", true},
+		{"usera", fmt.Sprintf(`sk-ssh-ed25519@openssh.com %s google-ssh {"userName":"usera@example.com","expireOn":"2095-04-23T12:34:56+0000"}`, skKey), false},
+		{"usera", fmt.Sprintf(`no-touch-required sk-ssh-ed25519@openssh.com %s usera`, skKey), false},
+		{"usera", fmt.Sprintf(`ssh-ed25519 %s usera`, skKey), true},
+		{"usera", fmt.Sprintf(`sk-ecdsa-sha2-nistp256@openssh.com %s usera`, pubKey), true},
+		{"usera", "sk-ssh-ed25519@openssh.com AAAAGnNrLXNzaC1lZDI1NTE5QG9wZW5zc2guY29t usera", true},
 	}
 
 	for _, tt := range table {
@@ -126,3 +133,31 @@ func TestValidateUser(t *testing.T) {
 		}
 	}
 }
+
+func TestKeyExpiration(t *testing.T) {
+	pubKey := MakeRandRSAPubKey(t)
+
+	table := []struct {
+		key      string
+		want     time.Time
+		expiring bool
+		wantErr  bool
+	}{
+		{fmt.Sprintf(`ssh-rsa %s google-ssh {"userName":"usera@example.com","expireOn":"2095-04-23T12:34:56+0000"}`, pubKey), time.Date(2095, 4, 23, 12, 34, 56, 0, time.UTC), true, false},
+		{fmt.Sprintf(`ssh-rsa %s google-ssh {"userName":"usera@example.com","expireOn":"2095-04-23T12:34:56Z"}`, pubKey), time.Date(2095, 4, 23, 12, 34, 56, 0, time.UTC), true, false},
+		{fmt.Sprintf(`ssh-rsa %s google-ssh {"userName":"usera@example.com","expireOn":"Apri 4, 2056"}`, pubKey), time.Time{}, false, true},
+		{fmt.Sprintf(`ssh-rsa %s google-ssh`, pubKey), time.Time{}, false, true},
+		{fmt.Sprintf("ssh-rsa %s usera", pubKey), time.Time{}, false, false},
+		{"    ", time.Time{}, false, true},
+	}
+
+	for _, tt := range table {
+		got, expiring, err := KeyExpiration(tt.key)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("KeyExpiration(%s) returned error: %v, want error: %t", tt.key, err, tt.wantErr)
+		}
+		if !got.Equal(tt.want) || expiring != tt.expiring {
+			t.Errorf("KeyExpiration(%s) = %v, %t, want %v, %t", tt.key, got, expiring, tt.want, tt.expiring)
+		}
+	}
+}
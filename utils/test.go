@@ -15,6 +15,7 @@
 package utils
 
 import (
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/base64"
@@ -36,3 +37,19 @@ func MakeRandRSAPubKey(t *testing.T) string {
 	}
 	return base64.StdEncoding.EncodeToString(sshPublic.Marshal())
 }
+
+// MakeRandSKEd25519PubKey generates base64 encoded FIDO security key ed25519
+// public key (sk-ssh-ed25519@openssh.com) for use in tests.
+func MakeRandSKEd25519PubKey(t *testing.T) string {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating ed25519 key: %v", err)
+	}
+	wire := struct {
+		Name        string
+		KeyBytes    []byte
+		Application string
+	}{ssh.KeyAlgoSKED25519, pub, "ssh:"}
+	return base64.StdEncoding.EncodeToString(ssh.Marshal(&wire))
+}